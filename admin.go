@@ -0,0 +1,497 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminControlTimeout is the time to wait for a plugin to accept a control
+// command sent by the admin interface.
+const adminControlTimeout = time.Second
+
+// adminServer provides a web based interface showing the current state of
+// the multiplexer. Plugins can be paused, resumed and rolled from it. The
+// same endpoints form a control API that can be used instead of signals.
+// Actions require the configured token. If no token is configured, the
+// interface has to be bound to a loopback address or a unix domain socket and
+// actions are only accepted from loopback clients for requests addressed to
+// localhost or to the host the interface is bound to. The latter prevents DNS
+// rebinding attacks.
+type adminServer struct {
+	plex   *multiplexer
+	listen net.Listener
+	server *http.Server
+	token  string
+	hosts  map[string]bool
+}
+
+type adminPluginStatus struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Streams  []string `json:"streams"`
+	Stats    bool     `json:"stats"`
+	Messages int64    `json:"messages"`
+	Queued   int      `json:"queued"`
+	Capacity int      `json:"capacity"`
+	Paused   bool     `json:"paused"`
+}
+
+type adminStreamStatus struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Consumers []string `json:"consumers"`
+	Producers []string `json:"producers"`
+}
+
+type adminStatus struct {
+	Consumers []adminPluginStatus `json:"consumers"`
+	Streams   []adminStreamStatus `json:"streams"`
+	Producers []adminPluginStatus `json:"producers"`
+	Metrics   json.RawMessage     `json:"metrics"`
+}
+
+// startAdminServer starts the admin interface on the given address.
+// Addresses starting with "unix://" are opened as unix domain sockets.
+// Pass an empty token to accept actions from local clients without
+// authorization. This is only allowed for loopback addresses and unix domain
+// sockets.
+func startAdminServer(plex *multiplexer, address string, token string) (*adminServer, error) {
+	address, protocol := shared.ParseAddress(address)
+	if protocol != "unix" && token == "" {
+		if host, _, err := net.SplitHostPort(address); err != nil || !isLoopbackHost(host) {
+			return nil, fmt.Errorf("An admin token is required to listen on %s, use a loopback address or set --admintoken", address) // ### return, unprotected ###
+		}
+	}
+	if protocol == "unix" {
+		if err := shared.RemoveStaleSocket(address); err != nil {
+			Log.Warning.Print("Admin could not remove stale socket: ", err)
+		}
+	}
+
+	listen, err := shared.ListenSocket(protocol, address)
+	if err != nil {
+		return nil, err // ### return, could not listen ###
+	}
+
+	admin := &adminServer{
+		plex:   plex,
+		listen: listen,
+		token:  token,
+	}
+
+	// Browsers cannot connect to unix domain sockets, so the host is only
+	// checked for network addresses.
+	if protocol != "unix" {
+		admin.hosts = map[string]bool{"localhost": true}
+		if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+			admin.hosts[strings.ToLower(host)] = true
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", admin.handleIndex)
+	mux.HandleFunc("/status", admin.handleStatus)
+	mux.HandleFunc("/plugins", admin.handlePlugins)
+	mux.HandleFunc("/plugins/", admin.handlePlugin)
+	mux.HandleFunc("/pause", admin.handleAll)
+	mux.HandleFunc("/resume", admin.handleAll)
+	mux.HandleFunc("/roll", admin.handleAll)
+	mux.HandleFunc("/rotate", admin.handleAll)
+	mux.HandleFunc("/reload", admin.handleReload)
+	admin.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := admin.server.Serve(listen); err != nil && err != http.ErrServerClosed {
+			Log.Error.Print("Admin: ", err)
+		}
+	}()
+
+	Log.Note.Print("Admin interface listening on ", listen.Addr())
+	return admin, nil
+}
+
+// stop closes the admin interface.
+func (admin *adminServer) stop() {
+	if err := admin.server.Close(); err != nil {
+		Log.Error.Print("Admin: ", err)
+	}
+}
+
+// adminPluginID returns the identifier used by the admin interface for the
+// consumer or producer at the given index.
+func adminPluginID(kind string, idx int) string {
+	return fmt.Sprintf("%s-%d", kind, idx)
+}
+
+func newAdminPluginStatus(id string, plugin interface{}, streamIDs []core.MessageStreamID) adminPluginStatus {
+	status := adminPluginStatus{
+		ID:      id,
+		Type:    pluginName(plugin),
+		Streams: make([]string, 0, len(streamIDs)),
+	}
+
+	for _, streamID := range streamIDs {
+		status.Streams = append(status.Streams, core.StreamTypes.GetStreamName(streamID))
+	}
+
+	if reporter, hasStats := plugin.(core.StatsReporter); hasStats {
+		stats := reporter.Stats()
+		status.Stats = true
+		status.Messages = stats.Messages
+		status.Queued = stats.Queued
+		status.Capacity = stats.Capacity
+		status.Paused = stats.Paused
+	}
+	return status
+}
+
+// status collects the current topology, plugin state and metrics.
+func (admin *adminServer) status() adminStatus {
+	status := adminStatus{
+		Consumers: []adminPluginStatus{},
+		Streams:   []adminStreamStatus{},
+		Producers: []adminPluginStatus{},
+	}
+
+	streams := make(map[core.MessageStreamID]*adminStreamStatus)
+	getStream := func(streamID core.MessageStreamID) *adminStreamStatus {
+		stream, exists := streams[streamID]
+		if !exists {
+			stream = &adminStreamStatus{
+				Name:      core.StreamTypes.GetStreamName(streamID),
+				Consumers: []string{},
+				Producers: []string{},
+			}
+			if plugin := core.StreamTypes.GetStream(streamID); plugin != nil {
+				stream.Type = pluginName(plugin)
+			}
+			streams[streamID] = stream
+		}
+		return stream
+	}
+
+	// The first consumer is the internal log consumer
+	for idx, cons := range admin.plex.consumers[1:] {
+		id := adminPluginID("consumer", idx+1)
+		status.Consumers = append(status.Consumers, newAdminPluginStatus(id, cons, cons.Streams()))
+		for _, streamID := range cons.Streams() {
+			stream := getStream(streamID)
+			stream.Consumers = append(stream.Consumers, id)
+		}
+	}
+
+	wildcard := []string{}
+	for idx, prod := range admin.plex.producers {
+		id := adminPluginID("producer", idx)
+		status.Producers = append(status.Producers, newAdminPluginStatus(id, prod, prod.Streams()))
+		for _, streamID := range prod.Streams() {
+			if streamID == core.WildcardStreamID {
+				wildcard = append(wildcard, id)
+				continue // ### continue, added to all streams ###
+			}
+			stream := getStream(streamID)
+			stream.Producers = append(stream.Producers, id)
+		}
+	}
+
+	for streamID, stream := range streams {
+		if !isInternalStream(streamID) {
+			stream.Producers = append(stream.Producers, wildcard...)
+		}
+		status.Streams = append(status.Streams, *stream)
+	}
+	sort.Slice(status.Streams, func(i, j int) bool {
+		return status.Streams[i].Name < status.Streams[j].Name
+	})
+
+	if metrics, err := shared.Metric.Dump(); err == nil {
+		status.Metrics = metrics
+	} else {
+		status.Metrics = json.RawMessage("{}")
+	}
+	return status
+}
+
+// adminPlugin references a consumer or producer managed by the admin
+// interface.
+type adminPlugin struct {
+	id      string
+	plugin  interface{}
+	control chan<- core.PluginControl
+	streams []core.MessageStreamID
+}
+
+// plugins returns all consumers and producers except for the internal log
+// consumer.
+func (admin *adminServer) plugins() []adminPlugin {
+	plugins := make([]adminPlugin, 0, len(admin.plex.consumers)+len(admin.plex.producers))
+	for idx, cons := range admin.plex.consumers[1:] {
+		plugins = append(plugins, adminPlugin{adminPluginID("consumer", idx+1), cons, cons.Control(), cons.Streams()})
+	}
+	for idx, prod := range admin.plex.producers {
+		plugins = append(plugins, adminPlugin{adminPluginID("producer", idx), prod, prod.Control(), prod.Streams()})
+	}
+	return plugins
+}
+
+// getPlugin returns the plugin with the given id.
+func (admin *adminServer) getPlugin(id string) (adminPlugin, bool) {
+	for _, plugin := range admin.plugins() {
+		if plugin.id == id {
+			return plugin, true // ### return, found ###
+		}
+	}
+	return adminPlugin{}, false
+}
+
+// send passes a control command to the given plugin. An error is returned if
+// the plugin does not accept the command within adminControlTimeout.
+func (admin *adminServer) send(plugin adminPlugin, command core.PluginControl) error {
+	select {
+	case plugin.control <- command:
+		return nil
+	case <-time.After(adminControlTimeout):
+		return fmt.Errorf("%s (%s) did not accept the command", plugin.id, pluginName(plugin.plugin))
+	}
+}
+
+// parseAdminAction converts the name of an action to a control command.
+// "rotate" is an alias for "roll".
+func parseAdminAction(action string) (core.PluginControl, bool) {
+	switch action {
+	case "pause":
+		return core.PluginControlPause, true
+	case "resume":
+		return core.PluginControlResume, true
+	case "roll", "rotate":
+		return core.PluginControlRoll, true
+	default:
+		return 0, false
+	}
+}
+
+// isSameOrigin returns false for requests sent by a page that has not been
+// served by the admin interface. This prevents other websites from
+// triggering actions through the browser of a user.
+func isSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true // ### return, not sent by a browser ###
+	}
+	originURL, err := url.Parse(origin)
+	return err == nil && originURL.Host == req.Host
+}
+
+// isLoopbackHost returns true for "localhost" and loopback addresses.
+func isLoopbackHost(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "localhost" {
+		return true // ### return, localhost ###
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLocalRequest returns true if the request has been sent by a loopback
+// client to localhost, a loopback address or the host the admin interface is
+// bound to. The Host header is set by the client, so the remote address is
+// checked, too.
+func (admin *adminServer) isLocalRequest(req *http.Request) bool {
+	if admin.hosts == nil {
+		return true // ### return, unix domain socket ###
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !isLoopbackHost(client) {
+		return false // ### return, remote client ###
+	}
+
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	return isLoopbackHost(host) || admin.hosts[strings.ToLower(host)]
+}
+
+// isAuthorized returns true if the request carries the configured token as
+// bearer token.
+func (admin *adminServer) isAuthorized(req *http.Request) bool {
+	expected := []byte("Bearer " + admin.token)
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) == 1
+}
+
+func writeAdminJSON(resp http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return // ### return, encoding error ###
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// checkAction returns false and writes an error if the request is not a
+// POST request sent by a client allowed to trigger actions.
+func (admin *adminServer) checkAction(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "POST" {
+		resp.Header().Set("Allow", "POST")
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return false // ### return, not a POST ###
+	}
+	if admin.token != "" {
+		if !admin.isAuthorized(req) {
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="gollum"`)
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return false // ### return, invalid token ###
+		}
+	} else if !admin.isLocalRequest(req) {
+		http.Error(resp, "Only local requests are allowed, configure an admin token to allow remote actions", http.StatusForbidden)
+		return false // ### return, not local ###
+	}
+	if !isSameOrigin(req) {
+		http.Error(resp, "Cross origin requests are not allowed", http.StatusForbidden)
+		return false // ### return, cross origin ###
+	}
+	return true
+}
+
+func (admin *adminServer) handleIndex(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(resp, req)
+		return // ### return, unknown page ###
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Write([]byte(adminPage))
+}
+
+func (admin *adminServer) handleStatus(resp http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(resp, admin.status())
+}
+
+// handlePlugins returns the state of all plugins.
+func (admin *adminServer) handlePlugins(resp http.ResponseWriter, req *http.Request) {
+	plugins := admin.plugins()
+	states := make([]adminPluginStatus, 0, len(plugins))
+	for _, plugin := range plugins {
+		states = append(states, newAdminPluginStatus(plugin.id, plugin.plugin, plugin.streams))
+	}
+	writeAdminJSON(resp, states)
+}
+
+// handlePlugin returns the state of a plugin for GET requests to
+// /plugins/<id> and executes an action for POST requests to
+// /plugins/<id>/<action> where action is one of pause, resume, roll or rotate.
+func (admin *adminServer) handlePlugin(resp http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/plugins/"), "/")
+	if len(parts) > 2 {
+		http.NotFound(resp, req)
+		return // ### return, malformed path ###
+	}
+
+	plugin, exists := admin.getPlugin(parts[0])
+	if !exists {
+		http.Error(resp, "Unknown plugin "+parts[0], http.StatusNotFound)
+		return // ### return, unknown plugin ###
+	}
+
+	if len(parts) == 1 {
+		writeAdminJSON(resp, newAdminPluginStatus(plugin.id, plugin.plugin, plugin.streams))
+		return // ### return, state requested ###
+	}
+
+	if !admin.checkAction(resp, req) {
+		return // ### return, invalid request ###
+	}
+
+	command, valid := parseAdminAction(parts[1])
+	if !valid {
+		http.Error(resp, "Unknown action "+parts[1], http.StatusBadRequest)
+		return // ### return, unknown action ###
+	}
+
+	if err := admin.send(plugin, command); err != nil {
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		return // ### return, plugin is busy ###
+	}
+	Log.Note.Printf("Admin: %s %s (%s)", parts[1], plugin.id, pluginName(plugin.plugin))
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// handleAll executes the action given by the path for all plugins. Rolling
+// all plugins is equivalent to sending SIGHUP.
+func (admin *adminServer) handleAll(resp http.ResponseWriter, req *http.Request) {
+	if !admin.checkAction(resp, req) {
+		return // ### return, invalid request ###
+	}
+
+	action := strings.TrimPrefix(req.URL.Path, "/")
+	command, _ := parseAdminAction(action)
+
+	if command == core.PluginControlRoll {
+		select {
+		case admin.plex.commands <- signalRoll:
+		case <-time.After(adminControlTimeout):
+			http.Error(resp, "Gollum is busy", http.StatusServiceUnavailable)
+			return // ### return, main loop is busy ###
+		}
+	} else {
+		failed := []string{}
+		for _, plugin := range admin.plugins() {
+			if err := admin.send(plugin, command); err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+		if len(failed) > 0 {
+			http.Error(resp, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+			return // ### return, some plugins are busy ###
+		}
+	}
+
+	Log.Note.Printf("Admin: %s all plugins", action)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// handleReload tests the configuration and starts a new gollum process with
+// the same command line, equivalent to sending SIGUSR2. The reload is
+// refused if the configuration test fails.
+func (admin *adminServer) handleReload(resp http.ResponseWriter, req *http.Request) {
+	if !admin.checkAction(resp, req) {
+		return // ### return, invalid request ###
+	}
+
+	if err := testUpgradeConfig(); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, invalid configuration ###
+	}
+
+	select {
+	case admin.plex.commands <- signalUpgrade:
+		Log.Note.Print("Admin: reload")
+		resp.WriteHeader(http.StatusAccepted)
+	case <-time.After(adminControlTimeout):
+		http.Error(resp, "Gollum is busy", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminLocalActions(t *testing.T) {
+	expect := shared.NewExpect(t)
+	admin := &adminServer{hosts: map[string]bool{"localhost": true, "127.0.0.1": true}}
+
+	// The Host header is set by the client and must not grant access
+	req := httptest.NewRequest("POST", "http://localhost/roll", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	resp := httptest.NewRecorder()
+	expect.False(admin.checkAction(resp, req))
+	expect.Equal(http.StatusForbidden, resp.Code)
+
+	req = httptest.NewRequest("POST", "http://localhost/roll", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	expect.True(admin.checkAction(httptest.NewRecorder(), req))
+
+	req = httptest.NewRequest("POST", "http://[::1]:8080/roll", nil)
+	req.RemoteAddr = "[::1]:1234"
+	expect.True(admin.checkAction(httptest.NewRecorder(), req))
+
+	// Loopback clients are still subject to the host check
+	req = httptest.NewRequest("POST", "http://attacker.example/roll", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	expect.False(admin.checkAction(httptest.NewRecorder(), req))
+}
+
+func TestAdminTokenRequired(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	_, err := startAdminServer(nil, "0.0.0.0:0", "")
+	expect.NotNil(err)
+	_, err = startAdminServer(nil, ":0", "")
+	expect.NotNil(err)
+
+	admin, err := startAdminServer(nil, "127.0.0.1:0", "")
+	expect.NoError(err)
+	if admin != nil {
+		admin.stop()
+	}
+
+	admin, err = startAdminServer(nil, "0.0.0.0:0", "secret")
+	expect.NoError(err)
+	if admin != nil {
+		admin.stop()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// adminPage is the single page application served by the admin interface.
+// It polls /status and renders the topology, plugin state and metrics.
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gollum</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 24px; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+td.num { text-align: right; font-family: monospace; }
+.paused { color: #b00; font-weight: bold; }
+.bar { width: 120px; height: 10px; background: #eee; display: inline-block; }
+.fill { height: 10px; background: #4a4; }
+.fill.high { background: #c44; }
+.topology li { font-family: monospace; margin: 2px 0; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Gollum</h1>
+<p>
+<button data-path="pause">Pause all</button>
+<button data-path="resume">Resume all</button>
+<button data-path="roll">Roll all</button>
+<button data-path="reload">Reload</button>
+</p>
+<div id="error"></div>
+
+<h2>Topology</h2>
+<ul class="topology" id="topology"></ul>
+
+<h2>Consumers</h2>
+<table>
+<thead><tr><th>ID</th><th>Type</th><th>Streams</th><th>Messages</th><th>State</th><th></th></tr></thead>
+<tbody id="consumers"></tbody>
+</table>
+
+<h2>Streams</h2>
+<table>
+<thead><tr><th>Name</th><th>Type</th><th>Consumers</th><th>Producers</th></tr></thead>
+<tbody id="streams"></tbody>
+</table>
+
+<h2>Producers</h2>
+<table>
+<thead><tr><th>ID</th><th>Type</th><th>Streams</th><th>Messages</th><th>Channel</th><th>State</th><th></th></tr></thead>
+<tbody id="producers"></tbody>
+</table>
+
+<h2>Metrics</h2>
+<table>
+<thead><tr><th>Name</th><th>Value</th></tr></thead>
+<tbody id="metrics"></tbody>
+</table>
+
+<script>
+function escape(text) {
+	return String(text).replace(/[&<>"']/g, function (c) {
+		return "&#" + c.charCodeAt(0) + ";";
+	});
+}
+
+function buttons(plugin) {
+	var html = "";
+	if (plugin.stats) {
+		html += plugin.paused ?
+			'<button data-id="' + escape(plugin.id) + '" data-action="resume">Resume</button> ' :
+			'<button data-id="' + escape(plugin.id) + '" data-action="pause">Pause</button> ';
+	}
+	return html + '<button data-id="' + escape(plugin.id) + '" data-action="roll">Roll</button>';
+}
+
+function state(plugin) {
+	if (!plugin.stats) {
+		return "-";
+	}
+	return plugin.paused ? '<span class="paused">paused</span>' : "running";
+}
+
+function fill(plugin) {
+	if (!plugin.stats || plugin.capacity == 0) {
+		return "-";
+	}
+	var percent = Math.round(100 * plugin.queued / plugin.capacity);
+	return '<span class="bar"><div class="fill' + (percent >= 90 ? " high" : "") + '" style="width:' + percent + '%"></div></span> ' +
+		plugin.queued + " / " + plugin.capacity;
+}
+
+function render(status) {
+	var names = {}, html = "";
+	status.consumers.concat(status.producers).forEach(function (plugin) {
+		names[plugin.id] = plugin.type + " (" + plugin.id + ")";
+	});
+
+	status.streams.forEach(function (stream) {
+		var consumers = stream.consumers.map(function (id) { return names[id]; }).join(", ") || "-";
+		var producers = stream.producers.map(function (id) { return names[id]; }).join(", ") || "-";
+		html += "<li>" + escape(consumers) + " &rarr; <b>" + escape(stream.name) + "</b> &rarr; " + escape(producers) + "</li>";
+	});
+	document.getElementById("topology").innerHTML = html;
+
+	html = "";
+	status.consumers.forEach(function (cons) {
+		html += "<tr><td>" + escape(cons.id) + "</td><td>" + escape(cons.type) + "</td><td>" + escape(cons.streams.join(", ")) +
+			'</td><td class="num">' + (cons.stats ? cons.messages : "-") + "</td><td>" + state(cons) + "</td><td>" + buttons(cons) + "</td></tr>";
+	});
+	document.getElementById("consumers").innerHTML = html;
+
+	html = "";
+	status.streams.forEach(function (stream) {
+		html += "<tr><td>" + escape(stream.name) + "</td><td>" + escape(stream.type || "-") + "</td><td>" +
+			escape(stream.consumers.join(", ") || "-") + "</td><td>" + escape(stream.producers.join(", ") || "-") + "</td></tr>";
+	});
+	document.getElementById("streams").innerHTML = html;
+
+	html = "";
+	status.producers.forEach(function (prod) {
+		html += "<tr><td>" + escape(prod.id) + "</td><td>" + escape(prod.type) + "</td><td>" + escape(prod.streams.join(", ")) +
+			'</td><td class="num">' + (prod.stats ? prod.messages : "-") + "</td><td>" + fill(prod) + "</td><td>" + state(prod) +
+			"</td><td>" + buttons(prod) + "</td></tr>";
+	});
+	document.getElementById("producers").innerHTML = html;
+
+	html = "";
+	Object.keys(status.metrics).sort().forEach(function (name) {
+		html += "<tr><td>" + escape(name) + '</td><td class="num">' + escape(status.metrics[name]) + "</td></tr>";
+	});
+	document.getElementById("metrics").innerHTML = html;
+}
+
+function update() {
+	fetch("status").then(function (resp) {
+		if (!resp.ok) {
+			throw new Error(resp.statusText);
+		}
+		return resp.json();
+	}).then(function (status) {
+		document.getElementById("error").textContent = "";
+		render(status);
+	}).catch(function (err) {
+		document.getElementById("error").textContent = "Failed to fetch status: " + err.message;
+	});
+}
+
+function post(path, askToken) {
+	var headers = {};
+	var token = sessionStorage.getItem("token");
+	if (token) {
+		headers["Authorization"] = "Bearer " + token;
+	}
+	return fetch(path, {method: "POST", headers: headers}).then(function (resp) {
+		if (resp.status == 401 && askToken) {
+			token = prompt("Admin token");
+			if (token) {
+				sessionStorage.setItem("token", token);
+				return post(path, false);
+			}
+		}
+		return resp;
+	});
+}
+
+document.addEventListener("click", function (event) {
+	var target = event.target;
+	if (target.tagName != "BUTTON") {
+		return;
+	}
+	var path = target.dataset.path || "plugins/" + target.dataset.id + "/" + target.dataset.action;
+	post(path, true).then(function (resp) {
+		if (!resp.ok) {
+			return resp.text().then(function (text) { throw new Error(text); });
+		}
+		setTimeout(update, 200);
+	}).catch(function (err) {
+		document.getElementById("error").textContent = err.message;
+	});
+});
+
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,141 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"math"
+	"reflect"
+	"runtime"
+	"time"
+)
+
+// benchDefaultSec is the duration of a benchmark started by "gollum bench"
+// if neither a duration nor a message count has been given.
+const benchDefaultSec = 10
+
+// benchProfiler is the type of the consumer generating benchmark messages.
+const benchProfiler = "consumer.Profiler"
+
+// isBenchmark returns true if a benchmark has been requested.
+func isBenchmark() bool {
+	return benchCommand || *flagBenchSec > 0 || *flagBenchCount > 0
+}
+
+// benchDuration returns the maximum runtime of the benchmark. 0 means that
+// the benchmark is only limited by the message count.
+func benchDuration() time.Duration {
+	if *flagBenchSec == 0 && *flagBenchCount == 0 {
+		return benchDefaultSec * time.Second // ### return, default ###
+	}
+	return time.Duration(*flagBenchSec) * time.Second
+}
+
+// prepareBenchmark replaces all consumers of the given config by a profiler
+// consumer sending to all streams the configured producers listen to. If
+// producers only listen to the wildcard stream, the profiler sends to it.
+// A profiler consumer found in the config is kept instead, so that message
+// generation can be configured. If count is greater than 0, the profiler
+// stops after generating count messages.
+func prepareBenchmark(conf *core.Config, count int) error {
+	consumerInterface := reflect.TypeOf((*core.Consumer)(nil)).Elem()
+	producerInterface := reflect.TypeOf((*core.Producer)(nil)).Elem()
+
+	plugins := []core.PluginConfig{}
+	profilerIdx := -1
+	hasProducers := false
+	streams := []string{}
+	knownStreams := make(map[string]bool)
+
+	for _, config := range conf.Plugins {
+		pluginType := shared.RuntimeType.GetTypeOf(config.Typename)
+		switch {
+		case !config.Enable || pluginType == nil:
+			// Errors are reported by the multiplexer
+
+		case pluginType.Implements(consumerInterface):
+			if config.Typename != benchProfiler || profilerIdx >= 0 {
+				continue // ### continue, replaced by profiler ###
+			}
+			profilerIdx = len(plugins)
+
+		case pluginType.Implements(producerInterface):
+			hasProducers = true
+			for _, stream := range config.Stream {
+				if !knownStreams[stream] && !isInternalStream(core.GetStreamID(stream)) {
+					knownStreams[stream] = true
+					streams = append(streams, stream)
+				}
+			}
+		}
+		plugins = append(plugins, config)
+	}
+
+	if profilerIdx < 0 {
+		if !hasProducers {
+			return fmt.Errorf("No producer found")
+		}
+		profiler := core.NewPluginConfig(benchProfiler)
+		if len(streams) == 0 {
+			streams = append(streams, core.WildcardStream)
+		}
+		profiler.Stream = streams
+		profiler.Override("Batches", math.MaxInt32)
+		profilerIdx = len(plugins)
+		plugins = append(plugins, profiler)
+	}
+
+	if count > 0 {
+		plugins[profilerIdx].Override("Runs", count)
+		plugins[profilerIdx].Override("Batches", 1)
+	}
+
+	conf.Plugins = plugins
+	return nil
+}
+
+// runBenchmark runs the given multiplexer and prints throughput, latency,
+// allocations and drops measured during the run. Allocations include the
+// allocations required to generate messages.
+func runBenchmark(plex multiplexer) {
+	plex.benchTime = benchDuration()
+
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	mallocs := memStats.Mallocs
+	start := time.Now()
+
+	plex.run()
+
+	runTime := time.Since(start)
+	runtime.ReadMemStats(&memStats)
+	mallocs = memStats.Mallocs - mallocs
+	stats := core.GetBenchmarkStats()
+
+	allocsPerMsg := 0.0
+	if stats.Processed > 0 {
+		allocsPerMsg = float64(mallocs) / float64(stats.Processed)
+	}
+	latency := func(percent float64) time.Duration {
+		return time.Duration(stats.LatencyUs.Percentile(percent)) * time.Microsecond
+	}
+
+	fmt.Printf("Bench: %d messages processed in %.2f sec = %.0f msg/sec\n", stats.Processed, runTime.Seconds(), float64(stats.Processed)/runTime.Seconds())
+	fmt.Printf("Bench: latency p50 %s, p99 %s, max %s\n", latency(50), latency(99), time.Duration(stats.LatencyUs.Max)*time.Microsecond)
+	fmt.Printf("Bench: %.2f allocations/msg\n", allocsPerMsg)
+	fmt.Printf("Bench: %d messages dropped\n", stats.Dropped)
+}
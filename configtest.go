@@ -0,0 +1,160 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strings"
+)
+
+// pluginName returns the type name of a plugin without pointer prefix.
+func pluginName(plugin interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", plugin), "*")
+}
+
+// isInternalStream returns true for streams that are written by gollum
+// itself.
+func isInternalStream(streamID core.MessageStreamID) bool {
+	switch streamID {
+	case core.LogInternalStreamID, core.HealthInternalStreamID, core.TraceInternalStreamID, core.DroppedStreamID, core.WildcardStreamID:
+		return true
+	default:
+		return false
+	}
+}
+
+// testConfig validates the configuration the multiplexer has been created
+// from and prints a summary of all streams and the plugins attached to them.
+// Stream references that are likely to be wrong are reported as warning as
+// they may still be reached by formatters or streams that change the stream
+// of a message. Returns false if errors have been found.
+func (plex multiplexer) testConfig(conf *core.Config) bool {
+	errors := plex.configErrors
+
+	for _, config := range conf.Plugins {
+		if !config.Enable || shared.RuntimeType.GetTypeOf(config.Typename) == nil {
+			continue // ### continue, disabled or already reported ###
+		}
+		for _, key := range config.GetUnknownKeys() {
+			fmt.Printf("ERROR: Unknown configuration key in %s: %s\n", config.Typename, key)
+			errors++
+		}
+	}
+
+	if len(plex.consumers) <= 1 {
+		fmt.Println("ERROR: No consumers configured.")
+		errors++
+	}
+	if len(plex.producers) == 0 {
+		fmt.Println("ERROR: No producers configured.")
+		errors++
+	}
+
+	// Collect the plugins attached to each stream. The first consumer is the
+	// internal log consumer which is not reported.
+
+	writers := make(map[core.MessageStreamID][]string)
+	readers := make(map[core.MessageStreamID][]string)
+	wildcardReaders := []string{}
+
+	for _, consumer := range plex.consumers[1:] {
+		for _, streamID := range consumer.Streams() {
+			writers[streamID] = append(writers[streamID], pluginName(consumer))
+		}
+	}
+
+	for _, producer := range plex.producers {
+		for _, streamID := range producer.Streams() {
+			if streamID == core.WildcardStreamID {
+				wildcardReaders = append(wildcardReaders, pluginName(producer))
+			} else {
+				readers[streamID] = append(readers[streamID], pluginName(producer))
+			}
+		}
+	}
+
+	streamNames := []string{}
+	streamIDs := make(map[string]core.MessageStreamID)
+	addStream := func(streamID core.MessageStreamID) {
+		if streamID == core.WildcardStreamID {
+			return // ### return, not a real stream ###
+		}
+		name := core.StreamTypes.GetStreamName(streamID)
+		if _, known := streamIDs[name]; !known {
+			streamIDs[name] = streamID
+			streamNames = append(streamNames, name)
+		}
+	}
+
+	core.StreamTypes.ForEachStream(func(streamID core.MessageStreamID, stream core.Stream) {
+		addStream(streamID)
+	})
+	for streamID := range writers {
+		addStream(streamID)
+	}
+	sort.Strings(streamNames)
+
+	// Print the topology and check references
+
+	warnings := []string{}
+	fmt.Println("Streams:")
+
+	for _, name := range streamNames {
+		streamID := streamIDs[name]
+		streamType := "default"
+		if stream := core.StreamTypes.GetStream(streamID); stream != nil {
+			if _, isDefault := stream.(*core.StreamBase); !isDefault {
+				streamType = pluginName(stream)
+			}
+		}
+
+		producers := readers[streamID]
+		if !isInternalStream(streamID) {
+			producers = append(producers, wildcardReaders...)
+		}
+
+		fmt.Printf("  %s (%s)\n", name, streamType)
+		if len(writers[streamID]) > 0 {
+			fmt.Printf("    consumers: %s\n", strings.Join(writers[streamID], ", "))
+		}
+		if len(producers) > 0 {
+			fmt.Printf("    producers: %s\n", strings.Join(producers, ", "))
+		}
+
+		switch {
+		case isInternalStream(streamID):
+			// Written by gollum itself
+		case len(writers[streamID]) == 0 && len(readers[streamID]) > 0:
+			warnings = append(warnings, fmt.Sprintf("No consumer writes to stream %s used by %s", name, strings.Join(readers[streamID], ", ")))
+		case len(writers[streamID]) > 0 && len(producers) == 0:
+			warnings = append(warnings, fmt.Sprintf("No producer reads from stream %s written by %s", name, strings.Join(writers[streamID], ", ")))
+		}
+	}
+
+	for _, warning := range warnings {
+		fmt.Println("WARNING:", warning)
+	}
+
+	if errors > 0 {
+		fmt.Printf("Config: %d error(s) found.\n", errors)
+		return false
+	}
+
+	fmt.Println("Config: parsed as ok.")
+	return true
+}
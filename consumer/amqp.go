@@ -0,0 +1,421 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AMQPMetadataExchange is the metadata key storing the exchange a message
+	// received by the AMQP consumer was published to.
+	AMQPMetadataExchange = "amqp_exchange"
+
+	// AMQPMetadataRoutingKey is the metadata key storing the routing key of a
+	// message received by the AMQP consumer.
+	AMQPMetadataRoutingKey = "amqp_routing_key"
+)
+
+// AMQP consumer plugin
+// Configuration example
+//
+//   - "consumer.AMQP":
+//     Enable: true
+//     Address: "localhost:5672"
+//     Username: "guest"
+//     Password: "guest"
+//     VHost: "/"
+//     HeartbeatSec: 60
+//     TimeoutSec: 5
+//     RetryDelayMs: 1000
+//     Queue: "logs"
+//     ConsumerTag: ""
+//     PrefetchCount: 100
+//     AckTimeoutMs: 1000
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//
+// The AMQP consumer reads messages from a queue of an AMQP 0-9-1 broker like
+// RabbitMQ. The exchange and the routing key of each message are stored in
+// the metadata fields "amqp_exchange" and "amqp_routing_key". Messages are
+// acknowledged manually after they have been passed to all streams of this
+// consumer, so messages not acknowledged before the connection is lost are
+// delivered again by the broker. New messages are not read while a fuse of
+// the streams this consumer writes to is burned (see the FusePolicy stream
+// setting).
+//
+// Address defines the broker to connect to. This can be any ip address and
+// port like "localhost:5672". By default this is set to "localhost:5672".
+//
+// Username and Password define the credentials used for PLAIN
+// authentication. By default both are set to "guest".
+//
+// VHost defines the virtual host to use. By default this is set to "/".
+//
+// HeartbeatSec defines the heartbeat interval requested from the broker.
+// The connection is considered lost if nothing has been received for two
+// intervals. Set to 0 to disable heartbeats. By default this is set to 60.
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established. By default this is set to 5.
+//
+// RetryDelayMs defines the number of milliseconds to wait before connecting
+// again after the connection has been lost. By default this is set to 1000.
+//
+// Queue defines the queue to consume from. The queue has to be declared
+// before it can be used. This setting is mandatory.
+//
+// ConsumerTag defines the consumer tag sent to the broker. By default this is
+// set to "gollum-" followed by the hostname.
+//
+// PrefetchCount defines the maximum number of messages the broker sends
+// before they have been acknowledged. Acknowledgements are sent for every
+// half of this number of messages. Set to 0 to not limit the number of
+// unacknowledged messages. By default this is set to 100.
+//
+// AckTimeoutMs defines the maximum number of milliseconds to wait before
+// acknowledging messages that have been passed to all streams.
+// By default this is set to 1000.
+//
+// TLS can be set to true to connect to the broker via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// broker's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// broker. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the broker's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// broker's certificate. By default this is set to false.
+type AMQP struct {
+	core.ConsumerBase
+	client     *shared.AMQPClient
+	guard      *sync.Mutex
+	options    shared.AMQPOptions
+	address    string
+	protocol   string
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	retryDelay time.Duration
+	ackTimeout time.Duration
+	queue      string
+	tag        string
+	prefetch   int
+	ackEvery   int
+	unacked    int
+	lastTag    uint64
+	sequence   uint64
+	quit       int32
+}
+
+func init() {
+	shared.RuntimeType.Register(AMQP{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *AMQP) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if !conf.HasValue("Queue") {
+		return core.NewConsumerError("No queue configured for consumer.AMQP")
+	}
+	cons.queue = conf.GetString("Queue", "")
+
+	hostname, _ := os.Hostname()
+	cons.tag = conf.GetString("ConsumerTag", "gollum-"+hostname)
+
+	cons.options.Username = conf.GetString("Username", "guest")
+	cons.options.Password = conf.GetString("Password", "guest")
+	cons.options.VHost = conf.GetString("VHost", "/")
+	cons.options.Heartbeat = time.Duration(conf.GetInt("HeartbeatSec", 60)) * time.Second
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:5672"))
+	cons.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	cons.ackTimeout = time.Duration(conf.GetInt("AckTimeoutMs", 1000)) * time.Millisecond
+
+	cons.prefetch = conf.GetInt("PrefetchCount", 100)
+	if cons.prefetch < 0 || cons.prefetch > 65535 {
+		return fmt.Errorf("AMQP: PrefetchCount has to be between 0 and 65535")
+	}
+	cons.ackEvery = cons.prefetch / 2
+	if cons.ackEvery < 1 {
+		cons.ackEvery = 1
+	}
+	if cons.ackTimeout <= 0 {
+		cons.ackTimeout = time.Second
+	}
+
+	if conf.GetBool("TLS", false) {
+		cons.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	cons.guard = new(sync.Mutex)
+	return nil
+}
+
+func (cons *AMQP) isQuitting() bool {
+	return atomic.LoadInt32(&cons.quit) != 0
+}
+
+// connect opens a new connection and starts consuming from the queue.
+func (cons *AMQP) connect() (*shared.AMQPClient, error) {
+	client, err := shared.DialAMQP(cons.protocol, cons.address, cons.tlsConfig, cons.timeout, cons.options)
+	if err != nil {
+		return nil, err
+	}
+
+	qos := shared.NewAMQPWriter(7)
+	qos.WriteLong(0)
+	qos.WriteShort(uint16(cons.prefetch))
+	qos.WriteBits(false)
+
+	consume := shared.NewAMQPWriter(len(cons.queue) + len(cons.tag) + 10)
+	consume.WriteShort(0)
+	consume.WriteShortstr(cons.queue)
+	consume.WriteShortstr(cons.tag)
+	consume.WriteBits(false, false, false, false)
+	consume.WriteTable(nil)
+
+	client.SetReadDeadline(time.Now().Add(cons.timeout))
+	err = client.Call(shared.AMQPClassBasic, shared.AMQPBasicQos, qos.Bytes(), shared.AMQPBasicQosOk)
+	if err == nil {
+		err = client.Call(shared.AMQPClassBasic, shared.AMQPBasicConsume, consume.Bytes(), shared.AMQPBasicConsumeOk)
+	}
+	client.SetReadDeadline(time.Time{})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	cons.client = client
+	cons.unacked = 0
+
+	if cons.isQuitting() {
+		client.Close()
+		return nil, fmt.Errorf("AMQP: shutting down")
+	}
+	return client, nil
+}
+
+func (cons *AMQP) disconnect(client *shared.AMQPClient) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.client == client {
+		cons.client = nil
+	}
+	client.Close()
+}
+
+// ack acknowledges all messages that have been passed to the streams. The
+// guard has to be locked when calling this function.
+func (cons *AMQP) ack() error {
+	if cons.client == nil || cons.unacked == 0 {
+		return nil // ### return, nothing to acknowledge ###
+	}
+
+	args := shared.NewAMQPWriter(9)
+	args.WriteLonglong(cons.lastTag)
+	args.WriteBits(true)
+	cons.unacked = 0
+	return cons.client.WriteChannelMethod(shared.AMQPClassBasic, shared.AMQPBasicAck, args.Bytes())
+}
+
+// readBody reads the content header and all body frames of a delivered
+// message.
+func (cons *AMQP) readBody(client *shared.AMQPClient) ([]byte, error) {
+	frame, err := client.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	size, err := shared.DecodeAMQPContentHeader(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 0, size)
+	for uint64(len(body)) < size {
+		if frame, err = client.ReadFrame(); err != nil {
+			return nil, err
+		}
+		if frame.Type != shared.AMQPFrameBody {
+			return nil, fmt.Errorf("AMQP: expected content body, got frame type %d", frame.Type)
+		}
+		body = append(body, frame.Payload...)
+	}
+	return body, nil
+}
+
+// deliver reads a delivered message and passes it to all streams.
+func (cons *AMQP) deliver(client *shared.AMQPClient, args *shared.AMQPReader) error {
+	args.ReadShortstr()
+	deliveryTag, _ := args.ReadLonglong()
+	args.ReadOctet()
+	exchange, _ := args.ReadShortstr()
+	routingKey, err := args.ReadShortstr()
+	if err != nil {
+		return err
+	}
+
+	body, err := cons.readBody(client)
+	if err != nil {
+		return err
+	}
+
+	msg := core.NewMessage(cons, body, atomic.AddUint64(&cons.sequence, 1))
+	msg.Metadata = core.MessageMetadata{
+		AMQPMetadataExchange:   exchange,
+		AMQPMetadataRoutingKey: routingKey,
+	}
+	cons.EnqueueMessage(msg)
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	cons.lastTag = deliveryTag
+	if cons.unacked++; cons.unacked >= cons.ackEvery {
+		return cons.ack()
+	}
+	return nil
+}
+
+// handle processes a single frame sent by the broker.
+func (cons *AMQP) handle(client *shared.AMQPClient, frame shared.AMQPFrame) error {
+	if frame.Type != shared.AMQPFrameMethod {
+		return nil // ### return, heartbeat ###
+	}
+
+	classID, methodID, args, err := shared.DecodeAMQPMethod(frame)
+	if err != nil {
+		return err
+	}
+	if err := client.CheckClose(classID, methodID, args); err != nil {
+		return err
+	}
+
+	switch {
+	case classID == shared.AMQPClassBasic && methodID == shared.AMQPBasicDeliver:
+		return cons.deliver(client, args)
+	case classID == shared.AMQPClassBasic && methodID == shared.AMQPBasicCancel:
+		return fmt.Errorf("AMQP: consumer has been cancelled by the broker")
+	}
+	return nil
+}
+
+// read connects to the broker and processes messages until the consumer is
+// stopped.
+func (cons *AMQP) read() {
+	defer cons.WorkerDone()
+
+	for !cons.isQuitting() {
+		client, err := cons.connect()
+		if err != nil {
+			if !cons.isQuitting() {
+				Log.Error.Print("AMQP connection error - ", err)
+				time.Sleep(cons.retryDelay)
+			}
+			continue // ### continue, try again ###
+		}
+
+		for {
+			cons.WaitOnFuse()
+			if heartbeat := client.HeartbeatInterval(); heartbeat > 0 {
+				client.SetReadDeadline(time.Now().Add(2 * heartbeat))
+			}
+
+			frame, err := client.ReadFrame()
+			if err == nil {
+				err = cons.handle(client, frame)
+			}
+			if err != nil {
+				if !cons.isQuitting() {
+					Log.Error.Print("AMQP error - ", err)
+					time.Sleep(cons.retryDelay)
+				}
+				cons.disconnect(client)
+				break // ### break, reconnect ###
+			}
+		}
+	}
+}
+
+// tick sends pending acknowledgements and heartbeats.
+func (cons *AMQP) tick() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if cons.client == nil {
+		return // ### return, not connected ###
+	}
+
+	err := cons.ack()
+	if err == nil {
+		err = cons.client.Heartbeat()
+	}
+	if err != nil {
+		Log.Error.Print("AMQP write error - ", err)
+	}
+}
+
+// Consume connects to the broker and starts reading.
+func (cons *AMQP) Consume(workers *sync.WaitGroup) {
+	atomic.StoreInt32(&cons.quit, 0)
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		cons.read()
+	}()
+
+	defer func() {
+		atomic.StoreInt32(&cons.quit, 1)
+		cons.guard.Lock()
+		if cons.client != nil {
+			cons.ack()
+			cons.client.Close()
+		}
+		cons.guard.Unlock()
+	}()
+
+	cons.TickerControlLoop(cons.ackTimeout, nil, cons.tick)
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"strings"
+)
+
+// tlsCommonName returns the common name of a verified client certificate or
+// an empty string if the client did not present one.
+func tlsCommonName(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	commonName, _ := shared.GetTLSPeerIdentity(*state)
+	return commonName
+}
+
+// httpCredentials reads the credentials of a HTTP request. The authorization
+// header can contain a bearer token ("Bearer <token>"), basic authentication
+// or an HMAC signature of the body ("HMAC <key>:<signature>"). Signatures are
+// only read if body is not nil.
+func httpCredentials(req *http.Request, body []byte) core.AuthCredentials {
+	creds := core.AuthCredentials{
+		CommonName: tlsCommonName(req.TLS),
+	}
+
+	auth := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		creds.Token = strings.TrimPrefix(auth, "Bearer ")
+
+	case strings.HasPrefix(auth, "HMAC ") && body != nil:
+		signature := strings.SplitN(strings.TrimPrefix(auth, "HMAC "), ":", 2)
+		if len(signature) == 2 {
+			creds.KeyID, creds.Signature, creds.Payload = signature[0], signature[1], body
+		}
+
+	default:
+		creds.User, creds.Password, _ = req.BasicAuth()
+	}
+	return creds
+}
@@ -15,11 +15,13 @@
 package consumer
 
 import (
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"io"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -27,23 +29,58 @@ const (
 	consoleBufferGrowSize = 256
 )
 
+var consoleStream = ""
+
+// SetConsoleStream sets the stream all console consumers write to, replacing
+// the configured streams. This is used to set the stream from the command
+// line. Passing an empty string uses the configured streams.
+func SetConsoleStream(stream string) {
+	consoleStream = stream
+}
+
 // Console consumer plugin
 // Configuration example
 //
 //   - "consumer.Console":
 //     Enable: true
-//	   ExitOnEOF: true
+//     Framing: "newline"
+//     ExitOnEOF: true
+//     ExitOnPipeClose: true
+//
+// This consumer reads from stdin. By default a message is generated after each
+// newline character.
 //
-// This consumer reads from stdin. A message is generated after each newline
-// character.
+// Framing defines how messages are separated. By default this is set to
+// "newline".
+//  - "newline" generates a message after each newline character.
+//  - "null" generates a message after each null byte, e.g. for the output of
+//    "find -print0".
+//  - "length" reads messages prefixed by a 32 bit big endian length.
+//  - "varint" reads messages prefixed by an unsigned varint length, i.e. length
+//    delimited protocol buffers.
 //
-// ExitOnEOF can be set to true to trigger an exit signal if StdIn is closed
-// (e.g. when a pipe is closed). This is set to false by default.
+// ExitOnEOF can be set to true to trigger an exit signal if the end of stdin
+// is reached, i.e. a file redirected to stdin has been read or Ctrl+D has been
+// pressed on a terminal. If this is set to false, reading from a terminal
+// continues after Ctrl+D. This is set to false by default.
 //
-// This consumer does not define any options beside the standard ones.
+// ExitOnPipeClose can be set to true to trigger an exit signal if stdin is a
+// pipe or socket that has been closed by the writing process. By default this
+// is set to the value of ExitOnEOF.
+//
+// If stdin cannot deliver any more data and no exit signal is triggered, the
+// consumer stops reading but gollum keeps running.
+//
+// The stream of all console consumers can be set by the "-cs" command line
+// flag, overriding the configured streams.
 type Console struct {
 	core.ConsumerBase
-	autoexit bool
+	flags         shared.BufferedReaderFlags
+	delimiter     string
+	exitOnEOF     bool
+	exitOnClose   bool
+	isPipe        bool
+	isInteractive bool
 }
 
 func init() {
@@ -52,26 +89,74 @@ func init() {
 
 // Configure initializes this consumer with values from a plugin config.
 func (cons *Console) Configure(conf core.PluginConfig) error {
-	cons.autoexit = conf.GetBool("ExitOnEOF", false)
+	cons.exitOnEOF = conf.GetBool("ExitOnEOF", false)
+	cons.exitOnClose = conf.GetBool("ExitOnPipeClose", cons.exitOnEOF)
+
+	cons.flags = 0
+	cons.delimiter = ""
+	framing := strings.ToLower(conf.GetString("Framing", "newline"))
+	switch framing {
+	case "newline":
+		cons.delimiter = "\n"
+	case "null":
+		cons.delimiter = "\x00"
+	case "length":
+		cons.flags = shared.BufferedReaderFlagMLE32 | shared.BufferedReaderFlagBigEndian
+	case "varint":
+		cons.flags = shared.BufferedReaderFlagMLEVarint
+	default:
+		return fmt.Errorf("Unknown framing: %s", framing)
+	}
+
+	if stat, err := os.Stdin.Stat(); err == nil {
+		mode := stat.Mode()
+		cons.isPipe = mode&(os.ModeNamedPipe|os.ModeSocket) != 0
+		cons.isInteractive = mode&os.ModeCharDevice != 0
+	}
+
+	if consoleStream != "" {
+		conf.Stream = []string{consoleStream}
+	}
 	return cons.ConsumerBase.Configure(conf)
 }
 
+// exit triggers an exit signal for this process.
+func (cons *Console) exit() {
+	proc, _ := os.FindProcess(os.Getpid())
+	proc.Signal(os.Interrupt)
+}
+
 func (cons *Console) readStdIn() {
-	buffer := shared.NewBufferedReader(consoleBufferGrowSize, 0, 0, "\n")
+	buffer := shared.NewBufferedReader(consoleBufferGrowSize, cons.flags, 0, cons.delimiter)
 
 	for {
 		err := buffer.ReadAll(os.Stdin, cons.Enqueue)
 		switch err {
 		case io.EOF:
-			if cons.autoexit {
-				proc, _ := os.FindProcess(os.Getpid())
-				proc.Signal(os.Interrupt)
+			switch {
+			case cons.isPipe:
+				Log.Note.Print("Console: stdin pipe has been closed")
+				if cons.exitOnClose {
+					cons.exit()
+				}
+				return // ### return, no more data ###
+
+			case cons.isInteractive && !cons.exitOnEOF:
+				// Ctrl+D on a terminal, keep reading
+
+			default:
+				Log.Note.Print("Console: end of stdin reached")
+				if cons.exitOnEOF {
+					cons.exit()
+				}
+				return // ### return, no more data ###
 			}
 
 		case nil:
 			// ignore
 		default:
 			Log.Error.Print("Error reading stdin: ", err)
+			return // ### return, stdin not readable ###
 		}
 	}
 }
@@ -0,0 +1,617 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dockerOffsetNewest = "newest"
+	dockerOffsetOldest = "oldest"
+	dockerMaxFrameSize = 1 << 24
+)
+
+// Docker consumer plugin
+// Configuration example
+//
+//   - "consumer.Docker":
+//     Enable: true
+//     Endpoint: "unix:///var/run/docker.sock"
+//     APIVersion: ""
+//     DefaultOffset: "Newest"
+//     Stdout: true
+//     Stderr: true
+//     LabelPrefix: "label_"
+//     ContainerSelector: ""
+//     StreamSelectors:
+//       "nginx": "app=nginx,env!=dev"
+//     RetryDelayMs: 5000
+//     Stream: "docker"
+//
+// The Docker consumer reads the stdout and stderr output of containers by
+// using the Docker Engine API. Containers are discovered when the consumer
+// starts and whenever a container is started. Each line is sent as a separate
+// message using the timestamp recorded by Docker. The metadata fields
+// "container_id", "container_name", "container_image" and "log_stream"
+// (stdout or stderr) are attached to each message, as well as all container
+// labels (see LabelPrefix). Labels set by Kubernetes (e.g.
+// "io.kubernetes.pod.name") are attached in the same way.
+// Reading is resumed at the last received line if the connection to Docker is
+// lost. Lines are not read while a fuse of the streams this consumer writes to
+// is burned (see the FusePolicy stream setting).
+// Containers managed by containerd without Docker are not supported.
+//
+// Endpoint defines the address of the Docker Engine API. Valid schemes are
+// "unix", "tcp", "http" and "https". By default this is set to
+// "unix:///var/run/docker.sock".
+//
+// APIVersion defines the API version to request, e.g. "1.41". By default this
+// is set to "", i.e. the version of the daemon is used.
+//
+// DefaultOffset defines where to start reading the containers running when
+// this consumer starts. Valid values are "Oldest" and "Newest". Containers
+// started later are always read from the beginning.
+// By default this is set to "Newest".
+//
+// Stdout can be set to false to not read the stdout output.
+// By default this is set to true.
+//
+// Stderr can be set to false to not read the stderr output.
+// By default this is set to true.
+//
+// LabelPrefix defines the prefix added to the name of container labels when
+// storing them as metadata. By default this is set to "label_".
+//
+// ContainerSelector defines a label selector containers have to match to be
+// read. A selector is a comma separated list of requirements which all have to
+// be met. Valid requirements are "key=value", "key!=value", "key" (label
+// exists) and "!key" (label does not exist). By default this is set to "",
+// i.e. all containers are read.
+//
+// StreamSelectors maps stream names to label selectors. Messages of a
+// container are sent to all streams whose selector matches the container.
+// Messages of containers matching none of these selectors are sent to the
+// streams configured by Stream. By default no selectors are set.
+//
+// RetryDelayMs defines the number of milliseconds to wait before reconnecting
+// to Docker after an error. By default this is set to 5000.
+type Docker struct {
+	core.ConsumerBase
+	client      *http.Client
+	baseURL     string
+	offset      string
+	stdout      bool
+	stderr      bool
+	labelPrefix string
+	selector    dockerSelector
+	selectors   map[core.MessageStreamID]dockerSelector
+	retryDelay  time.Duration
+	containers  map[string]bool
+	resume      map[string]time.Time
+	guard       *sync.Mutex
+	sequence    *uint64
+	context     context.Context
+	cancel      context.CancelFunc
+}
+
+// dockerRequirement is a single requirement of a label selector
+type dockerRequirement struct {
+	key    string
+	value  string
+	negate bool
+	exists bool
+}
+
+type dockerSelector []dockerRequirement
+
+type dockerContainer struct {
+	id       string
+	tty      bool
+	streams  []core.MessageStreamID
+	metadata [3]core.MessageMetadata
+}
+
+// dockerInspect contains the fields of the container inspect response used by
+// this consumer.
+type dockerInspect struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Tty    bool              `json:"Tty"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+}
+
+type dockerEvent struct {
+	ID     string `json:"id"`
+	Action string `json:"Action"`
+	Status string `json:"status"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+func init() {
+	shared.RuntimeType.Register(Docker{})
+}
+
+// parseDockerSelector parses a comma separated list of label requirements.
+func parseDockerSelector(selector string) (dockerSelector, error) {
+	requirements := dockerSelector{}
+	for _, requirement := range strings.Split(selector, ",") {
+		requirement = strings.TrimSpace(requirement)
+		switch {
+		case requirement == "":
+			continue // ### continue, empty ###
+
+		case strings.Contains(requirement, "!="):
+			parts := strings.SplitN(requirement, "!=", 2)
+			requirements = append(requirements, dockerRequirement{key: strings.TrimSpace(parts[0]), value: strings.TrimSpace(parts[1]), negate: true})
+
+		case strings.Contains(requirement, "="):
+			parts := strings.SplitN(requirement, "=", 2)
+			requirements = append(requirements, dockerRequirement{key: strings.TrimSpace(parts[0]), value: strings.TrimSpace(parts[1])})
+
+		case requirement[0] == '!':
+			requirements = append(requirements, dockerRequirement{key: strings.TrimSpace(requirement[1:]), exists: true, negate: true})
+
+		default:
+			requirements = append(requirements, dockerRequirement{key: requirement, exists: true})
+		}
+
+		if requirements[len(requirements)-1].key == "" {
+			return nil, fmt.Errorf("Docker: empty label in selector \"%s\"", selector)
+		}
+	}
+	return requirements, nil
+}
+
+// matches returns true if the given labels meet all requirements.
+func (selector dockerSelector) matches(labels map[string]string) bool {
+	for _, requirement := range selector {
+		value, exists := labels[requirement.key]
+		met := exists
+		if !requirement.exists {
+			met = exists && value == requirement.value
+		}
+		if met == requirement.negate {
+			return false // ### return, requirement not met ###
+		}
+	}
+	return true
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Docker) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(conf.GetString("Endpoint", "unix:///var/run/docker.sock"))
+	if err != nil {
+		return err
+	}
+
+	transport := &http.Transport{}
+	switch endpoint.Scheme {
+	case "unix":
+		socket := endpoint.Path
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		cons.baseURL = "http://docker"
+	case "tcp", "http":
+		cons.baseURL = "http://" + endpoint.Host
+	case "https":
+		cons.baseURL = "https://" + endpoint.Host
+	default:
+		return fmt.Errorf("Docker: unsupported endpoint scheme \"%s\"", endpoint.Scheme)
+	}
+	cons.client = &http.Client{Transport: transport}
+
+	if version := strings.TrimPrefix(conf.GetString("APIVersion", ""), "v"); version != "" {
+		cons.baseURL += "/v" + version
+	}
+
+	cons.offset = strings.ToLower(conf.GetString("DefaultOffset", dockerOffsetNewest))
+	if cons.offset != dockerOffsetNewest && cons.offset != dockerOffsetOldest {
+		return fmt.Errorf("Docker: unknown DefaultOffset \"%s\"", cons.offset)
+	}
+
+	cons.stdout = conf.GetBool("Stdout", true)
+	cons.stderr = conf.GetBool("Stderr", true)
+	cons.labelPrefix = conf.GetString("LabelPrefix", "label_")
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 5000)) * time.Millisecond
+
+	if cons.selector, err = parseDockerSelector(conf.GetString("ContainerSelector", "")); err != nil {
+		return err
+	}
+
+	cons.selectors = make(map[core.MessageStreamID]dockerSelector)
+	for stream, selector := range conf.GetStringMap("StreamSelectors", map[string]string{}) {
+		if cons.selectors[core.GetStreamID(stream)], err = parseDockerSelector(selector); err != nil {
+			return err
+		}
+	}
+
+	cons.containers = make(map[string]bool)
+	cons.resume = make(map[string]time.Time)
+	cons.guard = new(sync.Mutex)
+	cons.sequence = new(uint64)
+	cons.context, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// get sends a GET request to the Docker API. The response body has to be
+// closed by the caller.
+func (cons *Docker) get(path string, query url.Values) (*http.Response, error) {
+	requestURL := cons.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(cons.context, "GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cons.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s: %s", path, resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+func (cons *Docker) getJSON(path string, query url.Values, value interface{}) error {
+	resp, err := cons.get(path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func (cons *Docker) inspect(id string) (dockerInspect, error) {
+	info := dockerInspect{}
+	err := cons.getJSON("/containers/"+url.PathEscape(id)+"/json", nil, &info)
+	return info, err
+}
+
+func (cons *Docker) isStopped() bool {
+	return cons.context.Err() != nil
+}
+
+// newContainer creates the metadata and stream mapping of a container.
+func (cons *Docker) newContainer(info dockerInspect) *dockerContainer {
+	container := &dockerContainer{
+		id:  info.ID,
+		tty: info.Config.Tty,
+	}
+
+	streamIDs := make([]core.MessageStreamID, 0, len(cons.selectors))
+	for streamID, selector := range cons.selectors {
+		if selector.matches(info.Config.Labels) {
+			streamIDs = append(streamIDs, streamID)
+		}
+	}
+	sort.Slice(streamIDs, func(i, j int) bool { return streamIDs[i] < streamIDs[j] })
+	container.streams = streamIDs
+
+	for _, logStream := range []int{1, 2} {
+		metadata := core.MessageMetadata{
+			"container_id":    info.ID,
+			"container_name":  strings.TrimPrefix(info.Name, "/"),
+			"container_image": info.Config.Image,
+			"log_stream":      "stdout",
+		}
+		if logStream == 2 {
+			metadata["log_stream"] = "stderr"
+		}
+		for key, value := range info.Config.Labels {
+			metadata[cons.labelPrefix+key] = value
+		}
+		container.metadata[logStream] = metadata
+	}
+	return container
+}
+
+// follow starts reading the given container if it is not read already.
+func (cons *Docker) follow(id string, fromStart bool) {
+	info, err := cons.inspect(id)
+	switch {
+	case err != nil:
+		if !cons.isStopped() {
+			Log.Error.Print("Docker: ", err)
+		}
+		return // ### return, unknown container ###
+	case !info.State.Running || !cons.selector.matches(info.Config.Labels):
+		return // ### return, not running or not selected ###
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.containers[info.ID] {
+		return // ### return, already read ###
+	}
+
+	cons.containers[info.ID] = true
+	if _, resumed := cons.resume[info.ID]; !resumed {
+		if fromStart {
+			cons.resume[info.ID] = time.Time{}
+		} else {
+			cons.resume[info.ID] = time.Now()
+		}
+	}
+
+	cons.AddWorker()
+	go cons.readContainer(cons.newContainer(info))
+}
+
+// readContainer reads the logs of a container until the container stops.
+func (cons *Docker) readContainer(container *dockerContainer) {
+	defer cons.WorkerDone()
+	defer func() {
+		cons.guard.Lock()
+		delete(cons.containers, container.id)
+		cons.guard.Unlock()
+	}()
+
+	for !cons.isStopped() {
+		err := cons.readLogs(container)
+		if cons.isStopped() {
+			return // ### return, stopped ###
+		}
+
+		// The log stream ends if the container stops
+		if info, inspectErr := cons.inspect(container.id); inspectErr == nil && !info.State.Running {
+			cons.guard.Lock()
+			delete(cons.resume, container.id)
+			cons.guard.Unlock()
+			return // ### return, container stopped ###
+		}
+
+		if err != nil {
+			Log.Warning.Printf("Docker: reading %s failed: %s", container.id, err)
+		}
+		select {
+		case <-cons.context.Done():
+		case <-time.After(cons.retryDelay):
+		}
+	}
+}
+
+func (cons *Docker) readLogs(container *dockerContainer) error {
+	query := url.Values{
+		"follow":     {"1"},
+		"timestamps": {"1"},
+		"stdout":     {fmt.Sprint(cons.stdout)},
+		"stderr":     {fmt.Sprint(cons.stderr)},
+	}
+
+	cons.guard.Lock()
+	since := cons.resume[container.id]
+	cons.guard.Unlock()
+
+	if !since.IsZero() {
+		since = since.Add(time.Nanosecond)
+		query.Set("since", fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()))
+	}
+
+	resp, err := cons.get("/containers/"+url.PathEscape(container.id)+"/logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if container.tty {
+		return cons.readRawLogs(container, resp.Body)
+	}
+	return cons.readMultiplexedLogs(container, resp.Body)
+}
+
+// readRawLogs reads the logs of containers with a TTY. These are not
+// multiplexed and always written to stdout.
+func (cons *Docker) readRawLogs(container *dockerContainer, body io.Reader) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			cons.enqueueLine(container, 1, line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readMultiplexedLogs reads logs sent as frames with an 8 byte header
+// containing the output stream and the length of the frame. Each frame
+// contains one log entry. Long lines are split into several entries.
+func (cons *Docker) readMultiplexedLogs(container *dockerContainer, body io.Reader) error {
+	header := make([]byte, 8)
+	partial := [3][]byte{}
+
+	for {
+		if _, err := io.ReadFull(body, header); err != nil {
+			return err
+		}
+
+		logStream := int(header[0])
+		size := binary.BigEndian.Uint32(header[4:])
+		if size > dockerMaxFrameSize {
+			return fmt.Errorf("frame of %d bytes is too large", size)
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(body, frame); err != nil {
+			return err
+		}
+		if size == 0 || (logStream != 1 && logStream != 2) {
+			continue // ### continue, empty, stdin or system error ###
+		}
+
+		// Continued entries have their own timestamp which is used to resume
+		var continued time.Time
+		if len(partial[logStream]) > 0 {
+			if idx := bytes.IndexByte(frame, ' '); idx >= 0 {
+				continued, _ = time.Parse(time.RFC3339Nano, string(frame[:idx]))
+				frame = frame[idx+1:]
+			}
+			frame = append(partial[logStream], frame...)
+			partial[logStream] = nil
+		}
+
+		if frame[len(frame)-1] != '\n' && len(frame) < dockerMaxFrameSize {
+			partial[logStream] = frame
+			continue // ### continue, partial line ###
+		}
+
+		cons.enqueueLine(container, logStream, frame)
+		if !continued.IsZero() {
+			cons.guard.Lock()
+			cons.resume[container.id] = continued
+			cons.guard.Unlock()
+		}
+	}
+}
+
+// enqueueLine converts a line prefixed by a timestamp into a message.
+func (cons *Docker) enqueueLine(container *dockerContainer, logStream int, line []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	timestamp := time.Now()
+
+	if idx := bytes.IndexByte(line, ' '); idx > 0 {
+		if parsed, err := time.Parse(time.RFC3339Nano, string(line[:idx])); err == nil {
+			timestamp = parsed
+			line = line[idx+1:]
+		}
+	}
+
+	cons.WaitOnFuse()
+
+	msg := core.NewMessage(cons, line, atomic.AddUint64(cons.sequence, 1)-1)
+	msg.Timestamp = timestamp
+	msg.Metadata = container.metadata[logStream]
+
+	if len(container.streams) == 0 {
+		cons.EnqueueMessage(msg)
+	} else {
+		for _, streamID := range container.streams {
+			cons.EnqueueMessageTo(msg, streamID)
+		}
+	}
+
+	cons.guard.Lock()
+	cons.resume[container.id] = timestamp
+	cons.guard.Unlock()
+}
+
+// watch discovers running containers and containers being started. The
+// connection to Docker is reestablished after errors.
+func (cons *Docker) watch() {
+	defer cons.WorkerDone()
+	fromStart := cons.offset == dockerOffsetOldest
+
+	for !cons.isStopped() {
+		if err := cons.watchEvents(fromStart); err != nil && !cons.isStopped() {
+			Log.Error.Print("Docker: ", err)
+		}
+		fromStart = true
+
+		select {
+		case <-cons.context.Done():
+		case <-time.After(cons.retryDelay):
+		}
+	}
+}
+
+func (cons *Docker) watchEvents(fromStart bool) error {
+	// Subscribe to events before listing containers so that no container
+	// start is missed
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start"},
+	})
+	resp, err := cons.get("/events", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	running := []struct {
+		ID string `json:"Id"`
+	}{}
+	if err := cons.getJSON("/containers/json", nil, &running); err != nil {
+		return err
+	}
+	for _, container := range running {
+		cons.follow(container.ID, fromStart)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := dockerEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+
+		id := event.Actor.ID
+		if id == "" {
+			id = event.ID
+		}
+		if id != "" && (event.Action == "start" || event.Status == "start") {
+			cons.follow(id, true)
+		}
+	}
+}
+
+// Consume starts reading the logs of all selected containers.
+func (cons *Docker) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go cons.watch()
+	defer cons.cancel()
+
+	cons.DefaultControlLoop(nil)
+}
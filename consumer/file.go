@@ -29,6 +29,10 @@ import (
 	"time"
 )
 
+// FileMetadataPath is the metadata key storing the path of the file a message
+// has been read from.
+const FileMetadataPath = "file_path"
+
 const (
 	fileBufferGrowSize = 1024
 	fileOffsetStart    = "oldest"
@@ -57,6 +61,9 @@ const (
 // that marks the end of a message. If the file is part of e.g. a log rotation
 // the file consumer can set to a symbolic link of the latest file and be told
 // to reopen the file by sending a SIGHUP.
+// Reading is paused while a fuse of the streams this consumer writes to is
+// burned (see the FusePolicy stream setting).
+// The configured path of the file is stored in the metadata field "file_path".
 //
 // File is a mandatory setting and contains the file to read. The file will be
 // read from beginning to end and the reader will stay attached until the
@@ -85,6 +92,7 @@ type File struct {
 	seek           int
 	seekOffset     int64
 	state          fileState
+	metadata       core.MessageMetadata
 }
 
 func init() {
@@ -106,6 +114,7 @@ func (cons *File) Configure(conf core.PluginConfig) error {
 	cons.fileName = conf.GetString("File", "")
 	cons.offsetFileName = conf.GetString("OffsetFile", "")
 	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
+	cons.metadata = core.MessageMetadata{FileMetadataPath: cons.fileName}
 
 	switch strings.ToLower(conf.GetString("DefaultOffset", fileOffsetEnd)) {
 	default:
@@ -122,9 +131,15 @@ func (cons *File) Configure(conf core.PluginConfig) error {
 	return nil
 }
 
+func (cons *File) enqueue(data []byte, sequence uint64) {
+	msg := core.NewMessage(cons, data, sequence)
+	msg.Metadata = cons.metadata
+	cons.EnqueueMessage(msg)
+}
+
 func (cons *File) enqueueAndPersist(data []byte, sequence uint64) {
 	cons.seekOffset, _ = cons.file.Seek(0, 1)
-	cons.Enqueue(data, sequence)
+	cons.enqueue(data, sequence)
 	ioutil.WriteFile(cons.offsetFileName, []byte(strconv.FormatInt(cons.seekOffset, 10)), 0644)
 }
 
@@ -174,9 +189,13 @@ func (cons *File) close() {
 func (cons *File) read() {
 	defer cons.close()
 
-	sendFunction := cons.Enqueue
+	enqueue := cons.enqueue
 	if cons.offsetFileName != "" {
-		sendFunction = cons.enqueueAndPersist
+		enqueue = cons.enqueueAndPersist
+	}
+	sendFunction := func(data []byte, sequence uint64) {
+		cons.WaitOnFuse()
+		enqueue(data, sequence)
 	}
 
 	buffer := shared.NewBufferedReader(fileBufferGrowSize, 0, 0, cons.delimiter)
@@ -0,0 +1,529 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fluentd consumer plugin
+// Configuration example
+//
+//   - "consumer.Fluentd":
+//     Enable: true
+//     Address: "0.0.0.0:24224"
+//     Payload: "message"
+//     MessageKey: "message"
+//     SharedKey: ""
+//     Hostname: ""
+//     TimeoutSec: 60
+//     Users:
+//       "agent": "password"
+//     TagStreams:
+//       "app.access": "access"
+//       "app.*": "app"
+//
+// The Fluentd consumer accepts messages sent by Fluentd, Fluent Bit or any
+// other client using the Fluentd forward protocol. The "Message", "Forward",
+// "PackedForward" and "CompressedPackedForward" modes are supported.
+// Acknowledgements are sent if requested by the client.
+// The tag of each message is stored in the metadata field "fluentd_tag".
+// In "message" mode all other record fields holding a string, number or
+// boolean are stored as metadata named "fluentd_<field>". The message
+// timestamp is set to the event time.
+//
+// Address defines the address and port to listen to. This can be any ip
+// address and port like "0.0.0.0:24224" or a file like
+// "unix:///var/gollum_fluentd.socket". By default this is set to
+// "0.0.0.0:24224".
+//
+// Payload defines the data used as message payload. When set to "message" the
+// record field given by MessageKey is used. Records without this field are
+// written as JSON. When set to "json" the whole record is written as JSON.
+// By default this is set to "message".
+//
+// MessageKey defines the record field used as payload in "message" mode.
+// By default this is set to "message". Fluent Bit often uses "log".
+//
+// SharedKey enables the handshake for clients using a security section.
+// By default this is set to "", i.e. no handshake is done.
+//
+// Users maps usernames to passwords. If set, clients have to authenticate
+// during the handshake. This requires SharedKey to be set.
+// By default no users are set.
+//
+// Hostname defines the hostname sent during the handshake. When left empty
+// the hostname of the machine is used. By default this is set to "".
+//
+// TimeoutSec defines the number of seconds after which an idle connection is
+// closed. By default this is set to 60.
+//
+// TagStreams maps Fluentd tags to streams. Tags ending with "*" match all
+// tags starting with the given prefix. The longest matching prefix is used.
+// Messages with a tag that is not mapped are sent to the streams configured
+// by Stream.
+type Fluentd struct {
+	core.ConsumerBase
+	listen      net.Listener
+	protocol    string
+	address     string
+	messageKey  string
+	jsonPayload bool
+	sharedKey   string
+	users       map[string]string
+	hostname    string
+	timeout     time.Duration
+	tags        map[string]core.MessageStreamID
+	prefixes    []string
+	tagCache    map[string]fluentdRoute
+	tagGuard    *sync.RWMutex
+	sequence    *uint64
+	quit        bool
+}
+
+// fluentdPrefixes sorts tag patterns so that the longest pattern comes first.
+type fluentdPrefixes []string
+
+func (prefixes fluentdPrefixes) Len() int           { return len(prefixes) }
+func (prefixes fluentdPrefixes) Less(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) }
+func (prefixes fluentdPrefixes) Swap(i, j int)      { prefixes[i], prefixes[j] = prefixes[j], prefixes[i] }
+
+// fluentdRoute stores the result of a tag lookup.
+type fluentdRoute struct {
+	streamID core.MessageStreamID
+	mapped   bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Fluentd{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Fluentd) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", "0.0.0.0:24224"))
+	if cons.protocol != "unix" {
+		cons.protocol = "tcp"
+	}
+
+	switch payload := strings.ToLower(conf.GetString("Payload", "message")); payload {
+	case "message":
+	case "json":
+		cons.jsonPayload = true
+	default:
+		return fmt.Errorf("Fluentd: unknown payload %s", payload)
+	}
+
+	cons.messageKey = conf.GetString("MessageKey", "message")
+	cons.sharedKey = conf.GetString("SharedKey", "")
+	cons.users = conf.GetStringMap("Users", map[string]string{})
+	if len(cons.users) > 0 && cons.sharedKey == "" {
+		return fmt.Errorf("Fluentd: Users requires SharedKey to be set")
+	}
+
+	cons.hostname = conf.GetString("Hostname", "")
+	if cons.hostname == "" {
+		cons.hostname, _ = os.Hostname()
+	}
+	cons.timeout = time.Duration(conf.GetInt("TimeoutSec", 60)) * time.Second
+
+	cons.tags = make(map[string]core.MessageStreamID)
+	cons.prefixes = []string{}
+	for tag, stream := range conf.GetStringMap("TagStreams", map[string]string{}) {
+		cons.tags[tag] = core.GetStreamID(stream)
+		if strings.HasSuffix(tag, "*") {
+			cons.prefixes = append(cons.prefixes, tag)
+		}
+	}
+	sort.Sort(fluentdPrefixes(cons.prefixes))
+
+	cons.tagCache = make(map[string]fluentdRoute)
+	cons.tagGuard = new(sync.RWMutex)
+	cons.sequence = new(uint64)
+	cons.quit = false
+	return nil
+}
+
+// getRoute returns the stream a given tag is mapped to.
+func (cons *Fluentd) getRoute(tag string) fluentdRoute {
+	cons.tagGuard.RLock()
+	route, cached := cons.tagCache[tag]
+	cons.tagGuard.RUnlock()
+
+	if cached {
+		return route // ### return, known tag ###
+	}
+
+	if streamID, exists := cons.tags[tag]; exists {
+		route = fluentdRoute{streamID, true}
+	} else {
+		for _, prefix := range cons.prefixes {
+			if strings.HasPrefix(tag, prefix[:len(prefix)-1]) {
+				route = fluentdRoute{cons.tags[prefix], true}
+				break // ### break, longest match ###
+			}
+		}
+	}
+
+	cons.tagGuard.Lock()
+	cons.tagCache[tag] = route
+	cons.tagGuard.Unlock()
+	return route
+}
+
+// fluentdJSONValue converts decoded msgpack values so that they can be
+// written as JSON, i.e. binary data is converted to string.
+func fluentdJSONValue(value interface{}) interface{} {
+	switch value.(type) {
+	case []byte:
+		return string(value.([]byte))
+	case shared.MsgpackExt:
+		if timestamp, isTime := shared.FluentdTime(value); isTime {
+			return timestamp.Format(time.RFC3339Nano)
+		}
+		return nil
+	case []interface{}:
+		array := value.([]interface{})
+		for i, item := range array {
+			array[i] = fluentdJSONValue(item)
+		}
+		return array
+	case map[string]interface{}:
+		object := value.(map[string]interface{})
+		for key, item := range object {
+			object[key] = fluentdJSONValue(item)
+		}
+		return object
+	default:
+		return value
+	}
+}
+
+// fluentdMetadataValue converts a scalar record value to a metadata string.
+func fluentdMetadataValue(value interface{}) (string, bool) {
+	switch value.(type) {
+	case string, []byte:
+		return shared.FluentdString(value), true
+	case int64:
+		return strconv.FormatInt(value.(int64), 10), true
+	case uint64:
+		return strconv.FormatUint(value.(uint64), 10), true
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+	default:
+		return "", false
+	}
+}
+
+// enqueueEvent creates a message from a single event and passes it to the
+// streams mapped to the given tag.
+func (cons *Fluentd) enqueueEvent(tag string, eventTime interface{}, record interface{}) {
+	fields, isMap := record.(map[string]interface{})
+	if !isMap {
+		Log.Warning.Print("Fluentd record is not a map (tag ", tag, ")")
+		return // ### return, invalid record ###
+	}
+
+	metadata := core.MessageMetadata{shared.FluentdMetadataPrefix + "tag": tag}
+	var payload []byte
+
+	if message, hasMessage := fields[cons.messageKey]; hasMessage && !cons.jsonPayload {
+		if text, isScalar := fluentdMetadataValue(message); isScalar {
+			payload = []byte(text)
+			for name, value := range fields {
+				if name == cons.messageKey {
+					continue // ### continue, payload ###
+				}
+				if text, isScalar := fluentdMetadataValue(value); isScalar {
+					metadata[shared.FluentdMetadataPrefix+name] = text
+				}
+			}
+		}
+	}
+
+	if payload == nil {
+		var err error
+		if payload, err = json.Marshal(fluentdJSONValue(fields)); err != nil {
+			Log.Error.Print("Fluentd record error: ", err)
+			return // ### return, invalid record ###
+		}
+	}
+
+	msg := core.NewMessage(cons, payload, atomic.AddUint64(cons.sequence, 1)-1)
+	msg.Metadata = metadata
+	if timestamp, isTime := shared.FluentdTime(eventTime); isTime {
+		msg.Timestamp = timestamp
+	}
+
+	if route := cons.getRoute(tag); route.mapped {
+		cons.EnqueueMessageTo(msg, route.streamID)
+	} else {
+		cons.EnqueueMessage(msg)
+	}
+}
+
+// enqueueEntries decodes a list of [time, record] entries.
+func (cons *Fluentd) enqueueEntries(tag string, entries []interface{}) {
+	for _, entry := range entries {
+		if pair, isArray := entry.([]interface{}); isArray && len(pair) >= 2 {
+			cons.enqueueEvent(tag, pair[0], pair[1])
+		} else {
+			Log.Warning.Print("Fluentd invalid entry (tag ", tag, ")")
+		}
+	}
+}
+
+// enqueuePacked decodes a stream of msgpack encoded [time, record] entries.
+func (cons *Fluentd) enqueuePacked(tag string, data []byte, options map[string]interface{}) error {
+	if shared.FluentdString(options["compressed"]) == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return err
+		}
+	}
+
+	reader := shared.NewMsgpackReader(data)
+	for reader.HasData() {
+		entry, err := reader.ReadValue()
+		if err != nil {
+			return err
+		}
+		cons.enqueueEntries(tag, []interface{}{entry})
+	}
+	return nil
+}
+
+// processMessage handles a single forward protocol message and returns the
+// chunk id to acknowledge, if any.
+func (cons *Fluentd) processMessage(value interface{}) (string, error) {
+	message, isArray := value.([]interface{})
+	if !isArray || len(message) < 2 {
+		return "", fmt.Errorf("Invalid message")
+	}
+
+	tag := shared.FluentdString(message[0])
+	options := map[string]interface{}{}
+
+	switch message[1].(type) {
+	case []interface{}: // Forward mode
+		if len(message) > 2 {
+			options, _ = message[2].(map[string]interface{})
+		}
+		cons.enqueueEntries(tag, message[1].([]interface{}))
+
+	case []byte, string: // PackedForward mode
+		if len(message) > 2 {
+			options, _ = message[2].(map[string]interface{})
+		}
+		if err := cons.enqueuePacked(tag, []byte(shared.FluentdString(message[1])), options); err != nil {
+			return "", err
+		}
+
+	default: // Message mode
+		if len(message) < 3 {
+			return "", fmt.Errorf("Invalid message")
+		}
+		if len(message) > 3 {
+			options, _ = message[3].(map[string]interface{})
+		}
+		cons.enqueueEvent(tag, message[1], message[2])
+	}
+
+	return shared.FluentdString(options["chunk"]), nil
+}
+
+// handshake authenticates a client as described by the forward protocol
+// specification.
+func (cons *Fluentd) handshake(conn net.Conn, reader *shared.MsgpackStreamReader) error {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	authSalt := ""
+	if len(cons.users) > 0 {
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		authSalt = base64.StdEncoding.EncodeToString(salt)
+	}
+
+	helo := shared.NewMsgpackWriter(128)
+	helo.WriteArrayHeader(2)
+	helo.WriteString("HELO")
+	helo.WriteMapHeader(3)
+	helo.WriteString("nonce")
+	helo.WriteString(base64.StdEncoding.EncodeToString(nonce))
+	helo.WriteString("auth")
+	helo.WriteString(authSalt)
+	helo.WriteString("keepalive")
+	helo.WriteBool(true)
+	if _, err := conn.Write(helo.Bytes()); err != nil {
+		return err
+	}
+
+	value, err := reader.ReadValue()
+	if err != nil {
+		return err
+	}
+	ping, isArray := value.([]interface{})
+	if !isArray || len(ping) < 6 || shared.FluentdString(ping[0]) != "PING" {
+		return fmt.Errorf("Expected PING")
+	}
+
+	nonceString := base64.StdEncoding.EncodeToString(nonce)
+	clientHostname := shared.FluentdString(ping[1])
+	salt := shared.FluentdString(ping[2])
+	reason := ""
+
+	switch {
+	case shared.FluentdString(ping[3]) != shared.FluentdDigest(salt, clientHostname, nonceString, cons.sharedKey):
+		reason = "shared key mismatch"
+	case authSalt != "":
+		username := shared.FluentdString(ping[4])
+		password, exists := cons.users[username]
+		if !exists || shared.FluentdString(ping[5]) != shared.FluentdDigest(authSalt, username, password) {
+			reason = "username/password mismatch"
+		}
+	}
+
+	pong := shared.NewMsgpackWriter(256)
+	pong.WriteArrayHeader(5)
+	pong.WriteString("PONG")
+	pong.WriteBool(reason == "")
+	pong.WriteString(reason)
+	pong.WriteString(cons.hostname)
+	pong.WriteString(shared.FluentdDigest(salt, cons.hostname, nonceString, cons.sharedKey))
+	if _, err := conn.Write(pong.Bytes()); err != nil {
+		return err
+	}
+
+	if reason != "" {
+		return fmt.Errorf("Authentication of %s failed: %s", clientHostname, reason)
+	}
+	return nil
+}
+
+func (cons *Fluentd) read(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	reader := shared.NewMsgpackStreamReader(conn)
+	if cons.sharedKey != "" {
+		conn.SetDeadline(time.Now().Add(cons.timeout))
+		if err := cons.handshake(conn, reader); err != nil {
+			Log.Error.Print("Fluentd handshake failed: ", err)
+			return // ### return, not authenticated ###
+		}
+	}
+
+	ack := shared.NewMsgpackWriter(64)
+	for !cons.quit {
+		conn.SetDeadline(time.Now().Add(cons.timeout))
+		value, err := reader.ReadValue()
+		if err != nil {
+			if err != io.EOF && !cons.quit {
+				Log.Error.Print("Fluentd read failed: ", err)
+			}
+			return // ### return, connection closed ###
+		}
+
+		chunk, err := cons.processMessage(value)
+		if err != nil {
+			Log.Error.Print("Fluentd message error: ", err)
+			continue // ### continue, invalid message ###
+		}
+
+		if chunk != "" {
+			ack.Reset()
+			ack.WriteMapHeader(1)
+			ack.WriteString("ack")
+			ack.WriteString(chunk)
+			if _, err := conn.Write(ack.Bytes()); err != nil {
+				Log.Error.Print("Fluentd ack failed: ", err)
+				return // ### return, connection closed ###
+			}
+		}
+	}
+}
+
+func (cons *Fluentd) accept() {
+	defer cons.WorkerDone()
+
+	for !cons.quit {
+		client, err := cons.listen.Accept()
+		if err != nil {
+			if !cons.quit {
+				Log.Error.Print("Fluentd listen failed: ", err)
+			}
+			break // ### break ###
+		}
+
+		go func() {
+			defer shared.RecoverShutdown()
+			cons.AddWorker()
+			cons.read(client)
+		}()
+	}
+}
+
+// Consume listens to a given socket.
+func (cons *Fluentd) Consume(workers *sync.WaitGroup) {
+	var err error
+	cons.quit = false
+
+	if cons.listen, err = shared.ListenSocket(cons.protocol, cons.address); err != nil {
+		Log.Error.Print("Fluentd connection error: ", err)
+		return
+	}
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		cons.accept()
+	}()
+
+	defer func() {
+		cons.quit = true
+		cons.listen.Close()
+	}()
+
+	cons.DefaultControlLoop(nil)
+}
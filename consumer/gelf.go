@@ -0,0 +1,274 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gelfMaxPacketSize = 65536
+)
+
+// GELF consumer plugin
+// Configuration example
+//
+//   - "consumer.GELF":
+//     Enable: true
+//     Address: "udp://0.0.0.0:12201"
+//     Payload: "message"
+//     ChunkTimeoutSec: 5
+//
+// The GELF consumer accepts messages using the Graylog Extended Log Format.
+// Messages can be sent via UDP (chunked, gzip or zlib compressed) or TCP
+// (uncompressed, separated by null bytes).
+// All GELF fields but the payload are attached to the message as metadata
+// named "gelf_<field>", e.g. "gelf_host" or "gelf_level". Additional fields
+// are stored without their leading underscore, i.e. "_user" is stored as
+// "gelf_user". The message timestamp is set to the GELF timestamp if given.
+//
+// Address defines the protocol, address and port to listen to. The protocol
+// can be either "udp://" or "tcp://". By default this is set to
+// "udp://0.0.0.0:12201".
+//
+// Payload defines the data used as message payload. When set to "message"
+// the field "short_message" is used. When set to "json" the whole,
+// uncompressed GELF document is used. By default this is set to "message".
+//
+// ChunkTimeoutSec defines the number of seconds to wait for all chunks of a
+// chunked message to arrive. Incomplete messages are discarded after this
+// time. By default this is set to 5.
+type GELF struct {
+	core.ConsumerBase
+	listen       io.Closer
+	protocol     string
+	address      string
+	jsonPayload  bool
+	chunkTimeout time.Duration
+	sequence     *uint64
+	quit         bool
+}
+
+func init() {
+	shared.RuntimeType.Register(GELF{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GELF) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", "udp://0.0.0.0:12201"))
+	switch cons.protocol {
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("GELF: unknown protocol type %s", cons.protocol)
+	}
+
+	switch strings.ToLower(conf.GetString("Payload", "message")) {
+	case "message":
+	case "json":
+		cons.jsonPayload = true
+	default:
+		return fmt.Errorf("GELF: unknown payload %s", conf.GetString("Payload", ""))
+	}
+
+	cons.chunkTimeout = time.Duration(conf.GetInt("ChunkTimeoutSec", 5)) * time.Second
+	cons.sequence = new(uint64)
+	cons.quit = false
+	return nil
+}
+
+// gelfValueString converts a decoded JSON value into a metadata string.
+func gelfValueString(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return value.(string)
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value.(bool))
+	case nil:
+		return ""
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// enqueueGELF parses an uncompressed GELF document and passes it to all
+// streams.
+func (cons *GELF) enqueueGELF(document []byte) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(document, &fields); err != nil {
+		Log.Error.Print("GELF parser error: ", err)
+		return // ### return, invalid message ###
+	}
+
+	shortMessage, isString := fields["short_message"].(string)
+	if !isString {
+		Log.Error.Print("GELF message without short_message")
+		return // ### return, invalid message ###
+	}
+
+	var msg core.Message
+	seq := atomic.AddUint64(cons.sequence, 1) - 1
+	if cons.jsonPayload {
+		// The document may still point to the read buffer
+		payload := make([]byte, len(document))
+		copy(payload, document)
+		msg = core.NewMessage(cons, payload, seq)
+	} else {
+		msg = core.NewMessage(cons, []byte(shortMessage), seq)
+	}
+
+	if timestamp, isNumber := fields["timestamp"].(float64); isNumber {
+		seconds := int64(timestamp)
+		msg.Timestamp = time.Unix(seconds, int64((timestamp-float64(seconds))*1e9))
+	}
+
+	msg.Metadata = make(core.MessageMetadata, len(fields))
+	for name, value := range fields {
+		if name != "short_message" {
+			msg.Metadata[shared.GELFMetadataPrefix+strings.TrimPrefix(name, "_")] = gelfValueString(value)
+		}
+	}
+
+	cons.EnqueueMessage(msg)
+}
+
+func (cons *GELF) udpRead() {
+	defer cons.WorkerDone()
+
+	conn := cons.listen.(net.PacketConn)
+	assembler := shared.NewGELFAssembler(cons.chunkTimeout)
+	packet := make([]byte, gelfMaxPacketSize)
+
+	for !cons.quit {
+		size, _, err := conn.ReadFrom(packet)
+		if err != nil {
+			if !cons.quit {
+				Log.Error.Print("GELF read failed: ", err)
+			}
+			return // ### return, connection closed ###
+		}
+
+		message, err := assembler.Add(packet[:size])
+		if err != nil {
+			Log.Error.Print("GELF chunk error: ", err)
+			continue // ### continue, invalid chunk ###
+		}
+		if message == nil {
+			continue // ### continue, incomplete ###
+		}
+
+		document, err := shared.GELFDecompress(message)
+		if err != nil {
+			Log.Error.Print("GELF decompression failed: ", err)
+			continue // ### continue, invalid message ###
+		}
+		cons.enqueueGELF(document)
+	}
+}
+
+func (cons *GELF) tcpRead(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	buffer := shared.NewBufferedReader(socketBufferGrowSize, shared.BufferedReaderFlagDelimiter, 0, "\x00")
+	enqueue := func(data []byte, sequence uint64) {
+		cons.enqueueGELF(data)
+	}
+
+	for !cons.quit {
+		if err := buffer.ReadAll(conn, enqueue); err != nil {
+			if err != io.EOF {
+				Log.Error.Print("GELF read failed: ", err)
+			}
+			return // ### return, connection closed ###
+		}
+	}
+}
+
+func (cons *GELF) tcpAccept() {
+	defer cons.WorkerDone()
+
+	listener := cons.listen.(net.Listener)
+	for !cons.quit {
+		client, err := listener.Accept()
+		if err != nil {
+			if !cons.quit {
+				Log.Error.Print("GELF listen failed: ", err)
+			}
+			break // ### break ###
+		}
+
+		go func() {
+			defer shared.RecoverShutdown()
+			cons.AddWorker()
+			cons.tcpRead(client)
+		}()
+	}
+}
+
+// Consume listens to a given socket.
+func (cons *GELF) Consume(workers *sync.WaitGroup) {
+	var err error
+	var listen func()
+
+	cons.quit = false
+
+	if cons.protocol == "udp" {
+		if cons.listen, err = shared.ListenPacketSocket(cons.protocol, cons.address); err != nil {
+			Log.Error.Print("GELF connection error: ", err)
+			return
+		}
+		listen = cons.udpRead
+	} else {
+		if cons.listen, err = shared.ListenSocket(cons.protocol, cons.address); err != nil {
+			Log.Error.Print("GELF connection error: ", err)
+			return
+		}
+		listen = cons.tcpAccept
+	}
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		listen()
+	}()
+
+	defer func() {
+		cons.quit = true
+		cons.listen.Close()
+	}()
+
+	cons.DefaultControlLoop(nil)
+}
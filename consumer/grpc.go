@@ -0,0 +1,432 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GRPCMetadataClient is the metadata key storing the name of the client that
+// sent a message to the GRPC consumer.
+const GRPCMetadataClient = "grpc_client"
+
+// grpcEncodings maps gRPC message encodings to compressors.
+var grpcEncodings = map[string]string{
+	"gzip":    "gzip",
+	"deflate": "zlib",
+	"snappy":  "snappy",
+}
+
+// GRPC consumer plugin
+// Configuration example
+//
+//   - "consumer.GRPC":
+//     Enable: true
+//     Address: ":5881"
+//     MaxMessageSizeKB: 4096
+//     AuthTokens:
+//       "agent": "secret"
+//     AuthBasic:
+//       "user": "password"
+//     AuthCertificates:
+//       - "web01"
+//     AuthStreams:
+//       "agent":
+//         - "logs"
+//     RateLimit: 0
+//     AllowedStreams:
+//       - "logs"
+//     TLSCert: "/etc/gollum/server.crt"
+//     TLSKey: "/etc/gollum/server.key"
+//     TLSClientCA: "/etc/gollum/clients.crt"
+//
+// The GRPC consumer implements the streaming Ingest RPC defined in
+// proto/ingest.proto. Clients send batches of messages and receive an ack for
+// each batch after all of its messages have been passed to their streams.
+// Each message can name its own stream and carries metadata and a timestamp.
+// Messages without a stream name are sent to the streams configured by Stream.
+// Batches are received over HTTP/2, either over TLS or unencrypted (h2c).
+// Compressed messages using the gzip, deflate or snappy encoding are accepted.
+// A W3C trace context sent in the "traceparent" and "tracestate" metadata of
+// the call is attached to all messages that do not have a "traceparent"
+// metadata value of their own.
+// The name of the client is stored in the metadata field "grpc_client".
+// New batches are not read while a fuse of the streams this consumer writes to
+// is burned (see the FusePolicy stream setting).
+//
+// Address defines the address and port to listen to.
+// By default this is set to ":5881".
+//
+// MaxMessageSizeKB defines the maximum size of a single batch in KB. Larger
+// batches cause the call to fail. By default this is set to 4096.
+//
+// AuthTokens maps client names to tokens. Clients send their token via the
+// "authorization" header as in "Bearer <token>". By default no tokens are set.
+//
+// AuthBasic maps user names to passwords. Clients send them via basic
+// authentication. By default no users are set.
+//
+// AuthCertificates lists the common names of the client certificates that are
+// accepted. Certificates have to be verified via TLSClientCA.
+// By default no certificates are set.
+//
+// If any of the Auth settings is set, clients have to authenticate with one of
+// the configured methods. The name of the client is used as the value of
+// "grpc_client". If authentication is disabled the common name of the client
+// certificate or the address of the client is used as name.
+//
+// AuthStreams maps client names to the streams a client may write to,
+// including the streams configured by Stream. Messages to other streams are
+// rejected. Clients not listed may write to any stream. By default this is
+// empty.
+//
+// RateLimit defines the maximum number of messages per second accepted from a
+// single client. Clients exceeding this limit are slowed down. Set to 0 to
+// disable this limit. By default this is set to 0.
+//
+// AllowedStreams defines the streams a client may write to by naming them in
+// a message. Messages naming other streams are rejected. If empty any stream
+// is allowed. By default this is empty.
+//
+// TLSCert defines the path to a PEM encoded certificate. If set, TLS is used.
+// By default this is set to "" (TLS disabled).
+//
+// TLSKey defines the path to the PEM encoded private key for TLSCert.
+// By default this is set to "".
+//
+// TLSClientCA defines the path to a PEM encoded list of CA certificates used
+// to verify client certificates. The common name and the subject alternative
+// names of the client are attached to each message as the metadata values
+// "tls_cn" and "tls_san". By default this is set to "".
+type GRPC struct {
+	core.ConsumerBase
+	server     *http.Server
+	address    string
+	tlsConfig  *tls.Config
+	auth       *core.Authenticator
+	maxSize    int
+	rateLimit  float64
+	limits     map[string]*grpcRateLimit
+	limitGuard *sync.Mutex
+	sequence   *uint64
+}
+
+// grpcRateLimit is a token bucket shared by all calls of a client.
+type grpcRateLimit struct {
+	guard  *sync.Mutex
+	tokens float64
+	last   time.Time
+	calls  int
+}
+
+func init() {
+	shared.RuntimeType.Register(GRPC{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GRPC) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.address = conf.GetString("Address", ":5881")
+	cons.maxSize = conf.GetInt("MaxMessageSizeKB", 4096) << 10
+	cons.rateLimit = float64(conf.GetInt("RateLimit", 0))
+
+	if cons.auth, err = core.NewAuthenticator(conf); err != nil {
+		return fmt.Errorf("GRPC: %s", err)
+	}
+
+	if cons.tlsConfig, err = configureTLS(conf); err != nil {
+		return err
+	}
+	if cons.tlsConfig != nil {
+		cons.tlsConfig.NextProtos = []string{"h2"}
+	}
+
+	cons.limits = make(map[string]*grpcRateLimit)
+	cons.limitGuard = new(sync.Mutex)
+	cons.sequence = new(uint64)
+	return nil
+}
+
+// authenticate returns the name of the client sending the given request.
+// If the client could not be authenticated false is returned.
+func (cons *GRPC) authenticate(req *http.Request) (string, bool) {
+	if cons.auth.IsEnabled() {
+		client, err := cons.auth.Authenticate(httpCredentials(req, nil))
+		return client, err == nil // ### return, authenticated ###
+	}
+
+	if commonName := tlsCommonName(req.TLS); commonName != "" {
+		return commonName, true // ### return, client certificate ###
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host, true
+	}
+	return req.RemoteAddr, true
+}
+
+// acquireRateLimit returns the rate limit of the given client. Each call has
+// to be followed by a call to releaseRateLimit.
+func (cons *GRPC) acquireRateLimit(client string) *grpcRateLimit {
+	cons.limitGuard.Lock()
+	defer cons.limitGuard.Unlock()
+
+	limit, exists := cons.limits[client]
+	if !exists {
+		limit = &grpcRateLimit{
+			guard:  new(sync.Mutex),
+			tokens: cons.rateLimit,
+			last:   time.Now(),
+		}
+		cons.limits[client] = limit
+	}
+	limit.calls++
+	return limit
+}
+
+// releaseRateLimit removes the rate limit of a client after its last call
+// has ended.
+func (cons *GRPC) releaseRateLimit(client string) {
+	cons.limitGuard.Lock()
+	defer cons.limitGuard.Unlock()
+
+	if limit, exists := cons.limits[client]; exists {
+		if limit.calls--; limit.calls == 0 {
+			delete(cons.limits, client)
+		}
+	}
+}
+
+// wait blocks until the given number of messages may be processed.
+func (cons *GRPC) wait(limit *grpcRateLimit, count int) {
+	if cons.rateLimit <= 0 {
+		return // ### return, no limit ###
+	}
+
+	limit.guard.Lock()
+	now := time.Now()
+	limit.tokens += now.Sub(limit.last).Seconds() * cons.rateLimit
+	if limit.tokens > cons.rateLimit {
+		limit.tokens = cons.rateLimit
+	}
+	limit.last = now
+	limit.tokens -= float64(count)
+	debt := limit.tokens
+	limit.guard.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / cons.rateLimit * float64(time.Second)))
+	}
+}
+
+// finish sets the status of a call. The status is sent as a trailer.
+func (cons *GRPC) finish(resp http.ResponseWriter, status shared.GRPCStatus, message string) {
+	resp.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(status)))
+	if message != "" {
+		resp.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// decompress decodes a compressed batch.
+func (cons *GRPC) decompress(compressor core.Compressor, data []byte) ([]byte, error) {
+	if compressor == nil {
+		return nil, fmt.Errorf("compressed message without encoding")
+	}
+	reader, err := compressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(cons.maxSize)+1))
+	if err == nil && len(decoded) > cons.maxSize {
+		return nil, shared.GRPCFrameTooLargeError{}
+	}
+	return decoded, err
+}
+
+// enqueueBatch passes all messages of a batch to their streams. The trace
+// context of the call is used for all messages that are not traced.
+func (cons *GRPC) enqueueBatch(batch []shared.IngestMessage, client string, tlsMeta core.MessageMetadata, header http.Header) shared.IngestAck {
+	ack := shared.IngestAck{}
+	for _, ingestMsg := range batch {
+		msg := core.NewMessage(cons, ingestMsg.Data, atomic.AddUint64(cons.sequence, 1))
+		if ingestMsg.Timestamp != 0 {
+			msg.Timestamp = time.Unix(0, ingestMsg.Timestamp)
+		}
+
+		msg.Metadata = make(core.MessageMetadata, len(ingestMsg.Metadata)+len(tlsMeta)+1)
+		for key, value := range ingestMsg.Metadata {
+			msg.Metadata[key] = value
+		}
+		for key, value := range tlsMeta {
+			msg.Metadata[key] = value
+		}
+		msg.Metadata[GRPCMetadataClient] = client
+		msg.Metadata = core.ExtractTraceContext(msg.Metadata, header.Get)
+
+		if ingestMsg.Stream == "" {
+			if !cons.auth.AreDefaultStreamsAllowed(client, cons.Streams()) {
+				ack.Rejected++
+				continue // ### continue, stream not allowed ###
+			}
+			cons.EnqueueMessage(msg)
+			ack.Accepted++
+			continue // ### continue, default streams ###
+		}
+
+		streamID := core.GetStreamID(ingestMsg.Stream)
+		if !cons.auth.IsStreamAllowed(client, streamID) {
+			ack.Rejected++
+			continue // ### continue, stream not allowed ###
+		}
+		cons.EnqueueMessageTo(msg, streamID)
+		ack.Accepted++
+	}
+	return ack
+}
+
+// ingest handles a single call of the Ingest RPC.
+func (cons *GRPC) ingest(resp http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor != 2 || !strings.HasPrefix(req.Header.Get("Content-Type"), shared.GRPCContentType) {
+		resp.WriteHeader(http.StatusUnsupportedMediaType)
+		return // ### return, not a gRPC call ###
+	}
+
+	resp.Header().Set("Content-Type", shared.GRPCContentType)
+	resp.Header().Set("Grpc-Accept-Encoding", "gzip,deflate,snappy")
+
+	if req.URL.Path != shared.IngestPath {
+		cons.finish(resp, shared.GRPCStatusUnimplemented, "unknown method "+req.URL.Path)
+		return // ### return, unknown method ###
+	}
+
+	client, authenticated := cons.authenticate(req)
+	if !authenticated {
+		cons.finish(resp, shared.GRPCStatusUnauthenticated, "invalid credentials")
+		return // ### return, not authenticated ###
+	}
+
+	var compressor core.Compressor
+	if encoding := req.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		name, supported := grpcEncodings[encoding]
+		if !supported {
+			cons.finish(resp, shared.GRPCStatusUnimplemented, "unsupported encoding "+encoding)
+			return // ### return, unknown encoding ###
+		}
+		compressor, _ = core.NewCompressor(name)
+	}
+
+	var tlsMeta core.MessageMetadata
+	if req.TLS != nil {
+		tlsMeta = tlsMetadata(*req.TLS)
+	}
+
+	limit := cons.acquireRateLimit(client)
+	defer cons.releaseRateLimit(client)
+
+	resp.WriteHeader(http.StatusOK)
+	flusher, _ := resp.(http.Flusher)
+
+	for {
+		data, compressed, err := shared.ReadGRPCFrame(req.Body, cons.maxSize)
+		if err == nil && compressed {
+			data, err = cons.decompress(compressor, data)
+		}
+
+		switch err.(type) {
+		case nil:
+		case shared.GRPCFrameTooLargeError:
+			cons.finish(resp, shared.GRPCStatusResourceExhausted, "batch exceeds MaxMessageSizeKB")
+			return // ### return, batch too large ###
+		default:
+			if err == io.EOF {
+				cons.finish(resp, shared.GRPCStatusOK, "")
+			} else {
+				cons.finish(resp, shared.GRPCStatusInvalidArgument, err.Error())
+			}
+			return // ### return, end of call ###
+		}
+
+		batch, err := shared.DecodeIngestBatch(data)
+		if err != nil {
+			cons.finish(resp, shared.GRPCStatusInvalidArgument, err.Error())
+			return // ### return, invalid batch ###
+		}
+
+		cons.wait(limit, len(batch))
+		cons.WaitOnFuse()
+
+		ack := cons.enqueueBatch(batch, client, tlsMeta, req.Header)
+		if err := shared.WriteGRPCFrame(resp, shared.EncodeIngestAck(ack), false); err != nil {
+			return // ### return, client gone ###
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (cons *GRPC) serve(listen net.Listener) {
+	defer cons.WorkerDone()
+
+	if err := cons.server.Serve(listen); err != nil && err != http.ErrServerClosed {
+		Log.Error.Print("GRPC: ", err)
+	}
+}
+
+// Consume listens to the configured address and handles Ingest calls.
+func (cons *GRPC) Consume(workers *sync.WaitGroup) {
+	listen, err := shared.ListenSocket("tcp", cons.address)
+	if err != nil {
+		Log.Error.Print("GRPC: ", err)
+		return // ### return, could not listen ###
+	}
+
+	protocols := new(http.Protocols)
+	if cons.tlsConfig != nil {
+		listen = tls.NewListener(listen, cons.tlsConfig)
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	cons.server = &http.Server{
+		Handler:   http.HandlerFunc(cons.ingest),
+		Protocols: protocols,
+	}
+
+	cons.AddMainWorker(workers)
+	go cons.serve(listen)
+	defer cons.server.Close()
+
+	cons.DefaultControlLoop(nil)
+}
@@ -16,15 +16,24 @@ package consumer
 
 import (
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// HttpMetadataClient is the metadata key storing the name of a client that
+// has been authenticated by the Http consumer.
+const HttpMetadataClient = "http_client"
+
 // Http consumer plugin
 // Configuration example
 //
@@ -33,6 +42,28 @@ import (
 //     Address: ":80"
 //     ReadTimeoutSec: 5
 //     WithHeaders: false
+//     TLSCert: "/etc/gollum/server.crt"
+//     TLSKey: "/etc/gollum/server.key"
+//     TLSClientCA: "/etc/gollum/clients.crt"
+//     AuthTokens:
+//       "agent": "secret"
+//     AuthBasic:
+//       "user": "password"
+//     AuthHMACKeys:
+//       "signer": "key"
+//     AuthCertificates:
+//       - "web01"
+//     AuthStreams:
+//       "agent":
+//         - "logs"
+//
+// Requests are answered with status 503 and a Retry-After header while a fuse
+// of the streams this consumer writes to is burned (see the FusePolicy stream
+// setting).
+//
+// A valid W3C trace context sent in the "traceparent" and "tracestate" headers
+// is attached to each message as the metadata values "traceparent" and
+// "tracestate".
 //
 // Address stores the identifier to bind to.
 // This is allowed be any ip address/dns and port like "localhost:5880".
@@ -43,6 +74,42 @@ import (
 //
 // WithHeaders can be set to false to only read the HTTP body instead of passing
 // the while HTTP message. By default this setting is set to true.
+//
+// TLSCert defines the path to a PEM encoded certificate. If set, HTTPS is used.
+// By default this is set to "" (TLS disabled).
+//
+// TLSKey defines the path to the PEM encoded private key for TLSCert.
+// By default this is set to "".
+//
+// TLSClientCA defines the path to a PEM encoded list of CA certificates used
+// to verify client certificates. If set, clients have to authenticate with a
+// certificate signed by one of these CAs. The common name and the subject
+// alternative names of the client are attached to each message as the metadata
+// values "tls_cn" and "tls_san". By default this is set to "".
+//
+// AuthTokens maps client names to tokens. Clients send their token via the
+// "Authorization" header as in "Bearer <token>". By default no tokens are set.
+//
+// AuthBasic maps user names to passwords. Clients send them via basic
+// authentication. By default no users are set.
+//
+// AuthHMACKeys maps client names to secrets. Clients sign the request body
+// with HMAC-SHA256 and send the hex encoded signature via the "Authorization"
+// header as in "HMAC <client>:<signature>". By default no keys are set.
+//
+// AuthCertificates lists the common names of the client certificates that are
+// accepted. Certificates have to be verified via TLSClientCA.
+// By default no certificates are set.
+//
+// If any of the Auth settings is set, clients have to authenticate with one of
+// the configured methods. Other requests are answered with status 401. The
+// name of the client is attached to each message as the metadata value
+// "http_client".
+//
+// AuthStreams maps client names to the streams a client may write to.
+// Requests of clients that may not write to the streams of this consumer are
+// answered with status 403. Clients not listed may write to any stream.
+// By default this is empty.
 type Http struct {
 	core.ConsumerBase
 	listen         *shared.StopListener
@@ -50,6 +117,8 @@ type Http struct {
 	sequence       uint64
 	readTimeoutSec time.Duration
 	withHeaders    bool
+	tlsConfig      *tls.Config
+	auth           *core.Authenticator
 }
 
 func init() {
@@ -66,11 +135,74 @@ func (cons *Http) Configure(conf core.PluginConfig) error {
 	cons.address = conf.GetString("Address", ":80")
 	cons.readTimeoutSec = time.Duration(conf.GetInt("ReadTimeoutSec", 3)) * time.Second
 	cons.withHeaders = conf.GetBool("WithHeaders", true)
+	if cons.auth, err = core.NewAuthenticator(conf); err != nil {
+		return fmt.Errorf("Http: %s", err)
+	}
+	cons.tlsConfig, err = configureTLS(conf)
 	return err
 }
 
+// authenticate returns the name of the client sending the given request.
+// If authentication is disabled an empty name is returned. Signed request
+// bodies are read and replaced by a copy. If the client could not be
+// authenticated the error status is returned.
+func (cons *Http) authenticate(req *http.Request) (string, int) {
+	if !cons.auth.IsEnabled() {
+		return "", http.StatusOK // ### return, authentication disabled ###
+	}
+
+	var body []byte
+	if strings.HasPrefix(req.Header.Get("Authorization"), "HMAC ") && req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return "", http.StatusBadRequest // ### return, bad body ###
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	client, err := cons.auth.Authenticate(httpCredentials(req, body))
+	switch {
+	case err != nil:
+		return "", http.StatusUnauthorized
+	case !cons.auth.AreDefaultStreamsAllowed(client, cons.Streams()):
+		return "", http.StatusForbidden
+	default:
+		return client, http.StatusOK
+	}
+}
+
+// enqueueRequest passes the given data to all streams. If the client has been
+// authenticated, its identity is attached as metadata. The same is done for
+// the W3C trace context of the request.
+func (cons *Http) enqueueRequest(req *http.Request, client string, data []byte) {
+	msg := core.NewMessage(cons, data, atomic.AddUint64(&cons.sequence, 1))
+	if req.TLS != nil {
+		msg.Metadata = tlsMetadata(*req.TLS)
+	}
+	if client != "" {
+		if msg.Metadata == nil {
+			msg.Metadata = core.MessageMetadata{}
+		}
+		msg.Metadata[HttpMetadataClient] = client
+	}
+	msg.Metadata = core.ExtractTraceContext(msg.Metadata, req.Header.Get)
+	cons.EnqueueMessage(msg)
+}
+
 // requestHandler will handle a single web request.
 func (cons *Http) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	if cons.IsFuseBurned() {
+		resp.Header().Set("Retry-After", "1")
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return // ### return, back-pressure ###
+	}
+
+	client, status := cons.authenticate(req)
+	if status != http.StatusOK {
+		resp.WriteHeader(status)
+		return // ### return, not authenticated ###
+	}
+
 	if cons.withHeaders {
 		// Read the whole package
 		requestBuffer := bytes.NewBuffer(nil)
@@ -79,7 +211,7 @@ func (cons *Http) requestHandler(resp http.ResponseWriter, req *http.Request) {
 			return // ### return, missing body or bad write ###
 		}
 
-		cons.Enqueue(requestBuffer.Bytes(), atomic.AddUint64(&cons.sequence, 1))
+		cons.enqueueRequest(req, client, requestBuffer.Bytes())
 		resp.WriteHeader(http.StatusCreated)
 	} else {
 		// Read only the message body
@@ -95,7 +227,7 @@ func (cons *Http) requestHandler(resp http.ResponseWriter, req *http.Request) {
 			return // ### return, missing body or bad write ###
 		}
 
-		cons.Enqueue(body[:length], atomic.AddUint64(&cons.sequence, 1))
+		cons.enqueueRequest(req, client, body[:length])
 		resp.WriteHeader(http.StatusCreated)
 	}
 }
@@ -109,7 +241,12 @@ func (cons *Http) serve() {
 		ReadTimeout: cons.readTimeoutSec,
 	}
 
-	err := srv.Serve(cons.listen)
+	var listener net.Listener = cons.listen
+	if cons.tlsConfig != nil {
+		listener = tls.NewListener(cons.listen, cons.tlsConfig)
+	}
+
+	err := srv.Serve(listener)
 	if _, isStopRequest := err.(shared.StopRequestError); err != nil && !isStopRequest {
 		Log.Error.Print("httpd: ", err)
 	}
@@ -57,6 +57,8 @@ const (
 //
 // The kafka consumer reads from a given kafka topic. This consumer is based on
 // the sarama library so most settings relate to the settings from this library.
+// Fetching is paused while a fuse of the streams this consumer writes to is
+// burned (see the FusePolicy stream setting).
 //
 // DefaultOffset defines the message index to start reading from.
 // Valid values are either "Newset", "Oldest", or a number.
@@ -227,6 +229,8 @@ func (cons *Kafka) readFromPartition(partitionID int32) {
 	// Loop over worker
 
 	for !cons.client.Closed() {
+		cons.WaitOnFuse()
+
 		select {
 		case event := <-partCons.Messages():
 			cons.offsets[partitionID] = event.Offset
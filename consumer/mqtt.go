@@ -0,0 +1,372 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MQTTMetadataTopic is the metadata key storing the topic of a message
+	// received by the MQTT consumer.
+	MQTTMetadataTopic = "mqtt_topic"
+
+	// MQTTMetadataRetain is the metadata key storing "true" if a message
+	// received by the MQTT consumer was a retained message.
+	MQTTMetadataRetain = "mqtt_retain"
+)
+
+// MQTT consumer plugin
+// Configuration example
+//
+//   - "consumer.MQTT":
+//     Enable: true
+//     Address: "localhost:1883"
+//     Version: "3.1.1"
+//     ClientID: ""
+//     Username: ""
+//     Password: ""
+//     CleanSession: true
+//     SessionExpirySec: 0
+//     KeepAliveSec: 30
+//     TimeoutSec: 5
+//     RetryDelayMs: 1000
+//     MaxMessageSizeKB: 1024
+//     QoS: 0
+//     SharedGroup: ""
+//     Topics:
+//       - "devices/+/telemetry"
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//
+// The MQTT consumer subscribes to topics of an MQTT 3.1.1 or MQTT 5 broker.
+// The topic of each message is stored in the metadata field "mqtt_topic".
+// Retained messages have the metadata field "mqtt_retain" set to "true".
+// Messages are acknowledged after they have been passed to all streams of
+// this consumer. Messages sent with QoS 2 are passed on only once, even if
+// the broker sends them again. New messages are not read while a fuse of the
+// streams this consumer writes to is burned (see the FusePolicy stream
+// setting).
+//
+// Address defines the broker to connect to. This can be any ip address and
+// port like "localhost:1883". By default this is set to "localhost:1883".
+//
+// Version defines the protocol version to use. Valid values are "3.1.1" and
+// "5". By default this is set to "3.1.1".
+//
+// ClientID defines the client identifier sent to the broker. Session state is
+// bound to this identifier, so it has to be unique for each instance.
+// By default this is set to "gollum-" followed by the hostname.
+//
+// Username and Password define the credentials sent to the broker.
+// By default both are set to "".
+//
+// CleanSession can be set to false to resume the session stored by the broker
+// for ClientID. Messages published while this consumer was not connected are
+// received after a reconnect in this case. By default this is set to true.
+//
+// SessionExpirySec defines the number of seconds the broker keeps the session
+// after the connection has been closed. This setting is only used by MQTT 5.
+// By default this is set to 0.
+//
+// KeepAliveSec defines the keep alive interval sent to the broker. A ping is
+// sent if no packet has been sent for half of this interval.
+// By default this is set to 30.
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established. By default this is set to 5.
+//
+// RetryDelayMs defines the number of milliseconds to wait before connecting
+// again after the connection has been lost. By default this is set to 1000.
+//
+// MaxMessageSizeKB defines the maximum size of a single packet. Larger packets
+// are refused by closing the connection. By default this is set to 1024.
+//
+// QoS defines the maximum quality of service level requested for all topics.
+// Valid values are 0, 1 and 2. By default this is set to 0.
+//
+// SharedGroup defines the name of a shared subscription group. If set, all
+// topics are subscribed as "$share/<SharedGroup>/<topic>" so that messages
+// are distributed between all clients of the group. This requires MQTT 5 or
+// a broker supporting shared subscriptions for MQTT 3.1.1.
+// By default this is set to "".
+//
+// Topics defines the topic filters to subscribe to. By default this is set to
+// "#", i.e. all topics.
+//
+// TLS can be set to true to connect to the broker via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// broker's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// broker. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the broker's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// broker's certificate. By default this is set to false.
+type MQTT struct {
+	core.ConsumerBase
+	client        *shared.MQTTClient
+	guard         *sync.Mutex
+	options       shared.MQTTConnectOptions
+	subscriptions []shared.MQTTSubscription
+	received      map[uint16]bool
+	address       string
+	protocol      string
+	tlsConfig     *tls.Config
+	timeout       time.Duration
+	retryDelay    time.Duration
+	maxSize       int
+	sequence      uint64
+	quit          int32
+}
+
+func init() {
+	shared.RuntimeType.Register(MQTT{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MQTT) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.options.Version, err = shared.ParseMQTTVersion(conf.GetString("Version", "3.1.1"))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	cons.options.ClientID = conf.GetString("ClientID", "gollum-"+hostname)
+	cons.options.Username = conf.GetString("Username", "")
+	cons.options.Password = conf.GetString("Password", "")
+	cons.options.CleanStart = conf.GetBool("CleanSession", true)
+	cons.options.SessionExpirySec = uint32(conf.GetInt("SessionExpirySec", 0))
+	cons.options.KeepAlive = time.Duration(conf.GetInt("KeepAliveSec", 30)) * time.Second
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:1883"))
+	cons.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	cons.maxSize = conf.GetInt("MaxMessageSizeKB", 1024) << 10
+
+	qos := conf.GetInt("QoS", 0)
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("MQTT: QoS %d is not supported", qos)
+	}
+
+	group := conf.GetString("SharedGroup", "")
+	for _, topic := range conf.GetStringArray("Topics", []string{"#"}) {
+		if group != "" {
+			topic = "$share/" + group + "/" + topic
+		}
+		cons.subscriptions = append(cons.subscriptions, shared.MQTTSubscription{Filter: topic, QoS: byte(qos)})
+	}
+	if len(cons.subscriptions) == 0 {
+		return fmt.Errorf("MQTT: no topics configured")
+	}
+
+	if conf.GetBool("TLS", false) {
+		cons.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	cons.received = make(map[uint16]bool)
+	cons.guard = new(sync.Mutex)
+	return nil
+}
+
+func (cons *MQTT) isQuitting() bool {
+	return atomic.LoadInt32(&cons.quit) != 0
+}
+
+// connect opens a new connection and subscribes to all topics.
+func (cons *MQTT) connect() (*shared.MQTTClient, error) {
+	client, err := shared.DialMQTT(cons.protocol, cons.address, cons.tlsConfig, cons.timeout, cons.options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Packet ids of QoS 2 messages are only valid within a session
+	if !client.SessionPresent() {
+		cons.received = make(map[uint16]bool)
+	}
+
+	if err := client.Write(shared.EncodeMQTTSubscribe(client.Version(), 1, cons.subscriptions)); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	cons.guard.Lock()
+	cons.client = client
+	cons.guard.Unlock()
+
+	if cons.isQuitting() {
+		client.Close()
+		return nil, fmt.Errorf("MQTT: shutting down")
+	}
+	return client, nil
+}
+
+func (cons *MQTT) disconnect(client *shared.MQTTClient) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.client == client {
+		cons.client = nil
+	}
+	client.Close()
+}
+
+// enqueue passes a message to all streams of this consumer.
+func (cons *MQTT) enqueue(publish shared.MQTTMessage) {
+	msg := core.NewMessage(cons, publish.Payload, atomic.AddUint64(&cons.sequence, 1))
+	msg.Metadata = core.MessageMetadata{MQTTMetadataTopic: publish.Topic}
+	if publish.Retain {
+		msg.Metadata[MQTTMetadataRetain] = "true"
+	}
+	cons.EnqueueMessage(msg)
+}
+
+// handle processes a single packet sent by the broker.
+func (cons *MQTT) handle(client *shared.MQTTClient, packet shared.MQTTPacket) error {
+	switch packet.Type {
+	case shared.MQTTPublish:
+		publish, err := shared.DecodeMQTTPublish(client.Version(), packet)
+		if err != nil {
+			return err
+		}
+
+		switch publish.QoS {
+		case 0:
+			cons.enqueue(publish)
+		case 1:
+			cons.enqueue(publish)
+			return client.Write(shared.EncodeMQTTAck(shared.MQTTPubAck, publish.PacketID))
+		case 2:
+			// The message is passed on once and released by PUBREL
+			if !cons.received[publish.PacketID] {
+				cons.enqueue(publish)
+				cons.received[publish.PacketID] = true
+			}
+			return client.Write(shared.EncodeMQTTAck(shared.MQTTPubRec, publish.PacketID))
+		}
+
+	case shared.MQTTPubRel:
+		packetID, _ := shared.DecodeMQTTAck(packet)
+		delete(cons.received, packetID)
+		return client.Write(shared.EncodeMQTTAck(shared.MQTTPubComp, packetID))
+
+	case shared.MQTTSubAck:
+		if _, _, err := shared.DecodeMQTTSubAck(client.Version(), packet); err != nil {
+			Log.Error.Print("MQTT subscription refused - ", err)
+		}
+	}
+	return nil
+}
+
+// read connects to the broker and processes messages until the consumer is
+// stopped.
+func (cons *MQTT) read() {
+	defer cons.WorkerDone()
+
+	for !cons.isQuitting() {
+		client, err := cons.connect()
+		if err != nil {
+			if !cons.isQuitting() {
+				Log.Error.Print("MQTT connection error - ", err)
+				time.Sleep(cons.retryDelay)
+			}
+			continue // ### continue, try again ###
+		}
+
+		for {
+			cons.WaitOnFuse()
+			packet, err := client.Read(cons.maxSize)
+			if err == nil {
+				err = cons.handle(client, packet)
+			}
+			if err != nil {
+				if !cons.isQuitting() {
+					Log.Error.Print("MQTT error - ", err)
+					time.Sleep(cons.retryDelay)
+				}
+				cons.disconnect(client)
+				break // ### break, reconnect ###
+			}
+		}
+	}
+}
+
+// ping keeps the connection alive.
+func (cons *MQTT) ping() {
+	cons.guard.Lock()
+	client := cons.client
+	cons.guard.Unlock()
+
+	if client != nil {
+		if err := client.Ping(cons.options.KeepAlive); err != nil {
+			Log.Error.Print("MQTT write error - ", err)
+		}
+	}
+}
+
+// Consume connects to the broker and starts reading.
+func (cons *MQTT) Consume(workers *sync.WaitGroup) {
+	atomic.StoreInt32(&cons.quit, 0)
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		cons.read()
+	}()
+
+	defer func() {
+		atomic.StoreInt32(&cons.quit, 1)
+		cons.guard.Lock()
+		if cons.client != nil {
+			cons.client.Close()
+		}
+		cons.guard.Unlock()
+	}()
+
+	interval := cons.options.KeepAlive / 2
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+	cons.TickerControlLoop(interval, nil, cons.ping)
+}
@@ -0,0 +1,502 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// NATSMetadataSubject is the metadata key storing the subject of a message
+	// received by the NATS consumer.
+	NATSMetadataSubject = "nats_subject"
+
+	// NATSMetadataStream is the metadata key storing the JetStream stream a
+	// message received by the NATS consumer has been read from.
+	NATSMetadataStream = "nats_stream"
+
+	// NATSMetadataSequence is the metadata key storing the JetStream stream
+	// sequence number of a message received by the NATS consumer.
+	NATSMetadataSequence = "nats_sequence"
+)
+
+const (
+	// natsPingInterval is the interval at which the connection is checked.
+	natsPingInterval = 30 * time.Second
+
+	// natsInboxSID is the subscription id of the inbox receiving messages
+	// pulled from JetStream.
+	natsInboxSID = "1"
+)
+
+// NATS consumer plugin
+// Configuration example
+//
+//   - "consumer.NATS":
+//     Enable: true
+//     Address: "localhost:4222"
+//     ClientName: "gollum"
+//     Username: ""
+//     Password: ""
+//     Token: ""
+//     TimeoutSec: 5
+//     RetryDelayMs: 1000
+//     Subjects:
+//   - ">"
+//     QueueGroup: ""
+//     JetStream: ""
+//     Durable: "gollum"
+//     FilterSubject: ""
+//     AckWaitSec: 30
+//     MaxAckPending: 1000
+//     BatchSize: 100
+//     PullTimeoutSec: 5
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//
+// The NATS consumer reads messages from a NATS server, either by subscribing
+// to subjects or by reading from a JetStream stream via a durable pull
+// consumer. The subject of each message is stored in the metadata field
+// "nats_subject". Messages read from JetStream also store the stream name
+// in "nats_stream" and the stream sequence number in "nats_sequence".
+// A W3C trace context sent in the message headers is stored in the metadata
+// fields "traceparent" and "tracestate". New messages are not read while a
+// fuse of the streams this consumer writes to is burned (see the FusePolicy
+// stream setting).
+//
+// Address defines the server to connect to. This can be any ip address and
+// port like "localhost:4222". By default this is set to "localhost:4222".
+//
+// ClientName defines the name of the connection shown by the server.
+// By default this is set to "gollum".
+//
+// Username and Password define the credentials sent to the server.
+// By default both are set to "".
+//
+// Token defines an authentication token sent to the server.
+// By default this is set to "".
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established. By default this is set to 5.
+//
+// RetryDelayMs defines the number of milliseconds to wait before connecting
+// again after the connection has been lost. By default this is set to 1000.
+//
+// Subjects defines the subjects to subscribe to if JetStream is not set.
+// By default this is set to ">", i.e. all subjects.
+//
+// QueueGroup defines the queue group used for all subscriptions if JetStream
+// is not set. Messages are distributed between all subscribers of the same
+// queue group. By default this is set to "".
+//
+// JetStream defines the JetStream stream to read from. If set, the durable
+// consumer named by Durable is created if necessary and messages are pulled
+// in batches. Each message is acknowledged after it has been passed to all
+// streams of this consumer. Messages that are not acknowledged within
+// AckWaitSec are delivered again. By default this is set to "", i.e.
+// Subjects are subscribed instead.
+//
+// Durable defines the name of the durable JetStream consumer. The position in
+// the stream is stored by the server, so this name has to be shared by all
+// instances reading the same messages. An existing consumer is only reused if
+// its configuration matches the settings of this consumer.
+// By default this is set to "gollum".
+//
+// FilterSubject defines a subject used to read only a part of the JetStream
+// stream. By default this is set to "", i.e. all messages are read.
+//
+// AckWaitSec defines the number of seconds JetStream waits for a message to
+// be acknowledged before it is delivered again. If passing a message to the
+// streams takes longer than half of this time, e.g. because of back-pressure,
+// the server is told that the message is still being processed.
+// By default this is set to 30.
+//
+// MaxAckPending defines the maximum number of JetStream messages delivered
+// but not yet acknowledged. By default this is set to 1000.
+//
+// BatchSize defines the maximum number of messages to pull from JetStream at
+// once. By default this is set to 100.
+//
+// PullTimeoutSec defines the number of seconds a pull request waits for new
+// messages. By default this is set to 5.
+//
+// TLS can be set to true to connect to the server via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server's certificate. By default this is set to false.
+type NATS struct {
+	core.ConsumerBase
+	client        *shared.NATSClient
+	guard         *sync.Mutex
+	options       shared.NATSOptions
+	address       string
+	protocol      string
+	tlsConfig     *tls.Config
+	timeout       time.Duration
+	retryDelay    time.Duration
+	subjects      []string
+	queueGroup    string
+	jetStream     string
+	durable       string
+	filterSubject string
+	ackWait       time.Duration
+	maxAckPending int
+	batchSize     int
+	pullTimeout   time.Duration
+	inbox         string
+	inProgress    string
+	progressSent  time.Time
+	lastPing      time.Time
+	sequence      uint64
+	quit          int32
+}
+
+func init() {
+	shared.RuntimeType.Register(NATS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *NATS) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	cons.options.Name = conf.GetString("ClientName", "gollum")
+	cons.options.Username = conf.GetString("Username", "")
+	cons.options.Password = conf.GetString("Password", "")
+	cons.options.Token = conf.GetString("Token", "")
+
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:4222"))
+	cons.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+
+	cons.subjects = conf.GetStringArray("Subjects", []string{">"})
+	cons.queueGroup = conf.GetString("QueueGroup", "")
+	cons.jetStream = conf.GetString("JetStream", "")
+	cons.durable = conf.GetString("Durable", "gollum")
+	cons.filterSubject = conf.GetString("FilterSubject", "")
+	cons.ackWait = time.Duration(conf.GetInt("AckWaitSec", 30)) * time.Second
+	cons.maxAckPending = conf.GetInt("MaxAckPending", 1000)
+	cons.batchSize = conf.GetInt("BatchSize", 100)
+	cons.pullTimeout = time.Duration(conf.GetInt("PullTimeoutSec", 5)) * time.Second
+
+	switch {
+	case cons.jetStream == "" && len(cons.subjects) == 0:
+		return core.NewConsumerError("No subjects configured for consumer.NATS")
+	case cons.jetStream != "" && cons.durable == "":
+		return core.NewConsumerError("No durable consumer configured for consumer.NATS")
+	case strings.ContainsAny(cons.jetStream+cons.durable, ".*> "):
+		return fmt.Errorf("NATS: JetStream and Durable must not contain '.', '*', '>' or spaces")
+	case cons.batchSize < 1:
+		return fmt.Errorf("NATS: BatchSize has to be at least 1")
+	case cons.ackWait <= 0 || cons.pullTimeout <= 0:
+		return fmt.Errorf("NATS: AckWaitSec and PullTimeoutSec have to be at least 1")
+	}
+
+	if conf.GetBool("TLS", false) {
+		cons.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	cons.guard = new(sync.Mutex)
+	return nil
+}
+
+func (cons *NATS) isQuitting() bool {
+	return atomic.LoadInt32(&cons.quit) != 0
+}
+
+// createConsumer creates the durable JetStream consumer or makes sure an
+// existing one matches the configuration.
+func (cons *NATS) createConsumer(client *shared.NATSClient) error {
+	config := map[string]interface{}{
+		"durable_name":    cons.durable,
+		"deliver_policy":  "all",
+		"ack_policy":      "explicit",
+		"ack_wait":        cons.ackWait.Nanoseconds(),
+		"max_ack_pending": cons.maxAckPending,
+	}
+	if cons.filterSubject != "" {
+		config["filter_subject"] = cons.filterSubject
+	}
+	request, _ := json.Marshal(map[string]interface{}{
+		"stream_name": cons.jetStream,
+		"config":      config,
+	})
+
+	subject := fmt.Sprintf("$JS.API.CONSUMER.DURABLE.CREATE.%s.%s", cons.jetStream, cons.durable)
+	response, err := client.Request(subject, request, cons.timeout)
+	if err != nil {
+		return err
+	}
+	return shared.DecodeNATSAPIError(response.Payload)
+}
+
+// connect opens a new connection and subscribes to all subjects or, if
+// JetStream is used, to the inbox receiving pulled messages.
+func (cons *NATS) connect() (*shared.NATSClient, error) {
+	client, err := shared.DialNATS(cons.protocol, cons.address, cons.tlsConfig, cons.timeout, cons.options)
+	if err != nil {
+		return nil, err
+	}
+
+	if cons.jetStream != "" {
+		cons.inbox = shared.NewNATSInbox()
+		if err = cons.createConsumer(client); err == nil {
+			err = client.Subscribe(cons.inbox, "", natsInboxSID)
+		}
+	} else {
+		for i, subject := range cons.subjects {
+			if err = client.Subscribe(subject, cons.queueGroup, strconv.Itoa(i+1)); err != nil {
+				break // ### break, connection lost ###
+			}
+		}
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	cons.client = client
+	cons.lastPing = time.Now()
+
+	if cons.isQuitting() {
+		client.Close()
+		return nil, fmt.Errorf("NATS: shutting down")
+	}
+	return client, nil
+}
+
+func (cons *NATS) disconnect(client *shared.NATSClient) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.client == client {
+		cons.client = nil
+	}
+	client.Close()
+}
+
+// parseAckSubject returns the stream name and the stream sequence number
+// stored in the reply subject of a JetStream message.
+func parseAckSubject(subject string) (string, string) {
+	tokens := strings.Split(subject, ".")
+	switch {
+	case len(tokens) == 9:
+		return tokens[2], tokens[5] // ### return, ack subject without domain ###
+	case len(tokens) >= 11:
+		return tokens[4], tokens[7] // ### return, ack subject with domain and account ###
+	}
+	return "", ""
+}
+
+// enqueue passes a message to all streams. JetStream messages are
+// acknowledged afterwards.
+func (cons *NATS) enqueue(client *shared.NATSClient, received shared.NATSMessage) error {
+	msg := core.NewMessage(cons, received.Payload, atomic.AddUint64(&cons.sequence, 1))
+	msg.Metadata = core.MessageMetadata{NATSMetadataSubject: received.Subject}
+	if received.Header != nil {
+		msg.Metadata = core.ExtractTraceContext(msg.Metadata, received.Header.Get)
+	}
+
+	if cons.jetStream == "" {
+		cons.EnqueueMessage(msg)
+		return nil // ### return, nothing to acknowledge ###
+	}
+
+	stream, sequence := parseAckSubject(received.Reply)
+	msg.Metadata[NATSMetadataStream] = stream
+	msg.Metadata[NATSMetadataSequence] = sequence
+
+	cons.guard.Lock()
+	cons.inProgress = received.Reply
+	cons.progressSent = time.Now()
+	cons.guard.Unlock()
+
+	cons.EnqueueMessage(msg)
+
+	cons.guard.Lock()
+	cons.inProgress = ""
+	cons.guard.Unlock()
+
+	if err := client.Publish(received.Reply, "", []byte("+ACK")); err != nil {
+		return err
+	}
+	return client.Flush()
+}
+
+// subscribe reads messages of the subscribed subjects until the connection
+// is lost.
+func (cons *NATS) subscribe(client *shared.NATSClient) error {
+	for {
+		cons.WaitOnFuse()
+		client.SetReadDeadline(time.Now().Add(3 * natsPingInterval))
+
+		msg, err := client.Read()
+		if err != nil {
+			return err
+		}
+		if msg.Op == shared.NATSOpMsg {
+			cons.enqueue(client, msg)
+		}
+	}
+}
+
+// pull reads batches of messages from JetStream until the connection is
+// lost.
+func (cons *NATS) pull(client *shared.NATSClient) error {
+	subject := fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", cons.jetStream, cons.durable)
+	request, _ := json.Marshal(map[string]interface{}{
+		"batch":   cons.batchSize,
+		"expires": cons.pullTimeout.Nanoseconds(),
+	})
+
+	for {
+		cons.WaitOnFuse()
+		if err := client.Publish(subject, cons.inbox, request); err != nil {
+			return err
+		}
+		if err := client.Flush(); err != nil {
+			return err
+		}
+
+	nextPull:
+		for received := 0; received < cons.batchSize; {
+			client.SetReadDeadline(time.Now().Add(cons.pullTimeout + cons.timeout))
+			msg, err := client.Read()
+			switch {
+			case err != nil:
+				return err
+			case msg.Op != shared.NATSOpMsg || msg.SID != natsInboxSID:
+				continue // ### continue, not a pulled message ###
+			case msg.Status == 100:
+				continue // ### continue, idle heartbeat ###
+			case msg.Status == 404 || msg.Status == 408:
+				break nextPull // ### break, no more messages ###
+			case msg.Status != 0:
+				return fmt.Errorf("NATS: JetStream error - %d %s", msg.Status, msg.Description)
+			}
+
+			if err := cons.enqueue(client, msg); err != nil {
+				return err
+			}
+			received++
+		}
+	}
+}
+
+// read connects to the server and processes messages until the consumer is
+// stopped.
+func (cons *NATS) read() {
+	defer cons.WorkerDone()
+
+	for !cons.isQuitting() {
+		client, err := cons.connect()
+		if err == nil {
+			if cons.jetStream != "" {
+				err = cons.pull(client)
+			} else {
+				err = cons.subscribe(client)
+			}
+			cons.disconnect(client)
+		}
+
+		if err != nil && !cons.isQuitting() {
+			Log.Error.Print("NATS error - ", err)
+			time.Sleep(cons.retryDelay)
+		}
+	}
+}
+
+// tick extends the ack wait of a JetStream message that is still being passed
+// to the streams and checks the connection.
+func (cons *NATS) tick() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if cons.client == nil {
+		return // ### return, not connected ###
+	}
+
+	var err error
+	if cons.inProgress != "" && time.Since(cons.progressSent) >= cons.ackWait/2 {
+		cons.progressSent = time.Now()
+		if err = cons.client.Publish(cons.inProgress, "", []byte("+WPI")); err == nil {
+			err = cons.client.Flush()
+		}
+	}
+	if err == nil && time.Since(cons.lastPing) >= natsPingInterval {
+		cons.lastPing = time.Now()
+		err = cons.client.Ping()
+	}
+	if err != nil {
+		Log.Error.Print("NATS write error - ", err)
+	}
+}
+
+// Consume connects to the server and starts reading.
+func (cons *NATS) Consume(workers *sync.WaitGroup) {
+	atomic.StoreInt32(&cons.quit, 0)
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		cons.read()
+	}()
+
+	defer func() {
+		atomic.StoreInt32(&cons.quit, 1)
+		cons.guard.Lock()
+		if cons.client != nil {
+			cons.client.Close()
+		}
+		cons.guard.Unlock()
+	}()
+
+	cons.TickerControlLoop(time.Second, nil, cons.tick)
+}
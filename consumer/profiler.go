@@ -22,6 +22,7 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,10 +37,18 @@ import (
 //     TemplateCount: 20
 //     Characters: "abcdefghijklmnopqrstuvwxyz .,!;:-_"
 //     Message: "{name:\"%100s\", number: %2d, float: %4f}"
+//     MessageTemplate: ""
+//     SizeDistribution: "uniform"
+//     Pattern: "constant"
+//     Rate: 0
+//     BurstSize: 1000
+//     BurstPauseMs: 1000
+//     RampStartRate: 1
+//     RampDurationSec: 60
 //
 // The profiler plugin generates Runs x Batches messages and send them to the
-// configured streams as fast as possible. This consumer can be used to profile
-// producers and/or configurations.
+// configured streams as fast as possible or following a traffic pattern.
+// This consumer can be used to profile producers and/or configurations.
 //
 // Runs defines the number of messages per batch. By default this is set to
 // 10000.
@@ -59,14 +68,58 @@ import (
 // parameter. I.e. "%200d" will generate a digit between 0 and 200, "%10s" will
 // generate a string with 10 characters, etc..
 // By default this is set to "%256s".
+//
+// MessageTemplate defines a template used to generate a new payload for each
+// message. If set, Message and TemplateCount are ignored. The template may
+// contain the following placeholders:
+// ${string:N} or ${string:MIN-MAX} generates a string of N or MIN to MAX
+// characters. ${int:MIN-MAX} and ${float:MIN-MAX} generate a number in the
+// given range. ${choice:A|B|C} chooses one of the given values.
+// ${timestamp} or ${timestamp:<format>} writes the current time using Go's
+// time.Format function or as "unix" or "unixms" timestamp. The format is set
+// to RFC3339 by default. ${sequence} writes the sequence number of the
+// message and ${ip} writes a random IPv4 address.
+// By default this is set to "".
+//
+// SizeDistribution defines how the length of ${string:MIN-MAX} placeholders
+// is distributed. Valid values are "uniform", "normal" (centered in the range)
+// and "exponential" (most values close to MIN). By default this is set to
+// "uniform".
+//
+// Pattern defines the traffic pattern used to send messages. Valid values are
+// "constant", "burst" and "ramp". By default this is set to "constant".
+//
+// Rate defines the number of messages per second to send. For the "ramp"
+// pattern this is the rate reached at the end of the ramp. Set to 0 to send
+// messages as fast as possible. By default this is set to 0.
+//
+// BurstSize defines the number of messages sent in one burst when Pattern is
+// set to "burst". Messages are sent as fast as possible or limited by Rate.
+// By default this is set to 1000.
+//
+// BurstPauseMs defines the number of milliseconds to wait between two bursts.
+// By default this is set to 1000.
+//
+// RampStartRate defines the number of messages per second sent at the start
+// of a ramp. By default this is set to 1.
+//
+// RampDurationSec defines the number of seconds it takes to increase the rate
+// from RampStartRate to Rate. By default this is set to 60.
 type Profiler struct {
 	core.ConsumerBase
-	profileRuns int
-	batches     int
-	templates   [][]byte
-	chars       string
-	message     string
-	quit        bool
+	profileRuns   int
+	batches       int
+	templates     [][]byte
+	chars         string
+	message       string
+	generator     *profilerTemplate
+	pattern       string
+	rate          float64
+	burstSize     int
+	burstPause    time.Duration
+	rampStartRate float64
+	rampDuration  time.Duration
+	quit          bool
 }
 
 var profilerDefaultCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ01234567890 "
@@ -89,9 +142,72 @@ func (cons *Profiler) Configure(conf core.PluginConfig) error {
 	cons.message = conf.GetString("Message", "%# %256s")
 	cons.templates = make([][]byte, numTemplates)
 
+	if template := conf.GetString("MessageTemplate", ""); template != "" {
+		distribution := strings.ToLower(conf.GetString("SizeDistribution", "uniform"))
+		if cons.generator, err = newProfilerTemplate(shared.Unescape(template), cons.chars, distribution); err != nil {
+			return err
+		}
+	}
+
+	cons.rate = float64(conf.GetInt("Rate", 0))
+	cons.burstSize = conf.GetInt("BurstSize", 1000)
+	cons.burstPause = time.Duration(conf.GetInt("BurstPauseMs", 1000)) * time.Millisecond
+	cons.rampStartRate = math.Max(float64(conf.GetInt("RampStartRate", 1)), 1)
+	cons.rampDuration = time.Duration(conf.GetInt("RampDurationSec", 60)) * time.Second
+
+	switch cons.pattern = strings.ToLower(conf.GetString("Pattern", "constant")); cons.pattern {
+	case "constant":
+	case "burst":
+		if cons.burstSize <= 0 {
+			return fmt.Errorf("Profiler: BurstSize must be greater than 0")
+		}
+	case "ramp":
+		if cons.rate <= 0 {
+			return fmt.Errorf("Profiler: The ramp pattern requires a Rate")
+		}
+	default:
+		return fmt.Errorf("Profiler: Unknown pattern \"%s\"", cons.pattern)
+	}
+
 	return nil
 }
 
+// currentRate returns the number of messages per second to send at the given
+// time since the start of the profile run. 0 means no limit.
+func (cons *Profiler) currentRate(elapsed time.Duration) float64 {
+	if cons.pattern != "ramp" || elapsed >= cons.rampDuration {
+		return cons.rate
+	}
+	progress := float64(elapsed) / float64(cons.rampDuration)
+	return cons.rampStartRate + (cons.rate-cons.rampStartRate)*progress
+}
+
+// wait paces the profile run according to the traffic pattern. count is the
+// number of messages sent so far, nextDue the time the next message is due.
+func (cons *Profiler) wait(count int, testStart time.Time, nextDue time.Time) time.Time {
+	if cons.pattern == "burst" && count%cons.burstSize == 0 {
+		time.Sleep(cons.burstPause)
+		return time.Now() // ### return, start new burst ###
+	}
+
+	now := time.Now()
+	rate := cons.currentRate(now.Sub(testStart))
+	if rate <= 0 {
+		return now // ### return, no limit ###
+	}
+
+	if nextDue.Before(now.Add(-time.Second)) {
+		nextDue = now // Do not catch up after a stall
+	}
+	nextDue = nextDue.Add(time.Duration(float64(time.Second) / rate))
+
+	// Sleep in intervals of at least 1ms to reduce scheduling overhead
+	if delay := nextDue.Sub(now); delay >= time.Millisecond {
+		time.Sleep(delay)
+	}
+	return nextDue
+}
+
 func (cons *Profiler) generateString(size int) string {
 	randString := make([]byte, size)
 	for i := 0; i < size; i++ {
@@ -155,11 +271,14 @@ func (cons *Profiler) generateTemplate() []byte {
 }
 
 func (cons *Profiler) profile() {
-	for i := 0; i < len(cons.templates); i++ {
-		cons.templates[i] = cons.generateTemplate()
+	if cons.generator == nil {
+		for i := 0; i < len(cons.templates); i++ {
+			cons.templates[i] = cons.generateTemplate()
+		}
 	}
 
 	testStart := time.Now()
+	nextDue := testStart
 	minTime := math.MaxFloat64
 	maxTime := 0.0
 
@@ -168,8 +287,17 @@ func (cons *Profiler) profile() {
 		start := time.Now()
 
 		for i := 0; i < cons.profileRuns && !cons.quit; i++ {
-			template := cons.templates[rand.Intn(len(cons.templates))]
-			cons.EnqueueCopy(template, uint64(b*cons.profileRuns+i))
+			sequence := b*cons.profileRuns + i
+			if sequence > 0 {
+				nextDue = cons.wait(sequence, testStart, nextDue)
+			}
+
+			if cons.generator != nil {
+				cons.Enqueue(cons.generator.generate(uint64(sequence)), uint64(sequence))
+			} else {
+				template := cons.templates[rand.Intn(len(cons.templates))]
+				cons.EnqueueCopy(template, uint64(sequence))
+			}
 		}
 
 		runTime := time.Since(start)
@@ -194,8 +322,12 @@ func (cons *Profiler) profile() {
 		maxTime,
 		float64(cons.profileRuns)/maxTime))
 
-	proc, _ := os.FindProcess(os.Getpid())
-	proc.Signal(os.Interrupt)
+	// Only trigger a shutdown if the profile run was not aborted, i.e. gollum
+	// is not already shutting down.
+	if !cons.quit {
+		proc, _ := os.FindProcess(os.Getpid())
+		proc.Signal(os.Interrupt)
+	}
 }
 
 // Consume starts a profile run and exits gollum when done
@@ -0,0 +1,236 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type profilerFieldType int
+
+const (
+	profilerText      = profilerFieldType(iota)
+	profilerString    = profilerFieldType(iota)
+	profilerInt       = profilerFieldType(iota)
+	profilerFloat     = profilerFieldType(iota)
+	profilerChoice    = profilerFieldType(iota)
+	profilerTimestamp = profilerFieldType(iota)
+	profilerSequence  = profilerFieldType(iota)
+	profilerIP        = profilerFieldType(iota)
+)
+
+type profilerField struct {
+	kind    profilerFieldType
+	text    string
+	choices []string
+	min     float64
+	max     float64
+}
+
+// profilerTemplate generates message payloads from a template containing
+// ${...} placeholders.
+type profilerTemplate struct {
+	fields       []profilerField
+	chars        string
+	distribution string
+}
+
+// newProfilerTemplate parses a template string. Placeholders with unknown
+// names or invalid parameters are reported as error.
+func newProfilerTemplate(template string, chars string, distribution string) (*profilerTemplate, error) {
+	switch distribution {
+	case "uniform", "normal", "exponential":
+	default:
+		return nil, fmt.Errorf("Profiler: Unknown size distribution \"%s\"", distribution)
+	}
+
+	tpl := &profilerTemplate{chars: chars, distribution: distribution}
+	for {
+		start := strings.Index(template, "${")
+		if start == -1 {
+			break // ### break, no more placeholders ###
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end == -1 {
+			break // ### break, not terminated ###
+		}
+		end += start
+
+		tpl.addText(template[:start])
+		field, err := parseProfilerField(template[start+2 : end])
+		if err != nil {
+			return nil, err
+		}
+		tpl.fields = append(tpl.fields, field)
+		template = template[end+1:]
+	}
+
+	tpl.addText(template)
+	return tpl, nil
+}
+
+func (tpl *profilerTemplate) addText(text string) {
+	if text != "" {
+		tpl.fields = append(tpl.fields, profilerField{kind: profilerText, text: text})
+	}
+}
+
+// parseProfilerRange parses "N" or "MIN-MAX".
+func parseProfilerRange(value string) (float64, float64, error) {
+	separator := -1
+	if len(value) > 1 {
+		if separator = strings.IndexByte(value[1:], '-'); separator != -1 {
+			separator++
+		}
+	}
+
+	if separator == -1 {
+		single, err := strconv.ParseFloat(value, 64)
+		return single, single, err
+	}
+
+	min, err := strconv.ParseFloat(value[:separator], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseFloat(value[separator+1:], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("%s is not a valid range", value)
+	}
+	return min, max, nil
+}
+
+func parseProfilerField(placeholder string) (profilerField, error) {
+	name, args := placeholder, ""
+	if colon := strings.IndexByte(placeholder, ':'); colon != -1 {
+		name, args = placeholder[:colon], placeholder[colon+1:]
+	}
+
+	field := profilerField{}
+	switch name {
+	case "string", "int", "float":
+		if args == "" {
+			return field, fmt.Errorf("Profiler: ${%s} requires a size or range", placeholder)
+		}
+		var err error
+		if field.min, field.max, err = parseProfilerRange(args); err != nil {
+			return field, fmt.Errorf("Profiler: ${%s}: %s", placeholder, err.Error())
+		}
+		switch name {
+		case "string":
+			field.kind = profilerString
+		case "int":
+			field.kind = profilerInt
+		default:
+			field.kind = profilerFloat
+		}
+
+	case "choice":
+		field.kind = profilerChoice
+		field.choices = strings.Split(args, "|")
+
+	case "timestamp":
+		field.kind = profilerTimestamp
+		if field.text = args; field.text == "" {
+			field.text = time.RFC3339
+		}
+
+	case "sequence":
+		field.kind = profilerSequence
+
+	case "ip":
+		field.kind = profilerIP
+
+	default:
+		return field, fmt.Errorf("Profiler: Unknown placeholder ${%s}", placeholder)
+	}
+
+	return field, nil
+}
+
+// size returns a random length between min and max following the configured
+// size distribution.
+func (tpl *profilerTemplate) size(min float64, max float64) int {
+	var size float64
+	switch tpl.distribution {
+	case "normal":
+		// The range covers 3 standard deviations around the center
+		size = (min+max)/2 + rand.NormFloat64()*(max-min)/6
+	case "exponential":
+		// 95% of all values are within the range
+		size = min + rand.ExpFloat64()*(max-min)/3
+	default:
+		size = min + rand.Float64()*(max-min+1)
+	}
+	return int(math.Max(min, math.Min(max, size)))
+}
+
+func (tpl *profilerTemplate) appendString(payload []byte, size int) []byte {
+	for i := 0; i < size; i++ {
+		payload = append(payload, tpl.chars[rand.Intn(len(tpl.chars))])
+	}
+	return payload
+}
+
+// generate creates a new payload from the template.
+func (tpl *profilerTemplate) generate(sequence uint64) []byte {
+	payload := make([]byte, 0, 256)
+	for _, field := range tpl.fields {
+		switch field.kind {
+		case profilerText:
+			payload = append(payload, field.text...)
+
+		case profilerString:
+			payload = tpl.appendString(payload, tpl.size(field.min, field.max))
+
+		case profilerInt:
+			value := int64(field.min) + rand.Int63n(int64(field.max)-int64(field.min)+1)
+			payload = strconv.AppendInt(payload, value, 10)
+
+		case profilerFloat:
+			value := field.min + rand.Float64()*(field.max-field.min)
+			payload = strconv.AppendFloat(payload, value, 'f', -1, 64)
+
+		case profilerChoice:
+			payload = append(payload, field.choices[rand.Intn(len(field.choices))]...)
+
+		case profilerTimestamp:
+			switch now := time.Now(); field.text {
+			case "unix":
+				payload = strconv.AppendInt(payload, now.Unix(), 10)
+			case "unixms":
+				payload = strconv.AppendInt(payload, now.UnixNano()/int64(time.Millisecond), 10)
+			default:
+				payload = now.AppendFormat(payload, field.text)
+			}
+
+		case profilerSequence:
+			payload = strconv.AppendUint(payload, sequence, 10)
+
+		case profilerIP:
+			ip := rand.Uint32()
+			payload = append(payload, fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))...)
+		}
+	}
+	return payload
+}
@@ -0,0 +1,362 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pubSubScope = "https://www.googleapis.com/auth/pubsub"
+	// PubSubMetadataMessageID is the metadata key storing the Pub/Sub message id
+	PubSubMetadataMessageID = "pubsub_message_id"
+	// PubSubMetadataOrderingKey is the metadata key storing the ordering key
+	PubSubMetadataOrderingKey = "pubsub_ordering_key"
+)
+
+// PubSub consumer plugin
+// Configuration example
+//
+//   - "consumer.PubSub":
+//     Enable: true
+//     Project: "my-project"
+//     Subscription: "gollum"
+//     CredentialsFile: ""
+//     Endpoint: "https://pubsub.googleapis.com"
+//     MaxMessages: 100
+//     Workers: 1
+//     MaxOutstandingMessages: 1000
+//     MaxOutstandingKB: 0
+//     AckDeadlineSec: 60
+//     AttributePrefix: ""
+//     UsePublishTime: true
+//     RetryDelayMs: 5000
+//     Stream: "pubsub"
+//
+// The PubSub consumer reads messages from a Google Cloud Pub/Sub subscription
+// by using synchronous pull requests. Messages are acknowledged after they
+// have been passed to all streams this consumer writes to. Messages are not
+// acknowledged if gollum stops before that, so Pub/Sub sends them again after
+// the ack deadline. Messages still buffered by producers when gollum crashes
+// are lost. No new messages are pulled while a fuse of the streams this
+// consumer writes to is burned. The message attributes are attached as
+// metadata together with the fields "pubsub_message_id" and
+// "pubsub_ordering_key" (if set).
+//
+// Project defines the Google Cloud project containing the subscription. This
+// setting is mandatory.
+//
+// Subscription defines the subscription to read from. This setting is
+// mandatory.
+//
+// CredentialsFile defines a service account key or user credentials file. If
+// empty the file named by GOOGLE_APPLICATION_CREDENTIALS is used. If this is
+// not set either, credentials are requested from the metadata server, e.g. to
+// use workload identity on Kubernetes Engine. By default this is set to "".
+//
+// Endpoint defines the URL of the Pub/Sub API.
+// By default this is set to "https://pubsub.googleapis.com".
+//
+// MaxMessages defines the maximum number of messages requested per pull
+// request. By default this is set to 100.
+//
+// Workers defines the number of pull requests sent concurrently. Set this to 1
+// to keep the order of messages sharing an ordering key.
+// By default this is set to 1.
+//
+// MaxOutstandingMessages defines the maximum number of messages that have been
+// received but not yet acknowledged. By default this is set to 1000.
+//
+// MaxOutstandingKB defines the maximum size of messages in KB that have been
+// received but not yet acknowledged. Pulling stops once this size is reached.
+// By default this is set to 0, i.e. there is no limit.
+//
+// AckDeadlineSec defines the number of seconds Pub/Sub waits for an
+// acknowledgement before sending a message again. The deadline is extended
+// while messages are being passed to the streams. Set to 0 to use the
+// deadline of the subscription without extensions. By default this is set to 60.
+//
+// AttributePrefix defines the prefix added to the name of message attributes
+// when storing them as metadata. By default this is set to "".
+//
+// UsePublishTime can be set to false to not use the time a message has been
+// published as message timestamp. By default this is set to true.
+//
+// RetryDelayMs defines the number of milliseconds to wait before pulling again
+// after an error. By default this is set to 5000.
+type PubSub struct {
+	core.ConsumerBase
+	client          *http.Client
+	credentials     *shared.GoogleCredentials
+	subscriptionURL string
+	maxMessages     int
+	workers         int
+	maxOutstanding  int
+	maxBytes        int
+	outstanding     int
+	bytes           int
+	ackDeadline     int
+	attributePrefix string
+	usePublishTime  bool
+	retryDelay      time.Duration
+	guard           *sync.Mutex
+	available       *sync.Cond
+	sequence        *uint64
+	context         context.Context
+	cancel          context.CancelFunc
+}
+
+type pubSubReceivedMessage struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Data        string            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+}
+
+type pubSubPullResponse struct {
+	ReceivedMessages []pubSubReceivedMessage `json:"receivedMessages"`
+}
+
+func init() {
+	shared.RuntimeType.Register(PubSub{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PubSub) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	project := conf.GetString("Project", "")
+	subscription := conf.GetString("Subscription", "")
+	if project == "" || subscription == "" {
+		return fmt.Errorf("PubSub: Project and Subscription must be set")
+	}
+
+	endpoint := strings.TrimRight(conf.GetString("Endpoint", "https://pubsub.googleapis.com"), "/")
+	cons.subscriptionURL = fmt.Sprintf("%s/v1/projects/%s/subscriptions/%s", endpoint, url.PathEscape(project), url.PathEscape(subscription))
+
+	if cons.credentials, err = shared.NewGoogleCredentials(conf.GetString("CredentialsFile", ""), pubSubScope); err != nil {
+		return err
+	}
+
+	cons.maxMessages = conf.GetInt("MaxMessages", 100)
+	cons.workers = conf.GetInt("Workers", 1)
+	cons.maxOutstanding = conf.GetInt("MaxOutstandingMessages", 1000)
+	cons.maxBytes = conf.GetInt("MaxOutstandingKB", 0) << 10
+	cons.ackDeadline = conf.GetInt("AckDeadlineSec", 60)
+	cons.attributePrefix = conf.GetString("AttributePrefix", "")
+	cons.usePublishTime = conf.GetBool("UsePublishTime", true)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 5000)) * time.Millisecond
+
+	if cons.maxMessages < 1 || cons.workers < 1 || cons.maxOutstanding < 1 {
+		return fmt.Errorf("PubSub: MaxMessages, Workers and MaxOutstandingMessages must be greater than 0")
+	}
+
+	// Pull requests may wait up to 90 seconds for messages
+	cons.client = &http.Client{Timeout: 2 * time.Minute}
+	cons.guard = new(sync.Mutex)
+	cons.available = sync.NewCond(cons.guard)
+	cons.sequence = new(uint64)
+	cons.context, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (cons *PubSub) isStopped() bool {
+	return cons.context.Err() != nil
+}
+
+// acquire blocks until messages may be pulled and returns the number of
+// messages to request.
+func (cons *PubSub) acquire() int {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	for !cons.isStopped() && (cons.outstanding >= cons.maxOutstanding || (cons.maxBytes > 0 && cons.bytes >= cons.maxBytes)) {
+		cons.available.Wait()
+	}
+
+	count := cons.maxOutstanding - cons.outstanding
+	if count > cons.maxMessages {
+		count = cons.maxMessages
+	}
+	cons.outstanding += count
+	return count
+}
+
+// release returns messages and bytes acquired by acquire or received.
+func (cons *PubSub) release(count int, bytes int) {
+	cons.guard.Lock()
+	cons.outstanding -= count
+	cons.bytes -= bytes
+	cons.guard.Unlock()
+	cons.available.Broadcast()
+}
+
+func (cons *PubSub) post(ctx context.Context, method string, request interface{}, response interface{}) error {
+	return cons.credentials.Post(ctx, cons.client, cons.subscriptionURL+":"+method, request, response)
+}
+
+// modifyAckDeadline sets the ack deadline of the given messages.
+func (cons *PubSub) modifyAckDeadline(ackIDs []string, seconds int) {
+	request := map[string]interface{}{"ackIds": ackIDs, "ackDeadlineSeconds": seconds}
+	if err := cons.post(context.Background(), "modifyAckDeadline", request, nil); err != nil {
+		Log.Warning.Print("PubSub could not modify ack deadline: ", err)
+	}
+}
+
+// extendAckDeadline extends the ack deadline of the given messages until done
+// is closed.
+func (cons *PubSub) extendAckDeadline(ackIDs []string, done <-chan struct{}) {
+	defer cons.WorkerDone()
+	ticker := time.NewTicker(time.Duration(cons.ackDeadline) * time.Second * 2 / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return // ### return, processed ###
+		case <-ticker.C:
+			cons.modifyAckDeadline(ackIDs, cons.ackDeadline)
+		}
+	}
+}
+
+func (cons *PubSub) newMessage(received pubSubReceivedMessage) (core.Message, error) {
+	data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+	if err != nil {
+		return core.Message{}, err
+	}
+
+	msg := core.NewMessage(cons, data, atomic.AddUint64(cons.sequence, 1))
+	if cons.usePublishTime {
+		if published, err := time.Parse(time.RFC3339Nano, received.Message.PublishTime); err == nil {
+			msg.Timestamp = published
+		}
+	}
+
+	msg.Metadata = make(core.MessageMetadata, len(received.Message.Attributes)+2)
+	for key, value := range received.Message.Attributes {
+		msg.Metadata[cons.attributePrefix+key] = value
+	}
+	msg.Metadata[PubSubMetadataMessageID] = received.Message.MessageID
+	if received.Message.OrderingKey != "" {
+		msg.Metadata[PubSubMetadataOrderingKey] = received.Message.OrderingKey
+	}
+	return msg, nil
+}
+
+// process passes received messages to the streams and acknowledges them.
+func (cons *PubSub) process(messages []pubSubReceivedMessage) {
+	ackIDs := make([]string, 0, len(messages))
+	for _, received := range messages {
+		ackIDs = append(ackIDs, received.AckID)
+	}
+
+	if cons.ackDeadline > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		cons.AddWorker()
+		go cons.extendAckDeadline(ackIDs, done)
+	}
+
+	for _, received := range messages {
+		msg, err := cons.newMessage(received)
+		if err != nil {
+			Log.Error.Printf("PubSub invalid message %s - %s", received.Message.MessageID, err.Error())
+			continue // ### continue, acknowledge invalid messages ###
+		}
+		cons.EnqueueMessage(msg)
+	}
+
+	if err := cons.post(context.Background(), "acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil); err != nil {
+		Log.Error.Print("PubSub acknowledge failed: ", err)
+	}
+}
+
+func (cons *PubSub) pullLoop() {
+	defer cons.WorkerDone()
+
+	for !cons.isStopped() {
+		cons.WaitOnFuse()
+		count := cons.acquire()
+		if cons.isStopped() {
+			cons.release(count, 0)
+			return // ### return, stopped ###
+		}
+
+		response := pubSubPullResponse{}
+		err := cons.post(cons.context, "pull", map[string]interface{}{"maxMessages": count}, &response)
+		if err != nil {
+			cons.release(count, 0)
+			if cons.isStopped() {
+				return // ### return, stopped ###
+			}
+			Log.Error.Print("PubSub pull failed: ", err)
+			select {
+			case <-cons.context.Done():
+			case <-time.After(cons.retryDelay):
+			}
+			continue // ### continue, retry ###
+		}
+
+		received := response.ReceivedMessages
+		size := 0
+		for _, msg := range received {
+			size += len(msg.Message.Data) * 3 / 4
+		}
+
+		cons.release(count-len(received), -size)
+		if len(received) > 0 {
+			cons.process(received)
+		}
+		cons.release(len(received), size)
+	}
+}
+
+// Consume starts pulling messages from the subscription.
+func (cons *PubSub) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go cons.pullLoop()
+	for i := 1; i < cons.workers; i++ {
+		cons.AddWorker()
+		go cons.pullLoop()
+	}
+
+	defer func() {
+		cons.cancel()
+		cons.guard.Lock()
+		cons.available.Broadcast()
+		cons.guard.Unlock()
+	}()
+
+	cons.DefaultControlLoop(nil)
+}
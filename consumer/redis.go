@@ -0,0 +1,474 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"gopkg.in/redis.v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisStreamPending = "0"
+	redisStreamNew     = ">"
+)
+
+// Redis consumer plugin
+// Configuration example
+//
+//   - "consumer.Redis":
+//     Enable: true
+//     Address: "127.0.0.1:6379"
+//     Database: 0
+//     Key: "gollum"
+//     Storage: "stream"
+//     Group: "gollum"
+//     Consumer: "gollum01"
+//     ProcessingKey: "gollum:processing"
+//     Field: "data"
+//     BatchSize: 100
+//     TimeoutMs: 1000
+//     ReclaimIdleMs: 60000
+//
+// The redis consumer reads messages from a redis list or a redis stream.
+// Values are removed from the list or acknowledged in the stream after all
+// producers the message has been passed to confirmed it (see
+// ConsumerBase.EnqueueTracked), i.e. after a successful batch flush for
+// producers writing through a MessageBatch (e.g. File or Socket) and after the
+// message has been processed for all other producers. Values that have not
+// been confirmed are read again after a restart, so values may be passed on
+// more than once. Producers buffering messages without a MessageBatch confirm
+// messages before they are sent, so values buffered by these producers can be
+// lost on a crash.
+//
+// Address stores the identifier to connect to.
+// This can either be any ip address and port like "localhost:6379" or a file
+// like "unix:///var/redis.socket". By default this is set to ":6379".
+//
+// Database defines the redis database to connect to.
+// By default this is set to 0.
+//
+// Key defines the redis key to read values from.
+// By default this is set to "default".
+//
+// Storage defines the type of the storage to read from. Valid values are
+// "list" and "stream". Lists are read by using BRPOPLPUSH, i.e. values are
+// moved to the processing list when they are read and removed from it after
+// they have been confirmed. Values left in the processing list are moved back
+// to the list on startup (requires redis 6.2). Streams are read by using a
+// consumer group. Entries stay pending until they have been confirmed.
+// By default this is set to "list".
+//
+// Group defines the consumer group used when reading from a stream. The group
+// is created if it does not exist. By default this is set to "gollum".
+//
+// Consumer defines the name of this consumer inside the consumer group.
+// The name has to be stable between restarts so that pending entries can be
+// processed again. By default this is set to the hostname.
+//
+// ProcessingKey defines the list values are moved to while they are being
+// processed when reading from a list. Every consumer reading the same list
+// needs its own processing list. By default this is set to
+// "<Key>:processing:<Consumer>".
+//
+// Field defines the field of a stream entry that is used as message payload.
+// Entries without this field are acknowledged and ignored.
+// By default this is set to "data".
+//
+// BatchSize defines the maximum number of stream entries to read at once.
+// By default this is set to 100.
+//
+// TimeoutMs defines the number of milliseconds to block while waiting for new
+// values. Lists only support a resolution of seconds, so this value is rounded
+// up to the next second for lists. By default this is set to 1000.
+//
+// ReclaimIdleMs defines the number of milliseconds an entry has to be pending
+// in the consumer group before it is claimed by this consumer on startup.
+// This allows processing entries of consumers that are not available anymore.
+// Set to 0 to only process the pending entries of this consumer.
+// By default this is set to 0.
+type Redis struct {
+	core.ConsumerBase
+	address     string
+	protocol    string
+	password    string
+	database    int64
+	key         string
+	group       string
+	consumer    string
+	processing  string
+	field       string
+	batchSize   int
+	timeout     time.Duration
+	reclaimIdle time.Duration
+	client      *redis.Client
+	read        func()
+	acknowledge func([]string)
+	confirmed   []string
+	confirmLock *sync.Mutex
+	sequence    uint64
+	quit        bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Redis{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Redis) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+
+	cons.password = conf.GetString("Password", "")
+	cons.database = int64(conf.GetInt("Database", 0))
+	cons.key = conf.GetString("Key", "default")
+	cons.group = conf.GetString("Group", "gollum")
+	cons.consumer = conf.GetString("Consumer", hostname)
+	cons.processing = conf.GetString("ProcessingKey", cons.key+":processing:"+cons.consumer)
+	cons.field = conf.GetString("Field", "data")
+	cons.batchSize = conf.GetInt("BatchSize", 100)
+	cons.timeout = time.Duration(conf.GetInt("TimeoutMs", 1000)) * time.Millisecond
+	cons.reclaimIdle = time.Duration(conf.GetInt("ReclaimIdleMs", 0)) * time.Millisecond
+	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":6379"))
+
+	storage := strings.ToLower(conf.GetString("Storage", "list"))
+	switch storage {
+	case "list":
+		cons.read = cons.readList
+		cons.acknowledge = cons.acknowledgeList
+	case "stream":
+		cons.read = cons.readStream
+		cons.acknowledge = cons.acknowledgeStream
+	default:
+		return core.NewConsumerError("Unknown storage type for consumer.Redis: ", storage)
+	}
+
+	cons.confirmLock = new(sync.Mutex)
+	if cons.batchSize < 1 {
+		cons.batchSize = 1
+	}
+	if cons.timeout < time.Millisecond {
+		cons.timeout = time.Millisecond
+	}
+
+	if cons.consumer == "" {
+		return core.NewConsumerError("No consumer name configured for consumer.Redis")
+	}
+
+	return nil
+}
+
+// confirm stores a value or entry id that is acknowledged by the next call
+// to flushConfirmed. This function is called by producers.
+func (cons *Redis) confirm(value string) {
+	cons.confirmLock.Lock()
+	cons.confirmed = append(cons.confirmed, value)
+	cons.confirmLock.Unlock()
+}
+
+// flushConfirmed acknowledges all values and entry ids confirmed since the
+// last call.
+func (cons *Redis) flushConfirmed() {
+	cons.confirmLock.Lock()
+	confirmed := cons.confirmed
+	cons.confirmed = nil
+	cons.confirmLock.Unlock()
+
+	if len(confirmed) > 0 {
+		cons.acknowledge(confirmed)
+	}
+}
+
+// acknowledgeList removes confirmed values from the processing list.
+func (cons *Redis) acknowledgeList(values []string) {
+	for _, value := range values {
+		if err := cons.client.LRem(cons.processing, 1, value).Err(); err != nil {
+			Log.Error.Print("Redis: ", err)
+		}
+	}
+}
+
+// acknowledgeStream acknowledges confirmed entries in the consumer group.
+func (cons *Redis) acknowledgeStream(ids []string) {
+	cmd := redis.NewIntCmd(append([]string{"XACK", cons.key, cons.group}, ids...)...)
+	cons.client.Process(cmd)
+	if err := cmd.Err(); err != nil {
+		Log.Error.Print("Redis: ", err)
+	}
+}
+
+// requeue moves all values left in the processing list back to the list.
+// These values have not been confirmed before the last shutdown and are read
+// again in their original order before any other value.
+func (cons *Redis) requeue() error {
+	requeued := 0
+	for !cons.quit {
+		cmd := redis.NewStringCmd("LMOVE", cons.processing, cons.key, "LEFT", "RIGHT")
+		cons.client.Process(cmd)
+
+		switch err := cmd.Err(); {
+		case err == redis.Nil:
+			if requeued > 0 {
+				Log.Note.Printf("Redis: Requeued %d unconfirmed values of %s", requeued, cons.key)
+			}
+			return nil // ### return, done ###
+		case err != nil:
+			return err
+		}
+		requeued++
+	}
+	return nil
+}
+
+func (cons *Redis) readList() {
+	defer cons.WorkerDone()
+	defer cons.flushConfirmed()
+
+	for !cons.quit {
+		err := cons.requeue()
+		if err == nil {
+			break // ### break, ready ###
+		}
+		Log.Error.Print("Redis: ", err)
+		time.Sleep(cons.timeout)
+	}
+
+	timeoutSec := int64((cons.timeout + time.Second - 1) / time.Second)
+	for !cons.quit {
+		cons.flushConfirmed()
+
+		value, err := cons.client.BRPopLPush(cons.key, cons.processing, timeoutSec).Result()
+		switch {
+		case err == redis.Nil:
+			continue // ### continue, timeout ###
+		case err != nil:
+			if !cons.quit {
+				Log.Error.Print("Redis: ", err)
+				time.Sleep(cons.timeout)
+			}
+			continue // ### continue, try again ###
+		}
+
+		cons.EnqueueTracked([]byte(value), cons.sequence, func() { cons.confirm(value) })
+		cons.sequence++
+	}
+}
+
+// process passes all given stream entries to the streams of this consumer.
+// Entries are acknowledged after they have been confirmed. The number of
+// entries processed and the id of the last entry are returned.
+func (cons *Redis) process(entries []interface{}) (int, string) {
+	lastID := ""
+	for _, entry := range entries {
+		// Each entry is an array of the entry id and a flat field/value array.
+		// The field array is nil if the entry has been deleted in the meantime.
+		entryData, isArray := entry.([]interface{})
+		if !isArray || len(entryData) != 2 {
+			continue // ### continue, unknown format ###
+		}
+
+		id, isString := entryData[0].(string)
+		if !isString {
+			continue // ### continue, unknown format ###
+		}
+		lastID = id
+
+		fields, _ := entryData[1].([]interface{})
+		found := false
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := fields[i].(string); name == cons.field {
+				value, _ := fields[i+1].(string)
+				cons.EnqueueTracked([]byte(value), cons.sequence, func() { cons.confirm(id) })
+				cons.sequence++
+				found = true
+				break // ### break, done ###
+			}
+		}
+
+		if !found {
+			if fields != nil {
+				Log.Warning.Printf("Redis: Entry %s of %s has no field %s", id, cons.key, cons.field)
+			}
+			cons.confirm(id)
+		}
+	}
+
+	return len(entries), lastID
+}
+
+func (cons *Redis) command(args ...string) *redis.SliceCmd {
+	cmd := redis.NewSliceCmd(args...)
+	cons.client.Process(cmd)
+	return cmd
+}
+
+// createGroup creates the consumer group and the stream if necessary.
+func (cons *Redis) createGroup() error {
+	cmd := redis.NewStatusCmd("XGROUP", "CREATE", cons.key, cons.group, "$", "MKSTREAM")
+	cons.client.Process(cmd)
+
+	if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// reclaim moves all entries that are pending for longer than reclaimIdle to
+// this consumer. Claimed entries are handled as pending entries afterwards.
+func (cons *Redis) reclaim() error {
+	minIdle := strconv.FormatInt(int64(cons.reclaimIdle/time.Millisecond), 10)
+	count := strconv.Itoa(cons.batchSize)
+	cursor := "0-0"
+
+	for !cons.quit {
+		result, err := cons.command("XAUTOCLAIM", cons.key, cons.group, cons.consumer, minIdle, cursor, "COUNT", count, "JUSTID").Result()
+		if err != nil {
+			return err
+		}
+		if len(result) < 2 {
+			return fmt.Errorf("Unexpected XAUTOCLAIM response")
+		}
+
+		claimed, _ := result[1].([]interface{})
+		if len(claimed) > 0 {
+			Log.Note.Printf("Redis: Claimed %d pending entries of %s", len(claimed), cons.key)
+		}
+
+		cursor, _ = result[0].(string)
+		if cursor == "0-0" || cursor == "" {
+			return nil // ### return, done ###
+		}
+	}
+	return nil
+}
+
+// readGroup reads a batch of entries starting at the given id. Returns the
+// number of entries processed and the id of the last entry.
+func (cons *Redis) readGroup(id string) (int, string, error) {
+	timeoutMs := strconv.FormatInt(int64(cons.timeout/time.Millisecond), 10)
+	count := strconv.Itoa(cons.batchSize)
+
+	args := []string{"XREADGROUP", "GROUP", cons.group, cons.consumer, "COUNT", count}
+	if id == redisStreamNew {
+		args = append(args, "BLOCK", timeoutMs)
+	}
+	args = append(args, "STREAMS", cons.key, id)
+
+	result, err := cons.command(args...).Result()
+	if err == redis.Nil {
+		return 0, "", nil // ### return, timeout ###
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	processed, lastID := 0, ""
+	for _, stream := range result {
+		// Each stream is returned as an array of the key and the entries
+		streamData, isArray := stream.([]interface{})
+		if !isArray || len(streamData) != 2 {
+			continue // ### continue, unknown format ###
+		}
+		entries, _ := streamData[1].([]interface{})
+		count, id := cons.process(entries)
+		if id != "" {
+			lastID = id
+		}
+		processed += count
+	}
+	return processed, lastID, nil
+}
+
+func (cons *Redis) readStream() {
+	defer cons.WorkerDone()
+	defer cons.flushConfirmed()
+
+	for !cons.quit {
+		err := cons.createGroup()
+		if err == nil && cons.reclaimIdle > 0 {
+			err = cons.reclaim()
+		}
+		if err == nil {
+			break // ### break, ready ###
+		}
+		Log.Error.Print("Redis: ", err)
+		time.Sleep(cons.timeout)
+	}
+
+	// Entries that have been delivered to this consumer but have not been
+	// acknowledged (e.g. because of a crash) are processed first. Pending
+	// entries stay pending until they are confirmed, so reading continues
+	// after the last pending entry read.
+	startID := redisStreamPending
+	for !cons.quit {
+		cons.flushConfirmed()
+
+		processed, lastID, err := cons.readGroup(startID)
+		if err != nil {
+			if !cons.quit {
+				Log.Error.Print("Redis: ", err)
+				time.Sleep(cons.timeout)
+			}
+			continue // ### continue, try again ###
+		}
+
+		if startID != redisStreamNew {
+			if processed == 0 || lastID == "" {
+				startID = redisStreamNew
+			} else {
+				startID = lastID
+			}
+		}
+	}
+}
+
+// Consume connects to the redis server and starts reading.
+func (cons *Redis) Consume(workers *sync.WaitGroup) {
+	cons.quit = false
+	cons.client = redis.NewClient(&redis.Options{
+		Addr:     cons.address,
+		Network:  cons.protocol,
+		Password: cons.password,
+		DB:       cons.database,
+	})
+
+	if _, err := cons.client.Ping().Result(); err != nil {
+		Log.Error.Print("Redis: ", err)
+	}
+
+	go func() {
+		defer shared.RecoverShutdown()
+		cons.AddMainWorker(workers)
+		cons.read()
+	}()
+
+	defer func() {
+		cons.quit = true
+		cons.client.Close()
+	}()
+
+	cons.DefaultControlLoop(nil)
+}
@@ -15,12 +15,18 @@
 package consumer
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"io"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,8 +35,13 @@ import (
 
 const (
 	socketBufferGrowSize = 256
+	socketHandshakeMax   = 4096
 )
 
+// SocketMetadataClient is the metadata key storing the name of a client that
+// has been authenticated by the socket consumer.
+const SocketMetadataClient = "socket_client"
+
 // Socket consumer plugin
 // Configuration example
 //
@@ -41,13 +52,38 @@ const (
 //     Partitioner: "ascii"
 //     Delimiter: ":"
 //     Offset: 1
+//     TLSCert: "/etc/gollum/server.crt"
+//     TLSKey: "/etc/gollum/server.key"
+//     TLSClientCA: "/etc/gollum/clients.crt"
+//     Listeners: 0
+//     DatagramMaxKB: 64
+//     ReceiveBufferKB: 0
+//     SourceMetadata: false
+//     Permissions: "0770"
+//     PeerCredentials: false
+//     Handshake: ""
+//     HandshakeTimeoutSec: 5
+//     AuthTokens:
+//       "agent": "secret"
+//     AuthBasic:
+//       "user": "password"
+//     AuthCertificates:
+//       - "web01"
+//     AuthStreams:
+//       "agent":
+//         - "logs"
+//     AllowedStreams:
+//       - "logs"
 //
 // The socket consumer reads messages directly as-is from a given socket.
 // Messages are separated from the stream by using a specific paritioner method.
 //
 // Address stores the identifier to bind to.
 // This can either be any ip address and port like "localhost:5880" or a file
-// like "unix:///var/gollum.socket". By default this is set to ":5880".
+// like "unix:///var/gollum.socket". Abstract unix domain sockets (linux only)
+// are prefixed with "@", e.g. "unix://@gollum". A stale socket file left by a
+// previous process is removed before listening. By default this is set to
+// ":5880".
 //
 // Acknowledge can be set to a non-empty value to inform the writer on success
 // or error. On success the given string is send. Any error will close the
@@ -76,6 +112,85 @@ const (
 // Size defines the size in bytes used by the binary or fixed partitioner.
 // For binary this can be set to 1,2,4 or 8. By default 4 is chosen.
 // For fixed this defines the size of a message. By default 1 is chosen.
+//
+// TLSCert defines the path to a PEM encoded certificate. If set, connections
+// are encrypted using TLS and TCP is used even if Acknowledge is not set.
+// By default this is set to "" (TLS disabled).
+//
+// TLSKey defines the path to the PEM encoded private key for TLSCert.
+// By default this is set to "".
+//
+// TLSClientCA defines the path to a PEM encoded list of CA certificates used
+// to verify client certificates. If set, clients have to authenticate with a
+// certificate signed by one of these CAs. The common name and the subject
+// alternative names of the client are attached to each message as the metadata
+// values "tls_cn" and "tls_san". By default this is set to "".
+//
+// Listeners defines the number of UDP sockets opened on Address. If set to a
+// value larger than 1 the sockets are opened with SO_REUSEPORT so that the
+// kernel distributes datagrams between them. Each socket is read by its own
+// go routine. This setting is ignored for TCP and unix domain sockets and not
+// supported on windows. By default this is set to 0, i.e. GOMAXPROCS sockets
+// are opened.
+//
+// DatagramMaxKB defines the maximum size of an UDP datagram in KB. Larger
+// datagrams are truncated. Each UDP datagram is parsed separately. When using
+// the delimiter partitioner a missing delimiter at the end of a datagram is
+// added. By default this is set to 64, which is also the maximum.
+//
+// ReceiveBufferKB defines the size of the receive buffer of each UDP socket
+// in KB. Increase this value if datagrams are dropped during load peaks.
+// By default this is set to 0, i.e. the system default is used.
+//
+// SourceMetadata can be set to true to attach the IP address of the sender of
+// an UDP datagram to each message as the metadata value "source_ip".
+// By default this is set to false.
+//
+// Permissions defines the file permissions of a unix domain socket as octal
+// number, e.g. "0660". This setting is ignored for abstract sockets.
+// By default this is set to "", i.e. the permissions are defined by the umask.
+//
+// PeerCredentials can be set to true to attach the credentials of the process
+// connected to a unix domain socket to each message as the metadata values
+// "peer_uid", "peer_gid" and "peer_pid". This is only supported on linux.
+// By default this is set to false.
+//
+// Handshake defines a preamble a TCP or unix domain socket client has to send
+// as the first line after connecting. The preamble names the stream all
+// messages of this connection are sent to and an optional token, so that one
+// port can serve many applications. If no stream is named the streams
+// configured by Stream are used. Clients that send an invalid preamble or a
+// stream that is not allowed are disconnected. This setting cannot be used
+// with UDP. By default this is set to "" (no handshake).
+//  - "line" expects the stream name optionally followed by a space and the
+//    token, e.g. "logs secret\n".
+//  - "json" expects a JSON object with the fields "stream" and "token", e.g.
+//    {"stream":"logs","token":"secret"}.
+//
+// HandshakeTimeoutSec defines the number of seconds a client has to send the
+// preamble after connecting. By default this is set to 5.
+//
+// AuthTokens maps client names to tokens. Clients send their token in the
+// preamble. By default no tokens are set.
+//
+// AuthBasic maps user names to passwords. Clients send them as the fields
+// "user" and "password" of a JSON preamble. By default no users are set.
+//
+// AuthCertificates lists the common names of the client certificates that are
+// accepted. Certificates have to be verified via TLSClientCA.
+// By default no certificates are set.
+//
+// If any of the Auth settings is set, clients have to authenticate with one of
+// the configured methods. The name of the client is attached to each message
+// as the metadata value "socket_client". AuthTokens and AuthBasic require
+// Handshake to be set. Authentication is not supported for UDP.
+//
+// AuthStreams maps client names to the streams a client may write to,
+// including the streams configured by Stream. Clients not listed may write to
+// any stream. By default this is empty.
+//
+// AllowedStreams defines the streams a client may name in the preamble.
+// If empty any stream is allowed. By default this is empty.
 type Socket struct {
 	core.ConsumerBase
 	listen      io.Closer
@@ -86,6 +201,35 @@ type Socket struct {
 	offset      int
 	quit        bool
 	acknowledge string
+	tlsConfig   *tls.Config
+	listeners   int
+	datagramMax int
+	receiveBuf  int
+	sourceMeta  bool
+	permissions os.FileMode
+	peerCreds   bool
+	handshake   string
+	hsTimeout   time.Duration
+	auth        *core.Authenticator
+}
+
+// socketHandshake is the preamble sent by a client if Handshake is set.
+type socketHandshake struct {
+	Stream   string `json:"stream"`
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// socketPacketConns closes all UDP sockets opened by a socket consumer.
+type socketPacketConns []net.PacketConn
+
+// Close implements the io.Closer interface
+func (conns socketPacketConns) Close() error {
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
 }
 
 func init() {
@@ -102,14 +246,60 @@ func (cons *Socket) Configure(conf core.PluginConfig) error {
 	cons.acknowledge = shared.Unescape(conf.GetString("Acknowledge", ""))
 	cons.address, cons.protocol = shared.ParseAddress(conf.GetString("Address", ":5880"))
 
+	if cons.tlsConfig, err = configureTLS(conf); err != nil {
+		return err
+	}
+
 	if cons.protocol != "unix" {
-		if cons.acknowledge != "" {
+		if cons.acknowledge != "" || cons.tlsConfig != nil {
 			cons.protocol = "tcp"
 		} else {
 			cons.protocol = "udp"
 		}
 	}
 
+	cons.listeners = conf.GetInt("Listeners", 0)
+	if cons.listeners <= 0 {
+		cons.listeners = runtime.GOMAXPROCS(0)
+	}
+	cons.datagramMax = conf.GetInt("DatagramMaxKB", 64) << 10
+	if cons.datagramMax <= 0 || cons.datagramMax > 0xFFFF {
+		cons.datagramMax = 0xFFFF
+	}
+	cons.receiveBuf = conf.GetInt("ReceiveBufferKB", 0) << 10
+	cons.sourceMeta = conf.GetBool("SourceMetadata", false)
+	cons.peerCreds = conf.GetBool("PeerCredentials", false)
+
+	cons.permissions = 0
+	if permissions := conf.GetString("Permissions", ""); permissions != "" {
+		mode, err := strconv.ParseUint(permissions, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Socket: Invalid permissions \"%s\"", permissions)
+		}
+		cons.permissions = os.FileMode(mode)
+	}
+
+	cons.handshake = strings.ToLower(conf.GetString("Handshake", ""))
+	switch cons.handshake {
+	case "", "line", "json":
+	default:
+		return fmt.Errorf("Socket: Unknown handshake \"%s\"", cons.handshake)
+	}
+	cons.hsTimeout = time.Duration(conf.GetInt("HandshakeTimeoutSec", 5)) * time.Second
+	if cons.handshake != "" && cons.protocol == "udp" {
+		return fmt.Errorf("Socket: Handshake is not supported for UDP, set Acknowledge or TLS to use TCP")
+	}
+
+	if cons.auth, err = core.NewAuthenticator(conf); err != nil {
+		return fmt.Errorf("Socket: %s", err)
+	}
+	if cons.auth.IsEnabled() && cons.protocol == "udp" {
+		return fmt.Errorf("Socket: Authentication is not supported for UDP, set Acknowledge or TLS to use TCP")
+	}
+	if cons.auth.HasSecrets() && cons.handshake == "" {
+		return fmt.Errorf("Socket: AuthTokens and AuthBasic require Handshake to be set")
+	}
+
 	cons.delimiter = shared.Unescape(conf.GetString("Delimiter", "\n"))
 	cons.offset = conf.GetInt("Offset", 0)
 	cons.flags = 0
@@ -170,6 +360,50 @@ func (cons *Socket) clientDisconnected(err error) bool {
 	return false
 }
 
+// readHandshake reads the preamble line of a client. The line is read byte by
+// byte so that no message data following the preamble is consumed.
+func (cons *Socket) readHandshake(conn net.Conn) (socketHandshake, error) {
+	var handshake socketHandshake
+	line := make([]byte, 0, 64)
+	char := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(cons.hsTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := conn.Read(char); err != nil {
+			return handshake, err // ### return, read failed ###
+		}
+		if char[0] == '\n' {
+			break // ### break, preamble complete ###
+		}
+		if len(line) == socketHandshakeMax {
+			return handshake, fmt.Errorf("preamble exceeds %d bytes", socketHandshakeMax)
+		}
+		line = append(line, char[0])
+	}
+	line = bytes.TrimRight(line, "\r")
+
+	switch cons.handshake {
+	case "json":
+		if err := json.Unmarshal(line, &handshake); err != nil {
+			return handshake, err // ### return, invalid preamble ###
+		}
+	default:
+		fields := strings.Fields(string(line))
+		switch len(fields) {
+		case 0:
+		case 1:
+			handshake.Stream = fields[0]
+		case 2:
+			handshake.Stream, handshake.Token = fields[0], fields[1]
+		default:
+			return handshake, fmt.Errorf("invalid preamble")
+		}
+	}
+	return handshake, nil
+}
+
 func (cons *Socket) readFromConnection(conn net.Conn) {
 	defer func() {
 		conn.Close()
@@ -178,9 +412,88 @@ func (cons *Socket) readFromConnection(conn net.Conn) {
 
 	conn.SetDeadline(time.Time{})
 	buffer := shared.NewBufferedReader(socketBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	enqueue := cons.Enqueue
+
+	var metadata core.MessageMetadata
+	var commonName string
+
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if err := tlsConn.Handshake(); err != nil {
+			Log.Error.Print("Socket TLS handshake failed: ", err)
+			return // ### return, connection refused ###
+		}
+		state := tlsConn.ConnectionState()
+		metadata = tlsMetadata(state)
+		commonName = tlsCommonName(&state)
+	}
+
+	if unixConn, isUnix := conn.(*net.UnixConn); isUnix && cons.peerCreds {
+		peerMetadata, err := socketPeerMetadata(unixConn)
+		if err != nil {
+			Log.Error.Print("Socket could not read peer credentials: ", err)
+			return // ### return, connection refused ###
+		}
+		for key, value := range metadata {
+			peerMetadata[key] = value
+		}
+		metadata = peerMetadata
+	}
+
+	var streamID core.MessageStreamID
+	var handshake socketHandshake
+	routed := false
+
+	if cons.handshake != "" {
+		var err error
+		if handshake, err = cons.readHandshake(conn); err != nil {
+			Log.Error.Print("Socket handshake failed: ", err)
+			return // ### return, connection refused ###
+		}
+	}
+
+	client, err := cons.auth.Authenticate(core.AuthCredentials{
+		Token:      handshake.Token,
+		User:       handshake.User,
+		Password:   handshake.Password,
+		CommonName: commonName,
+	})
+	if err != nil {
+		Log.Warning.Print("Socket client authentication failed: ", conn.RemoteAddr())
+		return // ### return, connection refused ###
+	}
+
+	if handshake.Stream != "" {
+		streamID, routed = core.GetStreamID(handshake.Stream), true
+		if !cons.auth.IsStreamAllowed(client, streamID) {
+			Log.Warning.Printf("Socket client requested stream %s which is not allowed", handshake.Stream)
+			return // ### return, connection refused ###
+		}
+	} else if !cons.auth.AreDefaultStreamsAllowed(client, cons.Streams()) {
+		Log.Warning.Printf("Socket client %s may not write to the configured streams", client)
+		return // ### return, connection refused ###
+	}
+
+	if client != "" {
+		if metadata == nil {
+			metadata = core.MessageMetadata{}
+		}
+		metadata[SocketMetadataClient] = client
+	}
+
+	if metadata != nil || routed {
+		enqueue = func(data []byte, sequence uint64) {
+			msg := core.NewMessage(cons, data, sequence)
+			msg.Metadata = metadata
+			if routed {
+				cons.EnqueueMessageTo(msg, streamID)
+			} else {
+				cons.EnqueueMessage(msg)
+			}
+		}
+	}
 
 	for !cons.quit {
-		err := buffer.ReadAll(conn, cons.Enqueue)
+		err := buffer.ReadAll(conn, enqueue)
 
 		// Handle errors
 		if err != nil && err != io.EOF {
@@ -199,8 +512,70 @@ func (cons *Socket) readFromConnection(conn net.Conn) {
 	}
 }
 
+func (cons *Socket) readFromPacketConn(conn net.PacketConn) {
+	defer cons.WorkerDone()
+
+	buffer := shared.NewBufferedReader(socketBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	datagram := make([]byte, cons.datagramMax+len(cons.delimiter))
+	appendDelimiter := cons.flags == 0 && cons.delimiter != ""
+	reader := bytes.NewReader(nil)
+
+	for !cons.quit {
+		size, addr, err := conn.ReadFrom(datagram[:cons.datagramMax])
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); !cons.quit && isNetErr && netErr.Temporary() {
+				continue // ### continue, try again ###
+			}
+			if !cons.quit {
+				Log.Error.Print("Socket read failed: ", err)
+			}
+			return // ### return, socket closed ###
+		}
+
+		data := datagram[:size]
+		if appendDelimiter && !bytes.HasSuffix(data, []byte(cons.delimiter)) {
+			data = append(data, cons.delimiter...)
+		}
+
+		enqueue := cons.Enqueue
+		if cons.sourceMeta {
+			sourceIP := addr.String()
+			if udpAddr, isUDP := addr.(*net.UDPAddr); isUDP {
+				sourceIP = udpAddr.IP.String()
+			}
+			enqueue = func(data []byte, sequence uint64) {
+				msg := core.NewMessage(cons, data, sequence)
+				msg.Metadata = core.MessageMetadata{"source_ip": sourceIP}
+				cons.EnqueueMessage(msg)
+			}
+		}
+
+		reader.Reset(data)
+		if err := buffer.ReadAll(reader, enqueue); err != nil && err != io.EOF {
+			Log.Error.Print("Socket parsing failed: ", err)
+		}
+	}
+}
+
 func (cons *Socket) udpAccept() {
-	cons.readFromConnection(cons.listen.(*net.UDPConn))
+	defer cons.WorkerDone()
+
+	conns := cons.listen.(socketPacketConns)
+	for _, conn := range conns {
+		if cons.receiveBuf > 0 {
+			if udpConn, isUDP := conn.(*net.UDPConn); isUDP {
+				if err := udpConn.SetReadBuffer(cons.receiveBuf); err != nil {
+					Log.Warning.Print("Socket could not set receive buffer: ", err)
+				}
+			}
+		}
+
+		cons.AddWorker()
+		go func(conn net.PacketConn) {
+			defer shared.RecoverShutdown()
+			cons.readFromPacketConn(conn)
+		}(conn)
+	}
 }
 
 func (cons *Socket) tcpAccept() {
@@ -224,6 +599,15 @@ func (cons *Socket) tcpAccept() {
 	}
 }
 
+// removeStaleSocket removes the socket file at the configured address if no
+// process is listening to it anymore. Sockets inherited from a previous
+// process are not removed.
+func (cons *Socket) removeStaleSocket() {
+	if err := shared.RemoveStaleSocket(cons.address); err != nil {
+		Log.Warning.Print("Socket could not remove stale socket: ", err)
+	}
+}
+
 // Consume listens to a given socket.
 func (cons *Socket) Consume(workers *sync.WaitGroup) {
 	var err error
@@ -232,17 +616,31 @@ func (cons *Socket) Consume(workers *sync.WaitGroup) {
 	cons.quit = false
 
 	if cons.protocol == "udp" {
-		addr, _ := net.ResolveUDPAddr(cons.protocol, cons.address)
-		if cons.listen, err = net.ListenUDP(cons.protocol, addr); err != nil {
+		var conns []net.PacketConn
+		if conns, err = shared.ListenPacketSockets(cons.protocol, cons.address, cons.listeners); err != nil {
 			Log.Error.Print("Socket connection error: ", err)
 			return
 		}
+		cons.listen = socketPacketConns(conns)
 		listen = cons.udpAccept
 	} else {
-		if cons.listen, err = net.Listen(cons.protocol, cons.address); err != nil {
+		var listener net.Listener
+		if cons.protocol == "unix" {
+			cons.removeStaleSocket()
+		}
+		if listener, err = shared.ListenSocket(cons.protocol, cons.address); err != nil {
 			Log.Error.Print("Socket connection error: ", err)
 			return
 		}
+		if cons.protocol == "unix" && cons.permissions != 0 && !strings.HasPrefix(cons.address, "@") {
+			if err := os.Chmod(cons.address, cons.permissions); err != nil {
+				Log.Error.Print("Socket could not set permissions: ", err)
+			}
+		}
+		if cons.tlsConfig != nil {
+			listener = tls.NewListener(listener, cons.tlsConfig)
+		}
+		cons.listen = listener
 		listen = cons.tcpAccept
 	}
 
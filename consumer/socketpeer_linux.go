@@ -0,0 +1,48 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// socketPeerMetadata returns the credentials of the process connected to
+// the given unix domain socket as metadata.
+func socketPeerMetadata(conn *net.UnixConn) (core.MessageMetadata, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	return core.MessageMetadata{
+		"peer_uid": strconv.FormatUint(uint64(cred.Uid), 10),
+		"peer_gid": strconv.FormatUint(uint64(cred.Gid), 10),
+		"peer_pid": strconv.FormatInt(int64(cred.Pid), 10),
+	}, nil
+}
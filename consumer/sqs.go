@@ -0,0 +1,372 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sqsContentType = "application/x-amz-json-1.0"
+	// SQSMetadataMessageID is the metadata key storing the SQS message id
+	SQSMetadataMessageID = "sqs_message_id"
+	// SQSMetadataGroupID is the metadata key storing the message group id of
+	// messages read from FIFO queues
+	SQSMetadataGroupID = "sqs_group_id"
+)
+
+// SQS consumer plugin
+// Configuration example
+//
+//   - "consumer.SQS":
+//     Enable: true
+//     Region: "eu-west-1"
+//     Queue: "https://sqs.eu-west-1.amazonaws.com/123456789012/logs"
+//     AccessKeyID: ""
+//     SecretAccessKey: ""
+//     Profile: ""
+//     Endpoint: ""
+//     MaxMessages: 10
+//     WaitTimeSec: 20
+//     VisibilityTimeoutSec: 30
+//     Workers: 1
+//     AttributePrefix: ""
+//     UnwrapSNS: false
+//     RetryDelayMs: 5000
+//     Stream: "sqs"
+//
+// The SQS consumer reads messages from an Amazon SQS queue by using long
+// polling. Messages are deleted from the queue after they have been passed to
+// all streams this consumer writes to. The visibility timeout of received
+// messages is extended until then. Messages that have not been deleted
+// because gollum stopped are received again after the visibility timeout.
+// No new messages are received while a fuse of the streams this consumer
+// writes to is burned. The message attributes are attached as metadata
+// together with the fields "sqs_message_id" and "sqs_group_id" (FIFO queues).
+// The time a message has been sent is used as message timestamp.
+//
+// Region defines the AWS region of the queue. If not set AWS_REGION or
+// AWS_DEFAULT_REGION is used. This setting is mandatory if none of these
+// variables is set.
+//
+// Queue defines the URL or the name of the queue to read from. This setting is
+// mandatory.
+//
+// AccessKeyID and SecretAccessKey define the access key to use. If not set
+// credentials are loaded like the AWS SDKs do, i.e. from the environment, a
+// web identity token (IAM roles for service accounts), the shared credentials
+// file, the ECS container endpoint or the EC2 instance metadata service.
+// By default these are set to "".
+//
+// Profile defines the profile of the shared credentials file to use. By
+// default this is set to "", i.e. AWS_PROFILE or "default" is used.
+//
+// Endpoint defines the URL of the SQS API. By default this is set to "",
+// i.e. "https://sqs.<Region>.amazonaws.com" is used.
+//
+// MaxMessages defines the maximum number of messages received per request.
+// SQS returns up to 10 messages per request. By default this is set to 10.
+//
+// WaitTimeSec defines the number of seconds to wait for messages if the queue
+// is empty. SQS accepts up to 20 seconds. By default this is set to 20.
+//
+// VisibilityTimeoutSec defines the number of seconds received messages are
+// hidden from other consumers. The timeout is extended while messages are
+// being passed to the streams. By default this is set to 30.
+//
+// Workers defines the number of receive requests sent concurrently. Set this
+// to 1 to keep the order of messages read from FIFO queues.
+// By default this is set to 1.
+//
+// AttributePrefix defines the prefix added to the name of message attributes
+// when storing them as metadata. By default this is set to "".
+//
+// UnwrapSNS can be set to true to extract the message of SNS notifications
+// sent to the queue without raw message delivery. The subject and the topic
+// ARN are stored in the metadata fields "sns_subject" and "sns_topic".
+// Other messages are passed as-is. By default this is set to false.
+//
+// RetryDelayMs defines the number of milliseconds to wait before receiving
+// again after an error. By default this is set to 5000.
+type SQS struct {
+	core.ConsumerBase
+	client          *http.Client
+	credentials     *shared.AWSCredentials
+	region          string
+	endpoint        string
+	queue           string
+	queueURL        string
+	maxMessages     int
+	waitTime        int
+	visibility      int
+	workers         int
+	attributePrefix string
+	unwrapSNS       bool
+	retryDelay      time.Duration
+	sequence        *uint64
+	guard           *sync.Mutex
+	context         context.Context
+	cancel          context.CancelFunc
+}
+
+type sqsMessage struct {
+	MessageID         string            `json:"MessageId"`
+	ReceiptHandle     string            `json:"ReceiptHandle"`
+	Body              string            `json:"Body"`
+	Attributes        map[string]string `json:"Attributes"`
+	MessageAttributes map[string]struct {
+		DataType    string `json:"DataType"`
+		StringValue string `json:"StringValue"`
+	} `json:"MessageAttributes"`
+}
+
+type sqsNotification struct {
+	Type     string `json:"Type"`
+	Message  string `json:"Message"`
+	Subject  string `json:"Subject"`
+	TopicArn string `json:"TopicArn"`
+}
+
+func init() {
+	shared.RuntimeType.Register(SQS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *SQS) Configure(conf core.PluginConfig) error {
+	err := cons.ConsumerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if cons.region = shared.AWSRegion(conf.GetString("Region", "")); cons.region == "" {
+		return fmt.Errorf("SQS: Region must be set")
+	}
+	if cons.queue = conf.GetString("Queue", ""); cons.queue == "" {
+		return fmt.Errorf("SQS: Queue must be set")
+	}
+
+	cons.credentials, err = shared.NewAWSCredentials(
+		conf.GetString("AccessKeyID", ""),
+		conf.GetString("SecretAccessKey", ""),
+		"",
+		conf.GetString("Profile", ""))
+	if err != nil {
+		return fmt.Errorf("SQS: %s", err)
+	}
+
+	cons.endpoint = strings.TrimRight(conf.GetString("Endpoint", ""), "/")
+	if cons.endpoint == "" {
+		cons.endpoint = fmt.Sprintf("https://sqs.%s.amazonaws.com", cons.region)
+	}
+	if strings.HasPrefix(cons.queue, "https://") || strings.HasPrefix(cons.queue, "http://") {
+		cons.queueURL = cons.queue
+	}
+
+	cons.maxMessages = conf.GetInt("MaxMessages", 10)
+	cons.waitTime = conf.GetInt("WaitTimeSec", 20)
+	cons.visibility = conf.GetInt("VisibilityTimeoutSec", 30)
+	cons.workers = conf.GetInt("Workers", 1)
+	cons.attributePrefix = conf.GetString("AttributePrefix", "")
+	cons.unwrapSNS = conf.GetBool("UnwrapSNS", false)
+	cons.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 5000)) * time.Millisecond
+
+	if cons.maxMessages < 1 || cons.maxMessages > 10 {
+		return fmt.Errorf("SQS: MaxMessages must be between 1 and 10")
+	}
+	if cons.workers < 1 || cons.visibility < 1 {
+		return fmt.Errorf("SQS: Workers and VisibilityTimeoutSec must be greater than 0")
+	}
+
+	cons.client = &http.Client{Timeout: time.Duration(cons.waitTime+30) * time.Second}
+	cons.sequence = new(uint64)
+	cons.guard = new(sync.Mutex)
+	cons.context, cons.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (cons *SQS) isStopped() bool {
+	return cons.context.Err() != nil
+}
+
+func (cons *SQS) post(ctx context.Context, action string, request interface{}, response interface{}) error {
+	return cons.credentials.PostJSON(ctx, cons.client, cons.endpoint, "sqs", cons.region, "AmazonSQS."+action, sqsContentType, request, response)
+}
+
+// getQueueURL returns the URL of the queue, resolving the queue name if
+// required.
+func (cons *SQS) getQueueURL() (string, error) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+	if cons.queueURL != "" {
+		return cons.queueURL, nil // ### return, known ###
+	}
+
+	result := struct {
+		QueueURL string `json:"QueueUrl"`
+	}{}
+	if err := cons.post(cons.context, "GetQueueUrl", map[string]string{"QueueName": cons.queue}, &result); err != nil {
+		return "", err
+	}
+	cons.queueURL = result.QueueURL
+	return cons.queueURL, nil
+}
+
+// sqsBatchEntries creates the entries of a batch request changing the given
+// messages.
+func sqsBatchEntries(queueURL string, messages []sqsMessage, visibility int) map[string]interface{} {
+	entries := make([]map[string]interface{}, len(messages))
+	for i, msg := range messages {
+		entries[i] = map[string]interface{}{"Id": strconv.Itoa(i), "ReceiptHandle": msg.ReceiptHandle}
+		if visibility >= 0 {
+			entries[i]["VisibilityTimeout"] = visibility
+		}
+	}
+	return map[string]interface{}{"QueueUrl": queueURL, "Entries": entries}
+}
+
+// extendVisibility extends the visibility timeout of the given messages until
+// done is closed.
+func (cons *SQS) extendVisibility(queueURL string, messages []sqsMessage, done <-chan struct{}) {
+	defer cons.WorkerDone()
+	ticker := time.NewTicker(time.Duration(cons.visibility) * time.Second * 2 / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return // ### return, processed ###
+		case <-ticker.C:
+			if err := cons.post(context.Background(), "ChangeMessageVisibilityBatch", sqsBatchEntries(queueURL, messages, cons.visibility), nil); err != nil {
+				Log.Warning.Print("SQS could not extend visibility timeout: ", err)
+			}
+		}
+	}
+}
+
+func (cons *SQS) newMessage(received sqsMessage) core.Message {
+	msg := core.NewMessage(cons, []byte(received.Body), atomic.AddUint64(cons.sequence, 1))
+	if sent, err := strconv.ParseInt(received.Attributes["SentTimestamp"], 10, 64); err == nil {
+		msg.Timestamp = time.Unix(0, sent*int64(time.Millisecond))
+	}
+
+	msg.Metadata = make(core.MessageMetadata, len(received.MessageAttributes)+2)
+	for key, value := range received.MessageAttributes {
+		msg.Metadata[cons.attributePrefix+key] = value.StringValue
+	}
+	msg.Metadata[SQSMetadataMessageID] = received.MessageID
+	if groupID := received.Attributes["MessageGroupId"]; groupID != "" {
+		msg.Metadata[SQSMetadataGroupID] = groupID
+	}
+
+	if cons.unwrapSNS {
+		notification := sqsNotification{}
+		if json.Unmarshal([]byte(received.Body), &notification) == nil && notification.Type == "Notification" {
+			msg.Data = []byte(notification.Message)
+			msg.Metadata["sns_topic"] = notification.TopicArn
+			if notification.Subject != "" {
+				msg.Metadata["sns_subject"] = notification.Subject
+			}
+		}
+	}
+	return msg
+}
+
+// process passes received messages to the streams and deletes them.
+func (cons *SQS) process(queueURL string, messages []sqsMessage) {
+	done := make(chan struct{})
+	cons.AddWorker()
+	go cons.extendVisibility(queueURL, messages, done)
+
+	for _, received := range messages {
+		cons.EnqueueMessage(cons.newMessage(received))
+	}
+	close(done)
+
+	result := struct {
+		Failed []struct {
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		} `json:"Failed"`
+	}{}
+	if err := cons.post(context.Background(), "DeleteMessageBatch", sqsBatchEntries(queueURL, messages, -1), &result); err != nil {
+		Log.Error.Print("SQS delete failed: ", err)
+	}
+	for _, failed := range result.Failed {
+		Log.Error.Printf("SQS delete failed: %s - %s", failed.Code, failed.Message)
+	}
+}
+
+func (cons *SQS) receiveLoop() {
+	defer cons.WorkerDone()
+
+	for !cons.isStopped() {
+		cons.WaitOnFuse()
+
+		queueURL, err := cons.getQueueURL()
+		response := struct {
+			Messages []sqsMessage `json:"Messages"`
+		}{}
+		if err == nil {
+			err = cons.post(cons.context, "ReceiveMessage", map[string]interface{}{
+				"QueueUrl":                    queueURL,
+				"MaxNumberOfMessages":         cons.maxMessages,
+				"WaitTimeSeconds":             cons.waitTime,
+				"VisibilityTimeout":           cons.visibility,
+				"MessageAttributeNames":       []string{"All"},
+				"MessageSystemAttributeNames": []string{"SentTimestamp", "MessageGroupId"},
+			}, &response)
+		}
+
+		if err != nil {
+			if cons.isStopped() {
+				return // ### return, stopped ###
+			}
+			Log.Error.Print("SQS receive failed: ", err)
+			select {
+			case <-cons.context.Done():
+			case <-time.After(cons.retryDelay):
+			}
+			continue // ### continue, retry ###
+		}
+
+		if len(response.Messages) > 0 {
+			cons.process(queueURL, response.Messages)
+		}
+	}
+}
+
+// Consume starts receiving messages from the queue.
+func (cons *SQS) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go cons.receiveLoop()
+	for i := 1; i < cons.workers; i++ {
+		cons.AddWorker()
+		go cons.receiveLoop()
+	}
+
+	defer cons.cancel()
+	cons.DefaultControlLoop(nil)
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+const (
+	// TLSMetadataCommonName is the metadata key storing the common name of a
+	// verified client certificate.
+	TLSMetadataCommonName = "tls_cn"
+	// TLSMetadataAltNames is the metadata key storing the comma separated list
+	// of subject alternative names of a verified client certificate.
+	TLSMetadataAltNames = "tls_san"
+)
+
+// configureTLS reads the TLS settings common to all consumers supporting TLS.
+// If TLSCert is not set nil is returned, i.e. TLS is disabled.
+func configureTLS(conf core.PluginConfig) (*tls.Config, error) {
+	certFile := conf.GetString("TLSCert", "")
+	if certFile == "" {
+		return nil, nil // ### return, TLS disabled ###
+	}
+
+	return shared.NewServerTLSConfig(certFile,
+		conf.GetString("TLSKey", ""),
+		conf.GetString("TLSClientCA", ""))
+}
+
+// tlsMetadata returns the identity of a TLS client as message metadata.
+// If the client did not present a certificate nil is returned.
+func tlsMetadata(state tls.ConnectionState) core.MessageMetadata {
+	commonName, altNames := shared.GetTLSPeerIdentity(state)
+	if commonName == "" && len(altNames) == 0 {
+		return nil // ### return, anonymous client ###
+	}
+
+	return core.MessageMetadata{
+		TLSMetadataCommonName: commonName,
+		TLSMetadataAltNames:   strings.Join(altNames, ","),
+	}
+}
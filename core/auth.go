@@ -0,0 +1,210 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/shared"
+)
+
+const (
+	metricAuthRejected       = "AuthRejected"
+	metricAuthStreamRejected = "AuthStreamRejected"
+)
+
+func init() {
+	shared.Metric.New(metricAuthRejected)
+	shared.Metric.New(metricAuthStreamRejected)
+}
+
+// AuthCredentials holds the credentials presented by a client of a network
+// consumer. Fields that are not supported by a consumer are left empty.
+type AuthCredentials struct {
+	// Token is a static token, e.g. sent as "Bearer <token>".
+	Token string
+	// User and Password are sent via basic authentication.
+	User     string
+	Password string
+	// KeyID names the HMAC key used to create Signature. Signature is the
+	// hex encoded HMAC-SHA256 of Payload.
+	KeyID     string
+	Signature string
+	Payload   []byte
+	// CommonName is the common name of a verified client certificate.
+	CommonName string
+}
+
+// Authenticator validates the credentials of clients connecting to network
+// consumers and restricts the streams a client may write to. Clients may use
+// any of the configured methods. Rejected credentials and streams are counted
+// by the metrics "AuthRejected" and "AuthStreamRejected". The following
+// settings are read:
+//
+// AuthTokens maps client names to static tokens.
+//
+// AuthBasic maps user names to passwords for basic authentication. The user
+// name is used as the client name.
+//
+// AuthHMACKeys maps client names to secrets used to sign the payload with
+// HMAC-SHA256.
+//
+// AuthCertificates lists the common names of client certificates that are
+// accepted. The common name is used as the client name. Certificates have to
+// be verified via TLSClientCA.
+//
+// AuthStreams maps client names to the list of streams the client may write
+// to. Clients not listed here may write to any stream.
+//
+// AllowedStreams defines the streams any client may write to by naming them.
+// If empty any stream is allowed.
+type Authenticator struct {
+	tokens   map[string]string
+	users    map[string]string
+	hmacKeys map[string]string
+	certs    map[string]bool
+	streams  map[string]map[MessageStreamID]bool
+	allowed  map[MessageStreamID]bool
+}
+
+// NewAuthenticator reads the authentication settings from a plugin config.
+func NewAuthenticator(conf PluginConfig) (*Authenticator, error) {
+	auth := &Authenticator{
+		tokens:   make(map[string]string),
+		users:    conf.GetStringMap("AuthBasic", map[string]string{}),
+		hmacKeys: conf.GetStringMap("AuthHMACKeys", map[string]string{}),
+		certs:    make(map[string]bool),
+		streams:  make(map[string]map[MessageStreamID]bool),
+		allowed:  make(map[MessageStreamID]bool),
+	}
+
+	for client, token := range conf.GetStringMap("AuthTokens", map[string]string{}) {
+		if token == "" {
+			return nil, fmt.Errorf("empty token for client %s", client)
+		}
+		auth.tokens[token] = client
+	}
+	for user, password := range auth.users {
+		if password == "" {
+			return nil, fmt.Errorf("empty password for user %s", user)
+		}
+	}
+	for client, secret := range auth.hmacKeys {
+		if secret == "" {
+			return nil, fmt.Errorf("empty HMAC key for client %s", client)
+		}
+	}
+	for _, commonName := range conf.GetStringArray("AuthCertificates", []string{}) {
+		auth.certs[commonName] = true
+	}
+	for client, streams := range conf.GetStringArrayMap("AuthStreams", map[string][]string{}) {
+		auth.streams[client] = make(map[MessageStreamID]bool)
+		for _, stream := range streams {
+			auth.streams[client][GetStreamID(stream)] = true
+		}
+	}
+	for _, stream := range conf.GetStringArray("AllowedStreams", []string{}) {
+		auth.allowed[GetStreamID(stream)] = true
+	}
+
+	return auth, nil
+}
+
+// IsEnabled returns true if at least one authentication method is configured.
+// If false is returned all clients are accepted by Authenticate.
+func (auth *Authenticator) IsEnabled() bool {
+	return auth.HasSecrets() || len(auth.certs) > 0
+}
+
+// HasSecrets returns true if tokens, basic authentication or HMAC keys are
+// configured, i.e. clients have to send credentials to be accepted.
+func (auth *Authenticator) HasSecrets() bool {
+	return len(auth.tokens) > 0 || len(auth.users) > 0 || len(auth.hmacKeys) > 0
+}
+
+// Authenticate returns the name of the client presenting the given
+// credentials. If authentication is not enabled an empty name is returned.
+// If none of the credentials are valid an error is returned.
+func (auth *Authenticator) Authenticate(creds AuthCredentials) (string, error) {
+	if !auth.IsEnabled() {
+		return "", nil // ### return, authentication disabled ###
+	}
+
+	if creds.Token != "" {
+		for token, client := range auth.tokens {
+			if subtle.ConstantTimeCompare([]byte(creds.Token), []byte(token)) == 1 {
+				return client, nil // ### return, known token ###
+			}
+		}
+	}
+
+	if password, exists := auth.users[creds.User]; exists && creds.User != "" {
+		if subtle.ConstantTimeCompare([]byte(creds.Password), []byte(password)) == 1 {
+			return creds.User, nil // ### return, valid password ###
+		}
+	}
+
+	if secret, exists := auth.hmacKeys[creds.KeyID]; exists && creds.KeyID != "" {
+		if signature, err := hex.DecodeString(creds.Signature); err == nil {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(creds.Payload)
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return creds.KeyID, nil // ### return, valid signature ###
+			}
+		}
+	}
+
+	if creds.CommonName != "" && auth.certs[creds.CommonName] {
+		return creds.CommonName, nil // ### return, known certificate ###
+	}
+
+	shared.Metric.Inc(metricAuthRejected)
+	return "", fmt.Errorf("invalid credentials")
+}
+
+// IsStreamAllowed returns true if the given client may write to a stream it
+// named itself. Both AllowedStreams and AuthStreams are checked.
+func (auth *Authenticator) IsStreamAllowed(client string, streamID MessageStreamID) bool {
+	if len(auth.allowed) > 0 && !auth.allowed[streamID] {
+		shared.Metric.Inc(metricAuthStreamRejected)
+		return false // ### return, not allowed for anyone ###
+	}
+	return auth.isClientStream(client, streamID)
+}
+
+// AreDefaultStreamsAllowed returns true if the given client may write to all
+// of the given streams configured for the consumer. Only AuthStreams is
+// checked.
+func (auth *Authenticator) AreDefaultStreamsAllowed(client string, streamIDs []MessageStreamID) bool {
+	for _, streamID := range streamIDs {
+		if !auth.isClientStream(client, streamID) {
+			return false // ### return, not allowed for this client ###
+		}
+	}
+	return true
+}
+
+// isClientStream checks the AuthStreams restrictions of a client.
+func (auth *Authenticator) isClientStream(client string, streamID MessageStreamID) bool {
+	streams, restricted := auth.streams[client]
+	if restricted && !streams[streamID] {
+		shared.Metric.Inc(metricAuthStreamRejected)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestAuthenticator(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := NewPluginConfig("core.Authenticator")
+
+	auth, err := NewAuthenticator(conf)
+	expect.NoError(err)
+	expect.False(auth.IsEnabled())
+	client, err := auth.Authenticate(AuthCredentials{})
+	expect.NoError(err)
+	expect.Equal("", client)
+
+	conf.Settings["AuthTokens"] = map[string]string{"agent": "secret"}
+	conf.Settings["AuthBasic"] = map[string]string{"user": "password"}
+	conf.Settings["AuthHMACKeys"] = map[string]string{"signer": "key"}
+	conf.Settings["AuthCertificates"] = []string{"web01"}
+	auth, err = NewAuthenticator(conf)
+	expect.NoError(err)
+	expect.True(auth.IsEnabled())
+	expect.True(auth.HasSecrets())
+
+	client, err = auth.Authenticate(AuthCredentials{Token: "secret"})
+	expect.NoError(err)
+	expect.Equal("agent", client)
+
+	client, err = auth.Authenticate(AuthCredentials{User: "user", Password: "password"})
+	expect.NoError(err)
+	expect.Equal("user", client)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("payload"))
+	signature := hex.EncodeToString(mac.Sum(nil))
+	client, err = auth.Authenticate(AuthCredentials{KeyID: "signer", Signature: signature, Payload: []byte("payload")})
+	expect.NoError(err)
+	expect.Equal("signer", client)
+
+	client, err = auth.Authenticate(AuthCredentials{CommonName: "web01"})
+	expect.NoError(err)
+	expect.Equal("web01", client)
+
+	// Invalid credentials are rejected
+	_, err = auth.Authenticate(AuthCredentials{Token: "unknown"})
+	expect.True(err != nil)
+	_, err = auth.Authenticate(AuthCredentials{User: "user", Password: "wrong"})
+	expect.True(err != nil)
+	_, err = auth.Authenticate(AuthCredentials{KeyID: "signer", Signature: signature, Payload: []byte("changed")})
+	expect.True(err != nil)
+	_, err = auth.Authenticate(AuthCredentials{CommonName: "web02"})
+	expect.True(err != nil)
+
+	conf.Settings["AuthTokens"] = map[string]string{"agent": ""}
+	_, err = NewAuthenticator(conf)
+	expect.True(err != nil)
+}
+
+func TestAuthenticatorStreams(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := NewPluginConfig("core.Authenticator")
+	conf.Settings["AuthStreams"] = map[string][]string{"agent": {"logs"}}
+	conf.Settings["AllowedStreams"] = []string{"logs", "metrics"}
+
+	auth, err := NewAuthenticator(conf)
+	expect.NoError(err)
+
+	logs := GetStreamID("logs")
+	metrics := GetStreamID("metrics")
+	other := GetStreamID("other")
+
+	expect.True(auth.IsStreamAllowed("agent", logs))
+	expect.False(auth.IsStreamAllowed("agent", metrics))
+	expect.True(auth.IsStreamAllowed("web01", metrics))
+	expect.False(auth.IsStreamAllowed("web01", other))
+
+	// Default streams are only restricted per client
+	expect.True(auth.AreDefaultStreamsAllowed("web01", []MessageStreamID{other}))
+	expect.True(auth.AreDefaultStreamsAllowed("agent", []MessageStreamID{logs}))
+	expect.False(auth.AreDefaultStreamsAllowed("agent", []MessageStreamID{logs, other}))
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"sync/atomic"
+	"time"
+)
+
+// BenchmarkStats holds the values measured in benchmark mode.
+type BenchmarkStats struct {
+	// Processed is the number of messages processed by producers. A message
+	// sent to more than one producer is counted once per producer.
+	Processed uint64
+
+	// Dropped is the number of messages dropped or discarded, e.g. due to
+	// channel timeouts or sink failures.
+	Dropped uint64
+
+	// LatencyUs holds the number of microseconds between creating a message
+	// and a producer finishing to process it.
+	LatencyUs shared.HistogramSnapshot
+}
+
+var (
+	benchmarkEnabled   bool
+	benchmarkProcessed uint64
+	benchmarkDropped   uint64
+	benchmarkLatency   = shared.NewHistogram()
+)
+
+// EnableBenchmark activates the benchmark mode. In this mode messages are
+// timestamped with full precision and message latencies and drops are
+// counted. This function has to be called before any plugin is started.
+func EnableBenchmark() {
+	benchmarkEnabled = true
+}
+
+// IsBenchmarkEnabled returns true if EnableBenchmark has been called.
+func IsBenchmarkEnabled() bool {
+	return benchmarkEnabled
+}
+
+// GetBenchmarkStats returns the values measured since the last call to this
+// function or since EnableBenchmark has been called. This function is
+// threadsafe.
+func GetBenchmarkStats() BenchmarkStats {
+	return BenchmarkStats{
+		Processed: atomic.SwapUint64(&benchmarkProcessed, 0),
+		Dropped:   atomic.SwapUint64(&benchmarkDropped, 0),
+		LatencyUs: benchmarkLatency.Reset(),
+	}
+}
+
+// trackBenchmarkMessage counts a message processed by a producer.
+func trackBenchmarkMessage(msg Message) {
+	if benchmarkEnabled {
+		atomic.AddUint64(&benchmarkProcessed, 1)
+		benchmarkLatency.Add(int64(time.Since(msg.Timestamp) / time.Microsecond))
+	}
+}
+
+// countBenchmarkDrop counts a message dropped or discarded.
+func countBenchmarkDrop() {
+	if benchmarkEnabled {
+		atomic.AddUint64(&benchmarkDropped, 1)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy/snappy"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Compressor is the interface definition for compression algorithms used by
+// producers to compress files or batches. Compressors are stateless and may
+// be shared between producers. gzip, zlib, snappy, zstd and lz4 are
+// registered by default.
+type Compressor interface {
+	// NewWriter returns a writer compressing all data written to it.
+	// Compressed data is completely written to the given writer after the
+	// returned writer has been closed.
+	NewWriter(writer io.Writer) io.WriteCloser
+
+	// NewReader returns a reader decompressing the data read from the given
+	// reader.
+	NewReader(reader io.Reader) (io.Reader, error)
+
+	// Extension returns the file extension used for compressed files, e.g.
+	// ".gz".
+	Extension() string
+
+	// Encoding returns the name of the encoding as used by the HTTP
+	// Content-Encoding header.
+	Encoding() string
+}
+
+var compressors = struct {
+	byName map[string]Compressor
+	guard  *sync.RWMutex
+}{
+	byName: make(map[string]Compressor),
+	guard:  new(sync.RWMutex),
+}
+
+func init() {
+	RegisterCompressor("gzip", gzipCompressor{})
+	RegisterCompressor("zlib", zlibCompressor{})
+	RegisterCompressor("snappy", snappyCompressor{})
+	RegisterCompressor("zstd", zstdCompressor{})
+	RegisterCompressor("lz4", lz4Compressor{})
+}
+
+// RegisterCompressor makes a compressor available by name. Names are case
+// insensitive. This function is meant to be called from init functions,
+// e.g. to add algorithms that require additional libraries.
+func RegisterCompressor(name string, compressor Compressor) {
+	compressors.guard.Lock()
+	defer compressors.guard.Unlock()
+	compressors.byName[strings.ToLower(name)] = compressor
+}
+
+// NewCompressor returns the compressor registered for the given name. The
+// names "" and "none" return nil, i.e. no compression.
+func NewCompressor(name string) (Compressor, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "none" {
+		return nil, nil // ### return, no compression ###
+	}
+
+	compressors.guard.RLock()
+	defer compressors.guard.RUnlock()
+
+	if compressor, exists := compressors.byName[name]; exists {
+		return compressor, nil // ### return, found ###
+	}
+
+	names := []string{"none"}
+	for known := range compressors.byName {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Unknown compression %s, valid values are %s", name, strings.Join(names, ", "))
+}
+
+// Compress compresses the given data in memory.
+func Compress(compressor Compressor, data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)/2+64))
+	writer := compressor.NewWriter(buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// compressionMagics maps the magic bytes at the start of compressed data to
+// the name of the compression. zlib is only detected for the default, fastest
+// and best compression levels to avoid matching plain text.
+var compressionMagics = []struct {
+	magic string
+	name  string
+}{
+	{"\x1F\x8B", "gzip"},
+	{"\x78\x9C", "zlib"},
+	{"\x78\x01", "zlib"},
+	{"\x78\xDA", "zlib"},
+	{"\xFF\x06\x00\x00sNaPpY", "snappy"},
+	{"\x28\xB5\x2F\xFD", "zstd"},
+	{"\x04\x22\x4D\x18", "lz4"},
+}
+
+// DetectCompression returns the name of the compression used for the given
+// data based on its magic bytes. An empty string is returned if the data does
+// not look compressed.
+func DetectCompression(data []byte) string {
+	for _, entry := range compressionMagics {
+		if bytes.HasPrefix(data, []byte(entry.magic)) {
+			return entry.name // ### return, found ###
+		}
+	}
+	return ""
+}
+
+// Decompress decompresses the given data in memory using the compressor
+// registered for the given name. Snappy data not using the framing format is
+// decoded as a single block. If maxSize is greater than 0 an error is returned
+// if the decompressed data is larger than maxSize bytes.
+func Decompress(name string, data []byte, maxSize int) ([]byte, error) {
+	name = strings.ToLower(name)
+	switch {
+	case name == "zstd":
+		return shared.ZstdDecompress(data, maxSize)
+
+	case name == "snappy" && DetectCompression(data) != "snappy":
+		return decodeSnappyBlock(data, maxSize)
+	}
+
+	compressor, err := NewCompressor(name)
+	if err != nil || compressor == nil {
+		return data, err // ### return, not compressed ###
+	}
+	reader, err := compressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, int64(maxSize)+1)
+	}
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && len(decompressed) > maxSize {
+		return nil, fmt.Errorf("Decompressed data exceeds %d bytes", maxSize)
+	}
+	return decompressed, nil
+}
+
+// decodeSnappyBlock decodes snappy data not using the framing format. The
+// snappy decoder panics on some malformed length headers, so the header is
+// validated first and panics are returned as errors.
+func decodeSnappyBlock(data []byte, maxSize int) (decoded []byte, err error) {
+	if _, headerLen := binary.Uvarint(data); headerLen <= 0 {
+		return nil, snappy.ErrCorrupt // ### return, invalid length header ###
+	}
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, snappy.ErrCorrupt // ### return, invalid length ###
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("Decompressed data exceeds %d bytes", maxSize)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			decoded, err = nil, fmt.Errorf("Malformed snappy block: %v", r)
+		}
+	}()
+	return snappy.Decode(nil, data)
+}
+
+// compressedBatchWriter compresses each call to Write separately.
+type compressedBatchWriter struct {
+	compressor Compressor
+	writer     io.Writer
+}
+
+// NewCompressedBatchWriter returns a writer that compresses the data of each
+// call to Write separately before passing it to the given writer. This can
+// be used to compress the batches flushed by a MessageBatch. The resulting
+// data is a concatenation of independently compressed blocks. The gzip,
+// snappy, zstd and lz4 readers read concatenated blocks as one stream. zlib
+// readers stop after the first block, so zlib compressed batches cannot be
+// read back as one stream.
+func NewCompressedBatchWriter(compressor Compressor, writer io.Writer) io.Writer {
+	return compressedBatchWriter{compressor, writer}
+}
+
+// Write compresses the data and writes it to the underlying writer. The
+// number of uncompressed bytes is returned on success.
+func (batch compressedBatchWriter) Write(data []byte) (int, error) {
+	compressed, err := Compress(batch.compressor, data)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := batch.writer.Write(compressed); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewWriter(writer io.Writer) io.WriteCloser {
+	return gzip.NewWriter(writer)
+}
+
+func (gzipCompressor) NewReader(reader io.Reader) (io.Reader, error) {
+	return gzip.NewReader(reader)
+}
+
+func (gzipCompressor) Extension() string {
+	return ".gz"
+}
+
+func (gzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) NewWriter(writer io.Writer) io.WriteCloser {
+	return zlib.NewWriter(writer)
+}
+
+func (zlibCompressor) NewReader(reader io.Reader) (io.Reader, error) {
+	return zlib.NewReader(reader)
+}
+
+func (zlibCompressor) Extension() string {
+	return ".zz"
+}
+
+func (zlibCompressor) Encoding() string {
+	return "deflate"
+}
+
+// snappyCompressor uses the snappy framing format.
+type snappyCompressor struct{}
+
+// snappyWriter adds a no-op Close to the snappy writer which writes each
+// call to Write as a separate frame.
+type snappyWriter struct {
+	*snappy.Writer
+}
+
+func (snappyWriter) Close() error {
+	return nil
+}
+
+func (snappyCompressor) NewWriter(writer io.Writer) io.WriteCloser {
+	return snappyWriter{snappy.NewWriter(writer)}
+}
+
+func (snappyCompressor) NewReader(reader io.Reader) (io.Reader, error) {
+	return snappy.NewReader(reader), nil
+}
+
+func (snappyCompressor) Extension() string {
+	return ".sz"
+}
+
+func (snappyCompressor) Encoding() string {
+	return "x-snappy-framed"
+}
+
+// zstdCompressor writes single zstd frames. The reader decodes the complete
+// data in memory.
+type zstdCompressor struct{}
+
+func (zstdCompressor) NewWriter(writer io.Writer) io.WriteCloser {
+	return shared.NewZstdWriter(writer)
+}
+
+func (zstdCompressor) NewReader(reader io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := shared.ZstdDecompress(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decompressed), nil
+}
+
+func (zstdCompressor) Extension() string {
+	return ".zst"
+}
+
+func (zstdCompressor) Encoding() string {
+	return "zstd"
+}
+
+// lz4Compressor uses the LZ4 frame format.
+type lz4Compressor struct{}
+
+func (lz4Compressor) NewWriter(writer io.Writer) io.WriteCloser {
+	return shared.NewLZ4Writer(writer)
+}
+
+func (lz4Compressor) NewReader(reader io.Reader) (io.Reader, error) {
+	return shared.NewLZ4Reader(reader), nil
+}
+
+func (lz4Compressor) Extension() string {
+	return ".lz4"
+}
+
+func (lz4Compressor) Encoding() string {
+	return "x-lz4"
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"github.com/golang/snappy/snappy"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	expect := shared.NewExpect(t)
+	data := bytes.Repeat([]byte("compress me "), 1000)
+
+	for _, name := range []string{"gzip", "zlib", "Snappy", "zstd", "lz4"} {
+		compressor, err := NewCompressor(name)
+		expect.NoError(err)
+
+		compressed, err := Compress(compressor, data)
+		expect.NoError(err)
+		expect.Less(len(compressed), len(data))
+
+		reader, err := compressor.NewReader(bytes.NewReader(compressed))
+		expect.NoError(err)
+		decompressed, err := ioutil.ReadAll(reader)
+		expect.NoError(err)
+		expect.True(bytes.Equal(data, decompressed))
+	}
+
+	compressor, err := NewCompressor("none")
+	expect.NoError(err)
+	expect.Nil(compressor)
+
+	_, err = NewCompressor("unknown")
+	expect.NotNil(err)
+}
+
+func TestCompressedBatchWriter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	for _, name := range []string{"gzip", "snappy", "zstd", "lz4"} {
+		compressor, _ := NewCompressor(name)
+		buffer := bytes.Buffer{}
+		writer := NewCompressedBatchWriter(compressor, &buffer)
+
+		written, err := writer.Write([]byte("first batch\n"))
+		expect.NoError(err)
+		expect.Equal(12, written)
+		writer.Write([]byte("second batch\n"))
+
+		reader, err := compressor.NewReader(&buffer)
+		expect.NoError(err)
+		decompressed, err := ioutil.ReadAll(reader)
+		expect.NoError(err)
+		expect.Equal("first batch\nsecond batch\n", string(decompressed))
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	expect := shared.NewExpect(t)
+	data := bytes.Repeat([]byte("decompress me "), 1000)
+
+	for _, name := range []string{"gzip", "zlib", "snappy", "zstd", "lz4"} {
+		compressor, _ := NewCompressor(name)
+		compressed, _ := Compress(compressor, data)
+		expect.Equal(name, DetectCompression(compressed))
+
+		decompressed, err := Decompress(name, compressed, 0)
+		expect.NoError(err)
+		expect.True(bytes.Equal(data, decompressed))
+
+		_, err = Decompress(name, compressed, 1024)
+		expect.NotNil(err)
+	}
+
+	// Snappy blocks without framing
+	block, _ := snappy.Encode(nil, data)
+	decompressed, err := Decompress("snappy", block, 0)
+	expect.NoError(err)
+	expect.True(bytes.Equal(data, decompressed))
+
+	// Malformed snappy blocks return an error instead of panicking
+	for _, malformed := range []string{"\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", "\xff\xff\xff\xff\xff\xff\xff\xff\x7f", "\x0a\x00", string(block[:len(block)/2])} {
+		_, err = Decompress("snappy", []byte(malformed), 0)
+		expect.NotNil(err)
+	}
+
+	// zstd -1 "zstd"
+	expect.Equal("zstd", DetectCompression([]byte("\x28\xB5\x2F\xFD\x24")))
+	decompressed, err = Decompress("zstd", []byte("\x28\xB5\x2F\xFD\x20\x04\x21\x00\x00zstd"), 0)
+	expect.NoError(err)
+	expect.Equal("zstd", string(decompressed))
+
+	expect.Equal("", DetectCompression([]byte("x^plain text")))
+	_, err = Decompress("gzip", []byte("plain text"), 0)
+	expect.NotNil(err)
+}
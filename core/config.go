@@ -15,9 +15,15 @@
 package core
 
 import (
+	"fmt"
 	"github.com/trivago/gollum/shared"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // Config represents the top level config containing all plugin clonfigs
@@ -26,25 +32,54 @@ type Config struct {
 	Plugins []PluginConfig
 }
 
+// configIncludeKey is the name of the directive merging other configuration
+// files into a configuration.
+const configIncludeKey = "Include"
+
+// configReader reads a configuration file and all files included by it.
+type configReader struct {
+	config  *Config
+	origins []string
+	visited map[string]bool
+	reading map[string]bool
+}
+
 // ReadConfig parses a YAML config file into a new Config struct.
+// Environment variables and files referenced by string values are inserted,
+// see InterpolateConfigString.
+//
+// Instead of a plugin an entry may contain the "Include" directive, naming one
+// or a list of files to be merged into the configuration at the position of
+// the directive. Glob patterns are allowed and relative paths are relative to
+// the directory of the including file. Files matched by a pattern are read in
+// lexical order, files matched more than once are only read once.
+// An error is returned for include cycles, for identical plugin definitions and
+// for streams configured by more than one stream plugin.
 func ReadConfig(path string) (*Config, error) {
-	buffer, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+	reader := configReader{
+		config:  new(Config),
+		visited: make(map[string]bool),
+		reading: make(map[string]bool),
 	}
-
-	config := new(Config)
-	err = yaml.Unmarshal(buffer, &config.Values)
-	if err != nil {
+	if err := reader.readFile(path); err != nil {
 		return nil, err
 	}
+	config := reader.config
 
-	// As there might be multiple instances of the same plugin class we iterate
-	// over an array here.
+	var err error
 	for _, pluginData := range config.Values {
+		for typeName, pluginSettings := range pluginData {
+			for key, value := range pluginSettings {
+				if pluginSettings[key], err = interpolateConfigValue(value); err != nil {
+					return nil, fmt.Errorf("%s: %s: %s", typeName, key, err.Error())
+				}
+			}
+		}
+	}
 
-		// Each item in the array item is a map{class -> map{key -> value}}
-		// We "iterate" over the first map (one item only) to get the class.
+	// Each item in the array item is a map{class -> map{key -> value}}
+	// holding exactly one plugin.
+	for _, pluginData := range config.Values {
 		for typeName, pluginSettings := range pluginData {
 			plugin := NewPluginConfig(typeName)
 			plugin.Read(pluginSettings)
@@ -52,5 +87,248 @@ func ReadConfig(path string) (*Config, error) {
 		}
 	}
 
-	return config, err
+	if err := reader.checkDuplicates(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile appends all plugins defined by the given file and the files
+// included by it.
+func (reader *configReader) readFile(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if reader.reading[absPath] {
+		return fmt.Errorf("%s: Include cycle detected", path)
+	}
+	if reader.visited[absPath] {
+		return nil // ### return, already read ###
+	}
+	reader.visited[absPath] = true
+	reader.reading[absPath] = true
+	defer delete(reader.reading, absPath)
+
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	items := []shared.MarshalMap{}
+	if err := yaml.Unmarshal(buffer, &items); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for _, item := range items {
+		// Sort the keys so that items with multiple keys are read in a
+		// deterministic order.
+		keys := make([]string, 0, len(item))
+		for key := range item {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if key == configIncludeKey {
+				patterns, err := item.StringArray(key)
+				if err != nil {
+					return fmt.Errorf("%s: %s", path, err.Error())
+				}
+				for _, pattern := range patterns {
+					if err := reader.include(filepath.Dir(path), pattern); err != nil {
+						return err
+					}
+				}
+				continue // ### continue, not a plugin ###
+			}
+
+			settings := shared.NewMarshalMap()
+			if item[key] != nil {
+				if settings, err = item.MarshalMap(key); err != nil {
+					return fmt.Errorf("%s: %s", path, err.Error())
+				}
+			}
+			reader.config.Values = append(reader.config.Values, map[string]shared.MarshalMap{key: settings})
+			reader.origins = append(reader.origins, path)
+		}
+	}
+	return nil
+}
+
+// include reads all files matching the given pattern.
+func (reader *configReader) include(baseDir string, pattern string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(baseDir, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("Include %s: %s", pattern, err.Error())
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return fmt.Errorf("Include %s: File not found", pattern)
+	}
+
+	sort.Strings(matches)
+	for _, match := range matches {
+		if err := reader.readFile(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicates returns an error if a plugin has been defined more than once
+// with the same settings or if more than one stream plugin is configured for
+// the same stream.
+func (reader *configReader) checkDuplicates() error {
+	streamInterface := reflect.TypeOf((*Stream)(nil)).Elem()
+	streamOrigins := make(map[string]string)
+	plugins := reader.config.Plugins
+
+	for idx, plugin := range plugins {
+		for prevIdx := 0; prevIdx < idx; prevIdx++ {
+			prev := plugins[prevIdx]
+			if prev.Typename == plugin.Typename && prev.Enable == plugin.Enable &&
+				reflect.DeepEqual(prev.Stream, plugin.Stream) && reflect.DeepEqual(prev.Settings, plugin.Settings) {
+				return fmt.Errorf("Duplicate definition of %s in %s and %s", plugin.Typename, reader.origins[prevIdx], reader.origins[idx])
+			}
+		}
+
+		pluginType := shared.RuntimeType.GetTypeOf(plugin.Typename)
+		if !plugin.Enable || pluginType == nil || !pluginType.Implements(streamInterface) {
+			continue // ### continue, not an active stream plugin ###
+		}
+		for _, stream := range plugin.Stream {
+			if origin, exists := streamOrigins[stream]; exists {
+				return fmt.Errorf("Stream %s is configured in %s and %s", stream, origin, reader.origins[idx])
+			}
+			streamOrigins[stream] = reader.origins[idx]
+		}
+	}
+	return nil
+}
+
+// InterpolateConfigString replaces references to environment variables and
+// files in the given string. Interpolation is applied to the parsed values, so
+// the inserted data does not need to be escaped for YAML.
+//  - "${NAME}" is replaced by the environment variable NAME. Only upper case
+//    letters, digits and underscores are allowed in names. An error is returned
+//    if the variable is not set.
+//  - "${NAME:-default}" is replaced by the environment variable NAME or by
+//    "default" if that variable is not set or empty.
+//  - "${file:/path}" is replaced by the contents of the given file without
+//    trailing newlines, e.g. for secrets mounted by a container runtime.
+//  - "$${" is replaced by "${" and is not interpolated.
+// All other placeholders, e.g. the lower case placeholders of message
+// templates, are kept as-is.
+func InterpolateConfigString(text string) (string, error) {
+	if !strings.Contains(text, "${") {
+		return text, nil // ### return, nothing to do ###
+	}
+
+	result := make([]byte, 0, len(text))
+	for idx := 0; idx < len(text); idx++ {
+		switch {
+		case strings.HasPrefix(text[idx:], "$${"):
+			result = append(result, "${"...)
+			idx += 2
+
+		case strings.HasPrefix(text[idx:], "${"):
+			end := strings.IndexByte(text[idx:], '}')
+			if end == -1 {
+				result = append(result, text[idx:]...)
+				return string(result), nil // ### return, unterminated ###
+			}
+
+			placeholder := text[idx : idx+end+1]
+			value, err := interpolateConfigPlaceholder(placeholder[2 : len(placeholder)-1])
+			if err != nil {
+				return "", err
+			}
+			if value == nil {
+				result = append(result, placeholder...)
+			} else {
+				result = append(result, *value...)
+			}
+			idx += end
+
+		default:
+			result = append(result, text[idx])
+		}
+	}
+	return string(result), nil
+}
+
+// interpolateConfigPlaceholder returns the value of a placeholder without the
+// surrounding braces or nil if the placeholder is not to be replaced.
+func interpolateConfigPlaceholder(name string) (*string, error) {
+	if strings.HasPrefix(name, "file:") {
+		data, err := ioutil.ReadFile(name[5:])
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		return &value, nil // ### return, file contents ###
+	}
+
+	defaultValue := ""
+	hasDefault := false
+	if sepIdx := strings.Index(name, ":-"); sepIdx != -1 {
+		name, defaultValue, hasDefault = name[:sepIdx], name[sepIdx+2:], true
+	}
+	if !isEnvironmentVariableName(name) {
+		return nil, nil // ### return, keep as-is ###
+	}
+
+	value, isSet := os.LookupEnv(name)
+	switch {
+	case hasDefault && value == "":
+		value = defaultValue
+	case !isSet:
+		return nil, fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return &value, nil
+}
+
+// isEnvironmentVariableName returns true if the given name consists of upper
+// case letters, digits and underscores and does not start with a digit.
+func isEnvironmentVariableName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, char := range name {
+		switch {
+		case char >= 'A' && char <= 'Z', char >= '0' && char <= '9', char == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// interpolateConfigValue applies InterpolateConfigString to all strings
+// stored in the given value, including nested arrays and maps.
+func interpolateConfigValue(value interface{}) (interface{}, error) {
+	var err error
+	switch typedValue := value.(type) {
+	case string:
+		return InterpolateConfigString(typedValue)
+
+	case []interface{}:
+		for idx, item := range typedValue {
+			if typedValue[idx], err = interpolateConfigValue(item); err != nil {
+				return nil, err
+			}
+		}
+
+	case map[interface{}]interface{}:
+		for key, item := range typedValue {
+			if typedValue[key], err = interpolateConfigValue(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
 }
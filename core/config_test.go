@@ -0,0 +1,119 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolateConfigString(t *testing.T) {
+	expect := shared.NewExpect(t)
+	os.Setenv("GOLLUM_TEST_USER", "gollum")
+	os.Unsetenv("GOLLUM_TEST_UNSET")
+
+	secret, err := ioutil.TempFile("", "gollum_secret")
+	expect.NoError(err)
+	secret.WriteString("p#ss: word\n")
+	secret.Close()
+	defer os.Remove(secret.Name())
+
+	value, err := InterpolateConfigString("${GOLLUM_TEST_USER}:${file:" + secret.Name() + "}")
+	expect.NoError(err)
+	expect.Equal("gollum:p#ss: word", value)
+
+	value, err = InterpolateConfigString("${GOLLUM_TEST_UNSET:-default}/${stream}/${meta:key}/$${GOLLUM_TEST_USER}")
+	expect.NoError(err)
+	expect.Equal("default/${stream}/${meta:key}/${GOLLUM_TEST_USER}", value)
+
+	_, err = InterpolateConfigString("${GOLLUM_TEST_UNSET}")
+	expect.NotNil(err)
+
+	_, err = InterpolateConfigString("${file:/does/not/exist}")
+	expect.NotNil(err)
+}
+
+func TestReadConfigInterpolation(t *testing.T) {
+	expect := shared.NewExpect(t)
+	os.Setenv("GOLLUM_TEST_TOPIC", "logs")
+
+	configFile, err := ioutil.TempFile("", "gollum_config")
+	expect.NoError(err)
+	configFile.WriteString("- \"producer.Kafka\":\n" +
+		"    Topic:\n" +
+		"        \"*\": \"${GOLLUM_TEST_TOPIC}\"\n" +
+		"    Servers:\n" +
+		"        - \"${GOLLUM_TEST_HOST:-localhost}:9092\"\n")
+	configFile.Close()
+	defer os.Remove(configFile.Name())
+
+	config, err := ReadConfig(configFile.Name())
+	expect.NoError(err)
+	expect.Equal(1, len(config.Plugins))
+
+	topics := config.Plugins[0].GetStreamMap("Topic", "")
+	expect.Equal("logs", topics[WildcardStreamID])
+	expect.Equal([]string{"localhost:9092"}, config.Plugins[0].GetStringArray("Servers", []string{}))
+}
+
+func TestReadConfigInclude(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum_config")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(name string, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		expect.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	writeConfig("main.yaml", "- \"consumer.Console\":\n"+
+		"- Include: \"conf.d/*.yaml\"\n"+
+		"- \"producer.Console\":\n")
+	writeConfig("conf.d/b.yaml", "- \"producer.File\":\n    File: \"b.log\"\n")
+	writeConfig("conf.d/a.yaml", "- \"producer.File\":\n    File: \"a.log\"\n"+
+		"- Include:\n    - \"../common.yaml\"\n    - \"b.yaml\"\n")
+	writeConfig("common.yaml", "- \"producer.Null\":\n")
+
+	config, err := ReadConfig(filepath.Join(dir, "main.yaml"))
+	expect.NoError(err)
+
+	typeNames := []string{}
+	for _, plugin := range config.Plugins {
+		typeNames = append(typeNames, plugin.Typename)
+	}
+	expect.Equal([]string{"consumer.Console", "producer.File", "producer.Null", "producer.File", "producer.Console"}, typeNames)
+	expect.Equal("a.log", config.Plugins[1].GetString("File", ""))
+	expect.Equal("b.log", config.Plugins[3].GetString("File", ""))
+
+	// Include cycles
+	writeConfig("common.yaml", "- Include: \"main.yaml\"\n")
+	_, err = ReadConfig(filepath.Join(dir, "main.yaml"))
+	expect.NotNil(err)
+
+	// Identical definitions
+	writeConfig("common.yaml", "- \"producer.File\":\n    File: \"b.log\"\n")
+	_, err = ReadConfig(filepath.Join(dir, "main.yaml"))
+	expect.NotNil(err)
+
+	// Missing files
+	writeConfig("common.yaml", "- Include: \"missing.yaml\"\n")
+	_, err = ReadConfig(filepath.Join(dir, "main.yaml"))
+	expect.NotNil(err)
+}
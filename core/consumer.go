@@ -16,8 +16,11 @@ package core
 
 import (
 	"fmt"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,6 +47,10 @@ type Consumer interface {
 //   Stream:
 //      - "error"
 //      - "default"
+//   TimestampOffsetMs: 0
+//   MaxFutureMs: -1
+//   Decompress: "none"
+//   DecompressMaxSizeKB: 65536
 //
 // Enable switches the consumer on or off. By default this value is set to true.
 //
@@ -51,11 +58,39 @@ type Consumer interface {
 // message channels this consumer will produce. By default this is set to "*"
 // which means only producers set to consume "all streams" will get these
 // messages.
+//
+// TimestampOffsetMs defines a number of milliseconds added to the timestamp of
+// each message. This can be used to correct a known clock skew of a source.
+// Negative values are allowed. By default this is set to 0.
+//
+// MaxFutureMs defines the maximum number of milliseconds a message timestamp
+// may lie in the future. Timestamps beyond this limit are set to the current
+// time. Set to -1 to disable this check. By default this is set to -1.
+//
+// Decompress defines the compression used for the payload of incoming
+// messages. Valid values are "none", "gzip", "zlib", "snappy", "zstd", "lz4"
+// and "auto". When set to "auto" the compression is detected by the magic bytes
+// of each payload and payloads that don't look compressed are passed as-is.
+// Payloads that fail to decompress are passed as-is, too. Snappy payloads may
+// use the framing format or be a single block.
+// By default this is set to "none".
+//
+// DecompressMaxSizeKB defines the maximum size of a decompressed payload in
+// kilobytes. Larger payloads are passed as-is, protecting against
+// decompression bombs. Set to 0 to disable this check. By default this is set
+// to 65536, i.e. 64 MB.
 type ConsumerBase struct {
-	control chan PluginControl
-	streams []MappedStream
-	state   *PluginRunState
-	timeout time.Duration
+	control    chan PluginControl
+	streams    []MappedStream
+	state      *PluginRunState
+	timeout    time.Duration
+	timeOffset time.Duration
+	maxFuture  time.Duration
+	fuses      []*Fuse
+	pause      *Fuse
+	enqueued   *int64
+	decompress string
+	maxSize    int
 }
 
 // ConsumerError can be used to return consumer related errors e.g. during a
@@ -79,6 +114,20 @@ func (cons *ConsumerBase) Configure(conf PluginConfig) error {
 	cons.control = make(chan PluginControl, 1)
 	cons.timeout = time.Duration(conf.GetInt("ChannelTimeout", 0)) * time.Millisecond
 	cons.state = new(PluginRunState)
+	cons.pause = newFuse()
+	cons.enqueued = new(int64)
+	cons.timeOffset = time.Duration(conf.GetInt("TimestampOffsetMs", 0)) * time.Millisecond
+	cons.maxFuture = time.Duration(conf.GetInt("MaxFutureMs", -1)) * time.Millisecond
+	cons.decompress = strings.ToLower(conf.GetString("Decompress", "none"))
+	cons.maxSize = conf.GetInt("DecompressMaxSizeKB", 65536) << 10
+
+	switch cons.decompress {
+	case "none", "auto":
+	default:
+		if _, err := NewCompressor(cons.decompress); err != nil {
+			return NewConsumerError("Decompress: ", err)
+		}
+	}
 
 	for _, streamName := range conf.Stream {
 		streamID := GetStreamID(streamName)
@@ -87,6 +136,7 @@ func (cons *ConsumerBase) Configure(conf PluginConfig) error {
 			Stream:   StreamTypes.GetStreamOrFallback(streamID),
 		})
 	}
+	cons.fuses = getFuses(cons.Streams())
 
 	return nil
 }
@@ -130,15 +180,114 @@ func (cons *ConsumerBase) EnqueueCopy(data []byte, sequence uint64) {
 	cons.EnqueueMessage(NewMessage(cons, dataCopy, sequence))
 }
 
+// EnqueueTracked behaves like Enqueue but calls onDelivered once all
+// producers the message has been passed to confirmed it. Producers confirm a
+// message after their message callback returned. Messages stored in a
+// MessageBatch are confirmed after the batch has been flushed successfully.
+// Messages that are removed by a filter count as confirmed. onDelivered is
+// never called if the message has been dropped, retried or discarded by any
+// producer, so the consumer has to redeliver these messages on its own.
+// onDelivered may be called from any go routine, also before this function
+// returns.
+func (cons *ConsumerBase) EnqueueTracked(data []byte, sequence uint64, onDelivered func()) {
+	msg := NewMessage(cons, data, sequence)
+	msg.tracker = newMessageTracker(onDelivered)
+	cons.EnqueueMessage(msg)
+	msg.tracker.release()
+}
+
 // EnqueueMessage passes a given message  to all streams.
-// Only the StreamID of the message is modified, everything else is passed as-is.
+// Only the StreamID, the Timestamp and the Data of the message are modified,
+// everything else is passed as-is. The Timestamp is changed by
+// TimestampOffsetMs and MaxFutureMs, the Data is changed by Decompress.
+// This function blocks while the consumer is paused.
 func (cons *ConsumerBase) EnqueueMessage(msg Message) {
+	cons.pause.Wait()
+	cons.correctTimestamp(&msg)
+	cons.decompressData(&msg)
+	atomic.AddInt64(cons.enqueued, 1)
 	for _, mapping := range cons.streams {
 		msg.StreamID = mapping.StreamID
 		mapping.Stream.Enqueue(msg)
 	}
 }
 
+// EnqueueMessageTo passes a given message to the given stream instead of the
+// streams configured for this consumer. The Timestamp and Data are changed as
+// in EnqueueMessage. This function blocks while the consumer is paused.
+func (cons *ConsumerBase) EnqueueMessageTo(msg Message, streamID MessageStreamID) {
+	cons.pause.Wait()
+	cons.correctTimestamp(&msg)
+	cons.decompressData(&msg)
+	atomic.AddInt64(cons.enqueued, 1)
+	msg.StreamID = streamID
+	StreamTypes.GetStreamOrFallback(streamID).Enqueue(msg)
+}
+
+// correctTimestamp applies the configured clock skew correction to the given
+// message.
+func (cons *ConsumerBase) correctTimestamp(msg *Message) {
+	if cons.timeOffset != 0 {
+		msg.Timestamp = msg.Timestamp.Add(cons.timeOffset)
+	}
+	if cons.maxFuture >= 0 {
+		if now := time.Now(); msg.Timestamp.Sub(now) > cons.maxFuture {
+			msg.Timestamp = now
+		}
+	}
+}
+
+// decompressData applies the configured payload decompression to the given
+// message.
+func (cons *ConsumerBase) decompressData(msg *Message) {
+	algorithm := cons.decompress
+	if algorithm == "auto" {
+		algorithm = DetectCompression(msg.Data)
+	}
+	if algorithm == "none" || algorithm == "" {
+		return // ### return, not compressed ###
+	}
+
+	data, err := Decompress(algorithm, msg.Data, cons.maxSize)
+	if err != nil {
+		Log.Warning.Printf("Failed to decompress %s payload: %s", algorithm, err)
+		return // ### return, pass as-is ###
+	}
+	msg.Data = data
+}
+
+// IsFuseBurned returns true if the fuse of any stream this consumer is writing
+// to is burned. Consumers should stop accepting new data in this case.
+func (cons *ConsumerBase) IsFuseBurned() bool {
+	if cons.pause.IsBurned() {
+		return true // ### return, paused ###
+	}
+	for _, fuse := range cons.fuses {
+		if fuse.IsBurned() {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitOnFuse blocks until the fuses of all streams this consumer is writing
+// to are active. Consumers should call this function before reading new data.
+func (cons *ConsumerBase) WaitOnFuse() {
+	cons.pause.Wait()
+	for _, fuse := range cons.fuses {
+		fuse.Wait()
+	}
+}
+
+// Stats returns the number of messages enqueued by this consumer and its
+// pause state. This implements the StatsReporter interface.
+func (cons *ConsumerBase) Stats() PluginStats {
+	return PluginStats{
+		Messages: atomic.LoadInt64(cons.enqueued),
+		Paused:   cons.state.IsPaused(),
+	}
+}
+
 // Streams returns an array with all stream ids this consumer is writing to.
 func (cons *ConsumerBase) Streams() []MessageStreamID {
 	streamIDs := make([]MessageStreamID, 0, len(cons.streams))
@@ -161,11 +310,23 @@ func (cons *ConsumerBase) ProcessCommand(command PluginControl, onRoll func()) b
 	default:
 		// Do nothing
 	case PluginControlStop:
+		// Paused consumers have to continue in order to stop
+		if cons.state.Resume() {
+			cons.pause.Activate()
+		}
 		return true // ### return ###
 	case PluginControlRoll:
 		if onRoll != nil {
 			onRoll()
 		}
+	case PluginControlPause:
+		if cons.state.Pause() {
+			cons.pause.Burn()
+		}
+	case PluginControlResume:
+		if cons.state.Resume() {
+			cons.pause.Activate()
+		}
 	}
 
 	return false
@@ -0,0 +1,120 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestConsumerTimestampCorrection(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := NewPluginConfig("core.ConsumerBase")
+	conf.Settings["TimestampOffsetMs"] = -60000
+	conf.Settings["MaxFutureMs"] = 1000
+
+	cons := ConsumerBase{}
+	expect.NoError(cons.Configure(conf))
+
+	start := time.Now()
+	msg := NewMessage(nil, []byte("test"), 0)
+
+	// Skewed timestamps are shifted by the offset
+	msg.Timestamp = start
+	cons.correctTimestamp(&msg)
+	expect.Equal(start.Add(-time.Minute), msg.Timestamp)
+
+	// Timestamps too far in the future are clamped to the current time
+	msg.Timestamp = start.Add(time.Hour)
+	cons.correctTimestamp(&msg)
+	expect.False(msg.Timestamp.Before(start))
+	expect.True(msg.Timestamp.Before(start.Add(time.Minute)))
+
+	// Clamping is disabled by default
+	cons = ConsumerBase{}
+	expect.NoError(cons.Configure(NewPluginConfig("core.ConsumerBase")))
+	msg.Timestamp = start.Add(time.Hour)
+	cons.correctTimestamp(&msg)
+	expect.Equal(start.Add(time.Hour), msg.Timestamp)
+}
+
+func TestConsumerDecompress(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := NewPluginConfig("core.ConsumerBase")
+	conf.Settings["Decompress"] = "auto"
+	conf.Settings["DecompressMaxSizeKB"] = 1
+
+	cons := ConsumerBase{}
+	expect.NoError(cons.Configure(conf))
+
+	gzip, _ := NewCompressor("gzip")
+	compressed, _ := Compress(gzip, []byte("test"))
+	msg := NewMessage(nil, compressed, 0)
+	cons.decompressData(&msg)
+	expect.Equal("test", string(msg.Data))
+
+	// Plain payloads and payloads exceeding the size limit are passed as-is
+	cons.decompressData(&msg)
+	expect.Equal("test", string(msg.Data))
+
+	compressed, _ = Compress(gzip, bytes.Repeat([]byte("x"), 2048))
+	msg.Data = compressed
+	cons.decompressData(&msg)
+	expect.Equal(string(compressed), string(msg.Data))
+
+	// Malformed snappy blocks are passed as-is
+	conf.Settings["Decompress"] = "snappy"
+	expect.NoError(cons.Configure(conf))
+	malformed := []byte("\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01")
+	msg.Data = malformed
+	cons.decompressData(&msg)
+	expect.Equal(string(malformed), string(msg.Data))
+
+	conf.Settings["Decompress"] = "unknown"
+	expect.True(cons.Configure(conf) != nil)
+}
+
+func TestConsumerPause(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := NewPluginConfig("core.ConsumerBase")
+
+	cons := ConsumerBase{}
+	expect.NoError(cons.Configure(conf))
+	expect.False(cons.IsFuseBurned())
+
+	expect.False(cons.ProcessCommand(PluginControlPause, nil))
+	expect.True(cons.IsFuseBurned())
+	expect.True(cons.Stats().Paused)
+
+	resumed := make(chan struct{})
+	go func() {
+		cons.WaitOnFuse()
+		close(resumed)
+	}()
+
+	select {
+	case <-resumed:
+		t.Error("WaitOnFuse returned while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Stopping a paused consumer resumes it
+	expect.True(cons.ProcessCommand(PluginControlStop, nil))
+	<-resumed
+	expect.False(cons.IsFuseBurned())
+	expect.False(cons.Stats().Paused)
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// FaultInjection holds the configuration for the soak test mode. All rates are
+// given as a probability in the range [0..1] and are evaluated per message
+// when the message is passed to a producer derived from ProducerBase.
+type FaultInjection struct {
+	// FailRate is the probability of a message being rejected by its sink.
+	// Rejected messages are dropped, i.e. sent to the retry queue.
+	FailRate float64
+
+	// SlowRate is the probability of a message being delayed by up to
+	// MaxDelay before it is passed to the producer.
+	SlowRate float64
+
+	// MalformedRate is the probability of the message payload being mangled.
+	MalformedRate float64
+
+	// MaxDelay defines the upper bound for delays caused by SlowRate.
+	MaxDelay time.Duration
+}
+
+// FaultInjectionStats holds the counters collected during a soak test.
+type FaultInjectionStats struct {
+	Failed    uint64
+	Delayed   uint64
+	Malformed uint64
+	Lost      uint64
+}
+
+var (
+	faultConfig *FaultInjection
+	faultStats  FaultInjectionStats
+)
+
+// EnableFaultInjection activates the soak test mode with the given fault
+// rates. This function has to be called before any plugin is started.
+func EnableFaultInjection(config FaultInjection) {
+	faultConfig = &config
+}
+
+// IsFaultInjectionEnabled returns true if EnableFaultInjection has been called.
+func IsFaultInjectionEnabled() bool {
+	return faultConfig != nil
+}
+
+// GetFaultInjectionStats returns a snapshot of the soak test counters.
+// This function is threadsafe.
+func GetFaultInjectionStats() FaultInjectionStats {
+	return FaultInjectionStats{
+		Failed:    atomic.LoadUint64(&faultStats.Failed),
+		Delayed:   atomic.LoadUint64(&faultStats.Delayed),
+		Malformed: atomic.LoadUint64(&faultStats.Malformed),
+		Lost:      atomic.LoadUint64(&faultStats.Lost),
+	}
+}
+
+// countLostMessage is called whenever a message is discarded without being
+// passed to any other queue.
+func countLostMessage() {
+	if faultConfig != nil {
+		atomic.AddUint64(&faultStats.Lost, 1)
+	}
+}
+
+// injectFault applies the configured faults to a given message. If false is
+// returned the message has been rejected and must not be processed further.
+func injectFault(msg *Message, timeout time.Duration) bool {
+	if rand.Float64() < faultConfig.FailRate {
+		atomic.AddUint64(&faultStats.Failed, 1)
+		msg.Drop(timeout)
+		return false // ### return, sink failure ###
+	}
+
+	if faultConfig.MaxDelay > 0 && rand.Float64() < faultConfig.SlowRate {
+		atomic.AddUint64(&faultStats.Delayed, 1)
+		time.Sleep(time.Duration(rand.Int63n(int64(faultConfig.MaxDelay))))
+	}
+
+	if len(msg.Data) > 0 && rand.Float64() < faultConfig.MalformedRate {
+		atomic.AddUint64(&faultStats.Malformed, 1)
+
+		// Work on a copy as the payload might be shared between streams
+		malformed := make([]byte, rand.Intn(len(msg.Data))+1)
+		copy(malformed, msg.Data)
+		malformed[rand.Intn(len(malformed))] ^= byte(rand.Intn(255) + 1)
+		msg.Data = malformed
+	}
+
+	return true
+}
@@ -19,3 +19,19 @@ package core
 type Filter interface {
 	Accepts(msg Message) bool
 }
+
+// PassThroughFilter is implemented by filters that may accept all messages,
+// e.g. filter.All. If PassThrough returns true, streams do not call the
+// filter at all.
+type PassThroughFilter interface {
+	Filter
+
+	// PassThrough returns true if Accepts would return true for any message.
+	PassThrough() bool
+}
+
+// isPassThroughFilter returns true if the given filter accepts all messages.
+func isPassThroughFilter(filter Filter) bool {
+	passThrough, isPassThrough := filter.(PassThroughFilter)
+	return isPassThrough && passThrough.PassThrough()
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync"
+)
+
+// formattedMessage stores the result of a formatter run by a formatPool.
+type formattedMessage struct {
+	pool     *formatPool
+	data     []byte
+	streamID MessageStreamID
+}
+
+// formatPool formats the messages of a producer by using multiple goroutines
+// before they are passed to the producer's main loop. If ordered is set,
+// messages leave the pool in the order they entered it. This order is global,
+// i.e. it is not tracked per stream.
+type formatPool struct {
+	format  Formatter
+	workers int
+	ordered bool
+	input   <-chan Message
+	output  chan Message
+	slots   sync.Pool
+}
+
+type formatJob struct {
+	msg  Message
+	slot chan Message
+}
+
+// newFormatPool creates a pool formatting messages read from input. The
+// formatted messages are written to the output channel of the pool once start
+// has been called. The output channel is closed after input has been closed
+// and all messages have been formatted.
+func newFormatPool(format Formatter, workers int, ordered bool, input <-chan Message) *formatPool {
+	pool := &formatPool{
+		format:  format,
+		workers: workers,
+		ordered: ordered,
+		input:   input,
+		output:  make(chan Message, workers),
+	}
+	pool.slots.New = func() interface{} { return make(chan Message, 1) }
+	return pool
+}
+
+// start starts the workers of the pool. The workers stop after the input
+// channel has been closed.
+func (pool *formatPool) start() {
+	if pool.ordered {
+		pool.startOrdered(pool.input)
+	} else {
+		pool.startUnordered(pool.input)
+	}
+}
+
+func (pool *formatPool) formatMessage(msg Message) Message {
+	data, streamID := pool.format.Format(msg)
+	msg.formatted = &formattedMessage{pool, data, streamID}
+	return msg
+}
+
+// startUnordered starts workers reading from input and writing to output
+// directly.
+func (pool *formatPool) startUnordered(input <-chan Message) {
+	workers := new(sync.WaitGroup)
+	workers.Add(pool.workers)
+
+	for i := 0; i < pool.workers; i++ {
+		go func() {
+			defer workers.Done()
+			for msg := range input {
+				pool.output <- pool.formatMessage(msg)
+			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(pool.output)
+	}()
+}
+
+// startOrdered starts workers receiving jobs from a dispatcher. Each job has a
+// slot the result is written to. The slots are queued in input order and
+// are read by a collector writing results to output in this order.
+func (pool *formatPool) startOrdered(input <-chan Message) {
+	jobs := make(chan formatJob, pool.workers)
+	slots := make(chan chan Message, 4*pool.workers)
+
+	for i := 0; i < pool.workers; i++ {
+		go func() {
+			for job := range jobs {
+				job.slot <- pool.formatMessage(job.msg)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		defer close(slots)
+		for msg := range input {
+			slot := pool.slots.Get().(chan Message)
+			slots <- slot
+			jobs <- formatJob{msg, slot}
+		}
+	}()
+
+	go func() {
+		defer close(pool.output)
+		for slot := range slots {
+			msg := <-slot
+			pool.slots.Put(slot)
+			pool.output <- msg
+		}
+	}()
+}
+
+// pending returns the number of messages inside the pool.
+func (pool *formatPool) pending() int {
+	return len(pool.output)
+}
+
+// formatted returns the result of the pool's formatter for a message if the
+// message has been formatted by this pool.
+func (pool *formatPool) formatted(msg Message) ([]byte, MessageStreamID, bool) {
+	if pool == nil || msg.formatted == nil || msg.formatted.pool != pool {
+		return nil, msg.StreamID, false
+	}
+	return msg.formatted.data, msg.formatted.streamID, true
+}
+
+// pooledFormatter is returned by ProducerBase.GetFormatter if a format pool
+// is used so that helpers like MessageBatch use the results of the pool.
+type pooledFormatter struct {
+	pool *formatPool
+}
+
+// Format returns the result of the pool if the message has been formatted by
+// it and calls the formatter otherwise.
+func (format pooledFormatter) Format(msg Message) ([]byte, MessageStreamID) {
+	if data, streamID, isFormatted := format.pool.formatted(msg); isFormatted {
+		return data, streamID
+	}
+	return format.pool.format.Format(msg)
+}
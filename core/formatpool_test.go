@@ -0,0 +1,99 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFormatter delays early messages so that later messages are formatted
+// first if multiple workers are used.
+type slowFormatter struct {
+	calls *int32
+}
+
+func (format slowFormatter) Format(msg Message) ([]byte, MessageStreamID) {
+	atomic.AddInt32(format.calls, 1)
+	time.Sleep(time.Duration(10-msg.Sequence%10) * time.Millisecond)
+	return append([]byte("formatted "), msg.Data...), msg.StreamID + 1
+}
+
+func TestFormatPoolOrdered(t *testing.T) {
+	expect := shared.NewExpect(t)
+	format := slowFormatter{new(int32)}
+	input := make(chan Message, 20)
+
+	pool := newFormatPool(format, 4, true, input)
+	pool.start()
+	for i := 0; i < 20; i++ {
+		input <- NewMessage(nil, []byte("test"), uint64(i))
+	}
+	close(input)
+
+	next := uint64(0)
+	for msg := range pool.output {
+		expect.Equal(next, msg.Sequence)
+		next++
+
+		data, streamID, isFormatted := pool.formatted(msg)
+		expect.True(isFormatted)
+		expect.Equal("formatted test", string(data))
+		expect.Equal(WildcardStreamID+1, streamID)
+		expect.Equal("test", string(msg.Data))
+	}
+	expect.Equal(uint64(20), next)
+	expect.Equal(int32(20), atomic.LoadInt32(format.calls))
+
+	// Results are returned by the pooled formatter without formatting again
+	formatter := pooledFormatter{pool}
+	msg := pool.formatMessage(NewMessage(nil, []byte("pooled"), 0))
+	data, _ := formatter.Format(msg)
+	expect.Equal("formatted pooled", string(data))
+	expect.Equal(int32(21), atomic.LoadInt32(format.calls))
+
+	// Messages formatted by other pools are formatted again
+	otherPool := &formatPool{format: format}
+	_, _, isFormatted := otherPool.formatted(msg)
+	expect.False(isFormatted)
+	_, _, isFormatted = (*formatPool)(nil).formatted(msg)
+	expect.False(isFormatted)
+}
+
+func TestFormatPoolUnordered(t *testing.T) {
+	expect := shared.NewExpect(t)
+	input := make(chan Message, 20)
+
+	pool := newFormatPool(slowFormatter{new(int32)}, 4, false, input)
+	pool.start()
+	for i := 0; i < 20; i++ {
+		input <- NewMessage(nil, []byte("test"), uint64(i))
+	}
+	close(input)
+
+	// The order depends on scheduling, so only the set of results is checked
+	seen := make(map[uint64]bool)
+	for msg := range pool.output {
+		expect.False(seen[msg.Sequence])
+		expect.Equal("formatted test", string(msg.formatted.data))
+		seen[msg.Sequence] = true
+	}
+	expect.Equal(20, len(seen))
+	for i := uint64(0); i < 20; i++ {
+		expect.True(seen[i])
+	}
+}
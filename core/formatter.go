@@ -21,3 +21,60 @@ type Formatter interface {
 	// In addition to that the formatter may change the stream of the message.
 	Format(msg Message) ([]byte, MessageStreamID)
 }
+
+// MetadataFormatter is implemented by formatters that attach metadata to a
+// message, e.g. values extracted from the payload. Streams call
+// FormatMetadata instead of Format for these formatters. Producers only use
+// Format, so metadata is only attached if the formatter is used by a stream.
+type MetadataFormatter interface {
+	Formatter
+
+	// FormatMetadata behaves like Format but also returns the metadata of
+	// the formatted message. The metadata of the given message must not be
+	// modified, use MessageMetadata.Clone to create a copy.
+	FormatMetadata(msg Message) ([]byte, MessageStreamID, MessageMetadata)
+}
+
+// PassThroughFormatter is implemented by formatters that may return payload
+// and stream of a message unchanged, e.g. format.Forward. If PassThrough
+// returns true, streams and producers do not call the formatter at all.
+type PassThroughFormatter interface {
+	Formatter
+
+	// PassThrough returns true if Format would return the message unchanged.
+	PassThrough() bool
+}
+
+// FormatterRunner is implemented by formatters running background tasks, e.g.
+// to keep a cache up to date. These tasks must not be started by Configure as
+// plugins are configured when testing a configuration, too. Start is called
+// when the producer or stream using the formatter is started. Stop is called
+// after the producer or stream has been stopped and blocks until the
+// background tasks have finished. Formatters wrapping other formatters should
+// pass both calls on using StartFormatter and StopFormatter.
+type FormatterRunner interface {
+	Start()
+	Stop()
+}
+
+// StartFormatter calls Start if the given formatter implements
+// FormatterRunner.
+func StartFormatter(format Formatter) {
+	if runner, isRunner := format.(FormatterRunner); isRunner {
+		runner.Start()
+	}
+}
+
+// StopFormatter calls Stop if the given formatter implements FormatterRunner.
+func StopFormatter(format Formatter) {
+	if runner, isRunner := format.(FormatterRunner); isRunner {
+		runner.Stop()
+	}
+}
+
+// isPassThroughFormatter returns true if the given formatter does not modify
+// messages.
+func isPassThroughFormatter(format Formatter) bool {
+	passThrough, isPassThrough := format.(PassThroughFormatter)
+	return isPassThrough && passThrough.PassThrough()
+}
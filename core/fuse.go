@@ -0,0 +1,188 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	metricFusesBurned = "FusesBurned"
+)
+
+// FusePolicy defines how a stream reacts to a burned fuse.
+type FusePolicy int
+
+const (
+	// FusePolicyNone ignores back-pressure, i.e. messages are queued, retried
+	// or dropped by the producers as configured.
+	FusePolicyNone = FusePolicy(iota)
+
+	// FusePolicyPause causes consumers that support it to pause reading new
+	// messages while the fuse is burned.
+	FusePolicyPause = FusePolicy(iota)
+
+	// FusePolicyBlock behaves like FusePolicyPause but also blocks all
+	// messages sent to the stream until the fuse is active again.
+	FusePolicyBlock = FusePolicy(iota)
+)
+
+// Fuse signals back-pressure from the producers of a stream to its
+// consumers. A fuse can be burned by multiple producers and stays burned
+// until all of them activated it again.
+type Fuse struct {
+	burned int32
+	active chan struct{}
+	guard  *sync.Mutex
+}
+
+// fuses is written during configuration only and is read-only afterwards,
+// so no locking is required to access the map itself.
+var fuses = make(map[MessageStreamID]*Fuse)
+
+// fusesReleased is set by ReleaseFuses to prevent fuses from being burned
+// during shutdown.
+var fusesReleased = int32(0)
+
+func init() {
+	shared.Metric.New(metricFusesBurned)
+}
+
+func newFuse() *Fuse {
+	active := make(chan struct{})
+	close(active)
+	return &Fuse{
+		active: active,
+		guard:  new(sync.Mutex),
+	}
+}
+
+// ParseFusePolicy converts the name of a fuse policy to a FusePolicy.
+func ParseFusePolicy(name string) (FusePolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return FusePolicyNone, nil
+	case "pause":
+		return FusePolicyPause, nil
+	case "block":
+		return FusePolicyBlock, nil
+	default:
+		return FusePolicyNone, fmt.Errorf("Unknown fuse policy %s", name)
+	}
+}
+
+// setFusePolicy creates a fuse for the given stream if the policy requires
+// one.
+func setFusePolicy(streamID MessageStreamID, policy FusePolicy) {
+	if policy != FusePolicyNone {
+		if _, exists := fuses[streamID]; !exists {
+			fuses[streamID] = newFuse()
+		}
+	}
+}
+
+// GetFuse returns the fuse of the given stream or nil if the stream has no
+// fuse policy set.
+func GetFuse(streamID MessageStreamID) *Fuse {
+	return fuses[streamID]
+}
+
+// getFuses returns the fuses of all given streams. The wildcard stream maps
+// to all fuses.
+func getFuses(streamIDs []MessageStreamID) []*Fuse {
+	result := []*Fuse{}
+	for _, streamID := range streamIDs {
+		if streamID == WildcardStreamID {
+			result = result[:0]
+			for _, fuse := range fuses {
+				result = append(result, fuse)
+			}
+			return result // ### return, all fuses ###
+		}
+		if fuse, exists := fuses[streamID]; exists {
+			result = append(result, fuse)
+		}
+	}
+	return result
+}
+
+// ReleaseFuses activates all fuses regardless of the number of times they
+// have been burned. Fuses cannot be burned anymore after this function has
+// been called. This is called during shutdown so that paused consumers can
+// stop.
+func ReleaseFuses() {
+	atomic.StoreInt32(&fusesReleased, 1)
+	for _, fuse := range fuses {
+		fuse.guard.Lock()
+		if atomic.SwapInt32(&fuse.burned, 0) > 0 {
+			close(fuse.active)
+			shared.Metric.Dec(metricFusesBurned)
+		}
+		fuse.guard.Unlock()
+	}
+}
+
+// Burn marks the fuse as burned. Each call to Burn has to be followed by a
+// call to Activate.
+func (fuse *Fuse) Burn() {
+	if atomic.LoadInt32(&fusesReleased) == 1 {
+		return // ### return, fuses released ###
+	}
+
+	fuse.guard.Lock()
+	defer fuse.guard.Unlock()
+
+	if atomic.AddInt32(&fuse.burned, 1) == 1 {
+		fuse.active = make(chan struct{})
+		shared.Metric.Inc(metricFusesBurned)
+	}
+}
+
+// Activate reverts one call to Burn. The fuse is active again once all
+// calls to Burn have been reverted.
+func (fuse *Fuse) Activate() {
+	fuse.guard.Lock()
+	defer fuse.guard.Unlock()
+
+	burned := atomic.LoadInt32(&fuse.burned)
+	if burned == 0 {
+		return // ### return, not burned ###
+	}
+	if atomic.StoreInt32(&fuse.burned, burned-1); burned == 1 {
+		close(fuse.active)
+		shared.Metric.Dec(metricFusesBurned)
+	}
+}
+
+// IsBurned returns true if the fuse is burned.
+func (fuse *Fuse) IsBurned() bool {
+	return atomic.LoadInt32(&fuse.burned) > 0
+}
+
+// Wait blocks until the fuse is active.
+func (fuse *Fuse) Wait() {
+	if !fuse.IsBurned() {
+		return // ### return, active ###
+	}
+
+	fuse.guard.Lock()
+	active := fuse.active
+	fuse.guard.Unlock()
+	<-active
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestFuse(t *testing.T) {
+	expect := shared.NewExpect(t)
+	streamID := GetStreamID("fuseTest")
+	defer delete(fuses, streamID)
+
+	setFusePolicy(streamID, FusePolicyNone)
+	expect.Nil(GetFuse(streamID))
+
+	setFusePolicy(streamID, FusePolicyPause)
+	fuse := GetFuse(streamID)
+	expect.NotNil(fuse)
+	expect.Equal(1, len(getFuses([]MessageStreamID{streamID, GetStreamID("noFuse")})))
+
+	fuse.Burn()
+	fuse.Burn()
+	expect.True(fuse.IsBurned())
+
+	// The fuse stays burned until all burns have been reverted
+	fuse.Activate()
+	expect.True(fuse.IsBurned())
+
+	released := make(chan bool)
+	go func() {
+		fuse.Wait()
+		released <- true
+	}()
+
+	select {
+	case <-released:
+		t.Error("Wait returned on a burned fuse")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fuse.Activate()
+	expect.False(fuse.IsBurned())
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Error("Wait did not return on an active fuse")
+	}
+
+	// Activating an active fuse is ignored
+	fuse.Activate()
+	expect.False(fuse.IsBurned())
+}
+
+func TestParseFusePolicy(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	policy, err := ParseFusePolicy("Block")
+	expect.NoError(err)
+	expect.Equal(FusePolicyBlock, policy)
+
+	policy, err = ParseFusePolicy("")
+	expect.NoError(err)
+	expect.Equal(FusePolicyNone, policy)
+
+	_, err = ParseFusePolicy("drop")
+	expect.NotNil(err)
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health events written to HealthInternalStream
+const (
+	// HealthPluginStarted is sent after a consumer or producer has been started
+	HealthPluginStarted = "plugin_started"
+	// HealthPluginStopped is sent after a consumer has been stopped
+	HealthPluginStopped = "plugin_stopped"
+	// HealthFileRotated is sent after a file has been rotated
+	HealthFileRotated = "file_rotated"
+	// HealthEndpointOffline is sent if a producer burns its fuses because its
+	// endpoint is not available
+	HealthEndpointOffline = "endpoint_offline"
+	// HealthEndpointOnline is sent if the endpoint of a producer is available
+	// again
+	HealthEndpointOnline = "endpoint_online"
+	// HealthQueueHigh is sent if the channel of a producer exceeds the high
+	// watermark
+	HealthQueueHigh = "queue_high_watermark"
+	// HealthQueueLow is sent if the channel of a producer has been drained
+	// below the low watermark again
+	HealthQueueLow = "queue_low_watermark"
+)
+
+const healthQueueSize = 1024
+
+// healthEvents forwards health events to HealthInternalStream. Events are
+// queued so that sending an event never blocks. Events are discarded if the
+// queue is full.
+type healthEvents struct {
+	queue    chan Message
+	done     chan struct{}
+	guard    *sync.RWMutex
+	sequence uint64
+	stopped  bool
+}
+
+var health *healthEvents
+
+// StartHealthEvents enables sending health events if at least one producer
+// listens to HealthInternalStream.
+func StartHealthEvents() {
+	if !StreamTypes.IsStreamRegistered(HealthInternalStreamID) {
+		return // ### return, no listeners ###
+	}
+
+	events := &healthEvents{
+		queue: make(chan Message, healthQueueSize),
+		done:  make(chan struct{}),
+		guard: new(sync.RWMutex),
+	}
+
+	stream := StreamTypes.GetStream(HealthInternalStreamID)
+	go func() {
+		defer close(events.done)
+		for msg := range events.queue {
+			stream.Enqueue(msg)
+		}
+	}()
+	health = events
+}
+
+// StopHealthEvents sends all queued health events and disables sending new
+// events. This has to be called before producers are stopped.
+func StopHealthEvents() {
+	events := health
+	if events == nil {
+		return // ### return, not started ###
+	}
+
+	events.guard.Lock()
+	events.stopped = true
+	close(events.queue)
+	events.guard.Unlock()
+	<-events.done
+}
+
+// EmitHealthEvent sends a health event as JSON object to HealthInternalStream.
+// The object contains the keys "event", "time" and "plugin" as well as the
+// given fields. Events are discarded if no producer listens to
+// HealthInternalStream.
+func EmitHealthEvent(event string, plugin string, fields map[string]interface{}) {
+	events := health
+	if events == nil {
+		return // ### return, disabled ###
+	}
+
+	now := time.Now()
+	record := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		record[key] = value
+	}
+	record["event"] = event
+	record["time"] = now.UTC().Format(time.RFC3339Nano)
+	record["plugin"] = plugin
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return // ### return, invalid fields ###
+	}
+
+	msg := NewMessage(nil, data, atomic.AddUint64(&events.sequence, 1))
+	msg.StreamID = HealthInternalStreamID
+	msg.Timestamp = now
+
+	events.guard.RLock()
+	defer events.guard.RUnlock()
+	if !events.stopped {
+		select {
+		case events.queue <- msg:
+		default:
+			// Queue is full, discard the event
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/shared"
+	"sync"
+	"testing"
+)
+
+func TestHealthEvents(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	// Disabled events are ignored
+	EmitHealthEvent(HealthPluginStarted, "producer.Test", nil)
+
+	health = &healthEvents{
+		queue: make(chan Message, 1),
+		done:  make(chan struct{}),
+		guard: new(sync.RWMutex),
+	}
+	defer func() { health = nil }()
+
+	EmitHealthEvent(HealthFileRotated, "producer.File", map[string]interface{}{"file": "test.log", "event": "overwritten"})
+	EmitHealthEvent(HealthPluginStarted, "producer.Test", nil) // queue is full
+	expect.Equal(1, len(health.queue))
+
+	msg := <-health.queue
+	expect.Equal(HealthInternalStreamID, msg.StreamID)
+	expect.Equal(uint64(1), msg.Sequence)
+
+	record := make(map[string]interface{})
+	expect.NoError(json.Unmarshal(msg.Data, &record))
+	expect.Equal(HealthFileRotated, record["event"])
+	expect.Equal("producer.File", record["plugin"])
+	expect.Equal("test.log", record["file"])
+
+	close(health.done)
+	StopHealthEvents()
+	EmitHealthEvent(HealthPluginStopped, "producer.Test", nil)
+	expect.Equal(0, len(health.queue))
+}
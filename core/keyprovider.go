@@ -0,0 +1,26 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+// KeyProvider is the interface definition for plugins providing encryption
+// keys, e.g. by requesting them from a key management service. Key providers
+// are created by type name and configured with the settings of the plugin
+// using them.
+type KeyProvider interface {
+	// GetKey returns the key to use for encrypting new data and an ID that
+	// is stored along with the encrypted data to identify the key. This
+	// function is called each time new data is encrypted so keys may change.
+	GetKey() ([]byte, string, error)
+}
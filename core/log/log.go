@@ -15,10 +15,18 @@
 package Log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // Verbosity defines an enumeration for log verbosity
@@ -35,6 +43,21 @@ const (
 	VerbosityDebug = Verbosity(iota)
 )
 
+// Format defines an enumeration for log output formats
+type Format byte
+
+const (
+	// FormatText writes one line of text per message
+	FormatText = Format(iota)
+	// FormatJSON writes one JSON object per message
+	FormatJSON = Format(iota)
+)
+
+// Fields contains additional values written with a log message. Fields are
+// written as key=value pairs in text format and as additional keys in JSON
+// format.
+type Fields map[string]interface{}
+
 type logReferrer struct {
 	writer io.Writer
 }
@@ -42,9 +65,14 @@ type logReferrer struct {
 type logNull struct {
 }
 
+// logLevel writes messages of one verbosity level as log records.
+type logLevel struct {
+	level Verbosity
+}
+
 var (
 	// Error is a predefined log channel for errors. This log is backed by consumer.Log
-	Error = log.New(logEnabled, "ERROR: ", log.Lshortfile)
+	Error = log.New(logLevel{VerbosityError}, "", log.Lshortfile)
 
 	// Warning is a predefined log channel for warnings. This log is backed by consumer.Log
 	Warning = log.New(logDisabled, "", 0)
@@ -55,8 +83,15 @@ var (
 	// Debug is a predefined log channel for debug messages. This log is backed by consumer.Log
 	Debug = log.New(logDisabled, "", 0)
 
-	logEnabled  = logReferrer{os.Stdout}
-	logDisabled = logNull{}
+	logEnabled   = logReferrer{os.Stdout}
+	logDisabled  = logNull{}
+	logOutput    = io.Writer(os.Stdout)
+	logFormat    = FormatText
+	logVerbosity = VerbosityError
+
+	logLevelNames  = []string{"error", "warning", "note", "debug"}
+	logTextPrefix  = []string{"ERROR: ", "Warning: ", "", "Debug: "}
+	logSourceRegex = regexp.MustCompile(`^([^\s:]+\.go:\d+): `)
 )
 
 func init() {
@@ -73,32 +108,151 @@ func SetVerbosity(loglevel Verbosity) {
 	Note = log.New(logDisabled, "", 0)
 	Debug = log.New(logDisabled, "", 0)
 
+	if loglevel > VerbosityDebug {
+		loglevel = VerbosityDebug
+	}
+	logVerbosity = loglevel
+
 	switch loglevel {
 	default:
 		fallthrough
 
 	case VerbosityDebug:
-		Debug = log.New(&logEnabled, "Debug: ", 0)
+		Debug = log.New(logLevel{VerbosityDebug}, "", 0)
 		fallthrough
 
 	case VerbosityNote:
-		Note = log.New(&logEnabled, "", 0)
+		Note = log.New(logLevel{VerbosityNote}, "", 0)
 		fallthrough
 
 	case VerbosityWarning:
-		Warning = log.New(&logEnabled, "Warning: ", log.Lshortfile)
+		Warning = log.New(logLevel{VerbosityWarning}, "", log.Lshortfile)
 		fallthrough
 
 	case VerbosityError:
-		Error = log.New(&logEnabled, "ERROR: ", log.Lshortfile)
+		Error = log.New(logLevel{VerbosityError}, "", log.Lshortfile)
 	}
 }
 
+// SetFormat defines the format log messages are written in.
+func SetFormat(format Format) {
+	logFormat = format
+}
+
+// SetOutput defines the writer logs are written to if they are not written to
+// a stream. By default this is os.Stdout.
+func SetOutput(writer io.Writer) {
+	logOutput = writer
+	SetWriter(writer)
+}
+
 // SetWriter forces (enabled) logs to be written to the given writer.
 func SetWriter(writer io.Writer) {
 	logEnabled.writer = writer
 }
 
+// ResetWriter writes (enabled) logs to the writer set by SetOutput again.
+func ResetWriter() {
+	SetWriter(logOutput)
+}
+
+// Error writes an error message with the given fields
+func (fields Fields) Error(message string) {
+	fields.write(VerbosityError, message)
+}
+
+// Warning writes a warning message with the given fields
+func (fields Fields) Warning(message string) {
+	fields.write(VerbosityWarning, message)
+}
+
+// Note writes a note message with the given fields
+func (fields Fields) Note(message string) {
+	fields.write(VerbosityNote, message)
+}
+
+// Debug writes a debug message with the given fields
+func (fields Fields) Debug(message string) {
+	fields.write(VerbosityDebug, message)
+}
+
+func (fields Fields) write(level Verbosity, message string) {
+	if level > logVerbosity {
+		return // ### return, level disabled ###
+	}
+
+	source := ""
+	if level <= VerbosityWarning {
+		if _, file, line, ok := runtime.Caller(2); ok {
+			source = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+	}
+	writeRecord(level, source, message, fields)
+}
+
+// writeRecord formats a log message in the current format and writes it.
+func writeRecord(level Verbosity, source string, message string, fields Fields) {
+	buffer := bytes.Buffer{}
+
+	switch logFormat {
+	case FormatJSON:
+		record := make(map[string]interface{}, len(fields)+4)
+		for key, value := range fields {
+			if err, isError := value.(error); isError {
+				value = err.Error()
+			}
+			record[key] = value
+		}
+		record["time"] = time.Now().Format(time.RFC3339Nano)
+		record["level"] = logLevelNames[level]
+		record["message"] = message
+		if source != "" {
+			record["source"] = source
+		}
+
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]string{"level": logLevelNames[level], "message": message})
+		}
+		buffer.Write(encoded)
+
+	default:
+		buffer.WriteString(logTextPrefix[level])
+		if source != "" {
+			buffer.WriteString(source)
+			buffer.WriteString(": ")
+		}
+		buffer.WriteString(message)
+
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&buffer, " %s=%v", key, fields[key])
+		}
+	}
+
+	logEnabled.Write(buffer.Bytes())
+}
+
+// Write converts a message written by a log.Logger into a log record.
+// The source file prefix added by log.Lshortfile is stored separately.
+func (log logLevel) Write(message []byte) (int, error) {
+	length := len(message)
+	text := string(bytes.TrimRight(message, "\n"))
+
+	source := ""
+	if match := logSourceRegex.FindStringSubmatch(text); match != nil {
+		source = match[1]
+		text = text[len(match[0]):]
+	}
+
+	writeRecord(log.level, source, text, nil)
+	return length, nil
+}
+
 // Write Drops all messages
 func (log logNull) Write(message []byte) (int, error) {
 	return len(message), nil
@@ -115,15 +269,16 @@ func (log logReferrer) Write(message []byte) (int, error) {
 		message = message[:length-1]
 	}
 
+	if _, isFile := log.writer.(*os.File); isFile {
+		fmt.Fprintln(log.writer, string(message))
+		return length, nil
+	}
+
 	switch {
 	case log.writer == nil:
 		fmt.Println(string(message))
 		return length, nil
 
-	case log.writer == os.Stdout || log.writer == os.Stderr:
-		fmt.Fprintln(log.writer, string(message))
-		return length, nil
-
 	default:
 		return log.writer.Write(message)
 	}
@@ -0,0 +1,65 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package Log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogFormats(t *testing.T) {
+	expect := shared.NewExpect(t)
+	buffer := new(bytes.Buffer)
+	SetOutput(buffer)
+	defer SetOutput(os.Stdout)
+	defer SetFormat(FormatText)
+
+	SetVerbosity(VerbosityWarning)
+	defer SetVerbosity(VerbosityError)
+
+	Error.Print("failed")
+	expect.True(strings.HasPrefix(buffer.String(), "ERROR: log_test.go:"))
+	expect.True(strings.HasSuffix(buffer.String(), ": failed"))
+
+	buffer.Reset()
+	Fields{"plugin": "test", "count": 2}.Warning("slow")
+	expect.True(strings.HasPrefix(buffer.String(), "Warning: log_test.go:"))
+	expect.True(strings.HasSuffix(buffer.String(), ": slow count=2 plugin=test"))
+
+	// Disabled levels are not written
+	buffer.Reset()
+	Note.Print("disabled")
+	Fields{}.Note("disabled")
+	expect.Equal(0, buffer.Len())
+
+	SetFormat(FormatJSON)
+	buffer.Reset()
+	Fields{"plugin": "test", "error": errors.New("broken")}.Error("failed")
+
+	record := make(map[string]interface{})
+	expect.NoError(json.Unmarshal(buffer.Bytes(), &record))
+	expect.Equal("error", record["level"])
+	expect.Equal("failed", record["message"])
+	expect.Equal("test", record["plugin"])
+	expect.Equal("broken", record["error"])
+
+	source, _ := record["source"].(string)
+	expect.True(strings.HasPrefix(source, "log_test.go:"))
+}
@@ -30,6 +30,10 @@ const (
 	WildcardStream = "*"
 	// DroppedStream is the name of the stream used to store dropped messages
 	DroppedStream = "_DROPPED_"
+	// HealthInternalStream is the name of the internal health event channel
+	HealthInternalStream = "_GOLLUM_HEALTH_"
+	// TraceInternalStream is the name of the internal trace span channel
+	TraceInternalStream = "_GOLLUM_TRACES_"
 )
 
 var (
@@ -41,6 +45,12 @@ var (
 
 	// DroppedStreamID is the ID of the "_DROPPED_" stream
 	DroppedStreamID = GetStreamID(DroppedStream)
+
+	// HealthInternalStreamID is the ID of the "_GOLLUM_HEALTH_" stream
+	HealthInternalStreamID = GetStreamID(HealthInternalStream)
+
+	// TraceInternalStreamID is the ID of the "_GOLLUM_TRACES_" stream
+	TraceInternalStreamID = GetStreamID(TraceInternalStream)
 )
 
 var retryQueue chan Message
@@ -81,14 +91,40 @@ type LinkableMessageSource interface {
 	IsLinked() bool
 }
 
+// MessageMetadata stores additional, named values attached to a message by
+// its consumer, e.g. the authenticated identity of a client.
+type MessageMetadata map[string]string
+
+// MetadataEventTime is the metadata key storing the time an event occurred
+// as parsed from the payload by format.EventTime. The value is formatted as
+// RFC3339 with nanoseconds in UTC.
+const MetadataEventTime = "event_time"
+
 // Message is a container used for storing the internal state of messages.
 // This struct is passed between consumers and producers.
+// Data and Metadata are shared between all copies of a message, i.e. between
+// streams, mirrors and producers, so they have to be treated as read-only
+// after the message has been enqueued. Formatters have to return a new slice
+// instead of modifying Data in place. Use Metadata.Clone if values need to be
+// changed.
 type Message struct {
 	Data      []byte
 	StreamID  MessageStreamID
 	Source    MessageSource
 	Timestamp time.Time
 	Sequence  uint64
+	Metadata  MessageMetadata
+	formatted *formattedMessage
+	tracker   *messageTracker
+}
+
+// Clone returns a copy of the metadata that may be modified.
+func (meta MessageMetadata) Clone() MessageMetadata {
+	clone := make(MessageMetadata, len(meta))
+	for key, value := range meta {
+		clone[key] = value
+	}
+	return clone
 }
 
 // EnableRetryQueue creates a retried messages channel using the given size.
@@ -98,6 +134,12 @@ func EnableRetryQueue(size int) {
 	}
 }
 
+// IsRetryQueueEnabled returns true if EnableRetryQueue has been called, i.e.
+// dropped messages are not lost but can be processed by the loopback consumer.
+func IsRetryQueueEnabled() bool {
+	return retryQueue != nil
+}
+
 // GetRetryQueue returns read access to the retry queue.
 func GetRetryQueue() <-chan Message {
 	return retryQueue
@@ -105,11 +147,16 @@ func GetRetryQueue() <-chan Message {
 
 // NewMessage creates a new message from a given data stream
 func NewMessage(source MessageSource, data []byte, sequence uint64) Message {
+	timestamp := shared.LowResolutionTimeNow
+	if benchmarkEnabled {
+		timestamp = time.Now() // Required for latency measurements
+	}
+
 	return Message{
 		Data:      data,
 		Source:    source,
 		StreamID:  WildcardStreamID,
-		Timestamp: shared.LowResolutionTimeNow, //time.Now(),
+		Timestamp: timestamp,
 		Sequence:  sequence,
 	}
 }
@@ -119,6 +166,19 @@ func (msg Message) String() string {
 	return string(msg.Data)
 }
 
+// EventTime returns the time the event stored in this message occurred as
+// set by format.EventTime. If no valid event time is stored the timestamp of
+// the message is returned. Like the timestamp the event time is returned in
+// local time.
+func (msg Message) EventTime() time.Time {
+	if value, isSet := msg.Metadata[MetadataEventTime]; isSet {
+		if eventTime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return eventTime.Local() // ### return, event time set ###
+		}
+	}
+	return msg.Timestamp
+}
+
 // Enqueue is a convenience function to push a message to a channel while
 // waiting for a timeout instead of just blocking.
 // Passing a timeout of -1 will discard the message.
@@ -142,6 +202,9 @@ func (msg Message) Enqueue(channel chan<- Message, timeout time.Duration) {
 			// Start timeout based retries
 			case start.IsZero():
 				if timeout < 0 {
+					msg.tracker.fail()
+					countLostMessage()
+					countBenchmarkDrop()
 					return // ### return, drop and ignore ###
 				}
 				start = time.Now()
@@ -161,19 +224,37 @@ func (msg Message) Enqueue(channel chan<- Message, timeout time.Duration) {
 
 // Drop pushes a message to the retry queue and sets the stream to _DROPPED_.
 // This queue can be consumed by the loopback consumer. If no such consumer has
-// been configured, the message is lost.
+// been configured, the message is lost. If the retry budget of the message's
+// stream is exhausted, the message is sent to the stream's dead letter stream
+// instead. A tracked message is never confirmed as delivered after it has been
+// dropped.
 func (msg Message) Drop(timeout time.Duration) {
+	countBenchmarkDrop()
+	msg.tracker.fail()
 	if retryQueue != nil {
+		if !spendRetryBudget(msg) {
+			return // ### return, budget exhausted ###
+		}
 		msg.StreamID = DroppedStreamID
+		msg.formatted = nil
 		msg.Enqueue(retryQueue, timeout)
+	} else {
+		countLostMessage()
 	}
 }
 
 // Retry pushes a message to the retry queue. This queue can be consumed by
 // the loopback consumer. If no such consumer has been configured, the message
-// is lost.
+// is lost. Retries are subject to the same retry budget as Drop.
 func (msg Message) Retry(timeout time.Duration) {
+	msg.tracker.fail()
 	if retryQueue != nil {
+		if !spendRetryBudget(msg) {
+			return // ### return, budget exhausted ###
+		}
+		msg.formatted = nil
 		msg.Enqueue(retryQueue, timeout)
+	} else {
+		countLostMessage()
 	}
 }
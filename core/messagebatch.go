@@ -18,23 +18,46 @@ import (
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"io"
+	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// messageBatchMaxBuffers is the maximum number of messages stored by a
+// vectored MessageBatch. This matches IOV_MAX on most systems so that a batch
+// can be written with a single writev call.
+const messageBatchMaxBuffers = 1024
+
 // Internel helper type for frontbuffer/backbuffer storage
 type messageQueue struct {
-	buffer     []byte
-	contentLen int32
-	doneCount  uint32
+	buffer       []byte
+	buffers      [][]byte
+	capacity     int
+	contentLen   int32
+	bufferCount  int32
+	messageCount int32
+	doneCount    uint32
+	trackers     trackerList
+	trackGuard   *sync.Mutex
+}
+
+// BuffersWriter is implemented by resources that can write multiple buffers
+// with a single call, e.g. by using writev.
+type BuffersWriter interface {
+	// WriteBuffers writes all buffers in the given order and returns the
+	// number of bytes written.
+	WriteBuffers(buffers [][]byte) (int64, error)
 }
 
 // MessageBatch is a helper class for producers to format and store messages
 // into a single buffer that is flushed to an io.Writer.
 // You can use the Reached* functions to determine whether a flush should be
-// called, i.e. if a timeout or size threshold has been reached.
+// called, i.e. if a timeout, size or message count threshold has been reached.
+// A vectored MessageBatch stores references to the formatted messages
+// instead of copying them into a contiguous buffer.
 type MessageBatch struct {
 	delimiter string
 	queue     [2]messageQueue
@@ -47,14 +70,71 @@ type MessageBatch struct {
 func newMessageQueue(size int) messageQueue {
 	return messageQueue{
 		buffer:     make([]byte, size),
+		capacity:   size,
+		contentLen: 0,
+		doneCount:  uint32(0),
+		trackGuard: new(sync.Mutex),
+	}
+}
+
+func newVectoredMessageQueue(size int) messageQueue {
+	return messageQueue{
+		buffers:    make([][]byte, messageBatchMaxBuffers),
+		capacity:   size,
 		contentLen: 0,
 		doneCount:  uint32(0),
+		trackGuard: new(sync.Mutex),
 	}
 }
 
 func (queue *messageQueue) reset() {
+	for i := range queue.buffers {
+		queue.buffers[i] = nil
+	}
 	queue.contentLen = 0
+	queue.bufferCount = 0
+	queue.messageCount = 0
 	queue.doneCount = 0
+	queue.trackers = nil
+}
+
+// track holds the tracker of a message stored in the queue until the queue
+// has been flushed.
+func (queue *messageQueue) track(tracker *messageTracker) {
+	tracker.hold()
+	queue.trackGuard.Lock()
+	queue.trackers = append(queue.trackers, tracker)
+	queue.trackGuard.Unlock()
+}
+
+// storedBuffers returns the messages stored by a vectored queue.
+func (queue *messageQueue) storedBuffers() [][]byte {
+	count := int(queue.bufferCount)
+	if count > len(queue.buffers) {
+		count = len(queue.buffers)
+	}
+	return queue.buffers[:count]
+}
+
+// write writes the content of the queue to the given resource.
+func (queue *messageQueue) write(resource io.Writer) error {
+	if queue.buffers == nil {
+		_, err := resource.Write(queue.buffer[:queue.contentLen])
+		return err
+	}
+
+	var err error
+	buffers := queue.storedBuffers()
+	switch writer := resource.(type) {
+	case BuffersWriter:
+		_, err = writer.WriteBuffers(buffers)
+	case *os.File:
+		_, err = shared.WriteFileBuffers(writer, buffers)
+	default:
+		vector := net.Buffers(buffers)
+		_, err = vector.WriteTo(resource)
+	}
+	return err
 }
 
 // NewMessageBatch creates a new MessageBatch with a given size (in bytes)
@@ -69,6 +149,22 @@ func NewMessageBatch(size int, format Formatter) *MessageBatch {
 	}
 }
 
+// NewVectoredMessageBatch creates a new MessageBatch that stores up to size
+// bytes by keeping references to the formatted messages. Messages are not
+// copied, so their payload must not be modified after they have been
+// appended. A flush writes all messages with a single call to WriteBuffers
+// if the resource implements BuffersWriter or with writev if the resource is
+// a file. Any other io.Writer receives one Write call per message.
+func NewVectoredMessageBatch(size int, format Formatter) *MessageBatch {
+	return &MessageBatch{
+		queue:     [2]messageQueue{newVectoredMessageQueue(size), newVectoredMessageQueue(size)},
+		flushing:  new(sync.Mutex),
+		lastFlush: time.Now(),
+		activeSet: uint32(0),
+		format:    format,
+	}
+}
+
 // Append formats a message and appends it to the internal buffer.
 // If the message does not fit into the buffer this function returns false.
 // If the message can never fit into the buffer (too large), true is returned
@@ -92,15 +188,24 @@ func (batch *MessageBatch) Append(msg Message) bool {
 	messageLength := len(payload)
 	var currentOffset, nextOffset int
 
+	// Vectored queues reserve a slot for the message reference first
+	slot := -1
+	if activeQueue.buffers != nil {
+		if slot = int(atomic.AddInt32(&activeQueue.bufferCount, 1)) - 1; slot >= len(activeQueue.buffers) {
+			return false // ### return, queue is full ###
+		}
+	}
+
 	// There might be multiple threads writing to the queue, so try to get a
 	// write window (lockless)
 	for {
 		currentOffset = int(activeQueue.contentLen)
 		nextOffset = currentOffset + messageLength
 
-		if nextOffset > len(activeQueue.buffer) {
-			if messageLength > len(activeQueue.buffer) {
+		if nextOffset > activeQueue.capacity {
+			if messageLength > activeQueue.capacity {
 				Log.Warning.Printf("MessageBatch: Message is too large (%d bytes).", messageLength)
+				msg.tracker.fail()
 				return true // ### return, cannot be written ever ###
 			}
 			return false // ### return, queue is full ###
@@ -111,7 +216,15 @@ func (batch *MessageBatch) Append(msg Message) bool {
 		}
 	}
 
-	copy(activeQueue.buffer[currentOffset:], payload)
+	if slot >= 0 {
+		activeQueue.buffers[slot] = payload
+	} else {
+		copy(activeQueue.buffer[currentOffset:], payload)
+	}
+	if msg.tracker != nil {
+		activeQueue.track(msg.tracker)
+	}
+	atomic.AddInt32(&activeQueue.messageCount, 1)
 	return true
 }
 
@@ -126,7 +239,8 @@ func (batch *MessageBatch) Touch() {
 // Writing will be done in a separate go routine to be non-blocking.
 //
 // The validate callback will be called after messages have been successfully
-// written to the io.Writer.
+// written to the io.Writer. Tracked messages are confirmed as delivered after
+// validate returned true and marked as not delivered if onError returned true.
 // If validate returns false the buffer will not be resetted (automatic retry).
 // If validate is nil a return value of true is assumed (buffer reset).
 //
@@ -165,14 +279,14 @@ func (batch *MessageBatch) Flush(resource io.Writer, validate func() bool, onErr
 		defer shared.RecoverShutdown()
 		defer batch.flushing.Unlock()
 
-		_, err := resource.Write(flushQueue.buffer[:flushQueue.contentLen])
-
-		if err == nil {
+		if err := flushQueue.write(resource); err == nil {
 			if validate == nil || validate() {
+				flushQueue.trackers.release()
 				flushQueue.reset()
 			}
 		} else {
 			if onError == nil || onError(err) {
+				flushQueue.trackers.fail()
 				flushQueue.reset()
 			}
 		}
@@ -213,6 +327,17 @@ func (batch MessageBatch) ReachedSizeThreshold(size int) bool {
 	return batch.queue[activeIdx].contentLen >= int32(size)
 }
 
+// ReachedCountThreshold returns true if the number of messages stored in the
+// buffer is above or equal to the count given.
+// If count is 0 or less this function always returns false.
+func (batch MessageBatch) ReachedCountThreshold(count int) bool {
+	if count <= 0 {
+		return false // ### return, disabled ###
+	}
+	activeIdx := batch.activeSet >> 31
+	return atomic.LoadInt32(&batch.queue[activeIdx].messageCount) >= int32(count)
+}
+
 // ReachedTimeThreshold returns true if the last flush was more than timeout ago.
 // If there is no data this function returns false.
 func (batch MessageBatch) ReachedTimeThreshold(timeout time.Duration) bool {
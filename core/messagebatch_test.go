@@ -17,6 +17,8 @@ package core
 import (
 	"fmt"
 	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 )
@@ -59,6 +61,29 @@ func (writer MessageBatchWriter) onError(err error) bool {
 	return false
 }
 
+type mockBuffersWriter struct {
+	calls   *int
+	written *[]byte
+}
+
+func (writer mockBuffersWriter) Write(data []byte) (int, error) {
+	return 0, fmt.Errorf("unexpected Write call")
+}
+
+func (writer mockBuffersWriter) WriteBuffers(buffers [][]byte) (int64, error) {
+	*writer.calls++
+	written := int64(0)
+	for _, buffer := range buffers {
+		*writer.written = append(*writer.written, buffer...)
+		written += int64(len(buffer))
+	}
+	return written, nil
+}
+
+func (mock *mockFormatter) Configure(conf PluginConfig) error {
+	return nil
+}
+
 func (mock *mockFormatter) Format(msg Message) ([]byte, MessageStreamID) {
 	return msg.Data, msg.StreamID
 }
@@ -124,3 +149,81 @@ func TestMessageBatch(t *testing.T) {
 	expect.False(*writer.successCalled)
 	expect.True(*writer.errorCalled)
 }
+
+func TestVectoredMessageBatch(t *testing.T) {
+	expect := shared.NewExpect(t)
+	writer := mockBuffersWriter{new(int), new([]byte)}
+
+	test10 := NewMessage(nil, []byte("1234567890"), 0)
+	test30 := NewMessage(nil, []byte("123456789012345678901234567890"), 1)
+	buffer := NewVectoredMessageBatch(25, nil)
+
+	expect.True(buffer.Append(test30)) // Too large -> ignored
+	expect.True(buffer.Append(test10))
+	expect.True(buffer.Append(test10))
+	expect.False(buffer.Append(test10)) // Too large
+	expect.True(buffer.ReachedSizeThreshold(20))
+
+	buffer.Flush(writer, nil, nil)
+	buffer.WaitForFlush(time.Duration(0))
+
+	expect.Equal(1, *writer.calls)
+	expect.Equal("12345678901234567890", string(*writer.written))
+	expect.True(buffer.IsEmpty())
+
+	// Files are written with writev
+
+	file, err := ioutil.TempFile("", "gollum_batch")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buffer = NewVectoredMessageBatch(4096, nil)
+	for i := 0; i < messageBatchMaxBuffers+1; i++ {
+		msg := NewMessage(nil, []byte{'a' + byte(i%26)}, uint64(i))
+		if !buffer.Append(msg) {
+			expect.Equal(messageBatchMaxBuffers, i)
+			buffer.Flush(file, nil, nil)
+			buffer.WaitForFlush(time.Duration(0))
+			expect.True(buffer.Append(msg))
+		}
+	}
+	buffer.Flush(file, nil, nil)
+	buffer.WaitForFlush(time.Duration(0))
+
+	data, err := ioutil.ReadFile(file.Name())
+	expect.NoError(err)
+	expect.Equal(messageBatchMaxBuffers+1, len(data))
+	expect.Equal("abcdefghijklmnopqrstuvwxyza", string(data[:27]))
+}
+
+func TestMessageBatchThresholds(t *testing.T) {
+	expect := shared.NewExpect(t)
+	writer := MessageBatchWriter{expect, new(bool), new(bool), false, false}
+
+	test10 := NewMessage(nil, []byte("1234567890"), 0)
+	test50 := NewMessage(nil, []byte("12345678901234567890123456789012345678901234567890"), 1)
+	buffer := NewMessageBatch(100, nil)
+
+	expect.False(buffer.ReachedCountThreshold(1))
+
+	expect.True(buffer.Append(test10))
+	expect.True(buffer.Append(test10))
+	expect.True(buffer.ReachedCountThreshold(2))
+	expect.False(buffer.ReachedCountThreshold(3))
+	expect.False(buffer.ReachedCountThreshold(0)) // disabled
+	expect.False(buffer.ReachedSizeThreshold(30))
+
+	// A single large message triggers the size but not the count threshold
+
+	expect.True(buffer.Append(test50))
+	expect.True(buffer.ReachedSizeThreshold(30))
+	expect.False(buffer.ReachedCountThreshold(4))
+
+	buffer.Flush(writer, writer.onSuccess, writer.onError)
+	buffer.WaitForFlush(time.Duration(0))
+
+	expect.True(*writer.successCalled)
+	expect.False(buffer.ReachedCountThreshold(1))
+	expect.False(buffer.ReachedSizeThreshold(10))
+}
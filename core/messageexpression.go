@@ -0,0 +1,66 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/shared"
+)
+
+// MessageExpressionVariables lists the variables that can be used by
+// expressions evaluated with NewMessageExpressionScope:
+//   payload    the message payload as string
+//   json       the payload decoded as JSON, null if it is not valid JSON
+//   meta       an object containing the message metadata
+//   stream     the name of the message's stream
+//   sequence   the sequence number of the message
+//   timestamp  the time the message was created as unix time in seconds
+//   hostname   the name of the host gollum is running on
+var MessageExpressionVariables = []string{"payload", "json", "meta", "stream", "sequence", "timestamp", "hostname"}
+
+// NewMessageExpressionScope returns a scope resolving the variables listed
+// in MessageExpressionVariables for the given message. Data is used as
+// payload, streamID as stream. The payload is decoded only if "json" is
+// accessed and only once per scope.
+func NewMessageExpressionScope(msg Message, data []byte, streamID MessageStreamID) shared.ExpressionScope {
+	var decoded interface{}
+	isDecoded := false
+
+	return func(name string) (interface{}, bool) {
+		switch name {
+		case "payload":
+			return string(data), true
+		case "json":
+			if !isDecoded {
+				isDecoded = true
+				if err := json.Unmarshal(data, &decoded); err != nil {
+					decoded = nil
+				}
+			}
+			return decoded, true
+		case "meta":
+			return map[string]string(msg.Metadata), true
+		case "stream":
+			return StreamTypes.GetStreamName(streamID), true
+		case "sequence":
+			return float64(msg.Sequence), true
+		case "timestamp":
+			return float64(msg.Timestamp.UnixNano()) / 1e9, true
+		case "hostname":
+			return templateHostnameValue, true
+		}
+		return nil, false
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync/atomic"
+)
+
+// messageTracker is shared by all copies of a tracked message. Every place
+// holding the message, i.e. the consumer, a paused stream, a producer or a
+// MessageBatch, holds a reference. The callback is called once the last
+// reference has been released, unless the message has been dropped, retried
+// or discarded on the way. All methods can be called on a nil tracker.
+type messageTracker struct {
+	pending int32
+	failed  int32
+	onDone  func()
+}
+
+// newMessageTracker creates a tracker holding one reference for the caller.
+func newMessageTracker(onDone func()) *messageTracker {
+	return &messageTracker{
+		pending: 1,
+		onDone:  onDone,
+	}
+}
+
+func (tracker *messageTracker) hold() {
+	if tracker != nil {
+		atomic.AddInt32(&tracker.pending, 1)
+	}
+}
+
+func (tracker *messageTracker) release() {
+	if tracker == nil || atomic.AddInt32(&tracker.pending, -1) != 0 {
+		return // ### return, not tracked or still pending ###
+	}
+	if atomic.LoadInt32(&tracker.failed) == 0 {
+		tracker.onDone()
+	}
+}
+
+// fail marks the message as not delivered. The callback of a failed message
+// is never called.
+func (tracker *messageTracker) fail() {
+	if tracker != nil {
+		atomic.StoreInt32(&tracker.failed, 1)
+	}
+}
+
+// trackerList stores the trackers of the messages stored in a messageQueue.
+type trackerList []*messageTracker
+
+func (list trackerList) release() {
+	for _, tracker := range list {
+		tracker.release()
+	}
+}
+
+func (list trackerList) fail() {
+	for _, tracker := range list {
+		tracker.fail()
+		tracker.release()
+	}
+}
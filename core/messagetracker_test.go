@@ -0,0 +1,91 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func newTrackedTestMessage(delivered *int) Message {
+	msg := NewMessage(nil, []byte("test"), 0)
+	msg.tracker = newMessageTracker(func() { *delivered++ })
+	return msg
+}
+
+func TestMessageTrackerProducer(t *testing.T) {
+	expect := shared.NewExpect(t)
+	messages := make(chan Message, 2)
+	prod := ProducerBase{
+		messages: messages,
+		output:   messages,
+		state:    new(PluginRunState),
+		drained:  new(int64),
+		handled:  new(int64),
+		overflow: new(int32),
+		offline:  new(int32),
+	}
+
+	delivered := 0
+	msg := newTrackedTestMessage(&delivered)
+	prod.Enqueue(msg)
+	prod.Enqueue(msg)
+	msg.tracker.release()
+	expect.Equal(0, delivered)
+
+	// The message is confirmed after all producers processed it
+	onMessage := func(msg Message) {}
+	expect.True(prod.NextNonBlocking(onMessage))
+	expect.Equal(0, delivered)
+	expect.True(prod.NextNonBlocking(onMessage))
+	expect.Equal(1, delivered)
+
+	// Dropped messages are never confirmed
+	delivered = 0
+	msg = newTrackedTestMessage(&delivered)
+	prod.Enqueue(msg)
+	msg.tracker.release()
+	expect.True(prod.NextNonBlocking(func(msg Message) { msg.Drop(-1) }))
+	expect.Equal(0, delivered)
+}
+
+func TestMessageTrackerBatch(t *testing.T) {
+	expect := shared.NewExpect(t)
+	writer := MessageBatchWriter{expect, new(bool), new(bool), false, false}
+	batch := NewMessageBatch(15, new(mockFormatter))
+
+	// Messages are confirmed after the batch has been flushed
+	delivered := 0
+	msg := newTrackedTestMessage(&delivered)
+	expect.True(batch.Append(msg))
+	msg.tracker.release()
+	expect.Equal(0, delivered)
+
+	batch.Flush(writer, writer.onSuccess, writer.onError)
+	batch.WaitForFlush(time.Duration(0))
+	expect.Equal(1, delivered)
+
+	// Messages of a batch that failed to flush are never confirmed
+	delivered = 0
+	msg = newTrackedTestMessage(&delivered)
+	expect.True(batch.Append(msg))
+	msg.tracker.release()
+
+	writer.returnError = true
+	batch.Flush(writer, writer.onSuccess, func(err error) bool { return true })
+	batch.WaitForFlush(time.Duration(0))
+	expect.Equal(0, delivered)
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+)
+
+// mirrors maps streams to the streams their messages are copied to. The map
+// is written during configuration only and is read-only afterwards.
+var mirrors = make(map[MessageStreamID][]MessageStreamID)
+
+// setMirrors registers the streams messages of the given stream are copied
+// to. An error is returned if a target would cause messages to be copied back
+// to the given stream.
+func setMirrors(streamID MessageStreamID, targets []MessageStreamID) error {
+	for _, target := range targets {
+		switch {
+		case target == WildcardStreamID:
+			return fmt.Errorf("Streams cannot be mirrored to %s", WildcardStream)
+		case target == streamID || mirrorReaches(target, streamID, make(map[MessageStreamID]bool)):
+			return fmt.Errorf("Mirroring %s to %s creates a loop",
+				StreamTypes.GetStreamName(streamID), StreamTypes.GetStreamName(target))
+		}
+	}
+	if len(targets) > 0 {
+		mirrors[streamID] = targets
+	}
+	return nil
+}
+
+// mirrorReaches returns true if messages of the stream "from" are mirrored to
+// the stream "to", either directly or through other mirrors.
+func mirrorReaches(from MessageStreamID, to MessageStreamID, visited map[MessageStreamID]bool) bool {
+	if visited[from] {
+		return false // ### return, already checked ###
+	}
+	visited[from] = true
+
+	for _, target := range mirrors[from] {
+		if target == to || mirrorReaches(target, to, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorMessage sends a copy of the given message to all streams its stream is
+// mirrored to. The copies share the payload of the original message as
+// formatters never modify a payload but return a new one.
+func mirrorMessage(msg Message) {
+	for _, target := range mirrors[msg.StreamID] {
+		mirrored := msg
+		mirrored.StreamID = target
+		mirrored.tracker = nil // mirrors do not delay delivery confirmation
+		StreamTypes.GetStreamOrFallback(target).Enqueue(mirrored)
+	}
+}
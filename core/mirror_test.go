@@ -0,0 +1,43 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestMirrorLoops(t *testing.T) {
+	expect := shared.NewExpect(t)
+	streamA := GetStreamID("mirrorTestA")
+	streamB := GetStreamID("mirrorTestB")
+	streamC := GetStreamID("mirrorTestC")
+	defer func() {
+		delete(mirrors, streamA)
+		delete(mirrors, streamB)
+		delete(mirrors, streamC)
+	}()
+
+	expect.NotNil(setMirrors(streamA, []MessageStreamID{streamA}))
+	expect.NotNil(setMirrors(streamA, []MessageStreamID{WildcardStreamID}))
+
+	expect.NoError(setMirrors(streamA, []MessageStreamID{streamB}))
+	expect.NoError(setMirrors(streamB, []MessageStreamID{streamC}))
+	expect.True(mirrorReaches(streamA, streamC, make(map[MessageStreamID]bool)))
+	expect.False(mirrorReaches(streamC, streamA, make(map[MessageStreamID]bool)))
+
+	expect.NotNil(setMirrors(streamC, []MessageStreamID{streamA}))
+	expect.NoError(setMirrors(streamC, []MessageStreamID{}))
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"github.com/trivago/gollum/shared"
 	"sync"
+	"sync/atomic"
 )
 
 var metricActiveWorkers = "ActiveWorkers"
@@ -31,15 +32,41 @@ const (
 
 	// PluginControlRoll notifies the consumer about a reconnect or reopen request
 	PluginControlRoll = PluginControl(2)
+
+	// PluginControlPause causes a producer to stop processing messages and a
+	// consumer to block when enqueueing new messages.
+	PluginControlPause = PluginControl(3)
+
+	// PluginControlResume reverts PluginControlPause.
+	PluginControlResume = PluginControl(4)
 )
 
+// PluginStats contains runtime information about a consumer or producer.
+type PluginStats struct {
+	// Messages is the number of messages enqueued by a consumer or processed
+	// by a producer.
+	Messages int64
+	// Queued is the number of messages waiting in a producer's channel.
+	Queued int
+	// Capacity is the size of a producer's channel.
+	Capacity int
+	// Paused is true if the plugin has been paused by PluginControlPause.
+	Paused bool
+}
+
+// StatsReporter is implemented by plugins that report runtime information.
+type StatsReporter interface {
+	// Stats returns the current runtime information of the plugin.
+	Stats() PluginStats
+}
+
 // PluginRunState is used in some plugins to store information about the
 // execution state of the plugin (i.e. if it is running or not) as well as
 // threading primitives that enable gollum to wait for a plugin top properly
 // shut down.
 type PluginRunState struct {
 	workers *sync.WaitGroup
-	paused  bool
+	paused  int32
 }
 
 // Plugin is the base class for any runtime class that can be configured and
@@ -52,19 +79,21 @@ func init() {
 	shared.Metric.New(metricActiveWorkers)
 }
 
-// Pause implements the MessageSource interface
-func (state *PluginRunState) Pause() {
-	state.paused = true
+// Pause marks the plugin as paused. Returns false if the plugin has already
+// been paused. This function is threadsafe.
+func (state *PluginRunState) Pause() bool {
+	return atomic.CompareAndSwapInt32(&state.paused, 0, 1)
 }
 
-// IsPaused implements the MessageSource interface
+// IsPaused returns true if the plugin is paused. This function is threadsafe.
 func (state *PluginRunState) IsPaused() bool {
-	return state.paused
+	return atomic.LoadInt32(&state.paused) == 1
 }
 
-// Resume implements the MessageSource interface
-func (state *PluginRunState) Resume() {
-	state.paused = false
+// Resume marks the plugin as running. Returns false if the plugin has not
+// been paused. This function is threadsafe.
+func (state *PluginRunState) Resume() bool {
+	return atomic.CompareAndSwapInt32(&state.paused, 1, 0)
 }
 
 // SetWorkerWaitGroup sets the WaitGroup used to manage workers
@@ -17,6 +17,7 @@ package core
 import (
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"sort"
 )
 
 // PluginConfig is a configuration for a specific plugin
@@ -51,14 +52,24 @@ func (conf *PluginConfig) registerKey(key string) {
 // check the keys read from the config files against the keys requested up to
 // this point. Unknown keys will be written to the error log.
 func (conf PluginConfig) Validate() bool {
-	valid := true
+	unknownKeys := conf.GetUnknownKeys()
+	for _, key := range unknownKeys {
+		Log.Warning.Printf("Unknown configuration key in %s: %s", conf.Typename, key)
+	}
+	return len(unknownKeys) == 0
+}
+
+// GetUnknownKeys returns all keys read from the config file that have not been
+// requested up to this point. The keys are returned in sorted order.
+func (conf PluginConfig) GetUnknownKeys() []string {
+	unknownKeys := []string{}
 	for key := range conf.Settings {
 		if _, exists := conf.validKeys[key]; !exists {
-			valid = false
-			Log.Warning.Printf("Unknown configuration key in %s: %s", conf.Typename, key)
+			unknownKeys = append(unknownKeys, key)
 		}
 	}
-	return valid
+	sort.Strings(unknownKeys)
+	return unknownKeys
 }
 
 // Read analyzes a given key/value map to extract the configuration values valid
@@ -150,6 +161,20 @@ func (conf PluginConfig) GetStringMap(key string, defaultValue map[string]string
 	return defaultValue
 }
 
+// GetStringArrayMap tries to read a non-predefined, string to string array
+// map from a PluginConfig. If that value is not found defaultValue is returned.
+func (conf PluginConfig) GetStringArrayMap(key string, defaultValue map[string][]string) map[string][]string {
+	conf.registerKey(key)
+	if conf.HasValue(key) {
+		if value, err := conf.Settings.StringArrayMap(key); err != nil {
+			Log.Error.Fatalf(err.Error())
+		} else {
+			return value
+		}
+	}
+	return defaultValue
+}
+
 // GetStreamMap tries to read a non-predefined, stream to string map from a
 // plugin config. A mapping on the wildcard stream is always returned.
 // The target is either defaultValue or a value defined by the config.
@@ -0,0 +1,205 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// streamPriorities is written during configuration only and is read-only
+// afterwards, so no locking is required to access the map itself.
+var streamPriorities = make(map[MessageStreamID]int)
+
+// setStreamPriority sets the weight producers use to schedule messages of the
+// given stream.
+func setStreamPriority(streamID MessageStreamID, priority int) {
+	streamPriorities[streamID] = priority
+}
+
+// GetStreamPriority returns the priority of the given stream as configured by
+// the stream's Priority setting. Streams without a priority return 1.
+func GetStreamPriority(streamID MessageStreamID) int {
+	if priority, exists := streamPriorities[streamID]; exists {
+		return priority
+	}
+	return 1
+}
+
+// getPriorities returns the distinct priorities of the given streams in
+// descending order. The wildcard stream maps to all priorities.
+func getPriorities(streamIDs []MessageStreamID) []int {
+	unique := make(map[int]bool)
+	for _, streamID := range streamIDs {
+		if streamID == WildcardStreamID {
+			unique[1] = true
+			for _, priority := range streamPriorities {
+				unique[priority] = true
+			}
+		} else {
+			unique[GetStreamPriority(streamID)] = true
+		}
+	}
+
+	priorities := make([]int, 0, len(unique))
+	for priority := range unique {
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	return priorities
+}
+
+// priorityLane queues the messages of all streams sharing a priority.
+type priorityLane struct {
+	weight   int
+	messages chan Message
+}
+
+// priorityScheduler queues the messages of a producer by the priority of their
+// stream and passes them to the producer using weighted round robin. If all
+// queues are filled, a queue with a priority of n is read n times as often as
+// a queue with a priority of 1. Queues of lower priority fill up first so that
+// their streams are throttled first if the producer is saturated.
+type priorityScheduler struct {
+	lanes  []priorityLane
+	laneOf map[int]int
+	ready  chan struct{}
+	output chan Message
+}
+
+// newPriorityScheduler creates one queue of the given capacity for each of the
+// given priorities. Priorities are expected in descending order. Messages are
+// written to the output channel of the scheduler once run has been called.
+// The output channel is closed after close has been called and all messages
+// have been passed on.
+func newPriorityScheduler(priorities []int, capacity int) *priorityScheduler {
+	scheduler := &priorityScheduler{
+		lanes:  make([]priorityLane, len(priorities)),
+		laneOf: make(map[int]int),
+		ready:  make(chan struct{}, 1),
+		output: make(chan Message, priorities[0]),
+	}
+	for i, priority := range priorities {
+		scheduler.lanes[i] = priorityLane{priority, make(chan Message, capacity)}
+		scheduler.laneOf[priority] = i
+	}
+	return scheduler
+}
+
+// input returns the queue of the lowest priority. Messages written to this
+// channel directly are scheduled with the lowest priority.
+func (scheduler *priorityScheduler) input() chan Message {
+	return scheduler.lanes[len(scheduler.lanes)-1].messages
+}
+
+// enqueue adds a message to the queue of its stream's priority. Messages of
+// streams with an unknown priority are added to the lowest priority queue.
+func (scheduler *priorityScheduler) enqueue(msg Message, timeout time.Duration) {
+	idx, exists := scheduler.laneOf[GetStreamPriority(msg.StreamID)]
+	if !exists {
+		idx = len(scheduler.lanes) - 1
+	}
+	msg.Enqueue(scheduler.lanes[idx].messages, timeout)
+	scheduler.notify()
+}
+
+func (scheduler *priorityScheduler) notify() {
+	select {
+	case scheduler.ready <- struct{}{}:
+	default:
+		// A notification is already pending
+	}
+}
+
+// run passes queued messages to the output channel until close is called.
+func (scheduler *priorityScheduler) run() {
+	defer close(scheduler.output)
+	closed := make([]bool, len(scheduler.lanes))
+	open := len(scheduler.lanes)
+
+	for open > 0 {
+		idle := true
+		for i, lane := range scheduler.lanes {
+			for n := 0; n < lane.weight && !closed[i]; n++ {
+				select {
+				case msg, isOpen := <-lane.messages:
+					if !isOpen {
+						closed[i] = true
+						open--
+						continue // ### continue, lane closed ###
+					}
+					scheduler.output <- msg
+					idle = false
+				default:
+					n = lane.weight // lane is empty
+				}
+			}
+		}
+
+		if idle && open > 0 && scheduler.wait(closed) {
+			closed[len(closed)-1] = true
+			open--
+		}
+	}
+}
+
+// wait blocks until a message has been added by enqueue or a message has
+// been written to the input queue directly. Messages of the input queue are
+// passed on right away as all other queues are empty. Returns true if the
+// input queue has been closed.
+func (scheduler *priorityScheduler) wait(closed []bool) bool {
+	last := len(scheduler.lanes) - 1
+	if closed[last] {
+		<-scheduler.ready
+		return false // ### return, input already closed ###
+	}
+
+	select {
+	case <-scheduler.ready:
+	case msg, isOpen := <-scheduler.lanes[last].messages:
+		if !isOpen {
+			return true // ### return, input closed ###
+		}
+		scheduler.output <- msg
+	}
+	return false
+}
+
+// close closes all queues. Queued messages are still passed on.
+func (scheduler *priorityScheduler) close() {
+	for _, lane := range scheduler.lanes {
+		close(lane.messages)
+	}
+	scheduler.notify()
+}
+
+// pending returns the number of messages inside the scheduler.
+func (scheduler *priorityScheduler) pending() int {
+	pending := len(scheduler.output)
+	for _, lane := range scheduler.lanes {
+		pending += len(lane.messages)
+	}
+	return pending
+}
+
+// capacity returns the number of messages the queues of the scheduler can
+// store.
+func (scheduler *priorityScheduler) capacity() int {
+	capacity := 0
+	for _, lane := range scheduler.lanes {
+		capacity += cap(lane.messages)
+	}
+	return capacity
+}
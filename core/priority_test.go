@@ -0,0 +1,113 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestStreamPriority(t *testing.T) {
+	expect := shared.NewExpect(t)
+	highID := GetStreamID("priorityTestHigh")
+	lowID := GetStreamID("priorityTestLow")
+	defer delete(streamPriorities, highID)
+
+	expect.Equal(1, GetStreamPriority(highID))
+	expect.Equal(1, len(getPriorities([]MessageStreamID{highID, lowID})))
+
+	setStreamPriority(highID, 3)
+	expect.Equal(3, GetStreamPriority(highID))
+
+	priorities := getPriorities([]MessageStreamID{lowID, highID})
+	expect.Equal(2, len(priorities))
+	expect.Equal(3, priorities[0])
+	expect.Equal(1, priorities[1])
+
+	expect.Equal(1, len(getPriorities([]MessageStreamID{highID})))
+	expect.Equal(2, len(getPriorities([]MessageStreamID{WildcardStreamID})))
+}
+
+func TestPriorityScheduler(t *testing.T) {
+	expect := shared.NewExpect(t)
+	highID := GetStreamID("priorityTestHigh")
+	lowID := GetStreamID("priorityTestLow")
+	setStreamPriority(highID, 3)
+	defer delete(streamPriorities, highID)
+
+	scheduler := newPriorityScheduler([]int{3, 1}, 10)
+	expect.Equal(20, scheduler.capacity())
+
+	for i := 0; i < 6; i++ {
+		msg := NewMessage(nil, []byte("h"), uint64(i))
+		msg.StreamID = highID
+		scheduler.enqueue(msg, 0)
+	}
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(nil, []byte("l"), uint64(i))
+		msg.StreamID = lowID
+		scheduler.enqueue(msg, 0)
+	}
+	expect.Equal(9, scheduler.pending())
+
+	scheduler.close()
+	go scheduler.run()
+
+	order := ""
+	for msg := range scheduler.output {
+		order += msg.String()
+	}
+	expect.Equal("hhhlhhhll", order)
+}
+
+func TestPrioritySchedulerInput(t *testing.T) {
+	expect := shared.NewExpect(t)
+	scheduler := newPriorityScheduler([]int{3, 1}, 10)
+	go scheduler.run()
+
+	// Messages written to the input queue directly wake up the scheduler
+	scheduler.input() <- NewMessage(nil, []byte("direct"), 0)
+	msg := <-scheduler.output
+	expect.Equal("direct", msg.String())
+
+	scheduler.close()
+	_, isOpen := <-scheduler.output
+	expect.False(isOpen)
+}
+
+func TestProducerPriorityMessages(t *testing.T) {
+	expect := shared.NewExpect(t)
+	highID := GetStreamID("priorityTestHigh")
+	setStreamPriority(highID, 3)
+	defer delete(streamPriorities, highID)
+	shared.RuntimeType.Register(mockFormatter{})
+
+	conf := NewPluginConfig("core.ProducerBase")
+	conf.Stream = []string{"priorityTestHigh", "priorityTestLow"}
+	conf.Settings["Formatter"] = "core.mockFormatter"
+
+	prod := ProducerBase{}
+	expect.NoError(prod.Configure(conf))
+	expect.NotNil(prod.priority)
+
+	// Messages passed to the producer's channel are queued by the scheduler
+	prod.Messages() <- NewMessage(nil, []byte("direct"), 0)
+	expect.Equal(1, prod.priority.pending())
+
+	go prod.priority.run()
+	msg := <-prod.output
+	expect.Equal("direct", msg.String())
+	prod.priority.close()
+}
@@ -17,10 +17,30 @@ package core
 import (
 	"fmt"
 	"github.com/trivago/gollum/shared"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	metricMessagesRejected = "MessagesRejected"
+)
+
+const (
+	// RejectMetadataReason is the metadata key storing the reason why a
+	// message was rejected by a producer's sink.
+	RejectMetadataReason = "reject_reason"
+
+	// RejectMetadataStream is the metadata key storing the name of the stream
+	// a rejected message was sent to originally.
+	RejectMetadataStream = "reject_stream"
+)
+
+func init() {
+	shared.Metric.New(metricMessagesRejected)
+}
+
 // Producer is an interface for plugins that pass messages to other services,
 // files or storages.
 type Producer interface {
@@ -50,14 +70,24 @@ type Producer interface {
 //     Channel: 1024
 //     ChannelTimeout: 200
 //     Formatter: "format.Envelope"
+//     FormatterWorkers: 1
+//     FormatterOrdered: true
+//     RejectStream: ""
+//     FuseHighWatermark: 90
+//     FuseLowWatermark: 50
+//     TraceSpans: false
 //     Stream:
 //       - "error"
 //       - "default"
 //
 // Enable switches the consumer on or off. By default this value is set to true.
 //
-// Channel sets the size of the channel used to communicate messages. By default
-// this value is set to 8192.
+// Channel sets the size of the channel used to communicate messages. If the
+// producer listens to streams with different priorities, one channel of this
+// size is used per priority. Messages are then read from these channels by
+// weighted round robin, i.e. messages of a stream with a priority of 4 are
+// read four times as often as those of a stream with a priority of 1 if the
+// producer is saturated. By default this value is set to 8192.
 //
 // ChannelTimeoutMs sets a timeout in milliseconds for messages to wait if this
 // producer's queue is full.
@@ -73,6 +103,42 @@ type Producer interface {
 //
 // Formatter sets a formatter to use. Each formatter has its own set of options
 // which can be set here, too. By default this is set to format.Forward.
+//
+// FormatterWorkers defines the number of goroutines formatting messages. If
+// set to a value greater than 1, messages are formatted before they are
+// passed to the producer so that CPU-heavy formatters run in parallel. The
+// formatter has to be safe for concurrent use in this case. Set to 0 to use
+// one worker per CPU. Workers are not started for format.Forward. By default
+// this is set to 1, i.e. messages are formatted by the producer.
+//
+// FormatterOrdered defines whether messages formatted by multiple workers are
+// passed to the producer in the order they arrived. The order is kept across
+// all streams of the producer, not per stream, so a slow message also delays
+// messages of other streams. Setting this to false allows faster messages to
+// overtake slower ones. By default this is set to true.
+//
+// RejectStream defines a stream messages are sent to if they have been
+// rejected by the producer's sink, e.g. because of a mapping error. The reason
+// and the original stream are stored in the metadata fields "reject_reason"
+// and "reject_stream". Not all producers support this setting. By default this
+// is set to "", i.e. rejected messages are discarded.
+//
+// FuseHighWatermark defines the fill level of the channel in percent at which
+// the fuses of all streams this producer listens to are burned. Fuses are only
+// available for streams with a FusePolicy other than "none". A health event is
+// sent to "_GOLLUM_HEALTH_" when this level is exceeded. By default this is
+// set to 90.
+//
+// FuseLowWatermark defines the fill level of the channel in percent at which
+// burned fuses are activated again and a health event is sent. By default
+// this is set to 50.
+//
+// TraceSpans enables emitting a span for each message carrying a sampled W3C
+// trace context in its "traceparent" metadata field. The span starts when the
+// message was created and ends when the message has been passed to the
+// producer's sink. Spans are sent as OTLP/JSON to "_GOLLUM_TRACES_" and the
+// "traceparent" field is replaced by the span's context before the message is
+// passed on. By default this is set to false.
 type ProducerBase struct {
 	messages chan Message
 	control  chan PluginControl
@@ -80,6 +146,30 @@ type ProducerBase struct {
 	state    *PluginRunState
 	timeout  time.Duration
 	format   Formatter
+	forward  bool
+	pool     *formatPool
+	priority *priorityScheduler
+	output   chan Message
+	drained  *int64
+	handled  *int64
+	rejects  MessageStreamID
+	reroute  bool
+	fuses    []*Fuse
+	fuseHigh int
+	fuseLow  int
+	overflow *int32
+	offline  *int32
+	name     string
+	tracing  bool
+}
+
+// DrainReporter is implemented by plugins that can report how many messages
+// were flushed during shutdown and how many messages are still waiting to be
+// processed.
+type DrainReporter interface {
+	// DrainStats returns the number of messages flushed during shutdown and
+	// the number of messages still pending.
+	DrainStats() (flushed int64, pending int)
 }
 
 // ProducerError can be used to return consumer related errors e.g. during a
@@ -106,17 +196,55 @@ func (prod *ProducerBase) Configure(conf PluginConfig) error {
 		return err // ### return, plugin load error ###
 	}
 	prod.format = format.(Formatter)
+	prod.forward = isPassThroughFormatter(prod.format)
 
 	prod.streams = make([]MessageStreamID, len(conf.Stream))
 	prod.control = make(chan PluginControl, 1)
 	prod.messages = make(chan Message, conf.GetInt("Channel", 8192))
 	prod.timeout = time.Duration(conf.GetInt("ChannelTimeoutMs", 0)) * time.Millisecond
 	prod.state = new(PluginRunState)
+	prod.drained = new(int64)
+	prod.handled = new(int64)
 
 	for i, stream := range conf.Stream {
 		prod.streams[i] = GetStreamID(stream)
 	}
 
+	prod.output = prod.messages
+	if priorities := getPriorities(prod.streams); len(priorities) > 1 {
+		prod.priority = newPriorityScheduler(priorities, cap(prod.messages))
+		prod.messages = prod.priority.input()
+		prod.output = prod.priority.output
+	}
+
+	workers := conf.GetInt("FormatterWorkers", 1)
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > 1 && !prod.forward {
+		prod.pool = newFormatPool(prod.format, workers, conf.GetBool("FormatterOrdered", true), prod.output)
+		prod.output = prod.pool.output
+	}
+
+	if rejectStream := conf.GetString("RejectStream", ""); rejectStream != "" {
+		prod.rejects = GetStreamID(rejectStream)
+		prod.reroute = true
+	}
+
+	prod.fuses = getFuses(prod.streams)
+	prod.fuseHigh = prod.capacity() * conf.GetInt("FuseHighWatermark", 90) / 100
+	prod.fuseLow = prod.capacity() * conf.GetInt("FuseLowWatermark", 50) / 100
+	if prod.fuseHigh <= 0 || prod.fuseHigh > prod.capacity() {
+		prod.fuseHigh = prod.capacity()
+	}
+	if prod.fuseLow >= prod.fuseHigh {
+		prod.fuseLow = prod.fuseHigh - 1
+	}
+	prod.overflow = new(int32)
+	prod.offline = new(int32)
+	prod.name = conf.Typename
+	prod.tracing = conf.GetBool("TraceSpans", false)
+
 	return nil
 }
 
@@ -126,10 +254,20 @@ func (prod ProducerBase) SetWorkerWaitGroup(workers *sync.WaitGroup) {
 	prod.state.SetWorkerWaitGroup(workers)
 }
 
-// AddMainWorker adds the first worker to the waitgroup
+// AddMainWorker adds the first worker to the waitgroup and starts the
+// formatter, the priority scheduler and the formatter workers of this
+// producer if required. All of them are stopped by Close.
 func (prod ProducerBase) AddMainWorker(workers *sync.WaitGroup) {
 	prod.state.SetWorkerWaitGroup(workers)
 	prod.AddWorker()
+
+	StartFormatter(prod.format)
+	if prod.priority != nil {
+		go prod.priority.run()
+	}
+	if prod.pool != nil {
+		prod.pool.start()
+	}
 }
 
 // AddWorker adds an additional worker to the waitgroup. Assumes that either
@@ -154,8 +292,10 @@ func (prod ProducerBase) GetTimeout() time.Duration {
 
 // Next returns the latest message from the channel as well as the open state
 // of the channel. This function blocks if the channel is empty.
+// Tracked messages returned by Next are never confirmed as delivered.
 func (prod ProducerBase) Next() (Message, bool) {
-	msg, ok := <-prod.messages
+	msg, ok := <-prod.output
+	prod.checkFuses()
 	return msg, ok
 }
 
@@ -163,24 +303,57 @@ func (prod ProducerBase) Next() (Message, bool) {
 // Returns false if no message was recieved.
 func (prod ProducerBase) NextNonBlocking(onMessage func(msg Message)) bool {
 	select {
-	case msg := <-prod.messages:
-		onMessage(msg)
+	case msg := <-prod.input():
+		prod.checkFuses()
+		prod.processMessage(msg, onMessage)
 		return true
 	default:
 		return false
 	}
 }
 
-// Format calls the formatters Format function
+// Format calls the formatters Format function. If FormatterWorkers is used,
+// the result of the workers is returned instead.
 func (prod *ProducerBase) Format(msg Message) ([]byte, MessageStreamID) {
+	if prod.forward {
+		return msg.Data, msg.StreamID // ### return, pass-through ###
+	}
+	if data, streamID, isFormatted := prod.pool.formatted(msg); isFormatted {
+		return data, streamID
+	}
 	return prod.format.Format(msg)
 }
 
-// GetFormatter returns the formatter of this producer
+// GetFormatter returns the formatter of this producer. If FormatterWorkers is
+// used, the returned formatter returns the result of the workers.
 func (prod *ProducerBase) GetFormatter() Formatter {
+	if prod.pool != nil {
+		return pooledFormatter{prod.pool}
+	}
 	return prod.format
 }
 
+// Reject sends a message that has been rejected by the producer's sink to the
+// configured reject stream. The given reason is attached to the message's
+// metadata. Messages are discarded if no reject stream is configured or if
+// the message has already been sent to the reject stream.
+// This function is threadsafe.
+func (prod *ProducerBase) Reject(msg Message, reason string) {
+	shared.Metric.Inc(metricMessagesRejected)
+	if !prod.reroute || msg.StreamID == prod.rejects {
+		msg.tracker.fail()
+		countLostMessage()
+		return // ### return, discard ###
+	}
+
+	msg.formatted = nil
+	msg.Metadata = msg.Metadata.Clone()
+	msg.Metadata[RejectMetadataReason] = reason
+	msg.Metadata[RejectMetadataStream] = StreamTypes.GetStreamName(msg.StreamID)
+	msg.StreamID = prod.rejects
+	StreamTypes.GetStreamOrFallback(prod.rejects).Enqueue(msg)
+}
+
 // PauseAllStreams sends the Pause() command to all streams this producer is
 // listening to.
 func (prod *ProducerBase) PauseAllStreams(capacity int) {
@@ -199,6 +372,62 @@ func (prod *ProducerBase) ResumeAllStreams() {
 	}
 }
 
+// BurnFuses burns the fuses of all streams this producer is listening to.
+// This should be called if the producer's endpoint is not reachable. Calling
+// BurnFuses again before ActivateFuses has been called is ignored.
+// This function is threadsafe.
+func (prod *ProducerBase) BurnFuses() {
+	if atomic.CompareAndSwapInt32(prod.offline, 0, 1) {
+		EmitHealthEvent(HealthEndpointOffline, prod.name, nil)
+		for _, fuse := range prod.fuses {
+			fuse.Burn()
+		}
+	}
+}
+
+// ActivateFuses reverts a previous call to BurnFuses. Calling ActivateFuses
+// without calling BurnFuses first is ignored.
+// This function is threadsafe.
+func (prod *ProducerBase) ActivateFuses() {
+	if atomic.CompareAndSwapInt32(prod.offline, 1, 0) {
+		EmitHealthEvent(HealthEndpointOnline, prod.name, nil)
+		for _, fuse := range prod.fuses {
+			fuse.Activate()
+		}
+	}
+}
+
+// queued returns the number of messages waiting in the channel or in the
+// priority queues of this producer.
+func (prod ProducerBase) queued() int {
+	if prod.priority != nil {
+		return prod.priority.pending()
+	}
+	return len(prod.messages)
+}
+
+// capacity returns the number of messages the channel or the priority queues
+// of this producer can store.
+func (prod ProducerBase) capacity() int {
+	if prod.priority != nil {
+		return prod.priority.capacity()
+	}
+	return cap(prod.messages)
+}
+
+// checkFuses activates the fuses burned by Enqueue if the channel has been
+// drained below the low watermark.
+func (prod ProducerBase) checkFuses() {
+	if prod.queued() <= prod.fuseLow && atomic.LoadInt32(prod.overflow) == 1 {
+		if atomic.CompareAndSwapInt32(prod.overflow, 1, 0) {
+			EmitHealthEvent(HealthQueueLow, prod.name, map[string]interface{}{"queued": prod.queued(), "capacity": prod.capacity()})
+			for _, fuse := range prod.fuses {
+				fuse.Activate()
+			}
+		}
+	}
+}
+
 // Streams returns the streams this producer is listening to.
 func (prod *ProducerBase) Streams() []MessageStreamID {
 	return prod.streams
@@ -211,14 +440,37 @@ func (prod *ProducerBase) Control() chan<- PluginControl {
 }
 
 // Messages returns write access to the message channel this producer reads from.
+// If the producer listens to streams of different priority, messages written
+// to this channel are queued with the lowest priority.
 func (prod *ProducerBase) Messages() chan<- Message {
 	return prod.messages
 }
 
 // Enqueue will add the message to the internal channel so it can be processed
 // by the producer main loop.
+// If the soak test mode is active faults are injected at this point.
+// The fuses of this producer's streams are burned if the channel exceeds
+// the high watermark.
+// If the producer listens to streams of different priority, the message is
+// added to the queue of its stream's priority.
 func (prod *ProducerBase) Enqueue(msg Message) {
-	msg.Enqueue(prod.messages, prod.timeout)
+	if faultConfig != nil && !injectFault(&msg, prod.timeout) {
+		return // ### return, rejected by fault injection ###
+	}
+	if prod.fuseHigh > 0 && prod.queued() >= prod.fuseHigh {
+		if atomic.CompareAndSwapInt32(prod.overflow, 0, 1) {
+			EmitHealthEvent(HealthQueueHigh, prod.name, map[string]interface{}{"queued": prod.queued(), "capacity": prod.capacity()})
+			for _, fuse := range prod.fuses {
+				fuse.Burn()
+			}
+		}
+	}
+	msg.tracker.hold()
+	if prod.priority != nil {
+		prod.priority.enqueue(msg, prod.timeout)
+	} else {
+		msg.Enqueue(prod.messages, prod.timeout)
+	}
 }
 
 // ProcessCommand provides a callback based possibility to react on the
@@ -233,18 +485,93 @@ func (prod *ProducerBase) ProcessCommand(command PluginControl, onRoll func()) b
 		if onRoll != nil {
 			onRoll()
 		}
+	case PluginControlPause:
+		prod.state.Pause()
+	case PluginControlResume:
+		prod.state.Resume()
 	}
 
 	return false
 }
 
+// input returns the channel the control loops read messages from. While the
+// producer is paused a nil channel is returned so that messages stay queued.
+func (prod ProducerBase) input() <-chan Message {
+	if prod.state.IsPaused() {
+		return nil
+	}
+	return prod.output
+}
+
+// processMessage passes a message to the given callback. If TraceSpans is
+// enabled and the message is traced, the message is passed on with a child
+// span context and the span is emitted after the callback returned.
+func (prod *ProducerBase) processMessage(msg Message, onMessage func(msg Message)) {
+	atomic.AddInt64(prod.handled, 1)
+	defer msg.tracker.release()
+	if !prod.tracing || !IsTracingEnabled() {
+		onMessage(msg)
+		return // ### return, tracing disabled ###
+	}
+
+	parent, traced := TraceContextFromMetadata(msg.Metadata)
+	if !traced {
+		onMessage(msg)
+		return // ### return, not traced ###
+	}
+
+	span := parent.NewChild()
+	msg.Metadata = msg.Metadata.Clone()
+	msg.Metadata[MetadataTraceParent] = span.String()
+	onMessage(msg)
+
+	EmitTraceSpan(span, parent, msg.Metadata[MetadataTraceState], "gollum "+prod.name, msg.Timestamp, time.Now(),
+		map[string]string{
+			"gollum.producer": prod.name,
+			"gollum.stream":   StreamTypes.GetStreamName(msg.StreamID),
+		})
+}
+
 // Close closes the internal message channel and sends all remaining messages to
 // the given callback. This function is called by *ControlLoop after a quit
 // command has been recieved.
 func (prod *ProducerBase) Close(onMessage func(msg Message)) {
-	close(prod.messages)
-	for msg := range prod.messages {
-		onMessage(msg)
+	if prod.priority != nil {
+		prod.priority.close()
+	} else {
+		close(prod.messages)
+	}
+	for msg := range prod.output {
+		prod.processMessage(msg, onMessage)
+		trackMessageLatency(msg)
+		atomic.AddInt64(prod.drained, 1)
+	}
+	StopFormatter(prod.format)
+	prod.checkFuses()
+	prod.ActivateFuses()
+}
+
+// DrainStats returns the number of messages flushed by Close and the number
+// of messages still waiting in the message channel. This implements the
+// DrainReporter interface.
+func (prod *ProducerBase) DrainStats() (int64, int) {
+	pending := prod.queued()
+	if prod.pool != nil {
+		pending += prod.pool.pending()
+	}
+	return atomic.LoadInt64(prod.drained), pending
+}
+
+// Stats returns the number of messages processed by this producer, the fill
+// level of its message channel and its pause state. This implements the
+// StatsReporter interface.
+func (prod *ProducerBase) Stats() PluginStats {
+	_, pending := prod.DrainStats()
+	return PluginStats{
+		Messages: atomic.LoadInt64(prod.handled),
+		Queued:   pending,
+		Capacity: prod.capacity(),
+		Paused:   prod.state.IsPaused(),
 	}
 }
 
@@ -254,8 +581,10 @@ func (prod *ProducerBase) DefaultControlLoop(onMessage func(msg Message), onRoll
 	defer prod.Close(onMessage)
 	for {
 		select {
-		case msg := <-prod.messages:
-			onMessage(msg)
+		case msg := <-prod.input():
+			prod.checkFuses()
+			prod.processMessage(msg, onMessage)
+			trackMessageLatency(msg)
 
 		case command := <-prod.control:
 			if prod.ProcessCommand(command, onRoll) {
@@ -272,8 +601,10 @@ func (prod *ProducerBase) TickerControlLoop(interval time.Duration, onMessage fu
 	defer prod.Close(onMessage)
 	for {
 		select {
-		case msg := <-prod.messages:
-			onMessage(msg)
+		case msg := <-prod.input():
+			prod.checkFuses()
+			prod.processMessage(msg, onMessage)
+			trackMessageLatency(msg)
 
 		case command := <-prod.control:
 			if prod.ProcessCommand(command, onRoll) {
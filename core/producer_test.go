@@ -0,0 +1,47 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestProducerPause(t *testing.T) {
+	expect := shared.NewExpect(t)
+	messages := make(chan Message, 2)
+	prod := ProducerBase{
+		messages: messages,
+		output:   messages,
+		state:    new(PluginRunState),
+		drained:  new(int64),
+		handled:  new(int64),
+		overflow: new(int32),
+		offline:  new(int32),
+	}
+
+	processed := 0
+	onMessage := func(msg Message) { processed++ }
+	messages <- NewMessage(nil, []byte("test"), 0)
+
+	prod.ProcessCommand(PluginControlPause, nil)
+	expect.False(prod.NextNonBlocking(onMessage))
+	expect.Equal(PluginStats{Queued: 1, Capacity: 2, Paused: true}, prod.Stats())
+
+	prod.ProcessCommand(PluginControlResume, nil)
+	expect.True(prod.NextNonBlocking(onMessage))
+	expect.Equal(1, processed)
+	expect.Equal(PluginStats{Messages: 1, Capacity: 2}, prod.Stats())
+}
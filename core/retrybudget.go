@@ -0,0 +1,103 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"sync"
+	"time"
+)
+
+const (
+	metricRetriesRejected = "RetriesRejected"
+)
+
+// retryBudget is a token bucket limiting the number of messages per second
+// that are passed to the retry queue for a given stream. The budget is shared
+// by all producers listening to this stream.
+type retryBudget struct {
+	rate       float64
+	tokens     float64
+	lastUpdate time.Time
+	deadLetter MessageStreamID
+	hasTarget  bool
+	guard      *sync.Mutex
+}
+
+// retryBudgets is written during configuration only and is read-only
+// afterwards, so no locking is required to access the map itself.
+var retryBudgets = make(map[MessageStreamID]*retryBudget)
+
+func init() {
+	shared.Metric.New(metricRetriesRejected)
+}
+
+// setRetryBudget restricts retries of messages on the given stream to the
+// given number of messages per second. If the budget is exhausted messages are
+// sent to the given dead letter stream. If deadLetter is empty these messages
+// are discarded.
+func setRetryBudget(streamID MessageStreamID, retriesPerSec int, deadLetter string) {
+	budget := &retryBudget{
+		rate:       float64(retriesPerSec),
+		tokens:     float64(retriesPerSec),
+		lastUpdate: time.Now(),
+		hasTarget:  deadLetter != "",
+		guard:      new(sync.Mutex),
+	}
+	if budget.hasTarget {
+		budget.deadLetter = GetStreamID(deadLetter)
+	}
+	retryBudgets[streamID] = budget
+}
+
+// take returns true if a token could be taken from the bucket.
+func (budget *retryBudget) take() bool {
+	budget.guard.Lock()
+	defer budget.guard.Unlock()
+
+	now := time.Now()
+	budget.tokens += now.Sub(budget.lastUpdate).Seconds() * budget.rate
+	budget.lastUpdate = now
+
+	if budget.tokens > budget.rate {
+		budget.tokens = budget.rate
+	}
+	if budget.tokens < 1 {
+		return false // ### return, budget exhausted ###
+	}
+
+	budget.tokens--
+	return true
+}
+
+// spendRetryBudget returns true if the given message may be passed to the retry
+// queue. If the retry budget of the message's stream is exhausted the message
+// is passed to the dead letter stream or discarded and false is returned.
+func spendRetryBudget(msg Message) bool {
+	budget, exists := retryBudgets[msg.StreamID]
+	if !exists || budget.take() {
+		return true // ### return, retry allowed ###
+	}
+
+	shared.Metric.Inc(metricRetriesRejected)
+	if !budget.hasTarget {
+		countLostMessage()
+		return false // ### return, discard ###
+	}
+
+	msg.StreamID = budget.deadLetter
+	StreamTypes.GetStreamOrFallback(budget.deadLetter).Enqueue(msg)
+	return false
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	expect := shared.NewExpect(t)
+	streamID := GetStreamID("retryBudgetTest")
+	defer delete(retryBudgets, streamID)
+
+	msg := NewMessage(nil, []byte("test"), 0)
+	msg.StreamID = streamID
+	expect.True(spendRetryBudget(msg))
+
+	setRetryBudget(streamID, 2, "")
+	expect.True(spendRetryBudget(msg))
+	expect.True(spendRetryBudget(msg))
+	expect.False(spendRetryBudget(msg))
+
+	// The budget refills over time
+	time.Sleep(600 * time.Millisecond)
+	expect.True(spendRetryBudget(msg))
+	expect.False(spendRetryBudget(msg))
+}
@@ -15,6 +15,7 @@
 package core
 
 import (
+	"fmt"
 	"sync/atomic"
 )
 
@@ -42,6 +43,21 @@ type Stream interface {
 	Enqueue(msg Message)
 }
 
+// StreamRunner is implemented by streams running background tasks, e.g. to
+// generate messages. These tasks must not be started by Configure as plugins
+// are configured when testing a configuration, too. Start is called after all
+// producers have been started. Stop is called after all consumers have been
+// stopped and blocks until the background tasks have finished.
+type StreamRunner interface {
+	Start()
+	Stop()
+}
+
+// formattedStream is implemented by all streams derived from StreamBase.
+type formattedStream interface {
+	formatter() Formatter
+}
+
 // MappedStream holds a stream and the id the stream is assgined to
 type MappedStream struct {
 	StreamID MessageStreamID
@@ -61,6 +77,9 @@ type StreamBase struct {
 	Distribute     func(msg Message)
 	prevDistribute func(msg Message)
 	paused         chan Message
+	blockOnFuse    bool
+	mirrored       bool
+	passThrough    bool
 }
 
 // GetAndResetMessageCount returns the current message counter and resets it
@@ -69,6 +88,11 @@ func GetAndResetMessageCount() uint32 {
 	return atomic.SwapUint32(&MessageCount, 0)
 }
 
+// formatter returns the formatter of this stream.
+func (stream *StreamBase) formatter() Formatter {
+	return stream.Format
+}
+
 // Configure sets up all values requred by StreamBase
 func (stream *StreamBase) Configure(conf PluginConfig) error {
 	plugin, err := NewPluginWithType(conf.GetString("Formatter", "format.Forward"), conf)
@@ -83,6 +107,45 @@ func (stream *StreamBase) Configure(conf PluginConfig) error {
 	}
 	stream.Filter = plugin.(Filter)
 	stream.Distribute = stream.broadcast
+	stream.passThrough = isPassThroughFilter(stream.Filter) && isPassThroughFormatter(stream.Format)
+
+	retryBudget := conf.GetInt("RetryBudget", 0)
+	deadLetter := conf.GetString("DeadLetterStream", "")
+	if retryBudget > 0 {
+		for _, streamName := range conf.Stream {
+			setRetryBudget(GetStreamID(streamName), retryBudget, deadLetter)
+		}
+	}
+
+	fusePolicy, err := ParseFusePolicy(conf.GetString("FusePolicy", "none"))
+	if err != nil {
+		return err // ### return, unknown policy ###
+	}
+	for _, streamName := range conf.Stream {
+		setFusePolicy(GetStreamID(streamName), fusePolicy)
+	}
+	stream.blockOnFuse = fusePolicy == FusePolicyBlock
+
+	priority := conf.GetInt("Priority", 1)
+	if priority < 1 {
+		return fmt.Errorf("Invalid stream priority %d", priority)
+	}
+	if priority > 1 {
+		for _, streamName := range conf.Stream {
+			setStreamPriority(GetStreamID(streamName), priority)
+		}
+	}
+
+	mirrorTargets := []MessageStreamID{}
+	for _, streamName := range conf.GetStringArray("Mirror", []string{}) {
+		mirrorTargets = append(mirrorTargets, GetStreamID(streamName))
+	}
+	for _, streamName := range conf.Stream {
+		if err := setMirrors(GetStreamID(streamName), mirrorTargets); err != nil {
+			return err // ### return, invalid mirror ###
+		}
+	}
+	stream.mirrored = len(mirrorTargets) > 0
 	return nil
 }
 
@@ -125,12 +188,14 @@ func (stream *StreamBase) Resume() {
 		go func() {
 			for msg := range stashed {
 				stream.Distribute(msg)
+				msg.tracker.release()
 			}
 		}()
 	}
 }
 
 func (stream *StreamBase) stash(msg Message) {
+	msg.tracker.hold()
 	stream.paused <- msg
 }
 
@@ -143,12 +208,37 @@ func (stream *StreamBase) broadcast(msg Message) {
 // Enqueue checks the filter, formats the message and sends it to all producers
 // registered. Functions deriving from StreamBase can set the Distribute member
 // to hook into this function.
+// If the fuse policy of this stream is set to "block" this function blocks
+// while the fuse of the message's stream is burned.
+// Copies of the message are sent to all mirror streams before the message is
+// filtered or formatted.
+// Streams that neither filter nor format messages, i.e. use filter.All and
+// format.Forward, pass messages on directly without calling either plugin.
 func (stream *StreamBase) Enqueue(msg Message) {
+	if stream.blockOnFuse {
+		if fuse := GetFuse(msg.StreamID); fuse != nil {
+			fuse.Wait()
+		}
+	}
+	if stream.mirrored {
+		mirrorMessage(msg)
+	}
+
 	atomic.AddUint32(&MessageCount, 1)
+	trackMessageSize(msg)
+
+	if stream.passThrough {
+		stream.Distribute(msg)
+		return // ### return, pass-through ###
+	}
 
 	if stream.Filter.Accepts(msg) {
 		var streamID MessageStreamID
-		msg.Data, streamID = stream.Format.Format(msg)
+		if format, isMetadataFormatter := stream.Format.(MetadataFormatter); isMetadataFormatter {
+			msg.Data, streamID, msg.Metadata = format.FormatMetadata(msg)
+		} else {
+			msg.Data, streamID = stream.Format.Format(msg)
+		}
 
 		if msg.StreamID == streamID {
 			stream.Distribute(msg)
@@ -0,0 +1,72 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+// streamTestPlugin is a filter and formatter counting the number of calls.
+type streamTestPlugin struct {
+	calls       int
+	passThrough bool
+}
+
+func (plugin *streamTestPlugin) Accepts(msg Message) bool {
+	plugin.calls++
+	return true
+}
+
+func (plugin *streamTestPlugin) Format(msg Message) ([]byte, MessageStreamID) {
+	plugin.calls++
+	return msg.Data, msg.StreamID
+}
+
+func (plugin *streamTestPlugin) PassThrough() bool {
+	return plugin.passThrough
+}
+
+func TestStreamPassThrough(t *testing.T) {
+	expect := shared.NewExpect(t)
+	plugin := &streamTestPlugin{passThrough: true}
+	distributed := [][]byte{}
+
+	stream := StreamBase{
+		Filter: plugin,
+		Format: plugin,
+		Distribute: func(msg Message) {
+			distributed = append(distributed, msg.Data)
+		},
+	}
+	stream.passThrough = isPassThroughFilter(stream.Filter) && isPassThroughFormatter(stream.Format)
+	expect.True(stream.passThrough)
+
+	payload := []byte("test")
+	stream.Enqueue(NewMessage(nil, payload, 0))
+
+	expect.Equal(0, plugin.calls)
+	expect.Equal(1, len(distributed))
+	expect.True(&payload[0] == &distributed[0][0])
+
+	// Plugins that may modify messages have to be called
+	plugin.passThrough = false
+	stream.passThrough = isPassThroughFilter(stream.Filter) && isPassThroughFormatter(stream.Format)
+	expect.False(stream.passThrough)
+
+	stream.Enqueue(NewMessage(nil, payload, 0))
+	expect.Equal(2, plugin.calls)
+	expect.Equal(2, len(distributed))
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"sync"
+	"time"
+)
+
+// streamMetric holds the histograms tracked for a single stream.
+type streamMetric struct {
+	size    *shared.Histogram
+	latency *shared.Histogram
+}
+
+type streamMetricRegistry struct {
+	metrics map[MessageStreamID]streamMetric
+	guard   *sync.RWMutex
+}
+
+// streamMetrics is nil as long as EnableStreamMetrics has not been called.
+var streamMetrics *streamMetricRegistry
+
+// EnableStreamMetrics enables tracking of message sizes and latencies per
+// stream. The histograms are registered as "Stream:<name>:MessageSize" and
+// "Stream:<name>:LatencyMs" when the first message passes a stream.
+// Message sizes are measured before the stream's formatter is applied.
+// Latencies are measured from the message timestamp to the time a producer
+// finished processing the message.
+func EnableStreamMetrics() {
+	if streamMetrics == nil {
+		streamMetrics = &streamMetricRegistry{
+			metrics: make(map[MessageStreamID]streamMetric),
+			guard:   new(sync.RWMutex),
+		}
+	}
+}
+
+func (registry *streamMetricRegistry) get(streamID MessageStreamID) streamMetric {
+	registry.guard.RLock()
+	metric, exists := registry.metrics[streamID]
+	registry.guard.RUnlock()
+
+	if exists {
+		return metric // ### return, known stream ###
+	}
+
+	registry.guard.Lock()
+	defer registry.guard.Unlock()
+
+	if metric, exists = registry.metrics[streamID]; !exists {
+		name := "Stream:" + StreamTypes.GetStreamName(streamID)
+		metric = streamMetric{
+			size:    shared.Metric.NewHistogram(name + ":MessageSize"),
+			latency: shared.Metric.NewHistogram(name + ":LatencyMs"),
+		}
+		registry.metrics[streamID] = metric
+	}
+	return metric
+}
+
+// trackMessageSize counts the size of a message entering a stream.
+func trackMessageSize(msg Message) {
+	if streamMetrics != nil {
+		streamMetrics.get(msg.StreamID).size.Add(int64(len(msg.Data)))
+	}
+}
+
+// trackMessageLatency counts the time since a message has been created.
+func trackMessageLatency(msg Message) {
+	if streamMetrics != nil {
+		latency := time.Since(msg.Timestamp) / time.Millisecond
+		streamMetrics.get(msg.StreamID).latency.Add(int64(latency))
+	}
+	trackBenchmarkMessage(msg)
+}
@@ -84,6 +84,32 @@ func (registry StreamRegistry) IsStreamRegistered(id MessageStreamID) bool {
 	return exists
 }
 
+// StartStreams starts the formatters of all registered streams and calls
+// Start for all registered streams implementing StreamRunner.
+func (registry StreamRegistry) StartStreams() {
+	for _, stream := range registry.streams {
+		if formatted, isFormatted := stream.(formattedStream); isFormatted {
+			StartFormatter(formatted.formatter())
+		}
+		if runner, isRunner := stream.(StreamRunner); isRunner {
+			runner.Start()
+		}
+	}
+}
+
+// StopStreams calls Stop for all registered streams implementing
+// StreamRunner and stops the formatters of all registered streams.
+func (registry StreamRegistry) StopStreams() {
+	for _, stream := range registry.streams {
+		if runner, isRunner := stream.(StreamRunner); isRunner {
+			runner.Stop()
+		}
+		if formatted, isFormatted := stream.(formattedStream); isFormatted {
+			StopFormatter(formatted.formatter())
+		}
+	}
+}
+
 // ForEachStream loops over all registered streams and calls the given function.
 func (registry StreamRegistry) ForEachStream(callback func(streamID MessageStreamID, stream Stream)) {
 	for streamID, stream := range registry.streams {
@@ -0,0 +1,126 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+type templateSegmentType int
+
+const (
+	templateText      = templateSegmentType(iota)
+	templateHostname  = templateSegmentType(iota)
+	templateStream    = templateSegmentType(iota)
+	templateTimestamp = templateSegmentType(iota)
+	templateSequence  = templateSegmentType(iota)
+	templateMetadata  = templateSegmentType(iota)
+)
+
+type templateSegment struct {
+	kind templateSegmentType
+	text string
+}
+
+var templateHostnameValue, _ = os.Hostname()
+
+// MessageTemplate is a string containing placeholders that are replaced by
+// values of a message. Supported placeholders are ${hostname}, ${stream},
+// ${timestamp}, ${sequence} and ${meta:<key>} which is replaced by the
+// metadata field <key>. Unknown placeholders are written as-is.
+type MessageTemplate struct {
+	segments        []templateSegment
+	timestampFormat string
+}
+
+// NewMessageTemplate parses a template. The given format is used for the
+// ${timestamp} placeholder and is based on Go's time.Format function.
+func NewMessageTemplate(template string, timestampFormat string) MessageTemplate {
+	tmpl := MessageTemplate{timestampFormat: timestampFormat}
+	addText := func(text string) {
+		if text == "" {
+			return // ### return, nothing to add ###
+		}
+		if last := len(tmpl.segments) - 1; last >= 0 && tmpl.segments[last].kind == templateText {
+			tmpl.segments[last].text += text
+		} else {
+			tmpl.segments = append(tmpl.segments, templateSegment{templateText, text})
+		}
+	}
+
+	for {
+		start := strings.Index(template, "${")
+		if start == -1 {
+			break // ### break, no more placeholders ###
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end == -1 {
+			break // ### break, not terminated ###
+		}
+		end += start
+
+		addText(template[:start])
+		name := template[start+2 : end]
+
+		switch {
+		case name == "hostname":
+			tmpl.segments = append(tmpl.segments, templateSegment{templateHostname, ""})
+		case name == "stream":
+			tmpl.segments = append(tmpl.segments, templateSegment{templateStream, ""})
+		case name == "timestamp":
+			tmpl.segments = append(tmpl.segments, templateSegment{templateTimestamp, ""})
+		case name == "sequence":
+			tmpl.segments = append(tmpl.segments, templateSegment{templateSequence, ""})
+		case strings.HasPrefix(name, "meta:"):
+			tmpl.segments = append(tmpl.segments, templateSegment{templateMetadata, name[5:]})
+		default:
+			addText(template[start : end+1])
+		}
+		template = template[end+1:]
+	}
+
+	addText(template)
+	return tmpl
+}
+
+// Append appends the template with all placeholders replaced by the values of
+// the given message to buffer. The given stream is used for ${stream}.
+func (tmpl MessageTemplate) Append(buffer []byte, msg Message, streamID MessageStreamID) []byte {
+	for _, segment := range tmpl.segments {
+		switch segment.kind {
+		case templateText:
+			buffer = append(buffer, segment.text...)
+		case templateHostname:
+			buffer = append(buffer, templateHostnameValue...)
+		case templateStream:
+			buffer = append(buffer, StreamTypes.GetStreamName(streamID)...)
+		case templateTimestamp:
+			buffer = msg.Timestamp.AppendFormat(buffer, tmpl.timestampFormat)
+		case templateSequence:
+			buffer = strconv.AppendUint(buffer, msg.Sequence, 10)
+		case templateMetadata:
+			buffer = append(buffer, msg.Metadata[segment.text]...)
+		}
+	}
+	return buffer
+}
+
+// String returns the template with all placeholders replaced by the values of
+// the given message.
+func (tmpl MessageTemplate) String(msg Message, streamID MessageStreamID) string {
+	return string(tmpl.Append(make([]byte, 0, 64), msg, streamID))
+}
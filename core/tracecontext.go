@@ -0,0 +1,148 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// MetadataTraceParent is the metadata key storing the W3C traceparent of
+	// a message.
+	MetadataTraceParent = "traceparent"
+
+	// MetadataTraceState is the metadata key storing the W3C tracestate of a
+	// message.
+	MetadataTraceState = "tracestate"
+)
+
+// TraceContext stores the fields of a W3C traceparent header.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceParent parses a W3C traceparent value as in
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Returns false if
+// the value is not valid. Values of future versions are accepted as long as
+// they start with the fields of version 00.
+func ParseTraceParent(value string) (TraceContext, bool) {
+	ctx := TraceContext{}
+	value = strings.TrimSpace(value)
+
+	switch {
+	case len(value) < 55,
+		value[2] != '-' || value[35] != '-' || value[52] != '-',
+		value[:2] == "00" && len(value) != 55,
+		value[:2] != "00" && len(value) > 55 && value[55] != '-',
+		strings.ToLower(value[:2]) == "ff",
+		strings.ToLower(value) != value:
+		return ctx, false // ### return, invalid format ###
+	}
+
+	var version [1]byte
+	if _, err := hex.Decode(version[:], []byte(value[:2])); err != nil {
+		return ctx, false // ### return, invalid version ###
+	}
+	if _, err := hex.Decode(ctx.TraceID[:], []byte(value[3:35])); err != nil {
+		return ctx, false // ### return, invalid trace id ###
+	}
+	if _, err := hex.Decode(ctx.SpanID[:], []byte(value[36:52])); err != nil {
+		return ctx, false // ### return, invalid span id ###
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(value[53:55])); err != nil {
+		return ctx, false // ### return, invalid flags ###
+	}
+	ctx.Flags = flags[0]
+
+	if ctx.TraceID == [16]byte{} || ctx.SpanID == [8]byte{} {
+		return ctx, false // ### return, invalid ids ###
+	}
+	return ctx, true
+}
+
+// TraceContextFromMetadata returns the trace context stored in the metadata
+// of a message. Returns false if the message does not carry a valid context.
+func TraceContextFromMetadata(meta MessageMetadata) (TraceContext, bool) {
+	value, exists := meta[MetadataTraceParent]
+	if !exists {
+		return TraceContext{}, false // ### return, not traced ###
+	}
+	return ParseTraceParent(value)
+}
+
+// String returns the trace context as version 00 traceparent value.
+func (ctx TraceContext) String() string {
+	return "00-" + hex.EncodeToString(ctx.TraceID[:]) + "-" +
+		hex.EncodeToString(ctx.SpanID[:]) + "-" + hex.EncodeToString([]byte{ctx.Flags})
+}
+
+// IsSampled returns true if the sampled flag is set.
+func (ctx TraceContext) IsSampled() bool {
+	return ctx.Flags&0x01 != 0
+}
+
+// NewChild returns a trace context of the same trace with a new, random span
+// id.
+func (ctx TraceContext) NewChild() TraceContext {
+	child := ctx
+	for child.SpanID == ctx.SpanID || child.SpanID == [8]byte{} {
+		rand.Read(child.SpanID[:])
+	}
+	return child
+}
+
+// ExtractTraceContext copies a valid traceparent and the corresponding
+// tracestate returned by the given getter (e.g. http.Header.Get) to the given
+// metadata. Existing values are not overwritten. The metadata is created if
+// it is nil and returned.
+func ExtractTraceContext(meta MessageMetadata, get func(key string) string) MessageMetadata {
+	if _, exists := meta[MetadataTraceParent]; exists {
+		return meta // ### return, already traced ###
+	}
+
+	ctx, valid := ParseTraceParent(get(MetadataTraceParent))
+	if !valid {
+		return meta // ### return, not traced ###
+	}
+
+	if meta == nil {
+		meta = make(MessageMetadata, 2)
+	}
+	meta[MetadataTraceParent] = ctx.String()
+	if state := strings.TrimSpace(get(MetadataTraceState)); state != "" {
+		meta[MetadataTraceState] = state
+	}
+	return meta
+}
+
+// InjectTraceContext passes the traceparent and tracestate stored in the
+// given metadata to the given setter (e.g. http.Header.Set). Nothing is set
+// if the metadata does not contain a valid trace context.
+func InjectTraceContext(meta MessageMetadata, set func(key string, value string)) {
+	ctx, valid := TraceContextFromMetadata(meta)
+	if !valid {
+		return // ### return, not traced ###
+	}
+
+	set(MetadataTraceParent, ctx.String())
+	if state, exists := meta[MetadataTraceState]; exists && state != "" {
+		set(MetadataTraceState, state)
+	}
+}
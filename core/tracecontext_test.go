@@ -0,0 +1,83 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"testing"
+)
+
+func TestTraceParent(t *testing.T) {
+	expect := shared.NewExpect(t)
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	ctx, valid := ParseTraceParent(value)
+	expect.True(valid)
+	expect.True(ctx.IsSampled())
+	expect.Equal(value, ctx.String())
+
+	child := ctx.NewChild()
+	expect.Equal(ctx.TraceID, child.TraceID)
+	expect.Neq(ctx.SpanID, child.SpanID)
+	expect.Equal(ctx.Flags, child.Flags)
+
+	// Future versions may append fields
+	_, valid = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	expect.True(valid)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	} {
+		_, valid = ParseTraceParent(invalid)
+		expect.False(valid)
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	expect := shared.NewExpect(t)
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	header := http.Header{}
+	expect.Nil(ExtractTraceContext(nil, header.Get))
+
+	header.Set("Traceparent", value)
+	header.Set("Tracestate", "vendor=value")
+	meta := ExtractTraceContext(nil, header.Get)
+	expect.Equal(value, meta[MetadataTraceParent])
+	expect.Equal("vendor=value", meta[MetadataTraceState])
+
+	// Existing values are not overwritten
+	existing := MessageMetadata{MetadataTraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"}
+	meta = ExtractTraceContext(existing, header.Get)
+	expect.Equal(existing[MetadataTraceParent], meta[MetadataTraceParent])
+	expect.MapNotSet(meta, MetadataTraceState)
+
+	injected := http.Header{}
+	InjectTraceContext(MessageMetadata{MetadataTraceParent: value, MetadataTraceState: "vendor=value"}, injected.Set)
+	expect.Equal(value, injected.Get("traceparent"))
+	expect.Equal("vendor=value", injected.Get("tracestate"))
+
+	injected = http.Header{}
+	InjectTraceContext(MessageMetadata{MetadataTraceParent: "invalid"}, injected.Set)
+	expect.Equal(0, len(injected))
+}
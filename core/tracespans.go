@@ -0,0 +1,189 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const traceQueueSize = 4096
+
+// traceSpans forwards spans to TraceInternalStream. Spans are queued so that
+// emitting a span never blocks. Spans are discarded if the queue is full.
+type traceSpans struct {
+	queue    chan Message
+	done     chan struct{}
+	guard    *sync.RWMutex
+	resource []otlpAttribute
+	sequence uint64
+	stopped  bool
+}
+
+var traces *traceSpans
+
+// The following types define the OTLP/JSON encoding of a span, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	TraceState   string          `json:"traceState,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpSpanKindInternal is the OTLP span kind used for pipeline hops
+const otlpSpanKindInternal = 1
+
+// StartTraceSpans enables emitting spans if at least one producer listens to
+// TraceInternalStream.
+func StartTraceSpans() {
+	if !StreamTypes.IsStreamRegistered(TraceInternalStreamID) {
+		return // ### return, no listeners ###
+	}
+
+	hostname, _ := os.Hostname()
+	spans := &traceSpans{
+		queue: make(chan Message, traceQueueSize),
+		done:  make(chan struct{}),
+		guard: new(sync.RWMutex),
+		resource: []otlpAttribute{
+			{"service.name", otlpValue{"gollum"}},
+			{"host.name", otlpValue{hostname}},
+		},
+	}
+
+	stream := StreamTypes.GetStream(TraceInternalStreamID)
+	go func() {
+		defer close(spans.done)
+		for msg := range spans.queue {
+			stream.Enqueue(msg)
+		}
+	}()
+	traces = spans
+}
+
+// StopTraceSpans sends all queued spans and disables emitting new spans.
+// This has to be called before producers are stopped.
+func StopTraceSpans() {
+	spans := traces
+	if spans == nil {
+		return // ### return, not started ###
+	}
+
+	spans.guard.Lock()
+	spans.stopped = true
+	close(spans.queue)
+	spans.guard.Unlock()
+	<-spans.done
+}
+
+// IsTracingEnabled returns true if spans are sent to TraceInternalStream.
+func IsTracingEnabled() bool {
+	return traces != nil
+}
+
+// EmitTraceSpan sends a span as OTLP/JSON encoded ExportTraceServiceRequest
+// to TraceInternalStream. Each message contains exactly one span. Spans are
+// discarded if no producer listens to TraceInternalStream or if the trace is
+// not sampled.
+func EmitTraceSpan(span TraceContext, parent TraceContext, traceState string, name string, start time.Time, end time.Time, attributes map[string]string) {
+	spans := traces
+	if spans == nil || !span.IsSampled() {
+		return // ### return, disabled ###
+	}
+
+	record := otlpSpan{
+		TraceID:      hex.EncodeToString(span.TraceID[:]),
+		SpanID:       hex.EncodeToString(span.SpanID[:]),
+		ParentSpanID: hex.EncodeToString(parent.SpanID[:]),
+		TraceState:   traceState,
+		Name:         name,
+		Kind:         otlpSpanKindInternal,
+		StartTime:    strconv.FormatInt(start.UnixNano(), 10),
+		EndTime:      strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:   make([]otlpAttribute, 0, len(attributes)),
+	}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.Attributes = append(record.Attributes, otlpAttribute{key, otlpValue{attributes[key]}})
+	}
+
+	scope := otlpScopeSpans{Spans: []otlpSpan{record}}
+	scope.Scope.Name = "gollum"
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = spans.resource
+
+	data, err := json.Marshal(otlpTraceRequest{[]otlpResourceSpans{resource}})
+	if err != nil {
+		return // ### return, invalid span ###
+	}
+
+	msg := NewMessage(nil, data, atomic.AddUint64(&spans.sequence, 1))
+	msg.StreamID = TraceInternalStreamID
+	msg.Timestamp = end
+
+	spans.guard.RLock()
+	defer spans.guard.RUnlock()
+	if !spans.stopped {
+		select {
+		case spans.queue <- msg:
+		default:
+			// Queue is full, discard the span
+		}
+	}
+}
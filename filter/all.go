@@ -40,3 +40,8 @@ func (filter *All) Configure(conf core.PluginConfig) error {
 func (filter *All) Accepts(msg core.Message) bool {
 	return true
 }
+
+// PassThrough returns true as all messages are accepted
+func (filter *All) PassThrough() bool {
+	return true
+}
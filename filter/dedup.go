@@ -0,0 +1,125 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"container/list"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Dedup blocks messages that have already been seen within a given time
+// window. Messages are compared by hashing their payload or a part of it.
+// The hashes are stored in a LRU cache of limited size, i.e. the oldest
+// hashes are discarded if the cache is full.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Dedup"
+//     FilterWindowSec: 60
+//     FilterCacheSize: 10000
+//     FilterField: "event/id"
+//     FilterExpression: "id=(\d+)"
+//
+// FilterWindowSec defines the number of seconds a message is considered a
+// duplicate after a message with the same hash has been passed.
+// By default this is set to 60.
+//
+// FilterCacheSize defines the maximum number of hashes stored.
+// By default this is set to 10000.
+//
+// FilterField defines a JSON field to generate the hash from.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// Messages that are not valid JSON or do not contain this field are passed.
+// By default this is set to "", i.e. the whole message is used.
+//
+// FilterExpression defines a regular expression applied to the message or to
+// the value of FilterField if set. If the expression contains a capture group
+// the first group is used to generate the hash, otherwise the whole match is
+// used. Messages that do not match are passed. By default this is set to "".
+type Dedup struct {
+	window   time.Duration
+	capacity int
+	key      messageKey
+	seen     map[uint64]*list.Element
+	order    *list.List
+	guard    *sync.Mutex
+}
+
+type dedupEntry struct {
+	hash   uint64
+	passed time.Time
+}
+
+func init() {
+	shared.RuntimeType.Register(Dedup{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Dedup) Configure(conf core.PluginConfig) error {
+	filter.window = time.Duration(conf.GetInt("FilterWindowSec", 60)) * time.Second
+	filter.capacity = conf.GetInt("FilterCacheSize", 10000)
+	if filter.capacity < 1 {
+		filter.capacity = 1
+	}
+	filter.seen = make(map[uint64]*list.Element)
+	filter.order = list.New()
+	filter.guard = new(sync.Mutex)
+
+	var err error
+	filter.key, err = newMessageKey(conf)
+	return err
+}
+
+// isDuplicate checks if the given hash has been passed within the window and
+// stores it if not. This function is not threadsafe.
+func (filter *Dedup) isDuplicate(hash uint64, now time.Time) bool {
+	if element, exists := filter.seen[hash]; exists {
+		entry := element.Value.(*dedupEntry)
+		filter.order.MoveToFront(element)
+
+		if now.Sub(entry.passed) < filter.window {
+			return true // ### return, duplicate ###
+		}
+		entry.passed = now
+		return false
+	}
+
+	filter.seen[hash] = filter.order.PushFront(&dedupEntry{hash, now})
+	for filter.order.Len() > filter.capacity {
+		oldest := filter.order.Back()
+		filter.order.Remove(oldest)
+		delete(filter.seen, oldest.Value.(*dedupEntry).hash)
+	}
+	return false
+}
+
+// Accepts blocks messages that have already been passed within the window.
+func (filter *Dedup) Accepts(msg core.Message) bool {
+	key, found := filter.key.get(msg.Data)
+	if !found {
+		return true // ### return, nothing to compare ###
+	}
+
+	hash := fnv.New64a()
+	hash.Write(key)
+
+	filter.guard.Lock()
+	defer filter.guard.Unlock()
+	return !filter.isDuplicate(hash.Sum64(), time.Now())
+}
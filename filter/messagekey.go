@@ -0,0 +1,90 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+)
+
+// messageKey extracts a part of a message by reading the JSON field given by
+// FilterField and by applying the regular expression given by
+// FilterExpression to it.
+type messageKey struct {
+	field string
+	exp   *regexp.Regexp
+}
+
+// newMessageKey reads FilterField and FilterExpression from a plugin config.
+func newMessageKey(conf core.PluginConfig) (messageKey, error) {
+	key := messageKey{
+		field: conf.GetString("FilterField", ""),
+	}
+
+	if exp := conf.GetString("FilterExpression", ""); exp != "" {
+		var err error
+		if key.exp, err = regexp.Compile(exp); err != nil {
+			return key, err // ### return, regex parser error ###
+		}
+	}
+	return key, nil
+}
+
+// get returns the key of the given message. False is returned if the message
+// is not valid JSON, does not contain the field or does not match the
+// expression.
+func (key messageKey) get(data []byte) ([]byte, bool) {
+	value := data
+	if key.field != "" {
+		values := shared.NewMarshalMap()
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, false // ### return, no JSON ###
+		}
+
+		fieldValue, found := values.Path(key.field)
+		if !found {
+			return nil, false // ### return, field not found ###
+		}
+
+		if stringValue, isString := fieldValue.(string); isString {
+			value = []byte(stringValue)
+		} else {
+			var err error
+			if value, err = json.Marshal(fieldValue); err != nil {
+				return nil, false // ### return, invalid value ###
+			}
+		}
+	}
+
+	return key.match(value)
+}
+
+func (key messageKey) match(value []byte) ([]byte, bool) {
+	if key.exp == nil {
+		return value, true // ### return, no expression ###
+	}
+
+	match := key.exp.FindSubmatch(value)
+	switch {
+	case match == nil:
+		return nil, false
+	case len(match) > 1:
+		return match[1], true
+	default:
+		return match[0], true
+	}
+}
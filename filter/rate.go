@@ -0,0 +1,247 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rateAction int
+
+const (
+	rateActionDrop    = rateAction(iota)
+	rateActionDelay   = rateAction(iota)
+	rateActionReroute = rateAction(iota)
+)
+
+// Rate limits the number of messages passed per second.
+// Limits can be applied to all messages or per key, e.g. per user or host.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Rate"
+//     FilterRateLimit: 100
+//     FilterMode: "window"
+//     FilterBurst: 100
+//     FilterField: "user/id"
+//     FilterExpression: ""
+//     FilterCacheSize: 10000
+//     FilterAction: "drop"
+//     FilterRejectStream: ""
+//
+// FilterRateLimit defines the number of messages per second to pass.
+// By default this is set to 100.
+//
+// FilterMode defines how the limit is applied. When set to "window" at most
+// FilterRateLimit messages are passed per second, starting with the first
+// message of each second. When set to "bucket" a token bucket is used, i.e.
+// tokens are refilled continuously at FilterRateLimit per second and up to
+// FilterBurst messages can be passed at once after a quiet period.
+// By default this is set to "window".
+//
+// FilterBurst defines the size of the token bucket if FilterMode is set to
+// "bucket". By default this is set to FilterRateLimit.
+//
+// FilterField defines a JSON field used as key, i.e. each value of this field
+// has its own limit. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. Messages that are not valid JSON or do not contain
+// this field share a common limit. By default this is set to "", i.e. all
+// messages share a common limit.
+//
+// FilterExpression defines a regular expression applied to the message or to
+// the value of FilterField if set. If the expression contains a capture group
+// the first group is used as key, otherwise the whole match is used.
+// Messages that do not match share a common limit. By default this is set
+// to "".
+//
+// FilterCacheSize defines the maximum number of keys tracked. If more keys
+// are seen the least recently used keys are discarded, i.e. their limit is
+// reset. By default this is set to 10000.
+//
+// FilterAction defines what happens to messages exceeding the limit. When set
+// to "drop" messages are discarded. When set to "delay" the filter blocks
+// until the message can be passed, which slows down the consumer. When set to
+// "reroute" messages are sent to FilterRejectStream. By default this is set
+// to "drop".
+//
+// FilterRejectStream defines the stream messages are sent to if FilterAction
+// is set to "reroute". Messages already sent to this stream are discarded.
+// By default this is set to "".
+type Rate struct {
+	limit        float64
+	burst        float64
+	bucket       bool
+	key          messageKey
+	capacity     int
+	action       rateAction
+	rejectStream core.MessageStreamID
+	entries      map[uint64]*list.Element
+	order        *list.List
+	guard        *sync.Mutex
+}
+
+type rateEntry struct {
+	hash   uint64
+	tokens float64
+	count  int
+	start  time.Time
+}
+
+func init() {
+	shared.RuntimeType.Register(Rate{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Rate) Configure(conf core.PluginConfig) error {
+	limit := conf.GetInt("FilterRateLimit", 100)
+	if limit < 1 {
+		return fmt.Errorf("Rate: FilterRateLimit must be at least 1")
+	}
+	filter.limit = float64(limit)
+	filter.burst = float64(conf.GetInt("FilterBurst", limit))
+	if filter.burst < 1 {
+		filter.burst = 1
+	}
+
+	switch mode := strings.ToLower(conf.GetString("FilterMode", "window")); mode {
+	case "window":
+	case "bucket":
+		filter.bucket = true
+	default:
+		return fmt.Errorf("Rate: unknown mode %s", mode)
+	}
+
+	switch action := strings.ToLower(conf.GetString("FilterAction", "drop")); action {
+	case "drop":
+		filter.action = rateActionDrop
+	case "delay":
+		filter.action = rateActionDelay
+	case "reroute":
+		stream := conf.GetString("FilterRejectStream", "")
+		if stream == "" {
+			return fmt.Errorf("Rate: FilterRejectStream must be set to reroute messages")
+		}
+		filter.action = rateActionReroute
+		filter.rejectStream = core.GetStreamID(stream)
+	default:
+		return fmt.Errorf("Rate: unknown action %s", action)
+	}
+
+	filter.capacity = conf.GetInt("FilterCacheSize", 10000)
+	if filter.capacity < 1 {
+		filter.capacity = 1
+	}
+	filter.entries = make(map[uint64]*list.Element)
+	filter.order = list.New()
+	filter.guard = new(sync.Mutex)
+
+	var err error
+	filter.key, err = newMessageKey(conf)
+	return err
+}
+
+// getEntry returns the state of the given key and creates it if necessary.
+// This function is not threadsafe.
+func (filter *Rate) getEntry(hash uint64, now time.Time) *rateEntry {
+	if element, exists := filter.entries[hash]; exists {
+		filter.order.MoveToFront(element)
+		return element.Value.(*rateEntry) // ### return, known key ###
+	}
+
+	entry := &rateEntry{
+		hash:   hash,
+		tokens: filter.burst,
+		start:  now,
+	}
+	filter.entries[hash] = filter.order.PushFront(entry)
+	for filter.order.Len() > filter.capacity {
+		oldest := filter.order.Back()
+		filter.order.Remove(oldest)
+		delete(filter.entries, oldest.Value.(*rateEntry).hash)
+	}
+	return entry
+}
+
+// take tries to pass a message for the given key. If the limit has been
+// exceeded the time to wait until the next message can be passed is returned.
+// This function is not threadsafe.
+func (filter *Rate) take(hash uint64, now time.Time) (bool, time.Duration) {
+	entry := filter.getEntry(hash, now)
+
+	if filter.bucket {
+		entry.tokens += now.Sub(entry.start).Seconds() * filter.limit
+		if entry.tokens > filter.burst {
+			entry.tokens = filter.burst
+		}
+		entry.start = now
+
+		if entry.tokens >= 1 {
+			entry.tokens--
+			return true, 0 // ### return, token available ###
+		}
+		return false, time.Duration((1 - entry.tokens) / filter.limit * float64(time.Second))
+	}
+
+	if elapsed := now.Sub(entry.start); elapsed >= time.Second {
+		entry.start = now
+		entry.count = 0
+	}
+	if float64(entry.count) < filter.limit {
+		entry.count++
+		return true, 0 // ### return, within limit ###
+	}
+	return false, entry.start.Add(time.Second).Sub(now)
+}
+
+// Accepts passes messages as long as the limit of their key has not been
+// exceeded. Other messages are handled as defined by FilterAction.
+func (filter *Rate) Accepts(msg core.Message) bool {
+	hash := fnv.New64a()
+	if key, found := filter.key.get(msg.Data); found {
+		hash.Write(key)
+	}
+	keyHash := hash.Sum64()
+
+	for {
+		filter.guard.Lock()
+		passed, wait := filter.take(keyHash, time.Now())
+		filter.guard.Unlock()
+
+		switch {
+		case passed:
+			return true // ### return, within limit ###
+
+		case filter.action == rateActionDelay:
+			time.Sleep(wait)
+
+		case filter.action == rateActionReroute:
+			if msg.StreamID != filter.rejectStream {
+				msg.StreamID = filter.rejectStream
+				core.StreamTypes.GetStreamOrFallback(filter.rejectStream).Enqueue(msg)
+			}
+			return false // ### return, rerouted ###
+
+		default:
+			return false // ### return, dropped ###
+		}
+	}
+}
@@ -15,9 +15,11 @@
 package filter
 
 import (
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 	"regexp"
+	"strings"
 )
 
 // RegExp allows filtering messages using regular expressions.
@@ -27,15 +29,44 @@ import (
 //     Filter: "filter.RegExp"
 //     FilterExpression: "\d+-.*"
 //     FilterExpressionNot: "\d+-.*"
+//     FilterRules:
+//       - "deny:^DEBUG"
+//       - "accept:^(INFO|WARN)"
+//     FilterDefault: ""
+//     FilterMetadata: ""
 //
 // FilterExpression defines the regular expression used for matching the message
 // payload. If the expression matches, the message is passed.
 //
 // FilterExpressionNot defines a negated regular expression used for matching
 // the message payload. If the expression matches, the message is blocked.
+//
+// FilterRules defines an ordered list of rules. Each rule is a regular
+// expression prefixed by "accept:" or "deny:". Rules are checked in order and
+// the first matching rule decides whether a message is passed or blocked.
+// FilterExpressionNot and FilterExpression are checked before these rules, in
+// this order. All expressions are compiled when the filter is configured so
+// that invalid expressions are reported at startup. By default no rules are
+// set.
+//
+// FilterDefault defines whether messages not matching any rule are passed
+// ("accept") or blocked ("deny"). By default this is set to "", i.e. messages
+// are blocked if at least one accept rule or FilterExpression is set and
+// passed otherwise.
+//
+// FilterMetadata defines a metadata field the expressions are matched against
+// instead of the message payload. Messages without this field are matched
+// against an empty string. By default this is set to "", i.e. the payload is
+// used.
 type RegExp struct {
+	rules    []regexpRule
+	accept   bool
+	metadata string
+}
+
+type regexpRule struct {
 	exp    *regexp.Regexp
-	expNot *regexp.Regexp
+	accept bool
 }
 
 func init() {
@@ -44,37 +75,69 @@ func init() {
 
 // Configure initializes this filter with values from a plugin config.
 func (filter *RegExp) Configure(conf core.PluginConfig) error {
-	var err error
+	rules := []string{}
+	if exp := conf.GetString("FilterExpressionNot", ""); exp != "" {
+		rules = append(rules, "deny:"+exp)
+	}
+	if exp := conf.GetString("FilterExpression", ""); exp != "" {
+		rules = append(rules, "accept:"+exp)
+	}
+	rules = append(rules, conf.GetStringArray("FilterRules", []string{})...)
 
-	exp := conf.GetString("FilterExpression", "")
-	if exp != "" {
-		filter.exp, err = regexp.Compile(exp)
-		if err != nil {
-			return err // ### return, regex parser error ###
+	filter.accept = true
+	filter.rules = make([]regexpRule, 0, len(rules))
+	for idx, rule := range rules {
+		var exp string
+		accept := false
+
+		switch {
+		case strings.HasPrefix(rule, "accept:"):
+			exp, accept = rule[7:], true
+			filter.accept = false
+		case strings.HasPrefix(rule, "deny:"):
+			exp = rule[5:]
+		default:
+			return fmt.Errorf("RegExp: rule %d must start with \"accept:\" or \"deny:\"", idx)
 		}
-	}
 
-	exp = conf.GetString("FilterExpressionNot", "")
-	if exp != "" {
-		filter.expNot, err = regexp.Compile(exp)
+		compiled, err := regexp.Compile(exp)
 		if err != nil {
-			return err // ### return, regex parser error ###
+			return fmt.Errorf("RegExp: rule %d: %s", idx, err.Error()) // ### return, regex parser error ###
 		}
+		filter.rules = append(filter.rules, regexpRule{compiled, accept})
+	}
+
+	switch conf.GetString("FilterDefault", "") {
+	case "":
+	case "accept":
+		filter.accept = true
+	case "deny":
+		filter.accept = false
+	default:
+		return fmt.Errorf("RegExp: FilterDefault must be \"accept\" or \"deny\"")
 	}
 
+	filter.metadata = conf.GetString("FilterMetadata", "")
 	return nil
 }
 
-// Accepts allows all messages
+// Accepts passes or blocks messages depending on the first matching rule.
 func (filter *RegExp) Accepts(msg core.Message) bool {
-	if filter.exp != nil {
-		return filter.exp.MatchString(string(msg.Data))
+	if len(filter.rules) == 0 {
+		return true // ### return, pass everything ###
 	}
 
-	if filter.expNot != nil {
-		return !filter.expNot.MatchString(string(msg.Data))
+	var value string
+	if filter.metadata != "" {
+		value = msg.Metadata[filter.metadata]
+	} else {
+		value = string(msg.Data)
 	}
 
-	return true // ### return, pass everything ###
-
+	for _, rule := range filter.rules {
+		if rule.exp.MatchString(value) {
+			return rule.accept
+		}
+	}
+	return filter.accept
 }
@@ -0,0 +1,176 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// sampleScale is the denominator used for percentages, i.e. percentages can
+// be given with a precision of 4 decimal places.
+const sampleScale = 1000000
+
+type sampleMode int
+
+const (
+	sampleModeCount  = sampleMode(iota)
+	sampleModeRandom = sampleMode(iota)
+	sampleModeHash   = sampleMode(iota)
+)
+
+// Sample passes only a part of all messages to reduce the volume sent to
+// expensive sinks.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Sample"
+//     FilterMode: "count"
+//     FilterEvery: 10
+//     FilterPercent: 0
+//     FilterField: "request/id"
+//     FilterSalt: ""
+//
+// FilterMode defines how messages are selected. When set to "count" every
+// n-th message is passed. When set to "random" each message is passed with the
+// given probability. When set to "hash" the decision is based on a hash of
+// FilterField, i.e. all messages with the same field value are either passed
+// or blocked together. This can be used to e.g. keep all messages of a
+// request. By default this is set to "count".
+//
+// FilterEvery defines the 1-in-n ratio of messages to pass, e.g. 10 passes
+// every 10th message. By default this is set to 10.
+//
+// FilterPercent defines the percentage of messages to pass. Values with a
+// fraction like 0.5 are allowed. If set to a value greater than 0 this setting
+// is used instead of FilterEvery. By default this is set to 0.
+//
+// FilterField defines the JSON field hashed if FilterMode is set to "hash".
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// Messages that are not valid JSON or do not contain this field are passed.
+// By default this is set to "", i.e. the whole message is hashed.
+//
+// FilterSalt is prepended to the value hashed if FilterMode is set to "hash".
+// Different salts select different sets of values for the same percentage.
+// By default this is set to "".
+type Sample struct {
+	mode      sampleMode
+	numerator uint64
+	scale     uint64
+	counter   *uint64
+	field     string
+	salt      string
+}
+
+func init() {
+	shared.RuntimeType.Register(Sample{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Sample) Configure(conf core.PluginConfig) error {
+	switch mode := strings.ToLower(conf.GetString("FilterMode", "count")); mode {
+	case "count":
+		filter.mode = sampleModeCount
+	case "random":
+		filter.mode = sampleModeRandom
+	case "hash":
+		filter.mode = sampleModeHash
+	default:
+		return fmt.Errorf("Sample: unknown mode %s", mode)
+	}
+
+	var percent float64
+	switch value := conf.GetValue("FilterPercent", 0).(type) {
+	case int:
+		percent = float64(value)
+	case float64:
+		percent = value
+	default:
+		return fmt.Errorf("Sample: FilterPercent must be a number")
+	}
+
+	if percent > 0 {
+		if percent > 100 {
+			percent = 100
+		}
+		filter.numerator = uint64(percent * sampleScale / 100)
+		filter.scale = sampleScale
+	} else {
+		every := conf.GetInt("FilterEvery", 10)
+		if every < 1 {
+			return fmt.Errorf("Sample: FilterEvery must be at least 1")
+		}
+		filter.numerator = 1
+		filter.scale = uint64(every)
+	}
+
+	filter.counter = new(uint64)
+	filter.field = conf.GetString("FilterField", "")
+	filter.salt = conf.GetString("FilterSalt", "")
+	return nil
+}
+
+// getKey returns the value to hash for the given message.
+func (filter *Sample) getKey(data []byte) ([]byte, bool) {
+	if filter.field == "" {
+		return data, true // ### return, whole message ###
+	}
+
+	values := shared.NewMarshalMap()
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, false // ### return, no JSON ###
+	}
+
+	value, found := values.Path(filter.field)
+	if !found {
+		return nil, false // ### return, field not found ###
+	}
+
+	if stringValue, isString := value.(string); isString {
+		return []byte(stringValue), true
+	}
+	key, err := json.Marshal(value)
+	return key, err == nil
+}
+
+// Accepts passes messages according to the configured mode and ratio.
+func (filter *Sample) Accepts(msg core.Message) bool {
+	switch filter.mode {
+	case sampleModeRandom:
+		return uint64(rand.Int63n(int64(filter.scale))) < filter.numerator
+
+	case sampleModeHash:
+		key, found := filter.getKey(msg.Data)
+		if !found {
+			return true // ### return, nothing to hash ###
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(filter.salt))
+		hash.Write(key)
+		return hash.Sum64()%filter.scale < filter.numerator
+
+	default:
+		// Pass a message each time the ratio crosses a whole number, starting
+		// with the first message.
+		count := atomic.AddUint64(filter.counter, 1) - 1
+		return count*filter.numerator%filter.scale < filter.numerator
+	}
+}
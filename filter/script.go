@@ -0,0 +1,92 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"time"
+)
+
+// Script passes messages for which an expression defined in the config file
+// is true. See shared.Expression for the available operators and functions
+// and core.MessageExpressionVariables for the available variables.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Script"
+//     FilterExpression: "json.status >= 500 || meta.env == 'prod'"
+//     FilterTimeoutMs: 10
+//     FilterOnError: "deny"
+//
+// FilterExpression defines the expression evaluated for each message. The
+// message is passed if the result is not null, false, 0, "" or an empty
+// array or object. This setting is required.
+//
+// FilterTimeoutMs defines the maximum number of milliseconds the expression
+// may take per message. Set to 0 to disable the limit. By default this is
+// set to 10.
+//
+// FilterOnError defines whether messages are passed ("accept") or blocked
+// ("deny") if the expression fails or times out. An error is logged in both
+// cases. By default this is set to "deny".
+type Script struct {
+	expression *shared.Expression
+	timeout    time.Duration
+	onError    bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Script{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Script) Configure(conf core.PluginConfig) error {
+	source := conf.GetString("FilterExpression", "")
+	if strings.TrimSpace(source) == "" {
+		return fmt.Errorf("Script: FilterExpression must be set")
+	}
+
+	expression, err := shared.ParseExpression(source, core.MessageExpressionVariables)
+	if err != nil {
+		return fmt.Errorf("Script: %s", err)
+	}
+	filter.expression = expression
+	filter.timeout = time.Duration(conf.GetInt("FilterTimeoutMs", 10)) * time.Millisecond
+
+	switch onError := strings.ToLower(conf.GetString("FilterOnError", "deny")); onError {
+	case "accept":
+		filter.onError = true
+	case "deny":
+		filter.onError = false
+	default:
+		return fmt.Errorf("Script: FilterOnError must be \"accept\" or \"deny\"")
+	}
+	return nil
+}
+
+// Accepts passes messages for which the expression is true.
+func (filter *Script) Accepts(msg core.Message) bool {
+	scope := core.NewMessageExpressionScope(msg, msg.Data, msg.StreamID)
+	accept, err := filter.expression.EvalBool(scope, filter.timeout)
+	if err != nil {
+		Log.Error.Print("Script: ", err)
+		return filter.onError
+	}
+	return accept
+}
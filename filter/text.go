@@ -0,0 +1,106 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"unicode/utf8"
+)
+
+// Text blocks messages that are not valid UTF-8 text. This can be used to
+// protect text based producers from binary data sent by misbehaving clients.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Text"
+//     FilterAllowControl: false
+//     FilterFirstChars: "{["
+//     FilterRejectStream: "binary"
+//
+// FilterAllowControl can be set to true to pass messages containing control
+// characters other than tab, carriage return and newline. By default this is
+// set to false.
+//
+// FilterFirstChars defines a set of characters a message has to start with.
+// Leading whitespace is ignored. Setting this to "{[" will e.g. block all
+// messages that are not JSON objects or arrays. By default this is set to "",
+// i.e. messages may start with any character.
+//
+// FilterRejectStream defines a stream blocked messages are sent to instead of
+// discarding them. Messages already sent to this stream are discarded.
+// By default this is set to "", i.e. blocked messages are discarded.
+type Text struct {
+	allowControl bool
+	firstChars   []byte
+	rejectStream core.MessageStreamID
+	reroute      bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Text{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Text) Configure(conf core.PluginConfig) error {
+	filter.allowControl = conf.GetBool("FilterAllowControl", false)
+	filter.firstChars = []byte(conf.GetString("FilterFirstChars", ""))
+
+	if stream := conf.GetString("FilterRejectStream", ""); stream != "" {
+		filter.rejectStream = core.GetStreamID(stream)
+		filter.reroute = true
+	}
+	return nil
+}
+
+func (filter *Text) isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false // ### return, binary data ###
+	}
+
+	if !filter.allowControl {
+		for _, char := range data {
+			switch {
+			case char == '\t' || char == '\r' || char == '\n':
+			case char < ' ' || char == 0x7F:
+				return false // ### return, control character ###
+			}
+		}
+	}
+
+	if len(filter.firstChars) > 0 {
+		trimmed := bytes.TrimLeft(data, " \t\r\n")
+		if len(trimmed) == 0 || bytes.IndexByte(filter.firstChars, trimmed[0]) < 0 {
+			return false // ### return, unexpected start ###
+		}
+	}
+
+	return true
+}
+
+// Accepts passes all messages that are valid text. Other messages are
+// blocked and sent to the reject stream if configured.
+func (filter *Text) Accepts(msg core.Message) bool {
+	if filter.isText(msg.Data) {
+		return true // ### return, valid text ###
+	}
+
+	if filter.reroute && msg.StreamID != filter.rejectStream {
+		msg.StreamID = filter.rejectStream
+		core.StreamTypes.GetStreamOrFallback(filter.rejectStream).Enqueue(msg)
+	}
+	return false
+}
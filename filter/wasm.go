@@ -0,0 +1,124 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Wasm passes or blocks messages by calling a WebAssembly module. This
+// allows sandboxed predicates written in e.g. Rust, Go or AssemblyScript.
+// The module is executed by an interpreter and cannot access files or the
+// network. See shared.WasmPool for the required exports.
+// Configuration example
+//
+//   - "stream.Broadcast":
+//     Filter: "filter.Wasm"
+//     FilterModule: "/etc/gollum/filter.wasm"
+//     FilterFunction: "filter"
+//     FilterMaxMemoryMB: 16
+//     FilterFuel: 10000000
+//     FilterTimeoutMs: 100
+//     FilterInstances: 0
+//     FilterOnError: "deny"
+//
+// The function is called as <function>(ptr i32, len i32) i32 with the
+// message stored in a buffer returned by alloc. Messages are passed if the
+// result is not 0.
+//
+// FilterModule defines the path to the WebAssembly module. This setting is
+// required.
+//
+// FilterFunction defines the exported function called for each message.
+// By default this is set to "filter".
+//
+// FilterMaxMemoryMB defines the maximum size of the module's memory in MB.
+// By default this is set to 16.
+//
+// FilterFuel defines the maximum number of instructions executed per call.
+// Set to 0 to disable the limit. By default this is set to 10000000.
+//
+// FilterTimeoutMs defines the maximum number of milliseconds a call may
+// take. Set to 0 to disable the limit. By default this is set to 100.
+//
+// FilterInstances defines the number of module instances kept for
+// concurrent calls. By default this is set to 0, i.e. the number of CPUs.
+//
+// FilterOnError defines whether messages are passed ("accept") or blocked
+// ("deny") if the module fails, e.g. by exceeding a limit. An error is
+// logged in both cases. By default this is set to "deny".
+type Wasm struct {
+	pool    *shared.WasmPool
+	onError bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Wasm{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Wasm) Configure(conf core.PluginConfig) error {
+	path := conf.GetString("FilterModule", "")
+	if path == "" {
+		return fmt.Errorf("Wasm: FilterModule must be set")
+	}
+	instances := conf.GetInt("FilterInstances", 0)
+	if instances <= 0 {
+		instances = runtime.NumCPU()
+	}
+	options := shared.WasmOptions{MaxMemoryPages: uint32(conf.GetInt("FilterMaxMemoryMB", 16) * 16)}
+
+	var err error
+	filter.pool, err = shared.OpenWasmPool(path,
+		conf.GetString("FilterFunction", "filter"),
+		options,
+		int64(conf.GetInt("FilterFuel", 10000000)),
+		time.Duration(conf.GetInt("FilterTimeoutMs", 100))*time.Millisecond,
+		instances)
+	if err != nil {
+		return fmt.Errorf("Wasm: %s", err)
+	}
+
+	switch onError := strings.ToLower(conf.GetString("FilterOnError", "deny")); onError {
+	case "accept":
+		filter.onError = true
+	case "deny":
+		filter.onError = false
+	default:
+		return fmt.Errorf("Wasm: FilterOnError must be \"accept\" or \"deny\"")
+	}
+	return nil
+}
+
+// Accepts passes the message to the module and passes it if the module
+// returns a value other than 0.
+func (filter *Wasm) Accepts(msg core.Message) bool {
+	accept := false
+	err := filter.pool.Call(msg.Data, func(inst *shared.WasmInstance, result uint64) error {
+		accept = uint32(result) != 0
+		return nil
+	})
+	if err != nil {
+		Log.Error.Print("Wasm: ", err)
+		return filter.onError
+	}
+	return accept
+}
@@ -25,18 +25,32 @@ var (
 	flagVersion        = flag.Bool([]string{"v", "-version"}, false, "Print version information and quit.")
 	flagProfile        = flag.Bool([]string{"ps", "-profilespeed"}, false, "Write msg/sec measurements to log.")
 	flagLoglevel       = flag.Int([]string{"ll", "-loglevel"}, 0, "Set the loglevel [0-3]. Higher levels produce more messages.")
+	flagLogFormat      = flag.String([]string{"lf", "-logformat"}, "text", "Set the log format [text, json].")
+	flagLogOutput      = flag.String([]string{"lo", "-logoutput"}, "", "Write logs to stdout, stderr, the internal log stream (stream) or a given file. By default logs are written to the internal log stream if a producer listens to it, otherwise to stdout.")
 	flagNumCPU         = flag.Int([]string{"n", "-numcpu"}, 0, "Number of CPUs to use. Set 0 for all CPUs.")
 	flagMetricsPort    = flag.Int([]string{"m", "-metrics"}, 0, "Port to use for metric queries. Set 0 to disable.")
+	flagAdminAddress   = flag.String([]string{"a", "-admin"}, "", "Address of the web based admin interface and control API, e.g. localhost:8080 or unix:///var/run/gollum.sock. Leave empty to disable.")
+	flagAdminToken     = flag.String([]string{"at", "-admintoken"}, "", "Token required to trigger actions through the admin interface. Pass it as bearer token in the Authorization header. Required for non-loopback admin addresses. If empty, actions are only accepted from local clients.")
+	flagConsoleStream  = flag.String([]string{"cs", "-consolestream"}, "", "Send messages read by console consumers to the given stream instead of the configured streams.")
 	flagConfigFile     = flag.String([]string{"c", "-config"}, "", "Use a given configuration file.")
 	flagTestConfigFile = flag.String([]string{"tc", "-testconfig"}, "", "Test a given configuration file and exit.")
 	flagCPUProfile     = flag.String([]string{"pc", "-profilecpu"}, "", "Write CPU profiler results to a given file.")
 	flagMemProfile     = flag.String([]string{"pm", "-profilemem"}, "", "Write heap profile results to a given file.")
 	flagPidFile        = flag.String([]string{"p", "-pidfile"}, "", "Write the process id into a given file.")
+	flagPlugins        = flag.String([]string{"pl", "-plugins"}, "", "Load plugins from a comma separated list of files or directories.")
+	flagShutdownSec    = flag.Int([]string{"st", "-shutdowntime"}, 0, "Maximum number of seconds to wait for a graceful shutdown. Set 0 to wait until all messages are flushed.")
+	flagSoakSec        = flag.Int([]string{"sk", "-soak"}, 0, "Run a soak test with fault injection for the given number of seconds. Set 0 to disable.")
+	flagSoakFaults     = flag.String([]string{"sf", "-soakfaults"}, "fail:1,slow:1,malformed:1,delayms:100", "Fault rates in percent and the maximum delay used by the soak test.")
+	flagBenchSec       = flag.Int([]string{"bn", "-bench"}, 0, "Run a benchmark for the given number of seconds. Consumers are replaced by a profiler consumer sending to all configured producers. Set 0 to disable.")
+	flagBenchCount     = flag.Int([]string{"bc", "-benchcount"}, 0, "Stop the benchmark after the given number of messages have been generated. Set 0 to disable.")
 )
 
+// benchCommand is set if gollum has been started as "gollum bench".
+var benchCommand = false
+
 func init() {
 	flag.Usage = func() {
-		fmt.Println("Usage: gollum [OPTIONS]\n\nGollum - A n:m message multiplexer.\n\nOptions:")
+		fmt.Println("Usage: gollum [OPTIONS]\n       gollum bench [OPTIONS]\n\nGollum - A n:m message multiplexer.\n\nOptions:")
 		flag.CommandLine.SetOutput(os.Stdout)
 		flag.PrintDefaults()
 		fmt.Print("\n")
@@ -44,7 +58,12 @@ func init() {
 }
 
 func parseFlags() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		benchCommand = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 }
 
 func printFlags() {
@@ -0,0 +1,766 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// avroMagicByte is the first byte of messages in the wire format used by
+	// Confluent-compatible schema registries. It is followed by the schema id
+	// as 32 bit big endian integer.
+	avroMagicByte   = byte(0)
+	avroHeaderSize  = 5
+	avroErrorTTL    = 10 * time.Second
+	avroContentType = "application/vnd.schemaregistry.v1+json"
+)
+
+// avroType is a parsed Avro schema. Named types (records, enums and fixed)
+// are shared by all references so recursive types are possible.
+type avroType struct {
+	kind     string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name         string
+	fieldType    *avroType
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+type avroSchemaParser struct {
+	named map[string]*avroType
+}
+
+// parseAvroSchema parses an Avro schema given as JSON.
+func parseAvroSchema(schema string) (*avroType, error) {
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema: %s", err.Error())
+	}
+
+	parser := avroSchemaParser{named: make(map[string]*avroType)}
+	return parser.parse(value, "")
+}
+
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (parser *avroSchemaParser) parse(value interface{}, namespace string) (*avroType, error) {
+	switch schema := value.(type) {
+	case string:
+		switch schema {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: schema}, nil
+		}
+		if named, exists := parser.named[avroFullName(schema, namespace)]; exists {
+			return named, nil // ### return, reference in current namespace ###
+		}
+		if named, exists := parser.named[schema]; exists {
+			return named, nil // ### return, reference by full name ###
+		}
+		return nil, fmt.Errorf("Unknown Avro type %s", schema)
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, branch := range schema {
+			branchType, err := parser.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, branchType)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return parser.parseComplex(schema, namespace)
+	}
+	return nil, fmt.Errorf("Invalid Avro schema of type %T", value)
+}
+
+func (parser *avroSchemaParser) parseNamed(schema map[string]interface{}, kind string, namespace string) (*avroType, string, error) {
+	name, _ := schema["name"].(string)
+	if name == "" {
+		return nil, namespace, fmt.Errorf("Avro %s without name", kind)
+	}
+	if ns, hasNamespace := schema["namespace"].(string); hasNamespace && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+
+	named := &avroType{kind: kind, name: avroFullName(name, namespace)}
+	if idx := strings.LastIndex(named.name, "."); idx >= 0 {
+		namespace = named.name[:idx]
+	}
+	parser.named[named.name] = named
+	return named, namespace, nil
+}
+
+func (parser *avroSchemaParser) parseComplex(schema map[string]interface{}, namespace string) (*avroType, error) {
+	kind, isString := schema["type"].(string)
+	if !isString {
+		return parser.parse(schema["type"], namespace) // ### return, nested type ###
+	}
+
+	switch kind {
+	case "record", "error":
+		record, recordNamespace, err := parser.parseNamed(schema, "record", namespace)
+		if err != nil {
+			return nil, err
+		}
+		fields, _ := schema["fields"].([]interface{})
+		for _, fieldValue := range fields {
+			fieldSchema, isObject := fieldValue.(map[string]interface{})
+			name, _ := fieldSchema["name"].(string)
+			if !isObject || name == "" {
+				return nil, fmt.Errorf("Invalid field in Avro record %s", record.name)
+			}
+			fieldType, err := parser.parse(fieldSchema["type"], recordNamespace)
+			if err != nil {
+				return nil, err
+			}
+			defaultValue, hasDefault := fieldSchema["default"]
+			record.fields = append(record.fields, avroField{name, fieldType, defaultValue, hasDefault})
+		}
+		return record, nil
+
+	case "enum":
+		enum, _, err := parser.parseNamed(schema, kind, namespace)
+		if err != nil {
+			return nil, err
+		}
+		symbols, _ := schema["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			name, _ := symbol.(string)
+			enum.symbols = append(enum.symbols, name)
+		}
+		return enum, nil
+
+	case "fixed":
+		fixed, _, err := parser.parseNamed(schema, kind, namespace)
+		if err != nil {
+			return nil, err
+		}
+		size, _ := schema["size"].(json.Number)
+		if value, err := size.Int64(); err == nil && value >= 0 {
+			fixed.size = int(value)
+			return fixed, nil
+		}
+		return nil, fmt.Errorf("Invalid size of Avro fixed %s", fixed.name)
+
+	case "array":
+		items, err := parser.parse(schema["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: kind, items: items}, nil
+
+	case "map":
+		values, err := parser.parse(schema["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: kind, items: values}, nil
+	}
+
+	// Primitive types with attributes, e.g. logical types
+	return parser.parse(kind, namespace)
+}
+
+// typeName returns the name used to select a union branch in the Avro JSON
+// encoding.
+func (avro *avroType) typeName() string {
+	if avro.name != "" {
+		return avro.name
+	}
+	return avro.kind
+}
+
+// avroReader decodes Avro binary data.
+type avroReader struct {
+	data   []byte
+	offset int
+}
+
+func (reader *avroReader) readLong() (int64, error) {
+	value, size := binary.Uvarint(reader.data[reader.offset:])
+	if size <= 0 {
+		return 0, fmt.Errorf("Invalid varint at offset %d", reader.offset)
+	}
+	reader.offset += size
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+func (reader *avroReader) readFixed(size int) ([]byte, error) {
+	if size < 0 || reader.offset+size > len(reader.data) {
+		return nil, fmt.Errorf("Unexpected end of data at offset %d", reader.offset)
+	}
+	value := reader.data[reader.offset : reader.offset+size]
+	reader.offset += size
+	return value, nil
+}
+
+func (reader *avroReader) readBytes() ([]byte, error) {
+	size, err := reader.readLong()
+	if err != nil {
+		return nil, err
+	}
+	return reader.readFixed(int(size))
+}
+
+// readBlockCount returns the number of items in the next block of an array
+// or map.
+func (reader *avroReader) readBlockCount() (int64, error) {
+	count, err := reader.readLong()
+	if err == nil && count < 0 {
+		count = -count
+		_, err = reader.readLong() // block size in bytes
+	}
+	return count, err
+}
+
+// decodeAvro decodes a complete Avro binary value.
+func decodeAvro(avro *avroType, data []byte) (interface{}, error) {
+	reader := avroReader{data: data}
+	value, err := reader.decode(avro)
+	if err == nil && reader.offset != len(data) {
+		err = fmt.Errorf("%d bytes left after decoding", len(data)-reader.offset)
+	}
+	return value, err
+}
+
+func (reader *avroReader) decode(avro *avroType) (interface{}, error) {
+	switch avro.kind {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		value, err := reader.readFixed(1)
+		if err != nil {
+			return nil, err
+		}
+		return value[0] != 0, nil
+
+	case "int", "long":
+		return reader.readLong()
+
+	case "float":
+		value, err := reader.readFixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return protobufFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(value)))), nil
+
+	case "double":
+		value, err := reader.readFixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return protobufFloat(math.Float64frombits(binary.LittleEndian.Uint64(value))), nil
+
+	case "bytes":
+		value, err := reader.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(value), nil
+
+	case "fixed":
+		value, err := reader.readFixed(avro.size)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(value), nil
+
+	case "string":
+		value, err := reader.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return string(value), nil
+
+	case "enum":
+		idx, err := reader.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= int64(len(avro.symbols)) {
+			return nil, fmt.Errorf("Invalid symbol %d for Avro enum %s", idx, avro.name)
+		}
+		return avro.symbols[idx], nil
+
+	case "union":
+		idx, err := reader.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= int64(len(avro.branches)) {
+			return nil, fmt.Errorf("Invalid union branch %d", idx)
+		}
+		return reader.decode(avro.branches[idx])
+
+	case "record":
+		record := make(map[string]interface{}, len(avro.fields))
+		for _, field := range avro.fields {
+			value, err := reader.decode(field.fieldType)
+			if err != nil {
+				return nil, err
+			}
+			record[field.name] = value
+		}
+		return record, nil
+
+	case "array":
+		items := []interface{}{}
+		for {
+			count, err := reader.readBlockCount()
+			if err != nil || count == 0 {
+				return items, err
+			}
+			for i := int64(0); i < count; i++ {
+				item, err := reader.decode(avro.items)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+
+	case "map":
+		values := make(map[string]interface{})
+		for {
+			count, err := reader.readBlockCount()
+			if err != nil || count == 0 {
+				return values, err
+			}
+			for i := int64(0); i < count; i++ {
+				key, err := reader.readBytes()
+				if err != nil {
+					return nil, err
+				}
+				if values[string(key)], err = reader.decode(avro.items); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("Unsupported Avro type %s", avro.kind)
+}
+
+// avroWriter encodes Avro binary data.
+type avroWriter struct {
+	bytes.Buffer
+}
+
+func (writer *avroWriter) writeLong(value int64) {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutUvarint(buffer, uint64((value<<1)^(value>>63)))
+	writer.Write(buffer[:size])
+}
+
+func (writer *avroWriter) writeBytes(value []byte) {
+	writer.writeLong(int64(len(value)))
+	writer.Write(value)
+}
+
+// encodeAvro encodes a value decoded from JSON. Values are expected as
+// written by decodeAvro, i.e. bytes and fixed are base64 encoded and unions
+// are given by their plain value. The Avro JSON encoding of unions, i.e. an
+// object with the branch type name as its only key, is accepted, too.
+func encodeAvro(avro *avroType, value interface{}) ([]byte, error) {
+	writer := avroWriter{}
+	if err := writer.encode(avro, value); err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
+}
+
+func (writer *avroWriter) encode(avro *avroType, value interface{}) error {
+	switch avro.kind {
+	case "null":
+		if value != nil {
+			return fmt.Errorf("Expected null, got %T", value)
+		}
+
+	case "boolean":
+		flag, isBool := value.(bool)
+		if !isBool {
+			return fmt.Errorf("Expected boolean, got %T", value)
+		}
+		if flag {
+			writer.WriteByte(1)
+		} else {
+			writer.WriteByte(0)
+		}
+
+	case "int", "long":
+		bits := 64
+		if avro.kind == "int" {
+			bits = 32
+		}
+		number, err := protobufParseInt(value, bits)
+		if err != nil {
+			return err
+		}
+		writer.writeLong(number)
+
+	case "float":
+		number, err := protobufParseFloat(value)
+		if err != nil {
+			return err
+		}
+		binary.Write(writer, binary.LittleEndian, math.Float32bits(float32(number)))
+
+	case "double":
+		number, err := protobufParseFloat(value)
+		if err != nil {
+			return err
+		}
+		binary.Write(writer, binary.LittleEndian, math.Float64bits(number))
+
+	case "bytes", "fixed":
+		text, isString := value.(string)
+		if !isString {
+			return fmt.Errorf("Expected base64 string, got %T", value)
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return err
+		}
+		if avro.kind == "bytes" {
+			writer.writeBytes(data)
+		} else if len(data) != avro.size {
+			return fmt.Errorf("Expected %d bytes for Avro fixed %s, got %d", avro.size, avro.name, len(data))
+		} else {
+			writer.Write(data)
+		}
+
+	case "string":
+		text, isString := value.(string)
+		if !isString {
+			return fmt.Errorf("Expected string, got %T", value)
+		}
+		writer.writeBytes([]byte(text))
+
+	case "enum":
+		symbol, _ := value.(string)
+		for idx, name := range avro.symbols {
+			if name == symbol {
+				writer.writeLong(int64(idx))
+				return nil // ### return, symbol found ###
+			}
+		}
+		return fmt.Errorf("Unknown symbol %v for Avro enum %s", value, avro.name)
+
+	case "union":
+		idx, branchValue := avro.selectBranch(value)
+		if idx < 0 {
+			return fmt.Errorf("No union branch matches %T", value)
+		}
+		writer.writeLong(int64(idx))
+		return writer.encode(avro.branches[idx], branchValue)
+
+	case "record":
+		record, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("Expected object for Avro record %s, got %T", avro.name, value)
+		}
+		for _, field := range avro.fields {
+			fieldValue, exists := record[field.name]
+			if !exists && field.hasDefault {
+				fieldValue = field.defaultValue
+			}
+			if err := writer.encode(field.fieldType, fieldValue); err != nil {
+				return fmt.Errorf("%s.%s: %s", avro.name, field.name, err.Error())
+			}
+		}
+
+	case "array":
+		items, isArray := value.([]interface{})
+		if !isArray {
+			return fmt.Errorf("Expected array, got %T", value)
+		}
+		if len(items) > 0 {
+			writer.writeLong(int64(len(items)))
+			for _, item := range items {
+				if err := writer.encode(avro.items, item); err != nil {
+					return err
+				}
+			}
+		}
+		writer.writeLong(0)
+
+	case "map":
+		values, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("Expected object, got %T", value)
+		}
+		if len(values) > 0 {
+			writer.writeLong(int64(len(values)))
+			for key, item := range values {
+				writer.writeBytes([]byte(key))
+				if err := writer.encode(avro.items, item); err != nil {
+					return err
+				}
+			}
+		}
+		writer.writeLong(0)
+
+	default:
+		return fmt.Errorf("Unsupported Avro type %s", avro.kind)
+	}
+	return nil
+}
+
+// selectBranch returns the index of the union branch used to encode the given
+// value and the value to encode with that branch. -1 is returned if no branch
+// matches.
+func (avro *avroType) selectBranch(value interface{}) (int, interface{}) {
+	if wrapped, isObject := value.(map[string]interface{}); isObject && len(wrapped) == 1 {
+		for idx, branch := range avro.branches {
+			if branchValue, exists := wrapped[branch.typeName()]; exists {
+				return idx, branchValue // ### return, Avro JSON encoding ###
+			}
+		}
+	}
+
+	for idx, branch := range avro.branches {
+		if branch.accepts(value) {
+			return idx, value
+		}
+	}
+	return -1, value
+}
+
+// accepts returns true if the given value can be encoded by this type without
+// checking nested values.
+func (avro *avroType) accepts(value interface{}) bool {
+	switch typedValue := value.(type) {
+	case nil:
+		return avro.kind == "null"
+	case bool:
+		return avro.kind == "boolean"
+	case json.Number:
+		switch avro.kind {
+		case "int":
+			_, err := protobufParseInt(typedValue, 32)
+			return err == nil
+		case "long":
+			_, err := protobufParseInt(typedValue, 64)
+			return err == nil
+		case "float", "double":
+			return true
+		}
+	case string:
+		switch avro.kind {
+		case "string", "bytes", "fixed":
+			return true
+		case "enum":
+			for _, symbol := range avro.symbols {
+				if symbol == typedValue {
+					return true
+				}
+			}
+		}
+	case []interface{}:
+		return avro.kind == "array"
+	case map[string]interface{}:
+		return avro.kind == "record" || avro.kind == "map"
+	}
+	return false
+}
+
+// avroSchemaEntry is a cached schema. Concurrent requests for the same schema
+// wait until ready is closed.
+type avroSchemaEntry struct {
+	id      int
+	schema  *avroType
+	err     error
+	expires time.Time
+	ready   chan struct{}
+}
+
+// avroRegistry requests and caches schemas from a Confluent-compatible schema
+// registry. Schemas requested by id never change and are cached forever,
+// schemas requested by subject are cached for cacheTTL.
+type avroRegistry struct {
+	client    *http.Client
+	url       string
+	username  string
+	password  string
+	cacheTTL  time.Duration
+	guard     *sync.Mutex
+	byID      map[string]*avroSchemaEntry
+	bySubject map[string]*avroSchemaEntry
+}
+
+type avroRegistryResponse struct {
+	ID         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+}
+
+func newAvroRegistry(registryURL string, username string, password string, cacheTTL time.Duration, timeout time.Duration) *avroRegistry {
+	return &avroRegistry{
+		client:    &http.Client{Timeout: timeout},
+		url:       strings.TrimRight(registryURL, "/"),
+		username:  username,
+		password:  password,
+		cacheTTL:  cacheTTL,
+		guard:     new(sync.Mutex),
+		byID:      make(map[string]*avroSchemaEntry),
+		bySubject: make(map[string]*avroSchemaEntry),
+	}
+}
+
+// request requests the schema stored at the given path of the registry.
+func (registry *avroRegistry) request(path string) (int, *avroType, error) {
+	req, err := http.NewRequest("GET", registry.url+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", avroContentType)
+	if registry.username != "" {
+		req.SetBasicAuth(registry.username, registry.password)
+	}
+
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, nil, fmt.Errorf("Requesting schema %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	response := avroRegistryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, nil, err
+	}
+	if response.SchemaType != "" && response.SchemaType != "AVRO" {
+		return 0, nil, fmt.Errorf("Schema %s is of type %s", path, response.SchemaType)
+	}
+
+	schema, err := parseAvroSchema(response.Schema)
+	return response.ID, schema, err
+}
+
+// get returns the cached entry for the given key or requests it. Failed
+// requests are retried after avroErrorTTL at the earliest.
+func (registry *avroRegistry) get(cache map[string]*avroSchemaEntry, key string, ttl time.Duration, request func() (int, *avroType, error)) *avroSchemaEntry {
+	registry.guard.Lock()
+	entry, cached := cache[key]
+	if cached && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		registry.guard.Unlock()
+		<-entry.ready
+		return entry // ### return, cached ###
+	}
+
+	entry = &avroSchemaEntry{ready: make(chan struct{})}
+	cache[key] = entry
+	registry.guard.Unlock()
+
+	id, schema, err := request()
+
+	registry.guard.Lock()
+	entry.id, entry.schema, entry.err = id, schema, err
+	switch {
+	case err != nil:
+		entry.expires = time.Now().Add(avroErrorTTL)
+	case ttl > 0:
+		entry.expires = time.Now().Add(ttl)
+	}
+	registry.guard.Unlock()
+
+	close(entry.ready)
+	return entry
+}
+
+// getByID returns the schema with the given id.
+func (registry *avroRegistry) getByID(id int) (*avroType, error) {
+	entry := registry.get(registry.byID, strconv.Itoa(id), 0, func() (int, *avroType, error) {
+		_, schema, err := registry.request(fmt.Sprintf("/schemas/ids/%d", id))
+		return id, schema, err
+	})
+	return entry.schema, entry.err
+}
+
+// getBySubject returns the id and the schema of the latest version of the
+// given subject.
+func (registry *avroRegistry) getBySubject(subject string) (int, *avroType, error) {
+	entry := registry.get(registry.bySubject, subject, registry.cacheTTL, func() (int, *avroType, error) {
+		return registry.request(fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject)))
+	})
+	return entry.id, entry.schema, entry.err
+}
+
+// avroConfig contains the settings shared by the Avro formatters.
+type avroConfig struct {
+	registry *avroRegistry
+	schema   *avroType
+}
+
+// configureAvro reads the schema registry or local schema configured for the
+// Avro formatters.
+func configureAvro(conf core.PluginConfig) (avroConfig, error) {
+	config := avroConfig{}
+
+	if registryURL := conf.GetString("AvroSchemaRegistry", ""); registryURL != "" {
+		config.registry = newAvroRegistry(registryURL,
+			conf.GetString("AvroRegistryUser", ""),
+			conf.GetString("AvroRegistryPassword", ""),
+			time.Duration(conf.GetInt("AvroCacheTTLSec", 300))*time.Second,
+			time.Duration(conf.GetInt("AvroTimeoutMs", 2000))*time.Millisecond)
+	}
+
+	if schemaFile := conf.GetString("AvroSchemaFile", ""); schemaFile != "" {
+		schema, err := ioutil.ReadFile(schemaFile)
+		if err != nil {
+			return config, err
+		}
+		if config.schema, err = parseAvroSchema(string(schema)); err != nil {
+			return config, fmt.Errorf("%s: %s", schemaFile, err.Error())
+		}
+	}
+	return config, nil
+}
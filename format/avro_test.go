@@ -0,0 +1,123 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Event", "namespace": "test",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "count", "type": "long"},
+		{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"]}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "labels", "type": {"type": "map", "values": "int"}},
+		{"name": "raw", "type": "bytes"},
+		{"name": "score", "type": ["null", "double"], "default": null},
+		{"name": "next", "type": ["null", "Event"], "default": null}
+	]
+}`
+
+func TestAvroEncodeDecode(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	schemaFile, err := ioutil.TempFile("", "gollum_avro")
+	expect.NoError(err)
+	schemaFile.WriteString(testAvroSchema)
+	schemaFile.Close()
+	defer os.Remove(schemaFile.Name())
+
+	conf := core.NewPluginConfig("format.AvroEncode")
+	conf.Settings["AvroSchemaFile"] = schemaFile.Name()
+
+	encoder := AvroEncode{}
+	expect.NoError(encoder.Configure(conf))
+	decoder := AvroDecode{}
+	expect.NoError(decoder.Configure(conf))
+
+	testString := `{"name":"a","count":-2,"kind":"B","tags":["x"],"labels":{"l":1},"raw":"AAE=",` +
+		`"next":{"name":"b","count":1,"kind":"A","tags":[],"labels":{},"raw":"","score":{"double":1.5}}}`
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	encoded, _ := encoder.Format(msg)
+	expect.Equal("\x02a\x03\x02\x02\x02x\x00\x02\x02l\x02\x00\x04\x00\x01\x00\x02\x02b", string(encoded[:20]))
+
+	msg.Data = encoded
+	decoded, _ := decoder.Format(msg)
+	expect.Equal(`{"count":-2,"kind":"B","labels":{"l":1},"name":"a","next":{"count":1,"kind":"A","labels":{},`+
+		`"name":"b","next":null,"raw":"","score":1.5,"tags":[]},"raw":"AAE=","score":null,"tags":["x"]}`, string(decoded))
+
+	// Invalid values are passed as-is
+	msg.Data = []byte(`{"name":"a","count":"x"}`)
+	encoded, _ = encoder.Format(msg)
+	expect.Equal(`{"name":"a","count":"x"}`, string(encoded))
+}
+
+func TestAvroSchemaRegistry(t *testing.T) {
+	expect := shared.NewExpect(t)
+	requests := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		schema := strings.Replace(`{"type":"record","name":"R","fields":[{"name":"v","type":"int"}]}`, `"`, `\"`, -1)
+		switch req.URL.Path {
+		case "/subjects/console-value/versions/latest":
+			fmt.Fprintf(resp, `{"subject":"console-value","version":1,"id":7,"schema":"%s"}`, schema)
+		case "/schemas/ids/7":
+			fmt.Fprintf(resp, `{"schema":"%s"}`, schema)
+		default:
+			http.NotFound(resp, req)
+		}
+	}))
+	defer server.Close()
+
+	conf := core.NewPluginConfig("format.AvroEncode")
+	conf.Settings["AvroSchemaRegistry"] = server.URL
+	conf.Settings["AvroSubject"] = "console-value"
+
+	encoder := AvroEncode{}
+	expect.NoError(encoder.Configure(conf))
+	decoder := AvroDecode{}
+	expect.NoError(decoder.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"v":3}`), 0)
+	encoded, _ := encoder.Format(msg)
+	expect.Equal("\x00\x00\x00\x00\x07\x06", string(encoded))
+
+	msg.Data = encoded
+	decoded, _ := decoder.Format(msg)
+	expect.Equal(`{"v":3}`, string(decoded))
+
+	// Schemas are cached
+	encoder.Format(core.NewMessage(nil, []byte(`{"v":4}`), 0))
+	decoder.Format(msg)
+	expect.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	// Unknown schema ids are passed as-is
+	msg.Data = []byte("\x00\x00\x00\x00\x08\x06")
+	decoded, _ = decoder.Format(msg)
+	expect.Equal("\x00\x00\x00\x00\x08\x06", string(decoded))
+}
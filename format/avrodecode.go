@@ -0,0 +1,124 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// AvroDecode is a formatter that converts an Avro encoded message into JSON.
+// Schemas are requested from a Confluent-compatible schema registry by the id
+// stored in the message or read from a local file. If a message cannot be
+// decoded an error will be logged and the message is passed as-is.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.AvroDecode"
+//     AvroDecodeFormatter: "format.Forward"
+//     AvroSchemaRegistry: "http://localhost:8081"
+//     AvroRegistryUser: ""
+//     AvroRegistryPassword: ""
+//     AvroTimeoutMs: 2000
+//     AvroSchemaFile: ""
+//
+// AvroSchemaRegistry defines the URL of the schema registry. Messages are
+// expected in the registry's wire format, i.e. a zero byte followed by the
+// schema id as 32 bit big endian integer and the Avro data. Schemas are
+// cached forever as they cannot change for a given id.
+// By default this is set to "".
+//
+// AvroRegistryUser and AvroRegistryPassword define the credentials used for
+// basic authentication at the schema registry. By default both are set to "".
+//
+// AvroTimeoutMs defines the maximum number of milliseconds to wait for the
+// schema registry. Failed requests are retried after 10 seconds at the
+// earliest. By default this is set to 2000.
+//
+// AvroSchemaFile defines a file containing the schema used to decode messages
+// without the wire format header, e.g. if no schema registry is used.
+// By default this is set to "".
+//
+// Values are converted to JSON without type information, i.e. unions are
+// written as their plain value, bytes and fixed are base64 encoded and enums
+// are written by name. Logical types are written as their underlying type.
+//
+// AvroDecodeFormatter defines the formatter applied before the message is
+// decoded. By default this is set to "format.Forward"
+type AvroDecode struct {
+	base   core.Formatter
+	config avroConfig
+}
+
+func init() {
+	shared.RuntimeType.Register(AvroDecode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *AvroDecode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("AvroDecodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.config, err = configureAvro(conf)
+	return err
+}
+
+// getSchema returns the schema used to decode the given data and the data
+// following the wire format header.
+func (format *AvroDecode) getSchema(data []byte) (*avroType, []byte, error) {
+	if format.config.registry != nil && len(data) >= avroHeaderSize && data[0] == avroMagicByte {
+		id := int(binary.BigEndian.Uint32(data[1:avroHeaderSize]))
+		schema, err := format.config.registry.getByID(id)
+		return schema, data[avroHeaderSize:], err
+	}
+	if format.config.schema != nil {
+		return format.config.schema, data, nil // ### return, local schema ###
+	}
+	if format.config.registry != nil {
+		return nil, data, fmt.Errorf("Message without schema registry header")
+	}
+	return nil, data, fmt.Errorf("No schema registry or schema file configured")
+}
+
+// Format returns the Avro message as JSON
+func (format *AvroDecode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	schema, data, err := format.getSchema(basePayload)
+	if err != nil {
+		Log.Error.Print("AvroDecode: ", err)
+		return basePayload, stream // ### return, no schema ###
+	}
+
+	decoded, err := decodeAvro(schema, data)
+	if err != nil {
+		Log.Error.Print("AvroDecode: ", err)
+		return basePayload, stream // ### return, invalid message ###
+	}
+
+	payload, err := json.Marshal(decoded)
+	if err != nil {
+		Log.Error.Print("AvroDecode: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
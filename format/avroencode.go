@@ -0,0 +1,156 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"time"
+)
+
+// AvroEncode is a formatter that converts a JSON message into Avro. This is
+// the counterpart to format.AvroDecode. Schemas are requested from a
+// Confluent-compatible schema registry or read from a local file. If a
+// message cannot be encoded an error will be logged and the message is passed
+// as-is.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.AvroEncode"
+//     AvroEncodeFormatter: "format.Forward"
+//     AvroSchemaRegistry: "http://localhost:8081"
+//     AvroRegistryUser: ""
+//     AvroRegistryPassword: ""
+//     AvroSubject: "${stream}-value"
+//     AvroCacheTTLSec: 300
+//     AvroTimeoutMs: 2000
+//     AvroSchemaFile: ""
+//     AvroSchemaID: 0
+//
+// AvroSchemaRegistry defines the URL of the schema registry. Messages are
+// encoded by using the latest schema of the subject given by AvroSubject and
+// written in the registry's wire format, i.e. a zero byte followed by the
+// schema id as 32 bit big endian integer and the Avro data.
+// By default this is set to "".
+//
+// AvroRegistryUser and AvroRegistryPassword define the credentials used for
+// basic authentication at the schema registry. By default both are set to "".
+//
+// AvroSubject defines a template for the subject to request the schema for.
+// Templates support the placeholders ${stream}, ${hostname}, ${timestamp},
+// ${sequence} and ${meta:<key>}. The default matches the subject used for
+// message values of a Kafka topic named like the stream.
+// By default this is set to "${stream}-value".
+//
+// AvroCacheTTLSec defines the number of seconds the latest schema of a subject
+// is cached. New schema versions are used after this time.
+// By default this is set to 300.
+//
+// AvroTimeoutMs defines the maximum number of milliseconds to wait for the
+// schema registry. Failed requests are retried after 10 seconds at the
+// earliest. By default this is set to 2000.
+//
+// AvroSchemaFile defines a file containing the schema used to encode messages
+// if no schema registry is used. By default this is set to "".
+//
+// AvroSchemaID defines the schema id written in the wire format header when
+// encoding with AvroSchemaFile. By default this is set to 0, i.e. no header
+// is written.
+//
+// Values are expected as written by format.AvroDecode, i.e. unions are given
+// by their plain value and the first matching branch is used, bytes and fixed
+// are base64 encoded and enums are given by name. Unions may also be given in
+// the Avro JSON encoding, i.e. as an object with the type name as its only
+// key. Missing fields are set to their default value.
+//
+// AvroEncodeFormatter defines the formatter applied before the message is
+// encoded. By default this is set to "format.Forward"
+type AvroEncode struct {
+	base     core.Formatter
+	config   avroConfig
+	subject  core.MessageTemplate
+	schemaID int
+}
+
+func init() {
+	shared.RuntimeType.Register(AvroEncode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *AvroEncode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("AvroEncodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.subject = core.NewMessageTemplate(conf.GetString("AvroSubject", "${stream}-value"), time.RFC3339)
+	format.schemaID = conf.GetInt("AvroSchemaID", 0)
+
+	format.config, err = configureAvro(conf)
+	return err
+}
+
+// getSchema returns the schema used to encode the given message and the id
+// written in the wire format header. An id of 0 means no header is written.
+func (format *AvroEncode) getSchema(msg core.Message, stream core.MessageStreamID) (int, *avroType, error) {
+	if format.config.registry != nil {
+		return format.config.registry.getBySubject(format.subject.String(msg, stream))
+	}
+	if format.config.schema != nil {
+		return format.schemaID, format.config.schema, nil
+	}
+	return 0, nil, fmt.Errorf("No schema registry or schema file configured")
+}
+
+// Format returns the JSON message as Avro
+func (format *AvroEncode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	id, schema, err := format.getSchema(msg, stream)
+	if err != nil {
+		Log.Error.Print("AvroEncode: ", err)
+		return basePayload, stream // ### return, no schema ###
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(basePayload))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		Log.Error.Print("AvroEncode: ", err)
+		return basePayload, stream // ### return, not JSON ###
+	}
+
+	encoded, err := encodeAvro(schema, value)
+	if err != nil {
+		Log.Error.Print("AvroEncode: ", err)
+		return basePayload, stream // ### return, invalid message ###
+	}
+
+	if id == 0 {
+		return encoded, stream // ### return, no header ###
+	}
+
+	payload := make([]byte, avroHeaderSize, avroHeaderSize+len(encoded))
+	payload[0] = avroMagicByte
+	binary.BigEndian.PutUint32(payload[1:], uint32(id))
+	return append(payload, encoded...), stream
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CanonicalJSON is a formatter that rewrites a JSON message into a canonical
+// form. Keys are sorted, insignificant whitespace is removed and numbers are
+// normalized so that equal documents result in equal byte sequences.
+// Messages that are not valid JSON are passed as-is and an error is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.CanonicalJSON"
+//     CanonicalJSONFormatter: "format.Forward"
+//
+// Integer numbers that fit into 64 bits are written without fraction or
+// exponent. All other numbers are written in their shortest float64
+// representation, using exponent notation for values smaller than 1e-6 or
+// larger than 1e21 (as in RFC 8785). Strings are only escaped where required
+// by RFC 7159.
+//
+// CanonicalJSONFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+type CanonicalJSON struct {
+	base core.Formatter
+}
+
+func init() {
+	shared.RuntimeType.Register(CanonicalJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CanonicalJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CanonicalJSONFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	return nil
+}
+
+// Format returns the message payload as canonical JSON
+func (format *CanonicalJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	decoder := json.NewDecoder(bytes.NewReader(basePayload))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		Log.Error.Print("CanonicalJSON: ", err)
+		return basePayload, stream // ### return, not JSON ###
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		Log.Error.Print("CanonicalJSON: Trailing data after JSON value")
+		return basePayload, stream // ### return, not a single value ###
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(basePayload)))
+	if err := writeCanonicalJSON(buffer, value); err != nil {
+		Log.Error.Print("CanonicalJSON: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+
+	return buffer.Bytes(), stream
+}
+
+func writeCanonicalJSON(buffer *bytes.Buffer, value interface{}) error {
+	switch typedValue := value.(type) {
+	case nil:
+		buffer.WriteString("null")
+
+	case bool:
+		buffer.WriteString(strconv.FormatBool(typedValue))
+
+	case string:
+		writeCanonicalJSONString(buffer, typedValue)
+
+	case json.Number:
+		number, err := canonicalJSONNumber(typedValue)
+		if err != nil {
+			return err
+		}
+		buffer.WriteString(number)
+
+	case []interface{}:
+		buffer.WriteByte('[')
+		for i, item := range typedValue {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typedValue))
+		for key := range typedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			writeCanonicalJSONString(buffer, key)
+			buffer.WriteByte(':')
+			if err := writeCanonicalJSON(buffer, typedValue[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+
+	default:
+		return fmt.Errorf("Unexpected type %T", value)
+	}
+	return nil
+}
+
+func canonicalJSONNumber(number json.Number) (string, error) {
+	if intValue, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		return strconv.FormatInt(intValue, 10), nil // ### return, integer ###
+	}
+
+	floatValue, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return "", err
+	}
+	if math.IsInf(floatValue, 0) {
+		return "", fmt.Errorf("Number %s is out of range", number)
+	}
+	if floatValue == 0 {
+		return "0", nil // ### return, also catches -0 ###
+	}
+
+	absValue := math.Abs(floatValue)
+	if absValue >= 1e-6 && absValue < 1e21 {
+		return strconv.FormatFloat(floatValue, 'f', -1, 64), nil // ### return, decimal ###
+	}
+
+	// Go pads the exponent to two digits, RFC 8785 does not
+	formatted := strconv.FormatFloat(floatValue, 'e', -1, 64)
+	expIdx := strings.IndexByte(formatted, 'e')
+	exponent := strings.TrimLeft(formatted[expIdx+2:], "0")
+	return formatted[:expIdx+2] + exponent, nil
+}
+
+func writeCanonicalJSONString(buffer *bytes.Buffer, value string) {
+	const hex = "0123456789abcdef"
+	buffer.WriteByte('"')
+
+	for i := 0; i < len(value); {
+		char, size := utf8.DecodeRuneInString(value[i:])
+		switch {
+		case char == '"':
+			buffer.WriteString(`\"`)
+		case char == '\\':
+			buffer.WriteString(`\\`)
+		case char == '\b':
+			buffer.WriteString(`\b`)
+		case char == '\f':
+			buffer.WriteString(`\f`)
+		case char == '\n':
+			buffer.WriteString(`\n`)
+		case char == '\r':
+			buffer.WriteString(`\r`)
+		case char == '\t':
+			buffer.WriteString(`\t`)
+		case char < 0x20:
+			buffer.WriteString(`\u00`)
+			buffer.WriteByte(hex[char>>4])
+			buffer.WriteByte(hex[char&0xF])
+		default:
+			buffer.WriteString(value[i : i+size])
+		}
+		i += size
+	}
+
+	buffer.WriteByte('"')
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+	format := CanonicalJSON{}
+	conf := core.NewPluginConfig("format.CanonicalJSON")
+	expect.NoError(format.Configure(conf))
+
+	testString := `{ "b": [1.0, 2.50, -0, 1E3, 1e-7, 12345678901234567890],
+		"a": {"z": "<&>ä\u0001", "y": null, "x": true} }`
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	result, _ := format.Format(msg)
+	expect.Equal(`{"a":{"x":true,"y":null,"z":"<&>ä\u0001"},"b":[1,2.5,0,1000,1e-7,12345678901234567000]}`, string(result))
+
+	// Invalid JSON is passed as-is
+	msg = core.NewMessage(nil, []byte(`{"a":1} {"b":2}`), 0)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"a":1} {"b":2}`, string(result))
+}
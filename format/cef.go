@@ -0,0 +1,274 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CEF is a formatter that converts a JSON object into an ArcSight Common Event
+// Format (CEF) message. Messages that are not valid JSON objects are treated
+// like an object storing the message in the key "message".
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.CEF"
+//     CEFFormatter: "format.Forward"
+//     CEFVendor: "trivago"
+//     CEFProduct: "gollum"
+//     CEFProductVersion: ""
+//     CEFSignatureIDField: "signature_id"
+//     CEFNameField: "name"
+//     CEFSeverityField: "severity"
+//     CEFSeverityDefault: 5
+//     CEFFields:
+//       "src": "client/ip"
+//       "msg": "message"
+//
+// Pipes and backslashes in header fields are escaped, line breaks are replaced
+// by spaces. Backslashes, equal signs and line breaks in extension values are
+// escaped. Nested objects and arrays are written as JSON.
+//
+// CEFFormatter defines the formatter applied before the message is converted.
+// By default this is set to "format.Forward"
+//
+// CEFVendor, CEFProduct and CEFProductVersion define the device fields of the
+// header. By default these are set to "trivago", "gollum" and "".
+//
+// CEFSignatureIDField and CEFNameField define the fields storing the device
+// event class id and the name of the event. Missing values are written as
+// "unknown". By default these are set to "signature_id" and "name".
+//
+// CEFSeverityField defines the field storing the severity of the event. Valid
+// values are 0 to 10 as well as "Low", "Medium", "High" and "Very-High".
+// By default this is set to "severity".
+//
+// CEFSeverityDefault defines the severity used if the severity field is not
+// set or invalid. By default this is set to 5.
+//
+// CEFFields maps extension keys to fields of the message. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path. Missing fields are
+// not written. If no fields are set all fields not used in the header are
+// written by using their name as key. By default no fields are set.
+type CEF struct {
+	base            core.Formatter
+	vendor          string
+	product         string
+	productVersion  string
+	signatureField  string
+	nameField       string
+	severityField   string
+	severityDefault int
+	fields          map[string]string
+}
+
+// siemField is a key value pair of a CEF extension or LEEF attribute.
+type siemField struct {
+	key   string
+	value string
+}
+
+func init() {
+	shared.RuntimeType.Register(CEF{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CEF) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CEFFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.vendor = conf.GetString("CEFVendor", "trivago")
+	format.product = conf.GetString("CEFProduct", "gollum")
+	format.productVersion = conf.GetString("CEFProductVersion", "")
+	format.signatureField = conf.GetString("CEFSignatureIDField", "signature_id")
+	format.nameField = conf.GetString("CEFNameField", "name")
+	format.severityField = conf.GetString("CEFSeverityField", "severity")
+	format.severityDefault = conf.GetInt("CEFSeverityDefault", 5)
+	format.fields = conf.GetStringMap("CEFFields", map[string]string{})
+
+	if format.severityDefault < 0 || format.severityDefault > 10 {
+		return fmt.Errorf("CEFSeverityDefault must be between 0 and 10")
+	}
+	return nil
+}
+
+// decodeSIEMObject decodes a JSON object. Other messages are stored in the
+// key "message" of the returned object.
+func decodeSIEMObject(payload []byte) shared.MarshalMap {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	values := shared.NewMarshalMap()
+	if err := decoder.Decode(&values); err != nil {
+		return shared.MarshalMap{"message": string(payload)}
+	}
+	return values
+}
+
+// siemString converts a decoded JSON value into a string. Objects and arrays
+// are converted to JSON.
+func siemString(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		if encoded, err := json.Marshal(value); err == nil {
+			return string(encoded)
+		}
+	}
+	return syslogJSONString(value)
+}
+
+// siemHeaderValue returns a value used in the header or the given default if
+// the value is not set.
+func siemHeaderValue(values shared.MarshalMap, path string, defaultValue string) string {
+	if value, found := values.Path(path); found {
+		if text := siemString(value); text != "" {
+			return text
+		}
+	}
+	return defaultValue
+}
+
+// siemKey removes all characters not allowed in CEF extension keys and LEEF
+// attribute names.
+func siemKey(key string) string {
+	return strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9', char == '_', char == '.':
+			return char
+		default:
+			return -1
+		}
+	}, key)
+}
+
+// siemFields returns the fields of an event sorted by key. If no mapping is
+// given all top level fields except the excluded ones are returned.
+func siemFields(values shared.MarshalMap, mapping map[string]string, exclude ...string) []siemField {
+	fields := []siemField{}
+	if len(mapping) > 0 {
+		for key, path := range mapping {
+			if value, found := values.Path(path); found && value != nil {
+				fields = append(fields, siemField{siemKey(key), siemString(value)})
+			}
+		}
+	} else {
+		excluded := make(map[string]bool, len(exclude))
+		for _, key := range exclude {
+			excluded[key] = true
+		}
+		for key, value := range values {
+			if !excluded[key] && value != nil {
+				fields = append(fields, siemField{siemKey(key), siemString(value)})
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	return fields
+}
+
+// writeCEFHeaderValue writes a header field with pipes and backslashes
+// escaped and line breaks replaced.
+func writeCEFHeaderValue(buffer *bytes.Buffer, value string) {
+	for i := 0; i < len(value); i++ {
+		switch char := value[i]; char {
+		case '|', '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(char)
+		case '\r', '\n':
+			buffer.WriteByte(' ')
+		default:
+			buffer.WriteByte(char)
+		}
+	}
+	buffer.WriteByte('|')
+}
+
+// writeSIEMValue writes an extension or attribute value. Backslashes, line
+// breaks and the given special character are escaped.
+func writeSIEMValue(buffer *bytes.Buffer, value string, special byte) {
+	for i := 0; i < len(value); i++ {
+		switch char := value[i]; char {
+		case '\\', special:
+			buffer.WriteByte('\\')
+			buffer.WriteByte(char)
+		case '\r':
+			buffer.WriteString("\\r")
+		case '\n':
+			buffer.WriteString("\\n")
+		default:
+			buffer.WriteByte(char)
+		}
+	}
+}
+
+func (format *CEF) getSeverity(values shared.MarshalMap) string {
+	value, found := values.Path(format.severityField)
+	if !found {
+		return strconv.Itoa(format.severityDefault) // ### return, not set ###
+	}
+
+	severity := siemString(value)
+	if number, err := strconv.Atoi(severity); err == nil && number >= 0 && number <= 10 {
+		return severity // ### return, numeric severity ###
+	}
+	switch strings.ToLower(severity) {
+	case "low":
+		return "Low"
+	case "medium":
+		return "Medium"
+	case "high":
+		return "High"
+	case "very-high":
+		return "Very-High"
+	}
+	return strconv.Itoa(format.severityDefault)
+}
+
+// Format returns the JSON object as CEF message
+func (format *CEF) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	values := decodeSIEMObject(basePayload)
+
+	buffer := bytes.Buffer{}
+	buffer.WriteString("CEF:0|")
+	writeCEFHeaderValue(&buffer, format.vendor)
+	writeCEFHeaderValue(&buffer, format.product)
+	writeCEFHeaderValue(&buffer, format.productVersion)
+	writeCEFHeaderValue(&buffer, siemHeaderValue(values, format.signatureField, "unknown"))
+	writeCEFHeaderValue(&buffer, siemHeaderValue(values, format.nameField, "unknown"))
+	writeCEFHeaderValue(&buffer, format.getSeverity(values))
+
+	for i, field := range siemFields(values, format.fields, format.signatureField, format.nameField, format.severityField) {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(field.key)
+		buffer.WriteByte('=')
+		writeSIEMValue(&buffer, field.value, '=')
+	}
+
+	return buffer.Bytes(), stream
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestCEFFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.CEF")
+	conf.Settings["CEFProductVersion"] = "1.0"
+
+	formatter := CEF{}
+	expect.NoError(formatter.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"signature_id":"100","name":"a|b\\c","severity":"high",`+
+		`"message":"x=1\nnext","client":{"ip":"10.0.0.1"},"empty":null}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal(`CEF:0|trivago|gollum|1.0|100|a\|b\\c|High|client={"ip":"10.0.0.1"} message=x\=1\nnext`, string(result))
+
+	// Mapped fields and invalid severities
+	conf.Settings["CEFFields"] = map[string]string{"src": "client/ip", "msg": "message", "missing": "nothing"}
+	expect.NoError(formatter.Configure(conf))
+
+	msg.Data = []byte(`{"severity":11,"message":"text","client":{"ip":"10.0.0.1"}}`)
+	result, _ = formatter.Format(msg)
+	expect.Equal(`CEF:0|trivago|gollum|1.0|unknown|unknown|5|msg=text src=10.0.0.1`, string(result))
+
+	// Messages that are not JSON
+	msg.Data = []byte("plain text")
+	result, _ = formatter.Format(msg)
+	expect.Equal(`CEF:0|trivago|gollum|1.0|unknown|unknown|5|msg=plain text`, string(result))
+}
+
+func TestLEEFFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.LEEF")
+
+	formatter := LEEF{}
+	expect.NoError(formatter.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"event_id":"login","src":"10.0.0.1","usrName":"tab\there","cnt":3}`), 0)
+	result, _ := formatter.Format(msg)
+	expect.Equal("LEEF:2.0|trivago|gollum||login|x09|cnt=3\tsrc=10.0.0.1\tusrName=tab\\\there", string(result))
+
+	conf.Settings["LEEFDelimiter"] = "^"
+	conf.Settings["LEEFFields"] = map[string]string{"src": "src"}
+	expect.NoError(formatter.Configure(conf))
+
+	result, _ = formatter.Format(msg)
+	expect.Equal("LEEF:2.0|trivago|gollum||login|^|src=10.0.0.1", string(result))
+
+	// LEEF 1.0 supports tabs only
+	conf.Settings["LEEFFormatVersion"] = "1.0"
+	expect.NotNil(formatter.Configure(conf))
+
+	conf.Settings["LEEFDelimiter"] = "\\t"
+	expect.NoError(formatter.Configure(conf))
+
+	result, _ = formatter.Format(msg)
+	expect.Equal("LEEF:1.0|trivago|gollum||login|src=10.0.0.1", string(result))
+}
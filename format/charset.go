@@ -0,0 +1,324 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Charset is a formatter that converts messages from a given encoding to
+// UTF-8. Invalid byte sequences are replaced or removed, so that messages can
+// be safely passed to e.g. JSON based producers.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Charset"
+//     CharsetFormatter: "format.Forward"
+//     CharsetSource: "utf-8"
+//     CharsetInvalid: "replace"
+//     CharsetReplacement: "�"
+//     CharsetInvalidStream: ""
+//
+// CharsetFormatter defines the formatter applied before converting the
+// message. By default this is set to "format.Forward".
+//
+// CharsetSource defines the encoding of incoming messages. Valid values are
+// "utf-8", "latin-1" (ISO-8859-1), "windows-1252", "utf-16", "utf-16le",
+// "utf-16be" and "shift-jis". Messages encoded as "utf-16" may start with a
+// byte order mark. Messages without a byte order mark are read as big endian.
+// When set to "utf-8" messages are validated only. By default this is set to
+// "utf-8".
+//
+// CharsetInvalid defines how invalid byte sequences are handled. When set to
+// "replace" invalid sequences are replaced by CharsetReplacement. When set to
+// "drop" invalid sequences are removed. By default this is set to "replace".
+//
+// CharsetReplacement defines the string used to replace invalid sequences.
+// By default this is set to "�", the unicode replacement character.
+//
+// CharsetInvalidStream defines a stream messages containing invalid sequences
+// are sent to after they have been converted. By default this is set to "",
+// i.e. the stream of these messages is not changed.
+type Charset struct {
+	base        core.Formatter
+	decode      func(data []byte, out *charsetBuffer) []byte
+	replacement []byte
+	invalid     core.MessageStreamID
+	reroute     bool
+}
+
+// charsetBuffer collects the converted message and tracks invalid sequences.
+type charsetBuffer struct {
+	data        []byte
+	replacement []byte
+	hasInvalid  bool
+}
+
+// windows1252Table maps the bytes 0x80-0x9F of windows-1252 to unicode code
+// points. Undefined bytes are 0. All other bytes map to the same code point as
+// in latin-1.
+var windows1252Table = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0,
+}
+
+func init() {
+	shared.RuntimeType.Register(Charset{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Charset) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("CharsetFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	switch source := strings.ToLower(conf.GetString("CharsetSource", "utf-8")); source {
+	case "utf-8", "utf8":
+		format.decode = decodeCharsetUTF8
+	case "latin-1", "latin1", "iso-8859-1":
+		format.decode = decodeCharsetLatin1
+	case "windows-1252", "cp1252":
+		format.decode = decodeCharsetWindows1252
+	case "utf-16", "utf16":
+		format.decode = decodeCharsetUTF16
+	case "utf-16le", "utf16le":
+		format.decode = decodeCharsetUTF16LE
+	case "utf-16be", "utf16be":
+		format.decode = decodeCharsetUTF16BE
+	case "shift-jis", "shift_jis", "sjis":
+		format.decode = decodeCharsetShiftJIS
+	default:
+		return fmt.Errorf("Charset: Unknown source encoding \"%s\"", source)
+	}
+
+	switch invalid := strings.ToLower(conf.GetString("CharsetInvalid", "replace")); invalid {
+	case "replace":
+		format.replacement = []byte(shared.Unescape(conf.GetString("CharsetReplacement", "�")))
+	case "drop":
+		format.replacement = []byte{}
+	default:
+		return fmt.Errorf("Charset: Unknown invalid sequence handling \"%s\"", invalid)
+	}
+
+	if stream := conf.GetString("CharsetInvalidStream", ""); stream != "" {
+		format.invalid = core.GetStreamID(stream)
+		format.reroute = true
+	}
+	return nil
+}
+
+// reset prepares the buffer for converting a message of the given size.
+func (out *charsetBuffer) reset(size int) {
+	out.data = make([]byte, 0, size)
+}
+
+// writeRune appends a valid code point to the buffer.
+func (out *charsetBuffer) writeRune(char rune) {
+	if char < utf8.RuneSelf {
+		out.data = append(out.data, byte(char))
+		return // ### return, ASCII ###
+	}
+	var encoded [utf8.UTFMax]byte
+	size := utf8.EncodeRune(encoded[:], char)
+	out.data = append(out.data, encoded[:size]...)
+}
+
+// writeInvalid appends the replacement for an invalid sequence.
+func (out *charsetBuffer) writeInvalid() {
+	out.hasInvalid = true
+	out.data = append(out.data, out.replacement...)
+}
+
+// isCharsetASCII returns true if the given data only contains ASCII
+// characters, i.e. does not need to be converted.
+func isCharsetASCII(data []byte) bool {
+	for _, char := range data {
+		if char >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeCharsetUTF8(data []byte, out *charsetBuffer) []byte {
+	if utf8.Valid(data) {
+		return data // ### return, valid ###
+	}
+	out.reset(len(data))
+	for len(data) > 0 {
+		char, size := utf8.DecodeRune(data)
+		if char == utf8.RuneError && size <= 1 {
+			out.writeInvalid()
+		} else {
+			out.data = append(out.data, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return out.data
+}
+
+func decodeCharsetLatin1(data []byte, out *charsetBuffer) []byte {
+	if isCharsetASCII(data) {
+		return data // ### return, ASCII only ###
+	}
+	out.reset(len(data) * 2)
+	for _, char := range data {
+		out.writeRune(rune(char))
+	}
+	return out.data
+}
+
+func decodeCharsetWindows1252(data []byte, out *charsetBuffer) []byte {
+	if isCharsetASCII(data) {
+		return data // ### return, ASCII only ###
+	}
+	out.reset(len(data) * 2)
+	for _, char := range data {
+		switch {
+		case char < 0x80 || char > 0x9F:
+			out.writeRune(rune(char))
+		case windows1252Table[char-0x80] != 0:
+			out.writeRune(windows1252Table[char-0x80])
+		default:
+			out.writeInvalid()
+		}
+	}
+	return out.data
+}
+
+func decodeCharsetUTF16(data []byte, out *charsetBuffer) []byte {
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+		return decodeCharsetUTF16LE(data[2:], out) // ### return, little endian BOM ###
+	}
+	if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+		data = data[2:]
+	}
+	return decodeCharsetUTF16BE(data, out)
+}
+
+func decodeCharsetUTF16LE(data []byte, out *charsetBuffer) []byte {
+	return decodeCharsetUTF16Units(data, out, func(unit []byte) uint16 {
+		return uint16(unit[0]) | uint16(unit[1])<<8
+	})
+}
+
+func decodeCharsetUTF16BE(data []byte, out *charsetBuffer) []byte {
+	return decodeCharsetUTF16Units(data, out, func(unit []byte) uint16 {
+		return uint16(unit[0])<<8 | uint16(unit[1])
+	})
+}
+
+// decodeCharsetUTF16Units decodes pairs of bytes converted to UTF-16 code
+// units by the given function. Unpaired surrogates and a trailing odd byte
+// are invalid.
+func decodeCharsetUTF16Units(data []byte, out *charsetBuffer, getUnit func([]byte) uint16) []byte {
+	out.reset(len(data))
+	for len(data) >= 2 {
+		unit := rune(getUnit(data))
+		data = data[2:]
+
+		switch {
+		case !utf16.IsSurrogate(unit):
+			out.writeRune(unit)
+
+		case unit < 0xDC00 && len(data) >= 2:
+			// High surrogate, requires a low surrogate
+			if char := utf16.DecodeRune(unit, rune(getUnit(data))); char != utf8.RuneError {
+				out.writeRune(char)
+				data = data[2:]
+			} else {
+				out.writeInvalid()
+			}
+
+		default:
+			out.writeInvalid()
+		}
+	}
+	if len(data) > 0 {
+		out.writeInvalid()
+	}
+	return out.data
+}
+
+func decodeCharsetShiftJIS(data []byte, out *charsetBuffer) []byte {
+	if isCharsetASCII(data) {
+		return data // ### return, ASCII only ###
+	}
+	out.reset(len(data) * 3 / 2)
+	for idx := 0; idx < len(data); idx++ {
+		lead := data[idx]
+		switch {
+		case lead < 0x80:
+			out.data = append(out.data, lead)
+
+		case lead >= 0xA1 && lead <= 0xDF:
+			// Half-width katakana
+			out.writeRune(0xFF61 + rune(lead-0xA1))
+
+		case (lead >= 0x81 && lead <= 0x9F) || (lead >= 0xE0 && lead <= 0xEF):
+			row := int(lead - 0x81)
+			if lead >= 0xE0 {
+				row = int(lead-0xE0) + 31
+			}
+
+			column := -1
+			if idx+1 < len(data) {
+				switch trail := data[idx+1]; {
+				case trail >= 0x40 && trail <= 0x7E:
+					column = int(trail - 0x40)
+				case trail >= 0x80 && trail <= 0xFC:
+					column = int(trail-0x80) + 63
+				}
+			}
+
+			if column < 0 {
+				out.writeInvalid() // Only the lead byte is invalid
+			} else if char := shiftJISTable[row*188+column]; char != 0 {
+				out.writeRune(rune(char))
+				idx++
+			} else {
+				out.writeInvalid()
+				idx++
+			}
+
+		default:
+			out.writeInvalid()
+		}
+	}
+	return out.data
+}
+
+// Format converts the message to UTF-8. Messages that are already valid are
+// not copied.
+func (format *Charset) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	out := charsetBuffer{replacement: format.replacement}
+	data = format.decode(data, &out)
+
+	if out.hasInvalid && format.reroute {
+		return data, format.invalid // ### return, invalid data ###
+	}
+	return data, streamID
+}
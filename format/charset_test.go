@@ -0,0 +1,82 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func testCharset(expect shared.Expect, conf core.PluginConfig, data []byte) string {
+	format := Charset{}
+	expect.NoError(format.Configure(conf))
+	result, _ := format.Format(core.NewMessage(nil, data, 0))
+	return string(result)
+}
+
+func TestCharsetFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.Charset")
+
+	// UTF-8 validation
+	expect.Equal("grüße", testCharset(expect, conf, []byte("grüße")))
+	expect.Equal("a�b�", testCharset(expect, conf, []byte("a\xffb\xc3")))
+
+	conf.Settings["CharsetInvalid"] = "drop"
+	expect.Equal("ab", testCharset(expect, conf, []byte("a\xffb\xc3")))
+
+	conf.Settings["CharsetInvalid"] = "replace"
+	conf.Settings["CharsetReplacement"] = "?"
+
+	// Single byte encodings
+	conf.Settings["CharsetSource"] = "latin-1"
+	expect.Equal("grüße", testCharset(expect, conf, []byte("gr\xfc\xdfe")))
+
+	conf.Settings["CharsetSource"] = "windows-1252"
+	expect.Equal("€ “quoted” ü?", testCharset(expect, conf, []byte("\x80 \x93quoted\x94 \xfc\x81")))
+
+	// UTF-16 with and without byte order mark
+	conf.Settings["CharsetSource"] = "utf-16"
+	expect.Equal("hé😀", testCharset(expect, conf, []byte("\xff\xfeh\x00\xe9\x00\x3d\xd8\x00\xde")))
+	expect.Equal("hé", testCharset(expect, conf, []byte("\x00h\x00\xe9")))
+	expect.Equal("h??", testCharset(expect, conf, []byte("\x00h\xd8\x3d\x00")))
+
+	conf.Settings["CharsetSource"] = "utf-16le"
+	expect.Equal("hé", testCharset(expect, conf, []byte("h\x00\xe9\x00")))
+
+	// Shift-JIS
+	conf.Settings["CharsetSource"] = "shift-jis"
+	expect.Equal("日本語ｶﾅ", testCharset(expect, conf, []byte("\x93\xfa\x96\x7b\x8c\xea\xb6\xc5")))
+	expect.Equal("a? b?", testCharset(expect, conf, []byte("a\x81\x20b\xfd")))
+
+	// Messages with invalid sequences can be rerouted
+	conf.Settings["CharsetSource"] = "utf-8"
+	conf.Settings["CharsetInvalidStream"] = "invalid"
+	format := Charset{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("valid"), 0)
+	_, streamID := format.Format(msg)
+	expect.Equal(msg.StreamID, streamID)
+
+	msg.Data = []byte("in\xffvalid")
+	result, streamID := format.Format(msg)
+	expect.Equal("in?valid", string(result))
+	expect.Equal(core.GetStreamID("invalid"), streamID)
+
+	conf.Settings["CharsetSource"] = "ebcdic"
+	expect.NotNil(format.Configure(conf))
+}
@@ -28,6 +28,7 @@ import (
 //     EnvelopeFormatter: "format.Forward"
 //     Prefix: "<data>"
 //     Postfix: "</data>\n"
+//     EnvelopeTimestampFormat: "2006-01-02T15:04:05Z07:00"
 //
 // Prefix defines the message prefix. By default this is set to "".
 // Special characters like \n \r \t will be transformed into the actual control
@@ -37,12 +38,21 @@ import (
 // Special characters like \n \r \t will be transformed into the actual control
 // characters.
 //
+// Prefix and Postfix may contain the following placeholders which are replaced
+// for each message: ${hostname}, ${stream}, ${timestamp}, ${sequence} and
+// ${meta:<key>} which is replaced by the metadata field <key>. Unknown
+// placeholders are written as-is (see core.MessageTemplate).
+//
+// EnvelopeTimestampFormat defines the format used for the ${timestamp}
+// placeholder. The format is based on Go's time.Format function and set to
+// "2006-01-02T15:04:05Z07:00" (RFC3339) by default.
+//
 // EnvelopeDataFormatter defines the formatter for the data transferred as
 // message. By default this is set to "format.Forward"
 type Envelope struct {
 	base    core.Formatter
-	postfix string
-	prefix  string
+	postfix core.MessageTemplate
+	prefix  core.MessageTemplate
 }
 
 func init() {
@@ -57,8 +67,9 @@ func (format *Envelope) Configure(conf core.PluginConfig) error {
 	}
 
 	format.base = plugin.(core.Formatter)
-	format.prefix = shared.Unescape(conf.GetString("Prefix", ""))
-	format.postfix = shared.Unescape(conf.GetString("Postfix", "\n"))
+	timestampFormat := conf.GetString("EnvelopeTimestampFormat", "2006-01-02T15:04:05Z07:00")
+	format.prefix = core.NewMessageTemplate(shared.Unescape(conf.GetString("Prefix", "")), timestampFormat)
+	format.postfix = core.NewMessageTemplate(shared.Unescape(conf.GetString("Postfix", "\n")), timestampFormat)
 
 	return nil
 }
@@ -67,21 +78,10 @@ func (format *Envelope) Configure(conf core.PluginConfig) error {
 func (format *Envelope) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	basePayload, streamID := format.base.Format(msg)
 
-	prefixLen := len(format.prefix)
-	baseLen := len(basePayload)
-	postfixLen := len(format.postfix)
-
-	payload := make([]byte, prefixLen+baseLen+postfixLen)
-
-	if prefixLen > 0 {
-		prefixLen = copy(payload, format.prefix)
-	}
-
-	baseLen = copy(payload[prefixLen:], basePayload)
-
-	if postfixLen > 0 {
-		copy(payload[prefixLen+baseLen:], format.postfix)
-	}
+	payload := make([]byte, 0, len(basePayload)+64)
+	payload = format.prefix.Append(payload, msg, streamID)
+	payload = append(payload, basePayload...)
+	payload = format.postfix.Append(payload, msg, streamID)
 
 	return payload, streamID
 }
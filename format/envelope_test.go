@@ -0,0 +1,43 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeTemplate(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.Envelope")
+	conf.Settings["Prefix"] = "<${sequence}> ${timestamp} ${hostname} ${stream} ${meta:user}: "
+	conf.Settings["Postfix"] = " ${unknown}${"
+	conf.Settings["EnvelopeTimestampFormat"] = "15:04:05"
+
+	format := Envelope{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("test"), 42)
+	msg.Timestamp = time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg.StreamID = core.GetStreamID("envelope")
+	msg.Metadata = core.MessageMetadata{"user": "bob"}
+
+	hostname, _ := os.Hostname()
+	result, _ := format.Format(msg)
+	expect.Equal("<42> 03:04:05 "+hostname+" envelope bob: test ${unknown}${", string(result))
+}
@@ -0,0 +1,371 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventTimeLayouts maps the names of common layouts to Go time layouts.
+var eventTimeLayouts = map[string]string{
+	"rfc3339":  time.RFC3339Nano,
+	"rfc1123":  time.RFC1123,
+	"rfc1123z": time.RFC1123Z,
+	"rfc822":   time.RFC822,
+	"rfc822z":  time.RFC822Z,
+	"ansic":    time.ANSIC,
+	"unixdate": time.UnixDate,
+	"stamp":    time.Stamp,
+}
+
+// eventTimeEpochs maps the names of the epoch layouts to their unit.
+var eventTimeEpochs = map[string]time.Duration{
+	"epoch":   time.Second,
+	"epochms": time.Millisecond,
+	"epochus": time.Microsecond,
+	"epochns": time.Nanosecond,
+}
+
+// EventTime is a formatter that parses the time an event occurred from the
+// payload of a message. The time is stored as metadata of the message so
+// that it can be used for routing, e.g. to write to time based indexes.
+// The timestamp can optionally be rewritten in a normalized format.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.EventTime"
+//     EventTimeFormatter: "format.Forward"
+//     EventTimeField: "timestamp"
+//     EventTimeExpression: ""
+//     EventTimeLayouts:
+//       - "rfc3339"
+//       - "%d/%b/%Y:%H:%M:%S %z"
+//     EventTimeTimezone: "UTC"
+//     EventTimeFormat: "rfc3339"
+//     EventTimeRewrite: false
+//
+// EventTimeFormatter defines the formatter applied before the timestamp is
+// parsed. By default this is set to "format.Forward".
+//
+// EventTimeField defines the JSON field containing the timestamp. Field paths
+// can be defined in a format accepted by shared.MarshalMap.Path. By default
+// this is set to "", i.e. the message is not parsed as JSON.
+//
+// EventTimeExpression defines a regular expression applied to the message or
+// to the value of EventTimeField if set. If the expression contains a capture
+// group the first group is parsed as timestamp, otherwise the whole match is
+// used. By default this is set to "", i.e. the whole message or field value
+// is parsed.
+//
+// EventTimeLayouts defines a list of layouts tried in order to parse the
+// timestamp. Layouts can be given as Go time layout, e.g.
+// "2006-01-02 15:04:05", as strftime format, e.g. "%Y-%m-%d %H:%M:%S", or by
+// one of the names "rfc3339", "rfc1123", "rfc1123z", "rfc822", "rfc822z",
+// "ansic", "unixdate", "stamp" (syslog style, i.e. without year), "epoch",
+// "epochms", "epochus" and "epochns". Epoch values may contain a fraction.
+// The strftime directive %f parses fractional seconds and has to follow a
+// dot. By default this is set to ["rfc3339"].
+//
+// EventTimeTimezone defines the timezone used for timestamps that do not
+// contain a timezone. Names from the IANA timezone database as well as "UTC"
+// and "Local" can be used. By default this is set to "UTC".
+//
+// EventTimeFormat defines the format used when rewriting the timestamp. The
+// same names and layouts as for EventTimeLayouts can be used. The timestamp is
+// converted to UTC before being formatted. Epoch formats are written as
+// integers and as JSON numbers if the timestamp is rewritten in a field.
+// By default this is set to "rfc3339".
+//
+// EventTimeRewrite can be set to true to replace the timestamp in the message
+// by the normalized timestamp. If EventTimeField is set the message is
+// re-encoded, so the order of the JSON keys may change.
+// By default this is set to false.
+//
+// The parsed time is stored as RFC3339 timestamp in UTC in the metadata field
+// "event_time". Metadata is only stored if this formatter is used by a
+// stream. Messages without a timestamp or with a timestamp that cannot be
+// parsed are passed unchanged.
+type EventTime struct {
+	base     core.Formatter
+	field    string
+	exp      *regexp.Regexp
+	layouts  []string
+	location *time.Location
+	output   string
+	rewrite  bool
+}
+
+func init() {
+	shared.RuntimeType.Register(EventTime{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *EventTime) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("EventTimeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.field = conf.GetString("EventTimeField", "")
+	format.rewrite = conf.GetBool("EventTimeRewrite", false)
+
+	format.exp = nil
+	if expression := conf.GetString("EventTimeExpression", ""); expression != "" {
+		if format.exp, err = regexp.Compile(expression); err != nil {
+			return err // ### return, regex parser error ###
+		}
+	}
+
+	format.layouts = format.layouts[:0]
+	for _, layout := range conf.GetStringArray("EventTimeLayouts", []string{"rfc3339"}) {
+		format.layouts = append(format.layouts, parseEventTimeLayout(layout))
+	}
+	if len(format.layouts) == 0 {
+		return fmt.Errorf("EventTime: EventTimeLayouts must not be empty")
+	}
+
+	format.output = parseEventTimeLayout(conf.GetString("EventTimeFormat", "rfc3339"))
+
+	if format.location, err = time.LoadLocation(conf.GetString("EventTimeTimezone", "UTC")); err != nil {
+		return fmt.Errorf("EventTime: %s", err)
+	}
+	return nil
+}
+
+// parseEventTimeLayout converts a layout name or strftime format into a Go
+// time layout. The names of epoch layouts are returned as-is.
+func parseEventTimeLayout(layout string) string {
+	lowerLayout := strings.ToLower(layout)
+	if goLayout, isNamed := eventTimeLayouts[lowerLayout]; isNamed {
+		return goLayout // ### return, named layout ###
+	}
+	if _, isEpoch := eventTimeEpochs[lowerLayout]; isEpoch {
+		return lowerLayout // ### return, epoch layout ###
+	}
+	if !strings.Contains(layout, "%") {
+		return layout // ### return, go layout ###
+	}
+
+	return shared.StrftimeLayout(layout)
+}
+
+// parseEpoch parses a number of units since 1970-01-01 UTC. The number may
+// contain a fraction.
+func parseEpoch(text string, unit time.Duration) (time.Time, error) {
+	intPart, fracPart := text, ""
+	if dot := strings.IndexByte(text, '.'); dot >= 0 {
+		intPart, fracPart = text[:dot], text[dot+1:]
+	}
+
+	value, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err // ### return, not a number ###
+	}
+	nanos := value * int64(unit)
+
+	if fracPart != "" {
+		fraction, err := strconv.ParseFloat("0."+fracPart, 64)
+		if err != nil {
+			return time.Time{}, err // ### return, invalid fraction ###
+		}
+		if strings.HasPrefix(intPart, "-") {
+			fraction = -fraction
+		}
+		nanos += int64(fraction * float64(unit))
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// parse tries all configured layouts on the given text.
+func (format *EventTime) parse(text string) (time.Time, bool) {
+	text = strings.TrimSpace(text)
+	for _, layout := range format.layouts {
+		if unit, isEpoch := eventTimeEpochs[layout]; isEpoch {
+			if eventTime, err := parseEpoch(text, unit); err == nil {
+				return eventTime, true // ### return, parsed ###
+			}
+			continue // ### continue, try next layout ###
+		}
+
+		eventTime, err := time.ParseInLocation(layout, text, format.location)
+		if err != nil {
+			continue // ### continue, try next layout ###
+		}
+		if eventTime.Year() == 0 {
+			// Layouts without a year, e.g. syslog timestamps
+			now := time.Now().In(format.location)
+			eventTime = eventTime.AddDate(now.Year(), 0, 0)
+			if eventTime.After(now.AddDate(0, 1, 0)) {
+				eventTime = eventTime.AddDate(-1, 0, 0)
+			}
+		}
+		return eventTime, true
+	}
+	return time.Time{}, false
+}
+
+// formatTime formats the given time as defined by EventTimeFormat. Returns
+// true if the result is a number.
+func (format *EventTime) formatTime(eventTime time.Time) (string, bool) {
+	eventTime = eventTime.UTC()
+	if unit, isEpoch := eventTimeEpochs[format.output]; isEpoch {
+		seconds := eventTime.Unix()
+		nanos := int64(eventTime.Nanosecond())
+		return strconv.FormatInt(seconds*int64(time.Second/unit)+nanos/int64(unit), 10), true
+	}
+	return eventTime.Format(format.output), false
+}
+
+// match applies the expression to the given text and returns the indexes of
+// the timestamp. If no expression is set the whole text is returned.
+func (format *EventTime) match(text []byte) (int, int, bool) {
+	if format.exp == nil {
+		return 0, len(text), true // ### return, no expression ###
+	}
+
+	match := format.exp.FindSubmatchIndex(text)
+	switch {
+	case match == nil:
+		return 0, 0, false
+	case len(match) > 2 && match[2] >= 0:
+		return match[2], match[3], true
+	default:
+		return match[0], match[1], true
+	}
+}
+
+// replaceRange returns text with the bytes between start and end replaced by
+// value.
+func replaceRange(text []byte, start int, end int, value string) []byte {
+	result := make([]byte, 0, len(text)-(end-start)+len(value))
+	result = append(result, text[:start]...)
+	result = append(result, value...)
+	return append(result, text[end:]...)
+}
+
+// setEventTimeField sets the value of the field at the given path. Only paths
+// ending with a map key are supported.
+func setEventTimeField(values shared.MarshalMap, path string, value interface{}) bool {
+	parentPath, key := "", path
+	if slash := strings.LastIndex(path, "/"); slash >= 0 {
+		parentPath, key = path[:slash], path[slash+1:]
+	}
+	if strings.ContainsAny(key, "[]") {
+		return false // ### return, array index ###
+	}
+
+	parent, _ := values.Path(parentPath)
+	switch parent.(type) {
+	case shared.MarshalMap:
+		parent.(shared.MarshalMap)[key] = value
+	case map[string]interface{}:
+		parent.(map[string]interface{})[key] = value
+	default:
+		return false
+	}
+	return true
+}
+
+// apply parses the event time of the given payload and returns the payload
+// with the timestamp rewritten if EventTimeRewrite is set.
+func (format *EventTime) apply(data []byte) ([]byte, time.Time, bool) {
+	if format.field == "" {
+		start, end, found := format.match(data)
+		if !found {
+			return data, time.Time{}, false // ### return, no timestamp ###
+		}
+		eventTime, parsed := format.parse(string(data[start:end]))
+		if !parsed || !format.rewrite {
+			return data, eventTime, parsed // ### return, nothing to rewrite ###
+		}
+		value, _ := format.formatTime(eventTime)
+		return replaceRange(data, start, end, value), eventTime, true
+	}
+
+	values := shared.NewMarshalMap()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return data, time.Time{}, false // ### return, no JSON ###
+	}
+
+	var text string
+	switch value, _ := values.Path(format.field); value.(type) {
+	case string:
+		text = value.(string)
+	case json.Number:
+		text = value.(json.Number).String()
+	default:
+		return data, time.Time{}, false // ### return, no timestamp ###
+	}
+
+	start, end, found := format.match([]byte(text))
+	if !found {
+		return data, time.Time{}, false // ### return, no timestamp ###
+	}
+
+	eventTime, parsed := format.parse(text[start:end])
+	if !parsed || !format.rewrite {
+		return data, eventTime, parsed // ### return, nothing to rewrite ###
+	}
+
+	var fieldValue interface{}
+	switch value, isNumber := format.formatTime(eventTime); {
+	case format.exp != nil:
+		fieldValue = string(replaceRange([]byte(text), start, end, value))
+	case isNumber:
+		fieldValue = json.Number(value)
+	default:
+		fieldValue = value
+	}
+
+	if !setEventTimeField(values, format.field, fieldValue) {
+		return data, eventTime, true // ### return, field cannot be set ###
+	}
+	if rewritten, err := json.Marshal(values); err == nil {
+		data = rewritten
+	}
+	return data, eventTime, true
+}
+
+// Format parses the event time of a message and rewrites it if
+// EventTimeRewrite is set.
+func (format *EventTime) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	data, _, _ = format.apply(data)
+	return data, streamID
+}
+
+// FormatMetadata behaves like Format and additionally stores the event time
+// as metadata.
+func (format *EventTime) FormatMetadata(msg core.Message) ([]byte, core.MessageStreamID, core.MessageMetadata) {
+	data, streamID := format.base.Format(msg)
+	data, eventTime, parsed := format.apply(data)
+	if !parsed {
+		return data, streamID, msg.Metadata // ### return, no event time ###
+	}
+
+	metadata := msg.Metadata.Clone()
+	metadata[core.MetadataEventTime] = eventTime.UTC().Format(time.RFC3339Nano)
+	return data, streamID, metadata
+}
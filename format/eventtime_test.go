@@ -0,0 +1,93 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+	"time"
+)
+
+func TestEventTimeLayout(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	expect.Equal("02/Jan/2006:15:04:05 -0700", parseEventTimeLayout("%d/%b/%Y:%H:%M:%S %z"))
+	expect.Equal("2006-01-02 15:04:05.999999999 100%", parseEventTimeLayout("%F %T.%f 100%%"))
+	expect.Equal(time.RFC3339Nano, parseEventTimeLayout("RFC3339"))
+	expect.Equal("epochms", parseEventTimeLayout("EpochMs"))
+	expect.Equal("2006-01-02", parseEventTimeLayout("2006-01-02"))
+
+	eventTime, err := parseEpoch("1500000000.25", time.Second)
+	expect.NoError(err)
+	expect.Equal(int64(1500000000250000000), eventTime.UnixNano())
+
+	eventTime, _ = parseEpoch("-1.5", time.Second)
+	expect.Equal(int64(-1500000000), eventTime.UnixNano())
+
+	eventTime, _ = parseEpoch("1500000000123", time.Millisecond)
+	expect.Equal(int64(1500000000123000000), eventTime.UnixNano())
+}
+
+func TestEventTimeFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.EventTime")
+	conf.Settings["EventTimeExpression"] = `\[([^\]]+)\]`
+	conf.Settings["EventTimeLayouts"] = []interface{}{"rfc3339", "%d/%b/%Y:%H:%M:%S %z"}
+	conf.Settings["EventTimeRewrite"] = true
+
+	format := EventTime{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`127.0.0.1 - [10/Oct/2020:13:55:36 +0200] "GET /"`), 0)
+	result, _, metadata := format.FormatMetadata(msg)
+	expect.Equal(`127.0.0.1 - [2020-10-10T11:55:36Z] "GET /"`, string(result))
+	expect.Equal("2020-10-10T11:55:36Z", metadata[core.MetadataEventTime])
+
+	// Messages without timestamp are passed unchanged
+	msg.Data = []byte("no timestamp")
+	result, _, metadata = format.FormatMetadata(msg)
+	expect.Equal("no timestamp", string(result))
+	_, hasEventTime := metadata[core.MetadataEventTime]
+	expect.False(hasEventTime)
+
+	// JSON fields in a local timezone converted to epoch
+	conf = core.NewPluginConfig("format.EventTime")
+	conf.Settings["EventTimeField"] = "event/time"
+	conf.Settings["EventTimeLayouts"] = "%Y-%m-%d %H:%M:%S.%f"
+	conf.Settings["EventTimeTimezone"] = "Europe/Berlin"
+	conf.Settings["EventTimeFormat"] = "epochms"
+	conf.Settings["EventTimeRewrite"] = true
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte(`{"event":{"time":"2020-01-01 01:00:00.5","id":12345678901234567}}`)
+	result, _, metadata = format.FormatMetadata(msg)
+	expect.Equal(`{"event":{"id":12345678901234567,"time":1577836800500}}`, string(result))
+	expect.Equal("2020-01-01T00:00:00.5Z", metadata[core.MetadataEventTime])
+
+	// Epoch fields are parsed without rewriting
+	conf.Settings["EventTimeLayouts"] = "epoch"
+	conf.Settings["EventTimeRewrite"] = false
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte(`{"event":{"time":1577836800}}`)
+	result, _, metadata = format.FormatMetadata(msg)
+	expect.Equal(`{"event":{"time":1577836800}}`, string(result))
+	expect.Equal("2020-01-01T00:00:00Z", metadata[core.MetadataEventTime])
+
+	conf.Settings["EventTimeTimezone"] = "Nowhere/Unknown"
+	expect.NotNil(format.Configure(conf))
+}
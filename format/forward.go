@@ -40,3 +40,8 @@ func (format *Forward) Configure(conf core.PluginConfig) error {
 func (format *Forward) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	return msg.Data, msg.StreamID
 }
+
+// PassThrough returns true as messages are never modified
+func (format *Forward) PassThrough() bool {
+	return true
+}
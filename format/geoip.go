@@ -0,0 +1,327 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// GeoIP formatter plugin
+// GeoIP is a formatter that looks up an IP address in a MaxMind GeoIP2 or
+// GeoLite2 database and adds the location of the address to JSON objects.
+// Messages that are not a JSON object are passed as-is and an error is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.GeoIP"
+//     GeoIPFormatter: "format.Forward"
+//     GeoIPDatabase: "/usr/share/GeoIP/GeoLite2-City.mmdb"
+//     GeoIPASNDatabase: "/usr/share/GeoIP/GeoLite2-ASN.mmdb"
+//     GeoIPSourceKey: "client_ip"
+//     GeoIPSourceRegex: ""
+//     GeoIPDataKey: "geoip"
+//     GeoIPLanguage: "en"
+//     GeoIPReloadSec: 60
+//
+// The location is stored as an object containing the fields "country_code",
+// "country", "continent_code", "city", "latitude" and "longitude" as far as
+// they are known for the address. If GeoIPASNDatabase is set the fields "asn"
+// and "as_org" are added. Addresses that are not found in any database do not
+// add an object.
+//
+// GeoIPFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// GeoIPDatabase defines the path to a GeoIP2 or GeoLite2 country or city
+// database. By default this is set to "".
+//
+// GeoIPASNDatabase defines the path to a GeoIP2 or GeoLite2 ASN database.
+// By default this is set to "".
+//
+// GeoIPSourceKey defines the JSON field containing the IP address.
+// By default this is set to "ip".
+//
+// GeoIPSourceRegex defines a regular expression applied to the message to
+// find the IP address. The first capture group is used as address. If set,
+// GeoIPSourceKey is ignored. By default this is set to "".
+//
+// GeoIPDataKey defines the key used to store the location.
+// By default this is set to "geoip".
+//
+// GeoIPLanguage defines the language of the country and city names.
+// By default this is set to "en".
+//
+// GeoIPReloadSec defines the interval in seconds in which the database files
+// are checked for modifications while the producer or stream using this
+// formatter is running. Modified databases are loaded without interrupting
+// lookups. Set to 0 to disable reloading. By default this is set to 60.
+type GeoIP struct {
+	base      core.Formatter
+	sourceKey string
+	source    *regexp.Regexp
+	dataKey   string
+	language  string
+	location  *geoIPDatabase
+	asn       *geoIPDatabase
+	reload    time.Duration
+	quit      chan struct{}
+	watchers  sync.WaitGroup
+}
+
+// geoIPDatabase holds a database that is reloaded when its file is modified.
+type geoIPDatabase struct {
+	path    string
+	db      *shared.MaxMindDB
+	modTime time.Time
+	size    int64
+	guard   *sync.RWMutex
+}
+
+func init() {
+	shared.RuntimeType.Register(GeoIP{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *GeoIP) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("GeoIPFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.sourceKey = conf.GetString("GeoIPSourceKey", "ip")
+	format.dataKey = conf.GetString("GeoIPDataKey", "geoip")
+	format.language = conf.GetString("GeoIPLanguage", "en")
+	format.reload = time.Duration(conf.GetInt("GeoIPReloadSec", 60)) * time.Second
+
+	if source := conf.GetString("GeoIPSourceRegex", ""); source != "" {
+		if format.source, err = regexp.Compile(source); err != nil {
+			return fmt.Errorf("GeoIP: %s", err)
+		}
+		if format.source.NumSubexp() < 1 {
+			return fmt.Errorf("GeoIP: GeoIPSourceRegex requires a capture group")
+		}
+	}
+
+	if format.location, err = openGeoIPDatabase(conf.GetString("GeoIPDatabase", "")); err != nil {
+		return fmt.Errorf("GeoIP: %s", err)
+	}
+	if format.asn, err = openGeoIPDatabase(conf.GetString("GeoIPASNDatabase", "")); err != nil {
+		return fmt.Errorf("GeoIP: %s", err)
+	}
+	if format.location == nil && format.asn == nil {
+		Log.Error.Print("GeoIP: GeoIPDatabase or GeoIPASNDatabase has to be set")
+		return nil // ### return, no database ###
+	}
+	return nil
+}
+
+// Start starts checking the databases for modifications. This implements the
+// core.FormatterRunner interface.
+func (format *GeoIP) Start() {
+	core.StartFormatter(format.base)
+	if format.reload <= 0 {
+		return // ### return, reloading disabled ###
+	}
+
+	format.quit = make(chan struct{})
+	for _, database := range []*geoIPDatabase{format.location, format.asn} {
+		if database != nil {
+			format.watchers.Add(1)
+			go func(database *geoIPDatabase) {
+				defer format.watchers.Done()
+				database.watch(format.reload, format.quit)
+			}(database)
+		}
+	}
+}
+
+// Stop stops checking the databases for modifications and waits until all
+// checks have finished. This implements the core.FormatterRunner interface.
+func (format *GeoIP) Stop() {
+	if format.quit != nil {
+		close(format.quit)
+		format.watchers.Wait()
+		format.quit = nil
+	}
+	core.StopFormatter(format.base)
+}
+
+// openGeoIPDatabase loads the database at the given path. If path is empty
+// nil is returned.
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	if path == "" {
+		return nil, nil // ### return, not configured ###
+	}
+	database := &geoIPDatabase{
+		path:  path,
+		guard: new(sync.RWMutex),
+	}
+	if err := database.load(); err != nil {
+		return nil, err
+	}
+	return database, nil
+}
+
+// load reads the database file if it has been modified since the last call.
+func (database *geoIPDatabase) load() error {
+	info, err := os.Stat(database.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(database.modTime) && info.Size() == database.size {
+		return nil // ### return, not modified ###
+	}
+
+	db, err := shared.OpenMaxMindDB(database.path)
+	if err != nil {
+		return fmt.Errorf("%s: %s", database.path, err)
+	}
+
+	database.guard.Lock()
+	database.db = db
+	database.modTime = info.ModTime()
+	database.size = info.Size()
+	database.guard.Unlock()
+	return nil
+}
+
+// watch reloads the database in the given interval until quit is closed.
+// Databases that cannot be loaded are kept until a valid file is available.
+func (database *geoIPDatabase) watch(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return // ### return, stopped ###
+		case <-ticker.C:
+			if err := database.load(); err != nil {
+				Log.Warning.Print("GeoIP: reloading failed: ", err)
+			}
+		}
+	}
+}
+
+// lookup returns the record of the given address or nil if the address is
+// not part of the database.
+func (database *geoIPDatabase) lookup(ip net.IP) map[string]interface{} {
+	if database == nil {
+		return nil // ### return, not configured ###
+	}
+
+	database.guard.RLock()
+	db := database.db
+	database.guard.RUnlock()
+
+	record, err := db.Lookup(ip)
+	if err != nil {
+		Log.Warning.Print("GeoIP: ", err)
+	}
+	values, _ := record.(map[string]interface{})
+	return values
+}
+
+// geoIPField returns the value at the given path of a record.
+func geoIPField(record map[string]interface{}, path ...string) interface{} {
+	var value interface{} = record
+	for _, key := range path {
+		values, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil // ### return, not found ###
+		}
+		value = values[key]
+	}
+	return value
+}
+
+// getAddress returns the IP address of a message or nil if no valid address
+// is found.
+func (format *GeoIP) getAddress(payload []byte, values map[string]interface{}) net.IP {
+	var address string
+	if format.source != nil {
+		if match := format.source.FindSubmatch(payload); match != nil {
+			address = string(match[1])
+		}
+	} else {
+		address, _ = values[format.sourceKey].(string)
+	}
+	return net.ParseIP(address)
+}
+
+// getLocation returns the location information of the given address.
+func (format *GeoIP) getLocation(ip net.IP) map[string]interface{} {
+	info := make(map[string]interface{})
+	add := func(key string, value interface{}) {
+		if value != nil && value != "" {
+			info[key] = value
+		}
+	}
+
+	if record := format.location.lookup(ip); record != nil {
+		add("country_code", geoIPField(record, "country", "iso_code"))
+		add("country", geoIPField(record, "country", "names", format.language))
+		add("continent_code", geoIPField(record, "continent", "code"))
+		add("city", geoIPField(record, "city", "names", format.language))
+		add("latitude", geoIPField(record, "location", "latitude"))
+		add("longitude", geoIPField(record, "location", "longitude"))
+	}
+	if record := format.asn.lookup(ip); record != nil {
+		add("asn", geoIPField(record, "autonomous_system_number"))
+		add("as_org", geoIPField(record, "autonomous_system_organization"))
+	}
+	return info
+}
+
+// Format returns the message payload with added location information
+func (format *GeoIP) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	if format.location == nil && format.asn == nil {
+		return basePayload, stream // ### return, no database ###
+	}
+
+	values, err := decodeJSONObject(basePayload)
+	if err != nil {
+		Log.Error.Print("GeoIP: ", err)
+		return basePayload, stream // ### return, not a JSON object ###
+	}
+
+	ip := format.getAddress(basePayload, values)
+	if ip == nil {
+		return basePayload, stream // ### return, no address ###
+	}
+
+	info := format.getLocation(ip)
+	if len(info) == 0 {
+		return basePayload, stream // ### return, unknown address ###
+	}
+	values[format.dataKey] = info
+
+	payload, err := encodeJSON(values)
+	if err != nil {
+		Log.Error.Print("GeoIP: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/hex"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGeoIPCity maps 1.2.3.0/24 to Berlin, Germany
+const testGeoIPCity = "" +
+	"000001000018000002000018000003000018000004000018000005000018000006000018000007000018000018000008" +
+	"00000900001800000a00001800000b00001800000c00001800000d00001800000e00001800001800000f000010000018" +
+	"000011000018000012000018000013000018000014000018000015000018000016000018000018000017000018000028" +
+	"00000000000000000000000000000000e44463697479e1456e616d6573e142656e464265726c696e49636f6e74696e65" +
+	"6e74e144636f646542455547636f756e747279e24869736f5f636f6465424445456e616d6573e142656e474765726d61" +
+	"6e79486c6f636174696f6ee2486c6174697475646568404a400000000000496c6f6e67697475646568402a8000000000" +
+	"00abcdef4d61784d696e642e636f6de44d64617461626173655f7479706544546573744a69705f76657273696f6ec400" +
+	"0000044a6e6f64655f636f756e74c4000000184b7265636f72645f73697a65c400000018"
+
+// testGeoIPASN maps 1.2.0.0/16 to AS 3320
+const testGeoIPASN = "" +
+	"000001000010000002000010000003000010000004000010000005000010000006000010000007000010000010000008" +
+	"00000900001000000a00001000000b00001000000c00001000000d00001000000e00001000001000000f000020000010" +
+	"00000000000000000000000000000000e2586175746f6e6f6d6f75735f73797374656d5f6e756d626572c400000cf85d" +
+	"016175746f6e6f6d6f75735f73797374656d5f6f7267616e697a6174696f6e4754656c656b6f6dabcdef4d61784d696e" +
+	"642e636f6de44d64617461626173655f7479706544546573744a69705f76657273696f6ec4000000044a6e6f64655f63" +
+	"6f756e74c4000000104b7265636f72645f73697a65c400000018"
+
+func writeGeoIPTestDB(t *testing.T, path string, data string) {
+	raw, _ := hex.DecodeString(data)
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-geoip")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cityFile := filepath.Join(dir, "city.mmdb")
+	asnFile := filepath.Join(dir, "asn.mmdb")
+	writeGeoIPTestDB(t, cityFile, testGeoIPCity)
+	writeGeoIPTestDB(t, asnFile, testGeoIPASN)
+
+	format := GeoIP{}
+	conf := core.NewPluginConfig("format.GeoIP")
+	conf.Settings["GeoIPDatabase"] = cityFile
+	conf.Settings["GeoIPASNDatabase"] = asnFile
+	conf.Settings["GeoIPReloadSec"] = 0
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"ip":"1.2.3.4"}`), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(`{"geoip":{"as_org":"Telekom","asn":3320,"city":"Berlin","continent_code":"EU","country":"Germany","country_code":"DE","latitude":52.5,"longitude":13.25},"ip":"1.2.3.4"}`, string(result))
+
+	// Addresses found in a single database only add the known fields
+	msg = core.NewMessage(nil, []byte(`{"ip":"1.2.4.1"}`), 0)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"geoip":{"as_org":"Telekom","asn":3320},"ip":"1.2.4.1"}`, string(result))
+
+	// Unknown addresses, missing addresses and non-JSON messages are passed as-is
+	for _, payload := range []string{`{"ip":"5.6.7.8"}`, `{"ip":"invalid"}`, `{"host":"web01"}`, "1.2.3.4"} {
+		msg = core.NewMessage(nil, []byte(payload), 0)
+		result, _ = format.Format(msg)
+		expect.Equal(payload, string(result))
+	}
+}
+
+func TestGeoIPSourceRegex(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-geoip")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cityFile := filepath.Join(dir, "city.mmdb")
+	writeGeoIPTestDB(t, cityFile, testGeoIPCity)
+
+	format := GeoIP{}
+	conf := core.NewPluginConfig("format.GeoIP")
+	conf.Settings["GeoIPDatabase"] = cityFile
+	conf.Settings["GeoIPSourceRegex"] = `"request":"([0-9.]+) `
+	conf.Settings["GeoIPDataKey"] = "location"
+	conf.Settings["GeoIPReloadSec"] = 0
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"request":"1.2.3.4 GET /"}`), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(`{"location":{"city":"Berlin","continent_code":"EU","country":"Germany","country_code":"DE","latitude":52.5,"longitude":13.25},"request":"1.2.3.4 GET /"}`, string(result))
+
+	conf.Settings["GeoIPSourceRegex"] = `[0-9.]+`
+	expect.NotNil(format.Configure(conf))
+}
+
+func TestGeoIPReload(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-geoip")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	dbFile := filepath.Join(dir, "geoip.mmdb")
+	writeGeoIPTestDB(t, dbFile, testGeoIPASN)
+
+	format := GeoIP{}
+	conf := core.NewPluginConfig("format.GeoIP")
+	conf.Settings["GeoIPDatabase"] = dbFile
+	conf.Settings["GeoIPReloadSec"] = 0
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"ip":"1.2.3.4"}`), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(`{"ip":"1.2.3.4"}`, string(result))
+
+	// Modified files are loaded, invalid files keep the current database
+	writeGeoIPTestDB(t, dbFile, testGeoIPCity)
+	expect.NoError(format.location.load())
+	result, _ = format.Format(msg)
+	expect.Equal(`{"geoip":{"city":"Berlin","continent_code":"EU","country":"Germany","country_code":"DE","latitude":52.5,"longitude":13.25},"ip":"1.2.3.4"}`, string(result))
+
+	expect.NoError(ioutil.WriteFile(dbFile, []byte("invalid"), 0644))
+	expect.NotNil(format.location.load())
+	result2, _ := format.Format(msg)
+	expect.Equal(string(result), string(result2))
+}
+
+func TestGeoIPWatch(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-geoip")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	dbFile := filepath.Join(dir, "geoip.mmdb")
+	writeGeoIPTestDB(t, dbFile, testGeoIPASN)
+
+	format := GeoIP{}
+	conf := core.NewPluginConfig("format.GeoIP")
+	conf.Settings["GeoIPDatabase"] = dbFile
+	expect.NoError(format.Configure(conf))
+
+	// Databases are only checked while the formatter is running
+	format.reload = 10 * time.Millisecond
+	format.Start()
+	writeGeoIPTestDB(t, dbFile, testGeoIPCity)
+
+	msg := core.NewMessage(nil, []byte(`{"ip":"1.2.3.4"}`), 0)
+	result, _ := format.Format(msg)
+	for i := 0; i < 100 && !strings.Contains(string(result), "Berlin"); i++ {
+		time.Sleep(10 * time.Millisecond)
+		result, _ = format.Format(msg)
+	}
+	expect.Equal(`{"geoip":{"city":"Berlin","continent_code":"EU","country":"Germany","country_code":"DE","latitude":52.5,"longitude":13.25},"ip":"1.2.3.4"}`, string(result))
+
+	format.Stop()
+	expect.True(format.quit == nil)
+}
@@ -15,24 +15,83 @@
 package format
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"net"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// Hostname is a formatter that prefixes a message with the hostname.
+// Hostname is a formatter that adds the hostname or the IP of the current
+// machine to a message.
 // Configuration example
 //
 //   - "<producer|stream>":
 //     Formatter: "format.Hostname"
-//     HostnameFormatter: "format.Envelope"
+//     HostnameFormatter: "format.Forward"
+//     HostnameType: "short"
+//     HostnameInterface: ""
+//     HostnameSeparator: " "
+//     HostnamePosition: "prefix"
+//     HostnameField: "hostname"
+//     HostnameCacheSec: 300
 //
-// HostnameDataFormatter defines the formatter for the data transferred as
-// message. By default this is set to "format.Envelope"
+// HostnameFormatter defines the formatter for the data transferred as
+// message. By default this is set to "format.Forward"
+//
+// HostnameType defines which name is added to the message. Valid values are
+// "short" for the hostname as reported by the kernel, "fqdn" for the fully
+// qualified domain name and "ip" for the IP address of the primary network
+// interface. If the FQDN cannot be resolved the short hostname is used.
+// By default this is set to "short".
+//
+// HostnameInterface defines the network interface used when HostnameType is
+// set to "ip". By default this is set to "", i.e. the first interface that is
+// up and not a loopback interface is used. IPv4 addresses are preferred.
+//
+// HostnameSeparator defines the string placed between the hostname and the
+// message. By default this is set to " ".
+//
+// HostnamePosition defines where the hostname is added. Valid values are
+// "prefix", "postfix" and "field". When set to "field" the hostname is
+// stored in the field HostnameField of a JSON object. Messages that are not
+// a JSON object are prefixed. Note that the keys of the resulting JSON
+// object are sorted. By default this is set to "prefix".
+//
+// HostnameField defines the JSON field used when HostnamePosition is set to
+// "field". An existing field is overwritten. By default this is set to
+// "hostname".
+//
+// HostnameCacheSec defines the number of seconds a looked up name is cached
+// before it is resolved again. Set to 0 to resolve the name only once.
+// By default this is set to 300.
 type Hostname struct {
-	base core.Formatter
+	base      core.Formatter
+	lookup    func() (string, error)
+	separator []byte
+	position  string
+	field     string
+	cacheTime time.Duration
+	cache     atomic.Value
+}
+
+type hostnameCache struct {
+	name    string
+	expires time.Time
 }
 
+const (
+	hostnamePositionPrefix  = "prefix"
+	hostnamePositionPostfix = "postfix"
+	hostnamePositionField   = "field"
+)
+
 func init() {
 	shared.RuntimeType.Register(Hostname{})
 }
@@ -45,24 +104,180 @@ func (format *Hostname) Configure(conf core.PluginConfig) error {
 	}
 
 	format.base = plugin.(core.Formatter)
+	format.separator = []byte(conf.GetString("HostnameSeparator", " "))
+	format.field = conf.GetString("HostnameField", "hostname")
+	format.cacheTime = time.Duration(conf.GetInt("HostnameCacheSec", 300)) * time.Second
+
+	switch hostType := strings.ToLower(conf.GetString("HostnameType", "short")); hostType {
+	case "short":
+		format.lookup = os.Hostname
+	case "fqdn":
+		format.lookup = lookupFQDN
+	case "ip":
+		iface := conf.GetString("HostnameInterface", "")
+		format.lookup = func() (string, error) { return lookupInterfaceIP(iface) }
+	default:
+		return fmt.Errorf("Hostname: Unknown HostnameType \"%s\"", hostType)
+	}
+
+	switch format.position = strings.ToLower(conf.GetString("HostnamePosition", hostnamePositionPrefix)); format.position {
+	case hostnamePositionPrefix, hostnamePositionPostfix, hostnamePositionField:
+	default:
+		return fmt.Errorf("Hostname: Unknown HostnamePosition \"%s\"", format.position)
+	}
+
+	format.resolve()
 	return nil
 }
 
-// Format prepends the Hostname of the message to the message.
-func (format *Hostname) Format(msg core.Message) ([]byte, core.MessageStreamID) {
-	basePayload, stream := format.base.Format(msg)
-	baseLength := len(basePayload)
+// resolve looks up the name and stores it in the cache. Failed lookups keep
+// the previously resolved name.
+func (format *Hostname) resolve() string {
+	name, err := format.lookup()
+	if err != nil {
+		Log.Warning.Print("Hostname: ", err)
+		if cached, isSet := format.cache.Load().(hostnameCache); isSet {
+			name = cached.name
+		}
+	}
+
+	format.cache.Store(hostnameCache{
+		name:    name,
+		expires: time.Now().Add(format.cacheTime),
+	})
+	return name
+}
+
+// hostname returns the cached name and resolves it again if necessary.
+func (format *Hostname) hostname() string {
+	cached := format.cache.Load().(hostnameCache)
+	if format.cacheTime > 0 && time.Now().After(cached.expires) {
+		return format.resolve()
+	}
+	return cached.name
+}
+
+// lookupFQDN returns the fully qualified domain name of this machine by
+// doing a reverse lookup on the addresses of the hostname.
+func lookupFQDN() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
 
-	hostnameStr, err := os.Hostname()
+	addrs, err := net.LookupHost(hostname)
 	if err != nil {
-		hostnameStr = ""
+		return hostname, nil // ### return, not resolvable ###
+	}
+
+	for _, addr := range addrs {
+		names, err := net.LookupAddr(addr)
+		if err != nil {
+			continue // ### continue, no reverse entry ###
+		}
+		for _, name := range names {
+			if name = strings.TrimSuffix(name, "."); strings.Contains(name, ".") {
+				return name, nil // ### return, found ###
+			}
+		}
+	}
+	return hostname, nil
+}
+
+// lookupInterfaceIP returns the IP of the given interface or of the first
+// interface that is up and not a loopback interface if no name is given.
+// IPv4 addresses are preferred over IPv6 addresses.
+func lookupInterfaceIP(name string) (string, error) {
+	var ifaces []net.Interface
+	if name != "" {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return "", err
+		}
+		ifaces = []net.Interface{*iface}
 	} else {
-		hostnameStr += " "
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return "", err
+		}
+	}
+
+	ipv6 := ""
+	for _, iface := range ifaces {
+		if name == "" && (iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0) {
+			continue // ### continue, not a primary interface ###
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue // ### continue, no addresses ###
+		}
+		for _, addr := range addrs {
+			ipNet, isIPNet := addr.(*net.IPNet)
+			switch {
+			case !isIPNet || ipNet.IP.IsLinkLocalUnicast():
+				// Ignore
+			case ipNet.IP.To4() != nil:
+				return ipNet.IP.String(), nil // ### return, found IPv4 ###
+			case ipv6 == "":
+				ipv6 = ipNet.IP.String()
+			}
+		}
 	}
 
-	payload := make([]byte, len(hostnameStr)+baseLength)
-	len := copy(payload, []byte(hostnameStr))
-	copy(payload[len:], basePayload)
+	if ipv6 == "" {
+		return "", fmt.Errorf("No IP address found for interface \"%s\"", name)
+	}
+	return ipv6, nil
+}
 
-	return payload, stream
+// Format adds the hostname to the message.
+func (format *Hostname) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	hostname := format.hostname()
+
+	if hostname == "" {
+		return basePayload, stream // ### return, no hostname ###
+	}
+
+	switch format.position {
+	case hostnamePositionField:
+		if payload, injected := format.injectField(basePayload, hostname); injected {
+			return payload, stream // ### return, JSON object ###
+		}
+	case hostnamePositionPostfix:
+		return format.join(basePayload, []byte(hostname)), stream
+	}
+
+	return format.join([]byte(hostname), basePayload), stream
+}
+
+// join concatenates two strings using the configured separator.
+func (format *Hostname) join(first []byte, second []byte) []byte {
+	payload := make([]byte, len(first)+len(format.separator)+len(second))
+	offset := copy(payload, first)
+	offset += copy(payload[offset:], format.separator)
+	copy(payload[offset:], second)
+	return payload
+}
+
+// injectField stores the hostname in the configured field of a JSON object.
+// Returns false if the payload is not a JSON object.
+func (format *Hostname) injectField(payload []byte, hostname string) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false // ### return, not a JSON object ###
+	}
+
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(trimmed, &values); err != nil {
+		return nil, false // ### return, not a JSON object ###
+	}
+
+	values[format.field], _ = json.Marshal(hostname)
+	result, err := json.Marshal(values)
+	if err != nil {
+		return nil, false // ### return, invalid JSON ###
+	}
+	return result, true
 }
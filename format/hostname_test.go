@@ -0,0 +1,78 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHostnamePosition(t *testing.T) {
+	expect := shared.NewExpect(t)
+	hostname, _ := os.Hostname()
+
+	conf := core.NewPluginConfig("format.Hostname")
+	conf.Settings["HostnameSeparator"] = "|"
+
+	format := Hostname{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(hostname+"|test", string(result))
+
+	conf.Settings["HostnamePosition"] = "postfix"
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal("test|"+hostname, string(result))
+
+	conf.Settings["HostnamePosition"] = "field"
+	conf.Settings["HostnameField"] = "host"
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte(` {"message":"test","host":"other"}`)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"host":"`+hostname+`","message":"test"}`, string(result))
+
+	// Only JSON objects are modified
+	msg.Data = []byte(`["test"]`)
+	result, _ = format.Format(msg)
+	expect.Equal(hostname+`|["test"]`, string(result))
+
+	conf.Settings["HostnamePosition"] = "middle"
+	expect.NotNil(format.Configure(conf))
+}
+
+func TestHostnameIP(t *testing.T) {
+	expect := shared.NewExpect(t)
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skip("No loopback interface named lo")
+	}
+
+	conf := core.NewPluginConfig("format.Hostname")
+	conf.Settings["HostnameType"] = "ip"
+	conf.Settings["HostnameInterface"] = "lo"
+	conf.Settings["HostnamePosition"] = "field"
+
+	format := Hostname{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{}`), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(`{"hostname":"127.0.0.1"}`, string(result))
+}
@@ -15,26 +15,42 @@
 package format
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 	"hash/fnv"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Identifier is a formatter that will generate a (mostly) unique 64 bit
-// identifier number from the message timestamp and sequence number. The message
-// payload will not be encoded.
+// Identifier is a formatter that will generate a (mostly) unique identifier
+// for a message. The identifier can replace the message or can be added as
+// prefix or as a field of a JSON object so downstream systems can deduplicate
+// and trace individual messages.
 //
 //   - "<producer|stream>":
 //     Formatter: "format.Identifier"
-//     IdentifierType: "hash"
+//     IdentifierType: "uuidv7"
+//     IdentifierPosition: "field"
+//     IdentifierField: "id"
+//     IdentifierOverwrite: false
+//     IdentifierSeparator: " "
+//     IdentifierNodeID: -1
 //
 // IdentifierType defines the algorithm used to generate the message id.
-// This my be one of the following: "hash", "time", "seq", "seqhex".
-// By default this is set to "time".
+// This my be one of the following: "hash", "sha256", "time", "seq", "seqhex",
+// "uuidv4", "uuidv7" and "snowflake". By default this is set to "time".
 //  * When using "hash" the message payload will be hashed using fnv1a and returned
 // as hex.
+//  * When using "sha256" the message payload will be hashed using SHA-256 and
+// returned as hex, i.e. messages with the same payload get the same id.
 //  * When using "time" the id will be formatted YYMMDDHHmmSSxxxxxxx where x
 // denotes the sequence number modulo 10.000.000. I.e. 10mil messages per second
 // are possible before there is a collision.
@@ -42,12 +58,64 @@ import (
 // the sequence number.
 //  * When using "seqhex" the id will be returned as the hex representation of
 // the sequence number.
+//  * When using "uuidv4" (or "uuid") a random UUID is returned.
+//  * When using "uuidv7" a UUID starting with the current time is returned,
+// i.e. ids are sorted by their creation time.
+//  * When using "snowflake" a 64 bit integer built from the milliseconds since
+// 2015-01-01, IdentifierNodeID and a per millisecond counter is returned.
+// Up to 4096 ids per millisecond can be created per node.
+//
+// IdentifierPosition defines where the id is stored. Valid values are
+// "replace", "prefix" and "field". When set to "replace" the message is
+// replaced by the id. When set to "prefix" the id and IdentifierSeparator are
+// added in front of the message. When set to "field" the id is stored in the
+// field IdentifierField of a JSON object. Messages that are not a JSON object
+// are prefixed. Note that the keys of the resulting JSON object are sorted.
+// By default this is set to "replace".
+//
+// IdentifierField defines the JSON field used when IdentifierPosition is set
+// to "field". By default this is set to "id".
+//
+// IdentifierOverwrite can be set to true to replace an existing id field.
+// If set to false messages that already contain IdentifierField keep their id,
+// so an id is kept across multiple gollum instances. By default this is set
+// to false.
+//
+// IdentifierSeparator defines the string placed between the id and the
+// message when IdentifierPosition is set to "prefix". By default this is set
+// to " ".
+//
+// IdentifierNodeID defines the node id used by "snowflake" ids. Valid values
+// are 0 to 1023. Every gollum instance should use a different node id.
+// By default this is set to -1, i.e. the node id is derived from the hostname.
 //
 // IdentifierDataFormatter defines the formatter for the data that is used to
 // build the identifier from. By default this is set to "format.Forward"
 type Identifier struct {
-	base core.Formatter
-	hash func(msg core.Message) []byte
+	base      core.Formatter
+	hash      func(msg core.Message) []byte
+	position  string
+	field     string
+	overwrite bool
+	separator []byte
+	snowflake *identifierSnowflake
+}
+
+const (
+	identifierPositionReplace = "replace"
+	identifierPositionPrefix  = "prefix"
+	identifierPositionField   = "field"
+)
+
+// identifierSnowflakeEpoch is the start of snowflake ids in milliseconds
+// since 1970-01-01 (2015-01-01 00:00:00 UTC).
+const identifierSnowflakeEpoch = 1420070400000
+
+type identifierSnowflake struct {
+	node     int64
+	lastTime int64
+	sequence int64
+	guard    *sync.Mutex
 }
 
 func init() {
@@ -61,14 +129,39 @@ func (format *Identifier) Configure(conf core.PluginConfig) error {
 		return err
 	}
 	format.base = plugin.(core.Formatter)
+	format.field = conf.GetString("IdentifierField", "id")
+	format.overwrite = conf.GetBool("IdentifierOverwrite", false)
+	format.separator = []byte(conf.GetString("IdentifierSeparator", " "))
+
+	switch format.position = strings.ToLower(conf.GetString("IdentifierPosition", identifierPositionReplace)); format.position {
+	case identifierPositionReplace, identifierPositionPrefix, identifierPositionField:
+	default:
+		return fmt.Errorf("Identifier: Unknown IdentifierPosition \"%s\"", format.position)
+	}
 
 	switch strings.ToLower(conf.GetString("IdentifierType", "time")) {
 	case "hash":
 		format.hash = format.idHash
+	case "sha256":
+		format.hash = format.idSHA256
 	case "seq":
 		format.hash = format.idSeq
 	case "seqhex":
 		format.hash = format.idSeqHex
+	case "uuid", "uuidv4":
+		format.hash = format.idUUIDv4
+	case "uuidv7":
+		format.hash = format.idUUIDv7
+	case "snowflake":
+		node := int64(conf.GetInt("IdentifierNodeID", -1))
+		if node < 0 {
+			node = identifierHostNode()
+		}
+		if node > 1023 {
+			return fmt.Errorf("Identifier: IdentifierNodeID must be between 0 and 1023")
+		}
+		format.snowflake = &identifierSnowflake{node: node, guard: new(sync.Mutex)}
+		format.hash = format.idSnowflake
 	default:
 		fallthrough
 	case "time":
@@ -77,12 +170,25 @@ func (format *Identifier) Configure(conf core.PluginConfig) error {
 	return nil
 }
 
+// identifierHostNode derives a snowflake node id from the hostname.
+func identifierHostNode() int64 {
+	hostname, _ := os.Hostname()
+	hasher := fnv.New32a()
+	hasher.Write([]byte(hostname))
+	return int64(hasher.Sum32() % 1024)
+}
+
 func (format *Identifier) idHash(msg core.Message) []byte {
 	hasher := fnv.New64a()
 	hasher.Write(msg.Data)
 	return []byte(strconv.FormatUint(hasher.Sum64(), 16))
 }
 
+func (format *Identifier) idSHA256(msg core.Message) []byte {
+	hash := sha256.Sum256(msg.Data)
+	return []byte(hex.EncodeToString(hash[:]))
+}
+
 func (format *Identifier) idTime(msg core.Message) []byte {
 	return []byte(msg.Timestamp.Format("060102150405") + strconv.FormatUint(msg.Sequence%10000000, 10))
 }
@@ -95,9 +201,80 @@ func (format *Identifier) idSeqHex(msg core.Message) []byte {
 	return []byte(strconv.FormatUint(msg.Sequence, 16))
 }
 
+func (format *Identifier) idUUIDv4(msg core.Message) []byte {
+	return []byte(shared.NewUUIDv4().String())
+}
+
+func (format *Identifier) idUUIDv7(msg core.Message) []byte {
+	return []byte(shared.NewUUIDv7(time.Now()).String())
+}
+
+func (format *Identifier) idSnowflake(msg core.Message) []byte {
+	return []byte(strconv.FormatInt(format.snowflake.next(time.Now()), 10))
+}
+
+// next returns the next snowflake id. If the sequence of the current
+// millisecond is exhausted or the clock moved backwards the id of the next
+// free millisecond is used.
+func (snowflake *identifierSnowflake) next(now time.Time) int64 {
+	snowflake.guard.Lock()
+	defer snowflake.guard.Unlock()
+
+	timestamp := now.UnixNano()/int64(time.Millisecond) - identifierSnowflakeEpoch
+	if timestamp > snowflake.lastTime {
+		snowflake.lastTime = timestamp
+		snowflake.sequence = 0
+	} else if snowflake.sequence++; snowflake.sequence > 0xFFF {
+		snowflake.lastTime++
+		snowflake.sequence = 0
+	}
+
+	return snowflake.lastTime<<22 | snowflake.node<<12 | snowflake.sequence
+}
+
+// injectField stores the id in the configured field of a JSON object.
+// Returns false if the payload is not a JSON object.
+func (format *Identifier) injectField(payload []byte, id []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false // ### return, not a JSON object ###
+	}
+
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(trimmed, &values); err != nil {
+		return nil, false // ### return, not a JSON object ###
+	}
+
+	if _, exists := values[format.field]; exists && !format.overwrite {
+		return trimmed, true // ### return, keep existing id ###
+	}
+
+	values[format.field], _ = json.Marshal(string(id))
+	result, err := json.Marshal(values)
+	if err != nil {
+		return nil, false // ### return, invalid JSON ###
+	}
+	return result, true
+}
+
 // Format generates a unique identifier from the message contents or metadata.
 func (format *Identifier) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	dataMsg := msg
 	dataMsg.Data, dataMsg.StreamID = format.base.Format(msg)
-	return format.hash(dataMsg), dataMsg.StreamID
+	id := format.hash(dataMsg)
+
+	switch format.position {
+	case identifierPositionField:
+		if payload, injected := format.injectField(dataMsg.Data, id); injected {
+			return payload, dataMsg.StreamID // ### return, JSON object ###
+		}
+	case identifierPositionReplace:
+		return id, dataMsg.StreamID
+	}
+
+	payload := make([]byte, 0, len(id)+len(format.separator)+len(dataMsg.Data))
+	payload = append(payload, id...)
+	payload = append(payload, format.separator...)
+	payload = append(payload, dataMsg.Data...)
+	return payload, dataMsg.StreamID
 }
@@ -0,0 +1,114 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdentifierPosition(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Identifier")
+	conf.Settings["IdentifierType"] = "seq"
+
+	format := Identifier{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"message":"test"}`), 42)
+	result, _ := format.Format(msg)
+	expect.Equal("42", string(result))
+
+	conf.Settings["IdentifierPosition"] = "prefix"
+	conf.Settings["IdentifierSeparator"] = "|"
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal(`42|{"message":"test"}`, string(result))
+
+	conf.Settings["IdentifierPosition"] = "field"
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal(`{"id":"42","message":"test"}`, string(result))
+
+	// Existing ids are kept unless IdentifierOverwrite is set
+	msg.Data = []byte(`{"id":"1","message":"test"}`)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"id":"1","message":"test"}`, string(result))
+
+	conf.Settings["IdentifierOverwrite"] = true
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal(`{"id":"42","message":"test"}`, string(result))
+
+	// Only JSON objects are modified
+	msg.Data = []byte(`["test"]`)
+	result, _ = format.Format(msg)
+	expect.Equal(`42|["test"]`, string(result))
+
+	conf.Settings["IdentifierPosition"] = "middle"
+	expect.NotNil(format.Configure(conf))
+}
+
+func TestIdentifierTypes(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.Identifier")
+	conf.Settings["IdentifierPosition"] = "field"
+
+	msg := core.NewMessage(nil, []byte(`{"message":"test"}`), 0)
+	getID := func(format *Identifier) string {
+		result, _ := format.Format(msg)
+		values := map[string]string{}
+		expect.NoError(json.Unmarshal(result, &values))
+		return values["id"]
+	}
+
+	format := Identifier{}
+	conf.Settings["IdentifierType"] = "sha256"
+	expect.NoError(format.Configure(conf))
+	expect.Equal("4144005e3e781532fa967b3a15d3ccf5881c1da5ff6be0dc0db4a399631d187a", getID(&format))
+
+	conf.Settings["IdentifierType"] = "uuidv7"
+	expect.NoError(format.Configure(conf))
+	first := getID(&format)
+	expect.Equal(36, len(first))
+	expect.Equal("7", first[14:15])
+	expect.Neq(first, getID(&format))
+
+	conf.Settings["IdentifierType"] = "snowflake"
+	conf.Settings["IdentifierNodeID"] = 5
+	expect.NoError(format.Configure(conf))
+
+	id, err := strconv.ParseInt(getID(&format), 10, 64)
+	expect.NoError(err)
+	expect.Equal(int64(5), (id>>12)&0x3FF)
+	created := time.Unix(0, ((id>>22)+identifierSnowflakeEpoch)*int64(time.Millisecond))
+	expect.True(time.Since(created) < time.Minute)
+
+	// Ids of the same millisecond differ by their sequence
+	now := time.Now()
+	ids := map[int64]bool{}
+	for i := 0; i < 5000; i++ {
+		ids[format.snowflake.next(now)] = true
+	}
+	expect.Equal(5000, len(ids))
+
+	conf.Settings["IdentifierNodeID"] = 1024
+	expect.NotNil(format.Configure(conf))
+}
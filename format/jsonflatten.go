@@ -0,0 +1,192 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type jsonFlattenArrayMode int
+
+const (
+	jsonFlattenArraysIndex = jsonFlattenArrayMode(iota)
+	jsonFlattenArraysKeep  = jsonFlattenArrayMode(iota)
+	jsonFlattenArraysJSON  = jsonFlattenArrayMode(iota)
+)
+
+// JSONFlatten is a formatter that converts a nested JSON object into an
+// object with a single level of keys, e.g. {"a":{"b":1}} becomes {"a.b":1}.
+// This is required by targets that cannot store nested structures.
+// Messages that are not a valid JSON object are passed as-is and an error is
+// logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.JSONFlatten"
+//     JSONFlattenFormatter: "format.Forward"
+//     JSONFlattenSeparator: "."
+//     JSONFlattenArrays: "index"
+//
+// JSONFlattenFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// JSONFlattenSeparator defines the string used to join nested keys.
+// By default this is set to ".".
+//
+// JSONFlattenArrays defines how arrays are converted. When set to "index" each
+// array item is stored using its index as key, e.g. {"a.0":1,"a.1":2}. When set
+// to "keep" arrays are stored as-is. When set to "json" arrays are stored as a
+// string containing the JSON encoded array. Empty arrays and objects are always
+// stored as-is. By default this is set to "index".
+type JSONFlatten struct {
+	base      core.Formatter
+	separator string
+	arrays    jsonFlattenArrayMode
+}
+
+func init() {
+	shared.RuntimeType.Register(JSONFlatten{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONFlatten) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONFlattenFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.separator = conf.GetString("JSONFlattenSeparator", ".")
+
+	switch mode := conf.GetString("JSONFlattenArrays", "index"); strings.ToLower(mode) {
+	case "index":
+		format.arrays = jsonFlattenArraysIndex
+	case "keep":
+		format.arrays = jsonFlattenArraysKeep
+	case "json":
+		format.arrays = jsonFlattenArraysJSON
+	default:
+		return fmt.Errorf("JSONFlatten: Unknown array mode \"%s\"", mode)
+	}
+	return nil
+}
+
+// Format returns the message payload as flattened JSON object
+func (format *JSONFlatten) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	values, err := decodeJSONObject(basePayload)
+	if err != nil {
+		Log.Error.Print("JSONFlatten: ", err)
+		return basePayload, stream // ### return, not a JSON object ###
+	}
+
+	flat := make(map[string]interface{}, len(values))
+	if err := format.flatten(flat, "", values); err != nil {
+		Log.Error.Print("JSONFlatten: ", err)
+		return basePayload, stream // ### return, conflicting keys ###
+	}
+
+	payload, err := encodeJSON(flat)
+	if err != nil {
+		Log.Error.Print("JSONFlatten: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
+
+func (format *JSONFlatten) flatten(flat map[string]interface{}, prefix string, value interface{}) error {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		if len(typedValue) > 0 || prefix == "" {
+			for key, item := range typedValue {
+				if err := format.flatten(flat, format.join(prefix, key), item); err != nil {
+					return err
+				}
+			}
+			return nil // ### return, object flattened ###
+		}
+
+	case []interface{}:
+		if len(typedValue) > 0 {
+			switch format.arrays {
+			case jsonFlattenArraysIndex:
+				for idx, item := range typedValue {
+					if err := format.flatten(flat, format.join(prefix, strconv.Itoa(idx)), item); err != nil {
+						return err
+					}
+				}
+				return nil // ### return, array flattened ###
+
+			case jsonFlattenArraysJSON:
+				encoded, err := encodeJSON(typedValue)
+				if err != nil {
+					return err
+				}
+				value = string(encoded)
+			}
+		}
+	}
+
+	// Keys like "a.b" and {"a":{"b":...}} may exist in the same object
+	if _, exists := flat[prefix]; exists {
+		return fmt.Errorf("Key \"%s\" exists more than once", prefix)
+	}
+	flat[prefix] = value
+	return nil
+}
+
+func (format *JSONFlatten) join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + format.separator + key
+}
+
+// decodeJSONObject parses a message containing exactly one JSON object.
+// Numbers are decoded as json.Number to preserve their precision.
+func decodeJSONObject(payload []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	values := make(map[string]interface{})
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err // ### return, not a JSON object ###
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Trailing data after JSON object")
+	}
+	return values, nil
+}
+
+// encodeJSON encodes a value without escaping HTML characters and without a
+// trailing newline. Object keys are sorted.
+func encodeJSON(value interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
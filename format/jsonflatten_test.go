@@ -0,0 +1,75 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestJSONFlatten(t *testing.T) {
+	expect := shared.NewExpect(t)
+	format := JSONFlatten{}
+	conf := core.NewPluginConfig("format.JSONFlatten")
+	expect.NoError(format.Configure(conf))
+
+	testString := `{"a":{"b":{"c":1.50},"d":[true,{"e":"<x>"}]},"f":[],"g":{},"h":12345678901234567890}`
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	result, _ := format.Format(msg)
+	expect.Equal(`{"a.b.c":1.50,"a.d.0":true,"a.d.1.e":"<x>","f":[],"g":{},"h":12345678901234567890}`, string(result))
+
+	conf.Settings["JSONFlattenSeparator"] = "_"
+	conf.Settings["JSONFlattenArrays"] = "json"
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal(`{"a_b_c":1.50,"a_d":"[true,{\"e\":\"<x>\"}]","f":[],"g":{},"h":12345678901234567890}`, string(result))
+
+	// Conflicting keys and invalid JSON are passed as-is
+	msg = core.NewMessage(nil, []byte(`{"a_b":1,"a":{"b":2}}`), 0)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"a_b":1,"a":{"b":2}}`, string(result))
+
+	msg = core.NewMessage(nil, []byte(`[1,2]`), 0)
+	result, _ = format.Format(msg)
+	expect.Equal(`[1,2]`, string(result))
+
+	conf.Settings["JSONFlattenArrays"] = "unknown"
+	expect.NotNil(format.Configure(conf))
+}
+
+func TestJSONUnflatten(t *testing.T) {
+	expect := shared.NewExpect(t)
+	format := JSONUnflatten{}
+	conf := core.NewPluginConfig("format.JSONUnflatten")
+	expect.NoError(format.Configure(conf))
+
+	testString := `{"a.b.c":1.50,"a.d.0":true,"a.d.1.e":"x","a.f.1":2,"g":{"h":1},"g.i":2}`
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	result, _ := format.Format(msg)
+	expect.Equal(`{"a":{"b":{"c":1.50},"d":[true,{"e":"x"}],"f":{"1":2}},"g":{"h":1,"i":2}}`, string(result))
+
+	conf.Settings["JSONUnflattenArrays"] = false
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal(`{"a":{"b":{"c":1.50},"d":{"0":true,"1":{"e":"x"}},"f":{"1":2}},"g":{"h":1,"i":2}}`, string(result))
+
+	// Conflicting keys are passed as-is
+	msg = core.NewMessage(nil, []byte(`{"a":1,"a.b":2}`), 0)
+	result, _ = format.Format(msg)
+	expect.Equal(`{"a":1,"a.b":2}`, string(result))
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONUnflatten is a formatter that converts a JSON object with keys like
+// "a.b" into a nested object, e.g. {"a.b":1} becomes {"a":{"b":1}}. This is
+// the reverse of format.JSONFlatten.
+// Messages that are not a valid JSON object or contain conflicting keys like
+// "a" and "a.b" are passed as-is and an error is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.JSONUnflatten"
+//     JSONUnflattenFormatter: "format.Forward"
+//     JSONUnflattenSeparator: "."
+//     JSONUnflattenArrays: true
+//
+// JSONUnflattenFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// JSONUnflattenSeparator defines the string used to split keys.
+// By default this is set to ".".
+//
+// JSONUnflattenArrays can be set to true to convert objects whose keys are
+// the indexes 0 to n-1 into arrays, e.g. {"a.0":1,"a.1":2} becomes
+// {"a":[1,2]}. By default this is set to true.
+type JSONUnflatten struct {
+	base      core.Formatter
+	separator string
+	arrays    bool
+}
+
+func init() {
+	shared.RuntimeType.Register(JSONUnflatten{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONUnflatten) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("JSONUnflattenFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.separator = conf.GetString("JSONUnflattenSeparator", ".")
+	format.arrays = conf.GetBool("JSONUnflattenArrays", true)
+
+	if format.separator == "" {
+		return fmt.Errorf("JSONUnflatten: JSONUnflattenSeparator must not be empty")
+	}
+	return nil
+}
+
+// Format returns the message payload as nested JSON object
+func (format *JSONUnflatten) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	values, err := decodeJSONObject(basePayload)
+	if err != nil {
+		Log.Error.Print("JSONUnflatten: ", err)
+		return basePayload, stream // ### return, not a JSON object ###
+	}
+
+	// Sorting assures that "a" is always processed before "a.b"
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nested := make(map[string]interface{})
+	for _, key := range keys {
+		if err := format.set(nested, key, values[key]); err != nil {
+			Log.Error.Print("JSONUnflatten: ", err)
+			return basePayload, stream // ### return, conflicting keys ###
+		}
+	}
+
+	var result interface{} = nested
+	if format.arrays {
+		result = jsonObjectsToArrays(nested)
+	}
+
+	payload, err := encodeJSON(result)
+	if err != nil {
+		Log.Error.Print("JSONUnflatten: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
+
+func (format *JSONUnflatten) set(nested map[string]interface{}, key string, value interface{}) error {
+	path := strings.Split(key, format.separator)
+	node := nested
+
+	for _, segment := range path[:len(path)-1] {
+		child, exists := node[segment]
+		if !exists {
+			childNode := make(map[string]interface{})
+			node[segment] = childNode
+			node = childNode
+			continue // ### continue, new object ###
+		}
+
+		childNode, isObject := child.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("Key \"%s\" conflicts with a value", key)
+		}
+		node = childNode
+	}
+
+	last := path[len(path)-1]
+	if _, exists := node[last]; exists {
+		return fmt.Errorf("Key \"%s\" conflicts with an object", key)
+	}
+	node[last] = value
+	return nil
+}
+
+// jsonObjectsToArrays converts all objects whose keys are the indexes 0 to
+// n-1 into arrays. Objects with a single key "0" are converted, too.
+func jsonObjectsToArrays(value interface{}) interface{} {
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return value // ### return, nothing to convert ###
+	}
+
+	for key, item := range object {
+		object[key] = jsonObjectsToArrays(item)
+	}
+
+	if len(object) == 0 {
+		return object // ### return, empty object ###
+	}
+
+	array := make([]interface{}, len(object))
+	for key, item := range object {
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 || idx >= len(array) || strconv.Itoa(idx) != key {
+			return object // ### return, not an array ###
+		}
+		array[idx] = item
+	}
+	return array
+}
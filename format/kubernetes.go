@@ -0,0 +1,478 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	kubernetesErrorTTL       = 10 * time.Second
+	kubernetesRetryDelay     = 5 * time.Second
+)
+
+var (
+	// <pod>_<namespace>_<container>-<container id>.log
+	kubernetesContainerLog = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-[0-9a-f]{64}\.log$`)
+	// <namespace>_<pod>_<pod uid>/<container>/<restart count>.log
+	kubernetesPodLog = regexp.MustCompile(`([^_/]+)_([^_/]+)_[^_/]+/([^/]+)/[0-9]+\.log$`)
+)
+
+// Kubernetes formatter plugin
+// Kubernetes is a formatter that adds information about the Kubernetes pod a
+// message originates from to JSON objects. The pod is identified by its
+// namespace and name, read from the message metadata or parsed from the path
+// of the log file written by the kubelet. Pods are requested from the
+// Kubernetes API and cached. While the producer or stream using this formatter
+// is running, cached pods are updated by watching the API so changed labels
+// are visible immediately. Deleted pods are removed from the cache, expired
+// pods are removed once per cache TTL.
+// Messages that are not a JSON object are passed as-is and an error is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Kubernetes"
+//     KubernetesFormatter: "format.Forward"
+//     KubernetesDataKey: "kubernetes"
+//     KubernetesNamespaceKey: "label_io.kubernetes.pod.namespace"
+//     KubernetesPodKey: "label_io.kubernetes.pod.name"
+//     KubernetesPathKey: "file_path"
+//     KubernetesAPIServer: ""
+//     KubernetesTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token"
+//     KubernetesCAFile: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+//     KubernetesNodeName: ""
+//     KubernetesAnnotations: false
+//     KubernetesCacheTTLSec: 600
+//     KubernetesTimeoutMs: 2000
+//
+// The information is stored as an object containing the fields "namespace",
+// "pod", "uid", "node", "labels" and, if known, "container" and "annotations".
+// If the pod cannot be found or no API server is available only the known
+// fields are added.
+// Failed requests are retried after 10 seconds at the earliest.
+//
+// KubernetesFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// KubernetesDataKey defines the key used to store the pod information.
+// By default this is set to "kubernetes".
+//
+// KubernetesNamespaceKey defines the metadata key storing the namespace of the
+// pod. The default matches the labels attached by consumer.Docker.
+// By default this is set to "label_io.kubernetes.pod.namespace".
+//
+// KubernetesPodKey defines the metadata key storing the name of the pod.
+// By default this is set to "label_io.kubernetes.pod.name".
+//
+// KubernetesPathKey defines the metadata key storing the path of the log file
+// a message has been read from, as attached by consumer.File. The path is
+// used if the namespace or pod metadata is missing. Paths of the form
+// "/var/log/containers/<pod>_<namespace>_<container>-<id>.log" and
+// "/var/log/pods/<namespace>_<pod>_<uid>/<container>/<n>.log" are supported.
+// By default this is set to "file_path".
+//
+// KubernetesAPIServer defines the URL of the Kubernetes API. By default this
+// is set to "", i.e. the address given by the KUBERNETES_SERVICE_HOST and
+// KUBERNETES_SERVICE_PORT environment variables is used.
+//
+// KubernetesTokenFile defines the file containing the bearer token used to
+// authenticate. The file is read for each request so rotated tokens are used.
+// By default the token of the pod's service account is used.
+//
+// KubernetesCAFile defines the file containing the CA certificates used to
+// verify the API server. By default the CA of the pod's service account is
+// used if present.
+//
+// KubernetesNodeName restricts watching to pods running on the given node,
+// which is recommended when running gollum as a DaemonSet.
+// By default this is set to "", i.e. all pods are watched.
+//
+// KubernetesAnnotations can be set to true to add the pod annotations.
+// By default this is set to false.
+//
+// KubernetesCacheTTLSec defines the number of seconds a pod is cached.
+// By default this is set to 600.
+//
+// KubernetesTimeoutMs defines the maximum number of milliseconds to wait for
+// the Kubernetes API. By default this is set to 2000.
+type Kubernetes struct {
+	base         core.Formatter
+	client       *http.Client
+	apiServer    string
+	tokenFile    string
+	nodeName     string
+	dataKey      string
+	namespaceKey string
+	podKey       string
+	pathKey      string
+	annotations  bool
+	cacheTTL     time.Duration
+	pods         map[string]*kubernetesPodEntry
+	nextEviction time.Time
+	guard        *sync.Mutex
+	stopWatch    context.CancelFunc
+	watcher      sync.WaitGroup
+}
+
+// kubernetesPod contains the fields of a pod object used by this formatter.
+type kubernetesPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+// kubernetesPodEntry is not modified after ready has been closed. Updated pods
+// are stored as a new entry.
+type kubernetesPodEntry struct {
+	pod     *kubernetesPod
+	expires time.Time
+	ready   chan struct{}
+}
+
+type kubernetesWatchEvent struct {
+	Type   string        `json:"type"`
+	Object kubernetesPod `json:"object"`
+}
+
+func init() {
+	shared.RuntimeType.Register(Kubernetes{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Kubernetes) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("KubernetesFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.dataKey = conf.GetString("KubernetesDataKey", "kubernetes")
+	format.namespaceKey = conf.GetString("KubernetesNamespaceKey", "label_io.kubernetes.pod.namespace")
+	format.podKey = conf.GetString("KubernetesPodKey", "label_io.kubernetes.pod.name")
+	format.pathKey = conf.GetString("KubernetesPathKey", "file_path")
+	format.tokenFile = conf.GetString("KubernetesTokenFile", kubernetesServiceAccount+"token")
+	format.nodeName = conf.GetString("KubernetesNodeName", "")
+	format.annotations = conf.GetBool("KubernetesAnnotations", false)
+	format.cacheTTL = time.Duration(conf.GetInt("KubernetesCacheTTLSec", 600)) * time.Second
+
+	format.apiServer = strings.TrimRight(conf.GetString("KubernetesAPIServer", ""), "/")
+	if format.apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			Log.Error.Print("Kubernetes: KubernetesAPIServer is not set and gollum is not running in a cluster")
+			return nil // ### return, pods cannot be requested ###
+		}
+		format.apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	caFile := conf.GetString("KubernetesCAFile", kubernetesServiceAccount+"ca.crt")
+	if _, err := os.Stat(caFile); err != nil && !conf.HasValue("KubernetesCAFile") {
+		caFile = ""
+	}
+	tlsConfig, err := shared.NewClientTLSConfig(caFile, "", "", "", false)
+	if err != nil {
+		return err
+	}
+
+	format.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   time.Duration(conf.GetInt("KubernetesTimeoutMs", 2000)) * time.Millisecond,
+	}
+
+	format.pods = make(map[string]*kubernetesPodEntry)
+	format.guard = new(sync.Mutex)
+	return nil
+}
+
+// Start starts watching pods. This implements the core.FormatterRunner
+// interface.
+func (format *Kubernetes) Start() {
+	core.StartFormatter(format.base)
+	if format.client == nil || format.cacheTTL <= 0 {
+		return // ### return, nothing to watch ###
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	format.stopWatch = cancel
+	format.watcher.Add(1)
+	go func() {
+		defer format.watcher.Done()
+		format.watch(ctx)
+	}()
+}
+
+// Stop stops watching pods and waits until the watcher has finished. This
+// implements the core.FormatterRunner interface.
+func (format *Kubernetes) Stop() {
+	if format.stopWatch != nil {
+		format.stopWatch()
+		format.watcher.Wait()
+		format.stopWatch = nil
+	}
+	core.StopFormatter(format.base)
+}
+
+// newRequest creates a request to the Kubernetes API using the current token.
+func (format *Kubernetes) newRequest(path string, query url.Values) (*http.Request, error) {
+	requestURL := format.apiServer + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token, err := ioutil.ReadFile(format.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// requestPod returns the given pod or nil if it does not exist.
+func (format *Kubernetes) requestPod(namespace string, name string) (*kubernetesPod, error) {
+	req, err := format.newRequest(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := format.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		pod := new(kubernetesPod)
+		if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+			return nil, err
+		}
+		return pod, nil
+	case http.StatusNotFound:
+		return nil, nil // ### return, pod does not exist ###
+	default:
+		return nil, fmt.Errorf("Requesting pod %s/%s returned %s", namespace, name, resp.Status)
+	}
+}
+
+// getPod returns the given pod from the cache or requests it. Concurrent
+// requests for the same pod wait for the first one.
+func (format *Kubernetes) getPod(namespace string, name string) *kubernetesPod {
+	if format.client == nil {
+		return nil // ### return, no API server ###
+	}
+	key := namespace + "/" + name
+
+	format.guard.Lock()
+	now := time.Now()
+	entry, cached := format.pods[key]
+	if cached && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		format.guard.Unlock()
+		<-entry.ready
+		return entry.pod // ### return, cached ###
+	}
+
+	if now.After(format.nextEviction) {
+		format.evictExpired(now)
+	}
+	entry = &kubernetesPodEntry{ready: make(chan struct{})}
+	format.pods[key] = entry
+	format.guard.Unlock()
+
+	pod, err := format.requestPod(namespace, name)
+	expires := time.Now().Add(format.cacheTTL)
+	if err != nil {
+		Log.Error.Print("Kubernetes: ", err)
+		expires = time.Now().Add(kubernetesErrorTTL)
+	}
+
+	format.guard.Lock()
+	entry.pod = pod
+	entry.expires = expires
+	format.guard.Unlock()
+
+	close(entry.ready)
+	return pod
+}
+
+// evictExpired removes all expired pods from the cache. The guard has to be
+// locked by the caller.
+func (format *Kubernetes) evictExpired(now time.Time) {
+	for key, entry := range format.pods {
+		if entry.isReady() && now.After(entry.expires) {
+			delete(format.pods, key)
+		}
+	}
+	format.nextEviction = now.Add(format.cacheTTL)
+}
+
+// watch updates cached pods when they are modified and removes them when they
+// are deleted until the given context is cancelled.
+func (format *Kubernetes) watch(ctx context.Context) {
+	client := &http.Client{Transport: format.client.Transport}
+	query := url.Values{"watch": {"true"}}
+	if format.nodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+format.nodeName)
+	}
+
+	for {
+		if err := format.watchPods(ctx, client, query); err != nil && ctx.Err() == nil {
+			Log.Warning.Print("Kubernetes: watching pods failed: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return // ### return, stopped ###
+		case <-time.After(kubernetesRetryDelay):
+		}
+	}
+}
+
+func (format *Kubernetes) watchPods(ctx context.Context, client *http.Client, query url.Values) error {
+	req, err := format.newRequest("/api/v1/pods", query)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := kubernetesWatchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+
+		pod := event.Object
+		key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+
+		format.guard.Lock()
+		if entry, cached := format.pods[key]; cached && entry.isReady() {
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				format.pods[key] = &kubernetesPodEntry{
+					pod:     &pod,
+					expires: entry.expires,
+					ready:   entry.ready,
+				}
+			case "DELETED":
+				delete(format.pods, key)
+			}
+		}
+		format.guard.Unlock()
+	}
+}
+
+func (entry *kubernetesPodEntry) isReady() bool {
+	select {
+	case <-entry.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// getPodName returns the namespace, pod and container name of a message.
+func (format *Kubernetes) getPodName(msg core.Message) (namespace string, pod string, container string) {
+	namespace, pod = msg.Metadata[format.namespaceKey], msg.Metadata[format.podKey]
+	if namespace != "" && pod != "" {
+		return namespace, pod, ""
+	}
+
+	path := msg.Metadata[format.pathKey]
+	if match := kubernetesContainerLog.FindStringSubmatch(filepath.Base(path)); match != nil {
+		return match[2], match[1], match[3]
+	}
+	if match := kubernetesPodLog.FindStringSubmatch(filepath.ToSlash(path)); match != nil {
+		return match[1], match[2], match[3]
+	}
+	return "", "", ""
+}
+
+// Format returns the message payload with added pod information
+func (format *Kubernetes) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	namespace, name, container := format.getPodName(msg)
+	if namespace == "" || name == "" {
+		return basePayload, stream // ### return, not a pod ###
+	}
+
+	values, err := decodeJSONObject(basePayload)
+	if err != nil {
+		Log.Error.Print("Kubernetes: ", err)
+		return basePayload, stream // ### return, not a JSON object ###
+	}
+
+	info := map[string]interface{}{
+		"namespace": namespace,
+		"pod":       name,
+	}
+	if container != "" {
+		info["container"] = container
+	}
+
+	if pod := format.getPod(namespace, name); pod != nil {
+		info["uid"] = pod.Metadata.UID
+		info["node"] = pod.Spec.NodeName
+		info["labels"] = pod.Metadata.Labels
+		if pod.Metadata.Labels == nil {
+			info["labels"] = map[string]string{}
+		}
+		if format.annotations && len(pod.Metadata.Annotations) > 0 {
+			info["annotations"] = pod.Metadata.Annotations
+		}
+	}
+	values[format.dataKey] = info
+
+	payload, err := encodeJSON(values)
+	if err != nil {
+		Log.Error.Print("Kubernetes: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
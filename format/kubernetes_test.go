@@ -0,0 +1,121 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testKubernetesPod = `{"metadata":{"name":"p1","namespace":"ns","uid":"u1","labels":{"app":"%s"}},"spec":{"nodeName":"node1"}}`
+
+func TestKubernetes(t *testing.T) {
+	expect := shared.NewExpect(t)
+	requests := int32(0)
+	events := make(chan string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/namespaces/ns/pods/p1":
+			atomic.AddInt32(&requests, 1)
+			fmt.Fprintf(w, testKubernetesPod, "web")
+		case "/api/v1/pods":
+			w.(http.Flusher).Flush()
+			for event := range events {
+				fmt.Fprintf(w, `{"type":"%s","object":%s}`+"\n", event, fmt.Sprintf(testKubernetesPod, "api"))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	defer close(events)
+
+	format := Kubernetes{}
+	conf := core.NewPluginConfig("format.Kubernetes")
+	conf.Settings["KubernetesAPIServer"] = server.URL
+	conf.Settings["KubernetesTokenFile"] = ""
+	expect.NoError(format.Configure(conf))
+	format.Start()
+	defer format.Stop()
+
+	msg := core.NewMessage(nil, []byte(`{"msg":"x"}`), 0)
+	msg.Metadata = core.MessageMetadata{
+		"label_io.kubernetes.pod.namespace": "ns",
+		"label_io.kubernetes.pod.name":      "p1",
+	}
+
+	result, _ := format.Format(msg)
+	expect.Equal(`{"kubernetes":{"labels":{"app":"web"},"namespace":"ns","node":"node1","pod":"p1","uid":"u1"},"msg":"x"}`, string(result))
+	format.Format(msg)
+	expect.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	// Pods can be identified by the kubelet log file path
+	msg.Metadata = core.MessageMetadata{"file_path": "/var/log/containers/p1_ns_app-" + strings.Repeat("0a", 32) + ".log"}
+	result, _ = format.Format(msg)
+	expect.Equal(`{"kubernetes":{"container":"app","labels":{"app":"web"},"namespace":"ns","node":"node1","pod":"p1","uid":"u1"},"msg":"x"}`, string(result))
+
+	msg.Metadata = core.MessageMetadata{"file_path": "/var/log/pods/ns_p2_u2/app/0.log"}
+	result, _ = format.Format(msg)
+	expect.Equal(`{"kubernetes":{"container":"app","namespace":"ns","pod":"p2"},"msg":"x"}`, string(result))
+
+	// Cached pods are updated by watching
+	events <- "MODIFIED"
+	msg.Metadata = core.MessageMetadata{"label_io.kubernetes.pod.namespace": "ns", "label_io.kubernetes.pod.name": "p1"}
+	for i := 0; i < 100; i++ {
+		if result, _ = format.Format(msg); strings.Contains(string(result), "api") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect.Equal(`{"kubernetes":{"labels":{"app":"api"},"namespace":"ns","node":"node1","pod":"p1","uid":"u1"},"msg":"x"}`, string(result))
+	expect.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	// Deleted pods are removed from the cache
+	events <- "DELETED"
+	for i := 0; i < 100 && format.isCached("ns/p1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect.False(format.isCached("ns/p1"))
+
+	// Expired pods are removed from the cache
+	expect.True(format.isCached("ns/p2"))
+	format.guard.Lock()
+	format.pods["ns/p2"].expires = time.Now().Add(-time.Second)
+	format.nextEviction = time.Time{}
+	format.guard.Unlock()
+	format.Format(msg)
+	expect.False(format.isCached("ns/p2"))
+
+	// Messages without a pod or JSON object are passed as-is
+	msg.Data = []byte("text")
+	result, _ = format.Format(msg)
+	expect.Equal("text", string(result))
+}
+
+func (format *Kubernetes) isCached(key string) bool {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+	_, cached := format.pods[key]
+	return cached
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+)
+
+// LEEF is a formatter that converts a JSON object into an IBM QRadar Log Event
+// Extended Format (LEEF) message. Messages that are not valid JSON objects are
+// treated like an object storing the message in the key "message".
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.LEEF"
+//     LEEFFormatter: "format.Forward"
+//     LEEFFormatVersion: "2.0"
+//     LEEFDelimiter: "\t"
+//     LEEFVendor: "trivago"
+//     LEEFProduct: "gollum"
+//     LEEFProductVersion: ""
+//     LEEFEventIDField: "event_id"
+//     LEEFFields:
+//       "src": "client/ip"
+//       "devTime": "timestamp"
+//
+// Pipes and backslashes in header fields are escaped, line breaks are replaced
+// by spaces. Backslashes, line breaks and the delimiter are escaped in
+// attribute values. Nested objects and arrays are written as JSON.
+//
+// LEEFFormatter defines the formatter applied before the message is converted.
+// By default this is set to "format.Forward"
+//
+// LEEFFormatVersion defines the LEEF version to write. Can be "1.0" or "2.0".
+// By default this is set to "2.0".
+//
+// LEEFDelimiter defines the character used to separate attributes. Version 1.0
+// only supports tabs. By default this is set to "\t".
+//
+// LEEFVendor, LEEFProduct and LEEFProductVersion define the device fields of
+// the header. By default these are set to "trivago", "gollum" and "".
+//
+// LEEFEventIDField defines the field storing the event id. Missing values are
+// written as "unknown". By default this is set to "event_id".
+//
+// LEEFFields maps attribute names to fields of the message. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path. Missing fields are
+// not written. If no fields are set all fields except the event id are
+// written by using their name as attribute name. By default no fields are set.
+type LEEF struct {
+	base           core.Formatter
+	version        string
+	delimiter      byte
+	vendor         string
+	product        string
+	productVersion string
+	eventIDField   string
+	fields         map[string]string
+}
+
+func init() {
+	shared.RuntimeType.Register(LEEF{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *LEEF) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("LEEFFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.version = conf.GetString("LEEFFormatVersion", "2.0")
+	format.vendor = conf.GetString("LEEFVendor", "trivago")
+	format.product = conf.GetString("LEEFProduct", "gollum")
+	format.productVersion = conf.GetString("LEEFProductVersion", "")
+	format.eventIDField = conf.GetString("LEEFEventIDField", "event_id")
+	format.fields = conf.GetStringMap("LEEFFields", map[string]string{})
+
+	delimiter := shared.Unescape(conf.GetString("LEEFDelimiter", "\t"))
+	switch {
+	case format.version != "1.0" && format.version != "2.0":
+		return fmt.Errorf("LEEFFormatVersion must be 1.0 or 2.0")
+	case len(delimiter) != 1 || delimiter == "=" || delimiter == "\\":
+		return fmt.Errorf("LEEFDelimiter must be a single character other than '=' or '\\'")
+	case format.version == "1.0" && delimiter != "\t":
+		return fmt.Errorf("LEEFDelimiter must be a tab for LEEF 1.0")
+	}
+	format.delimiter = delimiter[0]
+	return nil
+}
+
+// Format returns the JSON object as LEEF message
+func (format *LEEF) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	values := decodeSIEMObject(basePayload)
+
+	buffer := bytes.Buffer{}
+	buffer.WriteString("LEEF:" + format.version + "|")
+	writeCEFHeaderValue(&buffer, format.vendor)
+	writeCEFHeaderValue(&buffer, format.product)
+	writeCEFHeaderValue(&buffer, format.productVersion)
+	writeCEFHeaderValue(&buffer, siemHeaderValue(values, format.eventIDField, "unknown"))
+
+	if format.version == "2.0" {
+		// Non-printable delimiters are written in hex notation
+		if format.delimiter > ' ' && format.delimiter < 0x7F && format.delimiter != '|' {
+			buffer.WriteByte(format.delimiter)
+		} else {
+			fmt.Fprintf(&buffer, "x%02X", format.delimiter)
+		}
+		buffer.WriteByte('|')
+	}
+
+	for i, field := range siemFields(values, format.fields, format.eventIDField) {
+		if i > 0 {
+			buffer.WriteByte(format.delimiter)
+		}
+		buffer.WriteString(field.key)
+		buffer.WriteByte('=')
+		writeSIEMValue(&buffer, field.value, format.delimiter)
+	}
+
+	return buffer.Bytes(), stream
+}
@@ -0,0 +1,900 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Field types as defined by google/protobuf/descriptor.proto
+const (
+	protobufTypeDouble   = 1
+	protobufTypeFloat    = 2
+	protobufTypeInt64    = 3
+	protobufTypeUint64   = 4
+	protobufTypeInt32    = 5
+	protobufTypeFixed64  = 6
+	protobufTypeFixed32  = 7
+	protobufTypeBool     = 8
+	protobufTypeString   = 9
+	protobufTypeGroup    = 10
+	protobufTypeMessage  = 11
+	protobufTypeBytes    = 12
+	protobufTypeUint32   = 13
+	protobufTypeEnum     = 14
+	protobufTypeSfixed32 = 15
+	protobufTypeSfixed64 = 16
+	protobufTypeSint32   = 17
+	protobufTypeSint64   = 18
+
+	protobufLabelRepeated = 3
+)
+
+type protobufField struct {
+	name     string
+	jsonName string
+	number   int
+	repeated bool
+	packed   bool
+	kind     int
+	typeName string
+}
+
+type protobufMessage struct {
+	name     string
+	fields   []*protobufField
+	byNumber map[int]*protobufField
+	byName   map[string]*protobufField
+	mapEntry bool
+}
+
+type protobufEnum struct {
+	byNumber map[int32]string
+	byName   map[string]int32
+}
+
+// protobufRegistry holds all message and enum types defined by a compiled
+// FileDescriptorSet (protoc --include_imports --descriptor_set_out).
+// Types are stored by their fully qualified name without leading dot.
+type protobufRegistry struct {
+	messages map[string]*protobufMessage
+	enums    map[string]*protobufEnum
+}
+
+func loadProtobufRegistry(path string) (*protobufRegistry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newProtobufRegistry(data)
+}
+
+func newProtobufRegistry(descriptorSet []byte) (*protobufRegistry, error) {
+	registry := &protobufRegistry{
+		messages: make(map[string]*protobufMessage),
+		enums:    make(map[string]*protobufEnum),
+	}
+
+	// FileDescriptorSet: repeated FileDescriptorProto file = 1
+	reader := shared.NewProtobufReader(descriptorSet)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != shared.ProtobufBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return nil, err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		file, err := reader.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.addFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+func (registry *protobufRegistry) addFile(data []byte) error {
+	var pkg, syntax string
+	var messages, enums [][]byte
+
+	// FileDescriptorProto: package = 2, message_type = 4, enum_type = 5,
+	// syntax = 12
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return err
+		}
+		if wireType != shared.ProtobufBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		value, err := reader.ReadBytes()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 2:
+			pkg = string(value)
+		case 4:
+			messages = append(messages, value)
+		case 5:
+			enums = append(enums, value)
+		case 12:
+			syntax = string(value)
+		}
+	}
+
+	for _, enum := range enums {
+		if err := registry.addEnum(pkg, enum); err != nil {
+			return err
+		}
+	}
+	for _, message := range messages {
+		if err := registry.addMessage(pkg, syntax == "proto3", message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protobufQualifiedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (registry *protobufRegistry) addEnum(scope string, data []byte) error {
+	enum := &protobufEnum{
+		byNumber: make(map[int32]string),
+		byName:   make(map[string]int32),
+	}
+	var name string
+
+	// EnumDescriptorProto: name = 1, value = 2
+	// EnumValueDescriptorProto: name = 1, number = 2
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return err
+		}
+		if wireType != shared.ProtobufBytes || (field != 1 && field != 2) {
+			if err := reader.Skip(wireType); err != nil {
+				return err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		value, err := reader.ReadBytes()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			name = string(value)
+			continue // ### continue, name ###
+		}
+
+		var valueName string
+		var valueNumber int32
+		valueReader := shared.NewProtobufReader(value)
+		for valueReader.HasData() {
+			valueField, valueWireType, err := valueReader.ReadTag()
+			if err != nil {
+				return err
+			}
+			switch {
+			case valueField == 1 && valueWireType == shared.ProtobufBytes:
+				nameBytes, err := valueReader.ReadBytes()
+				if err != nil {
+					return err
+				}
+				valueName = string(nameBytes)
+			case valueField == 2 && valueWireType == shared.ProtobufVarint:
+				number, err := valueReader.ReadVarint()
+				if err != nil {
+					return err
+				}
+				valueNumber = int32(number)
+			default:
+				if err := valueReader.Skip(valueWireType); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, exists := enum.byNumber[valueNumber]; !exists {
+			enum.byNumber[valueNumber] = valueName
+		}
+		enum.byName[valueName] = valueNumber
+	}
+
+	registry.enums[protobufQualifiedName(scope, name)] = enum
+	return nil
+}
+
+func (registry *protobufRegistry) addMessage(scope string, proto3 bool, data []byte) error {
+	message := &protobufMessage{
+		byNumber: make(map[int]*protobufField),
+		byName:   make(map[string]*protobufField),
+	}
+	var fields, nested, enums [][]byte
+
+	// DescriptorProto: name = 1, field = 2, nested_type = 3, enum_type = 4,
+	// options = 7 (MessageOptions: map_entry = 7)
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return err
+		}
+		if wireType != shared.ProtobufBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		value, err := reader.ReadBytes()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			message.name = protobufQualifiedName(scope, string(value))
+		case 2:
+			fields = append(fields, value)
+		case 3:
+			nested = append(nested, value)
+		case 4:
+			enums = append(enums, value)
+		case 7:
+			message.mapEntry = protobufReadBoolOption(value, 7)
+		}
+	}
+
+	for _, fieldData := range fields {
+		field, err := newProtobufField(fieldData, proto3)
+		if err != nil {
+			return err
+		}
+		message.fields = append(message.fields, field)
+		message.byNumber[field.number] = field
+		message.byName[field.name] = field
+		message.byName[field.jsonName] = field
+	}
+
+	for _, enum := range enums {
+		if err := registry.addEnum(message.name, enum); err != nil {
+			return err
+		}
+	}
+	for _, nestedMessage := range nested {
+		if err := registry.addMessage(message.name, proto3, nestedMessage); err != nil {
+			return err
+		}
+	}
+
+	registry.messages[message.name] = message
+	return nil
+}
+
+// protobufReadBoolOption returns the value of a bool field inside an options
+// message. Errors are treated as "not set".
+func protobufReadBoolOption(data []byte, option int) bool {
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return false
+		}
+		if field == option && wireType == shared.ProtobufVarint {
+			value, err := reader.ReadVarint()
+			return err == nil && value != 0 // ### return, found ###
+		}
+		if reader.Skip(wireType) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func newProtobufField(data []byte, proto3 bool) (*protobufField, error) {
+	field := new(protobufField)
+	packedSet := false
+
+	// FieldDescriptorProto: name = 1, number = 3, label = 4, type = 5,
+	// type_name = 6, options = 8 (FieldOptions: packed = 2), json_name = 10
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		fieldID, wireType, err := reader.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+
+		switch wireType {
+		case shared.ProtobufVarint:
+			value, err := reader.ReadVarint()
+			if err != nil {
+				return nil, err
+			}
+			switch fieldID {
+			case 3:
+				field.number = int(value)
+			case 4:
+				field.repeated = value == protobufLabelRepeated
+			case 5:
+				field.kind = int(value)
+			}
+
+		case shared.ProtobufBytes:
+			value, err := reader.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			switch fieldID {
+			case 1:
+				field.name = string(value)
+			case 6:
+				field.typeName = strings.TrimPrefix(string(value), ".")
+			case 8:
+				field.packed = protobufReadBoolOption(value, 2)
+				packedSet = protobufHasOption(value, 2)
+			case 10:
+				field.jsonName = string(value)
+			}
+
+		default:
+			if err := reader.Skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if field.jsonName == "" {
+		field.jsonName = protobufJSONName(field.name)
+	}
+
+	// Repeated scalar fields are packed by default in proto3
+	if proto3 && !packedSet && field.repeated {
+		switch field.kind {
+		case protobufTypeString, protobufTypeBytes, protobufTypeMessage, protobufTypeGroup:
+		default:
+			field.packed = true
+		}
+	}
+
+	return field, nil
+}
+
+func protobufHasOption(data []byte, option int) bool {
+	reader := shared.NewProtobufReader(data)
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return false
+		}
+		if field == option {
+			return true // ### return, found ###
+		}
+		if reader.Skip(wireType) != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// protobufJSONName converts a field name to lowerCamelCase as done by protoc.
+func protobufJSONName(name string) string {
+	jsonName := make([]byte, 0, len(name))
+	upper := false
+	for i := 0; i < len(name); i++ {
+		switch char := name[i]; {
+		case char == '_':
+			upper = true
+		case upper && char >= 'a' && char <= 'z':
+			jsonName = append(jsonName, char-'a'+'A')
+			upper = false
+		default:
+			jsonName = append(jsonName, char)
+			upper = false
+		}
+	}
+	return string(jsonName)
+}
+
+// decode converts a protobuf encoded message of the given type into a map that
+// can be marshalled into JSON using the proto3 JSON mapping.
+func (registry *protobufRegistry) decode(typeName string, data []byte) (map[string]interface{}, error) {
+	message, known := registry.messages[typeName]
+	if !known {
+		return nil, fmt.Errorf("Unknown message type %s", typeName)
+	}
+
+	result := make(map[string]interface{})
+	reader := shared.NewProtobufReader(data)
+
+	for reader.HasData() {
+		fieldID, wireType, err := reader.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+
+		field, known := message.byNumber[fieldID]
+		if !known {
+			if err := reader.Skip(wireType); err != nil {
+				return nil, err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		// Packed repeated fields contain several values
+		if wireType == shared.ProtobufBytes && field.repeated && protobufScalarWireType(field.kind) != shared.ProtobufBytes {
+			packed, err := reader.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			packedReader := shared.NewProtobufReader(packed)
+			for packedReader.HasData() {
+				value, err := registry.decodeValue(field, protobufScalarWireType(field.kind), &packedReader)
+				if err != nil {
+					return nil, err
+				}
+				result[field.jsonName] = protobufAppend(result[field.jsonName], value)
+			}
+			continue // ### continue, packed field ###
+		}
+
+		value, err := registry.decodeValue(field, wireType, &reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case registry.isMapField(field):
+			entry := value.(map[string]interface{})
+			fieldMap, _ := result[field.jsonName].(map[string]interface{})
+			if fieldMap == nil {
+				fieldMap = make(map[string]interface{})
+				result[field.jsonName] = fieldMap
+			}
+			key, hasKey := entry["key"]
+			if !hasKey {
+				key = protobufDefaultKey(registry.messages[field.typeName])
+			}
+			fieldMap[fmt.Sprint(key)] = entry["value"]
+
+		case field.repeated:
+			result[field.jsonName] = protobufAppend(result[field.jsonName], value)
+
+		default:
+			result[field.jsonName] = value
+		}
+	}
+
+	return result, nil
+}
+
+// protobufDefaultKey returns the key of a map entry that has no key field
+// set, i.e. the default value of the key type.
+func protobufDefaultKey(entry *protobufMessage) interface{} {
+	if keyField, known := entry.byNumber[1]; known {
+		switch keyField.kind {
+		case protobufTypeString:
+			return ""
+		case protobufTypeBool:
+			return false
+		}
+	}
+	return 0
+}
+
+func protobufAppend(list interface{}, value interface{}) []interface{} {
+	values, _ := list.([]interface{})
+	return append(values, value)
+}
+
+func (registry *protobufRegistry) isMapField(field *protobufField) bool {
+	if field.kind != protobufTypeMessage || !field.repeated {
+		return false
+	}
+	message, known := registry.messages[field.typeName]
+	return known && message.mapEntry
+}
+
+func protobufScalarWireType(kind int) shared.ProtobufWireType {
+	switch kind {
+	case protobufTypeDouble, protobufTypeFixed64, protobufTypeSfixed64:
+		return shared.ProtobufFixed64
+	case protobufTypeFloat, protobufTypeFixed32, protobufTypeSfixed32:
+		return shared.ProtobufFixed32
+	case protobufTypeString, protobufTypeBytes, protobufTypeMessage:
+		return shared.ProtobufBytes
+	case protobufTypeGroup:
+		return shared.ProtobufStartGroup
+	default:
+		return shared.ProtobufVarint
+	}
+}
+
+func protobufFloat(value float64) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "Infinity"
+	case math.IsInf(value, -1):
+		return "-Infinity"
+	default:
+		return value
+	}
+}
+
+func (registry *protobufRegistry) decodeValue(field *protobufField, wireType shared.ProtobufWireType, reader *shared.ProtobufReader) (interface{}, error) {
+	if expected := protobufScalarWireType(field.kind); wireType != expected {
+		return nil, fmt.Errorf("Field %s has wire type %d, expected %d", field.name, wireType, expected)
+	}
+
+	switch wireType {
+	case shared.ProtobufFixed64:
+		value, err := reader.ReadFixed64()
+		if err != nil {
+			return nil, err
+		}
+		switch field.kind {
+		case protobufTypeDouble:
+			return protobufFloat(math.Float64frombits(value)), nil
+		case protobufTypeSfixed64:
+			return strconv.FormatInt(int64(value), 10), nil
+		default:
+			return strconv.FormatUint(value, 10), nil
+		}
+
+	case shared.ProtobufFixed32:
+		value, err := reader.ReadFixed32()
+		if err != nil {
+			return nil, err
+		}
+		switch field.kind {
+		case protobufTypeFloat:
+			return protobufFloat(float64(math.Float32frombits(value))), nil
+		case protobufTypeSfixed32:
+			return int32(value), nil
+		default:
+			return value, nil
+		}
+
+	case shared.ProtobufBytes:
+		value, err := reader.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		switch field.kind {
+		case protobufTypeString:
+			return string(value), nil
+		case protobufTypeBytes:
+			return base64.StdEncoding.EncodeToString(value), nil
+		default:
+			return registry.decode(field.typeName, value)
+		}
+
+	case shared.ProtobufStartGroup:
+		return nil, fmt.Errorf("Field %s uses unsupported group encoding", field.name)
+
+	default:
+		value, err := reader.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		switch field.kind {
+		case protobufTypeBool:
+			return value != 0, nil
+		case protobufTypeInt64:
+			return strconv.FormatInt(int64(value), 10), nil
+		case protobufTypeUint64:
+			return strconv.FormatUint(value, 10), nil
+		case protobufTypeSint64:
+			return strconv.FormatInt(shared.ProtobufUnZigZag(value), 10), nil
+		case protobufTypeSint32:
+			return int32(shared.ProtobufUnZigZag(value)), nil
+		case protobufTypeUint32:
+			return uint32(value), nil
+		case protobufTypeEnum:
+			if enum, known := registry.enums[field.typeName]; known {
+				if name, known := enum.byNumber[int32(value)]; known {
+					return name, nil
+				}
+			}
+			return int32(value), nil
+		default:
+			return int32(value), nil
+		}
+	}
+}
+
+// encode converts a decoded JSON object into a protobuf message of the given
+// type. JSON numbers are expected to be decoded as json.Number.
+func (registry *protobufRegistry) encode(typeName string, value map[string]interface{}) ([]byte, error) {
+	message, known := registry.messages[typeName]
+	if !known {
+		return nil, fmt.Errorf("Unknown message type %s", typeName)
+	}
+
+	writer := shared.NewProtobufWriter(64)
+	for key, fieldValue := range value {
+		field, known := message.byName[key]
+		if !known {
+			return nil, fmt.Errorf("Unknown field %s in message %s", key, typeName)
+		}
+		if fieldValue == nil {
+			continue // ### continue, null equals unset ###
+		}
+
+		switch {
+		case registry.isMapField(field):
+			entries, isMap := fieldValue.(map[string]interface{})
+			if !isMap {
+				return nil, fmt.Errorf("Field %s must be an object", key)
+			}
+			for entryKey, entryValue := range entries {
+				entry, err := registry.encode(field.typeName, map[string]interface{}{
+					"key":   entryKey,
+					"value": entryValue,
+				})
+				if err != nil {
+					return nil, err
+				}
+				writer.WriteBytesField(field.number, entry)
+			}
+
+		case field.repeated:
+			values, isArray := fieldValue.([]interface{})
+			if !isArray {
+				return nil, fmt.Errorf("Field %s must be an array", key)
+			}
+			if field.packed {
+				packed := shared.NewProtobufWriter(len(values) * 4)
+				for _, item := range values {
+					if err := registry.encodeValue(&packed, field, item); err != nil {
+						return nil, err
+					}
+				}
+				writer.WriteBytesField(field.number, packed.Bytes())
+			} else {
+				for _, item := range values {
+					writer.WriteTag(field.number, protobufScalarWireType(field.kind))
+					if err := registry.encodeValue(&writer, field, item); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+		default:
+			writer.WriteTag(field.number, protobufScalarWireType(field.kind))
+			if err := registry.encodeValue(&writer, field, fieldValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return writer.Bytes(), nil
+}
+
+func protobufParseFloat(value interface{}) (float64, error) {
+	switch typedValue := value.(type) {
+	case json.Number:
+		return typedValue.Float64()
+	case string:
+		switch typedValue {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(typedValue, 64)
+	}
+	return 0, fmt.Errorf("Expected number, got %T", value)
+}
+
+func protobufParseInt(value interface{}, bits int) (int64, error) {
+	switch typedValue := value.(type) {
+	case json.Number:
+		return strconv.ParseInt(string(typedValue), 10, bits)
+	case string:
+		return strconv.ParseInt(typedValue, 10, bits)
+	}
+	return 0, fmt.Errorf("Expected integer, got %T", value)
+}
+
+func protobufParseUint(value interface{}, bits int) (uint64, error) {
+	switch typedValue := value.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(typedValue), 10, bits)
+	case string:
+		return strconv.ParseUint(typedValue, 10, bits)
+	}
+	return 0, fmt.Errorf("Expected unsigned integer, got %T", value)
+}
+
+func (registry *protobufRegistry) encodeValue(writer *shared.ProtobufWriter, field *protobufField, value interface{}) error {
+	switch field.kind {
+	case protobufTypeDouble:
+		number, err := protobufParseFloat(value)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed64(math.Float64bits(number))
+
+	case protobufTypeFloat:
+		number, err := protobufParseFloat(value)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed32(math.Float32bits(float32(number)))
+
+	case protobufTypeInt64, protobufTypeInt32:
+		bits := 64
+		if field.kind == protobufTypeInt32 {
+			bits = 32
+		}
+		number, err := protobufParseInt(value, bits)
+		if err != nil {
+			return err
+		}
+		writer.WriteVarint(uint64(number))
+
+	case protobufTypeUint64, protobufTypeUint32:
+		bits := 64
+		if field.kind == protobufTypeUint32 {
+			bits = 32
+		}
+		number, err := protobufParseUint(value, bits)
+		if err != nil {
+			return err
+		}
+		writer.WriteVarint(number)
+
+	case protobufTypeSint64:
+		number, err := protobufParseInt(value, 64)
+		if err != nil {
+			return err
+		}
+		writer.WriteVarint(shared.ProtobufZigZag64(number))
+
+	case protobufTypeSint32:
+		number, err := protobufParseInt(value, 32)
+		if err != nil {
+			return err
+		}
+		writer.WriteVarint(shared.ProtobufZigZag32(int32(number)))
+
+	case protobufTypeFixed64:
+		number, err := protobufParseUint(value, 64)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed64(number)
+
+	case protobufTypeSfixed64:
+		number, err := protobufParseInt(value, 64)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed64(uint64(number))
+
+	case protobufTypeFixed32:
+		number, err := protobufParseUint(value, 32)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed32(uint32(number))
+
+	case protobufTypeSfixed32:
+		number, err := protobufParseInt(value, 32)
+		if err != nil {
+			return err
+		}
+		writer.WriteFixed32(uint32(number))
+
+	case protobufTypeBool:
+		flag, isBool := value.(bool)
+		if text, isString := value.(string); isString {
+			// Map keys are always passed as strings
+			parsed, err := strconv.ParseBool(text)
+			flag, isBool = parsed, err == nil
+		}
+		if !isBool {
+			return fmt.Errorf("Field %s must be a boolean", field.name)
+		}
+		if flag {
+			writer.WriteVarint(1)
+		} else {
+			writer.WriteVarint(0)
+		}
+
+	case protobufTypeEnum:
+		if name, isString := value.(string); isString {
+			enum, known := registry.enums[field.typeName]
+			if !known {
+				return fmt.Errorf("Unknown enum type %s", field.typeName)
+			}
+			number, known := enum.byName[name]
+			if !known {
+				return fmt.Errorf("Unknown value %s for enum %s", name, field.typeName)
+			}
+			writer.WriteVarint(uint64(int64(number)))
+		} else {
+			number, err := protobufParseInt(value, 32)
+			if err != nil {
+				return err
+			}
+			writer.WriteVarint(uint64(number))
+		}
+
+	case protobufTypeString:
+		text, isString := value.(string)
+		if !isString {
+			return fmt.Errorf("Field %s must be a string", field.name)
+		}
+		writer.WriteBytes([]byte(text))
+
+	case protobufTypeBytes:
+		text, isString := value.(string)
+		if !isString {
+			return fmt.Errorf("Field %s must be a base64 string", field.name)
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return err
+		}
+		writer.WriteBytes(data)
+
+	case protobufTypeMessage:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("Field %s must be an object", field.name)
+		}
+		data, err := registry.encode(field.typeName, object)
+		if err != nil {
+			return err
+		}
+		writer.WriteBytes(data)
+
+	default:
+		return fmt.Errorf("Field %s uses an unsupported type", field.name)
+	}
+	return nil
+}
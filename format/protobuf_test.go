@@ -0,0 +1,149 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestProtobufField(name string, number, label, kind int, typeName string) []byte {
+	field := shared.NewProtobufWriter(32)
+	field.WriteStringField(1, name)
+	field.WriteVarintField(3, uint64(number))
+	field.WriteVarintField(4, uint64(label))
+	field.WriteVarintField(5, uint64(kind))
+	if typeName != "" {
+		field.WriteStringField(6, typeName)
+	}
+	return field.Bytes()
+}
+
+// newTestProtobufDescriptorSet creates the descriptor set for
+//
+//	syntax = "proto3";
+//	package test;
+//	message Msg {
+//	  enum Kind { UNKNOWN = 0; KIND_A = 1; }
+//	  message Inner { bool flag = 1; }
+//	  string name = 1;
+//	  int64 user_id = 2;
+//	  repeated int32 values = 3;
+//	  Kind kind = 4;
+//	  Inner inner = 5;
+//	  map<string, int32> counts = 6;
+//	  bytes raw = 7;
+//	  sint32 delta = 8;
+//	  double score = 9;
+//	}
+func newTestProtobufDescriptorSet() []byte {
+	enumValue := func(name string, number int) []byte {
+		value := shared.NewProtobufWriter(16)
+		value.WriteStringField(1, name)
+		value.WriteVarintField(2, uint64(number))
+		return value.Bytes()
+	}
+
+	enum := shared.NewProtobufWriter(64)
+	enum.WriteStringField(1, "Kind")
+	enum.WriteBytesField(2, enumValue("UNKNOWN", 0))
+	enum.WriteBytesField(2, enumValue("KIND_A", 1))
+
+	inner := shared.NewProtobufWriter(64)
+	inner.WriteStringField(1, "Inner")
+	inner.WriteBytesField(2, newTestProtobufField("flag", 1, 1, protobufTypeBool, ""))
+
+	mapOptions := shared.NewProtobufWriter(2)
+	mapOptions.WriteVarintField(7, 1)
+
+	entry := shared.NewProtobufWriter(64)
+	entry.WriteStringField(1, "CountsEntry")
+	entry.WriteBytesField(2, newTestProtobufField("key", 1, 1, protobufTypeString, ""))
+	entry.WriteBytesField(2, newTestProtobufField("value", 2, 1, protobufTypeInt32, ""))
+	entry.WriteBytesField(7, mapOptions.Bytes())
+
+	message := shared.NewProtobufWriter(512)
+	message.WriteStringField(1, "Msg")
+	message.WriteBytesField(2, newTestProtobufField("name", 1, 1, protobufTypeString, ""))
+	message.WriteBytesField(2, newTestProtobufField("user_id", 2, 1, protobufTypeInt64, ""))
+	message.WriteBytesField(2, newTestProtobufField("values", 3, protobufLabelRepeated, protobufTypeInt32, ""))
+	message.WriteBytesField(2, newTestProtobufField("kind", 4, 1, protobufTypeEnum, ".test.Msg.Kind"))
+	message.WriteBytesField(2, newTestProtobufField("inner", 5, 1, protobufTypeMessage, ".test.Msg.Inner"))
+	message.WriteBytesField(2, newTestProtobufField("counts", 6, protobufLabelRepeated, protobufTypeMessage, ".test.Msg.CountsEntry"))
+	message.WriteBytesField(2, newTestProtobufField("raw", 7, 1, protobufTypeBytes, ""))
+	message.WriteBytesField(2, newTestProtobufField("delta", 8, 1, protobufTypeSint32, ""))
+	message.WriteBytesField(2, newTestProtobufField("score", 9, 1, protobufTypeDouble, ""))
+	message.WriteBytesField(3, inner.Bytes())
+	message.WriteBytesField(3, entry.Bytes())
+	message.WriteBytesField(4, enum.Bytes())
+
+	file := shared.NewProtobufWriter(1024)
+	file.WriteStringField(1, "test.proto")
+	file.WriteStringField(2, "test")
+	file.WriteBytesField(4, message.Bytes())
+	file.WriteStringField(12, "proto3")
+
+	set := shared.NewProtobufWriter(1024)
+	set.WriteBytesField(1, file.Bytes())
+	return set.Bytes()
+}
+
+func TestProtobufFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	descriptorFile, err := ioutil.TempFile("", "gollum_protobuf")
+	expect.NoError(err)
+	descriptorFile.Write(newTestProtobufDescriptorSet())
+	descriptorFile.Close()
+	defer os.Remove(descriptorFile.Name())
+
+	conf := core.NewPluginConfig("format.ProtobufEncode")
+	conf.Settings["ProtobufDescriptorSet"] = descriptorFile.Name()
+	conf.Settings["ProtobufMessage"] = "test.Msg"
+
+	encoder := ProtobufEncode{}
+	expect.NoError(encoder.Configure(conf))
+	decoder := ProtobufDecode{}
+	expect.NoError(decoder.Configure(conf))
+
+	testString := `{"name":"test","user_id":12345678901234,"values":[1,-2,3],"kind":"KIND_A",` +
+		`"inner":{"flag":true},"counts":{"a":1},"raw":"AAE=","delta":-5,"score":1.5}`
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	encoded, _ := encoder.Format(msg)
+	expect.Neq(testString, string(encoded))
+
+	// Values are packed in proto3 (tag 3, wire type 2)
+	reader := shared.NewProtobufReader(encoded)
+	for reader.HasData() {
+		field, wireType, _ := reader.ReadTag()
+		if field == 3 {
+			expect.Equal(shared.ProtobufBytes, wireType)
+		}
+		reader.Skip(wireType)
+	}
+
+	msg.Data = encoded
+	decoded, _ := decoder.Format(msg)
+	expect.Equal(`{"counts":{"a":1},"delta":-5,"inner":{"flag":true},"kind":"KIND_A",`+
+		`"name":"test","raw":"AAE=","score":1.5,"userId":"12345678901234","values":[1,-2,3]}`, string(decoded))
+
+	// Unknown message types are rejected
+	conf.Settings["ProtobufMessage"] = "test.Unknown"
+	expect.NotNil(decoder.Configure(conf))
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// ProtobufDecode is a formatter that converts a protobuf encoded message into
+// JSON. The message layout is read from a compiled FileDescriptorSet so no
+// generated code is required. If a message cannot be decoded an error will be
+// logged and the message is passed as-is.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.ProtobufDecode"
+//     ProtobufDecodeFormatter: "format.Forward"
+//     ProtobufDescriptorSet: "/etc/gollum/service.pb"
+//     ProtobufMessage: "mypackage.MyMessage"
+//
+// ProtobufDescriptorSet defines the path to a FileDescriptorSet as generated by
+// "protoc --include_imports --descriptor_set_out". This setting is required
+// to decode messages. By default this is set to "".
+//
+// ProtobufMessage defines the fully qualified name of the message type to
+// decode. By default this is set to "".
+//
+// Fields are converted by using the proto3 JSON mapping, i.e. field names are
+// written in lowerCamelCase, 64 bit integers are written as strings, bytes
+// are base64 encoded and enums are written by name. Unknown fields are ignored.
+//
+// ProtobufDecodeFormatter defines the formatter applied before the message is
+// decoded. By default this is set to "format.Forward"
+type ProtobufDecode struct {
+	base        core.Formatter
+	registry    *protobufRegistry
+	messageType string
+}
+
+func init() {
+	shared.RuntimeType.Register(ProtobufDecode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *ProtobufDecode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("ProtobufDecodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.registry, format.messageType, err = configureProtobuf(conf)
+	return err
+}
+
+// configureProtobuf loads the descriptor set and validates the message type
+// configured for the protobuf formatters.
+func configureProtobuf(conf core.PluginConfig) (*protobufRegistry, string, error) {
+	descriptorFile := conf.GetString("ProtobufDescriptorSet", "")
+	messageType := conf.GetString("ProtobufMessage", "")
+	if descriptorFile == "" {
+		return nil, messageType, nil // ### return, not configured ###
+	}
+
+	registry, err := loadProtobufRegistry(descriptorFile)
+	if err != nil {
+		return nil, messageType, err
+	}
+	if _, known := registry.messages[messageType]; !known {
+		return nil, messageType, fmt.Errorf("Message type %s not found in %s", messageType, descriptorFile)
+	}
+	return registry, messageType, nil
+}
+
+// Format returns the protobuf message as JSON
+func (format *ProtobufDecode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	if format.registry == nil {
+		Log.Error.Print("ProtobufDecode: No descriptor set configured")
+		return basePayload, stream // ### return, not configured ###
+	}
+
+	decoded, err := format.registry.decode(format.messageType, basePayload)
+	if err != nil {
+		Log.Error.Print("ProtobufDecode: ", err)
+		return basePayload, stream // ### return, invalid message ###
+	}
+
+	payload, err := json.Marshal(decoded)
+	if err != nil {
+		Log.Error.Print("ProtobufDecode: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
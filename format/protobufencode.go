@@ -0,0 +1,95 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// ProtobufEncode is a formatter that converts a JSON object into a protobuf
+// encoded message. This is the counterpart to format.ProtobufDecode.
+// If a message cannot be encoded an error will be logged and the message is
+// passed as-is.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.ProtobufEncode"
+//     ProtobufEncodeFormatter: "format.Forward"
+//     ProtobufDescriptorSet: "/etc/gollum/service.pb"
+//     ProtobufMessage: "mypackage.MyMessage"
+//
+// ProtobufDescriptorSet defines the path to a FileDescriptorSet as generated by
+// "protoc --include_imports --descriptor_set_out". This setting is required
+// to encode messages. By default this is set to "".
+//
+// ProtobufMessage defines the fully qualified name of the message type to
+// encode. By default this is set to "".
+//
+// Fields may be given by their original name or their lowerCamelCase JSON
+// name. Values are expected to follow the proto3 JSON mapping, but numbers
+// are accepted for 64 bit integers, too. Unknown fields cause an error.
+//
+// ProtobufEncodeFormatter defines the formatter applied before the message is
+// encoded. By default this is set to "format.Forward"
+type ProtobufEncode struct {
+	base        core.Formatter
+	registry    *protobufRegistry
+	messageType string
+}
+
+func init() {
+	shared.RuntimeType.Register(ProtobufEncode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *ProtobufEncode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("ProtobufEncodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.registry, format.messageType, err = configureProtobuf(conf)
+	return err
+}
+
+// Format returns the JSON message as protobuf
+func (format *ProtobufEncode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+	if format.registry == nil {
+		Log.Error.Print("ProtobufEncode: No descriptor set configured")
+		return basePayload, stream // ### return, not configured ###
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(basePayload))
+	decoder.UseNumber()
+
+	value := make(map[string]interface{})
+	if err := decoder.Decode(&value); err != nil {
+		Log.Error.Print("ProtobufEncode: ", err)
+		return basePayload, stream // ### return, not JSON ###
+	}
+
+	payload, err := format.registry.encode(format.messageType, value)
+	if err != nil {
+		Log.Error.Print("ProtobufEncode: ", err)
+		return basePayload, stream // ### return, invalid message ###
+	}
+	return payload, stream
+}
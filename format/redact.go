@@ -0,0 +1,299 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Redact is a formatter that removes personally identifiable information
+// from messages, e.g. to ship logs in compliance with the GDPR.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Redact"
+//     RedactFormatter: "format.Forward"
+//     RedactDetectors:
+//       - "email"
+//       - "ipv4"
+//       - "ipv6"
+//       - "creditcard"
+//     RedactPatterns:
+//       "userid": "user-[0-9]+"
+//     RedactAction: "mask"
+//     RedactActions:
+//       "email": "tokenize"
+//     RedactMask: "[REDACTED]"
+//     RedactKey: ""
+//     RedactPolicy:
+//       "audit": "creditcard"
+//       "debug": "none"
+//
+// RedactFormatter defines the formatter applied before redacting.
+// By default this is set to "format.Forward".
+//
+// RedactDetectors defines the detectors applied to all streams not listed in
+// RedactPolicy. Built-in detectors are "email", "ipv4", "ipv6" and
+// "creditcard". Credit card numbers may contain spaces or dashes and are
+// validated using the Luhn checksum. IPv6 addresses are validated and need
+// at least two non-empty groups so that e.g. timestamps are not redacted.
+// By default all built-in detectors are used.
+//
+// RedactPatterns defines additional detectors as a map of detector name to
+// regular expression. Custom detectors are applied to all streams not listed
+// in RedactPolicy after the detectors from RedactDetectors. They can be used
+// in RedactPolicy, too. By default this is set to an empty map.
+//
+// RedactAction defines how detected values are replaced. When set to "mask"
+// values are replaced by RedactMask. When set to "hash" values are replaced by
+// the hex encoded HMAC-SHA256 of the value. When set to "tokenize" values are
+// replaced by the name of the detector followed by the first 16 characters of
+// the hash, e.g. "email_1a2b3c4d5e6f7a8b". Hashes and tokens are stable, so
+// values can still be correlated across messages. By default this is set to
+// "mask".
+//
+// RedactActions defines the action per detector as a map of detector name to
+// action. Detectors not listed use RedactAction. By default this is set to an
+// empty map.
+//
+// RedactMask defines the replacement used by the "mask" action.
+// By default this is set to "[REDACTED]".
+//
+// RedactKey defines the secret key used for hashing. A key should be set when
+// using "hash" or "tokenize", otherwise values with a small range like IP
+// addresses can be recovered by brute force. By default this is set to "".
+//
+// RedactPolicy defines the detectors per stream as a map of stream name to a
+// comma separated list of detectors. Set a stream to "none" to disable
+// redaction for this stream. By default this is set to an empty map, i.e.
+// RedactDetectors is used for all streams.
+type Redact struct {
+	base     core.Formatter
+	policies map[core.MessageStreamID][]redactDetector
+	mask     []byte
+	key      []byte
+}
+
+type redactAction int
+
+const (
+	redactMask = redactAction(iota)
+	redactHash
+	redactTokenize
+)
+
+type redactDetector struct {
+	name     string
+	exp      *regexp.Regexp
+	validate func([]byte) bool
+	action   redactAction
+}
+
+var redactBuiltinDetectors = []redactDetector{
+	{name: "email", exp: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)},
+	{name: "ipv4", exp: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`)},
+	{name: "ipv6", exp: regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f]{1,4})?`), validate: isRedactIPv6},
+	{name: "creditcard", exp: regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`), validate: isRedactCreditCard},
+}
+
+func init() {
+	shared.RuntimeType.Register(Redact{})
+}
+
+// isRedactIPv6 returns true if the given value is a valid IPv6 address with
+// at least two non-empty groups. This excludes values like "::" or "std::".
+func isRedactIPv6(value []byte) bool {
+	if len(value) > 45 || net.ParseIP(string(value)) == nil {
+		return false // ### return, no IPv6 address ###
+	}
+	groups := 0
+	for _, group := range strings.Split(string(value), ":") {
+		if group != "" {
+			groups++
+		}
+	}
+	return groups >= 2
+}
+
+// isRedactCreditCard returns true if the given value contains 13 to 19
+// digits that pass the Luhn checksum.
+func isRedactCreditCard(value []byte) bool {
+	digits := make([]byte, 0, len(value))
+	for _, char := range value {
+		if char >= '0' && char <= '9' {
+			digits = append(digits, char-'0')
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false // ### return, invalid length ###
+	}
+
+	sum := 0
+	for i := range digits {
+		digit := int(digits[len(digits)-1-i])
+		if i%2 == 1 {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+func parseRedactAction(action string) (redactAction, error) {
+	switch strings.ToLower(action) {
+	case "mask":
+		return redactMask, nil
+	case "hash":
+		return redactHash, nil
+	case "tokenize":
+		return redactTokenize, nil
+	default:
+		return redactMask, fmt.Errorf("Redact: Unknown action \"%s\"", action)
+	}
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Redact) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("RedactFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+	format.mask = []byte(conf.GetString("RedactMask", "[REDACTED]"))
+	format.key = []byte(conf.GetString("RedactKey", ""))
+
+	defaultAction, err := parseRedactAction(conf.GetString("RedactAction", "mask"))
+	if err != nil {
+		return err
+	}
+	actions := conf.GetStringMap("RedactActions", map[string]string{})
+
+	// Collect all detectors
+	detectors := make(map[string]redactDetector)
+	defaultNames := []string{}
+	for _, detector := range redactBuiltinDetectors {
+		detectors[detector.name] = detector
+		defaultNames = append(defaultNames, detector.name)
+	}
+
+	patterns := conf.GetStringMap("RedactPatterns", map[string]string{})
+	customNames := make([]string, 0, len(patterns))
+	for name, pattern := range patterns {
+		exp, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Redact: Invalid pattern for \"%s\": %s", name, err.Error())
+		}
+		detectors[name] = redactDetector{name: name, exp: exp}
+		customNames = append(customNames, name)
+	}
+	sort.Strings(customNames)
+	defaultNames = append(defaultNames, customNames...)
+
+	for name, action := range actions {
+		detector, exists := detectors[name]
+		if !exists {
+			return fmt.Errorf("Redact: Unknown detector \"%s\" in RedactActions", name)
+		}
+		if detector.action, err = parseRedactAction(action); err != nil {
+			return err
+		}
+		detectors[name] = detector
+	}
+
+	getDetectors := func(names []string) ([]redactDetector, error) {
+		policy := []redactDetector{}
+		used := make(map[string]bool)
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			if name == "" || name == "none" || used[name] {
+				continue // ### continue, no detector ###
+			}
+			used[name] = true
+			detector, exists := detectors[name]
+			if !exists {
+				return nil, fmt.Errorf("Redact: Unknown detector \"%s\"", name)
+			}
+			if _, hasAction := actions[name]; !hasAction {
+				detector.action = defaultAction
+			}
+			policy = append(policy, detector)
+		}
+		return policy, nil
+	}
+
+	if conf.HasValue("RedactDetectors") {
+		defaultNames = append(conf.GetStringArray("RedactDetectors", []string{}), customNames...)
+	}
+
+	format.policies = make(map[core.MessageStreamID][]redactDetector)
+	if format.policies[core.WildcardStreamID], err = getDetectors(defaultNames); err != nil {
+		return err
+	}
+	for streamID, names := range conf.GetStreamMap("RedactPolicy", "") {
+		if format.policies[streamID], err = getDetectors(strings.Split(names, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace returns the replacement for a detected value.
+func (format *Redact) replace(detector redactDetector, value []byte) []byte {
+	switch detector.action {
+	case redactHash, redactTokenize:
+		hash := hmac.New(sha256.New, format.key)
+		hash.Write(value)
+		digest := hex.EncodeToString(hash.Sum(nil))
+		if detector.action == redactTokenize {
+			return []byte(detector.name + "_" + digest[:16])
+		}
+		return []byte(digest)
+
+	default:
+		return format.mask
+	}
+}
+
+// Format removes all values found by the detectors configured for the
+// stream of the message.
+func (format *Redact) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	policy, exists := format.policies[msg.StreamID]
+	if !exists {
+		policy = format.policies[core.WildcardStreamID]
+	}
+
+	for _, detector := range policy {
+		data = detector.exp.ReplaceAllFunc(data, func(value []byte) []byte {
+			if detector.validate != nil && !detector.validate(value) {
+				return value // ### return, false positive ###
+			}
+			return format.replace(detector, value)
+		})
+	}
+	return data, streamID
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"testing"
+)
+
+func TestRedactFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Redact")
+	format := Redact{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("mail john.doe@example.com from 10.1.2.3 and fe80::1ff:fe23:4567:890a"), 0)
+	result, _ := format.Format(msg)
+	expect.Equal("mail [REDACTED] from [REDACTED] and [REDACTED]", string(result))
+
+	// Timestamps, C++ scopes and invalid card numbers are kept
+	msg.Data = []byte("12:30:45 std::string 4111 1111 1111 1112 card 4111-1111-1111-1111")
+	result, _ = format.Format(msg)
+	expect.Equal("12:30:45 std::string 4111 1111 1111 1112 card [REDACTED]", string(result))
+
+	// Actions and custom patterns
+	conf.Settings["RedactDetectors"] = []interface{}{"email"}
+	conf.Settings["RedactPatterns"] = map[interface{}]interface{}{"userid": "user-[0-9]+"}
+	conf.Settings["RedactAction"] = "hash"
+	conf.Settings["RedactActions"] = map[interface{}]interface{}{"userid": "tokenize"}
+	conf.Settings["RedactKey"] = "secret"
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte("a@example.com user-42 10.1.2.3")
+	result, _ = format.Format(msg)
+	parts := strings.Split(string(result), " ")
+	expect.Equal(3, len(parts))
+	expect.Equal(64, len(parts[0]))
+	expect.True(strings.HasPrefix(parts[1], "userid_"))
+	expect.Equal(23, len(parts[1]))
+	expect.Equal("10.1.2.3", parts[2])
+
+	again, _ := format.Format(msg)
+	expect.Equal(string(result), string(again))
+
+	// Per-stream policies
+	conf.Settings["RedactPolicy"] = map[interface{}]interface{}{"debug": "none", "audit": "ipv4"}
+	expect.NoError(format.Configure(conf))
+
+	msg.StreamID = core.GetStreamID("debug")
+	result, _ = format.Format(msg)
+	expect.Equal("a@example.com user-42 10.1.2.3", string(result))
+
+	msg.StreamID = core.GetStreamID("audit")
+	result, _ = format.Format(msg)
+	expect.Equal(64, len(strings.Split(string(result), " ")[2]))
+
+	conf.Settings["RedactPolicy"] = map[interface{}]interface{}{"debug": "phone"}
+	expect.NotNil(format.Configure(conf))
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"strings"
+)
+
+// Regexp is a formatter that applies a regular expression to a message to
+// replace or extract parts of it, e.g. to mask credit card numbers or to strip
+// ANSI color codes.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Regexp"
+//     RegexpFormatter: "format.Forward"
+//     RegexpExpression: "\\b(\\d{4})\\d{8}(\\d{4})\\b"
+//     RegexpTemplate: "${1}********${2}"
+//     RegexpMode: "replace"
+//     RegexpMetadata: false
+//
+// RegexpFormatter defines the formatter applied before the expression is
+// evaluated. By default this is set to "format.Forward".
+//
+// RegexpExpression defines the regular expression applied to the message.
+// The syntax is described at https://golang.org/pkg/regexp/syntax/.
+// By default this is set to "", i.e. messages are passed unchanged.
+//
+// RegexpTemplate defines the replacement template. Captures are referenced by
+// $1 or ${1} and named captures by ${name}. Use $$ for a literal $.
+// By default this is set to "", i.e. matches are removed.
+//
+// RegexpMode defines how the template is applied. When set to "replace" all
+// matches are replaced by the template. When set to "extract" the message is
+// replaced by the template expanded with the first match. Messages that do not
+// match are passed unchanged in both modes. By default this is set to
+// "replace".
+//
+// RegexpMetadata can be set to true to store the named captures of the first
+// match as metadata of the message. Captures that did not participate in the
+// match are not stored. Metadata is only stored if this formatter is used by
+// a stream. By default this is set to false.
+type Regexp struct {
+	base     core.Formatter
+	exp      *regexp.Regexp
+	template []byte
+	extract  bool
+	metadata bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Regexp{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Regexp) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("RegexpFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.exp = nil
+	if expression := conf.GetString("RegexpExpression", ""); expression != "" {
+		if format.exp, err = regexp.Compile(expression); err != nil {
+			return err // ### return, regex parser error ###
+		}
+	}
+
+	format.template = []byte(conf.GetString("RegexpTemplate", ""))
+	format.metadata = conf.GetBool("RegexpMetadata", false)
+
+	switch mode := strings.ToLower(conf.GetString("RegexpMode", "replace")); mode {
+	case "replace":
+		format.extract = false
+	case "extract":
+		format.extract = true
+	default:
+		return fmt.Errorf("Regexp: Unknown RegexpMode \"%s\"", mode)
+	}
+	return nil
+}
+
+// apply returns the transformed payload and the indexes of the first match.
+// The indexes are nil if the expression did not match.
+func (format *Regexp) apply(data []byte) ([]byte, []int) {
+	if format.exp == nil {
+		return data, nil // ### return, nothing to do ###
+	}
+
+	match := format.exp.FindSubmatchIndex(data)
+	if match == nil {
+		return data, nil // ### return, no match ###
+	}
+
+	if format.extract {
+		return format.exp.Expand(nil, format.template, data, match), match
+	}
+	return format.exp.ReplaceAll(data, format.template), match
+}
+
+// Format replaces or extracts the parts of a message matching the expression.
+func (format *Regexp) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	data, _ = format.apply(data)
+	return data, streamID
+}
+
+// FormatMetadata behaves like Format and additionally stores the named
+// captures of the first match as metadata if RegexpMetadata is set.
+func (format *Regexp) FormatMetadata(msg core.Message) ([]byte, core.MessageStreamID, core.MessageMetadata) {
+	data, streamID := format.base.Format(msg)
+	formatted, match := format.apply(data)
+	if !format.metadata || match == nil {
+		return formatted, streamID, msg.Metadata // ### return, nothing to store ###
+	}
+
+	metadata := msg.Metadata.Clone()
+	for idx, name := range format.exp.SubexpNames() {
+		if name != "" && match[2*idx] >= 0 {
+			metadata[name] = string(data[match[2*idx]:match[2*idx+1]])
+		}
+	}
+	return formatted, streamID, metadata
+}
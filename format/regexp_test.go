@@ -0,0 +1,73 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestRegexpFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Regexp")
+	conf.Settings["RegexpExpression"] = `\b(\d{4})\d{8}(\d{4})\b`
+	conf.Settings["RegexpTemplate"] = "${1}********${2}"
+
+	format := Regexp{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("card 1234567812345678 and 8765432187654321"), 0)
+	result, _ := format.Format(msg)
+	expect.Equal("card 1234********5678 and 8765********4321", string(result))
+
+	// Strip ANSI color codes
+	conf.Settings["RegexpExpression"] = `\x1b\[[0-9;]*m`
+	conf.Settings["RegexpTemplate"] = ""
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte("\x1b[31merror\x1b[0m")
+	result, _ = format.Format(msg)
+	expect.Equal("error", string(result))
+
+	// Extract with metadata
+	conf.Settings["RegexpExpression"] = `user=(?P<user>\w+)(?: id=(?P<id>\d+))?`
+	conf.Settings["RegexpTemplate"] = "$user"
+	conf.Settings["RegexpMode"] = "extract"
+	conf.Settings["RegexpMetadata"] = true
+	expect.NoError(format.Configure(conf))
+
+	msg.Data = []byte("login user=alice from 10.0.0.1")
+	msg.Metadata = core.MessageMetadata{"source": "test"}
+	result, _, metadata := format.FormatMetadata(msg)
+	expect.Equal("alice", string(result))
+	expect.Equal("alice", metadata["user"])
+	expect.Equal("test", metadata["source"])
+	_, hasID := metadata["id"]
+	expect.False(hasID)
+	expect.Equal(1, len(msg.Metadata))
+
+	msg.Data = []byte("no match")
+	result, _, metadata = format.FormatMetadata(msg)
+	expect.Equal("no match", string(result))
+	expect.Equal(1, len(metadata))
+
+	conf.Settings["RegexpMode"] = "split"
+	expect.NotNil(format.Configure(conf))
+
+	conf.Settings["RegexpExpression"] = "("
+	expect.NotNil(format.Configure(conf))
+}
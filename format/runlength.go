@@ -15,9 +15,12 @@
 package format
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 	"strconv"
+	"strings"
 )
 
 // Runlength is a formatter that prepends the length of the message, followed by
@@ -27,11 +30,29 @@ import (
 //   - "<producer|stream>":
 //     Formatter: "format.Runlength"
 //     RunlengthFormatter: "format.Envelope"
+//     RunlengthEncoding: "ascii"
+//     RunlengthSize: 4
 //
 // RunlengthDataFormatter defines the formatter for the data transferred as
 // message. By default this is set to "format.Forward"
+//
+// RunlengthEncoding defines how the length is written. The encodings match
+// the partitioners of consumer.Proxy. By default this is set to "ascii".
+//  - "ascii" writes the length as ASCII number followed by ":"
+//  - "binary" writes the length as binary number of a given size
+//  - "binary_le" is an alias for "binary"
+//  - "binary_be" is the same as "binary" but uses big endian encoding
+//  - "varint" writes the length as unsigned varint
+//  - "protobuf" is an alias for "varint" and writes length delimited protocol
+//    buffer messages
+//
+// RunlengthSize defines the size in bytes used by the binary encoding.
+// This can be set to 1,2,4 or 8. By default 4 is chosen.
 type Runlength struct {
-	base core.Formatter
+	base     core.Formatter
+	encode   func(length int) []byte
+	encoding binary.ByteOrder
+	size     int
 }
 
 func init() {
@@ -46,17 +67,68 @@ func (format *Runlength) Configure(conf core.PluginConfig) error {
 	}
 
 	format.base = plugin.(core.Formatter)
+	format.encoding = binary.LittleEndian
+
+	encoding := strings.ToLower(conf.GetString("RunlengthEncoding", "ascii"))
+	switch encoding {
+	case "ascii":
+		format.encode = format.encodeASCII
+
+	case "binary_be":
+		format.encoding = binary.BigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		format.encode = format.encodeBinary
+		switch format.size = conf.GetInt("RunlengthSize", 4); format.size {
+		case 1, 2, 4, 8:
+		default:
+			return fmt.Errorf("RunlengthSize only supports the value 1,2,4 and 8")
+		}
+
+	case "varint", "protobuf":
+		format.encode = format.encodeVarint
+
+	default:
+		return fmt.Errorf("Unknown runlength encoding: %s", encoding)
+	}
+
 	return nil
 }
 
-// Format prepends the length of the message (followed by ":") to the message.
+func (format *Runlength) encodeASCII(length int) []byte {
+	return []byte(strconv.Itoa(length) + ":")
+}
+
+func (format *Runlength) encodeBinary(length int) []byte {
+	lengthBytes := make([]byte, 8)
+	switch format.size {
+	case 1:
+		lengthBytes[0] = byte(length)
+	case 2:
+		format.encoding.PutUint16(lengthBytes, uint16(length))
+	case 4:
+		format.encoding.PutUint32(lengthBytes, uint32(length))
+	default:
+		format.encoding.PutUint64(lengthBytes, uint64(length))
+	}
+	return lengthBytes[:format.size]
+}
+
+func (format *Runlength) encodeVarint(length int) []byte {
+	lengthBytes := make([]byte, binary.MaxVarintLen64)
+	lengthSize := binary.PutUvarint(lengthBytes, uint64(length))
+	return lengthBytes[:lengthSize]
+}
+
+// Format prepends the length of the message to the message.
 func (format *Runlength) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	basePayload, stream := format.base.Format(msg)
 	baseLength := len(basePayload)
-	lengthStr := strconv.Itoa(baseLength) + ":"
+	lengthBytes := format.encode(baseLength)
 
-	payload := make([]byte, len(lengthStr)+baseLength)
-	len := copy(payload, []byte(lengthStr))
+	payload := make([]byte, len(lengthBytes)+baseLength)
+	len := copy(payload, lengthBytes)
 	copy(payload[len:], basePayload)
 
 	return payload, stream
@@ -0,0 +1,54 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestRunlengthEncodings(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.Runlength")
+	msg := core.NewMessage(nil, []byte("test"), 0)
+
+	formatter := Runlength{}
+	expect.NoError(formatter.Configure(conf))
+	data, _ := formatter.Format(msg)
+	expect.Equal("4:test", string(data))
+
+	conf.Settings["RunlengthEncoding"] = "binary_be"
+	expect.NoError(formatter.Configure(conf))
+	data, _ = formatter.Format(msg)
+	expect.Equal("\x00\x00\x00\x04test", string(data))
+
+	conf.Settings["RunlengthEncoding"] = "binary"
+	conf.Settings["RunlengthSize"] = 2
+	expect.NoError(formatter.Configure(conf))
+	data, _ = formatter.Format(msg)
+	expect.Equal("\x04\x00test", string(data))
+
+	conf.Settings["RunlengthEncoding"] = "protobuf"
+	msg.Data = make([]byte, 300)
+	expect.NoError(formatter.Configure(conf))
+	data, _ = formatter.Format(msg)
+	expect.Equal(302, len(data))
+	expect.Equal("\xac\x02", string(data[:2]))
+
+	conf.Settings["RunlengthSize"] = 3
+	conf.Settings["RunlengthEncoding"] = "binary"
+	expect.NotNil(formatter.Configure(conf))
+}
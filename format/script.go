@@ -0,0 +1,234 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Script is a formatter that transforms messages with expressions defined in
+// the config file. See shared.Expression for the available operators and
+// functions and core.MessageExpressionVariables for the available variables.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Script"
+//     ScriptFormatter: "format.Forward"
+//     ScriptExpression: "upper(json.level) + ': ' + json.message"
+//     ScriptFields:
+//       "level": "lower(json.level)"
+//       "http/slow": "json.duration > 1000"
+//     ScriptStream: "json.level == 'error' ? 'errors' : ''"
+//     ScriptTimeoutMs: 10
+//     ScriptErrorStream: ""
+//
+// ScriptFormatter defines the formatter applied before the expressions are
+// evaluated. By default this is set to "format.Forward".
+//
+// ScriptExpression defines an expression whose result replaces the payload.
+// Strings are used as-is, other values are encoded as JSON. By default this
+// is set to "", i.e. the payload is not replaced.
+//
+// ScriptFields maps JSON fields to expressions. The result of each
+// expression is stored in the given field of the JSON object contained in
+// the payload. Nested fields can be set by using "/" as a separator. All
+// expressions see the original payload. ScriptStream and ScriptExpression
+// are evaluated afterwards and see the modified payload.
+// Messages that are not a JSON object are passed as-is and an error is
+// logged. By default no fields are set.
+//
+// ScriptStream defines an expression returning the name of the stream the
+// message is routed to. An empty result keeps the current stream.
+// By default this is set to "".
+//
+// ScriptTimeoutMs defines the maximum number of milliseconds all expressions
+// may take per message. Set to 0 to disable the limit. By default this is
+// set to 10.
+//
+// ScriptErrorStream defines the stream messages are routed to if an
+// expression fails or times out. The payload of these messages is not
+// modified. By default this is set to "", i.e. messages are passed as-is and
+// an error is logged.
+type Script struct {
+	base        core.Formatter
+	expression  *shared.Expression
+	fields      []scriptField
+	stream      *shared.Expression
+	timeout     time.Duration
+	errorStream core.MessageStreamID
+	reroute     bool
+}
+
+type scriptField struct {
+	path       []string
+	expression *shared.Expression
+}
+
+func init() {
+	shared.RuntimeType.Register(Script{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Script) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("ScriptFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	if format.expression, err = parseScriptExpression(conf.GetString("ScriptExpression", "")); err != nil {
+		return err
+	}
+	if format.stream, err = parseScriptExpression(conf.GetString("ScriptStream", "")); err != nil {
+		return err
+	}
+
+	fields := conf.GetStringMap("ScriptFields", map[string]string{})
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	format.fields = make([]scriptField, 0, len(paths))
+	for _, path := range paths {
+		expression, err := parseScriptExpression(fields[path])
+		if err != nil {
+			return err
+		}
+		if expression == nil {
+			return fmt.Errorf("Script: expression for field \"%s\" is empty", path)
+		}
+		format.fields = append(format.fields, scriptField{strings.Split(path, "/"), expression})
+	}
+
+	format.timeout = time.Duration(conf.GetInt("ScriptTimeoutMs", 10)) * time.Millisecond
+	if stream := conf.GetString("ScriptErrorStream", ""); stream != "" {
+		format.errorStream = core.GetStreamID(stream)
+		format.reroute = true
+	}
+	return nil
+}
+
+// parseScriptExpression parses the given expression. Empty expressions
+// return nil.
+func parseScriptExpression(source string) (*shared.Expression, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil // ### return, not set ###
+	}
+	expression, err := shared.ParseExpression(source, core.MessageExpressionVariables)
+	if err != nil {
+		return nil, fmt.Errorf("Script: %s", err)
+	}
+	return expression, nil
+}
+
+// set stores value in the nested field given by path. Missing or
+// non-object parents are replaced by objects.
+func (field scriptField) set(object map[string]interface{}, value interface{}) {
+	last := len(field.path) - 1
+	for _, key := range field.path[:last] {
+		child, isObject := object[key].(map[string]interface{})
+		if !isObject {
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		object = child
+	}
+	object[field.path[last]] = value
+}
+
+// remaining returns the time left until the given deadline. If no timeout
+// is set, 0 is returned, i.e. there is no limit.
+func (format *Script) remaining(deadline time.Time) time.Duration {
+	if format.timeout == 0 {
+		return 0
+	}
+	if left := deadline.Sub(time.Now()); left > 0 {
+		return left
+	}
+	return time.Nanosecond
+}
+
+// transform evaluates all expressions for the given message.
+func (format *Script) transform(msg core.Message, data []byte, streamID core.MessageStreamID) ([]byte, core.MessageStreamID, error) {
+	deadline := time.Now().Add(format.timeout)
+	scope := core.NewMessageExpressionScope(msg, data, streamID)
+
+	if len(format.fields) > 0 {
+		object := make(map[string]interface{})
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, streamID, fmt.Errorf("message is not a JSON object: %s", err)
+		}
+		for _, field := range format.fields {
+			value, err := field.expression.Eval(scope, format.remaining(deadline))
+			if err != nil {
+				return nil, streamID, err
+			}
+			field.set(object, value)
+		}
+
+		encoded, err := json.Marshal(object)
+		if err != nil {
+			return nil, streamID, err
+		}
+		data = encoded
+		scope = core.NewMessageExpressionScope(msg, data, streamID)
+	}
+
+	if format.stream != nil {
+		value, err := format.stream.Eval(scope, format.remaining(deadline))
+		if err != nil {
+			return nil, streamID, err
+		}
+		if stream := shared.ExpressionString(value); stream != "" {
+			streamID = core.GetStreamID(stream)
+		}
+	}
+
+	if format.expression != nil {
+		value, err := format.expression.Eval(scope, format.remaining(deadline))
+		if err != nil {
+			return nil, streamID, err
+		}
+		data = []byte(shared.ExpressionString(value))
+	}
+
+	return data, streamID, nil
+}
+
+// Format applies the configured expressions to the message. Messages for
+// which an expression fails are passed unchanged or sent to
+// ScriptErrorStream.
+func (format *Script) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	result, resultStreamID, err := format.transform(msg, data, streamID)
+	if err != nil {
+		if format.reroute {
+			return data, format.errorStream // ### return, reroute failed message ###
+		}
+		Log.Error.Print("Script: ", err)
+		return data, streamID
+	}
+	return result, resultStreamID
+}
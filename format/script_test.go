@@ -0,0 +1,92 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestScriptFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Script")
+	conf.Settings["ScriptExpression"] = "upper(json.level) + ': ' + json.message + ' (' + meta.host + ')'"
+	format := Script{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"level":"warn","message":"disk full"}`), 0)
+	msg.Metadata = core.MessageMetadata{"host": "web01"}
+	result, streamID := format.Format(msg)
+	expect.Equal("WARN: disk full (web01)", string(result))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestScriptFormatterFields(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Script")
+	conf.Settings["ScriptFields"] = map[string]string{
+		"level":     "lower(json.level)",
+		"http/slow": "json.duration > 1000",
+	}
+	conf.Settings["ScriptStream"] = "json.http.slow ? 'slow' : ''"
+	format := Script{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"level":"INFO","duration":1500}`), 0)
+	result, streamID := format.Format(msg)
+	expect.Equal(`{"duration":1500,"http":{"slow":true},"level":"info"}`, string(result))
+	expect.Equal(core.GetStreamID("slow"), streamID)
+
+	msg.Data = []byte(`{"level":"INFO","duration":10}`)
+	result, streamID = format.Format(msg)
+	expect.Equal(`{"duration":10,"http":{"slow":false},"level":"info"}`, string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	// Non-JSON messages are passed as-is
+	msg.Data = []byte("plain text")
+	result, streamID = format.Format(msg)
+	expect.Equal("plain text", string(result))
+	expect.Equal(msg.StreamID, streamID)
+}
+
+func TestScriptFormatterErrors(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Script")
+	conf.Settings["ScriptExpression"] = "1 / json.count"
+	conf.Settings["ScriptErrorStream"] = "failed"
+	format := Script{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"count":4}`), 0)
+	result, streamID := format.Format(msg)
+	expect.Equal("0.25", string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg.Data = []byte(`{"count":0}`)
+	result, streamID = format.Format(msg)
+	expect.Equal(`{"count":0}`, string(result))
+	expect.Equal(core.GetStreamID("failed"), streamID)
+
+	conf.Settings["ScriptExpression"] = "unknown.field"
+	expect.NotNil(format.Configure(conf))
+
+	conf.Settings["ScriptExpression"] = ""
+	conf.Settings["ScriptFields"] = map[string]string{"field": " "}
+	expect.NotNil(format.Configure(conf))
+}
@@ -15,25 +15,82 @@
 package format
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Sequence is a formatter that allows prefixing a message with the message's
-// sequence number
+// sequence number or a counter maintained by the formatter.
 // Configuration example
 //
 //   - "<producer|stream>":
 //     Formatter: "format.Sequence"
 //     SequenceFormatter: "format.Envelope"
+//     SequenceSource: "message"
+//     SequenceSeparator: ":"
+//     SequencePerStream: false
+//     SequenceStateFile: ""
+//     SequenceStateBlock: 1024
 //
-// SequenceDataFormatter defines the formatter for the data transferred as
+// SequenceFormatter defines the formatter for the data transferred as
 // message. By default this is set to "format.Forward"
+//
+// SequenceSource defines which number is written. When set to "message" the
+// sequence number assigned by the consumer is used. When set to "counter"
+// the formatter uses its own 64-bit counter starting at 0 which is increased
+// for each message. By default this is set to "message".
+//
+// SequenceSeparator defines the string written after the number.
+// By default this is set to ":".
+//
+// SequencePerStream can be set to true to use a separate counter for each
+// stream the messages belong to. This setting requires
+// SequenceSource to be set to "counter". By default this is set to false.
+//
+// SequenceStateFile defines a file used to persist the counters so that
+// numbering continues after a restart. Numbers are reserved in blocks of
+// SequenceStateBlock numbers, i.e. the state file is updated once a block is
+// used up. A number is only used after its block has been stored, so numbers
+// are never reused, even after a crash. Errors writing the state file are
+// written to the log. After a restart numbering continues
+// with the next block, i.e. gaps of up to SequenceStateBlock numbers mark a
+// restart. Each Sequence formatter requires its own state file. This setting
+// requires SequenceSource to be set to "counter". By default this is set to
+// "", i.e. counters are not persisted.
+//
+// SequenceStateBlock defines the number of sequence numbers reserved at once.
+// Set to 1 to store each number, which removes the gaps after a restart at
+// the cost of writing the state file for each message. By default this is
+// set to 1024.
 type Sequence struct {
-	base     core.Formatter
-	length   int
-	sequence string
+	base      core.Formatter
+	separator string
+	useCount  bool
+	perStream bool
+	stateFile string
+	block     uint64
+	counters  map[core.MessageStreamID]*sequenceCounter
+	guard     *sync.RWMutex
+	stateLock *sync.Mutex
+	state     map[string]uint64
+}
+
+// sequenceCounter is a 64-bit counter. Numbers up to reserved may be used
+// without updating the state file.
+type sequenceCounter struct {
+	name     string
+	next     uint64
+	reserved uint64
 }
 
 func init() {
@@ -48,19 +105,152 @@ func (format *Sequence) Configure(conf core.PluginConfig) error {
 	}
 
 	format.base = plugin.(core.Formatter)
+	format.separator = shared.Unescape(conf.GetString("SequenceSeparator", ":"))
+	format.perStream = conf.GetBool("SequencePerStream", false)
+	format.stateFile = conf.GetString("SequenceStateFile", "")
+	format.block = uint64(conf.GetInt("SequenceStateBlock", 1024))
+	format.counters = make(map[core.MessageStreamID]*sequenceCounter)
+	format.guard = new(sync.RWMutex)
+	format.stateLock = new(sync.Mutex)
+	format.state = make(map[string]uint64)
+
+	switch source := strings.ToLower(conf.GetString("SequenceSource", "message")); source {
+	case "message":
+		if format.perStream || format.stateFile != "" {
+			return fmt.Errorf("Sequence: SequencePerStream and SequenceStateFile require SequenceSource \"counter\"")
+		}
+	case "counter":
+		format.useCount = true
+	default:
+		return fmt.Errorf("Sequence: Unknown SequenceSource \"%s\"", source)
+	}
+
+	if format.block == 0 {
+		format.block = 1
+	}
+
+	if format.stateFile != "" {
+		data, err := ioutil.ReadFile(format.stateFile)
+		switch {
+		case os.IsNotExist(err):
+			// Start from 0
+		case err != nil:
+			return err
+		default:
+			if err := json.Unmarshal(data, &format.state); err != nil {
+				return fmt.Errorf("Sequence: Invalid state file %s: %s", format.stateFile, err.Error())
+			}
+		}
+	}
+
 	return nil
 }
 
+// counter returns the counter used for the given stream.
+func (format *Sequence) counter(streamID core.MessageStreamID) *sequenceCounter {
+	if !format.perStream {
+		streamID = core.WildcardStreamID
+	}
+
+	format.guard.RLock()
+	counter, exists := format.counters[streamID]
+	format.guard.RUnlock()
+
+	if exists {
+		return counter // ### return, known counter ###
+	}
+
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if counter, exists = format.counters[streamID]; !exists {
+		name := core.StreamTypes.GetStreamName(streamID)
+		format.stateLock.Lock()
+		start := format.state[name]
+		format.stateLock.Unlock()
+
+		counter = &sequenceCounter{
+			name:     name,
+			next:     start,
+			reserved: start,
+		}
+		if format.stateFile == "" {
+			counter.reserved = ^uint64(0)
+		}
+		format.counters[streamID] = counter
+	}
+	return counter
+}
+
+// nextNumber returns the next number of the given counter. If the number is
+// not yet reserved a new block is reserved and stored in the state file.
+func (format *Sequence) nextNumber(counter *sequenceCounter) uint64 {
+	number := atomic.AddUint64(&counter.next, 1) - 1
+	if number < atomic.LoadUint64(&counter.reserved) {
+		return number // ### return, reserved ###
+	}
+
+	format.stateLock.Lock()
+	defer format.stateLock.Unlock()
+
+	reserved := atomic.LoadUint64(&counter.reserved)
+	for number >= reserved {
+		reserved += format.block
+	}
+	if reserved == atomic.LoadUint64(&counter.reserved) {
+		return number // ### return, reserved in the meantime ###
+	}
+
+	format.state[counter.name] = reserved
+	if err := format.writeState(); err != nil {
+		Log.Error.Print("Sequence: Failed to write state file: ", err)
+	}
+	atomic.StoreUint64(&counter.reserved, reserved)
+	return number
+}
+
+// writeState stores all counters in the state file. The file is replaced
+// atomically.
+func (format *Sequence) writeState() error {
+	data, err := json.Marshal(format.state)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(format.stateFile), filepath.Base(format.stateFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), format.stateFile)
+}
+
 // Format prepends the sequence number of the message (followed by ":") to the
 // message.
 func (format *Sequence) Format(msg core.Message) ([]byte, core.MessageStreamID) {
 	basePayload, stream := format.base.Format(msg)
-	baseLength := len(basePayload)
-	sequenceStr := strconv.FormatUint(msg.Sequence, 10) + ":"
 
-	payload := make([]byte, len(sequenceStr)+baseLength)
-	len := copy(payload, []byte(sequenceStr))
-	copy(payload[len:], basePayload)
+	number := msg.Sequence
+	if format.useCount {
+		number = format.nextNumber(format.counter(msg.StreamID))
+	}
+
+	payload := make([]byte, 0, len(basePayload)+len(format.separator)+20)
+	payload = strconv.AppendUint(payload, number, 10)
+	payload = append(payload, format.separator...)
+	payload = append(payload, basePayload...)
 
 	return payload, stream
 }
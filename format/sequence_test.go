@@ -0,0 +1,93 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSequenceCounter(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.Sequence")
+
+	format := Sequence{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("test"), 42)
+	result, _ := format.Format(msg)
+	expect.Equal("42:test", string(result))
+
+	conf.Settings["SequenceSource"] = "counter"
+	conf.Settings["SequencePerStream"] = true
+	conf.Settings["SequenceSeparator"] = " "
+	expect.NoError(format.Configure(conf))
+
+	msg.StreamID = core.GetStreamID("sequenceA")
+	result, _ = format.Format(msg)
+	expect.Equal("0 test", string(result))
+	result, _ = format.Format(msg)
+	expect.Equal("1 test", string(result))
+
+	msg.StreamID = core.GetStreamID("sequenceB")
+	result, _ = format.Format(msg)
+	expect.Equal("0 test", string(result))
+
+	conf.Settings["SequenceSource"] = "message"
+	expect.NotNil(format.Configure(conf))
+}
+
+func TestSequencePersistence(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	stateDir, err := ioutil.TempDir("", "gollum_sequence")
+	expect.NoError(err)
+	defer os.RemoveAll(stateDir)
+
+	conf := core.NewPluginConfig("format.Sequence")
+	conf.Settings["SequenceSource"] = "counter"
+	conf.Settings["SequenceStateFile"] = filepath.Join(stateDir, "sequence.json")
+	conf.Settings["SequenceStateBlock"] = 10
+
+	format := Sequence{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("test"), 0)
+	for i := 0; i < 12; i++ {
+		format.Format(msg)
+	}
+
+	state, err := ioutil.ReadFile(filepath.Join(stateDir, "sequence.json"))
+	expect.NoError(err)
+	expect.Equal(`{"*":20}`, string(state))
+
+	// A restart continues with the next block
+	restarted := Sequence{}
+	expect.NoError(restarted.Configure(conf))
+	result, _ := restarted.Format(msg)
+	expect.Equal("20:test", string(result))
+
+	// Numbers are written exactly if each number is reserved separately
+	conf.Settings["SequenceStateBlock"] = 1
+	expect.NoError(restarted.Configure(conf))
+	restarted.Format(msg)
+	expect.NoError(restarted.Configure(conf))
+	result, _ = restarted.Format(msg)
+	expect.Equal("31:test", string(result))
+}
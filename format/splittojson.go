@@ -0,0 +1,173 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+)
+
+type splitToJSONType int
+
+const (
+	splitToJSONString = splitToJSONType(iota)
+	splitToJSONInt    = splitToJSONType(iota)
+	splitToJSONFloat  = splitToJSONType(iota)
+	splitToJSONBool   = splitToJSONType(iota)
+)
+
+type splitToJSONKey struct {
+	name      string
+	valueType splitToJSONType
+}
+
+// SplitToJSON is a formatter that splits a message by a given token and
+// writes the resulting parts as fields of a JSON object. This is useful to
+// convert e.g. CSV or TSV formatted access logs to JSON.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.SplitToJSON"
+//     SplitToJSONDataFormatter: "format.Forward"
+//     SplitToJSONDelimiter: ","
+//     SplitToJSONKeys:
+//       - "host"
+//       - "-"
+//       - "status:int"
+//       - "duration:float"
+//
+// SplitToJSONDataFormatter defines the formatter applied before the message
+// is split. By default this is set to "format.Forward".
+//
+// SplitToJSONDelimiter defines the token used to split the message.
+// Quoted values are not treated in a special way, i.e. values must not
+// contain the delimiter. By default this is set to ",".
+//
+// SplitToJSONKeys defines the field names used for the parts of the
+// message in the order they appear. A type can be appended to each name by
+// using "name:type" where type can be "string", "int", "float" or "bool".
+// Values that cannot be converted to the given type are written as string.
+// Parts with the name "" or "-" are skipped. Parts without a matching name
+// are ignored and names without a matching part are not written.
+// By default no keys are set, i.e. an empty object is written.
+type SplitToJSON struct {
+	base      core.Formatter
+	delimiter []byte
+	keys      []splitToJSONKey
+}
+
+func init() {
+	shared.RuntimeType.Register(SplitToJSON{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *SplitToJSON) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("SplitToJSONDataFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err // ### return, plugin load error ###
+	}
+	format.base = plugin.(core.Formatter)
+
+	format.delimiter = []byte(conf.GetString("SplitToJSONDelimiter", ","))
+	if len(format.delimiter) == 0 {
+		return fmt.Errorf("SplitToJSON: delimiter must not be empty")
+	}
+
+	keys := conf.GetStringArray("SplitToJSONKeys", []string{})
+	format.keys = make([]splitToJSONKey, 0, len(keys))
+	for _, key := range keys {
+		parsed := splitToJSONKey{name: key, valueType: splitToJSONString}
+		if colonIdx := strings.LastIndex(key, ":"); colonIdx >= 0 {
+			parsed.name = key[:colonIdx]
+			switch strings.ToLower(key[colonIdx+1:]) {
+			case "string":
+			case "int":
+				parsed.valueType = splitToJSONInt
+			case "float":
+				parsed.valueType = splitToJSONFloat
+			case "bool":
+				parsed.valueType = splitToJSONBool
+			default:
+				return fmt.Errorf("SplitToJSON: unknown type in key %s", key)
+			}
+		}
+		format.keys = append(format.keys, parsed)
+	}
+
+	return nil
+}
+
+// value returns the JSON representation of a given part. Parts that cannot
+// be converted to the requested type are returned as string.
+func (key splitToJSONKey) value(part string) interface{} {
+	switch key.valueType {
+	case splitToJSONInt:
+		if value, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64); err == nil {
+			return value
+		}
+	case splitToJSONFloat:
+		if value, err := strconv.ParseFloat(strings.TrimSpace(part), 64); err == nil {
+			return value
+		}
+	case splitToJSONBool:
+		if value, err := strconv.ParseBool(strings.TrimSpace(part)); err == nil {
+			return value
+		}
+	}
+	return part
+}
+
+// Format splits the message and returns it as a JSON object with the fields
+// in the order given by SplitToJSONKeys.
+func (format *SplitToJSON) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	parts := bytes.Split(data, format.delimiter)
+
+	buffer := bytes.Buffer{}
+	buffer.WriteByte('{')
+	written := 0
+
+	for idx, part := range parts {
+		if idx >= len(format.keys) {
+			break // ### break, no more keys ###
+		}
+		key := format.keys[idx]
+		if key.name == "" || key.name == "-" {
+			continue // ### continue, skipped ###
+		}
+
+		name, _ := json.Marshal(key.name)
+		value, err := json.Marshal(key.value(string(part)))
+		if err != nil {
+			value, _ = json.Marshal(string(part)) // e.g. NaN
+		}
+
+		if written > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+		written++
+	}
+
+	buffer.WriteByte('}')
+	return buffer.Bytes(), streamID
+}
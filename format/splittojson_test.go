@@ -0,0 +1,51 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestSplitToJSON(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.SplitToJSON")
+	conf.Settings["SplitToJSONKeys"] = []interface{}{"host", "-", "status:int", "duration:float", "cached:bool", "path"}
+
+	formatter := SplitToJSON{}
+	expect.NoError(formatter.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("example.com,ignored,200,0.25,true,/\"index\""), 0)
+	data, _ := formatter.Format(msg)
+	expect.Equal(`{"host":"example.com","status":200,"duration":0.25,"cached":true,"path":"/\"index\""}`, string(data))
+
+	// Invalid values are written as string, missing parts are not written
+	msg.Data = []byte("example.com,,-,NaN")
+	data, _ = formatter.Format(msg)
+	expect.Equal(`{"host":"example.com","status":"-","duration":"NaN"}`, string(data))
+
+	conf.Settings["SplitToJSONDelimiter"] = "\t"
+	conf.Settings["SplitToJSONKeys"] = []interface{}{"a", "b"}
+	expect.NoError(formatter.Configure(conf))
+
+	msg.Data = []byte("1\t2\t3")
+	data, _ = formatter.Format(msg)
+	expect.Equal(`{"a":"1","b":"2"}`, string(data))
+
+	conf.Settings["SplitToJSONKeys"] = []interface{}{"a:date"}
+	expect.NotNil(formatter.Configure(conf))
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"regexp"
+	"strconv"
+)
+
+// StreamRoute is a formatter that modifies a message's stream based on the
+// message's content. A value is extracted from the message by using a
+// regular expression and/or a JSON field. This value is looked up in a
+// mapping table to get the name of the target stream.
+// If no value can be extracted or the value is not found in the mapping
+// table the message is sent to a default stream or keeps its stream.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.StreamRoute"
+//     StreamRouteFormatter: "format.Forward"
+//     StreamRouteField: "level"
+//     StreamRouteExpression: "level=(\w+)"
+//     StreamRouteDefault: ""
+//     StreamRouteMap:
+//       "error": "errors"
+//       "warning": "warnings"
+//
+// StreamRouteFormatter defines the formatter applied after the stream has
+// been changed. By default this is set to "format.Forward".
+//
+// StreamRouteField defines a JSON field whose value is used for routing.
+// Field paths can be defined in a format accepted by shared.MarshalMap.Path.
+// Messages that are not valid JSON or do not contain this field are not
+// routed. By default this is set to "", i.e. the whole message is used.
+//
+// StreamRouteExpression defines a regular expression applied to the message
+// or to the value of StreamRouteField if set. If the expression contains a
+// capture group the first group is used as value, otherwise the whole match
+// is used. Messages that do not match are not routed. By default this is set
+// to "", i.e. the value is used as is.
+//
+// StreamRouteDefault defines a stream used for messages that could not be
+// routed, i.e. no value could be extracted or the value is not found in
+// StreamRouteMap. By default this is set to "", i.e. the stream of these
+// messages is not changed.
+//
+// StreamRouteMap maps extracted values to stream names. If this map is empty
+// the extracted value is used as stream name.
+type StreamRoute struct {
+	base       core.Formatter
+	field      string
+	exp        *regexp.Regexp
+	routes     map[string]core.MessageStreamID
+	defaultID  core.MessageStreamID
+	hasDefault bool
+}
+
+func init() {
+	shared.RuntimeType.Register(StreamRoute{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *StreamRoute) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("StreamRouteFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err // ### return, plugin load error ###
+	}
+	format.base = plugin.(core.Formatter)
+	format.field = conf.GetString("StreamRouteField", "")
+
+	if exp := conf.GetString("StreamRouteExpression", ""); exp != "" {
+		if format.exp, err = regexp.Compile(exp); err != nil {
+			return err // ### return, regex parser error ###
+		}
+	}
+
+	format.routes = make(map[string]core.MessageStreamID)
+	for value, stream := range conf.GetStringMap("StreamRouteMap", map[string]string{}) {
+		format.routes[value] = core.GetStreamID(stream)
+	}
+
+	if stream := conf.GetString("StreamRouteDefault", ""); stream != "" {
+		format.defaultID = core.GetStreamID(stream)
+		format.hasDefault = true
+	}
+
+	return nil
+}
+
+func (format *StreamRoute) getFieldValue(data []byte) (string, bool) {
+	values := shared.NewMarshalMap()
+	if err := json.Unmarshal(data, &values); err != nil {
+		return "", false // ### return, no JSON ###
+	}
+
+	value, found := values.Path(format.field)
+	if !found {
+		return "", false // ### return, field not found ###
+	}
+
+	switch value.(type) {
+	case string:
+		return value.(string), true
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+func (format *StreamRoute) getValue(data []byte) (string, bool) {
+	value := string(data)
+	if format.field != "" {
+		var found bool
+		if value, found = format.getFieldValue(data); !found {
+			return "", false // ### return, no field value ###
+		}
+	}
+
+	if format.exp != nil {
+		match := format.exp.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			return "", false // ### return, no match ###
+		case len(match) > 1:
+			value = match[1]
+		default:
+			value = match[0]
+		}
+	}
+
+	return value, true
+}
+
+// Format changes the message's stream based on its content and passes the
+// message to the base formatter.
+func (format *StreamRoute) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	if format.field == "" && format.exp == nil {
+		return format.base.Format(msg) // ### return, nothing to route by ###
+	}
+
+	routedMsg := msg
+	if value, found := format.getValue(msg.Data); found {
+		if len(format.routes) == 0 {
+			if value != "" {
+				routedMsg.StreamID = core.GetStreamID(value)
+			}
+		} else if streamID, mapped := format.routes[value]; mapped {
+			routedMsg.StreamID = streamID
+		} else if format.hasDefault {
+			routedMsg.StreamID = format.defaultID
+		}
+	} else if format.hasDefault {
+		routedMsg.StreamID = format.defaultID
+	}
+
+	return format.base.Format(routedMsg)
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestStreamRouteExpression(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.StreamRoute")
+	conf.Settings["StreamRouteExpression"] = "level=(\\w+)"
+	conf.Settings["StreamRouteMap"] = map[interface{}]interface{}{
+		"error":   "errors",
+		"warning": "warnings",
+	}
+
+	formatter := StreamRoute{}
+	expect.NoError(formatter.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("time=1 level=error text"), 0)
+	data, streamID := formatter.Format(msg)
+	expect.Equal("time=1 level=error text", string(data))
+	expect.Equal(core.GetStreamID("errors"), streamID)
+
+	// Unmapped values and messages without match keep their stream
+	msg.Data = []byte("level=info")
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.WildcardStreamID, streamID)
+
+	msg.Data = []byte("no level")
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.WildcardStreamID, streamID)
+
+	conf.Settings["StreamRouteDefault"] = "other"
+	expect.NoError(formatter.Configure(conf))
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.GetStreamID("other"), streamID)
+}
+
+func TestStreamRouteField(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.StreamRoute")
+	conf.Settings["StreamRouteField"] = "source/name"
+
+	formatter := StreamRoute{}
+	expect.NoError(formatter.Configure(conf))
+
+	// Without map the value is used as stream name
+	msg := core.NewMessage(nil, []byte(`{"source":{"name":"app"}}`), 0)
+	_, streamID := formatter.Format(msg)
+	expect.Equal(core.GetStreamID("app"), streamID)
+
+	msg.Data = []byte("not json")
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.WildcardStreamID, streamID)
+
+	// Expressions are applied to the field value
+	conf.Settings["StreamRouteExpression"] = "^[a-z]+"
+	expect.NoError(formatter.Configure(conf))
+	msg.Data = []byte(`{"source":{"name":"web-01"}}`)
+	_, streamID = formatter.Format(msg)
+	expect.Equal(core.GetStreamID("web"), streamID)
+}
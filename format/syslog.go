@@ -0,0 +1,339 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const syslogNilValue = "-"
+
+// syslogHeaderFields contains the JSON keys of the RFC5424 header fields
+// following the version in the order they appear in a message.
+var syslogHeaderFields = []string{"timestamp", "hostname", "appname", "procid", "msgid"}
+
+type syslogParam struct {
+	name  string
+	value string
+}
+
+type syslogElement struct {
+	id     string
+	params []syslogParam
+}
+
+// syslogMessage contains the parts of a RFC5424 message.
+// Header fields set to the nil value "-" are stored as empty strings.
+type syslogMessage struct {
+	priority int
+	version  int
+	header   []string
+	elements []syslogElement
+	message  []byte
+}
+
+type syslogParser struct {
+	data   []byte
+	offset int
+}
+
+func (parser *syslogParser) fail(reason string) error {
+	return fmt.Errorf("Invalid RFC5424 message at offset %d: %s", parser.offset, reason)
+}
+
+func (parser *syslogParser) expect(char byte) error {
+	if parser.offset >= len(parser.data) || parser.data[parser.offset] != char {
+		return parser.fail(fmt.Sprintf("expected '%c'", char))
+	}
+	parser.offset++
+	return nil
+}
+
+func (parser *syslogParser) readToken() string {
+	start := parser.offset
+	for parser.offset < len(parser.data) && parser.data[parser.offset] != ' ' {
+		parser.offset++
+	}
+	return string(parser.data[start:parser.offset])
+}
+
+func (parser *syslogParser) readName() (string, error) {
+	start := parser.offset
+	for parser.offset < len(parser.data) {
+		switch parser.data[parser.offset] {
+		case ' ', '=', ']', '"':
+			if parser.offset == start {
+				return "", parser.fail("empty name")
+			}
+			return string(parser.data[start:parser.offset]), nil
+		}
+		parser.offset++
+	}
+	return "", parser.fail("unexpected end of message")
+}
+
+func (parser *syslogParser) readValue() (string, error) {
+	if err := parser.expect('"'); err != nil {
+		return "", err
+	}
+
+	value := bytes.Buffer{}
+	for parser.offset < len(parser.data) {
+		char := parser.data[parser.offset]
+		parser.offset++
+
+		switch char {
+		case '"':
+			return value.String(), nil // ### return, end of value ###
+
+		case '\\':
+			// Only ", \ and ] are escaped. Any other backslash is kept.
+			if parser.offset < len(parser.data) {
+				switch next := parser.data[parser.offset]; next {
+				case '"', '\\', ']':
+					char = next
+					parser.offset++
+				}
+			}
+		}
+		value.WriteByte(char)
+	}
+	return "", parser.fail("unterminated value")
+}
+
+func (parser *syslogParser) readElement() (syslogElement, error) {
+	element := syslogElement{}
+	if err := parser.expect('['); err != nil {
+		return element, err
+	}
+
+	var err error
+	if element.id, err = parser.readName(); err != nil {
+		return element, err
+	}
+
+	for {
+		if parser.offset >= len(parser.data) {
+			return element, parser.fail("unterminated element")
+		}
+		if parser.data[parser.offset] == ']' {
+			parser.offset++
+			return element, nil // ### return, end of element ###
+		}
+		if err := parser.expect(' '); err != nil {
+			return element, err
+		}
+
+		param := syslogParam{}
+		if param.name, err = parser.readName(); err != nil {
+			return element, err
+		}
+		if err := parser.expect('='); err != nil {
+			return element, err
+		}
+		if param.value, err = parser.readValue(); err != nil {
+			return element, err
+		}
+		element.params = append(element.params, param)
+	}
+}
+
+// parseSyslogMessage parses an RFC5424 formatted message.
+func parseSyslogMessage(data []byte) (syslogMessage, error) {
+	parser := syslogParser{data: data}
+	msg := syslogMessage{}
+
+	// PRI and VERSION
+	if err := parser.expect('<'); err != nil {
+		return msg, err
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return msg, parser.fail("invalid priority")
+	}
+
+	var err error
+	if msg.priority, err = strconv.Atoi(string(data[1:end])); err != nil || msg.priority > 191 {
+		return msg, parser.fail("invalid priority")
+	}
+	parser.offset = end + 1
+
+	if msg.version, err = strconv.Atoi(parser.readToken()); err != nil {
+		return msg, parser.fail("invalid version")
+	}
+
+	// Header fields
+	msg.header = make([]string, len(syslogHeaderFields))
+	for i := range syslogHeaderFields {
+		if err := parser.expect(' '); err != nil {
+			return msg, err
+		}
+		if msg.header[i] = parser.readToken(); msg.header[i] == syslogNilValue {
+			msg.header[i] = ""
+		}
+	}
+
+	// Structured data
+	if err := parser.expect(' '); err != nil {
+		return msg, err
+	}
+
+	if parser.offset < len(data) && data[parser.offset] == '-' {
+		parser.offset++
+	} else {
+		for parser.offset < len(data) && data[parser.offset] == '[' {
+			element, err := parser.readElement()
+			if err != nil {
+				return msg, err
+			}
+			msg.elements = append(msg.elements, element)
+		}
+		if len(msg.elements) == 0 {
+			return msg, parser.fail("missing structured data")
+		}
+	}
+
+	// Message
+	if parser.offset < len(data) {
+		if err := parser.expect(' '); err != nil {
+			return msg, err
+		}
+		msg.message = bytes.TrimPrefix(data[parser.offset:], []byte("\xEF\xBB\xBF"))
+	}
+
+	return msg, nil
+}
+
+// writeSyslogName writes an SD-ID or PARAM-NAME. Characters not allowed by
+// RFC5424 are removed and names are truncated to 32 characters.
+func writeSyslogName(buffer *bytes.Buffer, name string) {
+	written := 0
+	for i := 0; i < len(name) && written < 32; i++ {
+		switch char := name[i]; {
+		case char <= ' ' || char > '~', char == '=', char == ']', char == '"':
+			// Not allowed
+		default:
+			buffer.WriteByte(char)
+			written++
+		}
+	}
+}
+
+// writeSyslogValue writes an escaped PARAM-VALUE including quotes.
+func writeSyslogValue(buffer *bytes.Buffer, value string) {
+	buffer.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\', ']':
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteByte(value[i])
+	}
+	buffer.WriteByte('"')
+}
+
+// writeSyslogHeaderValue writes a header field, replacing empty values and
+// spaces which are not allowed in header fields.
+func writeSyslogHeaderValue(buffer *bytes.Buffer, value string) {
+	if value == "" {
+		buffer.WriteString(syslogNilValue)
+		return // ### return, nil value ###
+	}
+	buffer.Write(bytes.Replace([]byte(value), []byte(" "), []byte("_"), -1))
+}
+
+// bytes returns the RFC5424 representation of the message.
+func (msg syslogMessage) bytes() []byte {
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "<%d>%d", msg.priority, msg.version)
+
+	for _, value := range msg.header {
+		buffer.WriteByte(' ')
+		writeSyslogHeaderValue(&buffer, value)
+	}
+
+	buffer.WriteByte(' ')
+	if len(msg.elements) == 0 {
+		buffer.WriteString(syslogNilValue)
+	}
+	for _, element := range msg.elements {
+		buffer.WriteByte('[')
+		writeSyslogName(&buffer, element.id)
+		for _, param := range element.params {
+			buffer.WriteByte(' ')
+			writeSyslogName(&buffer, param.name)
+			buffer.WriteByte('=')
+			writeSyslogValue(&buffer, param.value)
+		}
+		buffer.WriteByte(']')
+	}
+
+	if len(msg.message) > 0 {
+		buffer.WriteByte(' ')
+		buffer.Write(msg.message)
+	}
+	return buffer.Bytes()
+}
+
+// syslogElementsFromJSON converts a decoded JSON object into structured data
+// elements. Element IDs and parameter names are sorted. Parameters with an
+// array value are written once per array item.
+func syslogElementsFromJSON(data map[string]interface{}) []syslogElement {
+	ids := make([]string, 0, len(data))
+	for id := range data {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	elements := make([]syslogElement, 0, len(ids))
+	for _, id := range ids {
+		element := syslogElement{id: id}
+		if params, isObject := data[id].(map[string]interface{}); isObject {
+			names := make([]string, 0, len(params))
+			for name := range params {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				if values, isArray := params[name].([]interface{}); isArray {
+					for _, value := range values {
+						element.params = append(element.params, syslogParam{name, syslogJSONString(value)})
+					}
+				} else {
+					element.params = append(element.params, syslogParam{name, syslogJSONString(params[name])})
+				}
+			}
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// syslogJSONString converts a decoded JSON value into a string. Null values
+// are converted to an empty string.
+func syslogJSONString(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value.(string)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestSyslogFormatters(t *testing.T) {
+	expect := shared.NewExpect(t)
+	conf := core.NewPluginConfig("format.SyslogDecode")
+
+	decoder := SyslogDecode{}
+	expect.NoError(decoder.Configure(conf))
+	encoder := SyslogEncode{}
+	expect.NoError(encoder.Configure(conf))
+
+	testString := `<165>1 2003-10-11T22:14:15.003Z host app - ID47 ` +
+		`[exampleSDID@32473 iut="3" eventSource="App\"x\]" iut="4"][examplePriority@32473 class="high"] ` + "\xEF\xBB\xBFtext"
+	msg := core.NewMessage(nil, []byte(testString), 0)
+
+	decoded, _ := decoder.Format(msg)
+	expect.Equal(`{"priority":165,"facility":20,"severity":5,"version":1,"timestamp":"2003-10-11T22:14:15.003Z",`+
+		`"hostname":"host","appname":"app","msgid":"ID47","structured_data":{"exampleSDID@32473":`+
+		`{"iut":["3","4"],"eventSource":"App\"x]"},"examplePriority@32473":{"class":"high"}},"message":"text"}`, string(decoded))
+
+	msg.Data = decoded
+	encoded, _ := encoder.Format(msg)
+	expect.Equal(`<165>1 2003-10-11T22:14:15.003Z host app - ID47 `+
+		`[examplePriority@32473 class="high"][exampleSDID@32473 eventSource="App\"x\]" iut="3" iut="4"] text`, string(encoded))
+
+	// Messages without structured data
+	msg.Data = []byte("<13>1 - - - - - -")
+	decoded, _ = decoder.Format(msg)
+	expect.Equal(`{"priority":13,"facility":1,"severity":5,"version":1}`, string(decoded))
+
+	msg.Data = decoded
+	encoded, _ = encoder.Format(msg)
+	expect.Equal("<13>1 - - - - - -", string(encoded))
+
+	// Invalid messages are passed as-is
+	msg.Data = []byte("<13>1 - - - - - [broken")
+	decoded, _ = decoder.Format(msg)
+	expect.Equal("<13>1 - - - - - [broken", string(decoded))
+}
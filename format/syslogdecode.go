@@ -0,0 +1,155 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+)
+
+// SyslogDecode is a formatter that converts an RFC5424 syslog message into a
+// JSON object. Structured data elements are converted into nested objects so
+// that they are not lost when passing syslog messages to JSON based services.
+// Messages that are not valid RFC5424 messages are passed as-is and an error
+// is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.SyslogDecode"
+//     SyslogDecodeFormatter: "format.Forward"
+//     SyslogDataKey: "structured_data"
+//
+// The message
+//
+//	<165>1 2003-10-11T22:14:15.003Z host app 1234 ID47 [ex@32473 iut="3" eventSource="App"] text
+//
+// is converted into
+//
+//	{"priority":165,"facility":20,"severity":5,"version":1,"timestamp":"2003-10-11T22:14:15.003Z",
+//	 "hostname":"host","appname":"app","procid":"1234","msgid":"ID47",
+//	 "structured_data":{"ex@32473":{"iut":"3","eventSource":"App"}},"message":"text"}
+//
+// Header fields set to "-" are omitted. If a parameter is used more than once
+// inside an element its values are stored as an array.
+//
+// SyslogDecodeFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// SyslogDataKey defines the key used to store the structured data elements.
+// By default this is set to "structured_data".
+type SyslogDecode struct {
+	base    core.Formatter
+	dataKey string
+}
+
+func init() {
+	shared.RuntimeType.Register(SyslogDecode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *SyslogDecode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("SyslogDecodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.dataKey = conf.GetString("SyslogDataKey", "structured_data")
+	return nil
+}
+
+// writeSyslogJSONKey writes a key to a JSON object started with "{".
+func writeSyslogJSONKey(buffer *bytes.Buffer, key string) {
+	if buffer.Len() > 1 {
+		buffer.WriteByte(',')
+	}
+	encodedKey, _ := json.Marshal(key)
+	buffer.Write(encodedKey)
+	buffer.WriteByte(':')
+}
+
+func writeSyslogJSONField(buffer *bytes.Buffer, key string, value interface{}) {
+	writeSyslogJSONKey(buffer, key)
+	encodedValue, _ := json.Marshal(value)
+	buffer.Write(encodedValue)
+}
+
+func writeSyslogJSONElements(buffer *bytes.Buffer, elements []syslogElement) {
+	elementBuffer := bytes.NewBufferString("{")
+	for _, element := range elements {
+		writeSyslogJSONKey(elementBuffer, element.id)
+
+		// Group parameters with the same name while keeping their order
+		names := []string{}
+		values := make(map[string][]string)
+		for _, param := range element.params {
+			if _, exists := values[param.name]; !exists {
+				names = append(names, param.name)
+			}
+			values[param.name] = append(values[param.name], param.value)
+		}
+
+		paramBuffer := bytes.NewBufferString("{")
+		for _, name := range names {
+			if len(values[name]) == 1 {
+				writeSyslogJSONField(paramBuffer, name, values[name][0])
+			} else {
+				writeSyslogJSONField(paramBuffer, name, values[name])
+			}
+		}
+		paramBuffer.WriteByte('}')
+		elementBuffer.Write(paramBuffer.Bytes())
+	}
+	elementBuffer.WriteByte('}')
+	buffer.Write(elementBuffer.Bytes())
+}
+
+// Format returns the syslog message as JSON object
+func (format *SyslogDecode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	syslogMsg, err := parseSyslogMessage(basePayload)
+	if err != nil {
+		Log.Error.Print("SyslogDecode: ", err)
+		return basePayload, stream // ### return, not RFC5424 ###
+	}
+
+	buffer := bytes.NewBufferString("{")
+	writeSyslogJSONField(buffer, "priority", syslogMsg.priority)
+	writeSyslogJSONField(buffer, "facility", syslogMsg.priority>>3)
+	writeSyslogJSONField(buffer, "severity", syslogMsg.priority&7)
+	writeSyslogJSONField(buffer, "version", syslogMsg.version)
+
+	for i, key := range syslogHeaderFields {
+		if syslogMsg.header[i] != "" {
+			writeSyslogJSONField(buffer, key, syslogMsg.header[i])
+		}
+	}
+
+	if len(syslogMsg.elements) > 0 {
+		writeSyslogJSONKey(buffer, format.dataKey)
+		writeSyslogJSONElements(buffer, syslogMsg.elements)
+	}
+
+	if len(syslogMsg.message) > 0 {
+		writeSyslogJSONField(buffer, "message", string(syslogMsg.message))
+	}
+
+	buffer.WriteByte('}')
+	return buffer.Bytes(), stream
+}
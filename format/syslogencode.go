@@ -0,0 +1,113 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+)
+
+// SyslogEncode is a formatter that converts a JSON object into an RFC5424
+// syslog message. This is the counterpart of format.SyslogDecode, i.e. the
+// same keys are used to generate the syslog header, the structured data
+// elements and the message text.
+// Messages that are not valid JSON objects are passed as-is and an error is
+// logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.SyslogEncode"
+//     SyslogEncodeFormatter: "format.Forward"
+//     SyslogDataKey: "structured_data"
+//
+// If "priority" is not set, "facility" and "severity" are used to build the
+// priority value. These default to 1 (user) and 5 (notice). Missing header
+// fields are set to "-", spaces in header fields are replaced by "_".
+// Element IDs and parameter names are written in sorted order. Array values
+// are written as one parameter per array item.
+//
+// SyslogEncodeFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// SyslogDataKey defines the key storing the structured data elements.
+// By default this is set to "structured_data".
+type SyslogEncode struct {
+	base    core.Formatter
+	dataKey string
+}
+
+func init() {
+	shared.RuntimeType.Register(SyslogEncode{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *SyslogEncode) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("SyslogEncodeFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.dataKey = conf.GetString("SyslogDataKey", "structured_data")
+	return nil
+}
+
+func getSyslogJSONInt(values map[string]interface{}, key string, defaultValue int) int {
+	if number, isNumber := values[key].(json.Number); isNumber {
+		if value, err := strconv.Atoi(number.String()); err == nil {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// Format returns the JSON object as RFC5424 syslog message
+func (format *SyslogEncode) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	decoder := json.NewDecoder(bytes.NewReader(basePayload))
+	decoder.UseNumber()
+
+	values := make(map[string]interface{})
+	if err := decoder.Decode(&values); err != nil {
+		Log.Error.Print("SyslogEncode: ", err)
+		return basePayload, stream // ### return, not JSON ###
+	}
+
+	priority := getSyslogJSONInt(values, "facility", 1)<<3 | getSyslogJSONInt(values, "severity", 5)&7
+	syslogMsg := syslogMessage{
+		priority: getSyslogJSONInt(values, "priority", priority),
+		version:  getSyslogJSONInt(values, "version", 1),
+		header:   make([]string, len(syslogHeaderFields)),
+	}
+
+	for i, key := range syslogHeaderFields {
+		syslogMsg.header[i] = syslogJSONString(values[key])
+	}
+
+	if elements, isObject := values[format.dataKey].(map[string]interface{}); isObject {
+		syslogMsg.elements = syslogElementsFromJSON(elements)
+	}
+
+	if text := syslogJSONString(values["message"]); text != "" {
+		syslogMsg.message = []byte(text)
+	}
+
+	return syslogMsg.bytes(), stream
+}
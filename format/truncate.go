@@ -0,0 +1,159 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Truncate is a formatter that trims whitespace and control characters and
+// limits messages to a maximum size. This protects sinks with strict size
+// limits like UDP syslog or Kinesis.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Truncate"
+//     TruncateFormatter: "format.Forward"
+//     TruncateTrim: "both"
+//     TruncateMaxLength: 1024
+//     TruncateMarker: "..."
+//     TruncateUTF8: true
+//     TruncateOversizeStream: ""
+//
+// TruncateFormatter defines the formatter applied before trimming and
+// truncating. By default this is set to "format.Forward".
+//
+// TruncateTrim defines which side of a message is trimmed. Whitespace and
+// control characters are removed. Valid values are "none", "left", "right"
+// and "both". By default this is set to "none".
+//
+// TruncateMaxLength defines the maximum size of a message in bytes after
+// trimming, including TruncateMarker. Set to 0 to disable truncation.
+// By default this is set to 0.
+//
+// TruncateMarker defines the string appended to truncated messages.
+// By default this is set to "...".
+//
+// TruncateUTF8 defines whether UTF-8 characters are kept intact, i.e.
+// messages are not cut in the middle of a multi-byte character. In this case
+// truncated messages may be shorter than TruncateMaxLength.
+// By default this is set to true.
+//
+// TruncateOversizeStream defines a stream oversized messages are sent to
+// instead of truncating them. The payload of these messages is not
+// truncated. By default this is set to "", i.e. messages are truncated.
+type Truncate struct {
+	base      core.Formatter
+	trimLeft  bool
+	trimRight bool
+	maxLength int
+	marker    []byte
+	keepUTF8  bool
+	oversize  core.MessageStreamID
+	reroute   bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Truncate{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Truncate) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("TruncateFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	switch trim := strings.ToLower(conf.GetString("TruncateTrim", "none")); trim {
+	case "none":
+		format.trimLeft, format.trimRight = false, false
+	case "left":
+		format.trimLeft, format.trimRight = true, false
+	case "right":
+		format.trimLeft, format.trimRight = false, true
+	case "both":
+		format.trimLeft, format.trimRight = true, true
+	default:
+		return fmt.Errorf("Truncate: Unknown trim mode \"%s\"", trim)
+	}
+
+	format.maxLength = conf.GetInt("TruncateMaxLength", 0)
+	format.marker = []byte(shared.Unescape(conf.GetString("TruncateMarker", "...")))
+	format.keepUTF8 = conf.GetBool("TruncateUTF8", true)
+
+	if format.maxLength < 0 {
+		return fmt.Errorf("Truncate: TruncateMaxLength must not be negative")
+	}
+	if format.maxLength > 0 && len(format.marker) >= format.maxLength {
+		return fmt.Errorf("Truncate: TruncateMarker must be shorter than TruncateMaxLength")
+	}
+
+	if stream := conf.GetString("TruncateOversizeStream", ""); stream != "" {
+		format.oversize = core.GetStreamID(stream)
+		format.reroute = true
+	}
+	return nil
+}
+
+// isTruncateTrimmed returns true for characters removed by trimming.
+func isTruncateTrimmed(char rune) bool {
+	return unicode.IsSpace(char) || unicode.IsControl(char)
+}
+
+// truncate cuts the given data so that it fits into maxLength bytes
+// including the marker. The data is copied as messages must not be modified.
+func (format *Truncate) truncate(data []byte) []byte {
+	length := format.maxLength - len(format.marker)
+	if format.keepUTF8 {
+		// Move back to the start of the character crossing the limit
+		for length > 0 && !utf8.RuneStart(data[length]) {
+			length--
+		}
+	}
+
+	truncated := make([]byte, 0, length+len(format.marker))
+	truncated = append(truncated, data[:length]...)
+	return append(truncated, format.marker...)
+}
+
+// Format trims and truncates the message. Oversized messages are sent to
+// TruncateOversizeStream if set.
+func (format *Truncate) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+
+	switch {
+	case format.trimLeft && format.trimRight:
+		data = bytes.TrimFunc(data, isTruncateTrimmed)
+	case format.trimLeft:
+		data = bytes.TrimLeftFunc(data, isTruncateTrimmed)
+	case format.trimRight:
+		data = bytes.TrimRightFunc(data, isTruncateTrimmed)
+	}
+
+	if format.maxLength == 0 || len(data) <= format.maxLength {
+		return data, streamID // ### return, fits ###
+	}
+	if format.reroute {
+		return data, format.oversize // ### return, oversized ###
+	}
+	return format.truncate(data), streamID
+}
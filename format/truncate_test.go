@@ -0,0 +1,85 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"testing"
+)
+
+func TestTruncateFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	conf := core.NewPluginConfig("format.Truncate")
+	conf.Settings["TruncateTrim"] = "both"
+	conf.Settings["TruncateMaxLength"] = 10
+	format := Truncate{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(" \t short\r\n\x00"), 0)
+	result, streamID := format.Format(msg)
+	expect.Equal("short", string(result))
+	expect.Equal(msg.StreamID, streamID)
+
+	msg.Data = []byte("0123456789abcdef")
+	result, _ = format.Format(msg)
+	expect.Equal("0123456...", string(result))
+	expect.Equal("0123456789abcdef", string(msg.Data))
+
+	// Multi-byte characters are not cut
+	msg.Data = []byte("012345äöü")
+	result, _ = format.Format(msg)
+	expect.Equal("012345...", string(result))
+
+	conf.Settings["TruncateUTF8"] = false
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal("012345\xc3...", string(result))
+
+	// Trim modes
+	conf.Settings["TruncateTrim"] = "right"
+	conf.Settings["TruncateMaxLength"] = 0
+	expect.NoError(format.Configure(conf))
+	msg.Data = []byte("  text  ")
+	result, _ = format.Format(msg)
+	expect.Equal("  text", string(result))
+
+	conf.Settings["TruncateTrim"] = "left"
+	expect.NoError(format.Configure(conf))
+	result, _ = format.Format(msg)
+	expect.Equal("text  ", string(result))
+
+	// Oversized messages are rerouted
+	conf.Settings["TruncateTrim"] = "none"
+	conf.Settings["TruncateMaxLength"] = 4
+	conf.Settings["TruncateMarker"] = ""
+	conf.Settings["TruncateOversizeStream"] = "oversize"
+	expect.NoError(format.Configure(conf))
+	result, streamID = format.Format(msg)
+	expect.Equal("  text  ", string(result))
+	expect.Equal(core.GetStreamID("oversize"), streamID)
+
+	msg.Data = []byte("text")
+	_, streamID = format.Format(msg)
+	expect.Equal(msg.StreamID, streamID)
+
+	// Invalid settings
+	conf.Settings["TruncateMarker"] = "...."
+	expect.NotNil(format.Configure(conf))
+	conf.Settings["TruncateMarker"] = ""
+	conf.Settings["TruncateTrim"] = "middle"
+	expect.NotNil(format.Configure(conf))
+}
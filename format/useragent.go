@@ -0,0 +1,350 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UserAgent formatter plugin
+// UserAgent is a formatter that parses the User-Agent string stored in a
+// field of a JSON object and adds the detected browser, operating system and
+// device to the object. Messages that are not a JSON object are passed as-is
+// and an error is logged.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.UserAgent"
+//     UserAgentFormatter: "format.Forward"
+//     UserAgentSourceKey: "user_agent"
+//     UserAgentDataKey: "user_agent_info"
+//     UserAgentRegexFile: ""
+//     UserAgentCacheSize: 1000
+//
+// The parsed data is stored as an object containing the fields "browser",
+// "browser_version", "os", "os_version", "device", "device_brand" and
+// "device_model". Parts that are not detected are set to "Other" and do not
+// add a version or brand.
+//
+// UserAgentFormatter defines the formatter applied before the message is
+// converted. By default this is set to "format.Forward"
+//
+// UserAgentSourceKey defines the JSON field containing the User-Agent string.
+// By default this is set to "user_agent".
+//
+// UserAgentDataKey defines the key used to store the parsed data.
+// By default this is set to "user_agent_info".
+//
+// UserAgentRegexFile defines the path to a regexes.yaml file as found in the
+// uap-core project. If set, the rules of this file are used instead of the
+// embedded rules. By default this is set to "".
+//
+// UserAgentCacheSize defines the number of parsed User-Agent strings kept in
+// memory. The cache is cleared when this number is reached. Set to 0 to
+// disable caching. By default this is set to 1000.
+type UserAgent struct {
+	base      core.Formatter
+	sourceKey string
+	dataKey   string
+	parser    *userAgentParser
+	cache     map[string]map[string]interface{}
+	cacheSize int
+	guard     *sync.Mutex
+}
+
+// userAgentRuleFile holds the rules of a uap-core style regexes file.
+type userAgentRuleFile struct {
+	UserAgentParsers []userAgentRuleSpec
+	OSParsers        []userAgentRuleSpec
+	DeviceParsers    []userAgentRuleSpec
+}
+
+// userAgentRuleSpec is a single rule. Family, Major and Minor are used as
+// replacements for the name and version, Brand and Model are used by device
+// rules only. Replacements may refer to capture groups by using $1 to $9.
+type userAgentRuleSpec struct {
+	Regex  string
+	Flag   string
+	Family string
+	Major  string
+	Minor  string
+	Patch  string
+	Brand  string
+	Model  string
+}
+
+type userAgentRule struct {
+	userAgentRuleSpec
+	expr *regexp.Regexp
+}
+
+type userAgentParser struct {
+	browsers []userAgentRule
+	systems  []userAgentRule
+	devices  []userAgentRule
+}
+
+// userAgentReplacementKeys lists the regexes.yaml keys of the replacement
+// fields Family, Major, Minor and Patch for each parser section.
+var userAgentReplacementKeys = map[string][4]string{
+	"user_agent_parsers": {"family_replacement", "v1_replacement", "v2_replacement", "v3_replacement"},
+	"os_parsers":         {"os_replacement", "os_v1_replacement", "os_v2_replacement", "os_v3_replacement"},
+	"device_parsers":     {"device_replacement", "", "", ""},
+}
+
+var userAgentGroupRef = regexp.MustCompile(`\$(\d)`)
+
+func init() {
+	shared.RuntimeType.Register(UserAgent{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *UserAgent) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("UserAgentFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+
+	format.base = plugin.(core.Formatter)
+	format.sourceKey = conf.GetString("UserAgentSourceKey", "user_agent")
+	format.dataKey = conf.GetString("UserAgentDataKey", "user_agent_info")
+	format.cacheSize = conf.GetInt("UserAgentCacheSize", 1000)
+	format.cache = make(map[string]map[string]interface{})
+	format.guard = new(sync.Mutex)
+
+	rules := userAgentEmbeddedRules
+	if regexFile := conf.GetString("UserAgentRegexFile", ""); regexFile != "" {
+		if rules, err = loadUserAgentRules(regexFile); err != nil {
+			return fmt.Errorf("UserAgent: %s", err)
+		}
+	}
+
+	if format.parser, err = newUserAgentParser(rules); err != nil {
+		return fmt.Errorf("UserAgent: %s", err)
+	}
+	return nil
+}
+
+// loadUserAgentRules reads a uap-core regexes.yaml file.
+func loadUserAgentRules(path string) (userAgentRuleFile, error) {
+	rules := userAgentRuleFile{}
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+
+	sections := make(map[string][]map[string]string)
+	if err := yaml.Unmarshal(buffer, &sections); err != nil {
+		return rules, fmt.Errorf("%s: %s", path, err)
+	}
+
+	parse := func(section string) []userAgentRuleSpec {
+		keys := userAgentReplacementKeys[section]
+		specs := make([]userAgentRuleSpec, 0, len(sections[section]))
+		for _, entry := range sections[section] {
+			specs = append(specs, userAgentRuleSpec{
+				Regex:  entry["regex"],
+				Flag:   entry["regex_flag"],
+				Family: entry[keys[0]],
+				Major:  entry[keys[1]],
+				Minor:  entry[keys[2]],
+				Patch:  entry[keys[3]],
+				Brand:  entry["brand_replacement"],
+				Model:  entry["model_replacement"],
+			})
+		}
+		return specs
+	}
+
+	rules.UserAgentParsers = parse("user_agent_parsers")
+	rules.OSParsers = parse("os_parsers")
+	rules.DeviceParsers = parse("device_parsers")
+	return rules, nil
+}
+
+// newUserAgentParser compiles the regular expressions of the given rules.
+func newUserAgentParser(rules userAgentRuleFile) (*userAgentParser, error) {
+	compile := func(specs []userAgentRuleSpec) []userAgentRule {
+		compiled := make([]userAgentRule, 0, len(specs))
+		for _, spec := range specs {
+			expr := spec.Regex
+			if spec.Flag == "i" {
+				expr = "(?i)" + expr
+			}
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				// Some uap-core rules use constructs not supported by RE2
+				Log.Warning.Printf("UserAgent: skipping rule %s: %s", spec.Regex, err)
+				continue
+			}
+			compiled = append(compiled, userAgentRule{spec, regex})
+		}
+		return compiled
+	}
+
+	parser := &userAgentParser{
+		browsers: compile(rules.UserAgentParsers),
+		systems:  compile(rules.OSParsers),
+		devices:  compile(rules.DeviceParsers),
+	}
+	if len(parser.browsers)+len(parser.systems)+len(parser.devices) == 0 {
+		return nil, fmt.Errorf("no valid rules found")
+	}
+	return parser, nil
+}
+
+// replace returns the replacement with all group references resolved or the
+// capture group at the given index if replacement is empty.
+func (rule *userAgentRule) replace(replacement string, match []string, group int) string {
+	if replacement == "" {
+		if group < len(match) {
+			return match[group]
+		}
+		return "" // ### return, no such group ###
+	}
+
+	result := userAgentGroupRef.ReplaceAllStringFunc(replacement, func(ref string) string {
+		index, _ := strconv.Atoi(ref[1:])
+		if index < len(match) {
+			return match[index]
+		}
+		return ""
+	})
+	return strings.TrimSpace(result)
+}
+
+// userAgentFind returns the first rule matching the given string and its capture
+// groups.
+func userAgentFind(rules []userAgentRule, userAgent string) (*userAgentRule, []string) {
+	for i := range rules {
+		if match := rules[i].expr.FindStringSubmatch(userAgent); match != nil {
+			return &rules[i], match
+		}
+	}
+	return nil, nil
+}
+
+// joinUserAgentVersion builds a dotted version string from the given parts,
+// stopping at the first empty part.
+func joinUserAgentVersion(parts ...string) string {
+	version := []string{}
+	for _, part := range parts {
+		if part == "" {
+			break
+		}
+		version = append(version, part)
+	}
+	return strings.Join(version, ".")
+}
+
+// parse returns the browser, operating system and device information of the
+// given User-Agent string.
+func (parser *userAgentParser) parse(userAgent string) map[string]interface{} {
+	info := map[string]interface{}{
+		"browser": "Other",
+		"os":      "Other",
+		"device":  "Other",
+	}
+	add := func(key string, value string) {
+		if value != "" {
+			info[key] = value
+		}
+	}
+
+	if rule, match := userAgentFind(parser.browsers, userAgent); rule != nil {
+		add("browser", rule.replace(rule.Family, match, 1))
+		add("browser_version", joinUserAgentVersion(
+			rule.replace(rule.Major, match, 2),
+			rule.replace(rule.Minor, match, 3),
+			rule.replace(rule.Patch, match, 4)))
+	}
+
+	if rule, match := userAgentFind(parser.systems, userAgent); rule != nil {
+		add("os", rule.replace(rule.Family, match, 1))
+		add("os_version", joinUserAgentVersion(
+			rule.replace(rule.Major, match, 2),
+			rule.replace(rule.Minor, match, 3),
+			rule.replace(rule.Patch, match, 4)))
+	}
+
+	if rule, match := userAgentFind(parser.devices, userAgent); rule != nil {
+		add("device", rule.replace(rule.Family, match, 1))
+		if rule.Brand != "" {
+			add("device_brand", rule.replace(rule.Brand, match, 0))
+		}
+		add("device_model", rule.replace(rule.Model, match, 1))
+	}
+
+	return info
+}
+
+// getInfo returns the parsed data of the given User-Agent string, using the
+// cache if enabled.
+func (format *UserAgent) getInfo(userAgent string) map[string]interface{} {
+	if format.cacheSize <= 0 {
+		return format.parser.parse(userAgent) // ### return, no cache ###
+	}
+
+	format.guard.Lock()
+	info, cached := format.cache[userAgent]
+	format.guard.Unlock()
+	if cached {
+		return info // ### return, cached ###
+	}
+
+	info = format.parser.parse(userAgent)
+
+	format.guard.Lock()
+	if len(format.cache) >= format.cacheSize {
+		format.cache = make(map[string]map[string]interface{})
+	}
+	format.cache[userAgent] = info
+	format.guard.Unlock()
+	return info
+}
+
+// Format returns the message payload with added User-Agent information
+func (format *UserAgent) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	basePayload, stream := format.base.Format(msg)
+
+	values, err := decodeJSONObject(basePayload)
+	if err != nil {
+		Log.Error.Print("UserAgent: ", err)
+		return basePayload, stream // ### return, not a JSON object ###
+	}
+
+	userAgent, _ := values[format.sourceKey].(string)
+	if userAgent == "" {
+		return basePayload, stream // ### return, no User-Agent ###
+	}
+
+	values[format.dataKey] = format.getInfo(userAgent)
+
+	payload, err := encodeJSON(values)
+	if err != nil {
+		Log.Error.Print("UserAgent: ", err)
+		return basePayload, stream // ### return, not representable ###
+	}
+	return payload, stream
+}
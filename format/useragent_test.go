@@ -0,0 +1,92 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserAgent(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	format := UserAgent{}
+	conf := core.NewPluginConfig("format.UserAgent")
+	conf.Settings["UserAgentSourceKey"] = "agent"
+	conf.Settings["UserAgentDataKey"] = "ua"
+	expect.NoError(format.Configure(conf))
+
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.109 Safari/537.36":                       `{"browser":"Chrome","browser_version":"120.0.6099","device":"Other","os":"Windows","os_version":"10"}`,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1":  `{"browser":"Mobile Safari","browser_version":"17.1","device":"iPhone","device_brand":"Apple","device_model":"iPhone","os":"iOS","os_version":"17.1.2"}`,
+		"Mozilla/5.0 (Linux; Android 13; SM-S911B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36": `{"browser":"Samsung Internet","browser_version":"23.0","device":"Samsung SM-S911B","device_brand":"Samsung","device_model":"SM-S911B","os":"Android","os_version":"13"}`,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                                                   `{"browser":"Googlebot","browser_version":"2.1","device":"Spider","device_brand":"Spider","device_model":"Desktop","os":"Other"}`,
+		"unknown": `{"browser":"Other","device":"Other","os":"Other"}`,
+	}
+
+	for userAgent, expected := range tests {
+		for i := 0; i < 2; i++ { // second run uses the cache
+			msg := core.NewMessage(nil, []byte(`{"agent":"`+userAgent+`"}`), 0)
+			result, _ := format.Format(msg)
+			expect.Equal(`{"agent":"`+userAgent+`","ua":`+expected+`}`, string(result))
+		}
+	}
+
+	// Missing fields and non-JSON messages are passed as-is
+	for _, payload := range []string{`{"host":"web01"}`, "curl/8.4.0"} {
+		msg := core.NewMessage(nil, []byte(payload), 0)
+		result, _ := format.Format(msg)
+		expect.Equal(payload, string(result))
+	}
+}
+
+func TestUserAgentRegexFile(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-useragent")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	regexFile := filepath.Join(dir, "regexes.yaml")
+	expect.NoError(ioutil.WriteFile(regexFile, []byte(`
+user_agent_parsers:
+  - regex: '(gollum)/(\d+)\.(\d+)'
+    family_replacement: 'Gollum'
+os_parsers:
+  - regex: '(TestOS) (\d+)'
+    os_v1_replacement: '$2$2'
+device_parsers:
+  - regex: 'device (\w+)'
+    regex_flag: 'i'
+    device_replacement: 'Test $1'
+    brand_replacement: 'Test'
+`), 0644))
+
+	format := UserAgent{}
+	conf := core.NewPluginConfig("format.UserAgent")
+	conf.Settings["UserAgentRegexFile"] = regexFile
+	conf.Settings["UserAgentCacheSize"] = 0
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte(`{"user_agent":"gollum/0.4 (TestOS 2; DEVICE x1)"}`), 0)
+	result, _ := format.Format(msg)
+	expect.Equal(`{"user_agent":"gollum/0.4 (TestOS 2; DEVICE x1)","user_agent_info":{"browser":"Gollum","browser_version":"0.4","device":"Test x1","device_brand":"Test","device_model":"x1","os":"TestOS","os_version":"22"}}`, string(result))
+
+	conf.Settings["UserAgentRegexFile"] = filepath.Join(dir, "missing.yaml")
+	expect.NotNil(format.Configure(conf))
+}
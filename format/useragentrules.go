@@ -0,0 +1,66 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+// userAgentEmbeddedRules is a compact subset of the uap-core regexes.yaml
+// covering common browsers, operating systems, devices and crawlers. Rules
+// are evaluated in order, the first matching rule is used. As in uap-core the
+// first capture group is used as name and the following groups as version if
+// no replacement is given.
+var userAgentEmbeddedRules = userAgentRuleFile{
+	UserAgentParsers: []userAgentRuleSpec{
+		{Regex: `(Googlebot|bingbot|YandexBot|DuckDuckBot|Baiduspider|facebookexternalhit|Twitterbot|Slackbot|AhrefsBot|Applebot)(?:/(\d+)\.(\d+))?`},
+		{Regex: `(curl|Wget|python-requests|Go-http-client|okhttp|Apache-HttpClient)/(\d+)\.(\d+)(?:\.(\d+))?`},
+		{Regex: `(Edg(?:e|A|iOS)?)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Edge"},
+		{Regex: `(OPR|Opera)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Opera"},
+		{Regex: `(SamsungBrowser)/(\d+)\.(\d+)`, Family: "Samsung Internet"},
+		{Regex: `(YaBrowser)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Yandex Browser"},
+		{Regex: `(Vivaldi)/(\d+)\.(\d+)(?:\.(\d+))?`},
+		{Regex: `(FxiOS)/(\d+)\.(\d+)`, Family: "Firefox iOS"},
+		{Regex: `(CriOS)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Chrome Mobile iOS"},
+		{Regex: `; wv\).+(Chrome)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Chrome Mobile WebView"},
+		{Regex: `(Chrome)/(\d+)\.(\d+)(?:\.(\d+))?.* Mobile`, Family: "Chrome Mobile"},
+		{Regex: `(Chromium)/(\d+)\.(\d+)(?:\.(\d+))?`},
+		{Regex: `(Chrome)/(\d+)\.(\d+)(?:\.(\d+))?`},
+		{Regex: `Android.+(Firefox)/(\d+)\.(\d+)(?:\.(\d+))?`, Family: "Firefox Mobile"},
+		{Regex: `(Firefox)/(\d+)\.(\d+)(?:\.(\d+))?`},
+		{Regex: `(Version)/(\d+)\.(\d+)(?:\.(\d+))?.*Mobile.*Safari/`, Family: "Mobile Safari"},
+		{Regex: `(Version)/(\d+)\.(\d+)(?:\.(\d+))?.*Safari/`, Family: "Safari"},
+		{Regex: `(Trident)/7\.0;.*rv:(\d+)\.(\d+)`, Family: "IE"},
+		{Regex: `(MSIE) (\d+)\.(\d+)`, Family: "IE"},
+	},
+	OSParsers: []userAgentRuleSpec{
+		{Regex: `(Windows Phone) (\d+)\.(\d+)`, Family: "Windows Phone"},
+		{Regex: `(Windows NT 10\.0)`, Family: "Windows", Major: "10"},
+		{Regex: `(Windows NT 6\.3)`, Family: "Windows", Major: "8", Minor: "1"},
+		{Regex: `(Windows NT 6\.2)`, Family: "Windows", Major: "8"},
+		{Regex: `(Windows NT 6\.1)`, Family: "Windows", Major: "7"},
+		{Regex: `(Android) (\d+)(?:\.(\d+))?(?:\.(\d+))?`},
+		{Regex: `(CPU OS|iPhone OS|CPU iPhone OS) (\d+)_(\d+)(?:_(\d+))?`, Family: "iOS"},
+		{Regex: `(Mac OS X) (\d+)[_.](\d+)(?:[_.](\d+))?`},
+		{Regex: `(CrOS) \S+ (\d+)\.(\d+)(?:\.(\d+))?`, Family: "Chrome OS"},
+		{Regex: `(Ubuntu|Fedora|Debian)`},
+		{Regex: `(Linux)`},
+	},
+	DeviceParsers: []userAgentRuleSpec{
+		{Regex: `(?i)bot|crawler|spider|slurp`, Family: "Spider", Brand: "Spider", Model: "Desktop"},
+		{Regex: `iPad`, Family: "iPad", Brand: "Apple", Model: "iPad"},
+		{Regex: `iPhone`, Family: "iPhone", Brand: "Apple", Model: "iPhone"},
+		{Regex: `Macintosh`, Family: "Mac", Brand: "Apple", Model: "Mac"},
+		{Regex: `; (SM-[A-Z0-9]+)`, Family: "Samsung $1", Brand: "Samsung", Model: "$1"},
+		{Regex: `; (Pixel[^;)]*?)(?: Build/|\)|;)`, Family: "$1", Brand: "Google", Model: "$1"},
+		{Regex: `Android [^;]+; ([^;)]+?)(?: Build/|\))`, Family: "$1", Brand: "Generic_Android", Model: "$1"},
+	},
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"runtime"
+	"time"
+)
+
+// Wasm is a formatter that transforms messages with a WebAssembly module.
+// This allows sandboxed transformations written in e.g. Rust, Go or
+// AssemblyScript. The module is executed by an interpreter and cannot access
+// files or the network. See shared.WasmPool for the required exports.
+// Configuration example
+//
+//   - "<producer|stream>":
+//     Formatter: "format.Wasm"
+//     WasmFormatter: "format.Forward"
+//     WasmModule: "/etc/gollum/transform.wasm"
+//     WasmFunction: "transform"
+//     WasmMaxMemoryMB: 16
+//     WasmFuel: 10000000
+//     WasmTimeoutMs: 100
+//     WasmInstances: 0
+//     WasmErrorStream: ""
+//
+// The function is called as <function>(ptr i32, len i32) i64 with the
+// message stored in a buffer returned by alloc. The result contains the
+// address of the new payload in the upper and its length in the lower 32
+// bits. A negative result drops the message.
+//
+// WasmFormatter defines the formatter applied before the module is called.
+// By default this is set to "format.Forward".
+//
+// WasmModule defines the path to the WebAssembly module. If not set,
+// messages are passed as-is and an error is logged.
+//
+// WasmFunction defines the exported function called for each message.
+// By default this is set to "transform".
+//
+// WasmMaxMemoryMB defines the maximum size of the module's memory in MB.
+// By default this is set to 16.
+//
+// WasmFuel defines the maximum number of instructions executed per call.
+// Set to 0 to disable the limit. By default this is set to 10000000.
+//
+// WasmTimeoutMs defines the maximum number of milliseconds a call may take.
+// Set to 0 to disable the limit. By default this is set to 100.
+//
+// WasmInstances defines the number of module instances kept for concurrent
+// calls. By default this is set to 0, i.e. the number of CPUs.
+//
+// WasmErrorStream defines the stream messages are routed to if the module
+// fails, e.g. by exceeding a limit. The payload of these messages is not
+// modified. By default this is set to "", i.e. messages are passed as-is and
+// an error is logged.
+type Wasm struct {
+	base        core.Formatter
+	pool        *shared.WasmPool
+	errorStream core.MessageStreamID
+	reroute     bool
+}
+
+func init() {
+	shared.RuntimeType.Register(Wasm{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Wasm) Configure(conf core.PluginConfig) error {
+	plugin, err := core.NewPluginWithType(conf.GetString("WasmFormatter", "format.Forward"), conf)
+	if err != nil {
+		return err
+	}
+	format.base = plugin.(core.Formatter)
+
+	path := conf.GetString("WasmModule", "")
+	if path == "" {
+		Log.Error.Print("Wasm: WasmModule must be set")
+		return nil // ### return, no module ###
+	}
+	instances := conf.GetInt("WasmInstances", 0)
+	if instances <= 0 {
+		instances = runtime.NumCPU()
+	}
+	options := shared.WasmOptions{MaxMemoryPages: uint32(conf.GetInt("WasmMaxMemoryMB", 16) * 16)}
+
+	format.pool, err = shared.OpenWasmPool(path,
+		conf.GetString("WasmFunction", "transform"),
+		options,
+		int64(conf.GetInt("WasmFuel", 10000000)),
+		time.Duration(conf.GetInt("WasmTimeoutMs", 100))*time.Millisecond,
+		instances)
+	if err != nil {
+		return fmt.Errorf("Wasm: %s", err)
+	}
+
+	if stream := conf.GetString("WasmErrorStream", ""); stream != "" {
+		format.errorStream = core.GetStreamID(stream)
+		format.reroute = true
+	}
+	return nil
+}
+
+// Format passes the message to the module and returns the payload written
+// by the module.
+func (format *Wasm) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	data, streamID := format.base.Format(msg)
+	if format.pool == nil {
+		return data, streamID // ### return, no module ###
+	}
+
+	var result []byte
+	dropped := false
+	err := format.pool.Call(data, func(inst *shared.WasmInstance, value uint64) error {
+		if int64(value) < 0 {
+			dropped = true
+			return nil // ### return, drop message ###
+		}
+		var err error
+		result, err = inst.ReadMemory(uint32(value>>32), uint32(value))
+		return err
+	})
+
+	switch {
+	case err != nil && format.reroute:
+		return data, format.errorStream
+	case err != nil:
+		Log.Error.Print("Wasm: ", err)
+		return data, streamID
+	case dropped:
+		return data, core.DroppedStreamID
+	default:
+		return result, streamID
+	}
+}
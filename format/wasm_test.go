@@ -0,0 +1,75 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// wasmTestChop is a module exporting alloc and transform. Transform removes
+// the last byte of a message and drops empty messages.
+var wasmTestChop = []byte{
+	0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0C, 0x02, 0x60, 0x01, 0x7F, 0x01, 0x7F,
+	0x60, 0x02, 0x7F, 0x7F, 0x01, 0x7E, 0x03, 0x03, 0x02, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1E, 0x03, 0x06, 0x6D, 0x65, 0x6D, 0x6F, 0x72, 0x79, 0x02, 0x00, 0x05, 0x61, 0x6C, 0x6C,
+	0x6F, 0x63, 0x00, 0x00, 0x09, 0x74, 0x72, 0x61, 0x6E, 0x73, 0x66, 0x6F, 0x72, 0x6D, 0x00, 0x01,
+	0x0A, 0x20, 0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0B, 0x18, 0x00, 0x20, 0x01, 0x45, 0x04, 0x40,
+	0x42, 0x7F, 0x0F, 0x0B, 0x20, 0x00, 0xAD, 0x42, 0x20, 0x86, 0x20, 0x01, 0x41, 0x01, 0x6B, 0xAD,
+	0x84, 0x0B,
+}
+
+func TestWasmFormatter(t *testing.T) {
+	expect := shared.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-wasm")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chop.wasm")
+	expect.NoError(ioutil.WriteFile(path, wasmTestChop, 0644))
+
+	conf := core.NewPluginConfig("format.Wasm")
+	conf.Settings["WasmModule"] = path
+	format := Wasm{}
+	expect.NoError(format.Configure(conf))
+
+	msg := core.NewMessage(nil, []byte("message\n"), 0)
+	result, streamID := format.Format(msg)
+	expect.Equal("message", string(result))
+	expect.Equal(msg.StreamID, streamID)
+	expect.Equal("message\n", string(msg.Data))
+
+	msg.Data = []byte{}
+	_, streamID = format.Format(msg)
+	expect.Equal(core.DroppedStreamID, streamID)
+
+	// Messages larger than the module's memory fail
+	conf.Settings["WasmErrorStream"] = "failed"
+	expect.NoError(format.Configure(conf))
+	msg.Data = make([]byte, 70000)
+	result, streamID = format.Format(msg)
+	expect.Equal(70000, len(result))
+	expect.Equal(core.GetStreamID("failed"), streamID)
+
+	conf.Settings["WasmFunction"] = "alloc"
+	expect.NotNil(format.Configure(conf))
+
+	conf.Settings["WasmModule"] = filepath.Join(dir, "missing.wasm")
+	expect.NotNil(format.Configure(conf))
+}
@@ -16,7 +16,7 @@ package main
 
 import (
 	"fmt"
-	_ "github.com/trivago/gollum/consumer"
+	"github.com/trivago/gollum/consumer"
 	_ "github.com/trivago/gollum/contrib"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
@@ -30,6 +30,8 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -47,10 +49,91 @@ func dumpMemoryProfile() {
 	}
 }
 
+func parseSoakFaults(spec string) (core.FaultInjection, error) {
+	faults := core.FaultInjection{}
+	for _, item := range strings.Split(spec, ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(keyValue) != 2 {
+			return faults, fmt.Errorf("Malformed soak fault: %s", item)
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(keyValue[1]), 64)
+		if err != nil {
+			return faults, fmt.Errorf("Malformed soak fault value: %s", item)
+		}
+
+		switch strings.ToLower(keyValue[0]) {
+		case "fail":
+			faults.FailRate = value / 100
+		case "slow":
+			faults.SlowRate = value / 100
+		case "malformed":
+			faults.MalformedRate = value / 100
+		case "delayms":
+			faults.MaxDelay = time.Duration(value) * time.Millisecond
+		default:
+			return faults, fmt.Errorf("Unknown soak fault: %s", keyValue[0])
+		}
+	}
+	return faults, nil
+}
+
+// configureLog sets the log format and output given by the command line and
+// returns if logs should be written to the internal log stream.
+func configureLog(format, output string) (logStreamMode, error) {
+	switch strings.ToLower(format) {
+	case "text":
+		Log.SetFormat(Log.FormatText)
+	case "json":
+		Log.SetFormat(Log.FormatJSON)
+	default:
+		return logStreamAuto, fmt.Errorf("Unknown log format: %s", format)
+	}
+
+	switch output {
+	case "":
+		return logStreamAuto, nil
+	case "stream":
+		return logStreamAlways, nil
+	case "stdout":
+		Log.SetOutput(os.Stdout)
+	case "stderr":
+		Log.SetOutput(os.Stderr)
+	default:
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return logStreamAuto, err
+		}
+		Log.SetOutput(file)
+	}
+	return logStreamNever, nil
+}
+
+// soakReport prints the fault injection counters and returns false if
+// messages have been lost although a retry queue was configured.
+func soakReport() bool {
+	stats := core.GetFaultInjectionStats()
+	fmt.Printf("Soak: %d failed, %d delayed, %d malformed, %d lost\n", stats.Failed, stats.Delayed, stats.Malformed, stats.Lost)
+
+	if core.IsRetryQueueEnabled() && stats.Lost > 0 {
+		fmt.Println("Soak: FAILED - messages were lost with a retry queue configured")
+		return false
+	}
+
+	fmt.Println("Soak: OK")
+	return true
+}
+
 func main() {
 	parseFlags()
 	Log.SetVerbosity(Log.Verbosity(*flagLoglevel))
 
+	logToStream, err := configureLog(*flagLogFormat, *flagLogOutput)
+	if err != nil {
+		fmt.Printf("Log: %s\n", err.Error())
+		return // ### return, log config error ###
+	}
+
 	if *flagVersion {
 		fmt.Printf("Gollum v%d.%d.%d\n", gollumMajorVer, gollumMinorVer, gollumPatchVer)
 		return // ### return, version only ###
@@ -66,15 +149,30 @@ func main() {
 		return // ### return, nothing to do ###
 	}
 
+	// Load external plugins
+
+	if *flagPlugins != "" {
+		if err := loadPlugins(*flagPlugins); err != nil {
+			fmt.Printf("Plugins: %s\n", err.Error())
+			return // ### return, plugin error ###
+		}
+	}
+
 	// Read config
 
 	config, err := core.ReadConfig(*configFile)
 	if err != nil {
 		fmt.Printf("Config: %s\n", err.Error())
+		if *flagTestConfigFile != "" {
+			os.Exit(1)
+		}
 		return // ### return, config error ###
 	} else if *flagTestConfigFile != "" {
-		fmt.Printf("Config: %s parsed as ok.\n", *configFile)
-		newMultiplexer(config, false)
+		fmt.Printf("Config: testing %s\n", *configFile)
+		plex := newMultiplexer(config, false)
+		if !plex.testConfig(config) {
+			os.Exit(1)
+		}
 		return // ### return, only test config ###
 	}
 
@@ -108,14 +206,55 @@ func main() {
 
 	// Metrics server start
 
+	if *flagMetricsPort != 0 || *flagAdminAddress != "" {
+		core.EnableStreamMetrics()
+	}
+
 	if *flagMetricsPort != 0 {
 		server := shared.NewMetricServer()
 		go server.Start(*flagMetricsPort)
 		defer server.Stop()
 	}
 
+	// Soak test mode
+
+	if *flagSoakSec > 0 {
+		faults, err := parseSoakFaults(*flagSoakFaults)
+		if err != nil {
+			fmt.Printf("Soak: %s\n", err.Error())
+			return // ### return, soak config error ###
+		}
+		core.EnableFaultInjection(faults)
+	}
+
+	// Benchmark mode
+
+	if isBenchmark() {
+		if err := prepareBenchmark(config, *flagBenchCount); err != nil {
+			fmt.Printf("Bench: %s\n", err.Error())
+			return // ### return, bench config error ###
+		}
+		core.EnableBenchmark()
+	}
+
 	// Start the multiplexer
 
+	consumer.SetConsoleStream(*flagConsoleStream)
+
 	plex := newMultiplexer(config, *flagProfile)
-	plex.run()
+	plex.soakTime = time.Duration(*flagSoakSec) * time.Second
+	plex.shutdownTime = time.Duration(*flagShutdownSec) * time.Second
+	plex.logToStream = logToStream
+	plex.adminAddress = *flagAdminAddress
+	plex.adminToken = *flagAdminToken
+
+	if core.IsBenchmarkEnabled() {
+		runBenchmark(plex)
+	} else {
+		plex.run()
+	}
+
+	if core.IsFaultInjectionEnabled() && !soakReport() {
+		os.Exit(1)
+	}
 }
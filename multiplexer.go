@@ -49,9 +49,10 @@ const (
 )
 
 const (
-	signalNone = signalType(iota)
-	signalExit = signalType(iota)
-	signalRoll = signalType(iota)
+	signalNone    = signalType(iota)
+	signalExit    = signalType(iota)
+	signalRoll    = signalType(iota)
+	signalUpgrade = signalType(iota)
 )
 
 type multiplexer struct {
@@ -61,9 +62,25 @@ type multiplexer struct {
 	producerWorker *sync.WaitGroup
 	state          multiplexerState
 	signal         chan os.Signal
+	commands       chan signalType
 	profile        bool
+	soakTime       time.Duration
+	benchTime      time.Duration
+	shutdownTime   time.Duration
+	logToStream    logStreamMode
+	adminAddress   string
+	adminToken     string
+	configErrors   int
 }
 
+type logStreamMode byte
+
+const (
+	logStreamAuto   = logStreamMode(iota)
+	logStreamAlways = logStreamMode(iota)
+	logStreamNever  = logStreamMode(iota)
+)
+
 // Create a new multiplexer based on a given config file.
 func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 	// Configure the multiplexer, create a byte pool and assign it to the log
@@ -97,6 +114,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 		pluginType := shared.RuntimeType.GetTypeOf(config.Typename)
 		if pluginType == nil {
 			Log.Error.Print("Failed to load plugin ", config.Typename, ": Type not found")
+			plex.configErrors++
 			continue // ### continue ###
 		}
 
@@ -116,6 +134,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 
 		if !validPlugin {
 			Log.Error.Print("Failed to load plugin ", config.Typename, ": Does not qualify for consumer, producer or stream interface")
+			plex.configErrors++
 
 			consumerMatch, consumerMissing := shared.GetMissingMethods(pluginType, consumerInterface)
 			producerMatch, producerMissing := shared.GetMissingMethods(pluginType, producerInterface)
@@ -155,6 +174,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 			plugin, err := core.NewPlugin(config)
 			if err != nil {
 				Log.Error.Print("Failed to configure stream plugin ", config.Typename, ": ", err)
+				plex.configErrors++
 				continue // ### continue ###
 			}
 			core.StreamTypes.Register(plugin.(core.Stream), core.GetStreamID(streamName))
@@ -172,6 +192,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 			plugin, err := core.NewPlugin(config)
 			if err != nil {
 				Log.Error.Print("Failed to configure producer plugin ", config.Typename, ": ", err)
+				plex.configErrors++
 				continue // ### continue ###
 			}
 
@@ -180,6 +201,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 
 			if len(streams) == 0 {
 				Log.Error.Print("Producer plugin ", config.Typename, " has no streams set")
+				plex.configErrors++
 				continue // ### continue ###
 			}
 
@@ -195,7 +217,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 			// Do not add internal streams to wildcard stream
 
 			for _, streamID := range streams {
-				if streamID != core.LogInternalStreamID && streamID != core.DroppedStreamID {
+				if streamID != core.LogInternalStreamID && streamID != core.HealthInternalStreamID && streamID != core.TraceInternalStreamID && streamID != core.DroppedStreamID {
 					wildcardStream.AddProducer(producer)
 					break
 				}
@@ -217,6 +239,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 			plugin, err := core.NewPlugin(config)
 			if err != nil {
 				Log.Error.Print("Failed to configure consumer plugin ", config.Typename, ": ", err)
+				plex.configErrors++
 				continue // ### continue ###
 			}
 
@@ -233,7 +256,7 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 	core.StreamTypes.ForEachStream(
 		func(streamID core.MessageStreamID, stream core.Stream) {
 			switch streamID {
-			case core.LogInternalStreamID, core.WildcardStreamID, core.DroppedStreamID:
+			case core.LogInternalStreamID, core.HealthInternalStreamID, core.TraceInternalStreamID, core.WildcardStreamID, core.DroppedStreamID:
 				// Internal streams are excluded for wildcard listeners
 			default:
 				core.StreamTypes.AddWildcardProducersToStream(stream)
@@ -247,7 +270,10 @@ func newMultiplexer(conf *core.Config, profile bool) multiplexer {
 // The internal log is flushed after the consumers have been shut down so that
 // consumer related messages are still in the log.
 // Producers are flushed after flushing the log, so producer related shutdown
-// messages will be posted to stdout
+// messages will be posted to stdout.
+// If a shutdown time is set, the whole sequence is aborted once this time has
+// passed. The number of flushed and abandoned messages is reported for each
+// producer.
 func (plex *multiplexer) shutdown() {
 	// Handle panics if any
 	if r := recover(); r != nil {
@@ -262,18 +288,43 @@ func (plex *multiplexer) shutdown() {
 	Log.Note.Print("Filthy little hobbites. They stole it from us. (shutdown)")
 	stateAtShutdown := plex.state
 
+	var deadline <-chan time.Time
+	if plex.shutdownTime > 0 {
+		deadline = time.After(plex.shutdownTime)
+	}
+
 	// Shutdown consumers
+	// Paused consumers and blocked streams need to be released first so that
+	// consumers can react on the stop command.
 	plex.state = multiplexerStateStopConsumers
+	core.ReleaseFuses()
 	if stateAtShutdown >= multiplexerStateStartConsumers {
 		for _, consumer := range plex.consumers {
 			consumer.Control() <- core.PluginControlStop
 		}
 
-		plex.consumerWorker.Wait()
+		if !waitForWorkers(plex.consumerWorker, deadline) {
+			Log.ResetWriter()
+			Log.Error.Print("Consumers did not stop within ", plex.shutdownTime)
+			plex.reportDrain()
+			plex.state = multiplexerStateStopped
+			return // ### return, shutdown time exceeded ###
+		}
+	}
+
+	// Streams generating messages and health events have to be stopped
+	// before producers are stopped
+	if stateAtShutdown >= multiplexerStateStartProducers {
+		core.StreamTypes.StopStreams()
+	}
+	for _, consumer := range plex.consumers[1:] {
+		core.EmitHealthEvent(core.HealthPluginStopped, pluginName(consumer), nil)
 	}
+	core.StopHealthEvents()
+	core.StopTraceSpans()
 
 	// Make sure remaining warning / errors are written to stderr
-	Log.SetWriter(os.Stdout)
+	Log.ResetWriter()
 	Log.Note.Print("It's the only way. Go in, or go back. (flushing)")
 
 	// Shutdown producers
@@ -282,12 +333,45 @@ func (plex *multiplexer) shutdown() {
 		for _, producer := range plex.producers {
 			producer.Control() <- core.PluginControlStop
 		}
-		plex.producerWorker.Wait()
+
+		if !waitForWorkers(plex.producerWorker, deadline) {
+			Log.Error.Print("Producers did not stop within ", plex.shutdownTime)
+		}
+		plex.reportDrain()
 	}
 
 	plex.state = multiplexerStateStopped
 }
 
+// waitForWorkers waits for the given workers to finish or for the deadline
+// to pass. A nil deadline waits forever. Returns false if the deadline was
+// reached.
+func waitForWorkers(workers *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// reportDrain writes the number of messages flushed and abandoned by each
+// producer during shutdown to the log.
+func (plex *multiplexer) reportDrain() {
+	for _, producer := range plex.producers {
+		if reporter, isReporter := producer.(core.DrainReporter); isReporter {
+			flushed, pending := reporter.DrainStats()
+			Log.Note.Printf("%s flushed %d messages, %d messages abandoned", pluginName(producer), flushed, pending)
+		}
+	}
+}
+
 // Run the multiplexer.
 // Fetch messags from the consumers and pass them to all producers.
 func (plex multiplexer) run() {
@@ -314,10 +398,20 @@ func (plex multiplexer) run() {
 	}
 
 	// If there are intenal log listeners switch to stream mode
-	if core.StreamTypes.IsStreamRegistered(core.LogInternalStreamID) {
+	switch hasListeners := core.StreamTypes.IsStreamRegistered(core.LogInternalStreamID); {
+	case plex.logToStream == logStreamAlways && !hasListeners:
+		Log.Warning.Print("Logs cannot be written to ", core.LogInternalStream, " as no producer listens to it")
+	case plex.logToStream != logStreamNever && hasListeners:
 		Log.SetWriter(plex.consumers[0].(*core.LogConsumer))
 	}
 
+	core.StartHealthEvents()
+	core.StartTraceSpans()
+	core.StreamTypes.StartStreams()
+	for _, producer := range plex.producers {
+		core.EmitHealthEvent(core.HealthPluginStarted, pluginName(producer), nil)
+	}
+
 	// Launch consumers
 	plex.state = multiplexerStateStartConsumers
 	for _, consumer := range plex.consumers {
@@ -327,6 +421,19 @@ func (plex multiplexer) run() {
 			consumer.Consume(plex.consumerWorker)
 		}()
 	}
+	for _, consumer := range plex.consumers[1:] {
+		core.EmitHealthEvent(core.HealthPluginStarted, pluginName(consumer), nil)
+	}
+
+	// Admin interface
+	plex.commands = make(chan signalType, 1)
+	if plex.adminAddress != "" {
+		if admin, err := startAdminServer(&plex, plex.adminAddress, plex.adminToken); err != nil {
+			Log.Error.Print("Admin: ", err)
+		} else {
+			defer admin.stop()
+		}
+	}
 
 	// Main loop - wait for exit
 	// Apache is using SIG_USR1 in some cases to signal child processes.
@@ -338,8 +445,26 @@ func (plex multiplexer) run() {
 	measure := time.Now()
 	timer := time.NewTicker(time.Duration(2) * time.Second)
 
+	var soakTimeout, benchTimeout <-chan time.Time
+	if plex.soakTime > 0 {
+		soakTimeout = time.After(plex.soakTime)
+	}
+	if plex.benchTime > 0 {
+		benchTimeout = time.After(plex.benchTime)
+	}
+
 	for {
 		select {
+		case <-soakTimeout:
+			Log.Note.Print("Soak test finished after ", plex.soakTime)
+			plex.state = multiplexerStateShutdown
+			return // ### return, soak test done ###
+
+		case <-benchTimeout:
+			Log.Note.Print("Benchmark finished after ", plex.benchTime)
+			plex.state = multiplexerStateShutdown
+			return // ### return, benchmark done ###
+
 		case <-timer.C:
 			duration := time.Since(measure)
 			measure = time.Now()
@@ -349,6 +474,7 @@ func (plex multiplexer) run() {
 			value := float64(messageCount) / duration.Seconds()
 			shared.Metric.SetF(metricMsgSec, value)
 			shared.Metric.Add(metricMessages, int64(messageCount))
+			shared.Metric.UpdateHistograms()
 
 			if plex.profile {
 				Log.Note.Printf("Processed %.2f msg/sec", value)
@@ -362,22 +488,43 @@ func (plex multiplexer) run() {
 			}
 
 		case sig := <-plex.signal:
-			switch translateSignal(sig) {
-			case signalExit:
-				Log.Note.Print("Master betrayed us. Wicked. Tricksy, False. (signal)")
-				plex.state = multiplexerStateShutdown
-				return // ### return, exit requested ###
-
-			case signalRoll:
-				for _, consumer := range plex.consumers {
-					consumer.Control() <- core.PluginControlRoll
-				}
-				for _, producer := range plex.producers {
-					producer.Control() <- core.PluginControlRoll
-				}
+			if plex.handleCommand(translateSignal(sig)) {
+				return // ### return, shutdown requested ###
+			}
 
-			default:
+		case command := <-plex.commands:
+			if plex.handleCommand(command) {
+				return // ### return, shutdown requested ###
 			}
 		}
 	}
 }
+
+// handleCommand executes a command received via signal or the admin
+// interface. Returns true if the multiplexer has to shut down.
+func (plex *multiplexer) handleCommand(command signalType) bool {
+	switch command {
+	case signalExit:
+		Log.Note.Print("Master betrayed us. Wicked. Tricksy, False. (signal)")
+		plex.state = multiplexerStateShutdown
+		return true // ### return, exit requested ###
+
+	case signalUpgrade:
+		if err := startUpgradeProcess(); err != nil {
+			Log.Error.Print("Upgrade failed: ", err)
+			return false // ### return, keep running ###
+		}
+		Log.Note.Print("Handing over to a new process. (upgrade)")
+		plex.state = multiplexerStateShutdown
+		return true // ### return, upgrade started ###
+
+	case signalRoll:
+		for _, consumer := range plex.consumers {
+			consumer.Control() <- core.PluginControlRoll
+		}
+		for _, producer := range plex.producers {
+			producer.Control() <- core.PluginControlRoll
+		}
+	}
+	return false
+}
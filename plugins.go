@@ -0,0 +1,90 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+// loadPlugins opens all Go plugin files given by a comma separated list of
+// files or directories. Directories are searched for files ending with ".so".
+// Plugins register their types via shared.RuntimeType.Register in their init
+// function, just like the builtin plugins do. A plugin therefore has to be
+// built with "go build -buildmode=plugin" against the same gollum sources and
+// Go version as the gollum binary loading it. As type names are derived from
+// the package path, plugin types should be placed in a regular package that is
+// imported by the main package of the plugin.
+func loadPlugins(pathList string) error {
+	var files []string
+	for _, path := range strings.Split(pathList, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue // ### continue, empty entry ###
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue // ### continue, single file ###
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".so") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	for _, file := range files {
+		registered := make(map[string]bool)
+		for _, typeName := range shared.RuntimeType.GetRegistered("") {
+			registered[typeName] = true
+		}
+
+		if _, err := plugin.Open(file); err != nil {
+			return fmt.Errorf("Failed to load plugin %s: %s", file, err.Error())
+		}
+
+		var newTypes []string
+		for _, typeName := range shared.RuntimeType.GetRegistered("") {
+			if !registered[typeName] {
+				newTypes = append(newTypes, typeName)
+			}
+		}
+
+		if len(newTypes) == 0 {
+			Log.Warning.Printf("Plugin %s did not register any types", file)
+		} else {
+			Log.Note.Printf("Plugin %s registered %s", file, strings.Join(newTypes, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,430 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregate producer plugin
+// Configuration example
+//
+//   - "producer.Aggregate":
+//     Enable: true
+//     Stream: "access"
+//     AggregateStream: "metrics"
+//     WindowSec: 60
+//     WindowGraceSec: 1
+//     KeyFields:
+//       - "host"
+//       - "status"
+//     Aggregates:
+//       "requests": "count"
+//       "bytes": "sum:size"
+//       "latency_max": "max:latency"
+//       "visitors": "distinct:client/ip"
+//     MaxGroups: 10000
+//
+// This producer aggregates JSON messages over tumbling windows and sends one
+// summary message per window and group to another stream, e.g. to generate
+// per-minute metrics from raw access logs. Messages are assigned to a window
+// by their timestamp and grouped by the values of KeyFields. Summary messages
+// are JSON objects containing the fields "window_start" and "window_end"
+// (RFC3339), the value of each key field stored under its path and the result
+// of each aggregate. Messages are formatted before they are aggregated, so a
+// formatter can be used to convert messages to JSON. Messages that are not
+// valid JSON are ignored. Windows that are still open when gollum is stopped
+// are discarded.
+//
+// AggregateStream defines the stream summary messages are sent to. This
+// setting is mandatory.
+//
+// WindowSec defines the length of a window in seconds. Windows are aligned to
+// the wall clock, i.e. a window of 60 seconds always starts at a full minute.
+// By default this is set to 60.
+//
+// WindowGraceSec defines the number of seconds to wait after a window has
+// ended before its summary is sent. This gives messages still being processed
+// the chance to be counted. Messages arriving for a window that has already
+// been sent are ignored. By default this is set to 1.
+//
+// KeyFields defines a list of JSON fields the messages of a window are grouped
+// by. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. Messages without a key field are grouped with a
+// value of null. By default this is set to [], i.e. one summary is generated
+// per window.
+//
+// Aggregates defines a map of summary fields and the aggregate used to
+// calculate them. Valid aggregates are "count", "sum:<field>", "min:<field>",
+// "max:<field>", "avg:<field>" and "distinct:<field>". "count" counts the
+// messages of a group, "distinct" counts the number of different values of a
+// field. The numeric aggregates ignore messages where the field is missing or
+// is not a number or a numeric string. By default this is set to
+// {"count": "count"}.
+//
+// MaxGroups defines the maximum number of groups stored per window. Messages
+// for additional groups are ignored and a warning is written once per window.
+// By default this is set to 10000.
+type Aggregate struct {
+	core.ProducerBase
+	target     core.MessageStreamID
+	window     time.Duration
+	grace      time.Duration
+	keyFields  []string
+	aggregates []aggregateSpec
+	maxGroups  int
+	windows    map[int64]*aggregateWindow
+	sent       time.Time
+	sequence   uint64
+}
+
+const (
+	aggregateCount = iota
+	aggregateSum
+	aggregateMin
+	aggregateMax
+	aggregateAvg
+	aggregateDistinct
+)
+
+var aggregateKinds = map[string]int{
+	"count":    aggregateCount,
+	"sum":      aggregateSum,
+	"min":      aggregateMin,
+	"max":      aggregateMax,
+	"avg":      aggregateAvg,
+	"distinct": aggregateDistinct,
+}
+
+type aggregateSpec struct {
+	name  string
+	kind  int
+	field string
+}
+
+type aggregateWindow struct {
+	start    time.Time
+	groups   map[string]*aggregateGroup
+	overflow bool
+}
+
+type aggregateGroup struct {
+	keys   []interface{}
+	values []aggregateValue
+}
+
+type aggregateValue struct {
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
+	distinct map[string]struct{}
+}
+
+func init() {
+	shared.RuntimeType.Register(Aggregate{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Aggregate) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	target := conf.GetString("AggregateStream", "")
+	if target == "" {
+		return fmt.Errorf("Aggregate: AggregateStream must be set")
+	}
+	prod.target = core.GetStreamID(target)
+
+	prod.window = time.Duration(conf.GetInt("WindowSec", 60)) * time.Second
+	if prod.window <= 0 {
+		return fmt.Errorf("Aggregate: WindowSec must be larger than 0")
+	}
+	prod.grace = time.Duration(conf.GetInt("WindowGraceSec", 1)) * time.Second
+	prod.keyFields = conf.GetStringArray("KeyFields", []string{})
+	prod.maxGroups = conf.GetInt("MaxGroups", 10000)
+	prod.windows = make(map[int64]*aggregateWindow)
+
+	aggregates := conf.GetStringMap("Aggregates", map[string]string{"count": "count"})
+	names := make([]string, 0, len(aggregates))
+	for name := range aggregates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec, err := newAggregateSpec(name, aggregates[name])
+		if err != nil {
+			return err
+		}
+		prod.aggregates = append(prod.aggregates, spec)
+	}
+	if len(prod.aggregates) == 0 {
+		return fmt.Errorf("Aggregate: At least one aggregate must be set")
+	}
+
+	return nil
+}
+
+// newAggregateSpec parses an aggregate in the form "kind" or "kind:field".
+func newAggregateSpec(name string, definition string) (aggregateSpec, error) {
+	spec := aggregateSpec{name: name}
+	kindName := strings.ToLower(definition)
+	if split := strings.IndexByte(definition, ':'); split >= 0 {
+		kindName = strings.ToLower(definition[:split])
+		spec.field = definition[split+1:]
+	}
+
+	kind, known := aggregateKinds[kindName]
+	switch {
+	case !known:
+		return spec, fmt.Errorf("Aggregate: Unknown aggregate \"%s\" for %s", definition, name)
+	case kind == aggregateCount && spec.field != "":
+		return spec, fmt.Errorf("Aggregate: count does not accept a field (%s)", name)
+	case kind != aggregateCount && spec.field == "":
+		return spec, fmt.Errorf("Aggregate: %s requires a field (%s)", kindName, name)
+	}
+
+	spec.kind = kind
+	return spec, nil
+}
+
+// aggregateNumber converts a decoded JSON value to a number.
+func aggregateNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		return parsed, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// aggregateString converts a decoded JSON value to a string used for grouping
+// and distinct counts.
+func aggregateString(value interface{}) string {
+	if stringValue, isString := value.(string); isString {
+		return stringValue
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func (prod *Aggregate) getGroup(window *aggregateWindow, values shared.MarshalMap) *aggregateGroup {
+	keys := make([]interface{}, len(prod.keyFields))
+	keyStrings := make([]string, len(prod.keyFields))
+	for i, field := range prod.keyFields {
+		keys[i], _ = values.Path(field)
+		keyStrings[i] = aggregateString(keys[i])
+	}
+
+	// JSON encoded values never contain a raw newline
+	groupKey := strings.Join(keyStrings, "\n")
+	if group, exists := window.groups[groupKey]; exists {
+		return group // ### return, known group ###
+	}
+
+	if prod.maxGroups > 0 && len(window.groups) >= prod.maxGroups {
+		if !window.overflow {
+			window.overflow = true
+			Log.Warning.Printf("Aggregate: More than %d groups in window %s, ignoring new groups", prod.maxGroups, window.start.Format(time.RFC3339))
+		}
+		return nil // ### return, too many groups ###
+	}
+
+	group := &aggregateGroup{
+		keys:   keys,
+		values: make([]aggregateValue, len(prod.aggregates)),
+	}
+	window.groups[groupKey] = group
+	return group
+}
+
+func (prod *Aggregate) aggregateMessage(msg core.Message) {
+	payload, _ := prod.ProducerBase.Format(msg)
+
+	values := shared.NewMarshalMap()
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return // ### return, no JSON ###
+	}
+
+	start := msg.Timestamp.Truncate(prod.window)
+	if !start.Add(prod.window).After(prod.sent) {
+		Log.Debug.Printf("Aggregate: Ignoring message for window %s that has already been sent", start.Format(time.RFC3339))
+		return // ### return, window already sent ###
+	}
+
+	window, exists := prod.windows[start.UnixNano()]
+	if !exists {
+		window = &aggregateWindow{
+			start:  start,
+			groups: make(map[string]*aggregateGroup),
+		}
+		prod.windows[start.UnixNano()] = window
+	}
+
+	group := prod.getGroup(window, values)
+	if group == nil {
+		return // ### return, too many groups ###
+	}
+
+	for i, spec := range prod.aggregates {
+		value := &group.values[i]
+		if spec.kind == aggregateCount {
+			value.count++
+			continue // ### continue, no field required ###
+		}
+
+		field, found := values.Path(spec.field)
+		if !found {
+			continue // ### continue, field missing ###
+		}
+
+		if spec.kind == aggregateDistinct {
+			if value.distinct == nil {
+				value.distinct = make(map[string]struct{})
+			}
+			value.distinct[aggregateString(field)] = struct{}{}
+			continue // ### continue, not numeric ###
+		}
+
+		number, isNumber := aggregateNumber(field)
+		if !isNumber {
+			continue // ### continue, not a number ###
+		}
+		if value.count == 0 || number < value.min {
+			value.min = number
+		}
+		if value.count == 0 || number > value.max {
+			value.max = number
+		}
+		value.sum += number
+		value.count++
+	}
+}
+
+// summary returns the summary of a group. Numeric aggregates of groups without
+// a numeric value are set to null.
+func (prod *Aggregate) summary(window *aggregateWindow, group *aggregateGroup) map[string]interface{} {
+	summary := map[string]interface{}{
+		"window_start": window.start.Format(time.RFC3339),
+		"window_end":   window.start.Add(prod.window).Format(time.RFC3339),
+	}
+	for i, field := range prod.keyFields {
+		summary[field] = group.keys[i]
+	}
+
+	for i, spec := range prod.aggregates {
+		value := group.values[i]
+		switch {
+		case spec.kind == aggregateCount:
+			summary[spec.name] = value.count
+		case spec.kind == aggregateDistinct:
+			summary[spec.name] = len(value.distinct)
+		case value.count == 0:
+			summary[spec.name] = nil
+		case spec.kind == aggregateSum:
+			summary[spec.name] = value.sum
+		case spec.kind == aggregateMin:
+			summary[spec.name] = value.min
+		case spec.kind == aggregateMax:
+			summary[spec.name] = value.max
+		case spec.kind == aggregateAvg:
+			summary[spec.name] = value.sum / float64(value.count)
+		}
+	}
+	return summary
+}
+
+// sendWindow sends one summary message per group of the given window. Groups
+// are sent in the order of their keys.
+func (prod *Aggregate) sendWindow(window *aggregateWindow) {
+	groupKeys := make([]string, 0, len(window.groups))
+	for groupKey := range window.groups {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	sort.Strings(groupKeys)
+
+	stream := core.StreamTypes.GetStreamOrFallback(prod.target)
+	for _, groupKey := range groupKeys {
+		data, err := json.Marshal(prod.summary(window, window.groups[groupKey]))
+		if err != nil {
+			Log.Error.Print("Aggregate: ", err)
+			continue // ### continue, cannot be encoded ###
+		}
+
+		prod.sequence++
+		msg := core.NewMessage(nil, data, prod.sequence)
+		msg.StreamID = prod.target
+		msg.Timestamp = window.start.Add(prod.window)
+		stream.Enqueue(msg)
+	}
+}
+
+// sendWindows sends all windows that ended at least WindowGraceSec ago.
+func (prod *Aggregate) sendWindows() {
+	now := time.Now()
+	closed := []*aggregateWindow{}
+
+	for key, window := range prod.windows {
+		end := window.start.Add(prod.window)
+		if now.Sub(end) >= prod.grace {
+			closed = append(closed, window)
+			delete(prod.windows, key)
+			if end.After(prod.sent) {
+				prod.sent = end
+			}
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool { return closed[i].start.Before(closed[j].start) })
+	for _, window := range closed {
+		prod.sendWindow(window)
+	}
+}
+
+func (prod *Aggregate) close() {
+	defer prod.WorkerDone()
+	if len(prod.windows) > 0 {
+		Log.Note.Printf("Aggregate: Discarding %d open windows", len(prod.windows))
+	}
+}
+
+// Produce aggregates messages and sends summaries after each window.
+func (prod *Aggregate) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	prod.AddMainWorker(workers)
+
+	// Check at least once per second but never less often than required
+	interval := prod.window / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	prod.TickerControlLoop(interval, prod.aggregateMessage, nil, prod.sendWindows)
+}
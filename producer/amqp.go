@@ -0,0 +1,403 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"sync"
+	"time"
+)
+
+// AMQP producer plugin
+// Configuration example
+//
+//   - "producer.AMQP":
+//     Enable: true
+//     Address: "localhost:5672"
+//     Username: "guest"
+//     Password: "guest"
+//     VHost: "/"
+//     HeartbeatSec: 60
+//     TimeoutSec: 5
+//     Exchange: ""
+//     ContentType: ""
+//     Persistent: true
+//     Confirm: true
+//     BatchMaxCount: 100
+//     BatchTimeoutSec: 1
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//     RoutingKey:
+//       "console": "logs.${stream}"
+//
+// The AMQP producer publishes messages to an AMQP 0-9-1 broker like RabbitMQ.
+// Messages are published in batches. If publisher confirms are enabled, a
+// batch is done after the broker confirmed all of its messages. Messages that
+// are not confirmed in time or that are refused by the broker are dropped,
+// i.e. they are sent to the retry stream. Exchanges have to be declared
+// before they can be used.
+//
+// Address defines the broker to connect to. This can be any ip address and
+// port like "localhost:5672". By default this is set to "localhost:5672".
+//
+// Username and Password define the credentials used for PLAIN
+// authentication. By default both are set to "guest".
+//
+// VHost defines the virtual host to use. By default this is set to "/".
+//
+// HeartbeatSec defines the heartbeat interval requested from the broker.
+// Set to 0 to disable heartbeats. By default this is set to 60.
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established and for a batch to be confirmed. By default this is set to 5.
+//
+// Exchange defines a template for the exchange messages are published to.
+// Templates support the placeholders ${stream}, ${hostname}, ${timestamp},
+// ${sequence} and ${meta:<key>}. By default this is set to "", i.e. the
+// default exchange is used which routes messages to the queue named by the
+// routing key.
+//
+// ContentType defines the content type sent with each message.
+// By default this is set to "", i.e. no content type is sent.
+//
+// Persistent can be set to false to not ask the broker to store messages on
+// disk. By default this is set to true.
+//
+// Confirm can be set to false to disable publisher confirms. Messages are
+// considered to be delivered as soon as they have been sent in this case.
+// By default this is set to true.
+//
+// BatchMaxCount defines the maximum number of messages per batch.
+// By default this is set to 100.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the
+// last batch was sent before a new batch is sent. By default this is set
+// to 1.
+//
+// TLS can be set to true to connect to the broker via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// broker's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// broker. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the broker's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// broker's certificate. By default this is set to false.
+//
+// RoutingKey maps a stream to a routing key template. Templates support the
+// same placeholders as Exchange. You can define the wildcard stream (*) here,
+// too. When set, all streams that do not have a specific mapping will use
+// this routing key. If no routing keys are set the stream name is used.
+type AMQP struct {
+	core.ProducerBase
+	client       *shared.AMQPClient
+	options      shared.AMQPOptions
+	properties   shared.AMQPProperties
+	address      string
+	protocol     string
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+	exchange     core.MessageTemplate
+	routingKeys  map[core.MessageStreamID]core.MessageTemplate
+	confirm      bool
+	batch        []amqpEntry
+	batchMax     int
+	batchTimeout time.Duration
+	lastSend     time.Time
+	deliveryTag  uint64
+}
+
+// amqpEntry is a formatted message waiting to be published.
+type amqpEntry struct {
+	msg        core.Message
+	exchange   string
+	routingKey string
+	payload    []byte
+}
+
+func init() {
+	shared.RuntimeType.Register(AMQP{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *AMQP) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.options.Username = conf.GetString("Username", "guest")
+	prod.options.Password = conf.GetString("Password", "guest")
+	prod.options.VHost = conf.GetString("VHost", "/")
+	prod.options.Heartbeat = time.Duration(conf.GetInt("HeartbeatSec", 60)) * time.Second
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:5672"))
+	prod.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	prod.exchange = core.NewMessageTemplate(conf.GetString("Exchange", ""), time.RFC3339)
+	prod.properties.ContentType = conf.GetString("ContentType", "")
+	prod.properties.Persistent = conf.GetBool("Persistent", true)
+	prod.confirm = conf.GetBool("Confirm", true)
+	prod.batchMax = conf.GetInt("BatchMaxCount", 100)
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second
+
+	if prod.batchMax < 1 {
+		return fmt.Errorf("AMQP: BatchMaxCount has to be at least 1")
+	}
+
+	if conf.GetBool("TLS", false) {
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	prod.routingKeys = make(map[core.MessageStreamID]core.MessageTemplate)
+	for streamID, key := range conf.GetStreamMap("RoutingKey", "") {
+		prod.routingKeys[streamID] = core.NewMessageTemplate(key, time.RFC3339)
+	}
+
+	prod.batch = make([]amqpEntry, 0, prod.batchMax)
+	return nil
+}
+
+func (prod *AMQP) getRoutingKey(msg core.Message, streamID core.MessageStreamID) string {
+	if key, exists := prod.routingKeys[streamID]; exists {
+		return key.String(msg, streamID) // ### return, mapped ###
+	}
+	if key, exists := prod.routingKeys[core.WildcardStreamID]; exists {
+		return key.String(msg, streamID) // ### return, wildcard mapping ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// connect opens a new connection if necessary and enables publisher confirms.
+// Returns false if no connection is available.
+func (prod *AMQP) connect() bool {
+	if prod.client != nil {
+		return true // ### return, already connected ###
+	}
+
+	client, err := shared.DialAMQP(prod.protocol, prod.address, prod.tlsConfig, prod.timeout, prod.options)
+	if err == nil && prod.confirm {
+		client.SetReadDeadline(time.Now().Add(prod.timeout))
+		err = client.Call(shared.AMQPClassConfirm, shared.AMQPConfirmSelect, []byte{0}, shared.AMQPConfirmSelectOk)
+		client.SetReadDeadline(time.Time{})
+		if err != nil {
+			client.Close()
+		}
+	}
+	if err != nil {
+		Log.Error.Print("AMQP connection error - ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.client = client
+	prod.deliveryTag = 0
+	return true
+}
+
+func (prod *AMQP) disconnect() {
+	if prod.client != nil {
+		prod.client.Close()
+		prod.client = nil
+	}
+}
+
+// readConfirms reads responses of the broker until all messages of the
+// current batch have been confirmed or the deadline has been reached. The
+// state of each message is stored in confirmed with 1 meaning acknowledged
+// and 2 meaning refused. The first message has the given delivery tag.
+func (prod *AMQP) readConfirms(firstTag uint64, confirmed []byte, deadline time.Time) error {
+	pending := 0
+	for _, state := range confirmed {
+		if state == 0 {
+			pending++
+		}
+	}
+
+	prod.client.SetReadDeadline(deadline)
+	defer prod.client.SetReadDeadline(time.Time{})
+
+	for pending > 0 || !prod.confirm {
+		frame, err := prod.client.ReadFrame()
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() && !prod.confirm {
+				return nil // ### return, no pending errors ###
+			}
+			return err
+		}
+		if frame.Type != shared.AMQPFrameMethod {
+			continue // ### continue, heartbeat or content of a returned message ###
+		}
+
+		classID, methodID, args, err := shared.DecodeAMQPMethod(frame)
+		if err != nil {
+			return err
+		}
+		if err := prod.client.CheckClose(classID, methodID, args); err != nil {
+			return err
+		}
+		if classID != shared.AMQPClassBasic || (methodID != shared.AMQPBasicAck && methodID != shared.AMQPBasicNack) {
+			continue // ### continue, not a confirm ###
+		}
+
+		tag, _ := args.ReadLonglong()
+		multiple, _ := args.ReadOctet()
+		state := byte(1)
+		if methodID == shared.AMQPBasicNack {
+			state = 2
+		}
+
+		first := tag
+		if multiple&0x01 != 0 {
+			first = firstTag
+		}
+		for current := first; current <= tag; current++ {
+			if idx := int(current - firstTag); current >= firstTag && idx < len(confirmed) && confirmed[idx] == 0 {
+				confirmed[idx] = state
+				pending--
+			}
+		}
+	}
+	return nil
+}
+
+// sendBatch publishes all messages of the current batch and waits for their
+// confirms.
+func (prod *AMQP) sendBatch() {
+	if len(prod.batch) == 0 {
+		return // ### return, nothing to send ###
+	}
+
+	batch := prod.batch
+	prod.batch = make([]amqpEntry, 0, prod.batchMax)
+	prod.lastSend = time.Now()
+
+	confirmed := make([]byte, len(batch))
+	var err error
+
+	if !prod.connect() {
+		err = fmt.Errorf("Not connected")
+	} else {
+		firstTag := prod.deliveryTag + 1
+		for _, entry := range batch {
+			properties := prod.properties
+			properties.Timestamp = entry.msg.Timestamp
+			if err = prod.client.Publish(entry.exchange, entry.routingKey, properties, entry.payload); err != nil {
+				break // ### break, connection lost ###
+			}
+			prod.deliveryTag++
+		}
+
+		// Without confirms, errors reported by the broker are checked only
+		// briefly as messages are sent by then.
+		deadline := time.Now().Add(prod.timeout)
+		if !prod.confirm {
+			deadline = time.Now().Add(10 * time.Millisecond)
+		}
+		if err == nil {
+			err = prod.readConfirms(firstTag, confirmed, deadline)
+			if !prod.confirm {
+				for i := range confirmed {
+					confirmed[i] = 1
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		Log.Error.Print("AMQP error - ", err)
+		prod.disconnect()
+	}
+
+	refused := 0
+	for i, entry := range batch {
+		switch confirmed[i] {
+		case 0:
+			entry.msg.Drop(prod.GetTimeout())
+		case 2:
+			refused++
+			entry.msg.Drop(prod.GetTimeout())
+		}
+	}
+	if refused > 0 {
+		Log.Warning.Printf("AMQP broker refused %d messages", refused)
+	}
+}
+
+func (prod *AMQP) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	prod.batch = append(prod.batch, amqpEntry{
+		msg:        msg,
+		exchange:   prod.exchange.String(msg, streamID),
+		routingKey: prod.getRoutingKey(msg, streamID),
+		payload:    payload,
+	})
+
+	if len(prod.batch) >= prod.batchMax {
+		prod.sendBatch()
+	}
+}
+
+func (prod *AMQP) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) >= prod.batchTimeout {
+		prod.sendBatch()
+	}
+
+	if prod.client != nil {
+		if err := prod.client.Heartbeat(); err != nil {
+			Log.Error.Print("AMQP error - ", err)
+			prod.disconnect()
+		}
+	}
+}
+
+func (prod *AMQP) close() {
+	defer prod.WorkerDone()
+	prod.sendBatch()
+	prod.disconnect()
+}
+
+// Produce writes to an AMQP broker.
+func (prod *AMQP) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	interval := prod.batchTimeout
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(interval, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
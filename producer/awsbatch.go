@@ -0,0 +1,325 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsEntry is a message prepared for a batch request of an AWS API. Entries
+// may contain more than one message if messages are aggregated.
+// The meaning of key depends on the API, e.g. it is the message group of SQS
+// and SNS or the partition key of Kinesis.
+type awsEntry struct {
+	messages   []core.Message
+	data       string
+	key        string
+	dedupID    string
+	attributes map[string]string
+	size       int
+}
+
+type awsBatch struct {
+	target  string
+	entries []awsEntry
+	size    int
+}
+
+// awsBatchSender sends a batch and returns the entries that have to be sent
+// again, as well as the error that caused the retry, if any.
+type awsBatchSender func(batch *awsBatch) ([]awsEntry, error)
+
+// awsBatcher collects entries per target (queue, topic or stream) and passes
+// full batches to a fixed number of workers. All batches of a target are sent
+// by the same worker so that the order of messages is kept.
+type awsBatcher struct {
+	name         string
+	batches      map[string]*awsBatch
+	batchMax     int
+	batchSizeMax int
+	batchTimeout time.Duration
+	lastSend     time.Time
+	queues       []chan *awsBatch
+	senders      *sync.WaitGroup
+	retries      int
+	throttles    int
+	retryDelay   time.Duration
+	dropTimeout  time.Duration
+}
+
+// errAWSThrottled is returned by senders if entries have to be sent again
+// because of throttling only.
+var errAWSThrottled = errors.New("requests are throttled")
+
+const awsMaxThrottleDelay = 10 * time.Second
+
+// awsMessageOptions contains the settings shared by the SQS and SNS producers.
+type awsMessageOptions struct {
+	groupMetadata string
+	groupDefault  string
+	deduplicate   bool
+	sendMetadata  bool
+}
+
+// configureAWS reads the credential settings shared by all AWS producers and
+// returns the credentials and the region to use.
+func configureAWS(name string, conf core.PluginConfig) (*shared.AWSCredentials, string, error) {
+	region := shared.AWSRegion(conf.GetString("Region", ""))
+	if region == "" {
+		return nil, "", fmt.Errorf("%s: Region must be set", name)
+	}
+
+	creds, err := shared.NewAWSCredentials(
+		conf.GetString("AccessKeyID", ""),
+		conf.GetString("SecretAccessKey", ""),
+		"",
+		conf.GetString("Profile", ""))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", name, err)
+	}
+	return creds, region, nil
+}
+
+func newAWSBatcher(name string, conf core.PluginConfig, countMax, sizeMaxKB int, dropTimeout time.Duration) *awsBatcher {
+	workers := conf.GetInt("Workers", 2)
+	if workers < 1 {
+		workers = 1
+	}
+
+	batcher := &awsBatcher{
+		name:         name,
+		batches:      make(map[string]*awsBatch),
+		batchMax:     conf.GetInt("BatchMaxCount", countMax),
+		batchSizeMax: conf.GetInt("BatchSizeMaxKB", sizeMaxKB) << 10,
+		batchTimeout: time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second,
+		queues:       make([]chan *awsBatch, workers),
+		senders:      new(sync.WaitGroup),
+		retries:      conf.GetInt("Retries", 3),
+		throttles:    conf.GetInt("ThrottleRetries", 10),
+		retryDelay:   time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond,
+		dropTimeout:  dropTimeout,
+	}
+
+	if batcher.batchMax < 1 || batcher.batchMax > countMax {
+		batcher.batchMax = countMax
+	}
+	for i := range batcher.queues {
+		batcher.queues[i] = make(chan *awsBatch, 1)
+	}
+	return batcher
+}
+
+func (options *awsMessageOptions) configure(conf core.PluginConfig) {
+	options.groupMetadata = conf.GetString("GroupIDMetadata", "")
+	options.groupDefault = conf.GetString("GroupIDDefault", "gollum")
+	options.deduplicate = conf.GetBool("DeduplicationID", true)
+	options.sendMetadata = conf.GetBool("SendMetadata", false)
+}
+
+// newEntry creates an entry for a message sent to the given queue or topic.
+// Group and deduplication ids are only set for FIFO queues and topics.
+func (options *awsMessageOptions) newEntry(msg core.Message, payload []byte, target string) awsEntry {
+	entry := awsEntry{
+		messages: []core.Message{msg},
+		data:     string(payload),
+		size:     len(payload),
+	}
+
+	if strings.HasSuffix(target, ".fifo") {
+		if entry.key = msg.Metadata[options.groupMetadata]; entry.key == "" {
+			entry.key = options.groupDefault
+		}
+		if options.deduplicate {
+			entry.dedupID = deduplicationID(msg, payload)
+		}
+	}
+
+	if options.sendMetadata && len(msg.Metadata) > 0 {
+		entry.attributes = msg.Metadata
+		for key, value := range entry.attributes {
+			entry.size += len(key) + len(value) + len("String")
+		}
+	}
+	return entry
+}
+
+// add appends an entry to the batch of the given target. Batches are sent if
+// they are full. Entries that exceed the maximum batch size are rejected.
+func (batcher *awsBatcher) add(prod *core.ProducerBase, target string, entry awsEntry) {
+	if entry.size > batcher.batchSizeMax {
+		reason := fmt.Sprintf("message size of %d bytes exceeds the limit of %d bytes", entry.size, batcher.batchSizeMax)
+		Log.Error.Printf("%s format error - %s", batcher.name, reason)
+		for _, msg := range entry.messages {
+			prod.Reject(msg, reason)
+		}
+		return // ### return, message too large ###
+	}
+
+	batch, exists := batcher.batches[target]
+	if exists && batch.size+entry.size > batcher.batchSizeMax {
+		batcher.sendBatch(target)
+		exists = false
+	}
+	if !exists {
+		batch = &awsBatch{target: target}
+		batcher.batches[target] = batch
+	}
+
+	batch.entries = append(batch.entries, entry)
+	batch.size += entry.size
+
+	if len(batch.entries) >= batcher.batchMax {
+		batcher.sendBatch(target)
+	}
+}
+
+func (batcher *awsBatcher) sendBatch(target string) {
+	if batch, exists := batcher.batches[target]; exists && len(batch.entries) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(target))
+		batcher.queues[hash.Sum32()%uint32(len(batcher.queues))] <- batch
+		delete(batcher.batches, target)
+	}
+}
+
+func (batcher *awsBatcher) sendAllBatches() {
+	for target := range batcher.batches {
+		batcher.sendBatch(target)
+	}
+	batcher.lastSend = time.Now()
+}
+
+func (batcher *awsBatcher) sendBatchOnTimeOut() {
+	if time.Since(batcher.lastSend) > batcher.batchTimeout {
+		batcher.sendAllBatches()
+	}
+}
+
+// isAWSThrottled returns true if a request failed because of throttling.
+func isAWSThrottled(err error) bool {
+	if err == errAWSThrottled {
+		return true
+	}
+	apiErr, isAPIError := err.(shared.AWSAPIError)
+	return isAPIError && (apiErr.StatusCode == http.StatusTooManyRequests || shared.IsAWSThrottlingCode(apiErr.Code))
+}
+
+// send passes a batch to the given sender, retrying failed entries. Retries
+// caused by throttling are counted separately from other errors. Entries
+// failing after all retries are dropped.
+func (batcher *awsBatcher) send(batch *awsBatch, sender awsBatchSender) {
+	delay := batcher.retryDelay
+	throttleDelay := batcher.retryDelay
+	retries, throttles := 0, 0
+
+	for {
+		retry, err := sender(batch)
+		if len(retry) == 0 {
+			return // ### return, done ###
+		}
+		batch = &awsBatch{target: batch.target, entries: retry}
+
+		if isAWSThrottled(err) {
+			if throttles >= batcher.throttles {
+				break // ### break, throttled too often ###
+			}
+			Log.Warning.Printf("%s requests to %s are throttled, retrying %d messages", batcher.name, batch.target, len(retry))
+			throttles++
+			time.Sleep(throttleDelay)
+			if throttleDelay *= 2; throttleDelay > awsMaxThrottleDelay {
+				throttleDelay = awsMaxThrottleDelay
+			}
+			continue // ### continue, throttled ###
+		}
+
+		if err != nil {
+			Log.Error.Printf("%s error sending to %s - %s", batcher.name, batch.target, err.Error())
+		}
+		if retries >= batcher.retries {
+			break // ### break, too many retries ###
+		}
+		retries++
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	for _, entry := range batch.entries {
+		for _, msg := range entry.messages {
+			msg.Drop(batcher.dropTimeout)
+		}
+	}
+}
+
+// start starts the workers sending batches via the given sender.
+func (batcher *awsBatcher) start(sender awsBatchSender) {
+	for _, queue := range batcher.queues {
+		batcher.senders.Add(1)
+		go func(queue <-chan *awsBatch) {
+			defer batcher.senders.Done()
+			for batch := range queue {
+				batcher.send(batch, sender)
+			}
+		}(queue)
+	}
+	batcher.lastSend = time.Now()
+}
+
+// close sends all remaining batches and waits for the workers to finish.
+func (batcher *awsBatcher) close() {
+	batcher.sendAllBatches()
+	for _, queue := range batcher.queues {
+		close(queue)
+	}
+	batcher.senders.Wait()
+}
+
+// awsFailure handles an entry the API failed to process. Entries failing
+// because of the sender are rejected, all other entries are returned for
+// retry.
+func awsFailure(prod *core.ProducerBase, name string, entry awsEntry, senderFault bool, code, message string, retry []awsEntry) []awsEntry {
+	if senderFault && !shared.IsAWSTemporaryCode(code) {
+		reason := code + ": " + message
+		Log.Error.Printf("%s rejected %d messages - %s", name, len(entry.messages), reason)
+		for _, msg := range entry.messages {
+			prod.Reject(msg, reason)
+		}
+		return retry
+	}
+	return append(retry, entry)
+}
+
+// awsRequestFailed handles errors of a batch request. Batches rejected by the
+// API are rejected, all other batches are returned for retry.
+func awsRequestFailed(prod *core.ProducerBase, name string, batch *awsBatch, err error) ([]awsEntry, error) {
+	if apiErr, isAPIError := err.(shared.AWSAPIError); isAPIError && !apiErr.Temporary() {
+		Log.Error.Printf("%s rejected %d entries for %s - %s", name, len(batch.entries), batch.target, apiErr.Error())
+		for _, entry := range batch.entries {
+			for _, msg := range entry.messages {
+				prod.Reject(msg, apiErr.Error())
+			}
+		}
+		return nil, nil // ### return, rejected ###
+	}
+	return batch.entries, err
+}
@@ -0,0 +1,457 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+// BigQuery producer plugin
+// Configuration example
+//
+//   - "producer.BigQuery":
+//     Enable: true
+//     Project: "my-project"
+//     Dataset: "logs"
+//     Table:
+//       "access": "access_log"
+//     CredentialsFile: ""
+//     Endpoint: "https://bigquery.googleapis.com"
+//     Fields:
+//       "status": "response/status"
+//     TimestampColumn: ""
+//     PayloadColumn: ""
+//     InsertIDField: ""
+//     Deduplicate: true
+//     SkipInvalidRows: false
+//     IgnoreUnknownValues: false
+//     BatchMaxCount: 500
+//     BatchSizeMaxKB: 8192
+//     BatchTimeoutSec: 5
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The BigQuery producer writes JSON messages to BigQuery tables by using
+// streaming inserts (tabledata.insertAll). Messages are sent in batches per
+// table. Each message is converted into a row, either as-is or by mapping
+// fields of the message to columns. Rows rejected by BigQuery are sent to the
+// RejectStream if set. Rows that were not inserted because of other invalid
+// rows in the same request are sent again. Requests failing after all retries
+// are dropped, i.e. sent to the retry stream.
+// The Storage Write API is not supported.
+//
+// Project defines the Google Cloud project containing the dataset. This
+// setting is mandatory.
+//
+// Dataset defines the dataset containing the tables. This setting is
+// mandatory.
+//
+// Table maps a stream to a table. You can define the wildcard stream (*)
+// here, too. If no mapping is set for a stream the stream name is used as
+// table. By default no mappings are set.
+//
+// CredentialsFile defines a service account key or user credentials file. If
+// empty the file named by GOOGLE_APPLICATION_CREDENTIALS is used. If this is
+// not set either, credentials are requested from the metadata server, e.g. to
+// use workload identity on Kubernetes Engine. By default this is set to "".
+//
+// Endpoint defines the URL of the BigQuery API.
+// By default this is set to "https://bigquery.googleapis.com".
+//
+// Fields maps column names to fields of the message. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path. Missing fields are
+// not set. If no fields are set the message is used as row.
+// By default no fields are set.
+//
+// TimestampColumn defines a column the message timestamp is written to.
+// By default this is set to "", i.e. the timestamp is not written.
+//
+// PayloadColumn defines a column messages that are not a JSON object are
+// written to as string. If not set these messages are rejected.
+// By default this is set to "".
+//
+// InsertIDField defines a field of the message used as insert ID. BigQuery
+// uses insert IDs to detect rows sent more than once. If the field is missing
+// or not set an ID is generated from the message if Deduplicate is set to true.
+// By default this is set to "".
+//
+// Deduplicate can be set to false to not send insert IDs unless InsertIDField
+// is set. This disables best-effort deduplication but allows higher insert
+// rates. By default this is set to true.
+//
+// SkipInvalidRows can be set to true to insert all valid rows of a request
+// even if other rows are invalid. By default this is set to false.
+//
+// IgnoreUnknownValues can be set to true to ignore fields that do not match
+// the table schema instead of rejecting the row. By default this is set to
+// false.
+//
+// BatchMaxCount defines the maximum number of rows sent in one request.
+// By default this is set to 500.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB. BigQuery rejects
+// requests larger than 10 MB. By default this is set to 8192.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 5.
+//
+// Workers defines the number of requests sent concurrently.
+// By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times a request is sent again after a network
+// error, a server error or because of rate limits. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a request is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
+type BigQuery struct {
+	core.ProducerBase
+	client          *http.Client
+	credentials     *shared.GoogleCredentials
+	baseURL         string
+	table           map[core.MessageStreamID]string
+	fields          map[string]string
+	timestampColumn string
+	payloadColumn   string
+	insertIDField   string
+	deduplicate     bool
+	skipInvalid     bool
+	ignoreUnknown   bool
+	batches         map[string]*bigQueryBatch
+	batchMax        int
+	batchSizeMax    int
+	batchTimeout    time.Duration
+	lastSend        time.Time
+	queue           chan *bigQueryBatch
+	senders         *sync.WaitGroup
+	retries         int
+	retryDelay      time.Duration
+}
+
+type bigQueryRow struct {
+	InsertID string          `json:"insertId,omitempty"`
+	JSON     json.RawMessage `json:"json"`
+}
+
+// bigQueryBatch stores the rows sent to a table. Messages are kept so that
+// they can be dropped if their row cannot be inserted.
+type bigQueryBatch struct {
+	table    string
+	messages []core.Message
+	rows     []bigQueryRow
+	size     int
+}
+
+type bigQueryResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+func init() {
+	shared.RuntimeType.Register(BigQuery{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *BigQuery) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	project := conf.GetString("Project", "")
+	dataset := conf.GetString("Dataset", "")
+	if project == "" || dataset == "" {
+		return fmt.Errorf("BigQuery: Project and Dataset must be set")
+	}
+
+	endpoint := strings.TrimRight(conf.GetString("Endpoint", "https://bigquery.googleapis.com"), "/")
+	prod.baseURL = fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/", endpoint, url.PathEscape(project), url.PathEscape(dataset))
+
+	if prod.credentials, err = shared.NewGoogleCredentials(conf.GetString("CredentialsFile", ""), bigQueryScope); err != nil {
+		return err
+	}
+
+	prod.table = conf.GetStreamMap("Table", "")
+	prod.fields = conf.GetStringMap("Fields", map[string]string{})
+	prod.timestampColumn = conf.GetString("TimestampColumn", "")
+	prod.payloadColumn = conf.GetString("PayloadColumn", "")
+	prod.insertIDField = conf.GetString("InsertIDField", "")
+	prod.deduplicate = conf.GetBool("Deduplicate", true)
+	prod.skipInvalid = conf.GetBool("SkipInvalidRows", false)
+	prod.ignoreUnknown = conf.GetBool("IgnoreUnknownValues", false)
+
+	prod.batchMax = conf.GetInt("BatchMaxCount", 500)
+	prod.batchSizeMax = conf.GetInt("BatchSizeMaxKB", 8192) << 10
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+
+	workers := conf.GetInt("Workers", 2)
+	if workers < 1 {
+		workers = 1
+	}
+
+	prod.batches = make(map[string]*bigQueryBatch)
+	prod.queue = make(chan *bigQueryBatch, workers)
+	prod.senders = new(sync.WaitGroup)
+	return nil
+}
+
+func (prod *BigQuery) getTable(streamID core.MessageStreamID) string {
+	if table, tableMapped := prod.table[streamID]; tableMapped {
+		return table // ### return, mapped table ###
+	}
+	if table, tableMapped := prod.table[core.WildcardStreamID]; tableMapped {
+		return table // ### return, wildcard table ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// newRow converts a message into a row.
+func (prod *BigQuery) newRow(msg core.Message, payload []byte) (bigQueryRow, error) {
+	row := bigQueryRow{}
+	values := shared.NewMarshalMap()
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		if prod.payloadColumn == "" {
+			return row, err // ### return, not a JSON object ###
+		}
+		values = shared.MarshalMap{prod.payloadColumn: string(payload)}
+	}
+
+	columns := values
+	if len(prod.fields) > 0 {
+		columns = shared.NewMarshalMap()
+		for column, path := range prod.fields {
+			if value, found := values.Path(path); found {
+				columns[column] = value
+			}
+		}
+	}
+	if prod.timestampColumn != "" {
+		columns[prod.timestampColumn] = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	if prod.insertIDField != "" {
+		if value, found := values.Path(prod.insertIDField); found {
+			row.InsertID = fmt.Sprint(value)
+		}
+	}
+	if row.InsertID == "" && prod.deduplicate {
+		row.InsertID = deduplicationID(msg, payload)
+	}
+
+	var err error
+	row.JSON, err = json.Marshal(columns)
+	return row, err
+}
+
+// deduplicationID generates an ID that is equal for all copies of a message
+// so that sinks like BigQuery can detect retried messages.
+func deduplicationID(msg core.Message, payload []byte) string {
+	return hex.EncodeToString(deduplicationHash(msg, payload))
+}
+
+// deduplicationHash returns the 16 byte hash used by deduplicationID.
+func deduplicationHash(msg core.Message, payload []byte) []byte {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint64(header, uint64(msg.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint64(header[8:], msg.Sequence)
+	binary.BigEndian.PutUint32(header[16:], uint32(msg.StreamID))
+
+	hash := fnv.New128a()
+	hash.Write(header)
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
+// insert sends a batch to BigQuery and returns the messages whose rows have to
+// be sent again. Rows rejected by BigQuery are dropped.
+func (prod *BigQuery) insert(batch *bigQueryBatch) ([]core.Message, []bigQueryRow, error) {
+	request := map[string]interface{}{
+		"kind":                "bigquery#tableDataInsertAllRequest",
+		"skipInvalidRows":     prod.skipInvalid,
+		"ignoreUnknownValues": prod.ignoreUnknown,
+		"rows":                batch.rows,
+	}
+
+	result := bigQueryResponse{}
+	if err := prod.credentials.Post(context.Background(), prod.client, prod.baseURL+url.PathEscape(batch.table)+"/insertAll", request, &result); err != nil {
+		if apiErr, isAPIError := err.(shared.GoogleAPIError); isAPIError && !apiErr.Temporary() {
+			Log.Error.Printf("BigQuery rejected %d rows for table %s - %s", len(batch.rows), batch.table, apiErr.Error())
+			for _, msg := range batch.messages {
+				prod.Reject(msg, apiErr.Error())
+			}
+			return nil, nil, nil // ### return, rejected ###
+		}
+		return batch.messages, batch.rows, err // ### return, retry ###
+	}
+
+	retryMessages := []core.Message{}
+	retryRows := []bigQueryRow{}
+	for _, insertError := range result.InsertErrors {
+		if insertError.Index < 0 || insertError.Index >= len(batch.rows) {
+			continue // ### continue, invalid index ###
+		}
+
+		reasons := []string{}
+		for _, rowError := range insertError.Errors {
+			if rowError.Reason != "stopped" {
+				reasons = append(reasons, fmt.Sprintf("%s: %s", rowError.Reason, rowError.Message))
+			}
+		}
+
+		if len(reasons) > 0 {
+			reason := strings.Join(reasons, ", ")
+			Log.Error.Printf("BigQuery rejected row for table %s - %s", batch.table, reason)
+			prod.Reject(batch.messages[insertError.Index], reason)
+		} else {
+			retryMessages = append(retryMessages, batch.messages[insertError.Index])
+			retryRows = append(retryRows, batch.rows[insertError.Index])
+		}
+	}
+	return retryMessages, retryRows, nil
+}
+
+// send inserts a batch, retrying rows that could not be inserted.
+func (prod *BigQuery) send(batch *bigQueryBatch) {
+	delay := prod.retryDelay
+	for attempt := 0; attempt <= prod.retries; attempt++ {
+		messages, rows, err := prod.insert(batch)
+		if len(rows) == 0 {
+			return // ### return, done ###
+		}
+
+		if err != nil {
+			Log.Error.Printf("BigQuery error inserting into %s - %s", batch.table, err.Error())
+		}
+		batch = &bigQueryBatch{table: batch.table, messages: messages, rows: rows}
+
+		if attempt < prod.retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	for _, msg := range batch.messages {
+		msg.Drop(prod.GetTimeout())
+	}
+}
+
+func (prod *BigQuery) sendLoop() {
+	defer prod.senders.Done()
+	for batch := range prod.queue {
+		prod.send(batch)
+	}
+}
+
+func (prod *BigQuery) sendBatch(table string) {
+	if batch, exists := prod.batches[table]; exists && len(batch.rows) > 0 {
+		prod.queue <- batch
+		delete(prod.batches, table)
+	}
+}
+
+func (prod *BigQuery) sendAllBatches() {
+	for table := range prod.batches {
+		prod.sendBatch(table)
+	}
+	prod.lastSend = time.Now()
+}
+
+func (prod *BigQuery) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) > prod.batchTimeout {
+		prod.sendAllBatches()
+	}
+}
+
+func (prod *BigQuery) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	row, err := prod.newRow(msg, payload)
+	if err != nil {
+		Log.Error.Print("BigQuery format error - ", err)
+		prod.Reject(msg, err.Error())
+		return // ### return, invalid message ###
+	}
+
+	table := prod.getTable(streamID)
+	batch, exists := prod.batches[table]
+	if exists && batch.size+len(row.JSON) > prod.batchSizeMax {
+		prod.sendBatch(table)
+		exists = false
+	}
+	if !exists {
+		batch = &bigQueryBatch{table: table}
+		prod.batches[table] = batch
+	}
+
+	batch.messages = append(batch.messages, msg)
+	batch.rows = append(batch.rows, row)
+	batch.size += len(row.JSON) + len(row.InsertID) + 32
+
+	if len(batch.rows) >= prod.batchMax {
+		prod.sendBatch(table)
+	}
+}
+
+func (prod *BigQuery) flush() {
+	prod.sendAllBatches()
+	close(prod.queue)
+	prod.senders.Wait()
+	prod.WorkerDone()
+}
+
+// Produce sends batches of rows to BigQuery.
+func (prod *BigQuery) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	for i := 0; i < cap(prod.queue); i++ {
+		prod.senders.Add(1)
+		go prod.sendLoop()
+	}
+
+	prod.lastSend = time.Now()
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clickHouseErrorCode = regexp.MustCompile(`^Code: (\d+)`)
+	clickHouseErrorRow  = regexp.MustCompile(`\(at row (\d+)\)`)
+)
+
+// ClickHouse producer plugin
+// Configuration example
+//
+//   - "producer.ClickHouse":
+//     Enable: true
+//     URL: "http://localhost:8123"
+//     Database: "default"
+//     User: "default"
+//     Password: ""
+//     Settings:
+//       "input_format_skip_unknown_fields": "1"
+//     Table:
+//       "access": "access_log"
+//     Columns:
+//       - "host"
+//       - "status"
+//     Fields:
+//       "status": "response/status"
+//     TimestampColumn: ""
+//     PayloadColumn: ""
+//     BatchMaxCount: 10000
+//     BatchSizeMaxKB: 8192
+//     BatchTimeoutSec: 5
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The ClickHouse producer loads JSON messages into ClickHouse tables by using
+// INSERT queries in the JSONEachRow format over the HTTP interface. Messages
+// are sent in batches per table. ClickHouse performs best with few, large
+// inserts so batches should be as large as possible. Rows not matching the
+// table schema are removed from the batch and sent to the RejectStream, which
+// can be used as dead-letter stream. The remaining rows of the batch are sent
+// again. Batches failing because of network or server errors are sent again
+// and dropped, i.e. sent to the retry stream, after all retries failed.
+// Batches for tables or columns that do not exist are rejected.
+//
+// URL defines the address of the ClickHouse HTTP interface.
+// By default this is set to "http://localhost:8123".
+//
+// Database defines the database containing the tables.
+// By default this is set to "default".
+//
+// User and Password define the credentials used to log in. By default User
+// is set to "default" and Password is set to "".
+//
+// Settings defines ClickHouse settings passed with each query, e.g.
+// "async_insert". The setting "date_time_input_format" is set to
+// "best_effort" unless defined here. By default no settings are set.
+//
+// Columns defines the columns written. If no columns are set, all fields of
+// the message are written and ClickHouse matches them to columns by name.
+// By default no columns are set.
+//
+// Fields maps column names to fields of the message. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path. Columns without a
+// mapping are read from the field with the same name. Missing fields are not
+// set, i.e. the default value of the column is used.
+// By default no fields are set.
+//
+// BatchMaxCount defines the maximum number of rows sent in one insert.
+// By default this is set to 10000.
+//
+// All other settings are equal to the settings of the Postgres producer.
+type ClickHouse struct {
+	core.ProducerBase
+	client   *http.Client
+	endpoint string
+	user     string
+	password string
+	settings map[string]string
+	batcher  *sqlBatcher
+}
+
+func init() {
+	shared.RuntimeType.Register(ClickHouse{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *ClickHouse) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.endpoint = strings.TrimRight(conf.GetString("URL", "http://localhost:8123"), "/") + "/"
+	prod.user = conf.GetString("User", "default")
+	prod.password = conf.GetString("Password", "")
+
+	prod.settings = conf.GetStringMap("Settings", map[string]string{})
+	prod.settings["database"] = conf.GetString("Database", "default")
+	if _, isSet := prod.settings["date_time_input_format"]; !isSet {
+		prod.settings["date_time_input_format"] = "best_effort"
+	}
+
+	prod.batcher = newSQLBatcher("ClickHouse", conf, 10000, prod.encodeRow, prod.GetTimeout())
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+	return nil
+}
+
+// encodeRow encodes a row in the JSONEachRow format.
+func (prod *ClickHouse) encodeRow(values shared.MarshalMap) ([]byte, error) {
+	row, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return append(row, '\n'), nil
+}
+
+// insert sends a batch as INSERT query. Schema errors are returned as
+// sqlRowError, sqlDataError or sqlBatchError.
+func (prod *ClickHouse) insert(worker int, batch *sqlBatch) error {
+	query := "INSERT INTO " + quoteSQLTable(batch.table, "`")
+	if len(prod.batcher.columns) > 0 {
+		query += " " + sqlColumnList(prod.batcher.columns, "`")
+	}
+
+	values := url.Values{"query": {query + " FORMAT JSONEachRow"}}
+	for key, value := range prod.settings {
+		values.Set(key, value)
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, batch.size))
+	for _, row := range batch.rows {
+		body.Write(row)
+	}
+
+	request, err := http.NewRequest("POST", prod.endpoint+"?"+values.Encode(), body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-ClickHouse-User", prod.user)
+	if prod.password != "" {
+		request.Header.Set("X-ClickHouse-Key", prod.password)
+	}
+
+	response, err := prod.client.Do(request)
+	if err != nil {
+		return err // ### return, request failed ###
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		return nil // ### return, inserted ###
+	}
+
+	message, _ := ioutil.ReadAll(response.Body)
+	reason := strings.TrimSpace(string(message))
+	code, _ := strconv.Atoi(response.Header.Get("X-ClickHouse-Exception-Code"))
+	if match := clickHouseErrorCode.FindStringSubmatch(reason); code == 0 && match != nil {
+		code, _ = strconv.Atoi(match[1])
+	}
+	if code == 0 {
+		return fmt.Errorf("%s: %s", response.Status, reason) // ### return, retry ###
+	}
+	return classifyClickHouseError(code, reason)
+}
+
+// classifyClickHouseError converts errors caused by invalid rows or tables
+// into the errors handled by sqlBatcher. All other errors are retried.
+func classifyClickHouseError(code int, reason string) error {
+	switch code {
+	case 6, 26, 27, 38, 41, 53, 69, 70, 72, 117, 349:
+		// Parsing and conversion errors
+		if match := clickHouseErrorRow.FindStringSubmatch(reason); match != nil {
+			if row, err := strconv.Atoi(match[1]); err == nil {
+				return sqlRowError{row - 1, reason}
+			}
+		}
+		return sqlDataError{reason}
+
+	case 16, 47, 60, 62, 81, 497, 516:
+		// Unknown tables and columns, syntax errors, missing privileges
+		return sqlBatchError{reason}
+
+	default:
+		return fmt.Errorf("%s", reason)
+	}
+}
+
+func (prod *ClickHouse) close() {
+	prod.batcher.close()
+	prod.WorkerDone()
+}
+
+func (prod *ClickHouse) sendMessage(msg core.Message) {
+	prod.batcher.add(&prod.ProducerBase, msg)
+}
+
+// Produce loads batches of rows into ClickHouse.
+func (prod *ClickHouse) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+	prod.batcher.start(&prod.ProducerBase, prod.insert)
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batcher.batchTimeout, prod.sendMessage, nil, prod.batcher.sendBatchOnTimeOut)
+}
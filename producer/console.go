@@ -15,10 +15,12 @@
 package producer
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/shared"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -29,19 +31,100 @@ import (
 //   - "producer.Console":
 //     Enable: true
 //     Console: "stderr"
+//     ConsoleStreams:
+//       "debug": "stdout"
+//     StreamPrefix: false
+//     Colors: false
+//     ColorPalette:
+//       - "cyan"
+//       - "green"
+//       - "yellow"
+//       - "magenta"
+//       - "blue"
+//       - "red"
+//     StreamColors:
+//       "error": "red"
 //
 // The console producer writes messages to the standard output streams.
 //
 // Console may either be "stdout" or "stderr". By default it is set to "stdout".
+//
+// ConsoleStreams maps streams to "stdout" or "stderr". Streams not listed here
+// are written to Console. By default this is empty.
+//
+// StreamPrefix can be set to true to prefix each message with the name of its
+// stream in square brackets. By default this is set to false.
+//
+// Colors can be set to true to colorize messages with ANSI escape codes. Each
+// stream is written in its own color. By default this is set to false.
+//
+// ColorPalette defines the colors assigned to streams not listed in
+// StreamColors. Each stream always gets the same color from this list.
+// Valid colors are "black", "red", "green", "yellow", "blue", "magenta",
+// "cyan", "white", the same names prefixed with "bright", a number between 0
+// and 255 for 256 color terminals and "none". By default this is set to
+// "cyan", "green", "yellow", "magenta", "blue" and "red".
+//
+// StreamColors maps streams to fixed colors, overriding the palette.
+// Use "*" to set a color for all streams. By default this is empty.
 type Console struct {
 	core.ProducerBase
-	console *os.File
+	consoles     map[core.MessageStreamID]*os.File
+	console      *os.File
+	streamColors map[core.MessageStreamID]string
+	palette      []string
+	colors       map[core.MessageStreamID]string
+	colorize     bool
+	prefix       bool
+}
+
+const consoleColorReset = "\x1b[0m"
+
+var consoleColors = map[string]int{
+	"black":   30,
+	"red":     31,
+	"green":   32,
+	"yellow":  33,
+	"blue":    34,
+	"magenta": 35,
+	"cyan":    36,
+	"white":   37,
 }
 
 func init() {
 	shared.RuntimeType.Register(Console{})
 }
 
+// consoleColor returns the ANSI escape sequence for the given color name or an
+// empty string for "none".
+func consoleColor(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == "none" || name == "" {
+		return "", nil // ### return, no color ###
+	}
+	if code, isNamed := consoleColors[name]; isNamed {
+		return fmt.Sprintf("\x1b[%dm", code), nil // ### return, named color ###
+	}
+	if code, isNamed := consoleColors[strings.TrimPrefix(name, "bright")]; isNamed {
+		return fmt.Sprintf("\x1b[%dm", code+60), nil // ### return, bright color ###
+	}
+	if code, err := strconv.Atoi(name); err == nil && code >= 0 && code <= 255 {
+		return fmt.Sprintf("\x1b[38;5;%dm", code), nil // ### return, 256 color ###
+	}
+	return "", fmt.Errorf("Unknown color %s", name)
+}
+
+func consoleFile(name string) (*os.File, error) {
+	switch strings.ToLower(name) {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		return nil, fmt.Errorf("Unknown console %s", name)
+	}
+}
+
 // Configure initializes this producer with values from a plugin config.
 func (prod *Console) Configure(conf core.PluginConfig) error {
 	err := prod.ProducerBase.Configure(conf)
@@ -49,23 +132,96 @@ func (prod *Console) Configure(conf core.PluginConfig) error {
 		return err
 	}
 
-	console := conf.GetString("Console", "stdout")
-
-	switch strings.ToLower(console) {
-	default:
-		fallthrough
-	case "stdout":
+	if prod.console, err = consoleFile(conf.GetString("Console", "stdout")); err != nil {
 		prod.console = os.Stdout
-	case "stderr":
-		prod.console = os.Stderr
+	}
+
+	prod.consoles = make(map[core.MessageStreamID]*os.File)
+	for streamID, name := range conf.GetStreamMap("ConsoleStreams", "") {
+		if prod.consoles[streamID], err = consoleFile(name); err != nil {
+			return err
+		}
+	}
+
+	prod.prefix = conf.GetBool("StreamPrefix", false)
+	prod.colorize = conf.GetBool("Colors", false)
+	prod.colors = make(map[core.MessageStreamID]string)
+
+	prod.palette = []string{}
+	for _, name := range conf.GetStringArray("ColorPalette", []string{"cyan", "green", "yellow", "magenta", "blue", "red"}) {
+		color, err := consoleColor(name)
+		if err != nil {
+			return err
+		}
+		prod.palette = append(prod.palette, color)
+	}
+
+	prod.streamColors = make(map[core.MessageStreamID]string)
+	for streamID, name := range conf.GetStreamMap("StreamColors", "") {
+		if prod.streamColors[streamID], err = consoleColor(name); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// getColor returns the escape sequence used for the given stream.
+func (prod *Console) getColor(streamID core.MessageStreamID) string {
+	if color, isKnown := prod.colors[streamID]; isKnown {
+		return color // ### return, cached ###
+	}
+
+	color, isSet := prod.streamColors[streamID]
+	if !isSet {
+		color, isSet = prod.streamColors[core.WildcardStreamID]
+	}
+	if !isSet && len(prod.palette) > 0 {
+		color = prod.palette[uint64(streamID)%uint64(len(prod.palette))]
+	}
+
+	prod.colors[streamID] = color
+	return color
+}
+
 func (prod *Console) printMessage(msg core.Message) {
-	text, _ := prod.ProducerBase.Format(msg)
-	fmt.Fprint(prod.console, string(text))
+	text, streamID := prod.ProducerBase.Format(msg)
+
+	console, isMapped := prod.consoles[streamID]
+	if !isMapped {
+		console = prod.console
+	}
+
+	if !prod.prefix && !prod.colorize {
+		fmt.Fprint(console, string(text))
+		return // ### return, plain output ###
+	}
+
+	buffer := bytes.Buffer{}
+	color := ""
+	if prod.colorize {
+		color = prod.getColor(streamID)
+	}
+
+	// Keep the trailing newline outside of the color sequence so that the
+	// terminal state is reset before the next line starts.
+	newline := bytes.HasSuffix(text, []byte("\n"))
+	if newline {
+		text = text[:len(text)-1]
+	}
+
+	buffer.WriteString(color)
+	if prod.prefix {
+		buffer.WriteString("[" + core.StreamTypes.GetStreamName(streamID) + "] ")
+	}
+	buffer.Write(text)
+	if color != "" {
+		buffer.WriteString(consoleColorReset)
+	}
+	if newline {
+		buffer.WriteByte('\n')
+	}
+	console.Write(buffer.Bytes())
 }
 
 // Produce writes to stdout or stderr.
@@ -16,6 +16,7 @@ package producer
 
 import (
 	"bytes"
+	"encoding/json"
 	elastigo "github.com/mattbaird/elastigo/lib"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
@@ -32,8 +33,12 @@ import (
 //     Enable: true
 //     Connections: 10
 //     RetrySec: 5
+//     Retries: 3
+//     RetryDelayMs: 1000
 //     TTL: "1d"
 //     DayBasedIndex: false
+//     TimeBasedIndex: false
+//     UseEventTime: false
 //     User: "root"
 //     Password: "root"
 //     BatchSizeByte: 65535
@@ -58,6 +63,15 @@ import (
 // RetrySec denotes the time in seconds after which a failed dataset will be
 // transmitted again. By default this is set to 5.
 //
+// Retries defines the number of times documents are sent again after they
+// have been rejected by elasticsearch because of a temporary error, i.e. an
+// item status of 429 (e.g. a full bulk queue) or 5xx. Only these documents
+// are sent again, not the whole bulk request. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before documents
+// are sent again. The delay is doubled for each retry. By default this is set
+// to 1000.
+//
 // Connections defines the number of simultaneous connections allowed to a
 // elasticsearch server. This is set to 6 by default.
 //
@@ -67,6 +81,17 @@ import (
 // DayBasedIndex can be set to true to append the date of the message to the
 // index as in "<index>_YYYY-MM-DD". By default this is set to false.
 //
+// TimeBasedIndex can be set to true to replace strftime directives like %Y,
+// %m or %d in index names with the time of the message, e.g. "logs-%Y.%m.%d".
+// By default this is set to false.
+//
+// UseEventTime can be set to true to use the event time of a message as set
+// by format.EventTime instead of the time the message was received. This time
+// is used for DayBasedIndex, TimeBasedIndex and as the timestamp of the
+// document. This way late arriving messages are written to
+// the index of the day they belong to. format.EventTime has to be used as a
+// stream formatter to do so. By default this is set to false.
+//
 // Servers defines a list of servers to connect to. The first server in the list
 // is used as the server passed to the "Domain" setting. The Domain setting can
 // be overwritten, too.
@@ -94,6 +119,11 @@ import (
 //
 // BatchTimeoutSec defines the time in seconds after which a flush will be
 // triggered. By default this is set to 5.
+//
+// Documents rejected by elasticsearch, e.g. because of mapping errors, are
+// sent to the RejectStream if set. This is also true for documents still
+// failing after all retries. As documents are batched these messages contain
+// the formatted document and are not assigned to their original stream.
 type ElasticSearch struct {
 	core.ProducerBase
 	conn          *elastigo.Conn
@@ -102,6 +132,10 @@ type ElasticSearch struct {
 	msgType       map[core.MessageStreamID]string
 	msgTTL        string
 	dayBasedIndex bool
+	timeIndex     bool
+	useEventTime  bool
+	retries       int
+	retryDelay    time.Duration
 }
 
 func init() {
@@ -133,21 +167,122 @@ func (prod *ElasticSearch) Configure(conf core.PluginConfig) error {
 	prod.indexer.BulkMaxDocs = conf.GetInt("BatchMaxCount", 128)
 
 	prod.indexer.Sender = func(buf *bytes.Buffer) error {
-		_, err := prod.conn.DoCommand("POST", "/_bulk", nil, buf)
+		bulk := buf.Bytes()
+		response, err := prod.conn.DoCommand("POST", "/_bulk", nil, buf)
 		if err != nil {
 			Log.Error.Print("ElasticSearch response error - ", err)
+			return err // ### return, bulk failed ###
 		}
-		return err
+		prod.retryFailedItems(bulk, response)
+		return nil
 	}
 
 	prod.index = conf.GetStreamMap("Index", "")
 	prod.msgType = conf.GetStreamMap("Type", "log")
 	prod.msgTTL = conf.GetString("TTL", "")
 	prod.dayBasedIndex = conf.GetBool("DayBasedIndex", false)
+	prod.timeIndex = conf.GetBool("TimeBasedIndex", false)
+	prod.useEventTime = conf.GetBool("UseEventTime", false)
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
 
 	return nil
 }
 
+// checkItems passes all documents of a bulk request that have been rejected
+// by elasticsearch to the reject stream. Documents rejected because of a
+// temporary error are returned as a new bulk request instead, unless final is
+// set to true.
+func (prod *ElasticSearch) checkItems(bulk []byte, response []byte, final bool) []byte {
+	result := struct {
+		Errors bool
+		Items  []map[string]struct {
+			Index  string      `json:"_index"`
+			Status int         `json:"status"`
+			Error  interface{} `json:"error"`
+		}
+	}{}
+
+	if err := json.Unmarshal(response, &result); err != nil || !result.Errors {
+		return nil // ### return, no item errors ###
+	}
+
+	// Each document is written as an action line followed by a source line
+	lines := bytes.Split(bytes.TrimRight(bulk, "\n"), []byte("\n"))
+	if len(lines) != 2*len(result.Items) {
+		Log.Error.Printf("ElasticSearch rejected documents cannot be assigned (%d items, %d lines)", len(result.Items), len(lines))
+		return nil // ### return, cannot assign documents ###
+	}
+
+	retry := []byte{}
+	for idx, item := range result.Items {
+		for _, status := range item {
+			if status.Error == nil {
+				continue // ### continue, no error ###
+			}
+
+			if !final && isTemporaryStatus(status.Status) {
+				retry = append(retry, lines[2*idx]...)
+				retry = append(retry, '\n')
+				retry = append(retry, lines[2*idx+1]...)
+				retry = append(retry, '\n')
+				continue // ### continue, retry document ###
+			}
+
+			reason, isString := status.Error.(string)
+			if !isString {
+				reasonJSON, _ := json.Marshal(status.Error)
+				reason = string(reasonJSON)
+			}
+			Log.Error.Printf("ElasticSearch rejected document for index %s (%d) - %s", status.Index, status.Status, reason)
+			prod.rejectDocument(lines[2*idx+1], idx, reason)
+		}
+	}
+	return retry
+}
+
+// rejectDocument passes a copy of the source line of a document to the
+// reject stream.
+func (prod *ElasticSearch) rejectDocument(source []byte, idx int, reason string) {
+	data := make([]byte, len(source))
+	copy(data, source)
+	prod.Reject(core.NewMessage(nil, data, uint64(idx)), reason)
+}
+
+// retryFailedItems checks the response of a bulk request and sends documents
+// that failed because of a temporary error again until they are accepted or
+// all retries have been used.
+func (prod *ElasticSearch) retryFailedItems(bulk []byte, response []byte) {
+	delay := prod.retryDelay
+	for attempt := 0; ; attempt++ {
+		final := attempt >= prod.retries
+		if bulk = prod.checkItems(bulk, response, final); len(bulk) == 0 {
+			return // ### return, done ###
+		}
+
+		documents := bytes.Count(bulk, []byte("\n")) / 2
+		Log.Warning.Printf("ElasticSearch retrying %d documents in %s", documents, delay)
+		time.Sleep(delay)
+		delay *= 2
+
+		var err error
+		response, err = prod.conn.DoCommand("POST", "/_bulk", nil, bulk)
+		for err != nil {
+			Log.Error.Print("ElasticSearch response error - ", err)
+			if attempt++; attempt >= prod.retries {
+				lines := bytes.Split(bytes.TrimRight(bulk, "\n"), []byte("\n"))
+				for idx := 1; idx < len(lines); idx += 2 {
+					prod.rejectDocument(lines[idx], idx/2, err.Error())
+				}
+				return // ### return, retries exhausted ###
+			}
+			time.Sleep(delay)
+			delay *= 2
+			response, err = prod.conn.DoCommand("POST", "/_bulk", nil, bulk)
+		}
+	}
+}
+
 func (prod *ElasticSearch) sendMessage(msg core.Message) {
 	index, indexMapped := prod.index[msg.StreamID]
 	if !indexMapped {
@@ -157,8 +292,16 @@ func (prod *ElasticSearch) sendMessage(msg core.Message) {
 		}
 	}
 
+	timestamp := msg.Timestamp
+	if prod.useEventTime {
+		timestamp = msg.EventTime()
+	}
+
+	if prod.timeIndex {
+		index = shared.Strftime(index, timestamp)
+	}
 	if prod.dayBasedIndex {
-		index = index + "_" + msg.Timestamp.Format("2006-01-02")
+		index = index + "_" + timestamp.Format("2006-01-02")
 	}
 
 	msgType, typeMapped := prod.msgType[msg.StreamID]
@@ -167,7 +310,7 @@ func (prod *ElasticSearch) sendMessage(msg core.Message) {
 	}
 
 	payload, _ := prod.ProducerBase.Format(msg)
-	err := prod.indexer.Index(index, msgType, "", prod.msgTTL, &msg.Timestamp, string(payload), true)
+	err := prod.indexer.Index(index, msgType, "", prod.msgTTL, &timestamp, string(payload), true)
 	if err != nil {
 		Log.Error.Print("ElasticSearch index error - ", err)
 	}
@@ -15,6 +15,7 @@
 package producer
 
 import (
+	"container/list"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
@@ -23,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,6 +39,7 @@ import (
 //     File: "/var/log/gollum.log"
 //     BatchSizeMaxKB: 16384
 //     BatchSizeByte: 4096
+//     BatchMaxCount: 0
 //     BatchTimeoutSec: 2
 //     FlushTimeoutSec: 10
 //     Rotate: false
@@ -44,24 +47,60 @@ import (
 //     RotateSizeMB: 1024
 //     RotateAt: "00:00"
 //     RotateTimestamp: "2006-01-02_15"
+//     RotateTimezone: ""
+//     Symlink: ""
 //     Compress: true
+//     Compression: "gzip"
+//     Encrypt: false
+//     EncryptKeyFile: ""
+//     EncryptKeyEnv: ""
+//     EncryptKeyProvider: ""
+//     EncryptKeyID: ""
+//     ChecksumManifest: ""
+//     ChecksumSidecar: false
+//     RotateHookCommand: ["/usr/local/bin/upload"]
+//     RotateHookURL: ""
+//     RotateHookHeaders:
+//       "Authorization": "Bearer token"
+//     RotateHookTimeoutSec: 30
+//     RotateHookRetries: 3
+//     RotateHookRetryDelayMs: 1000
+//     SyncPolicy: "never"
+//     SyncIntervalMs: 1000
+//     DirectIO: false
+//     Journal: false
+//     FanOutMetadata: ""
+//     FanOutRegex: ""
+//     FanOutDefault: "default"
+//     MaxOpenFiles: 0
+//     TimeBasedPath: false
+//     UseEventTime: false
+//     FileLock: false
+//     InstanceSuffix: ""
 //
 // The file producer writes messages to a file. This producer also allows log
 // rotation and compression of the rotated logs. Folders in the file path will
 // be created if necessary.
 //
 // File contains the path to the log file to write. The wildcard character "*"
-// can be used as a placeholder for the stream name.
+// can be used as a placeholder for the stream name. The character "%" can be
+// used as a placeholder for the fan-out key, see FanOutMetadata.
 // By default this is set to /var/prod/gollum.log.
 //
-// BatchSizeMaxKB defines the internal file buffer size in KB.
-// This producers allocates a front- and a backbuffer of this size. If the
+// BatchSizeMaxKB defines the maximum number of KB stored per batch.
+// This producers keeps a front- and a backbuffer of messages. If the
 // frontbuffer is filled up completely a flush is triggered and the frontbuffer
-// becomes available for writing again. Messages larger than BatchSizeMaxKB are
-// rejected.
+// becomes available for writing again. Messages are not copied into the
+// buffers but written to the file directly using writev. A batch holds up to
+// 1024 messages. Messages larger than BatchSizeMaxKB are rejected.
 //
 // BatchSizeByte defines the number of bytes to be buffered before they are written
-// to disk. By default this is set to 8KB.
+// to disk. A write is triggered as soon as this threshold is reached.
+// By default this is set to 8KB.
+//
+// BatchMaxCount defines the number of messages to be buffered before they are
+// written to disk. Set to 0 to write based on size and time only.
+// By default this is set to 0.
 //
 // BatchTimeoutSec defines the maximum number of seconds to wait after the last
 // message arrived before a batch is flushed automatically. By default this is
@@ -77,20 +116,197 @@ import (
 // rotate. Can be set in parallel with RotateSizeMB. By default this is set to
 // 1440 (i.e. 1 Day).
 //
-// RotateAt defines specific timestamp as in "HH:MM" when the log should be
-// rotated. Hours must be given in 24h format. When left empty this setting is
-// ignored. By default this setting is disabled.
+// RotateAt defines when the log should be rotated, either as a time of day as
+// in "HH:MM" (24h format) or as a cron expression with the fields minute,
+// hour, day of month, month and day of week, e.g. "0 */6 * * *" to rotate
+// every six hours or "30 7,19 * * mon-fri" to rotate at 07:30 and 19:30 on
+// weekdays. Macros like "@daily" or "@hourly" are supported, too. A file is
+// rotated if a scheduled time has passed since it was created. Times are
+// evaluated in RotateTimezone. When left empty this setting is ignored.
+// By default this setting is disabled.
 //
 // RotateTimestamp sets the timestamp added to the filename when file rotation
 // is enabled. The format is based on Go's time.Format function and set to
 // "2006-01-02_15" by default.
 //
-// Compress defines if a rotated logfile is to be gzip compressed or not.
+// RotateTimezone defines the timezone used for RotateAt, RotateTimestamp and
+// TimeBasedPath, e.g. "UTC" or "Europe/Berlin", so that rotation boundaries
+// and file names do not depend on the timezone of the host. Timezones are
+// given as IANA names. By default this is set to "", i.e. the local timezone
+// of the host is used.
+//
+// Symlink defines the path of a symlink that always points to the file
+// currently written, e.g. "/var/log/gollum.log" for rotated files named
+// "/var/log/gollum_2006-01-02_15.log". The symlink is replaced atomically on
+// every rotation so tools like "tail -F" always find the current file.
+// Relative paths are relative to the directory of File and the wildcard
+// character "*" can be used as a placeholder for the stream name. Existing
+// files that are not a symlink are never replaced. By default this is set to
+// "", i.e. a symlink named "<File>_current" is created if Rotate is enabled.
+//
+// Compress defines if a rotated logfile is to be compressed or not.
+// By default this is set to false.
+//
+// Compression defines the algorithm used when Compress is set to true.
+// Valid values are "gzip", "zlib", "snappy", "zstd", "lz4" and any other
+// compressor registered by core.RegisterCompressor. The file extension is
+// chosen by the algorithm, e.g. ".gz" for gzip. By default this is set to
+// "gzip".
+//
+// Encrypt can be set to true to encrypt rotated logfiles using AES-GCM.
+// Encrypted files get the extension ".enc", i.e. gzip compressed files are
+// stored as ".gz.enc". Each file starts with a header containing the key ID and the
+// nonce used for encryption. Data is encrypted in chunks of 64 KB which are
+// authenticated individually. Encryption is done in the background like
+// compression. The key is read from EncryptKeyFile, EncryptKeyEnv or
+// requested from EncryptKeyProvider. Exactly one of these has to be set.
+// By default this is set to false.
+//
+// EncryptKeyFile defines a file containing the AES key. Keys must be 16, 24
+// or 32 bytes long and can be stored raw, hex or base64 encoded.
+// By default this is set to "".
+//
+// EncryptKeyEnv defines an environment variable containing the hex or base64
+// encoded AES key. By default this is set to "".
+//
+// EncryptKeyProvider defines the type of a plugin implementing the
+// core.KeyProvider interface, e.g. to request keys from a key management
+// service. The plugin is configured with the settings of this producer and
+// asked for a key for each file. By default this is set to "".
+//
+// EncryptKeyID defines the key ID stored in the header of encrypted files
+// when using EncryptKeyFile or EncryptKeyEnv. By default this is set to "",
+// i.e. the first 8 bytes of the SHA-256 hash of the key are used (hex
+// encoded).
+//
+// ChecksumManifest defines a file the SHA-256 checksum of each rotated file is
+// appended to after compression and encryption are done. Lines use the format
+// of sha256sum, so the manifest can be verified with "sha256sum -c". Relative
+// paths are relative to the directory of the rotated file. Files below the
+// directory of the manifest are listed with a relative path, all other files
+// with an absolute path. The manifest is synced after each line.
+// By default this is set to "", i.e. no manifest is written.
+//
+// ChecksumSidecar can be set to true to write the SHA-256 checksum of each
+// rotated file to a file with the additional extension ".sha256", e.g.
+// "gollum_2006-01-02_15.gz.sha256". By default this is set to false.
+//
+// RotateHookCommand defines a command and its arguments that is executed after
+// a file has been rotated and, if enabled, compressed or encrypted. The
+// environment variables GOLLUM_ROTATED_FILE, GOLLUM_ROTATED_SOURCE,
+// GOLLUM_ROTATED_SIZE and GOLLUM_ROTATED_SHA256 contain the path of the final
+// file, the path before archiving, the size in bytes and the SHA-256 checksum
+// of the final file. A non-zero exit code is treated as an error.
+// By default this is set to [], i.e. no command is executed.
+//
+// RotateHookURL defines an http or https URL that receives a POST request
+// after a file has been rotated. The body is a JSON object containing the
+// fields "file", "source", "size", "sha256" and "rotated". Any status code
+// other than 2xx is treated as an error. By default this is set to "".
+//
+// RotateHookHeaders defines additional HTTP headers sent with each request to
+// RotateHookURL, e.g. for authentication. By default this is set to {}.
+//
+// RotateHookTimeoutSec defines the maximum number of seconds a hook command or
+// request may take. By default this is set to 30.
+//
+// RotateHookRetries defines the number of times a failed hook is retried.
+// The delay between two attempts starts at RotateHookRetryDelayMs and is
+// doubled after each attempt. Hooks are run in the background and are waited
+// for on shutdown. By default this is set to 3.
+//
+// RotateHookRetryDelayMs defines the number of milliseconds to wait before
+// the first retry of a failed hook. By default this is set to 1000.
+//
+// SyncPolicy defines when written data is committed to stable storage by
+// calling fsync. Valid values are "never", "interval" and "batch" (or
+// "every-batch"). When set to "never" the operating system decides when data
+// is persisted. When set to "interval" the file is synced every SyncIntervalMs
+// milliseconds if new data has been written. When set to "batch" the file is
+// synced after each batch has been written, which guarantees persistence at the
+// cost of throughput. Files are always synced before they are rotated or closed
+// if this is not set to "never". By default this is set to "never".
+//
+// SyncIntervalMs defines the number of milliseconds between two syncs if
+// SyncPolicy is set to "interval". By default this is set to 1000.
+//
+// DirectIO can be set to true to write to the file using direct I/O, i.e. the
+// page cache is bypassed. This is only supported on Linux and requires a file
+// system supporting O_DIRECT. This setting is best combined with SyncPolicy
+// set to "batch". By default this is set to false.
+//
+// Journal can be set to true to stage each batch in a write-ahead journal
+// before it is appended to the file. The journal is stored next to the file
+// using the extension ".journal". Batches that were interrupted by a crash are
+// written again when the producer starts, so files never end with a partially
+// written batch. Both the journal and the file are synced for each batch so
+// SyncPolicy is ignored. This setting cannot be combined with DirectIO.
+// By default this is set to false.
+//
+// FanOutMetadata defines a metadata key used to write messages to different
+// files, e.g. one file per tenant. The value of this key replaces the
+// placeholder "%" in File, which is required if fan-out is enabled. Characters
+// other than letters, digits, ".", "_" and "-" are replaced by "_" and leading
+// dots are removed. Each file has its own batch and rotation state.
+// By default this is set to "", i.e. fan-out is disabled.
+//
+// FanOutRegex defines a regular expression matched against the formatted
+// message to get the fan-out key if FanOutMetadata is not set or the metadata
+// key is missing. The first capture group or, if there is none, the whole match
+// is used as key. By default this is set to "".
+//
+// FanOutDefault defines the fan-out key used for messages without a key.
+// By default this is set to "default".
+//
+// MaxOpenFiles defines the maximum number of files kept open at the same time.
+// If this number is reached the least recently used file is flushed and
+// closed. Closed files are reopened without rotation when the next message
+// for them arrives. This setting should be set when using fan-out or "*" with
+// many streams. Independent of this setting files are closed the same way if
+// the file producers of this process use 80% of its file descriptor limit or
+// if a file cannot be opened because the limit has been reached. A warning is
+// logged in this case. The metrics "FilesOpen" and "FilesClosedByLimit" show
+// the number of used file descriptors and the number of files closed because
+// of the limit. By default this is set to 0, i.e. there is no limit.
+//
+// TimeBasedPath can be set to true to replace strftime directives like %Y,
+// %m, %d or %H in File with the time of each message, e.g.
+// "/var/log/%Y/%m/%d/gollum.log". Messages are written to the file matching
+// their time. Files of past periods are closed when files are rotated or once
+// they have not been written to for BatchTimeoutSec. Use "%%" as the fan-out
+// placeholder if it is directly followed by a letter.
+// By default this is set to false.
+//
+// UseEventTime can be set to true to use the event time of a message as set
+// by format.EventTime for TimeBasedPath instead of the time the message was
+// received. This way late arriving messages are written to the file of the
+// period they belong to. format.EventTime has to be used as a stream
+// formatter to do so. Messages without an event time use the time they were
+// received. By default this is set to false.
+//
+// FileLock can be set to true to take an exclusive advisory lock (flock) on
+// the file while a batch is written, so that batches of multiple processes
+// appending to the same file are not interleaved. Rotated files are locked
+// while they are compressed or encrypted and files that are locked or have
+// already been archived by another process are not archived again, e.g. when
+// a restarted process races the background compression of its predecessor.
+// Processes sharing a file do not coordinate rotation, so InstanceSuffix
+// should be used if Rotate is enabled. This setting is not supported on
+// windows and cannot be combined with DirectIO or Journal.
 // By default this is set to false.
+//
+// InstanceSuffix defines a string appended to the file name before the
+// extension and the rotation timestamp so that multiple processes write to
+// separate files. The placeholders ${hostname} and ${pid} are replaced by the
+// hostname and the process ID, e.g. "_${hostname}" writes to
+// "/var/log/gollum_web01.log". By default this is set to "".
 type File struct {
 	core.ProducerBase
-	filesByStream map[core.MessageStreamID]*fileState
+	filesByKey    map[fileKey]*fileState
 	files         map[uint32]*fileState
+	closedFiles   map[uint32]fileClosed
+	openFiles     *list.List
+	maxOpenFiles  int
 	rotate        fileRotateConfig
 	timestamp     string
 	fileDir       string
@@ -100,9 +316,40 @@ type File struct {
 	flushTimeout  time.Duration
 	bufferSizeMax int
 	batchSize     int
+	batchCount    int
 	wildcardPath  bool
+	symlink       string
+	syncPolicy    fileSyncPolicy
+	syncInterval  time.Duration
+	directIO      bool
+	journal       bool
+	fanOut        bool
+	fanOutMeta    string
+	fanOutRegex   *regexp.Regexp
+	fanOutDefault string
+	logFile       string
+	timePath      bool
+	useEventTime  bool
+	lockFiles     bool
+}
+
+// fileKey identifies the file a message is written to.
+type fileKey struct {
+	streamID core.MessageStreamID
+	fanOut   string
+	path     string
 }
 
+// fileClosed stores the state of a file closed because of MaxOpenFiles.
+type fileClosed struct {
+	path    string
+	created time.Time
+}
+
+const fileFanOutPlaceholder = "%"
+
+var fileFanOutInvalidChars = regexp.MustCompile("[^a-zA-Z0-9._-]")
+
 func init() {
 	shared.RuntimeType.Register(File{})
 }
@@ -114,14 +361,22 @@ func (prod *File) Configure(conf core.PluginConfig) error {
 		return err
 	}
 
-	prod.filesByStream = make(map[core.MessageStreamID]*fileState)
+	prod.filesByKey = make(map[fileKey]*fileState)
 	prod.files = make(map[uint32]*fileState)
+	prod.closedFiles = make(map[uint32]fileClosed)
+	prod.openFiles = list.New()
+	prod.maxOpenFiles = conf.GetInt("MaxOpenFiles", 0)
 	prod.bufferSizeMax = conf.GetInt("BatchSizeMaxKB", 8<<10) << 10 // 8 MB
 
 	prod.batchSize = conf.GetInt("BatchSizeByte", 8192)
+	prod.batchCount = conf.GetInt("BatchMaxCount", 0)
 	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second
 
 	logFile := conf.GetString("File", "/var/prod/gollum.log")
+	if suffix := conf.GetString("InstanceSuffix", ""); suffix != "" {
+		ext := filepath.Ext(logFile)
+		logFile = logFile[:len(logFile)-len(ext)] + expandFileInstanceSuffix(suffix) + ext
+	}
 	prod.wildcardPath = strings.IndexByte(logFile, '*') != -1
 
 	prod.fileDir = filepath.Dir(logFile)
@@ -129,55 +384,181 @@ func (prod *File) Configure(conf core.PluginConfig) error {
 	prod.fileName = filepath.Base(logFile)
 	prod.fileName = prod.fileName[:len(prod.fileName)-len(prod.fileExt)]
 	prod.timestamp = conf.GetString("RotateTimestamp", "2006-01-02_15")
+	prod.symlink = conf.GetString("Symlink", "")
 	prod.flushTimeout = time.Duration(conf.GetInt("FlushTimeoutSec", 5)) * time.Second
 
 	prod.rotate.enabled = conf.GetBool("Rotate", false)
 	prod.rotate.timeout = time.Duration(conf.GetInt("RotateTimeoutMin", 1440)) * time.Minute
 	prod.rotate.sizeByte = int64(conf.GetInt("RotateSizeMB", 1024)) << 20
-	prod.rotate.atHour = -1
-	prod.rotate.atMinute = -1
-	prod.rotate.compress = conf.GetBool("Compress", false)
+	prod.rotate.location = time.Local
+	if timezone := conf.GetString("RotateTimezone", ""); timezone != "" {
+		if prod.rotate.location, err = time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("Unknown RotateTimezone \"%s\": %s", timezone, err)
+		}
+	}
+	if conf.GetBool("Compress", false) {
+		if prod.rotate.compress, err = core.NewCompressor(conf.GetString("Compression", "gzip")); err != nil {
+			return err
+		}
+	}
 
-	rotateAt := conf.GetString("RotateAt", "")
-	if rotateAt != "" {
-		parts := strings.Split(rotateAt, ":")
-		rotateAtHour, _ := strconv.ParseInt(parts[0], 10, 8)
-		rotateAtMin, _ := strconv.ParseInt(parts[1], 10, 8)
+	if conf.GetBool("Encrypt", false) {
+		if prod.rotate.encrypt, err = newFileKeyProvider(conf); err != nil {
+			return err
+		}
+	}
+
+	if prod.rotate.hook, err = newFileRotateHook(conf); err != nil {
+		return err
+	}
+	prod.rotate.checksum = newFileChecksumWriter(conf)
+
+	if rotateAt := conf.GetString("RotateAt", ""); rotateAt != "" {
+		if prod.rotate.at, err = parseFileRotateAt(rotateAt); err != nil {
+			return err
+		}
+	}
+
+	switch strings.ToLower(conf.GetString("SyncPolicy", "never")) {
+	case "never":
+		prod.syncPolicy = fileSyncNever
+	case "interval":
+		prod.syncPolicy = fileSyncInterval
+	case "batch", "every-batch":
+		prod.syncPolicy = fileSyncBatch
+	default:
+		return fmt.Errorf("Unknown SyncPolicy \"%s\"", conf.GetString("SyncPolicy", ""))
+	}
+
+	prod.syncInterval = time.Duration(conf.GetInt("SyncIntervalMs", 1000)) * time.Millisecond
+	prod.directIO = conf.GetBool("DirectIO", false)
+	if prod.directIO && fileDirectIOFlag == 0 {
+		return fmt.Errorf("DirectIO is not supported on this platform")
+	}
+
+	prod.journal = conf.GetBool("Journal", false)
+	if prod.journal && prod.directIO {
+		return fmt.Errorf("Journal cannot be combined with DirectIO")
+	}
+
+	prod.lockFiles = conf.GetBool("FileLock", false)
+	switch {
+	case prod.lockFiles && !fileLockSupported:
+		return fmt.Errorf("FileLock is not supported on this platform")
+	case prod.lockFiles && (prod.directIO || prod.journal):
+		return fmt.Errorf("FileLock cannot be combined with DirectIO or Journal")
+	}
+	prod.rotate.lock = prod.lockFiles
+
+	prod.fanOutMeta = conf.GetString("FanOutMetadata", "")
+	prod.fanOutDefault = conf.GetString("FanOutDefault", "default")
+	if fanOutRegex := conf.GetString("FanOutRegex", ""); fanOutRegex != "" {
+		if prod.fanOutRegex, err = regexp.Compile(fanOutRegex); err != nil {
+			return err
+		}
+	}
+
+	prod.logFile = logFile
+	prod.timePath = conf.GetBool("TimeBasedPath", false)
+	prod.useEventTime = conf.GetBool("UseEventTime", false)
+	if prod.timePath {
+		if !shared.HasStrftimeDirective(logFile) {
+			return fmt.Errorf("File must contain a time directive when TimeBasedPath is enabled")
+		}
+		logFile = shared.Strftime(logFile, time.Time{})
+	}
 
-		prod.rotate.atHour = int(rotateAtHour)
-		prod.rotate.atMinute = int(rotateAtMin)
+	prod.fanOut = prod.fanOutMeta != "" || prod.fanOutRegex != nil
+	if prod.fanOut && !strings.Contains(logFile, fileFanOutPlaceholder) {
+		return fmt.Errorf("File must contain \"%s\" when fan-out is enabled", fileFanOutPlaceholder)
 	}
 
 	return nil
 }
 
-func (prod *File) getFileState(streamID core.MessageStreamID, forceRotate bool) (*fileState, error) {
-	if state, stateExists := prod.filesByStream[streamID]; stateExists {
+// parseFileRotateAt parses RotateAt as either a cron expression or a time of
+// day as in "HH:MM".
+func parseFileRotateAt(rotateAt string) (*shared.CronSchedule, error) {
+	if strings.Contains(rotateAt, ":") {
+		parts := strings.Split(rotateAt, ":")
+		hour, hourErr := strconv.Atoi(parts[0])
+		minute, minuteErr := strconv.Atoi(parts[len(parts)-1])
+		if len(parts) != 2 || hourErr != nil || minuteErr != nil {
+			return nil, fmt.Errorf("RotateAt \"%s\" must be given as \"HH:MM\" or a cron expression", rotateAt)
+		}
+		rotateAt = fmt.Sprintf("%d %d * * *", minute, hour)
+	}
+	return shared.ParseCronSchedule(rotateAt)
+}
+
+// expandFileInstanceSuffix replaces the placeholders of InstanceSuffix.
+func expandFileInstanceSuffix(suffix string) string {
+	hostname, _ := os.Hostname()
+	replacer := strings.NewReplacer("${hostname}", hostname, "${pid}", strconv.Itoa(os.Getpid()))
+	return replacer.Replace(suffix)
+}
+
+// getFanOutKey returns the fan-out key of a message. Characters that are not
+// safe to use in a path are replaced.
+func (prod *File) getFanOutKey(msg core.Message) string {
+	key := msg.Metadata[prod.fanOutMeta]
+	if key == "" && prod.fanOutRegex != nil {
+		if match := prod.fanOutRegex.FindSubmatch(msg.Data); match != nil {
+			key = string(match[0])
+			if len(match) > 1 {
+				key = string(match[1])
+			}
+		}
+	}
+
+	key = strings.TrimLeft(fileFanOutInvalidChars.ReplaceAllString(key, "_"), ".")
+	if key == "" {
+		return prod.fanOutDefault
+	}
+	return key
+}
+
+func (prod *File) getFileState(key fileKey, forceRotate bool) (*fileState, error) {
+	if state, stateExists := prod.filesByKey[key]; stateExists {
 		if rotate, err := state.needsRotate(prod.rotate, forceRotate); !rotate {
 			return state, err // ### return, already open or error ###
 		}
 	}
 
-	var logFileName, fileDir, fileName, fileExt string
+	var logFileName, fileDir, fileName, fileExt, symlink string
 	var fileID uint32
 
-	if prod.wildcardPath {
+	baseDir, baseName, baseExt := prod.fileDir, prod.fileName, prod.fileExt
+	if prod.timePath {
+		baseDir = filepath.Dir(key.path)
+		baseExt = filepath.Ext(key.path)
+		baseName = filepath.Base(key.path)
+		baseName = baseName[:len(baseName)-len(baseExt)]
+	}
+
+	if prod.wildcardPath || prod.fanOut || prod.timePath {
 		// Get state from filename (without timestamp, etc.)
 		var streamName string
-		switch streamID {
+		switch key.streamID {
 		case core.WildcardStreamID:
 			streamName = "all"
 		case core.LogInternalStreamID:
 			streamName = "gollum"
+		case core.HealthInternalStreamID:
+			streamName = "health"
+		case core.TraceInternalStreamID:
+			streamName = "traces"
 		case core.DroppedStreamID:
 			streamName = "dropped"
 		default:
-			streamName = core.StreamTypes.GetStreamName(streamID)
+			streamName = core.StreamTypes.GetStreamName(key.streamID)
 		}
 
-		fileDir = strings.Replace(prod.fileDir, "*", streamName, -1)
-		fileName = strings.Replace(prod.fileName, "*", streamName, -1)
-		fileExt = strings.Replace(prod.fileExt, "*", streamName, -1)
+		replacer := strings.NewReplacer("*", streamName, fileFanOutPlaceholder, key.fanOut)
+		fileDir = replacer.Replace(baseDir)
+		fileName = replacer.Replace(baseName)
+		fileExt = replacer.Replace(baseExt)
+		symlink = replacer.Replace(prod.symlink)
 
 		// Hash the base name
 		hash := fnv.New32a()
@@ -188,6 +569,7 @@ func (prod *File) getFileState(streamID core.MessageStreamID, forceRotate bool)
 		fileDir = prod.fileDir
 		fileName = prod.fileName
 		fileExt = prod.fileExt
+		symlink = prod.symlink
 		fileID = 0
 	}
 
@@ -195,12 +577,27 @@ func (prod *File) getFileState(streamID core.MessageStreamID, forceRotate bool)
 	state, stateExists := prod.files[fileID]
 	if !stateExists {
 		// state does not yet exist: create and map it
-		state = newFileState(prod.bufferSizeMax, prod.flushTimeout)
+		state = newFileState(prod.bufferSizeMax, prod.flushTimeout, prod.syncPolicy, prod.syncInterval)
+		state.locked = prod.lockFiles
 		prod.files[fileID] = state
-		prod.filesByStream[streamID] = state
-	} else if _, mappingExists := prod.filesByStream[streamID]; !mappingExists {
+		prod.filesByKey[key] = state
+
+		if closed, isClosed := prod.closedFiles[fileID]; isClosed {
+			// file has been closed because of MaxOpenFiles: reopen it
+			delete(prod.closedFiles, fileID)
+			state.fileCreated = closed.created
+			if err := prod.openFile(state, fileID, closed.path); err != nil {
+				return state, err // ### return error ###
+			}
+			if rotate, err := state.needsRotate(prod.rotate, forceRotate); !rotate {
+				return state, err // ### return, reopened or error ###
+			}
+		} else if prod.journal {
+			recoverFileJournals(fileDir, fileName)
+		}
+	} else if _, mappingExists := prod.filesByKey[key]; !mappingExists {
 		// state exists but is not mapped: map it and see if we need to rotate
-		prod.filesByStream[streamID] = state
+		prod.filesByKey[key] = state
 		if rotate, err := state.needsRotate(prod.rotate, forceRotate); !rotate {
 			return state, err // ### return, already open or error ###
 		}
@@ -215,13 +612,15 @@ func (prod *File) getFileState(streamID core.MessageStreamID, forceRotate bool)
 	if !prod.rotate.enabled {
 		logFileName = fmt.Sprintf("%s%s", fileName, fileExt)
 	} else {
-		timestamp := time.Now().Format(prod.timestamp)
+		timestamp := time.Now().In(prod.rotate.location).Format(prod.timestamp)
 		signature := fmt.Sprintf("%s_%s", fileName, timestamp)
 		counter := 0
 
 		files, _ := ioutil.ReadDir(fileDir)
 		for _, file := range files {
-			if strings.Contains(file.Name(), signature) {
+			if strings.Contains(file.Name(), signature) &&
+				!strings.HasSuffix(file.Name(), fileJournalExt) &&
+				!strings.HasSuffix(file.Name(), fileChecksumExt) {
 				counter++
 			}
 		}
@@ -236,62 +635,276 @@ func (prod *File) getFileState(streamID core.MessageStreamID, forceRotate bool)
 	logFile := fmt.Sprintf("%s/%s", fileDir, logFileName)
 
 	// Close existing log
+	// A flush running in the background may still write to the current file
+	// or its direct I/O and journal handles, so wait for it to finish first.
+	rotatedFile := ""
 	if state.file != nil {
-		currentLog := state.file
-		state.file = nil
+		state.batch.WaitForFlush(state.flushTimeout)
+		currentLog := state.detachFile()
+		rotatedFile = currentLog.Name()
 
-		if prod.rotate.compress {
-			go state.compressAndCloseLog(currentLog)
+		if prod.rotate.compress != nil || prod.rotate.encrypt != nil {
+			go state.archiveAndCloseLog(currentLog, prod.rotate)
 		} else {
 			Log.Note.Print("Rotated " + currentLog.Name())
 			currentLog.Close()
+
+			if prod.rotate.hasPostRotate() {
+				state.bgWriter.Add(1)
+				go func(rotate fileRotateConfig) {
+					defer state.bgWriter.Done()
+					state.postRotate(rotatedFile, rotatedFile, rotate)
+				}(prod.rotate)
+			}
 		}
 	}
 
 	// (Re)open logfile
-	var err error
-	state.file, err = os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	err := prod.openFile(state, fileID, logFile)
 	if err != nil {
 		return state, err // ### return error ###
 	}
+	if rotatedFile != "" {
+		core.EmitHealthEvent(core.HealthFileRotated, "producer.File", map[string]interface{}{"file": rotatedFile, "next": logFile})
+	}
 
 	// Create "current" symlink
 	state.fileCreated = time.Now()
-	if prod.rotate.enabled {
-		symLinkName := fmt.Sprintf("%s/%s_current%s", fileDir, fileName, fileExt)
-		os.Remove(symLinkName)
-		os.Symlink(logFileName, symLinkName)
+	switch {
+	case symlink != "":
+		if !filepath.IsAbs(symlink) {
+			symlink = filepath.Join(fileDir, symlink)
+		}
+	case prod.rotate.enabled:
+		symlink = fmt.Sprintf("%s/%s_current%s", fileDir, fileName, fileExt)
+	}
+
+	if symlink != "" && filepath.Clean(symlink) != filepath.Clean(logFile) {
+		if err := updateFileSymlink(logFile, symlink); err != nil {
+			Log.Error.Print("Error updating symlink - ", err)
+		}
 	}
 
 	return state, err
 }
 
+// openFile opens the given file for the given state. If MaxOpenFiles has been
+// reached the least recently used file is closed first. The same is done if
+// the file descriptor budget of the process is used up or if opening the file
+// fails because of the file descriptor limit.
+func (prod *File) openFile(state *fileState, fileID uint32, logFile string) error {
+	if state.lru == nil {
+		for prod.maxOpenFiles > 0 && prod.openFiles.Len() >= prod.maxOpenFiles {
+			prod.closeLeastRecentlyUsed()
+		}
+		state.lru = prod.openFiles.PushFront(fileID)
+	}
+
+	for fileDescriptors.exhausted() {
+		if !prod.closeForDescriptorLimit(state) {
+			break // ### break, no file left to close ###
+		}
+		fileDescriptors.warn("File descriptor budget used up, closing least recently used files.")
+	}
+
+	// Direct I/O and journals write at explicit offsets so O_APPEND must not
+	// be set
+	var err error
+	openFlags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if prod.directIO || prod.journal {
+		openFlags = os.O_RDWR | os.O_CREATE
+	}
+
+	for {
+		state.file, err = os.OpenFile(logFile, openFlags, 0644)
+		if !isTooManyOpenFiles(err) || !prod.closeForDescriptorLimit(state) {
+			break // ### break, opened or nothing to close ###
+		}
+		fileDescriptors.warn("File descriptor limit reached, closing least recently used files.")
+	}
+	if err != nil {
+		if isTooManyOpenFiles(err) {
+			fileDescriptors.warn("File descriptor limit reached, no file left to close.")
+		}
+		return err // ### return error ###
+	}
+	descriptors := 1
+
+	if prod.directIO {
+		if state.direct, err = newFileDirectWriter(state.file); err != nil {
+			state.file.Close()
+			state.file = nil
+			return err // ### return error ###
+		}
+		descriptors++
+	}
+
+	if prod.journal {
+		if state.journal, err = newFileJournalWriter(state.file); err != nil {
+			state.file.Close()
+			state.file = nil
+			return err // ### return error ###
+		}
+		descriptors++
+	}
+
+	state.descriptors = descriptors
+	fileDescriptors.acquire(descriptors)
+	return nil
+}
+
+// closeForDescriptorLimit closes the least recently used file to free a file
+// descriptor. The file of the given state is never closed. False is returned
+// if there is no file left to close.
+func (prod *File) closeForDescriptorLimit(state *fileState) bool {
+	if back := prod.openFiles.Back(); back == nil || back == state.lru {
+		return false // ### return, nothing to close ###
+	}
+	prod.closeLeastRecentlyUsed()
+	shared.Metric.Inc(metricFilesClosedByLimit)
+	return true
+}
+
+// closeLeastRecentlyUsed flushes and closes the least recently used file.
+// The state of the file is removed to free its buffers, only the path and
+// creation time are kept so that the file can be reopened without rotation.
+func (prod *File) closeLeastRecentlyUsed() {
+	fileID := prod.openFiles.Back().Value.(uint32)
+	state := prod.files[fileID]
+	if state.file != nil {
+		prod.closedFiles[fileID] = fileClosed{
+			path:    state.file.Name(),
+			created: state.fileCreated,
+		}
+	}
+
+	prod.removeFileState(fileID)
+	Log.Note.Print("Closed least recently used file ", prod.closedFiles[fileID].path)
+}
+
+// removeFileState flushes and closes the file of the given state and removes
+// the state and all of its mappings.
+func (prod *File) removeFileState(fileID uint32) {
+	state := prod.files[fileID]
+	if state.lru != nil {
+		prod.openFiles.Remove(state.lru)
+		state.lru = nil
+	}
+
+	state.closeFile()
+	delete(prod.files, fileID)
+	for key, mappedState := range prod.filesByKey {
+		if mappedState == state {
+			delete(prod.filesByKey, key)
+		}
+	}
+}
+
+// closePastPeriods closes the files of TimeBasedPath that do not belong to
+// the current period. Unless force is set, only files that have not been
+// written to for the batch timeout are closed. These files are reopened
+// without rotation if late messages arrive for their period.
+func (prod *File) closePastPeriods(force bool) {
+	now := time.Now()
+	currentPath := shared.Strftime(prod.logFile, now.In(prod.rotate.location))
+	idleSince := now.Add(-prod.batchTimeout)
+
+	past := make(map[*fileState]bool)
+	for key, state := range prod.filesByKey {
+		if key.path != currentPath && (force || state.lastWrite.Before(idleSince)) {
+			past[state] = true
+		}
+	}
+	for fileID, state := range prod.files {
+		if past[state] {
+			if state.file != nil {
+				if !force && prod.rotate.enabled {
+					prod.closedFiles[fileID] = fileClosed{
+						path:    state.file.Name(),
+						created: state.fileCreated,
+					}
+				}
+				Log.Note.Print("Closed file of past period ", state.file.Name())
+			}
+			prod.removeFileState(fileID)
+		}
+	}
+
+	// Files older than the rotation timeout are rotated when being reopened,
+	// so there is no need to remember them.
+	for fileID, closed := range prod.closedFiles {
+		if now.Sub(closed.created) >= prod.rotate.timeout {
+			delete(prod.closedFiles, fileID)
+		}
+	}
+}
+
+func (prod *File) reachedBatchThreshold(state *fileState) bool {
+	return state.batch.ReachedSizeThreshold(prod.batchSize) || state.batch.ReachedCountThreshold(prod.batchCount)
+}
+
 func (prod *File) writeBatchOnTimeOut() {
 	for _, state := range prod.files {
-		if state.batch.ReachedTimeThreshold(prod.batchTimeout) || state.batch.ReachedSizeThreshold(prod.batchSize) {
+		if state.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.reachedBatchThreshold(state) {
 			state.writeBatch()
 		}
+		state.syncOnInterval()
+	}
+	if prod.timePath {
+		prod.closePastPeriods(false)
 	}
 }
 
 func (prod *File) writeMessage(msg core.Message) {
 	msg.Data, msg.StreamID = prod.ProducerBase.Format(msg)
-	state, err := prod.getFileState(msg.StreamID, false)
+
+	key := fileKey{streamID: msg.StreamID}
+	if prod.fanOut {
+		key.fanOut = prod.getFanOutKey(msg)
+	}
+	if prod.timePath {
+		if prod.useEventTime {
+			key.path = shared.Strftime(prod.logFile, msg.EventTime().In(prod.rotate.location))
+		} else {
+			key.path = shared.Strftime(prod.logFile, msg.Timestamp.In(prod.rotate.location))
+		}
+	}
+
+	state, err := prod.getFileState(key, false)
 	if err != nil {
 		Log.Error.Print("File log error:", err)
 		msg.Drop(time.Duration(0))
 		return // ### return, dropped ###
 	}
+	if state.lru != nil {
+		prod.openFiles.MoveToFront(state.lru)
+	}
+	if prod.timePath {
+		state.lastWrite = time.Now()
+	}
 
 	if !state.batch.Append(msg) {
 		state.writeBatch()
 		state.batch.Append(msg)
 	}
+	if prod.reachedBatchThreshold(state) {
+		state.writeBatch()
+	}
 }
 
 func (prod *File) rotateLog() {
-	for streamID := range prod.filesByStream {
-		if _, err := prod.getFileState(streamID, true); err != nil {
+	// Closed files are not reopened, a new file is created when the next
+	// message for them arrives.
+	prod.closedFiles = make(map[uint32]fileClosed)
+
+	// Files of past periods are closed instead of creating an empty file for
+	// each of them.
+	if prod.timePath {
+		prod.closePastPeriods(true)
+	}
+
+	for key := range prod.filesByKey {
+		if _, err := prod.getFileState(key, true); err != nil {
 			Log.Error.Print("File rotate error:", err)
 		}
 	}
@@ -308,6 +921,11 @@ func (prod *File) flush() {
 func (prod *File) Produce(workers *sync.WaitGroup) {
 	defer prod.flush()
 
+	tickerInterval := prod.batchTimeout
+	if prod.syncPolicy == fileSyncInterval && prod.syncInterval < tickerInterval {
+		tickerInterval = prod.syncInterval
+	}
+
 	prod.AddMainWorker(workers)
-	prod.TickerControlLoop(prod.batchTimeout, prod.writeMessage, prod.rotateLog, prod.writeBatchOnTimeOut)
+	prod.TickerControlLoop(tickerInterval, prod.writeMessage, prod.rotateLog, prod.writeBatchOnTimeOut)
 }
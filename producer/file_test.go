@@ -0,0 +1,89 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/trivago/gollum/core"
+	_ "github.com/trivago/gollum/format"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countFileTestLogs returns the number of regular files starting with the
+// given prefix.
+func countFileTestLogs(dir string, prefix string) int {
+	files, _ := ioutil.ReadDir(dir)
+	count := 0
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestFileTimeBasedPathRotate(t *testing.T) {
+	expect := shared.NewExpect(t)
+	dir, err := ioutil.TempDir("", "gollum-file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	conf := core.NewPluginConfig("producer.File")
+	conf.Settings["File"] = filepath.Join(dir, "%Y-%m-%d.log")
+	conf.Settings["TimeBasedPath"] = true
+	conf.Settings["Rotate"] = true
+
+	prod := File{}
+	expect.NoError(prod.Configure(conf))
+
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+	today := now.Format("2006-01-02")
+
+	pastMsg := core.NewMessage(nil, []byte("past\n"), 0)
+	pastMsg.Timestamp = now.AddDate(0, 0, -1)
+	prod.writeMessage(pastMsg)
+	prod.writeMessage(core.NewMessage(nil, []byte("current\n"), 1))
+	expect.Equal(2, len(prod.files))
+
+	// Rotation only creates a new file for the current period
+	prod.rotateLog()
+	expect.Equal(1, len(prod.files))
+	expect.Equal(1, len(prod.filesByKey))
+	expect.Equal(1, countFileTestLogs(dir, yesterday))
+	expect.Equal(2, countFileTestLogs(dir, today))
+
+	// Idle files of past periods are closed and reopened for late messages
+	prod.writeMessage(pastMsg)
+	expect.Equal(2, len(prod.files))
+	for _, state := range prod.files {
+		state.lastWrite = now.Add(-prod.batchTimeout - time.Second)
+	}
+	prod.writeBatchOnTimeOut()
+	expect.Equal(1, len(prod.files))
+	expect.Equal(1, len(prod.closedFiles))
+
+	prod.writeMessage(pastMsg)
+	for _, state := range prod.files {
+		state.flush()
+	}
+	expect.Equal(2, countFileTestLogs(dir, yesterday))
+	expect.Equal(2, countFileTestLogs(dir, today))
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileChecksumExt is the extension of checksum sidecar files.
+const fileChecksumExt = ".sha256"
+
+// fileChecksumWriter stores the checksums of rotated files in a manifest
+// and/or a sidecar file. Both use the format of sha256sum so they can be
+// verified with "sha256sum -c".
+type fileChecksumWriter struct {
+	manifest string
+	sidecar  bool
+	guard    *sync.Mutex
+}
+
+// newFileChecksumWriter reads the Checksum* settings. If neither a manifest
+// nor sidecar files are configured nil is returned.
+func newFileChecksumWriter(conf core.PluginConfig) *fileChecksumWriter {
+	writer := &fileChecksumWriter{
+		manifest: conf.GetString("ChecksumManifest", ""),
+		sidecar:  conf.GetBool("ChecksumSidecar", false),
+		guard:    new(sync.Mutex),
+	}
+
+	if writer.manifest == "" && !writer.sidecar {
+		return nil
+	}
+	return writer
+}
+
+// fileChecksum returns the size and the hex encoded SHA-256 hash of a file.
+func fileChecksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileChecksum writes a sha256sum formatted line to the given file and
+// syncs it. name is the file name written to the line. flags are passed to
+// os.OpenFile in addition to os.O_WRONLY and os.O_CREATE.
+func writeFileChecksum(path string, flags int, name string, checksum string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(file, "%s  %s\n", checksum, name); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// manifestPath returns the path of the manifest for the given file. Relative
+// manifest paths are relative to the directory of the file.
+func (writer *fileChecksumWriter) manifestPath(path string) string {
+	if filepath.IsAbs(writer.manifest) {
+		return writer.manifest
+	}
+	return filepath.Join(filepath.Dir(path), writer.manifest)
+}
+
+// write stores the checksum of the given file. Files are listed relative to
+// the manifest if they are stored below the manifest's directory.
+func (writer *fileChecksumWriter) write(path string, checksum string) {
+	if writer.sidecar {
+		if err := writeFileChecksum(path+fileChecksumExt, os.O_TRUNC, filepath.Base(path), checksum); err != nil {
+			Log.Error.Print("File checksum error: ", err)
+		}
+	}
+
+	if writer.manifest != "" {
+		manifest := writer.manifestPath(path)
+		name, err := filepath.Rel(filepath.Dir(manifest), path)
+		if err != nil || strings.HasPrefix(name, "..") {
+			name, _ = filepath.Abs(path)
+		}
+
+		// Multiple files may be rotated at the same time
+		writer.guard.Lock()
+		defer writer.guard.Unlock()
+
+		if err := writeFileChecksum(manifest, os.O_APPEND, name, checksum); err != nil {
+			Log.Error.Print("File checksum manifest error: ", err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	fileDirectBlockSize  = 4096
+	fileDirectBufferSize = 256 * fileDirectBlockSize
+)
+
+// fileDirectWriter writes data to a file by using direct I/O, i.e. bypassing
+// the page cache. Direct I/O requires block aligned writes so data is staged
+// in an aligned buffer. Full blocks are written using the direct file handle
+// while a trailing, incomplete block is written through the regular handle so
+// that the file always contains all data. This block is written again using
+// direct I/O as soon as it is completed.
+type fileDirectWriter struct {
+	direct  *os.File
+	file    *os.File
+	buffer  []byte
+	pending int
+	offset  int64
+}
+
+// newFileDirectWriter opens the given file a second time using direct I/O.
+// The regular file handle must not be opened in append mode.
+func newFileDirectWriter(file *os.File) (*fileDirectWriter, error) {
+	if fileDirectIOFlag == 0 {
+		return nil, fmt.Errorf("Direct I/O is not supported on this platform")
+	}
+
+	direct, err := os.OpenFile(file.Name(), os.O_WRONLY|fileDirectIOFlag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := file.Stat()
+	if err != nil {
+		direct.Close()
+		return nil, err
+	}
+
+	// Allocate a buffer aligned to the block size
+	rawBuffer := make([]byte, fileDirectBufferSize+fileDirectBlockSize)
+	alignOffset := int(uintptr(unsafe.Pointer(&rawBuffer[0])) & (fileDirectBlockSize - 1))
+	if alignOffset != 0 {
+		alignOffset = fileDirectBlockSize - alignOffset
+	}
+
+	writer := &fileDirectWriter{
+		direct: direct,
+		file:   file,
+		buffer: rawBuffer[alignOffset : alignOffset+fileDirectBufferSize],
+		offset: stats.Size() &^ (fileDirectBlockSize - 1),
+	}
+
+	// Continue an existing, incomplete block
+	writer.pending = int(stats.Size() - writer.offset)
+	if writer.pending > 0 {
+		if _, err := file.ReadAt(writer.buffer[:writer.pending], writer.offset); err != nil && err != io.EOF {
+			direct.Close()
+			return nil, err
+		}
+	}
+
+	return writer, nil
+}
+
+// Write implements the io.Writer interface
+func (writer *fileDirectWriter) Write(data []byte) (int, error) {
+	written, err := writer.WriteBuffers([][]byte{data})
+	return int(written), err
+}
+
+// WriteBuffers implements the core.BuffersWriter interface. The buffers are
+// copied to the aligned buffer so that full blocks are written at once.
+func (writer *fileDirectWriter) WriteBuffers(buffers [][]byte) (int64, error) {
+	written := int64(0)
+	for _, data := range buffers {
+		for len(data) > 0 {
+			copied := copy(writer.buffer[writer.pending:], data)
+			writer.pending += copied
+			data = data[copied:]
+
+			if writer.pending == len(writer.buffer) {
+				if err := writer.writeBlocks(); err != nil {
+					return written, err
+				}
+			}
+			written += int64(copied)
+		}
+	}
+
+	if err := writer.writeBlocks(); err != nil {
+		return written, err
+	}
+
+	// Make the incomplete block visible
+	if writer.pending > 0 {
+		if _, err := writer.file.WriteAt(writer.buffer[:writer.pending], writer.offset); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeBlocks writes all complete blocks of the buffer to the file and moves
+// an incomplete, trailing block to the start of the buffer.
+func (writer *fileDirectWriter) writeBlocks() error {
+	blockBytes := writer.pending &^ (fileDirectBlockSize - 1)
+	if blockBytes == 0 {
+		return nil // ### return, nothing to do ###
+	}
+
+	if _, err := writer.direct.WriteAt(writer.buffer[:blockBytes], writer.offset); err != nil {
+		return err
+	}
+
+	writer.offset += int64(blockBytes)
+	writer.pending = copy(writer.buffer, writer.buffer[blockBytes:writer.pending])
+	return nil
+}
+
+// Sync commits the file to stable storage.
+func (writer *fileDirectWriter) Sync() error {
+	return writer.direct.Sync()
+}
+
+// Close closes the direct I/O file handle. The regular handle is not closed.
+func (writer *fileDirectWriter) Close() error {
+	return writer.direct.Close()
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"os"
+)
+
+// fileEncryptExt is appended to the name of encrypted files.
+const fileEncryptExt = ".enc"
+
+// fileStaticKey is a key provider for keys read from a file or an
+// environment variable.
+type fileStaticKey struct {
+	key   []byte
+	keyID string
+}
+
+// GetKey returns the configured key.
+func (static fileStaticKey) GetKey() ([]byte, string, error) {
+	return static.key, static.keyID, nil
+}
+
+// parseFileEncryptKey accepts a raw, hex or base64 encoded AES key of 16, 24
+// or 32 bytes.
+func parseFileEncryptKey(data []byte) ([]byte, error) {
+	isValid := func(key []byte) bool {
+		return len(key) == 16 || len(key) == 24 || len(key) == 32
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if key, err := hex.DecodeString(string(trimmed)); err == nil && isValid(key) {
+		return key, nil // ### return, hex ###
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil && isValid(key) {
+		return key, nil // ### return, base64 ###
+	}
+	if isValid(data) {
+		return data, nil // ### return, raw ###
+	}
+	return nil, fmt.Errorf("Encryption keys must be 16, 24 or 32 bytes long")
+}
+
+// newFileKeyProvider creates the key provider configured by EncryptKeyFile,
+// EncryptKeyEnv or EncryptKeyProvider. Exactly one of these has to be set.
+func newFileKeyProvider(conf core.PluginConfig) (core.KeyProvider, error) {
+	keyFile := conf.GetString("EncryptKeyFile", "")
+	keyEnv := conf.GetString("EncryptKeyEnv", "")
+	providerType := conf.GetString("EncryptKeyProvider", "")
+	keyID := conf.GetString("EncryptKeyID", "")
+
+	sources := 0
+	for _, source := range []string{keyFile, keyEnv, providerType} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("Encrypt requires exactly one of EncryptKeyFile, EncryptKeyEnv or EncryptKeyProvider")
+	}
+
+	if providerType != "" {
+		plugin, err := core.NewPluginWithType(providerType, conf)
+		if err != nil {
+			return nil, err
+		}
+		provider, isProvider := plugin.(core.KeyProvider)
+		if !isProvider {
+			return nil, fmt.Errorf("%s is not a key provider", providerType)
+		}
+		return provider, nil // ### return, plugin ###
+	}
+
+	var data []byte
+	if keyFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(keyFile); err != nil {
+			return nil, err
+		}
+	} else {
+		if data = []byte(os.Getenv(keyEnv)); len(data) == 0 {
+			return nil, fmt.Errorf("Environment variable %s is not set", keyEnv)
+		}
+	}
+
+	key, err := parseFileEncryptKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default ID is derived from the key so that it can be identified
+	// without storing any part of the key itself.
+	if keyID == "" {
+		digest := sha256.Sum256(key)
+		keyID = hex.EncodeToString(digest[:8])
+	}
+	return fileStaticKey{key, keyID}, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// fileRotateHook notifies external tools after a logfile has been rotated
+// and archived.
+type fileRotateHook struct {
+	command []string
+	url     string
+	headers map[string]string
+	timeout time.Duration
+	retries int
+	delay   time.Duration
+}
+
+// fileRotateEvent describes a rotated file. It is passed to hook commands as
+// environment variables and to webhooks as JSON.
+type fileRotateEvent struct {
+	File    string    `json:"file"`
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Rotated time.Time `json:"rotated"`
+}
+
+// newFileRotateHook reads the RotateHook* settings. If neither a command nor
+// an URL is configured nil is returned.
+func newFileRotateHook(conf core.PluginConfig) (*fileRotateHook, error) {
+	hook := &fileRotateHook{
+		command: conf.GetStringArray("RotateHookCommand", []string{}),
+		url:     conf.GetString("RotateHookURL", ""),
+		headers: conf.GetStringMap("RotateHookHeaders", map[string]string{}),
+		timeout: time.Duration(conf.GetInt("RotateHookTimeoutSec", 30)) * time.Second,
+		retries: conf.GetInt("RotateHookRetries", 3),
+		delay:   time.Duration(conf.GetInt("RotateHookRetryDelayMs", 1000)) * time.Millisecond,
+	}
+
+	if len(hook.command) == 0 && hook.url == "" {
+		return nil, nil // ### return, no hook ###
+	}
+
+	if hook.url != "" {
+		hookURL, err := url.Parse(hook.url)
+		if err != nil {
+			return nil, err
+		}
+		if hookURL.Scheme != "http" && hookURL.Scheme != "https" {
+			return nil, fmt.Errorf("RotateHookURL must be an http or https URL")
+		}
+	}
+	return hook, nil
+}
+
+// run notifies the command and the webhook about the rotated file.
+// Failed calls are retried with a doubling delay.
+func (hook *fileRotateHook) run(event fileRotateEvent) {
+	if len(hook.command) > 0 {
+		hook.retry("command", func() error { return hook.exec(event) })
+	}
+	if hook.url != "" {
+		hook.retry("webhook", func() error { return hook.post(event) })
+	}
+}
+
+func (hook *fileRotateHook) retry(name string, call func() error) {
+	delay := hook.delay
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil {
+			return // ### return, success ###
+		}
+		if attempt >= hook.retries {
+			Log.Error.Printf("File rotate %s failed after %d attempts: %s", name, attempt+1, err)
+			return // ### return, giving up ###
+		}
+		Log.Warning.Printf("File rotate %s failed, retrying: %s", name, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (hook *fileRotateHook) exec(event fileRotateEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.command[0], hook.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOLLUM_ROTATED_FILE="+event.File,
+		"GOLLUM_ROTATED_SOURCE="+event.Source,
+		"GOLLUM_ROTATED_SIZE="+strconv.FormatInt(event.Size, 10),
+		"GOLLUM_ROTATED_SHA256="+event.SHA256)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+	return err
+}
+
+func (hook *fileRotateHook) post(event fileRotateEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range hook.headers {
+		request.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: hook.timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", hook.url, response.Status)
+	}
+	return nil
+}
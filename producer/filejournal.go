@@ -0,0 +1,202 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/trivago/gollum/core/log"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileJournalExt        = ".journal"
+	fileJournalMagic      = "GJNL"
+	fileJournalHeaderSize = 20
+)
+
+// fileJournalWriter writes data to a file by staging it in a write-ahead
+// journal first. A journal record contains the offset the data is written
+// to, so a batch that was interrupted by a crash can be written again when
+// the file is opened the next time. The journal is cleared after the data
+// has been committed to stable storage.
+//
+// Record layout (big endian):
+//
+//	4 bytes magic "GJNL"
+//	8 bytes target offset
+//	4 bytes data length
+//	4 bytes CRC32 (IEEE) of the data
+//	n bytes data
+type fileJournalWriter struct {
+	file    *os.File
+	journal *os.File
+	offset  int64
+}
+
+// newFileJournalWriter opens or creates the journal for the given file.
+// The file must not be opened in append mode.
+func newFileJournalWriter(file *os.File) (*fileJournalWriter, error) {
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(file.Name()+fileJournalExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &fileJournalWriter{
+		file:    file,
+		journal: journal,
+		offset:  stats.Size(),
+	}
+	return writer, nil
+}
+
+// Write implements the io.Writer interface
+func (writer *fileJournalWriter) Write(data []byte) (int, error) {
+	written, err := writer.WriteBuffers([][]byte{data})
+	return int(written), err
+}
+
+// WriteBuffers implements the core.BuffersWriter interface. All buffers are
+// staged and committed as one batch.
+func (writer *fileJournalWriter) WriteBuffers(buffers [][]byte) (int64, error) {
+	dataLen := 0
+	for _, buffer := range buffers {
+		dataLen += len(buffer)
+	}
+
+	record := make([]byte, fileJournalHeaderSize, fileJournalHeaderSize+dataLen)
+	for _, buffer := range buffers {
+		record = append(record, buffer...)
+	}
+	data := record[fileJournalHeaderSize:]
+
+	copy(record, fileJournalMagic)
+	binary.BigEndian.PutUint64(record[4:], uint64(writer.offset))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[16:], crc32.ChecksumIEEE(data))
+
+	// Stage the batch
+	if err := writer.journal.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := writer.journal.WriteAt(record, 0); err != nil {
+		return 0, err
+	}
+	if err := writer.journal.Sync(); err != nil {
+		return 0, err
+	}
+
+	// Commit the batch
+	if _, err := writer.file.WriteAt(data, writer.offset); err != nil {
+		return 0, err
+	}
+	if err := writer.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	writer.offset += int64(len(data))
+	if err := writer.journal.Truncate(0); err != nil {
+		return int64(len(data)), err
+	}
+	return int64(len(data)), nil
+}
+
+// Close closes the journal. The journal file is removed if it does not
+// contain an uncommitted batch. The regular file handle is not closed.
+func (writer *fileJournalWriter) Close() error {
+	stats, err := writer.journal.Stat()
+	writer.journal.Close()
+
+	if err == nil && stats.Size() == 0 {
+		return os.Remove(writer.journal.Name())
+	}
+	return err
+}
+
+// recoverFileJournals scans the given directory for journals of files
+// starting with the given prefix and writes all uncommitted batches.
+func recoverFileJournals(dir string, prefix string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // ### return, nothing to recover ###
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, fileJournalExt) {
+			journalPath := filepath.Join(dir, name)
+			if err := recoverFileJournal(journalPath); err != nil {
+				Log.Error.Printf("File journal recovery of %s failed: %s", journalPath, err)
+			} else {
+				os.Remove(journalPath)
+			}
+		}
+	}
+}
+
+// recoverFileJournal writes the batch stored in the given journal to the file
+// it belongs to. Incomplete records are discarded as the file was not
+// modified before the record had been written.
+func recoverFileJournal(journalPath string) error {
+	record, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		return err
+	}
+	if len(record) == 0 {
+		return nil // ### return, no uncommitted batch ###
+	}
+
+	if len(record) < fileJournalHeaderSize || !bytes.Equal(record[:4], []byte(fileJournalMagic)) {
+		Log.Warning.Print("File journal discarded incomplete record in ", journalPath)
+		return nil // ### return, incomplete header ###
+	}
+
+	offset := int64(binary.BigEndian.Uint64(record[4:]))
+	length := int(binary.BigEndian.Uint32(record[12:]))
+	data := record[fileJournalHeaderSize:]
+
+	if len(data) != length || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(record[16:]) {
+		Log.Warning.Print("File journal discarded incomplete record in ", journalPath)
+		return nil // ### return, incomplete data ###
+	}
+
+	filePath := strings.TrimSuffix(journalPath, fileJournalExt)
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Writing the batch again is safe even if it had been committed, as the
+	// same data is written to the same position.
+	if _, err := file.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	Log.Note.Printf("File journal recovered %d bytes in %s", length, filePath)
+	return nil
+}
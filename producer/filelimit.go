@@ -0,0 +1,83 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricFilesOpen          = "FilesOpen"
+	metricFilesClosedByLimit = "FilesClosedByLimit"
+)
+
+// fileDescriptorWarnInterval is the minimum time between two warnings about
+// the file descriptor limit.
+const fileDescriptorWarnInterval = time.Minute
+
+// fileDescriptorBudget counts the file descriptors used by all file producers
+// of this process. The budget is 80% of the file descriptor limit so that
+// sockets and other plugins can still open files when it is used up.
+// Files being archived in the background are not counted.
+type fileDescriptorBudget struct {
+	open     *int64
+	limit    int64
+	lastWarn *int64
+}
+
+var fileDescriptors = newFileDescriptorBudget(fileDescriptorLimit())
+
+func init() {
+	shared.Metric.New(metricFilesOpen)
+	shared.Metric.New(metricFilesClosedByLimit)
+}
+
+func newFileDescriptorBudget(limit int64) fileDescriptorBudget {
+	return fileDescriptorBudget{
+		open:     new(int64),
+		limit:    limit * 4 / 5,
+		lastWarn: new(int64),
+	}
+}
+
+// acquire adds the given number of descriptors to the budget.
+func (budget fileDescriptorBudget) acquire(count int) {
+	shared.Metric.Set(metricFilesOpen, atomic.AddInt64(budget.open, int64(count)))
+}
+
+// release removes the given number of descriptors from the budget.
+func (budget fileDescriptorBudget) release(count int) {
+	shared.Metric.Set(metricFilesOpen, atomic.AddInt64(budget.open, -int64(count)))
+}
+
+// exhausted returns true if no more descriptors should be used. This is
+// always false if the limit of this process is not known.
+func (budget fileDescriptorBudget) exhausted() bool {
+	return budget.limit > 0 && atomic.LoadInt64(budget.open) >= budget.limit
+}
+
+// warn logs a warning about the file descriptor limit at most once per
+// fileDescriptorWarnInterval.
+func (budget fileDescriptorBudget) warn(reason string) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(budget.lastWarn)
+	if now-last < int64(fileDescriptorWarnInterval) || !atomic.CompareAndSwapInt64(budget.lastWarn, last, now) {
+		return // ### return, already warned ###
+	}
+	Log.Warning.Print(reason, " Consider raising the file descriptor limit (ulimit -n) or setting MaxOpenFiles.")
+}
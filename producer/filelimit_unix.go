@@ -0,0 +1,43 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package producer
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// fileDescriptorLimit returns the maximum number of file descriptors this
+// process may open or 0 if there is no such limit. Very large limits are
+// treated as unlimited.
+func fileDescriptorLimit() int64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil || limit.Cur == 0 || limit.Cur > math.MaxInt32 {
+		return 0 // ### return, unknown or no limit ###
+	}
+	return int64(limit.Cur)
+}
+
+// isTooManyOpenFiles returns true if the given error has been caused by
+// reaching the file descriptor limit.
+func isTooManyOpenFiles(err error) bool {
+	if pathErr, isPathErr := err.(*os.PathError); isPathErr {
+		return pathErr.Err == syscall.EMFILE || pathErr.Err == syscall.ENFILE
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+// fileDescriptorLimit returns 0 as there is no per process file descriptor
+// limit on windows.
+func fileDescriptorLimit() int64 {
+	return 0
+}
+
+// isTooManyOpenFiles always returns false on windows.
+func isTooManyOpenFiles(err error) bool {
+	return false
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"os"
+)
+
+// fileLockedWriter writes to a file while holding an exclusive advisory lock
+// so that writes of multiple processes appending to the same file are not
+// interleaved.
+type fileLockedWriter struct {
+	file *os.File
+}
+
+// Write implements the io.Writer interface.
+func (writer fileLockedWriter) Write(data []byte) (int, error) {
+	if err := lockFile(writer.file, true); err != nil {
+		return 0, err // ### return, lock failed ###
+	}
+	defer unlockFile(writer.file)
+	return writer.file.Write(data)
+}
+
+// WriteBuffers implements the core.BuffersWriter interface.
+func (writer fileLockedWriter) WriteBuffers(buffers [][]byte) (int64, error) {
+	if err := lockFile(writer.file, true); err != nil {
+		return 0, err // ### return, lock failed ###
+	}
+	defer unlockFile(writer.file)
+	return shared.WriteFileBuffers(writer.file, buffers)
+}
+
+// lockForArchive locks a rotated file before it is archived. The lock is
+// released when the file is closed. False is returned if the file is being
+// archived by another process or if it has already been archived, i.e. the
+// file has been removed or replaced.
+func lockForArchive(file *os.File) bool {
+	if err := lockFile(file, false); err != nil {
+		Log.Note.Print("Not archiving " + file.Name() + ", file is locked by another process")
+		return false // ### return, locked ###
+	}
+
+	opened, err := file.Stat()
+	if err == nil {
+		var current os.FileInfo
+		if current, err = os.Stat(file.Name()); err == nil && os.SameFile(opened, current) {
+			return true // ### return, locked ###
+		}
+	}
+
+	Log.Note.Print("Not archiving " + file.Name() + ", file has already been archived")
+	return false
+}
@@ -15,40 +15,73 @@
 package producer
 
 import (
-	"compress/gzip"
+	"container/list"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type fileSyncPolicy int
+
+const (
+	fileSyncNever    = fileSyncPolicy(iota)
+	fileSyncInterval = fileSyncPolicy(iota)
+	fileSyncBatch    = fileSyncPolicy(iota)
+)
+
 type fileState struct {
 	file         *os.File
+	direct       *fileDirectWriter
+	journal      *fileJournalWriter
 	batch        *core.MessageBatch
 	bgWriter     *sync.WaitGroup
 	fileCreated  time.Time
 	flushTimeout time.Duration
+	syncPolicy   fileSyncPolicy
+	syncInterval time.Duration
+	lastSync     time.Time
+	unsynced     int32
+	lru          *list.Element
+	lastWrite    time.Time
+	descriptors  int
+	locked       bool
 }
 
 type fileRotateConfig struct {
 	timeout  time.Duration
 	sizeByte int64
-	atHour   int
-	atMinute int
+	at       *shared.CronSchedule
+	location *time.Location
 	enabled  bool
-	compress bool
+	compress core.Compressor
+	encrypt  core.KeyProvider
+	hook     *fileRotateHook
+	checksum *fileChecksumWriter
+	lock     bool
+}
+
+// hasPostRotate returns true if anything has to be done after a file has been
+// rotated and archived.
+func (rotate fileRotateConfig) hasPostRotate() bool {
+	return rotate.hook != nil || rotate.checksum != nil
 }
 
-func newFileState(bufferSizeMax int, timeout time.Duration) *fileState {
+func newFileState(bufferSizeMax int, timeout time.Duration, syncPolicy fileSyncPolicy, syncInterval time.Duration) *fileState {
 	return &fileState{
-		batch:        core.NewMessageBatch(bufferSizeMax, nil),
+		batch:        core.NewVectoredMessageBatch(bufferSizeMax, nil),
 		bgWriter:     new(sync.WaitGroup),
 		flushTimeout: timeout,
+		syncPolicy:   syncPolicy,
+		syncInterval: syncInterval,
+		lastSync:     time.Now(),
 	}
 }
 
@@ -56,50 +89,157 @@ func (state *fileState) flush() {
 	state.writeBatch()
 	state.batch.WaitForFlush(state.flushTimeout)
 	state.bgWriter.Wait()
-	state.file.Close()
+	if file := state.detachFile(); file != nil {
+		file.Close()
+	}
+}
+
+// closeFile writes all buffered messages and closes the current file without
+// waiting for rotated files to be archived.
+func (state *fileState) closeFile() {
+	state.writeBatch()
+	state.batch.WaitForFlush(state.flushTimeout)
+	if file := state.detachFile(); file != nil {
+		file.Close()
+	}
 }
 
-func (state *fileState) compressAndCloseLog(sourceFile *os.File) {
+// detachFile syncs the current file if required by the sync policy, closes
+// the direct I/O handle and returns the regular file handle. The file
+// handle is removed from the state. Callers have to wait for a running batch
+// flush to finish before calling this function.
+func (state *fileState) detachFile() *os.File {
+	file := state.file
+	if file == nil {
+		return nil // ### return, nothing to do ###
+	}
+
+	if state.syncPolicy != fileSyncNever {
+		state.syncFile(file)
+	}
+	if state.direct != nil {
+		state.direct.Close()
+	}
+	if state.journal != nil {
+		if err := state.journal.Close(); err != nil {
+			Log.Error.Print("File journal error:", err)
+		}
+	}
+
+	fileDescriptors.release(state.descriptors)
+	state.descriptors = 0
+	state.file = nil
+	state.direct = nil
+	state.journal = nil
+	return file
+}
+
+func (state *fileState) syncFile(file *os.File) {
+	atomic.StoreInt32(&state.unsynced, 0)
+	state.lastSync = time.Now()
+	if err := file.Sync(); err != nil {
+		Log.Error.Print("File sync error:", err)
+	}
+}
+
+// syncOnInterval syncs the current file if data has been written since the
+// last sync and the sync interval has passed.
+func (state *fileState) syncOnInterval() {
+	if state.syncPolicy != fileSyncInterval || state.file == nil {
+		return // ### return, nothing to do ###
+	}
+	if time.Since(state.lastSync) >= state.syncInterval && atomic.LoadInt32(&state.unsynced) != 0 {
+		state.syncFile(state.file)
+	}
+}
+
+// archiveAndCloseLog compresses and/or encrypts a rotated file. The original
+// file is removed after it has been processed successfully.
+// If FileLock is enabled, files archived by another process are skipped.
+func (state *fileState) archiveAndCloseLog(sourceFile *os.File, rotate fileRotateConfig) {
 	state.bgWriter.Add(1)
 	defer state.bgWriter.Done()
 
+	if rotate.lock && !lockForArchive(sourceFile) {
+		sourceFile.Close()
+		return
+	}
+
 	// Generate file to zip into
 	sourceFileName := sourceFile.Name()
-	sourceDir := filepath.Dir(sourceFileName)
-	sourceExt := filepath.Ext(sourceFileName)
-	sourceBase := filepath.Base(sourceFileName)
-	sourceBase = sourceBase[:len(sourceBase)-len(sourceExt)]
+	targetFileName := sourceFileName
 
-	targetFileName := fmt.Sprintf("%s/%s.gz", sourceDir, sourceBase)
+	if rotate.compress != nil {
+		sourceDir := filepath.Dir(sourceFileName)
+		sourceExt := filepath.Ext(sourceFileName)
+		sourceBase := filepath.Base(sourceFileName)
+		sourceBase = sourceBase[:len(sourceBase)-len(sourceExt)]
+		targetFileName = fmt.Sprintf("%s/%s%s", sourceDir, sourceBase, rotate.compress.Extension())
+	}
+	if rotate.encrypt != nil {
+		targetFileName += fileEncryptExt
+	}
 
 	targetFile, err := os.OpenFile(targetFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		Log.Error.Print("File compress error:", err)
+		Log.Error.Print("File archive error:", err)
 		sourceFile.Close()
 		return
 	}
 
-	// Create zipfile and compress data
-	Log.Note.Print("Compressing " + sourceFileName)
+	// Build the writer chain: compression -> encryption -> file
+	var targetWriter io.Writer = targetFile
+	closers := []io.Closer{}
 
-	sourceFile.Seek(0, 0)
-	targetWriter := gzip.NewWriter(targetFile)
+	if rotate.encrypt != nil {
+		Log.Note.Print("Encrypting " + sourceFileName)
+		var encWriter *shared.EncryptedWriter
+		key, keyID, keyErr := rotate.encrypt.GetKey()
+		if keyErr == nil {
+			encWriter, keyErr = shared.NewEncryptedWriter(targetFile, key, keyID)
+		}
+		if keyErr != nil {
+			Log.Error.Print("File encryption error:", keyErr)
+			sourceFile.Close()
+			targetFile.Close()
+			if err := os.Remove(targetFileName); err != nil {
+				Log.Error.Print("Encrypted file remove failed:", err)
+			}
+			return
+		}
+		targetWriter = encWriter
+		closers = append(closers, encWriter)
+	}
+
+	if rotate.compress != nil {
+		Log.Note.Print("Compressing " + sourceFileName)
+		zipWriter := rotate.compress.NewWriter(targetWriter)
+		targetWriter = zipWriter
+		closers = append(closers, zipWriter)
+	}
 
+	sourceFile.Seek(0, 0)
 	for err == nil {
 		_, err = io.CopyN(targetWriter, sourceFile, 1<<20) // 1 MB chunks
 		runtime.Gosched()                                  // Be async!
 	}
 
-	// Cleanup
+	// Cleanup, writers have to be closed in reverse order to flush
 	sourceFile.Close()
-	targetWriter.Close()
-	targetFile.Close()
+	for i := len(closers) - 1; i >= 0; i-- {
+		if closeErr := closers[i].Close(); closeErr != nil && (err == nil || err == io.EOF) {
+			err = closeErr
+		}
+	}
+	if closeErr := targetFile.Close(); closeErr != nil && (err == nil || err == io.EOF) {
+		err = closeErr
+	}
 
 	if err != nil && err != io.EOF {
-		Log.Warning.Print("Compression failed:", err)
+		Log.Warning.Print("Archiving failed:", err)
 		err = os.Remove(targetFileName)
 		if err != nil {
-			Log.Error.Print("Compressed file remove failed:", err)
+			Log.Error.Print("Archived file remove failed:", err)
 		}
 		return
 	}
@@ -107,7 +247,37 @@ func (state *fileState) compressAndCloseLog(sourceFile *os.File) {
 	// Remove original log
 	err = os.Remove(sourceFileName)
 	if err != nil {
-		Log.Error.Print("Uncompressed file remove failed:", err)
+		Log.Error.Print("Original file remove failed:", err)
+	}
+
+	state.postRotate(targetFileName, sourceFileName, rotate)
+}
+
+// postRotate writes the checksum of a rotated file and runs the rotate hooks.
+// path is the final name of the file, source is the name of the file before it
+// was archived.
+func (state *fileState) postRotate(path string, source string, rotate fileRotateConfig) {
+	if !rotate.hasPostRotate() {
+		return // ### return, nothing to do ###
+	}
+
+	event := fileRotateEvent{
+		File:    path,
+		Source:  source,
+		Rotated: time.Now(),
+	}
+
+	var err error
+	if event.Size, event.SHA256, err = fileChecksum(path); err != nil {
+		Log.Error.Print("File checksum error: ", err)
+		return // ### return, file not readable ###
+	}
+
+	if rotate.checksum != nil {
+		rotate.checksum.write(path, event.SHA256)
+	}
+	if rotate.hook != nil {
+		rotate.hook.run(event)
 	}
 }
 
@@ -116,8 +286,35 @@ func (state *fileState) onWriterError(err error) bool {
 	return false
 }
 
+func (state *fileState) onWriteDone(file *os.File) bool {
+	switch state.syncPolicy {
+	case fileSyncBatch:
+		if err := file.Sync(); err != nil {
+			Log.Error.Print("File sync error:", err)
+		}
+	case fileSyncInterval:
+		atomic.StoreInt32(&state.unsynced, 1)
+	}
+	return true
+}
+
 func (state *fileState) writeBatch() {
-	state.batch.Flush(state.file, nil, state.onWriterError)
+	file := state.file
+	var writer io.Writer = file
+	if state.locked {
+		writer = fileLockedWriter{file}
+	}
+
+	switch {
+	case state.journal != nil:
+		state.batch.Flush(state.journal, nil, state.onWriterError)
+	case state.direct != nil:
+		state.batch.Flush(state.direct, func() bool { return state.onWriteDone(file) }, state.onWriterError)
+	case state.syncPolicy != fileSyncNever:
+		state.batch.Flush(writer, func() bool { return state.onWriteDone(file) }, state.onWriterError)
+	default:
+		state.batch.Flush(writer, nil, state.onWriterError)
+	}
 }
 
 func (state *fileState) needsRotate(rotate fileRotateConfig, forceRotate bool) (bool, error) {
@@ -152,11 +349,9 @@ func (state *fileState) needsRotate(rotate fileRotateConfig, forceRotate bool) (
 	}
 
 	// RotateAt crossed?
-	if rotate.atHour > -1 && rotate.atMinute > -1 {
-		now := time.Now()
-		rotateAt := time.Date(now.Year(), now.Month(), now.Day(), rotate.atHour, rotate.atMinute, 0, 0, now.Location())
-
-		if state.fileCreated.Sub(rotateAt).Minutes() < 0 {
+	if rotate.at != nil {
+		rotateAt := rotate.at.Next(state.fileCreated.In(rotate.location))
+		if !rotateAt.IsZero() && !rotateAt.After(time.Now()) {
 			return true, nil // ### return, too old ###
 		}
 	}
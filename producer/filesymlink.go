@@ -0,0 +1,52 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// updateFileSymlink points the symlink at the given path to the given target.
+// The symlink is created under a temporary name and renamed afterwards so
+// that readers never see a missing or dangling link. If the symlink is located
+// in the same directory tree as the target a relative link is created.
+// Existing files that are not a symlink are never replaced.
+func updateFileSymlink(target, symlink string) error {
+	if info, err := os.Lstat(symlink); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink", symlink)
+	}
+
+	linkTarget, err := filepath.Rel(filepath.Dir(symlink), target)
+	if err != nil {
+		if linkTarget, err = filepath.Abs(target); err != nil {
+			return err // ### return, invalid path ###
+		}
+	}
+
+	tempName := symlink + ".tmp" + strconv.Itoa(os.Getpid())
+	os.Remove(tempName)
+	if err := os.Symlink(linkTarget, tempName); err != nil {
+		return err // ### return, could not create link ###
+	}
+
+	if err := os.Rename(tempName, symlink); err != nil {
+		os.Remove(tempName)
+		return err // ### return, could not replace link ###
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fluentd producer plugin
+// Configuration example
+//
+//   - "producer.Fluentd":
+//     Enable: true
+//     Address: "localhost:24224"
+//     BatchSizeMaxKB: 8192
+//     BatchSizeByte: 8192
+//     BatchMaxCount: 0
+//     BatchTimeoutSec: 5
+//     Payload: "message"
+//     MessageKey: "message"
+//     EventTime: false
+//     Compression: "none"
+//     RequireAckResponse: false
+//     AckTimeoutSec: 30
+//     SharedKey: ""
+//     Username: ""
+//     Password: ""
+//     Hostname: ""
+//     Tag:
+//       "console": "app.console"
+//
+// The Fluentd producer sends messages to Fluentd, Fluent Bit or any other
+// service accepting the Fluentd forward protocol. Messages are collected per
+// tag and sent in batches using the "PackedForward" mode. If the connection
+// fails or an acknowledgement is not received, the batch is sent again when
+// the next batch is flushed.
+//
+// Address defines the server to connect to. This can be any ip address and
+// port like "localhost:24224" or a file like "unix:///var/fluentd.socket".
+// By default this is set to "localhost:24224".
+//
+// BatchSizeMaxKB defines the maximum number of bytes to buffer per tag before
+// messages get dropped. By default this is set to 8192.
+//
+// BatchSizeByte defines the number of bytes to be buffered before a batch is
+// sent. A batch is sent as soon as this threshold is reached.
+// By default this is set to 8192.
+//
+// BatchMaxCount defines the number of entries to be buffered before a batch is
+// sent. Set to 0 to send based on size and time only. By default this is set
+// to 0.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// message arrived before a batch is sent automatically. By default this is
+// set to 5.
+//
+// Payload defines how messages are stored in the Fluentd record. When set to
+// "message" the message is stored as string in the field given by MessageKey.
+// When set to "json" messages containing a JSON object are sent as record
+// while all other messages are treated as in "message" mode.
+// By default this is set to "message".
+//
+// MessageKey defines the record field used to store the message.
+// By default this is set to "message".
+//
+// EventTime can be set to true to send timestamps with nanosecond precision.
+// This requires Fluentd v0.14 or later. By default this is set to false,
+// i.e. timestamps are sent in seconds.
+//
+// Compression can be set to "gzip" to compress batches. By default this is set
+// to "none".
+//
+// RequireAckResponse can be set to true to wait for the server to acknowledge
+// each batch. Batches that are not acknowledged are sent again.
+// By default this is set to false.
+//
+// AckTimeoutSec defines the number of seconds to wait for an acknowledgement.
+// By default this is set to 30.
+//
+// SharedKey enables the handshake required by servers using a security
+// section. By default this is set to "", i.e. no handshake is done.
+//
+// Username and Password define the credentials sent during the handshake if
+// the server requires user authentication. By default both are set to "".
+//
+// Hostname defines the hostname sent during the handshake. When left empty
+// the hostname of the machine is used. By default this is set to "".
+//
+// Tag maps a stream to a specific Fluentd tag. You can define the wildcard
+// stream (*) here, too. When set, all streams that do not have a specific
+// mapping will use this tag. If no tag mappings are set the stream name is
+// used.
+type Fluentd struct {
+	core.ProducerBase
+	connection   net.Conn
+	reader       *shared.MsgpackStreamReader
+	guard        *sync.Mutex
+	batches      map[string]*core.MessageBatch
+	tags         map[core.MessageStreamID]string
+	protocol     string
+	address      string
+	batchSizeMax int
+	batchSize    int
+	batchCount   int
+	batchTimeout time.Duration
+	ackTimeout   time.Duration
+	messageKey   string
+	jsonPayload  bool
+	eventTime    bool
+	compressor   core.Compressor
+	requireAck   bool
+	sharedKey    string
+	username     string
+	password     string
+	hostname     string
+}
+
+// fluentdChunk writes a batch of entries as one PackedForward message.
+type fluentdChunk struct {
+	prod *Fluentd
+	tag  string
+}
+
+func init() {
+	shared.RuntimeType.Register(Fluentd{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Fluentd) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:24224"))
+	if prod.protocol != "unix" {
+		prod.protocol = "tcp"
+	}
+
+	prod.batchSizeMax = conf.GetInt("BatchSizeMaxKB", 8<<10) << 10
+	prod.batchSize = conf.GetInt("BatchSizeByte", 8192)
+	prod.batchCount = conf.GetInt("BatchMaxCount", 0)
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second
+	prod.ackTimeout = time.Duration(conf.GetInt("AckTimeoutSec", 30)) * time.Second
+
+	switch payload := strings.ToLower(conf.GetString("Payload", "message")); payload {
+	case "message":
+	case "json":
+		prod.jsonPayload = true
+	default:
+		return fmt.Errorf("Fluentd: unknown payload type %s", payload)
+	}
+
+	switch compression := strings.ToLower(conf.GetString("Compression", "none")); compression {
+	case "none":
+	case "gzip":
+		prod.compressor, _ = core.NewCompressor(compression)
+	default:
+		return fmt.Errorf("Fluentd: Compression %s is not supported", compression)
+	}
+
+	prod.messageKey = conf.GetString("MessageKey", "message")
+	prod.eventTime = conf.GetBool("EventTime", false)
+	prod.requireAck = conf.GetBool("RequireAckResponse", false)
+	prod.sharedKey = conf.GetString("SharedKey", "")
+	prod.username = conf.GetString("Username", "")
+	prod.password = conf.GetString("Password", "")
+
+	prod.hostname = conf.GetString("Hostname", "")
+	if prod.hostname == "" {
+		prod.hostname, _ = os.Hostname()
+	}
+
+	prod.tags = conf.GetStreamMap("Tag", "")
+	prod.batches = make(map[string]*core.MessageBatch)
+	prod.guard = new(sync.Mutex)
+	return nil
+}
+
+func fluentdRandom(size int) string {
+	data := make([]byte, size)
+	rand.Read(data)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// handshake authenticates this client as described by the forward protocol
+// specification. The server starts the handshake by sending a HELO message.
+func (prod *Fluentd) handshake() error {
+	value, err := prod.reader.ReadValue()
+	if err != nil {
+		return err
+	}
+	helo, isArray := value.([]interface{})
+	if !isArray || len(helo) < 2 || shared.FluentdString(helo[0]) != "HELO" {
+		return fmt.Errorf("Expected HELO")
+	}
+	options, _ := helo[1].(map[string]interface{})
+	nonce := shared.FluentdString(options["nonce"])
+	authSalt := shared.FluentdString(options["auth"])
+
+	salt := fluentdRandom(16)
+	password := ""
+	if authSalt != "" {
+		password = shared.FluentdDigest(authSalt, prod.username, prod.password)
+	}
+
+	ping := shared.NewMsgpackWriter(256)
+	ping.WriteArrayHeader(6)
+	ping.WriteString("PING")
+	ping.WriteString(prod.hostname)
+	ping.WriteString(salt)
+	ping.WriteString(shared.FluentdDigest(salt, prod.hostname, nonce, prod.sharedKey))
+	ping.WriteString(prod.username)
+	ping.WriteString(password)
+	if _, err := prod.connection.Write(ping.Bytes()); err != nil {
+		return err
+	}
+
+	if value, err = prod.reader.ReadValue(); err != nil {
+		return err
+	}
+	pong, isArray := value.([]interface{})
+	if !isArray || len(pong) < 5 || shared.FluentdString(pong[0]) != "PONG" {
+		return fmt.Errorf("Expected PONG")
+	}
+	if success, _ := pong[1].(bool); !success {
+		return fmt.Errorf("Authentication failed: %s", shared.FluentdString(pong[2]))
+	}
+	if shared.FluentdString(pong[4]) != shared.FluentdDigest(salt, shared.FluentdString(pong[3]), nonce, prod.sharedKey) {
+		return fmt.Errorf("Server failed to authenticate")
+	}
+	return nil
+}
+
+// connect opens a new connection if necessary and returns false if no
+// connection is available.
+func (prod *Fluentd) connect() bool {
+	if prod.connection != nil {
+		return true // ### return, already connected ###
+	}
+
+	conn, err := net.DialTimeout(prod.protocol, prod.address, prod.ackTimeout)
+	if err != nil {
+		Log.Error.Print("Fluentd connection error - ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	prod.reader = shared.NewMsgpackStreamReader(conn)
+
+	if prod.sharedKey != "" {
+		conn.SetDeadline(time.Now().Add(prod.ackTimeout))
+		err = prod.handshake()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			Log.Error.Print("Fluentd handshake error - ", err)
+			prod.disconnect()
+			return false // ### return, handshake failed ###
+		}
+	}
+	return true
+}
+
+func (prod *Fluentd) disconnect() {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+		prod.reader = nil
+	}
+}
+
+// waitForAck reads responses until the acknowledgement for the given chunk
+// has been received.
+func (prod *Fluentd) waitForAck(chunkID string) error {
+	prod.connection.SetReadDeadline(time.Now().Add(prod.ackTimeout))
+	defer prod.connection.SetReadDeadline(time.Time{})
+
+	for {
+		value, err := prod.reader.ReadValue()
+		if err != nil {
+			return err
+		}
+		if response, isMap := value.(map[string]interface{}); isMap && shared.FluentdString(response["ack"]) == chunkID {
+			return nil // ### return, acknowledged ###
+		}
+	}
+}
+
+// Write sends the given entries as one PackedForward message and waits for
+// the acknowledgement if required. This implements io.Writer for
+// core.MessageBatch.Flush.
+func (chunk fluentdChunk) Write(entries []byte) (int, error) {
+	prod := chunk.prod
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	if !prod.connect() {
+		return 0, fmt.Errorf("Not connected")
+	}
+
+	optionCount := 0
+	if prod.compressor != nil {
+		optionCount++
+	}
+	chunkID := ""
+	if prod.requireAck {
+		optionCount++
+		chunkID = fluentdRandom(16)
+	}
+
+	payload := entries
+	if prod.compressor != nil {
+		var err error
+		if payload, err = core.Compress(prod.compressor, entries); err != nil {
+			return 0, err
+		}
+	}
+
+	message := shared.NewMsgpackWriter(len(payload) + len(chunk.tag) + 64)
+	message.WriteArrayHeader(3)
+	message.WriteString(chunk.tag)
+	message.WriteBytes(payload)
+	message.WriteMapHeader(optionCount)
+	if prod.compressor != nil {
+		message.WriteString("compressed")
+		message.WriteString("gzip")
+	}
+	if prod.requireAck {
+		message.WriteString("chunk")
+		message.WriteString(chunkID)
+	}
+
+	_, err := prod.connection.Write(message.Bytes())
+	if err == nil && prod.requireAck {
+		err = prod.waitForAck(chunkID)
+	}
+	if err != nil {
+		prod.disconnect()
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// entry encodes a message as [time, record].
+func (prod *Fluentd) entry(msg core.Message, payload []byte) []byte {
+	entry := shared.NewMsgpackWriter(len(payload) + len(prod.messageKey) + 32)
+	entry.WriteArrayHeader(2)
+
+	if prod.eventTime {
+		entry.WriteValue(shared.FluentdEventTime(msg.Timestamp))
+	} else {
+		entry.WriteInt(msg.Timestamp.Unix())
+	}
+
+	if prod.jsonPayload {
+		record := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err == nil {
+			entry.WriteValue(record)
+			return entry.Bytes() // ### return, JSON record ###
+		}
+	}
+
+	entry.WriteMapHeader(1)
+	entry.WriteString(prod.messageKey)
+	entry.WriteString(string(payload))
+	return entry.Bytes()
+}
+
+func (prod *Fluentd) getTag(streamID core.MessageStreamID) string {
+	if tag, exists := prod.tags[streamID]; exists {
+		return tag // ### return, mapped ###
+	}
+	if tag, exists := prod.tags[core.WildcardStreamID]; exists {
+		return tag // ### return, wildcard mapping ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+func (prod *Fluentd) onWriteError(err error) bool {
+	Log.Error.Print("Fluentd error - ", err)
+	return false
+}
+
+func (prod *Fluentd) sendBatch(tag string, batch *core.MessageBatch) {
+	batch.Flush(fluentdChunk{prod, tag}, nil, prod.onWriteError)
+}
+
+func (prod *Fluentd) reachedBatchThreshold(batch *core.MessageBatch) bool {
+	return batch.ReachedSizeThreshold(prod.batchSize) || batch.ReachedCountThreshold(prod.batchCount)
+}
+
+func (prod *Fluentd) sendBatchOnTimeOut() {
+	for tag, batch := range prod.batches {
+		if batch.ReachedTimeThreshold(prod.batchTimeout) || prod.reachedBatchThreshold(batch) {
+			prod.sendBatch(tag, batch)
+		}
+	}
+}
+
+func (prod *Fluentd) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	tag := prod.getTag(streamID)
+
+	batch, exists := prod.batches[tag]
+	if !exists {
+		batch = core.NewMessageBatch(prod.batchSizeMax, nil)
+		prod.batches[tag] = batch
+	}
+
+	entryMsg := msg
+	entryMsg.Data = prod.entry(msg, payload)
+
+	if !batch.Append(entryMsg) {
+		prod.sendBatch(tag, batch)
+		batch.Append(entryMsg)
+	}
+	if prod.reachedBatchThreshold(batch) {
+		prod.sendBatch(tag, batch)
+	}
+}
+
+func (prod *Fluentd) flush() {
+	for tag, batch := range prod.batches {
+		prod.sendBatch(tag, batch)
+		batch.WaitForFlush(5 * time.Second)
+	}
+
+	prod.guard.Lock()
+	prod.disconnect()
+	prod.guard.Unlock()
+	prod.WorkerDone()
+}
+
+// Produce writes to a Fluentd server.
+func (prod *Fluentd) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GELF producer plugin
+// Configuration example
+//
+//   - "producer.GELF":
+//     Enable: true
+//     Address: "udp://localhost:12201"
+//     Compression: "gzip"
+//     ChunkSize: 1420
+//     Hostname: ""
+//     Level: "info"
+//     ReconnectDelayMs: 1000
+//     Fields:
+//       "environment": "production"
+//
+// The GELF producer sends messages to Graylog or any other service accepting
+// the Graylog Extended Log Format. The formatted message is sent as
+// "short_message". Metadata fields named "gelf_<field>" are sent as GELF
+// fields, i.e. "gelf_host", "gelf_level" and "gelf_full_message" override the
+// standard fields while all other fields are sent as additional fields, e.g.
+// "gelf_user" is sent as "_user". Values of additional fields that are valid
+// numbers are sent as numbers. This matches the metadata generated by
+// consumer.GELF. Messages that cannot be sent, e.g. because they are too
+// large, are passed to the RejectStream if set.
+//
+// Address defines the server to connect to. The protocol can be either
+// "udp://" or "tcp://". UDP messages are chunked if necessary, TCP messages
+// are separated by null bytes. By default this is set to
+// "udp://localhost:12201".
+//
+// Compression defines the compression used for UDP messages. This can be set
+// to "gzip", "zlib" or "none". TCP messages are never compressed.
+// By default this is set to "gzip".
+//
+// ChunkSize defines the maximum size of an UDP packet in bytes. Larger
+// messages are split into up to 128 chunks. By default this is set to 1420.
+//
+// Hostname defines the host sent with each message. When left empty the
+// hostname of the machine is used. By default this is set to "".
+//
+// Level defines the syslog severity sent with each message as name (e.g.
+// "err") or number. By default this is set to "info".
+//
+// ReconnectDelayMs defines the number of milliseconds to wait before trying to
+// reconnect after a connection failed. Messages arriving in the meantime are
+// dropped. By default this is set to 1000.
+//
+// Fields defines additional fields sent with each message. Names are sent
+// with a leading underscore. By default no additional fields are sent.
+type GELF struct {
+	core.ProducerBase
+	connection     net.Conn
+	protocol       string
+	address        string
+	compressor     core.Compressor
+	chunkSize      int
+	hostname       string
+	level          int
+	fields         map[string]string
+	reconnectDelay time.Duration
+	lastFailure    time.Time
+}
+
+func init() {
+	shared.RuntimeType.Register(GELF{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *GELF) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "udp://localhost:12201"))
+	switch prod.protocol {
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("GELF: unknown protocol type %s", prod.protocol)
+	}
+
+	compression := strings.ToLower(conf.GetString("Compression", "gzip"))
+	switch compression {
+	case "gzip", "zlib", "none":
+	default:
+		return fmt.Errorf("GELF: Compression %s is not supported", compression)
+	}
+	if prod.protocol == "udp" {
+		prod.compressor, _ = core.NewCompressor(compression)
+	}
+
+	prod.chunkSize = conf.GetInt("ChunkSize", 1420)
+	if prod.chunkSize <= shared.GELFChunkHeaderSize {
+		return fmt.Errorf("GELF: ChunkSize must be larger than %d", shared.GELFChunkHeaderSize)
+	}
+
+	if prod.level, err = parseSyslogLevel(conf.GetString("Level", "info"), syslogSeverities, 7); err != nil {
+		return err
+	}
+
+	prod.hostname = conf.GetString("Hostname", "")
+	if prod.hostname == "" {
+		prod.hostname, _ = os.Hostname()
+	}
+
+	prod.fields = conf.GetStringMap("Fields", map[string]string{})
+	prod.reconnectDelay = time.Duration(conf.GetInt("ReconnectDelayMs", 1000)) * time.Millisecond
+	return nil
+}
+
+// document creates the GELF document for a given message.
+func (prod *GELF) document(msg core.Message, payload []byte) ([]byte, error) {
+	fields := map[string]interface{}{
+		"version":       "1.1",
+		"host":          prod.hostname,
+		"short_message": string(bytes.TrimRight(payload, "\n")),
+		"timestamp":     float64(msg.Timestamp.UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         prod.level,
+	}
+
+	for name, value := range prod.fields {
+		fields["_"+strings.TrimPrefix(name, "_")] = value
+	}
+
+	for key, value := range msg.Metadata {
+		if !strings.HasPrefix(key, shared.GELFMetadataPrefix) {
+			continue // ### continue, no GELF field ###
+		}
+
+		switch name := key[len(shared.GELFMetadataPrefix):]; name {
+		case "host", "full_message":
+			fields[name] = value
+		case "level":
+			if level, err := parseSyslogLevel(value, syslogSeverities, 7); err == nil {
+				fields[name] = level
+			}
+		case "version", "timestamp", "short_message", "id", "":
+			// Generated from the message
+		default:
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				fields["_"+name] = number
+			} else {
+				fields["_"+name] = value
+			}
+		}
+	}
+
+	document, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if prod.compressor == nil {
+		return document, nil // ### return, uncompressed ###
+	}
+	return core.Compress(prod.compressor, document)
+}
+
+func (prod *GELF) connect() bool {
+	if prod.connection != nil {
+		return true // ### return, already connected ###
+	}
+	if time.Since(prod.lastFailure) < prod.reconnectDelay {
+		return false // ### return, wait before reconnecting ###
+	}
+
+	conn, err := net.Dial(prod.protocol, prod.address)
+	if err != nil {
+		Log.Error.Print("GELF connection error - ", err)
+		prod.lastFailure = time.Now()
+		return false
+	}
+
+	prod.connection = conn
+	return true
+}
+
+// packets returns the packets to send for a given GELF document.
+func (prod *GELF) packets(document []byte) ([][]byte, error) {
+	if prod.protocol == "tcp" {
+		return [][]byte{append(document, 0)}, nil // ### return, null delimited ###
+	}
+
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	return shared.GELFChunks(document, prod.chunkSize, binary.BigEndian.Uint64(idBytes))
+}
+
+func (prod *GELF) write(packets [][]byte) error {
+	for _, packet := range packets {
+		if _, err := prod.connection.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (prod *GELF) sendMessage(msg core.Message) {
+	var packets [][]byte
+	payload, _ := prod.ProducerBase.Format(msg)
+	document, err := prod.document(msg, payload)
+	if err == nil {
+		packets, err = prod.packets(document)
+	}
+	if err != nil {
+		Log.Error.Print("GELF format error - ", err)
+		prod.Reject(msg, err.Error())
+		return // ### return, invalid message ###
+	}
+
+	// Try to send the message, reconnect once if the connection was lost
+	for retry := 0; retry < 2; retry++ {
+		if !prod.connect() {
+			break // ### break, not connected ###
+		}
+		if err := prod.write(packets); err != nil {
+			Log.Error.Print("GELF write error - ", err)
+			prod.connection.Close()
+			prod.connection = nil
+			continue // ### continue, reconnect ###
+		}
+		return // ### return, sent ###
+	}
+
+	msg.Drop(prod.GetTimeout())
+}
+
+func (prod *GELF) flush() {
+	if prod.connection != nil {
+		prod.connection.Close()
+	}
+	prod.WorkerDone()
+}
+
+// Produce writes to a GELF server.
+func (prod *GELF) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	prod.AddMainWorker(workers)
+	prod.DefaultControlLoop(prod.sendMessage, nil)
+}
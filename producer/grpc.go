@@ -0,0 +1,408 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// grpcEncodings maps compressors to gRPC message encodings.
+var grpcEncodings = map[string]string{
+	"gzip":   "gzip",
+	"zlib":   "deflate",
+	"snappy": "snappy",
+}
+
+// GRPC producer plugin
+// Configuration example
+//
+//   - "producer.GRPC":
+//     Enable: true
+//     Servers:
+//       - "localhost:5881"
+//     Connections: 2
+//     BatchMaxCount: 512
+//     BatchTimeoutSec: 1
+//     TimeoutMs: 10000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//     AuthToken: ""
+//     Compression: "none"
+//     SendStream: true
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//
+// The GRPC producer forwards batches of messages to another gollum instance
+// running consumer.GRPC or any other server implementing the Ingest service
+// defined in proto/ingest.proto. Each message is sent with its stream name,
+// metadata and timestamp, so a W3C trace context stored in the "traceparent"
+// and "tracestate" metadata is passed on as well. Batches are distributed across all servers in a
+// round robin fashion. If a batch cannot be delivered it is sent to the next
+// server. Batches that could not be delivered after the given number of
+// retries are dropped, i.e. they are sent to the retry stream where they can
+// be written to disk, e.g. by setting the DeadLetterStream of the stream.
+//
+// Servers contains the addresses of all servers to send to.
+// By default this is set to "localhost:5881".
+//
+// Connections defines the number of HTTP/2 connections opened to each server.
+// Batches are sent concurrently over all connections. By default this is set
+// to 2.
+//
+// BatchMaxCount defines the maximum number of messages sent in one batch.
+// By default this is set to 512.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// batch has been sent before a new batch is sent. By default this is set to 1.
+//
+// TimeoutMs defines the number of milliseconds to wait for a batch to be
+// acknowledged. By default this is set to 10000.
+//
+// Retries defines the number of times a batch is sent again to another server
+// if sending failed. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds a server is not used after
+// sending to it failed. If all servers failed the server that failed first is
+// used. By default this is set to 1000.
+//
+// AuthToken defines the token sent via the "authorization" header as in
+// "Bearer <token>". By default this is set to "", i.e. no token is sent.
+//
+// Compression defines the algorithm used to compress batches. Valid values are
+// "none", "gzip", "zlib" (sent as "deflate") and "snappy".
+// By default this is set to "none".
+//
+// SendStream can be set to false to not send the name of the stream with each
+// message. The receiving consumer uses its own streams in this case.
+// By default this is set to true.
+//
+// TLS can be set to true to connect to the servers via TLS. Unencrypted
+// connections use HTTP/2 with prior knowledge (h2c). By default this is set
+// to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server certificate. When
+// left empty the host part of the server address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server certificate. By default this is set to false.
+type GRPC struct {
+	core.ProducerBase
+	servers      []*grpcServer
+	nextServer   *uint32
+	batch        grpcBatch
+	batchMax     int
+	batchTimeout time.Duration
+	lastSend     time.Time
+	queue        chan grpcBatch
+	senders      *sync.WaitGroup
+	retries      int
+	retryDelay   time.Duration
+	token        string
+	compressor   core.Compressor
+	encoding     string
+	sendStream   bool
+}
+
+// grpcBatch stores the messages of a batch. Messages are kept so that they
+// can be dropped if the batch cannot be delivered.
+type grpcBatch struct {
+	messages []core.Message
+	ingest   []shared.IngestMessage
+}
+
+// grpcServer holds the connection pool of a server.
+type grpcServer struct {
+	url      string
+	clients  []*http.Client
+	next     *uint32
+	failedAt *int64
+}
+
+func init() {
+	shared.RuntimeType.Register(GRPC{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *GRPC) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.batchMax = conf.GetInt("BatchMaxCount", 512)
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	prod.token = conf.GetString("AuthToken", "")
+	prod.sendStream = conf.GetBool("SendStream", true)
+
+	compression := conf.GetString("Compression", "none")
+	if prod.compressor, err = core.NewCompressor(compression); err != nil {
+		return err
+	}
+	if prod.compressor != nil {
+		var supported bool
+		if prod.encoding, supported = grpcEncodings[strings.ToLower(compression)]; !supported {
+			return fmt.Errorf("GRPC: compression %s is not supported", compression)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	scheme := "http"
+	protocols := new(http.Protocols)
+	if conf.GetBool("TLS", false) {
+		tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+		scheme = "https"
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	connections := conf.GetInt("Connections", 2)
+	if connections < 1 {
+		connections = 1
+	}
+	timeout := time.Duration(conf.GetInt("TimeoutMs", 10000)) * time.Millisecond
+
+	for _, address := range conf.GetStringArray("Servers", []string{"localhost:5881"}) {
+		server := &grpcServer{
+			url:      fmt.Sprintf("%s://%s%s", scheme, address, shared.IngestPath),
+			next:     new(uint32),
+			failedAt: new(int64),
+		}
+		for i := 0; i < connections; i++ {
+			server.clients = append(server.clients, &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					Protocols:       protocols,
+					TLSClientConfig: tlsConfig,
+				},
+			})
+		}
+		prod.servers = append(prod.servers, server)
+	}
+	if len(prod.servers) == 0 {
+		return fmt.Errorf("GRPC: no servers configured")
+	}
+
+	prod.nextServer = new(uint32)
+	prod.queue = make(chan grpcBatch, len(prod.servers)*connections)
+	prod.senders = new(sync.WaitGroup)
+	return nil
+}
+
+// getServer returns the next server to send to. Servers that failed within
+// the retry delay are skipped unless all servers failed.
+func (prod *GRPC) getServer() *grpcServer {
+	start := atomic.AddUint32(prod.nextServer, 1)
+	oldest := prod.servers[start%uint32(len(prod.servers))]
+
+	for i := 0; i < len(prod.servers); i++ {
+		server := prod.servers[(start+uint32(i))%uint32(len(prod.servers))]
+		failedAt := atomic.LoadInt64(server.failedAt)
+		if time.Since(time.Unix(0, failedAt)) > prod.retryDelay {
+			return server // ### return, server available ###
+		}
+		if failedAt < atomic.LoadInt64(oldest.failedAt) {
+			oldest = server
+		}
+	}
+	return oldest
+}
+
+// call sends an encoded batch to the server and waits for the ack.
+func (server *grpcServer) call(prod *GRPC, body []byte) (shared.IngestAck, error) {
+	ack := shared.IngestAck{}
+	client := server.clients[atomic.AddUint32(server.next, 1)%uint32(len(server.clients))]
+
+	req, err := http.NewRequest("POST", server.url, bytes.NewReader(body))
+	if err != nil {
+		return ack, err
+	}
+	req.Header.Set("Content-Type", shared.GRPCContentType)
+	req.Header.Set("Te", "trailers")
+	if prod.encoding != "" {
+		req.Header.Set("Grpc-Encoding", prod.encoding)
+	}
+	if prod.token != "" {
+		req.Header.Set("Authorization", "Bearer "+prod.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ack, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ack, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+
+	data, _, err := shared.ReadGRPCFrame(resp.Body, 1<<16)
+	switch {
+	case err == nil:
+		if ack, err = shared.DecodeIngestAck(data); err != nil {
+			return ack, err
+		}
+	case err != io.EOF:
+		return ack, err
+	}
+
+	// Trailers are available after the body has been read completely
+	io.Copy(ioutil.Discard, resp.Body)
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		message, _ = url.PathUnescape(message)
+		return ack, fmt.Errorf("gRPC status %s: %s", status, message)
+	}
+	if err == io.EOF {
+		return ack, fmt.Errorf("Missing ack")
+	}
+	return ack, nil
+}
+
+// send delivers a batch to one of the servers. The batch is dropped if all
+// attempts failed.
+func (prod *GRPC) send(batch grpcBatch) {
+	data := shared.EncodeIngestBatch(batch.ingest)
+	compressed := prod.compressor != nil
+	if compressed {
+		var err error
+		if data, err = core.Compress(prod.compressor, data); err != nil {
+			Log.Error.Print("GRPC compression error - ", err)
+			compressed = false
+			data = shared.EncodeIngestBatch(batch.ingest)
+		}
+	}
+
+	body := bytes.Buffer{}
+	shared.WriteGRPCFrame(&body, data, compressed)
+
+	for attempt := 0; attempt <= prod.retries; attempt++ {
+		server := prod.getServer()
+		ack, err := server.call(prod, body.Bytes())
+		if err == nil {
+			if ack.Rejected > 0 {
+				Log.Warning.Printf("GRPC server %s rejected %d messages", server.url, ack.Rejected)
+			}
+			return // ### return, delivered ###
+		}
+
+		Log.Error.Printf("GRPC error sending to %s - %s", server.url, err.Error())
+		atomic.StoreInt64(server.failedAt, time.Now().UnixNano())
+	}
+
+	for _, msg := range batch.messages {
+		msg.Drop(prod.GetTimeout())
+	}
+}
+
+func (prod *GRPC) sendLoop() {
+	defer prod.senders.Done()
+	for batch := range prod.queue {
+		prod.send(batch)
+	}
+}
+
+func (prod *GRPC) sendBatch() {
+	if len(prod.batch.messages) > 0 {
+		prod.queue <- prod.batch
+		prod.batch = grpcBatch{}
+	}
+	prod.lastSend = time.Now()
+}
+
+func (prod *GRPC) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) > prod.batchTimeout {
+		prod.sendBatch()
+	}
+}
+
+func (prod *GRPC) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	ingestMsg := shared.IngestMessage{
+		Data:      payload,
+		Metadata:  msg.Metadata,
+		Timestamp: msg.Timestamp.UnixNano(),
+	}
+	if prod.sendStream {
+		ingestMsg.Stream = core.StreamTypes.GetStreamName(streamID)
+	}
+
+	prod.batch.messages = append(prod.batch.messages, msg)
+	prod.batch.ingest = append(prod.batch.ingest, ingestMsg)
+	if len(prod.batch.messages) >= prod.batchMax {
+		prod.sendBatch()
+	}
+}
+
+func (prod *GRPC) flush() {
+	prod.sendBatch()
+	close(prod.queue)
+	prod.senders.Wait()
+	prod.WorkerDone()
+}
+
+// Produce sends batches of messages to the configured servers.
+func (prod *GRPC) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	for i := 0; i < cap(prod.queue); i++ {
+		prod.senders.Add(1)
+		go prod.sendLoop()
+	}
+
+	prod.lastSend = time.Now()
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
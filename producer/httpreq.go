@@ -17,12 +17,16 @@ package producer
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // HttpReq producer plugin
@@ -31,18 +35,48 @@ import (
 //   - "producer.HttpReq":
 //     Enable:  true
 //     Address: ":80"
+//     Compression: "none"
+//     Retries: 3
+//     RetryDelayMs: 1000
 //
 // The HttpReq producers sends messages that already are valid http request to a
 //  given webserver.
 //
 // Address defines the webserver to send http requests to. Set to ":80", which
 // is equal to "localhost:80" by default.
+//
+// Messages that are not valid http requests or that are answered with a 4xx
+// status code are sent to the RejectStream if set. Requests answered with a
+// status of 429 or 5xx and requests failing because of network errors are
+// sent again. Messages failing after all retries are dropped, i.e. sent to the
+// retry stream.
+//
+// If a message carries a W3C trace context in its "traceparent" and
+// "tracestate" metadata, the corresponding headers are added to requests that
+// do not have a traceparent header already.
+//
+// Compression defines the algorithm used to compress request bodies. The
+// Content-Encoding header is set accordingly. Requests that already have a
+// Content-Encoding are sent as-is. Valid values are "none", "gzip", "zlib"
+// (sent as "deflate"), "snappy", "zstd", "lz4" and any other compressor
+// registered by core.RegisterCompressor. By default this is set to "none".
+//
+// Retries defines the number of times a request is sent again after a
+// network error, a server error or because of rate limits. By default this is
+// set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a request is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
 type HttpReq struct {
 	core.ProducerBase
-	host    string
-	port    string
-	address string
-	listen  *shared.StopListener
+	host       string
+	port       string
+	address    string
+	listen     *shared.StopListener
+	compressor core.Compressor
+	retries    int
+	retryDelay time.Duration
 }
 
 func init() {
@@ -71,7 +105,16 @@ func (prod *HttpReq) Configure(conf core.PluginConfig) error {
 	}
 
 	prod.address = prod.host + ":" + prod.port
-	return nil
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	prod.compressor, err = core.NewCompressor(conf.GetString("Compression", "none"))
+	return err
+}
+
+// isTemporaryStatus returns true if a request or document rejected with the
+// given http status may succeed when being sent again.
+func isTemporaryStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
 }
 
 func (prod *HttpReq) sendReq(msg core.Message) {
@@ -80,6 +123,7 @@ func (prod *HttpReq) sendReq(msg core.Message) {
 	req, err := http.ReadRequest(bufio.NewReader(requestData))
 	if err != nil {
 		Log.Error.Print("HttpReq invalid request", err)
+		prod.Reject(msg, err.Error())
 		return
 	}
 
@@ -87,11 +131,87 @@ func (prod *HttpReq) sendReq(msg core.Message) {
 	req.RequestURI = ""
 	req.URL.Scheme = "http"
 
-	go func() {
-		if _, err := http.DefaultClient.Do(req); err != nil {
+	if req.Header.Get(core.MetadataTraceParent) == "" {
+		core.InjectTraceContext(msg.Metadata, req.Header.Set)
+	}
+
+	if prod.compressor != nil && req.Header.Get("Content-Encoding") == "" {
+		if err := prod.compressBody(req); err != nil {
+			Log.Error.Print("HttpReq compression failed: ", err)
+			prod.Reject(msg, err.Error())
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		Log.Error.Print("HttpReq invalid request body", err)
+		prod.Reject(msg, err.Error())
+		return
+	}
+
+	go prod.send(msg, req, body)
+}
+
+// send sends a request, retrying network errors, server errors and rate
+// limits. Requests rejected by the server are passed to the reject stream.
+func (prod *HttpReq) send(msg core.Message, req *http.Request, body []byte) {
+	delay := prod.retryDelay
+	for attempt := 0; ; attempt++ {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			status := resp.StatusCode
+			reason := ""
+			if status >= 400 {
+				respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+				reason = fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+			}
+			resp.Body.Close()
+
+			switch {
+			case status < 400:
+				return // ### return, sent ###
+			case !isTemporaryStatus(status):
+				Log.Error.Print("HttpReq request rejected - ", reason)
+				prod.Reject(msg, reason)
+				return // ### return, rejected ###
+			}
+			err = fmt.Errorf("%s", reason)
+		}
+
+		if attempt >= prod.retries {
 			Log.Error.Print("HttpReq send failed: ", err)
+			msg.Drop(prod.GetTimeout())
+			return // ### return, retries exhausted ###
 		}
-	}()
+
+		Log.Warning.Printf("HttpReq send failed, retrying in %s - %s", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// compressBody replaces the body of the given request with its compressed
+// version.
+func (prod *HttpReq) compressBody(req *http.Request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil // ### return, nothing to compress ###
+	}
+
+	compressed, err := core.Compress(prod.compressor, body)
+	if err != nil {
+		return err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	req.ContentLength = int64(len(compressed))
+	req.Header.Set("Content-Encoding", prod.compressor.Encoding())
+	return nil
 }
 
 // Produce writes to stdout or stderr.
@@ -29,10 +29,17 @@ const (
 	partRoundrobin = "roundrobin"
 	partHash       = "hash"
 	compressNone   = "none"
-	compressGZIP   = "zip"
-	compressSnappy = "snappy"
+	compressZip    = "zip"
 )
 
+// kafkaCompression maps the names of registered compressors to the codecs
+// supported by the Kafka client.
+var kafkaCompression = map[string]kafka.CompressionCodec{
+	compressNone: kafka.CompressionNone,
+	"gzip":       kafka.CompressionGZIP,
+	"snappy":     kafka.CompressionSnappy,
+}
+
 // Kafka producer plugin
 // Configuration example
 //
@@ -66,6 +73,9 @@ const (
 //
 // The kafka producer writes messages to a kafka cluster. This producer is
 // backed by the sarama library so most settings relate to that library.
+// The message format used by this version of sarama does not support record
+// headers. To propagate a W3C trace context, add it to the payload, e.g. by
+// using format.Envelope with a prefix of "${meta:traceparent} ".
 //
 // ClientId sets the client id of this producer. By default this is "gollum".
 //
@@ -85,7 +95,10 @@ const (
 // server as not reachable. By default this is set to 3.
 //
 // Compression sets the method of compression to use. Valid values are:
-// "None","Zip" and "Snappy". By default "None" is set.
+// "None", "Gzip" (or "Zip") and "Snappy". The name is resolved by
+// core.NewCompressor but compression is done by the Kafka client, so other
+// registered compressors like "zstd" or "lz4" are rejected.
+// By default "None" is set.
 //
 // MaxOpenRequests defines the number of simultanious connections are allowed.
 // By default this is set to 5.
@@ -180,16 +193,18 @@ func (prod *Kafka) Configure(conf core.PluginConfig) error {
 	prod.config.Producer.Return.Errors = true
 	prod.config.Producer.Return.Successes = false
 
-	switch strings.ToLower(conf.GetString("Compression", compressNone)) {
-	default:
-		fallthrough
-	case compressNone:
-		prod.config.Producer.Compression = kafka.CompressionNone
-	case compressGZIP:
-		prod.config.Producer.Compression = kafka.CompressionGZIP
-	case compressSnappy:
-		prod.config.Producer.Compression = kafka.CompressionSnappy
+	compression := strings.ToLower(conf.GetString("Compression", compressNone))
+	if compression == compressZip {
+		compression = "gzip"
+	}
+	if _, err := core.NewCompressor(compression); err != nil {
+		return err
+	}
+	codec, supported := kafkaCompression[compression]
+	if !supported {
+		return core.NewProducerError("Compression ", compression, " is not supported by the Kafka client")
 	}
+	prod.config.Producer.Compression = codec
 
 	switch strings.ToLower(conf.GetString("Partitioner", partRandom)) {
 	case partRandom:
@@ -0,0 +1,614 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	kinesisContentType     = "application/x-amz-json-1.1"
+	kinesisRecordSizeMax   = 1 << 20
+	kinesisPartitionKeyMax = 256
+	kinesisShardBytesMax   = 1 << 20
+	kinesisShardRecordsMax = 1000
+)
+
+// kinesisAggregationMagic is the prefix of records aggregated in the format
+// of the Kinesis Producer Library.
+var kinesisAggregationMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// Kinesis producer plugin
+// Configuration example
+//
+//   - "producer.Kinesis":
+//     Enable: true
+//     Region: "eu-west-1"
+//     KinesisStream:
+//       "console": "logs"
+//     AccessKeyID: ""
+//     SecretAccessKey: ""
+//     Profile: ""
+//     Endpoint: ""
+//     PartitionKey: "${sequence}"
+//     Aggregate: true
+//     AggregationMaxKB: 50
+//     RateLimitPercent: 100
+//     ShardRefreshSec: 60
+//     BatchMaxCount: 500
+//     BatchSizeMaxKB: 5120
+//     BatchTimeoutSec: 1
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     ThrottleRetries: 10
+//     RetryDelayMs: 1000
+//
+// The Kinesis producer sends messages to Amazon Kinesis Data Streams by using
+// PutRecords requests. Messages sharing the same shard are aggregated into
+// one Kinesis record in the format used by the Kinesis Producer Library, so
+// that consumers using the Kinesis Client Library or the KPL deaggregation
+// modules receive them as single records. Records rejected by Kinesis are
+// sent to the RejectStream if set. Records failing after all retries are
+// dropped, i.e. sent to the retry stream.
+//
+// Region defines the AWS region of the stream. If not set AWS_REGION or
+// AWS_DEFAULT_REGION is used. Credentials are searched like by the SQS
+// producer.
+//
+// KinesisStream maps a stream to a Kinesis stream name. You can define the
+// wildcard stream (*) here, too. The name of the gollum stream is used for
+// streams not mapped. By default this is set to an empty map.
+//
+// Endpoint defines the URL of the Kinesis API. By default this is set to "",
+// i.e. "https://kinesis.<Region>.amazonaws.com" is used.
+//
+// PartitionKey defines the partition key of each message. The placeholders
+// of format.Envelope, i.e. ${hostname}, ${stream}, ${timestamp},
+// ${sequence} and ${meta:key} are replaced by the values of the message.
+// Keys are truncated to 256 characters. Messages with an empty key use their
+// sequence number. By default this is set to "${sequence}".
+//
+// Aggregate can be set to false to send one Kinesis record per message.
+// By default this is set to true.
+//
+// AggregationMaxKB defines the maximum size of an aggregated record in KB.
+// This value is capped at 1024. By default this is set to 50.
+//
+// RateLimitPercent defines the percentage of the write limit of a shard
+// (1 MB and 1000 records per second) used by this producer. Requests are
+// delayed if they would exceed the limit of a shard. Set to 0 to disable
+// rate limiting. By default this is set to 100.
+//
+// ShardRefreshSec defines the number of seconds after which the list of
+// shards of a stream is requested again. Shards are used to aggregate
+// messages and to apply the rate limit. By default this is set to 60.
+//
+// BatchMaxCount defines the maximum number of records sent in one request.
+// Up to 500 records are accepted per request. By default this is set to 500.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB. Up to 5 MB are
+// accepted per request. By default this is set to 5120.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 1.
+//
+// Workers defines the number of requests sent concurrently. All requests for
+// the same stream are sent by the same worker. By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times failed records are sent again after a
+// network error or a server error. By default this is set to 3.
+//
+// ThrottleRetries defines the number of times records are sent again after
+// exceeding the provisioned throughput of a shard. Throttling does not count
+// against Retries. By default this is set to 10.
+//
+// RetryDelayMs defines the number of milliseconds to wait before records are
+// sent again. The delay is doubled for each retry. Delays after throttling are
+// capped at 10 seconds. By default this is set to 1000.
+type Kinesis struct {
+	core.ProducerBase
+	client         *http.Client
+	credentials    *shared.AWSCredentials
+	region         string
+	endpoint       string
+	stream         map[core.MessageStreamID]string
+	partitionKey   core.MessageTemplate
+	aggregate      bool
+	aggregationMax int
+	rateLimit      float64
+	shardRefresh   time.Duration
+	shards         map[string]*kinesisShardMap
+	limiters       map[string]*kinesisShardLimiter
+	aggregators    map[string]*kinesisAggregator
+	guard          *sync.Mutex
+	batcher        *awsBatcher
+}
+
+type kinesisShard struct {
+	id    string
+	start *big.Int
+	end   *big.Int
+}
+
+// kinesisShardMap contains the open shards of a stream sorted by hash key.
+type kinesisShardMap struct {
+	shards  []kinesisShard
+	updated time.Time
+}
+
+// kinesisShardLimiter is a token bucket for the write limit of a shard.
+type kinesisShardLimiter struct {
+	bytes   float64
+	records float64
+	last    time.Time
+}
+
+// kinesisAggregator collects the messages of one shard in the format of the
+// Kinesis Producer Library.
+type kinesisAggregator struct {
+	keys     []string
+	keyIndex map[string]uint64
+	records  shared.ProtobufWriter
+	messages []core.Message
+	data     []byte
+	size     int
+}
+
+type kinesisRecord struct {
+	Data         string `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+}
+
+func init() {
+	shared.RuntimeType.Register(Kinesis{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Kinesis) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if prod.credentials, prod.region, err = configureAWS("Kinesis", conf); err != nil {
+		return err
+	}
+
+	prod.endpoint = strings.TrimRight(conf.GetString("Endpoint", ""), "/")
+	if prod.endpoint == "" {
+		prod.endpoint = fmt.Sprintf("https://kinesis.%s.amazonaws.com", prod.region)
+	}
+
+	prod.stream = conf.GetStreamMap("KinesisStream", "")
+	prod.partitionKey = core.NewMessageTemplate(conf.GetString("PartitionKey", "${sequence}"), time.RFC3339)
+	prod.aggregate = conf.GetBool("Aggregate", true)
+	prod.aggregationMax = conf.GetInt("AggregationMaxKB", 50) << 10
+	prod.rateLimit = float64(conf.GetInt("RateLimitPercent", 100)) / 100
+	prod.shardRefresh = time.Duration(conf.GetInt("ShardRefreshSec", 60)) * time.Second
+	prod.shards = make(map[string]*kinesisShardMap)
+	prod.limiters = make(map[string]*kinesisShardLimiter)
+	prod.aggregators = make(map[string]*kinesisAggregator)
+	prod.guard = new(sync.Mutex)
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+	prod.batcher = newAWSBatcher("Kinesis", conf, 500, 5120, prod.GetTimeout())
+
+	if prod.aggregationMax <= 0 || prod.aggregationMax > kinesisRecordSizeMax {
+		prod.aggregationMax = kinesisRecordSizeMax
+	}
+	return nil
+}
+
+func (prod *Kinesis) getStream(streamID core.MessageStreamID) string {
+	if stream, streamMapped := prod.stream[streamID]; streamMapped {
+		return stream // ### return, mapped stream ###
+	}
+	if stream, streamMapped := prod.stream[core.WildcardStreamID]; streamMapped {
+		return stream // ### return, wildcard stream ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+func (prod *Kinesis) post(action string, request interface{}, response interface{}) error {
+	return prod.credentials.PostJSON(context.Background(), prod.client, prod.endpoint, "kinesis", prod.region, "Kinesis_20131202."+action, kinesisContentType, request, response)
+}
+
+// getPartitionKey returns the partition key of a message. Keys are truncated
+// to the maximum number of characters accepted by Kinesis.
+func (prod *Kinesis) getPartitionKey(msg core.Message, streamID core.MessageStreamID) string {
+	key := prod.partitionKey.String(msg, streamID)
+	if key == "" {
+		return strconv.FormatUint(msg.Sequence, 10) // ### return, no key ###
+	}
+
+	if utf8.RuneCountInString(key) > kinesisPartitionKeyMax {
+		runes := []rune(key)
+		key = string(runes[:kinesisPartitionKeyMax])
+	}
+	return key
+}
+
+// listShards requests the open shards of a stream.
+func (prod *Kinesis) listShards(stream string) (*kinesisShardMap, error) {
+	shardMap := &kinesisShardMap{updated: time.Now()}
+	request := map[string]interface{}{
+		"StreamName":  stream,
+		"ShardFilter": map[string]string{"Type": "AT_LATEST"},
+	}
+
+	for {
+		result := struct {
+			Shards []struct {
+				ShardID      string `json:"ShardId"`
+				HashKeyRange struct {
+					StartingHashKey string `json:"StartingHashKey"`
+					EndingHashKey   string `json:"EndingHashKey"`
+				} `json:"HashKeyRange"`
+			} `json:"Shards"`
+			NextToken string `json:"NextToken"`
+		}{}
+
+		if err := prod.post("ListShards", request, &result); err != nil {
+			return nil, err
+		}
+
+		for _, shard := range result.Shards {
+			start, startValid := new(big.Int).SetString(shard.HashKeyRange.StartingHashKey, 10)
+			end, endValid := new(big.Int).SetString(shard.HashKeyRange.EndingHashKey, 10)
+			if !startValid || !endValid {
+				return nil, fmt.Errorf("Invalid hash key range for shard %s", shard.ShardID)
+			}
+			shardMap.shards = append(shardMap.shards, kinesisShard{shard.ShardID, start, end})
+		}
+
+		if result.NextToken == "" {
+			break // ### break, all shards listed ###
+		}
+		request = map[string]interface{}{"NextToken": result.NextToken}
+	}
+
+	sort.Slice(shardMap.shards, func(i, j int) bool {
+		return shardMap.shards[i].start.Cmp(shardMap.shards[j].start) < 0
+	})
+	return shardMap, nil
+}
+
+// getShard returns the id of the shard a partition key is written to or an
+// empty string if the shards of the stream are not known. If refresh is set
+// the list of shards is requested again after ShardRefreshSec.
+func (prod *Kinesis) getShard(stream, key string, refresh bool) string {
+	prod.guard.Lock()
+	shardMap, known := prod.shards[stream]
+	prod.guard.Unlock()
+
+	if refresh && (!known || time.Since(shardMap.updated) > prod.shardRefresh) {
+		newShardMap, err := prod.listShards(stream)
+		if err != nil {
+			Log.Warning.Printf("Kinesis could not list shards of %s - %s", stream, err.Error())
+			if !known {
+				shardMap = &kinesisShardMap{}
+			}
+			newShardMap = &kinesisShardMap{shards: shardMap.shards, updated: time.Now()}
+		}
+		shardMap, known = newShardMap, true
+
+		prod.guard.Lock()
+		prod.shards[stream] = shardMap
+		prod.guard.Unlock()
+	}
+
+	if !known {
+		return "" // ### return, shards not known ###
+	}
+	return shardMap.find(key)
+}
+
+// find returns the id of the shard whose hash key range contains the MD5 hash
+// of the given partition key.
+func (shardMap *kinesisShardMap) find(key string) string {
+	hash := md5.Sum([]byte(key))
+	hashKey := new(big.Int).SetBytes(hash[:])
+
+	idx := sort.Search(len(shardMap.shards), func(i int) bool {
+		return shardMap.shards[i].end.Cmp(hashKey) >= 0
+	})
+	if idx < len(shardMap.shards) && shardMap.shards[idx].start.Cmp(hashKey) <= 0 {
+		return shardMap.shards[idx].id
+	}
+	return ""
+}
+
+// take removes the given number of bytes and records from the bucket and
+// returns the time to wait until the shard accepts them.
+func (limiter *kinesisShardLimiter) take(bytes, records int, rate float64, now time.Time) time.Duration {
+	bytesMax := kinesisShardBytesMax * rate
+	recordsMax := kinesisShardRecordsMax * rate
+
+	if limiter.last.IsZero() {
+		limiter.bytes, limiter.records = bytesMax, recordsMax
+	} else {
+		elapsed := now.Sub(limiter.last).Seconds()
+		if limiter.bytes += elapsed * bytesMax; limiter.bytes > bytesMax {
+			limiter.bytes = bytesMax
+		}
+		if limiter.records += elapsed * recordsMax; limiter.records > recordsMax {
+			limiter.records = recordsMax
+		}
+	}
+	limiter.last = now
+	limiter.bytes -= float64(bytes)
+	limiter.records -= float64(records)
+
+	wait := 0.0
+	if limiter.bytes < 0 {
+		wait = -limiter.bytes / bytesMax
+	}
+	if limiter.records < 0 && -limiter.records/recordsMax > wait {
+		wait = -limiter.records / recordsMax
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+// throttle waits until all shards written to by a batch accept the records
+// of the batch.
+func (prod *Kinesis) throttle(batch *awsBatch) {
+	if prod.rateLimit <= 0 {
+		return // ### return, no rate limit ###
+	}
+
+	shardBytes := make(map[string]int)
+	shardRecords := make(map[string]int)
+	for _, entry := range batch.entries {
+		if shard := prod.getShard(batch.target, entry.key, false); shard != "" {
+			shardBytes[shard] += entry.size
+			shardRecords[shard]++
+		}
+	}
+
+	now := time.Now()
+	wait := time.Duration(0)
+
+	prod.guard.Lock()
+	for shard, bytes := range shardBytes {
+		key := batch.target + "/" + shard
+		limiter, exists := prod.limiters[key]
+		if !exists {
+			limiter = new(kinesisShardLimiter)
+			prod.limiters[key] = limiter
+		}
+		if shardWait := limiter.take(bytes, shardRecords[shard], prod.rateLimit, now); shardWait > wait {
+			wait = shardWait
+		}
+	}
+	prod.guard.Unlock()
+
+	if wait > 0 {
+		Log.Debug.Printf("Kinesis delaying request to %s by %s", batch.target, wait)
+		time.Sleep(wait)
+	}
+}
+
+func newKinesisAggregator() *kinesisAggregator {
+	return &kinesisAggregator{
+		keyIndex: make(map[string]uint64),
+		records:  shared.NewProtobufWriter(1024),
+		size:     len(kinesisAggregationMagic) + md5.Size,
+	}
+}
+
+func kinesisVarintSize(value int) int {
+	size := 1
+	for ; value >= 0x80; value >>= 7 {
+		size++
+	}
+	return size
+}
+
+// sizeWith returns the size of the aggregated record if the given record
+// would be added.
+func (aggregator *kinesisAggregator) sizeWith(key string, data []byte) int {
+	size := aggregator.size
+	keyIdx, known := aggregator.keyIndex[key]
+	if !known {
+		keyIdx = uint64(len(aggregator.keys))
+		size += 1 + kinesisVarintSize(len(key)) + len(key)
+	}
+	recordSize := 1 + kinesisVarintSize(int(keyIdx)) + 1 + kinesisVarintSize(len(data)) + len(data)
+	size += 1 + kinesisVarintSize(recordSize) + recordSize
+
+	// The partition key of the aggregated record counts against the limit, too
+	if len(aggregator.keys) > 0 {
+		return size + len(aggregator.keys[0])
+	}
+	return size + len(key)
+}
+
+func (aggregator *kinesisAggregator) add(msg core.Message, key string, data []byte) {
+	size := aggregator.sizeWith(key, data)
+	keyIdx, known := aggregator.keyIndex[key]
+	if !known {
+		keyIdx = uint64(len(aggregator.keys))
+		aggregator.keyIndex[key] = keyIdx
+		aggregator.keys = append(aggregator.keys, key)
+	}
+	aggregator.size = size - len(aggregator.keys[0])
+
+	record := shared.NewProtobufWriter(len(data) + 16)
+	record.WriteVarintField(1, keyIdx)
+	record.WriteBytesField(3, data)
+	aggregator.records.WriteBytesField(3, record.Bytes())
+
+	aggregator.messages = append(aggregator.messages, msg)
+	aggregator.data = data
+}
+
+// entry returns the aggregated record. Single messages are not aggregated.
+func (aggregator *kinesisAggregator) entry() awsEntry {
+	if len(aggregator.messages) == 1 {
+		return awsEntry{
+			messages: aggregator.messages,
+			data:     string(aggregator.data),
+			key:      aggregator.keys[0],
+			size:     len(aggregator.data) + len(aggregator.keys[0]),
+		}
+	}
+
+	keyTable := shared.NewProtobufWriter(aggregator.size - aggregator.records.Len())
+	for _, key := range aggregator.keys {
+		keyTable.WriteStringField(1, key)
+	}
+
+	data := make([]byte, 0, aggregator.size)
+	data = append(data, kinesisAggregationMagic...)
+	data = append(data, keyTable.Bytes()...)
+	data = append(data, aggregator.records.Bytes()...)
+	checksum := md5.Sum(data[len(kinesisAggregationMagic):])
+	data = append(data, checksum[:]...)
+
+	return awsEntry{
+		messages: aggregator.messages,
+		data:     string(data),
+		key:      aggregator.keys[0],
+		size:     len(data) + len(aggregator.keys[0]),
+	}
+}
+
+func (prod *Kinesis) flushAggregator(aggregatorKey, stream string) {
+	if aggregator, exists := prod.aggregators[aggregatorKey]; exists {
+		delete(prod.aggregators, aggregatorKey)
+		prod.batcher.add(&prod.ProducerBase, stream, aggregator.entry())
+	}
+}
+
+func (prod *Kinesis) flushAllAggregators() {
+	for aggregatorKey := range prod.aggregators {
+		prod.flushAggregator(aggregatorKey, aggregatorKey[:strings.LastIndex(aggregatorKey, "/")])
+	}
+}
+
+func (prod *Kinesis) sendBatch(batch *awsBatch) ([]awsEntry, error) {
+	prod.throttle(batch)
+
+	records := make([]kinesisRecord, len(batch.entries))
+	for i, entry := range batch.entries {
+		records[i] = kinesisRecord{
+			Data:         base64.StdEncoding.EncodeToString([]byte(entry.data)),
+			PartitionKey: entry.key,
+		}
+	}
+
+	result := struct {
+		FailedRecordCount int `json:"FailedRecordCount"`
+		Records           []struct {
+			ErrorCode    string `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"Records"`
+	}{}
+
+	request := map[string]interface{}{"StreamName": batch.target, "Records": records}
+	if err := prod.post("PutRecords", request, &result); err != nil {
+		return awsRequestFailed(&prod.ProducerBase, "Kinesis", batch, err)
+	}
+	if result.FailedRecordCount == 0 {
+		return nil, nil // ### return, done ###
+	}
+
+	retry := []awsEntry{}
+	var retryErr error = errAWSThrottled
+	for idx, record := range result.Records {
+		if record.ErrorCode == "" || idx >= len(batch.entries) {
+			continue // ### continue, written ###
+		}
+		if !shared.IsAWSThrottlingCode(record.ErrorCode) {
+			retryErr = fmt.Errorf("%s: %s", record.ErrorCode, record.ErrorMessage)
+		}
+		retry = awsFailure(&prod.ProducerBase, "Kinesis", batch.entries[idx], true, record.ErrorCode, record.ErrorMessage, retry)
+	}
+	return retry, retryErr
+}
+
+func (prod *Kinesis) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	stream := prod.getStream(streamID)
+	key := prod.getPartitionKey(msg, streamID)
+
+	if len(payload)+len(key) > kinesisRecordSizeMax {
+		reason := fmt.Sprintf("message size of %d bytes exceeds the limit of %d bytes", len(payload)+len(key), kinesisRecordSizeMax)
+		Log.Error.Print("Kinesis format error - ", reason)
+		prod.Reject(msg, reason)
+		return // ### return, message too large ###
+	}
+
+	shard := prod.getShard(stream, key, prod.aggregate || prod.rateLimit > 0)
+	if !prod.aggregate {
+		prod.batcher.add(&prod.ProducerBase, stream, awsEntry{
+			messages: []core.Message{msg},
+			data:     string(payload),
+			key:      key,
+			size:     len(payload) + len(key),
+		})
+		return // ### return, not aggregated ###
+	}
+
+	aggregatorKey := stream + "/" + shard
+	aggregator, exists := prod.aggregators[aggregatorKey]
+	if exists && aggregator.sizeWith(key, payload) > prod.aggregationMax {
+		prod.flushAggregator(aggregatorKey, stream)
+		exists = false
+	}
+	if !exists {
+		aggregator = newKinesisAggregator()
+		prod.aggregators[aggregatorKey] = aggregator
+	}
+	aggregator.add(msg, key, payload)
+}
+
+func (prod *Kinesis) sendOnTimeOut() {
+	if time.Since(prod.batcher.lastSend) > prod.batcher.batchTimeout {
+		prod.flushAllAggregators()
+		prod.batcher.sendAllBatches()
+	}
+}
+
+func (prod *Kinesis) close() {
+	prod.flushAllAggregators()
+	prod.batcher.close()
+	prod.WorkerDone()
+}
+
+// Produce sends aggregated records to Kinesis.
+func (prod *Kinesis) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+	prod.batcher.start(prod.sendBatch)
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batcher.batchTimeout, prod.sendMessage, nil, prod.sendOnTimeOut)
+}
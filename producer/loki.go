@@ -0,0 +1,440 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/snappy/snappy"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Loki producer plugin
+// Configuration example
+//
+//   - "producer.Loki":
+//     Enable: true
+//     URL: "http://localhost:3100"
+//     Encoding: "protobuf"
+//     TenantID: ""
+//     User: ""
+//     Password: ""
+//     StreamLabel: "stream"
+//     Labels:
+//       "level": "level"
+//       "app": "app"
+//     StaticLabels:
+//       "job": "gollum"
+//     MaxLabelValues: 100
+//     OverflowLabelValue: "_other"
+//     BatchMaxCount: 5000
+//     BatchSizeMaxKB: 1024
+//     BatchTimeoutSec: 1
+//     TimeoutMs: 10000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The Loki producer sends messages to Grafana Loki using the push API. Each
+// message is sent as one log line with the time it was received. Messages are
+// grouped into Loki streams by their labels, which are read from metadata
+// fields. Lines of multiple streams are sent in one request. Batches are sent
+// by a single worker so that the lines of a stream keep their order.
+// Requests failing because of network or server errors or because of rate
+// limits (status 429) are sent again. If Loki sends a Retry-After header, the
+// next attempt waits at least as long as requested. Batches failing after all
+// retries are dropped, i.e. sent to the retry stream. Batches rejected by Loki
+// with any other status, e.g. because lines are too old, are sent to the
+// RejectStream if set. Note that Loki may have accepted some lines of such a
+// batch.
+//
+// URL defines the address of Loki. Requests are sent to the path
+// "/loki/api/v1/push" of this URL. By default this is set to
+// "http://localhost:3100".
+//
+// Encoding defines the format of push requests. This can be set to
+// "protobuf" to send snappy compressed protobuf messages or to "json".
+// By default this is set to "protobuf".
+//
+// TenantID defines the tenant sent as X-Scope-OrgID header when Loki runs in
+// multi-tenant mode. By default this is set to "", i.e. no header is sent.
+//
+// User and Password define the credentials sent via basic authentication,
+// e.g. for Grafana Cloud. By default both are set to "", i.e. no credentials
+// are sent.
+//
+// StreamLabel defines the label storing the name of the stream of a message.
+// Set to "" to not send the stream name. By default this is set to "stream".
+//
+// Labels maps label names to metadata fields. Messages without a field do not
+// get the corresponding label. By default no labels are mapped.
+//
+// StaticLabels defines labels added to all messages. By default no labels are
+// added.
+//
+// MaxLabelValues defines the maximum number of different values sent for a
+// label read from Labels. Each combination of labels creates a stream in Loki
+// so a label with many values, e.g. a user id, slows down Loki. Values
+// exceeding this limit are replaced by OverflowLabelValue and a warning is
+// written once per label. Set to 0 to disable the limit. By default this is
+// set to 100.
+//
+// OverflowLabelValue defines the value sent instead of values exceeding
+// MaxLabelValues. By default this is set to "_other".
+//
+// BatchMaxCount defines the maximum number of lines sent in one request.
+// By default this is set to 5000.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB before it is
+// compressed. By default this is set to 1024.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 1.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 10000.
+//
+// Retries defines the number of times a request is sent again after a network
+// error, a server error or because of rate limits. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a request is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
+type Loki struct {
+	core.ProducerBase
+	client         *http.Client
+	pushURL        string
+	useJSON        bool
+	tenantID       string
+	user           string
+	password       string
+	streamLabel    string
+	labels         map[string]string
+	staticLabels   map[string]string
+	maxLabelValues int
+	overflowValue  string
+	labelValues    map[string]map[string]struct{}
+	batch          *lokiBatch
+	batchMax       int
+	batchSizeMax   int
+	batchTimeout   time.Duration
+	lastSend       time.Time
+	queue          chan *lokiBatch
+	sender         *sync.WaitGroup
+	retries        int
+	retryDelay     time.Duration
+}
+
+type lokiBatch struct {
+	streams  map[string]*shared.LokiStream
+	messages []core.Message
+	size     int
+}
+
+// lokiRejectError is returned if Loki rejected a request so that it must not
+// be sent again.
+type lokiRejectError struct {
+	reason string
+}
+
+func (err lokiRejectError) Error() string {
+	return err.reason
+}
+
+func init() {
+	shared.RuntimeType.Register(Loki{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Loki) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.pushURL = strings.TrimRight(conf.GetString("URL", "http://localhost:3100"), "/") + "/loki/api/v1/push"
+	switch encoding := strings.ToLower(conf.GetString("Encoding", "protobuf")); encoding {
+	case "protobuf":
+		prod.useJSON = false
+	case "json":
+		prod.useJSON = true
+	default:
+		return fmt.Errorf("Loki: Encoding must be \"protobuf\" or \"json\"")
+	}
+
+	prod.tenantID = conf.GetString("TenantID", "")
+	prod.user = conf.GetString("User", "")
+	prod.password = conf.GetString("Password", "")
+
+	prod.streamLabel = conf.GetString("StreamLabel", "stream")
+	prod.labels = conf.GetStringMap("Labels", map[string]string{})
+	prod.staticLabels = conf.GetStringMap("StaticLabels", map[string]string{})
+	if prod.streamLabel != "" && !shared.LokiLabelName.MatchString(prod.streamLabel) {
+		return fmt.Errorf("Loki: Invalid label name \"%s\"", prod.streamLabel)
+	}
+	for _, labels := range []map[string]string{prod.labels, prod.staticLabels} {
+		for name := range labels {
+			if !shared.LokiLabelName.MatchString(name) {
+				return fmt.Errorf("Loki: Invalid label name \"%s\"", name)
+			}
+		}
+	}
+
+	prod.maxLabelValues = conf.GetInt("MaxLabelValues", 100)
+	prod.overflowValue = conf.GetString("OverflowLabelValue", "_other")
+	prod.labelValues = make(map[string]map[string]struct{})
+
+	prod.batchMax = conf.GetInt("BatchMaxCount", 5000)
+	prod.batchSizeMax = conf.GetInt("BatchSizeMaxKB", 1024) << 10
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 10000)) * time.Millisecond}
+
+	prod.queue = make(chan *lokiBatch, 1)
+	prod.sender = new(sync.WaitGroup)
+	return nil
+}
+
+// labelValue returns the value sent for a label read from metadata. New
+// values are replaced by OverflowLabelValue once MaxLabelValues is reached.
+func (prod *Loki) labelValue(label string, value string) string {
+	if prod.maxLabelValues <= 0 {
+		return value // ### return, no limit ###
+	}
+
+	values, exists := prod.labelValues[label]
+	if !exists {
+		values = make(map[string]struct{})
+		prod.labelValues[label] = values
+	}
+	if _, known := values[value]; known {
+		return value // ### return, known value ###
+	}
+
+	if len(values) >= prod.maxLabelValues {
+		if len(values) == prod.maxLabelValues {
+			values[prod.overflowValue] = struct{}{}
+			Log.Warning.Printf("Loki: More than %d values for label %s, sending \"%s\" instead", prod.maxLabelValues, label, prod.overflowValue)
+		}
+		return prod.overflowValue // ### return, too many values ###
+	}
+
+	values[value] = struct{}{}
+	return value
+}
+
+// messageLabels returns the labels of a message.
+func (prod *Loki) messageLabels(msg core.Message, streamID core.MessageStreamID) map[string]string {
+	labels := make(map[string]string, len(prod.staticLabels)+len(prod.labels)+1)
+	for name, value := range prod.staticLabels {
+		labels[name] = value
+	}
+	if prod.streamLabel != "" {
+		labels[prod.streamLabel] = core.StreamTypes.GetStreamName(streamID)
+	}
+	for name, field := range prod.labels {
+		if value, isSet := msg.Metadata[field]; isSet && value != "" {
+			labels[name] = prod.labelValue(name, value)
+		}
+	}
+	return labels
+}
+
+// encode returns the body and content type of a push request for a batch.
+func (prod *Loki) encode(batch *lokiBatch) ([]byte, string, error) {
+	labelStrings := make([]string, 0, len(batch.streams))
+	for labelString := range batch.streams {
+		labelStrings = append(labelStrings, labelString)
+	}
+	sort.Strings(labelStrings)
+
+	streams := make([]shared.LokiStream, 0, len(labelStrings))
+	for _, labelString := range labelStrings {
+		streams = append(streams, *batch.streams[labelString])
+	}
+
+	if prod.useJSON {
+		body, err := shared.EncodeLokiJSON(streams)
+		return body, "application/json", err
+	}
+	body, err := snappy.Encode(nil, shared.EncodeLokiProtobuf(streams))
+	return body, "application/x-protobuf", err
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header given
+// in seconds or as HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// post sends a push request. If the request should be sent again, the delay
+// requested by Loki is returned along with the error.
+func (prod *Loki) post(body []byte, contentType string) (time.Duration, error) {
+	request, err := http.NewRequest("POST", prod.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if prod.tenantID != "" {
+		request.Header.Set("X-Scope-OrgID", prod.tenantID)
+	}
+	if prod.user != "" || prod.password != "" {
+		request.SetBasicAuth(prod.user, prod.password)
+	}
+
+	response, err := prod.client.Do(request)
+	if err != nil {
+		return 0, err // ### return, request failed ###
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return 0, nil // ### return, sent ###
+	}
+
+	message, _ := ioutil.ReadAll(response.Body)
+	reason := fmt.Sprintf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return parseRetryAfter(response.Header.Get("Retry-After")), fmt.Errorf("%s", reason)
+	}
+	return 0, lokiRejectError{reason}
+}
+
+// push sends a batch to Loki, retrying failed requests.
+func (prod *Loki) push(batch *lokiBatch) {
+	body, contentType, err := prod.encode(batch)
+	if err != nil {
+		Log.Error.Print("Loki format error - ", err)
+		for _, msg := range batch.messages {
+			prod.Reject(msg, err.Error())
+		}
+		return // ### return, cannot be encoded ###
+	}
+
+	delay := prod.retryDelay
+	for attempt := 0; attempt <= prod.retries; attempt++ {
+		retryAfter, err := prod.post(body, contentType)
+		if err == nil {
+			return // ### return, sent ###
+		}
+
+		if rejectErr, isRejected := err.(lokiRejectError); isRejected {
+			Log.Error.Printf("Loki rejected %d lines - %s", len(batch.messages), rejectErr.Error())
+			for _, msg := range batch.messages {
+				prod.Reject(msg, rejectErr.Error())
+			}
+			return // ### return, rejected ###
+		}
+
+		Log.Error.Print("Loki push error - ", err)
+		if attempt < prod.retries {
+			wait := delay
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+			time.Sleep(wait)
+			delay *= 2
+		}
+	}
+
+	for _, msg := range batch.messages {
+		msg.Drop(prod.GetTimeout())
+	}
+}
+
+func (prod *Loki) sendLoop() {
+	defer prod.sender.Done()
+	for batch := range prod.queue {
+		prod.push(batch)
+	}
+}
+
+func (prod *Loki) sendBatch() {
+	if prod.batch != nil && len(prod.batch.messages) > 0 {
+		prod.queue <- prod.batch
+	}
+	prod.batch = nil
+	prod.lastSend = time.Now()
+}
+
+func (prod *Loki) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) > prod.batchTimeout {
+		prod.sendBatch()
+	}
+}
+
+func (prod *Loki) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	labels := prod.messageLabels(msg, streamID)
+	labelString := shared.LokiLabelString(labels)
+	line := string(bytes.TrimRight(payload, "\n"))
+
+	size := len(line) + 32
+	if prod.batch != nil && prod.batch.size+size+len(labelString) > prod.batchSizeMax {
+		prod.sendBatch()
+	}
+	if prod.batch == nil {
+		prod.batch = &lokiBatch{streams: make(map[string]*shared.LokiStream)}
+	}
+
+	stream, exists := prod.batch.streams[labelString]
+	if !exists {
+		stream = &shared.LokiStream{Labels: labels}
+		prod.batch.streams[labelString] = stream
+		size += len(labelString)
+	}
+
+	stream.Entries = append(stream.Entries, shared.LokiEntry{Timestamp: msg.Timestamp, Line: line})
+	prod.batch.messages = append(prod.batch.messages, msg)
+	prod.batch.size += size
+
+	if len(prod.batch.messages) >= prod.batchMax {
+		prod.sendBatch()
+	}
+}
+
+func (prod *Loki) flush() {
+	prod.sendBatch()
+	close(prod.queue)
+	prod.sender.Wait()
+	prod.WorkerDone()
+}
+
+// Produce sends batches of log lines to Loki.
+func (prod *Loki) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	prod.sender.Add(1)
+	go prod.sendLoop()
+
+	prod.lastSend = time.Now()
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
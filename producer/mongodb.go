@@ -0,0 +1,797 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mongoOpMsg          = 2013
+	mongoMaxMessageSize = 48000000
+	mongoDuplicateKey   = 11000
+)
+
+// MongoDB producer plugin
+// Configuration example
+//
+//   - "producer.MongoDB":
+//     Enable: true
+//     Address: "localhost:27017"
+//     Database: "gollum"
+//     Collection:
+//       "*": "${stream}"
+//     CollectionTimeFormat: "2006-01-02"
+//     Username: ""
+//     Password: ""
+//     AuthDatabase: "admin"
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//     Ordered: true
+//     WriteConcern: ""
+//     WriteConcernJournal: false
+//     WriteConcernTimeoutMs: 0
+//     TimestampField: ""
+//     PayloadField: ""
+//     Deduplicate: true
+//     TTLSec: 0
+//     TTLField: "timestamp"
+//     BatchMaxCount: 1000
+//     BatchSizeMaxKB: 8192
+//     BatchTimeoutSec: 5
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The MongoDB producer inserts JSON messages as documents into MongoDB
+// collections. Messages are sent in batches per collection by using bulk
+// inserts (the insert command) over the OP_MSG wire protocol, which requires
+// MongoDB 3.6 or later. Documents rejected by MongoDB, e.g. because of a
+// duplicate key or a failed schema validation, are sent to the RejectStream if
+// set. Batches failing because of network or server errors are sent again and
+// dropped, i.e. sent to the retry stream, after all retries failed.
+// Replica set discovery is not supported, i.e. Address has to point to the
+// primary or to a mongos router.
+//
+// Address defines the host and port of the MongoDB server.
+// By default this is set to "localhost:27017".
+//
+// Database defines the database containing the collections.
+// By default this is set to "gollum".
+//
+// Collection maps a stream to a collection name. You can define the wildcard
+// stream (*) here, too. Collection names may contain the placeholders
+// ${stream}, ${timestamp}, ${hostname}, ${sequence} and ${meta:<key>}, e.g.
+// "${stream}_${timestamp}" to write into a collection per stream and day.
+// Messages resulting in an invalid collection name are rejected. If no mapping
+// is set for a stream the stream name is used as collection.
+// By default no mappings are set.
+//
+// CollectionTimeFormat defines the format used for the ${timestamp}
+// placeholder of collection names. The format is based on Go's time.Format.
+// By default this is set to "2006-01-02".
+//
+// Username and Password enable SCRAM-SHA-256 authentication if Username is
+// set. SCRAM-SHA-1 is not supported. By default no authentication is used.
+//
+// AuthDatabase defines the database used for authentication.
+// By default this is set to "admin".
+//
+// TLS can be set to true to connect to MongoDB via TLS.
+// By default this is set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server certificate. When
+// left empty the host part of Address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server certificate. By default this is set to false.
+//
+// Ordered defines whether documents of a batch are inserted in order. If set
+// to true MongoDB stops inserting a batch at the first invalid document and
+// the remaining documents are sent again. If set to false MongoDB inserts all
+// valid documents of a batch, which is faster. By default this is set to true.
+//
+// WriteConcern defines the "w" option of the write concern, i.e. a number of
+// nodes or a tag like "majority". When left empty the default write concern
+// of the server is used. By default this is set to "".
+//
+// WriteConcernJournal can be set to true to request acknowledgment that
+// documents have been written to the journal. By default this is set to false.
+//
+// WriteConcernTimeoutMs defines the "wtimeout" option of the write concern. If
+// the write concern is not satisfied within this time the batch is sent again
+// if Deduplicate is set to true. Set to 0 to wait without a time limit.
+// By default this is set to 0.
+//
+// TimestampField defines a field the message timestamp is written to as BSON
+// date. By default this is set to "", i.e. the timestamp is not written.
+//
+// PayloadField defines a field messages that are not a JSON object are written
+// to as string. If not set these messages are rejected.
+// By default this is set to "".
+//
+// Deduplicate can be set to false to not generate document IDs. If set to
+// true, documents without an "_id" field get an ObjectId generated from the
+// message so that documents sent again after an error do not result in
+// duplicates. By default this is set to true.
+//
+// TTLSec enables automatic expiration of documents. If set to a value greater
+// than 0, a TTL index on TTLField is created for each collection before
+// documents are inserted into it for the first time. If TimestampField is not
+// set, the message timestamp is written to TTLField. Existing indexes on
+// TTLField are not modified. By default this is set to 0.
+//
+// TTLField defines the date field used for the TTL index.
+// By default this is set to "timestamp".
+//
+// BatchMaxCount defines the maximum number of documents sent in one request.
+// By default this is set to 1000.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB. MongoDB rejects
+// requests larger than 48 MB. By default this is set to 8192.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 5.
+//
+// Workers defines the number of requests sent concurrently. Each worker uses
+// its own connection. By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times a batch is sent again after a network
+// error or a server error. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a batch is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
+type MongoDB struct {
+	core.ProducerBase
+	address        string
+	database       string
+	authDatabase   string
+	username       string
+	password       string
+	tlsConfig      *tls.Config
+	collection     map[core.MessageStreamID]core.MessageTemplate
+	ordered        bool
+	writeConcern   shared.BSONDocument
+	timestampField string
+	payloadField   string
+	deduplicate    bool
+	ttl            int
+	ttlField       string
+	ttlIndexes     map[string]bool
+	ttlGuard       *sync.Mutex
+	batches        map[string]*mongoBatch
+	batchMax       int
+	batchSizeMax   int
+	batchTimeout   time.Duration
+	lastSend       time.Time
+	queue          chan *mongoBatch
+	senders        *sync.WaitGroup
+	timeout        time.Duration
+	retries        int
+	retryDelay     time.Duration
+}
+
+// mongoBatch stores the BSON documents sent to a collection. Messages are kept
+// so that they can be dropped if their document cannot be inserted.
+type mongoBatch struct {
+	collection string
+	messages   []core.Message
+	documents  [][]byte
+	generated  []bool
+	size       int
+}
+
+// mongoConnection is a connection used by one worker.
+type mongoConnection struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	requestID int32
+}
+
+// mongoError is an error reported by the server.
+type mongoError struct {
+	code    int64
+	message string
+}
+
+func (err mongoError) Error() string {
+	return fmt.Sprintf("%s (code %d)", err.message, err.code)
+}
+
+// Temporary returns false for errors that will not be resolved by sending a
+// request again.
+func (err mongoError) Temporary() bool {
+	switch err.code {
+	case 2, 13, 18, 73, 10334: // BadValue, Unauthorized, AuthenticationFailed, InvalidNamespace, BSONObjectTooLarge
+		return false
+	default:
+		return true
+	}
+}
+
+func init() {
+	shared.RuntimeType.Register(MongoDB{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *MongoDB) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address = conf.GetString("Address", "localhost:27017")
+	prod.database = conf.GetString("Database", "gollum")
+	if prod.database == "" {
+		return fmt.Errorf("MongoDB: Database must be set")
+	}
+
+	prod.username = conf.GetString("Username", "")
+	prod.password = conf.GetString("Password", "")
+	prod.authDatabase = conf.GetString("AuthDatabase", "admin")
+
+	if conf.GetBool("TLS", false) {
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+		if prod.tlsConfig.ServerName == "" {
+			prod.tlsConfig.ServerName, _, _ = net.SplitHostPort(prod.address)
+		}
+	}
+
+	timeFormat := conf.GetString("CollectionTimeFormat", "2006-01-02")
+	prod.collection = make(map[core.MessageStreamID]core.MessageTemplate)
+	for streamID, collection := range conf.GetStreamMap("Collection", "") {
+		prod.collection[streamID] = core.NewMessageTemplate(collection, timeFormat)
+	}
+
+	prod.ordered = conf.GetBool("Ordered", true)
+	if w := conf.GetString("WriteConcern", ""); w != "" {
+		if nodes, err := strconv.Atoi(w); err == nil {
+			prod.writeConcern = append(prod.writeConcern, shared.BSONElement{Key: "w", Value: int32(nodes)})
+		} else {
+			prod.writeConcern = append(prod.writeConcern, shared.BSONElement{Key: "w", Value: w})
+		}
+	}
+	if conf.GetBool("WriteConcernJournal", false) {
+		prod.writeConcern = append(prod.writeConcern, shared.BSONElement{Key: "j", Value: true})
+	}
+	if wtimeout := conf.GetInt("WriteConcernTimeoutMs", 0); wtimeout > 0 {
+		prod.writeConcern = append(prod.writeConcern, shared.BSONElement{Key: "wtimeout", Value: int32(wtimeout)})
+	}
+
+	prod.timestampField = conf.GetString("TimestampField", "")
+	prod.payloadField = conf.GetString("PayloadField", "")
+	prod.deduplicate = conf.GetBool("Deduplicate", true)
+	prod.ttl = conf.GetInt("TTLSec", 0)
+	prod.ttlField = conf.GetString("TTLField", "timestamp")
+	if prod.ttl > 0 && prod.timestampField == "" {
+		prod.timestampField = prod.ttlField
+	}
+
+	prod.batchMax = conf.GetInt("BatchMaxCount", 1000)
+	prod.batchSizeMax = conf.GetInt("BatchSizeMaxKB", 8192) << 10
+	if prod.batchSizeMax > mongoMaxMessageSize-(64<<10) {
+		prod.batchSizeMax = mongoMaxMessageSize - (64 << 10)
+	}
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second
+	prod.timeout = time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+
+	workers := conf.GetInt("Workers", 2)
+	if workers < 1 {
+		workers = 1
+	}
+
+	prod.ttlIndexes = make(map[string]bool)
+	prod.ttlGuard = new(sync.Mutex)
+	prod.batches = make(map[string]*mongoBatch)
+	prod.queue = make(chan *mongoBatch, workers)
+	prod.senders = new(sync.WaitGroup)
+	return nil
+}
+
+func (prod *MongoDB) getCollection(msg core.Message, streamID core.MessageStreamID) (string, error) {
+	tmpl, mapped := prod.collection[streamID]
+	if !mapped {
+		tmpl, mapped = prod.collection[core.WildcardStreamID]
+	}
+
+	collection := core.StreamTypes.GetStreamName(streamID)
+	if mapped {
+		collection = tmpl.String(msg, streamID)
+	}
+
+	if collection == "" || strings.ContainsAny(collection, "$\x00") || strings.HasPrefix(collection, "system.") {
+		return "", fmt.Errorf("Invalid collection name \"%s\"", collection)
+	}
+	return collection, nil
+}
+
+// newDocument converts a message into a BSON document. The second return
+// value is true if the document ID has been generated.
+func (prod *MongoDB) newDocument(msg core.Message, payload []byte) ([]byte, bool, error) {
+	values := shared.NewMarshalMap()
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		if prod.payloadField == "" {
+			return nil, false, err // ### return, not a JSON object ###
+		}
+		values = shared.MarshalMap{prod.payloadField: string(payload)}
+	}
+
+	if prod.timestampField != "" {
+		values[prod.timestampField] = msg.Timestamp
+	}
+
+	generated := false
+	if _, hasID := values["_id"]; !hasID && prod.deduplicate {
+		values["_id"] = mongoObjectID(msg, payload)
+		generated = true
+	}
+
+	document, err := shared.MarshalBSON(values)
+	return document, generated, err
+}
+
+// mongoObjectID generates an ObjectId that is equal for all copies of a
+// message. Like regular ObjectIds it starts with the creation time in seconds.
+func mongoObjectID(msg core.Message, payload []byte) shared.BSONObjectID {
+	id := shared.BSONObjectID{}
+	binary.BigEndian.PutUint32(id[:], uint32(msg.Timestamp.Unix()))
+	copy(id[4:], deduplicationHash(msg, payload))
+	return id
+}
+
+func (prod *MongoDB) connect(mongo *mongoConnection) error {
+	conn, err := net.DialTimeout("tcp", prod.address, prod.timeout)
+	if err != nil {
+		return err // ### return, connection failed ###
+	}
+
+	if prod.tlsConfig != nil {
+		tlsConn := tls.Client(conn, prod.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(prod.timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err // ### return, handshake failed ###
+		}
+		conn = tlsConn
+	}
+
+	mongo.conn = conn
+	mongo.reader = bufio.NewReader(conn)
+
+	if prod.username != "" {
+		if err := prod.authenticate(mongo); err != nil {
+			mongo.close()
+			return err // ### return, authentication failed ###
+		}
+	}
+	return nil
+}
+
+func (mongo *mongoConnection) close() {
+	if mongo.conn != nil {
+		mongo.conn.Close()
+		mongo.conn = nil
+	}
+}
+
+// authenticate performs a SCRAM-SHA-256 exchange.
+func (prod *MongoDB) authenticate(mongo *mongoConnection) error {
+	client := shared.NewScramClient(prod.username, prod.password)
+	reply, err := prod.command(mongo, shared.BSONDocument{
+		{Key: "saslStart", Value: int32(1)},
+		{Key: "mechanism", Value: "SCRAM-SHA-256"},
+		{Key: "payload", Value: []byte(client.FirstMessage())},
+		{Key: "options", Value: shared.BSONDocument{{Key: "skipEmptyExchange", Value: true}}},
+		{Key: "$db", Value: prod.authDatabase},
+	}, nil)
+	if err != nil {
+		return err // ### return, authentication failed ###
+	}
+
+	serverFirst, _ := reply["payload"].([]byte)
+	final, err := client.FinalMessage(string(serverFirst))
+	if err != nil {
+		return err // ### return, invalid server response ###
+	}
+
+	reply, err = prod.command(mongo, shared.BSONDocument{
+		{Key: "saslContinue", Value: int32(1)},
+		{Key: "conversationId", Value: reply["conversationId"]},
+		{Key: "payload", Value: []byte(final)},
+		{Key: "$db", Value: prod.authDatabase},
+	}, nil)
+	if err != nil {
+		return err // ### return, authentication failed ###
+	}
+
+	serverFinal, _ := reply["payload"].([]byte)
+	if err := client.Verify(string(serverFinal)); err != nil {
+		return err // ### return, invalid server signature ###
+	}
+
+	// Servers not supporting skipEmptyExchange require an empty message
+	for done, _ := reply["done"].(bool); !done; done, _ = reply["done"].(bool) {
+		reply, err = prod.command(mongo, shared.BSONDocument{
+			{Key: "saslContinue", Value: int32(1)},
+			{Key: "conversationId", Value: reply["conversationId"]},
+			{Key: "payload", Value: []byte{}},
+			{Key: "$db", Value: prod.authDatabase},
+		}, nil)
+		if err != nil {
+			return err // ### return, authentication failed ###
+		}
+	}
+	return nil
+}
+
+// command sends a command with an optional document sequence and returns the
+// reply. Network errors close the connection. Errors reported by the server
+// are returned as mongoError.
+func (prod *MongoDB) command(mongo *mongoConnection, cmd shared.BSONDocument, documents [][]byte) (map[string]interface{}, error) {
+	if mongo.conn == nil {
+		if err := prod.connect(mongo); err != nil {
+			return nil, err // ### return, not connected ###
+		}
+	}
+
+	body, err := shared.MarshalBSON(cmd)
+	if err != nil {
+		return nil, err // ### return, invalid command ###
+	}
+
+	// Header, flags and body section
+	header := make([]byte, 21, 21+len(body))
+	mongo.requestID++
+	binary.LittleEndian.PutUint32(header[4:], uint32(mongo.requestID))
+	binary.LittleEndian.PutUint32(header[12:], mongoOpMsg)
+	header = append(header, body...)
+	buffers := net.Buffers{header}
+	size := len(header)
+
+	// Document sequence section
+	if len(documents) > 0 {
+		sequence := make([]byte, 5, 15)
+		sequence[0] = 1
+		sequence = append(sequence, "documents\x00"...)
+		sequenceSize := len(sequence) - 1
+		buffers = append(buffers, sequence)
+		for _, document := range documents {
+			buffers = append(buffers, document)
+			sequenceSize += len(document)
+		}
+		binary.LittleEndian.PutUint32(sequence[1:], uint32(sequenceSize))
+		size += sequenceSize + 1
+	}
+	binary.LittleEndian.PutUint32(header, uint32(size))
+
+	mongo.conn.SetDeadline(time.Now().Add(prod.timeout))
+	if _, err := buffers.WriteTo(mongo.conn); err != nil {
+		mongo.close()
+		return nil, err // ### return, write failed ###
+	}
+
+	reply, err := mongo.readReply()
+	if err != nil {
+		mongo.close()
+		return nil, err // ### return, read failed ###
+	}
+
+	if ok, _ := mongoInt(reply["ok"]); ok != 1 {
+		code, _ := mongoInt(reply["code"])
+		message, _ := reply["errmsg"].(string)
+		return reply, mongoError{code, message}
+	}
+	return reply, nil
+}
+
+// readReply reads an OP_MSG reply and returns its body section.
+func (mongo *mongoConnection) readReply() (map[string]interface{}, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(mongo.reader, header); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < 21 || size > mongoMaxMessageSize {
+		return nil, fmt.Errorf("Invalid reply size %d", size)
+	}
+	if opCode := binary.LittleEndian.Uint32(header[12:]); opCode != mongoOpMsg {
+		return nil, fmt.Errorf("Unexpected reply type %d", opCode)
+	}
+
+	message := make([]byte, size-16)
+	if _, err := io.ReadFull(mongo.reader, message); err != nil {
+		return nil, err
+	}
+	if message[4] != 0 {
+		return nil, fmt.Errorf("Unexpected reply section type %d", message[4])
+	}
+	return shared.UnmarshalBSON(message[5:])
+}
+
+func mongoInt(value interface{}) (int64, bool) {
+	switch value.(type) {
+	case int32:
+		return int64(value.(int32)), true
+	case int64:
+		return value.(int64), true
+	case float64:
+		return int64(value.(float64)), true
+	default:
+		return 0, false
+	}
+}
+
+// ensureTTLIndex creates the TTL index for a collection once.
+func (prod *MongoDB) ensureTTLIndex(mongo *mongoConnection, collection string) error {
+	prod.ttlGuard.Lock()
+	created := prod.ttlIndexes[collection]
+	prod.ttlGuard.Unlock()
+	if created {
+		return nil // ### return, index exists ###
+	}
+
+	_, err := prod.command(mongo, shared.BSONDocument{
+		{Key: "createIndexes", Value: collection},
+		{Key: "indexes", Value: []shared.BSONDocument{{
+			{Key: "key", Value: shared.BSONDocument{{Key: prod.ttlField, Value: int32(1)}}},
+			{Key: "name", Value: prod.ttlField + "_ttl"},
+			{Key: "expireAfterSeconds", Value: int32(prod.ttl)},
+		}}},
+		{Key: "$db", Value: prod.database},
+	}, nil)
+
+	if err != nil {
+		if _, isMongoError := err.(mongoError); !isMongoError {
+			return err // ### return, retry ###
+		}
+		// E.g. an index on this field already exists with other options
+		Log.Warning.Printf("MongoDB could not create TTL index on %s - %s", collection, err.Error())
+	}
+
+	prod.ttlGuard.Lock()
+	prod.ttlIndexes[collection] = true
+	prod.ttlGuard.Unlock()
+	return nil
+}
+
+// insert sends a batch to MongoDB and returns the documents that have to be
+// sent again. Documents rejected by MongoDB are dropped.
+func (prod *MongoDB) insert(mongo *mongoConnection, batch *mongoBatch) (*mongoBatch, error) {
+	if prod.ttl > 0 {
+		if err := prod.ensureTTLIndex(mongo, batch.collection); err != nil {
+			return batch, err // ### return, retry ###
+		}
+	}
+
+	cmd := shared.BSONDocument{
+		{Key: "insert", Value: batch.collection},
+		{Key: "ordered", Value: prod.ordered},
+	}
+	if len(prod.writeConcern) > 0 {
+		cmd = append(cmd, shared.BSONElement{Key: "writeConcern", Value: prod.writeConcern})
+	}
+	cmd = append(cmd, shared.BSONElement{Key: "$db", Value: prod.database})
+
+	reply, err := prod.command(mongo, cmd, batch.documents)
+	if err != nil {
+		if mongoErr, isMongoError := err.(mongoError); isMongoError && !mongoErr.Temporary() {
+			Log.Error.Printf("MongoDB rejected %d documents for collection %s - %s", len(batch.documents), batch.collection, mongoErr.Error())
+			for _, msg := range batch.messages {
+				prod.Reject(msg, mongoErr.Error())
+			}
+			return nil, nil // ### return, rejected ###
+		}
+		return batch, err // ### return, retry ###
+	}
+
+	// In ordered mode documents following the first error were not inserted
+	retryFrom := len(batch.documents)
+	writeErrors, _ := reply["writeErrors"].([]interface{})
+	for _, item := range writeErrors {
+		writeError, _ := item.(map[string]interface{})
+		index, _ := mongoInt(writeError["index"])
+		if index < 0 || int(index) >= len(batch.documents) {
+			continue // ### continue, invalid index ###
+		}
+		if prod.ordered && int(index)+1 < retryFrom {
+			retryFrom = int(index) + 1
+		}
+
+		code, _ := mongoInt(writeError["code"])
+		if code == mongoDuplicateKey && batch.generated[index] {
+			continue // ### continue, inserted by a previous attempt ###
+		}
+
+		message, _ := writeError["errmsg"].(string)
+		reason := mongoError{code, message}.Error()
+		Log.Error.Printf("MongoDB rejected document for collection %s - %s", batch.collection, reason)
+		prod.Reject(batch.messages[index], reason)
+	}
+
+	if writeConcernError, hasError := reply["writeConcernError"].(map[string]interface{}); hasError {
+		code, _ := mongoInt(writeConcernError["code"])
+		message, _ := writeConcernError["errmsg"].(string)
+		err := mongoError{code, message}
+		if prod.deduplicate {
+			return batch, err // ### return, retry ###
+		}
+		Log.Warning.Printf("MongoDB write concern error for collection %s - %s", batch.collection, err.Error())
+	}
+
+	if retryFrom == len(batch.documents) {
+		return nil, nil // ### return, done ###
+	}
+	return &mongoBatch{
+		collection: batch.collection,
+		messages:   batch.messages[retryFrom:],
+		documents:  batch.documents[retryFrom:],
+		generated:  batch.generated[retryFrom:],
+	}, nil
+}
+
+// send inserts a batch, retrying documents that could not be inserted.
+func (prod *MongoDB) send(mongo *mongoConnection, batch *mongoBatch) {
+	delay := prod.retryDelay
+	for attempt := 0; attempt <= prod.retries; attempt++ {
+		remain, err := prod.insert(mongo, batch)
+		if remain == nil {
+			return // ### return, done ###
+		}
+
+		if err != nil {
+			Log.Error.Printf("MongoDB error inserting into %s - %s", batch.collection, err.Error())
+		}
+		batch = remain
+
+		if attempt < prod.retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	for _, msg := range batch.messages {
+		msg.Drop(prod.GetTimeout())
+	}
+}
+
+func (prod *MongoDB) sendLoop() {
+	defer prod.senders.Done()
+	mongo := new(mongoConnection)
+	defer mongo.close()
+
+	for batch := range prod.queue {
+		prod.send(mongo, batch)
+	}
+}
+
+func (prod *MongoDB) sendBatch(collection string) {
+	if batch, exists := prod.batches[collection]; exists && len(batch.documents) > 0 {
+		prod.queue <- batch
+		delete(prod.batches, collection)
+	}
+}
+
+func (prod *MongoDB) sendAllBatches() {
+	for collection := range prod.batches {
+		prod.sendBatch(collection)
+	}
+	prod.lastSend = time.Now()
+}
+
+func (prod *MongoDB) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) > prod.batchTimeout {
+		prod.sendAllBatches()
+	}
+}
+
+func (prod *MongoDB) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	collection, err := prod.getCollection(msg, streamID)
+	if err != nil {
+		Log.Error.Print("MongoDB error - ", err)
+		prod.Reject(msg, err.Error())
+		return // ### return, invalid collection ###
+	}
+
+	document, generated, err := prod.newDocument(msg, payload)
+	if err != nil {
+		Log.Error.Print("MongoDB format error - ", err)
+		prod.Reject(msg, err.Error())
+		return // ### return, invalid message ###
+	}
+
+	batch, exists := prod.batches[collection]
+	if exists && batch.size+len(document) > prod.batchSizeMax {
+		prod.sendBatch(collection)
+		exists = false
+	}
+	if !exists {
+		batch = &mongoBatch{collection: collection}
+		prod.batches[collection] = batch
+	}
+
+	batch.messages = append(batch.messages, msg)
+	batch.documents = append(batch.documents, document)
+	batch.generated = append(batch.generated, generated)
+	batch.size += len(document)
+
+	if len(batch.documents) >= prod.batchMax {
+		prod.sendBatch(collection)
+	}
+}
+
+func (prod *MongoDB) flush() {
+	prod.sendAllBatches()
+	close(prod.queue)
+	prod.senders.Wait()
+	prod.WorkerDone()
+}
+
+// Produce sends batches of documents to MongoDB.
+func (prod *MongoDB) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	for i := 0; i < cap(prod.queue); i++ {
+		prod.senders.Add(1)
+		go prod.sendLoop()
+	}
+
+	prod.lastSend = time.Now()
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
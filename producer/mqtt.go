@@ -0,0 +1,449 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT producer plugin
+// Configuration example
+//
+//   - "producer.MQTT":
+//     Enable: true
+//     Address: "localhost:1883"
+//     Version: "3.1.1"
+//     ClientID: ""
+//     Username: ""
+//     Password: ""
+//     CleanSession: true
+//     SessionExpirySec: 0
+//     KeepAliveSec: 30
+//     TimeoutSec: 5
+//     QoS: 0
+//     Retain: false
+//     MaxInflight: 64
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//     Topic:
+//       "console": "devices/${meta:device}/console"
+//
+// The MQTT producer publishes messages to an MQTT 3.1.1 or MQTT 5 broker.
+// Messages sent with a QoS of 1 or 2 are kept until the broker acknowledged
+// them and are sent again after a reconnect. Messages that cannot be sent are
+// dropped, i.e. they are sent to the retry stream.
+//
+// Address defines the broker to connect to. This can be any ip address and
+// port like "localhost:1883". By default this is set to "localhost:1883".
+//
+// Version defines the protocol version to use. Valid values are "3.1.1" and
+// "5". By default this is set to "3.1.1".
+//
+// ClientID defines the client identifier sent to the broker. Session state is
+// bound to this identifier, so it has to be set when using persistent
+// sessions. By default this is set to "", i.e. a random identifier is
+// generated on startup.
+//
+// Username and Password define the credentials sent to the broker.
+// By default both are set to "".
+//
+// CleanSession can be set to false to resume the session stored by the broker
+// for ClientID. By default this is set to true.
+//
+// SessionExpirySec defines the number of seconds the broker keeps the session
+// after the connection has been closed. This setting is only used by MQTT 5.
+// By default this is set to 0.
+//
+// KeepAliveSec defines the keep alive interval sent to the broker. A ping is
+// sent if no packet has been sent for half of this interval.
+// By default this is set to 30.
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established and for the acknowledgement of messages. By default this is
+// set to 5.
+//
+// QoS defines the quality of service level used for publishing. Valid values
+// are 0 (at most once), 1 (at least once) and 2 (exactly once).
+// By default this is set to 0.
+//
+// Retain can be set to true to send all messages with the retain flag set.
+// By default this is set to false.
+//
+// MaxInflight defines the maximum number of messages sent with a QoS of 1 or
+// 2 that have not been acknowledged yet. By default this is set to 64.
+//
+// TLS can be set to true to connect to the broker via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// broker's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// broker. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the broker's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// broker's certificate. By default this is set to false.
+//
+// Topic maps a stream to a topic template. Templates support the placeholders
+// ${stream}, ${hostname}, ${timestamp}, ${sequence} and ${meta:<key>}. You can
+// define the wildcard stream (*) here, too. When set, all streams that do not
+// have a specific mapping will use this topic. If no topic mappings are set
+// the stream name is used. Messages resulting in an empty topic or a topic
+// containing the wildcards "+" or "#" are rejected.
+type MQTT struct {
+	core.ProducerBase
+	client    *shared.MQTTClient
+	guard     *sync.Mutex
+	inflight  map[uint16]*mqttInflight
+	slots     chan struct{}
+	nextID    uint16
+	topics    map[core.MessageStreamID]core.MessageTemplate
+	options   shared.MQTTConnectOptions
+	address   string
+	protocol  string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	qos       byte
+	retain    bool
+}
+
+// mqttInflight stores a message that has not been acknowledged yet. Released
+// is set after a QoS 2 message has been received by the broker.
+type mqttInflight struct {
+	msg      core.Message
+	publish  shared.MQTTMessage
+	released bool
+}
+
+func init() {
+	shared.RuntimeType.Register(MQTT{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *MQTT) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.options.Version, err = shared.ParseMQTTVersion(conf.GetString("Version", "3.1.1"))
+	if err != nil {
+		return err
+	}
+
+	prod.options.ClientID = conf.GetString("ClientID", "")
+	if prod.options.ClientID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		prod.options.ClientID = "gollum-" + hex.EncodeToString(id)
+	}
+
+	prod.options.Username = conf.GetString("Username", "")
+	prod.options.Password = conf.GetString("Password", "")
+	prod.options.CleanStart = conf.GetBool("CleanSession", true)
+	prod.options.SessionExpirySec = uint32(conf.GetInt("SessionExpirySec", 0))
+	prod.options.KeepAlive = time.Duration(conf.GetInt("KeepAliveSec", 30)) * time.Second
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:1883"))
+	prod.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	prod.retain = conf.GetBool("Retain", false)
+
+	qos := conf.GetInt("QoS", 0)
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("MQTT: QoS %d is not supported", qos)
+	}
+	prod.qos = byte(qos)
+
+	maxInflight := conf.GetInt("MaxInflight", 64)
+	if maxInflight < 1 || maxInflight > 65535 {
+		return fmt.Errorf("MQTT: MaxInflight has to be between 1 and 65535")
+	}
+	prod.slots = make(chan struct{}, maxInflight)
+
+	if conf.GetBool("TLS", false) {
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	prod.topics = make(map[core.MessageStreamID]core.MessageTemplate)
+	for streamID, topic := range conf.GetStreamMap("Topic", "") {
+		prod.topics[streamID] = core.NewMessageTemplate(topic, time.RFC3339)
+	}
+
+	prod.inflight = make(map[uint16]*mqttInflight)
+	prod.guard = new(sync.Mutex)
+	return nil
+}
+
+func (prod *MQTT) getTopic(msg core.Message, streamID core.MessageStreamID) string {
+	if topic, exists := prod.topics[streamID]; exists {
+		return topic.String(msg, streamID) // ### return, mapped ###
+	}
+	if topic, exists := prod.topics[core.WildcardStreamID]; exists {
+		return topic.String(msg, streamID) // ### return, wildcard mapping ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// connect opens a new connection if necessary and sends all messages that
+// have not been acknowledged yet. Returns false if no connection is
+// available. The guard has to be locked when calling this function.
+func (prod *MQTT) connect() bool {
+	if prod.client != nil {
+		return true // ### return, already connected ###
+	}
+
+	client, err := shared.DialMQTT(prod.protocol, prod.address, prod.tlsConfig, prod.timeout, prod.options)
+	if err != nil {
+		Log.Error.Print("MQTT connection error - ", err)
+		return false // ### return, connection failed ###
+	}
+	prod.client = client
+	go prod.readAcks(client)
+
+	// Messages are sent again in the order they were sent first
+	ids := make([]int, 0, len(prod.inflight))
+	for id := range prod.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		entry := prod.inflight[uint16(id)]
+		if entry.released {
+			err = client.Write(shared.EncodeMQTTAck(shared.MQTTPubRel, entry.publish.PacketID))
+		} else {
+			entry.publish.Dup = true
+			err = client.Write(shared.EncodeMQTTPublish(client.Version(), entry.publish))
+		}
+		if err != nil {
+			Log.Error.Print("MQTT write error - ", err)
+			prod.disconnect(client)
+			return false // ### return, connection lost ###
+		}
+	}
+	return true
+}
+
+// disconnect closes the given connection if it is still in use. The guard has
+// to be locked when calling this function.
+func (prod *MQTT) disconnect(client *shared.MQTTClient) {
+	if prod.client == client && client != nil {
+		client.Close()
+		prod.client = nil
+	}
+}
+
+// acknowledge removes a message from the inflight list. Messages refused by
+// an MQTT 5 broker are rejected.
+func (prod *MQTT) acknowledge(packetID uint16, err error) {
+	entry, exists := prod.inflight[packetID]
+	if !exists {
+		return // ### return, unknown packet ###
+	}
+	delete(prod.inflight, packetID)
+	<-prod.slots
+
+	if err != nil {
+		Log.Error.Print("MQTT publish refused - ", err)
+		prod.Reject(entry.msg, err.Error())
+	}
+}
+
+// readAcks handles the packets sent by the broker until the given connection
+// is closed.
+func (prod *MQTT) readAcks(client *shared.MQTTClient) {
+	for {
+		packet, err := client.Read(0)
+		if err != nil {
+			prod.guard.Lock()
+			if prod.client == client {
+				Log.Error.Print("MQTT read error - ", err)
+				prod.disconnect(client)
+			}
+			prod.guard.Unlock()
+			return // ### return, connection closed ###
+		}
+
+		prod.guard.Lock()
+		switch packet.Type {
+		case shared.MQTTPubAck, shared.MQTTPubComp:
+			packetID, err := shared.DecodeMQTTAck(packet)
+			prod.acknowledge(packetID, err)
+
+		case shared.MQTTPubRec:
+			packetID, err := shared.DecodeMQTTAck(packet)
+			if entry, exists := prod.inflight[packetID]; exists && err == nil {
+				entry.released = true
+				client.Write(shared.EncodeMQTTAck(shared.MQTTPubRel, packetID))
+			} else {
+				prod.acknowledge(packetID, err)
+			}
+		}
+		prod.guard.Unlock()
+	}
+}
+
+// acquireSlot waits until less than MaxInflight messages are in flight.
+// Returns false if no slot became available in time.
+func (prod *MQTT) acquireSlot() bool {
+	if prod.qos == 0 {
+		return true // ### return, no acknowledgement required ###
+	}
+
+	select {
+	case prod.slots <- struct{}{}:
+		return true
+	case <-time.After(prod.timeout):
+		return false
+	}
+}
+
+func (prod *MQTT) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+
+	topic := prod.getTopic(msg, streamID)
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		prod.Reject(msg, fmt.Sprintf("Invalid topic \"%s\"", topic))
+		return // ### return, invalid topic ###
+	}
+
+	if !prod.acquireSlot() {
+		// Reconnect so that pending messages are sent again
+		Log.Error.Print("MQTT messages have not been acknowledged in time")
+		prod.guard.Lock()
+		prod.disconnect(prod.client)
+		prod.guard.Unlock()
+		msg.Drop(prod.GetTimeout())
+		return // ### return, broker not available ###
+	}
+
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	publish := shared.MQTTMessage{
+		Topic:   topic,
+		QoS:     prod.qos,
+		Retain:  prod.retain,
+		Payload: payload,
+	}
+
+	// Messages are added after connecting as all pending messages are sent
+	// again by connect.
+	connected := prod.connect()
+	if prod.qos > 0 {
+		for prod.nextID++; prod.nextID == 0 || prod.inflight[prod.nextID] != nil; prod.nextID++ {
+		}
+		publish.PacketID = prod.nextID
+		prod.inflight[publish.PacketID] = &mqttInflight{msg: msg, publish: publish}
+	}
+
+	if !connected {
+		if prod.qos == 0 {
+			msg.Drop(prod.GetTimeout())
+		}
+		return // ### return, sent after reconnect ###
+	}
+
+	if err := prod.client.Write(shared.EncodeMQTTPublish(prod.client.Version(), publish)); err != nil {
+		Log.Error.Print("MQTT write error - ", err)
+		prod.disconnect(prod.client)
+		if prod.qos == 0 {
+			msg.Drop(prod.GetTimeout())
+		}
+	}
+}
+
+// ping keeps the connection alive and reconnects to send pending messages.
+func (prod *MQTT) ping() {
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	if prod.client == nil {
+		if len(prod.inflight) > 0 {
+			prod.connect()
+		}
+		return // ### return, not connected ###
+	}
+
+	if err := prod.client.Ping(prod.options.KeepAlive); err != nil {
+		Log.Error.Print("MQTT write error - ", err)
+		prod.disconnect(prod.client)
+	}
+}
+
+// close waits for pending acknowledgements and disconnects. Messages that
+// have not been acknowledged in time are dropped.
+func (prod *MQTT) close() {
+	defer prod.WorkerDone()
+
+	for start := time.Now(); time.Since(start) < prod.timeout; time.Sleep(10 * time.Millisecond) {
+		prod.guard.Lock()
+		pending := len(prod.inflight)
+		if pending > 0 && prod.client == nil && !prod.connect() {
+			pending = 0
+		}
+		prod.guard.Unlock()
+		if pending == 0 {
+			break // ### break, done ###
+		}
+	}
+
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	prod.disconnect(prod.client)
+	for packetID, entry := range prod.inflight {
+		delete(prod.inflight, packetID)
+		entry.msg.Drop(prod.GetTimeout())
+	}
+}
+
+// Produce writes to an MQTT broker.
+func (prod *MQTT) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	interval := prod.options.KeepAlive / 2
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(interval, prod.sendMessage, nil, prod.ping)
+}
@@ -0,0 +1,395 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPingInterval is the interval at which an idle connection is checked.
+const natsPingInterval = 30 * time.Second
+
+// NATS producer plugin
+// Configuration example
+//
+//   - "producer.NATS":
+//     Enable: true
+//     Address: "localhost:4222"
+//     ClientName: "gollum"
+//     Username: ""
+//     Password: ""
+//     Token: ""
+//     TimeoutSec: 5
+//     JetStream: false
+//     BatchMaxCount: 100
+//     BatchTimeoutSec: 1
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//     Subject:
+//       "console": "logs.${stream}"
+//
+// The NATS producer publishes messages to a NATS server. Messages are
+// published in batches. A batch is done after the server processed all of its
+// messages or, if JetStream is enabled, after JetStream acknowledged that all
+// messages have been stored. Messages that are not acknowledged in time or
+// that are refused by JetStream are dropped, i.e. they are sent to the retry
+// stream. Messages with an invalid subject are sent to the RejectStream if
+// set.
+//
+// Address defines the server to connect to. This can be any ip address and
+// port like "localhost:4222". By default this is set to "localhost:4222".
+//
+// ClientName defines the name of the connection shown by the server.
+// By default this is set to "gollum".
+//
+// Username and Password define the credentials sent to the server.
+// By default both are set to "".
+//
+// Token defines an authentication token sent to the server.
+// By default this is set to "".
+//
+// TimeoutSec defines the number of seconds to wait for a connection to be
+// established and for a batch to be acknowledged. By default this is set
+// to 5.
+//
+// JetStream can be set to true to publish messages to JetStream. Messages
+// are stored by the JetStream stream matching their subject. Messages for
+// subjects not bound to a stream are refused. By default this is set to false.
+//
+// BatchMaxCount defines the maximum number of messages per batch.
+// By default this is set to 100.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the
+// last batch was sent before a new batch is sent. By default this is set
+// to 1.
+//
+// TLS can be set to true to connect to the server via TLS. By default this is
+// set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server's certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server's certificate.
+// When left empty the host part of the address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server's certificate. By default this is set to false.
+//
+// Subject maps a stream to a subject template. Templates support the
+// placeholders ${stream}, ${hostname}, ${timestamp}, ${sequence} and
+// ${meta:<key>}. You can define the wildcard stream (*) here, too. When set,
+// all streams that do not have a specific mapping will use this subject. If
+// no subjects are set the stream name is used.
+type NATS struct {
+	core.ProducerBase
+	client       *shared.NATSClient
+	options      shared.NATSOptions
+	address      string
+	protocol     string
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+	subjects     map[core.MessageStreamID]core.MessageTemplate
+	jetStream    bool
+	inbox        string
+	sequence     uint64
+	batch        []natsEntry
+	batchMax     int
+	batchTimeout time.Duration
+	lastSend     time.Time
+	lastPing     time.Time
+}
+
+// natsEntry is a formatted message waiting to be published.
+type natsEntry struct {
+	msg     core.Message
+	subject string
+	payload []byte
+}
+
+func init() {
+	shared.RuntimeType.Register(NATS{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *NATS) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.options.Name = conf.GetString("ClientName", "gollum")
+	prod.options.Username = conf.GetString("Username", "")
+	prod.options.Password = conf.GetString("Password", "")
+	prod.options.Token = conf.GetString("Token", "")
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "localhost:4222"))
+	prod.timeout = time.Duration(conf.GetInt("TimeoutSec", 5)) * time.Second
+	prod.jetStream = conf.GetBool("JetStream", false)
+	prod.batchMax = conf.GetInt("BatchMaxCount", 100)
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second
+
+	if prod.batchMax < 1 {
+		return fmt.Errorf("NATS: BatchMaxCount has to be at least 1")
+	}
+
+	if conf.GetBool("TLS", false) {
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	}
+
+	prod.subjects = make(map[core.MessageStreamID]core.MessageTemplate)
+	for streamID, subject := range conf.GetStreamMap("Subject", "") {
+		prod.subjects[streamID] = core.NewMessageTemplate(subject, time.RFC3339)
+	}
+
+	prod.batch = make([]natsEntry, 0, prod.batchMax)
+	return nil
+}
+
+func (prod *NATS) getSubject(msg core.Message, streamID core.MessageStreamID) string {
+	if subject, exists := prod.subjects[streamID]; exists {
+		return subject.String(msg, streamID) // ### return, mapped ###
+	}
+	if subject, exists := prod.subjects[core.WildcardStreamID]; exists {
+		return subject.String(msg, streamID) // ### return, wildcard mapping ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// connect opens a new connection if necessary. When publishing to JetStream
+// the inbox receiving acknowledgements is subscribed, too.
+// Returns false if no connection is available.
+func (prod *NATS) connect() bool {
+	if prod.client != nil {
+		return true // ### return, already connected ###
+	}
+
+	client, err := shared.DialNATS(prod.protocol, prod.address, prod.tlsConfig, prod.timeout, prod.options)
+	if err == nil && prod.jetStream {
+		prod.inbox = shared.NewNATSInbox()
+		if err = client.Subscribe(prod.inbox+".*", "", "1"); err != nil {
+			client.Close()
+		}
+	}
+	if err != nil {
+		Log.Error.Print("NATS connection error - ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.client = client
+	prod.lastPing = time.Now()
+	return true
+}
+
+func (prod *NATS) disconnect() {
+	if prod.client != nil {
+		prod.client.Close()
+		prod.client = nil
+	}
+}
+
+// readAcks reads responses of the server until all messages of the current
+// batch have been acknowledged or, if JetStream is disabled, until the server
+// answered the ping sent after the batch. The state of each message is stored
+// in acked with 1 meaning acknowledged and 2 meaning refused. The first
+// message uses the given sequence number as reply subject.
+func (prod *NATS) readAcks(firstSeq uint64, acked []byte, deadline time.Time) error {
+	prod.client.SetReadDeadline(deadline)
+	defer prod.client.SetReadDeadline(time.Time{})
+
+	pending := len(acked)
+	for pending > 0 {
+		msg, err := prod.client.Read()
+		if err != nil {
+			return err
+		}
+
+		if msg.Op == shared.NATSOpPong {
+			if !prod.jetStream {
+				for i := range acked {
+					acked[i] = 1
+				}
+				return nil // ### return, all messages processed ###
+			}
+			continue // ### continue, acks may follow ###
+		}
+
+		if !strings.HasPrefix(msg.Subject, prod.inbox+".") {
+			continue // ### continue, not an ack ###
+		}
+		seq, err := strconv.ParseUint(msg.Subject[len(prod.inbox)+1:], 10, 64)
+		idx := int(seq - firstSeq)
+		if err != nil || seq < firstSeq || idx >= len(acked) || acked[idx] != 0 {
+			continue // ### continue, ack of an earlier batch ###
+		}
+
+		acked[idx] = 1
+		switch {
+		case msg.Status == 503:
+			acked[idx] = 2
+			Log.Warning.Print("NATS JetStream error - no stream matches the subject")
+		case msg.Status != 0:
+			acked[idx] = 2
+			Log.Warning.Printf("NATS JetStream error - %d %s", msg.Status, msg.Description)
+		default:
+			if err := shared.DecodeNATSAPIError(msg.Payload); err != nil {
+				acked[idx] = 2
+				Log.Warning.Print("NATS JetStream error - ", err)
+			}
+		}
+		pending--
+	}
+	return nil
+}
+
+// ping checks an idle connection by sending a ping and waiting for the
+// response. Late acknowledgements of earlier batches are ignored.
+func (prod *NATS) ping() error {
+	prod.lastPing = time.Now()
+	if err := prod.client.Ping(); err != nil {
+		return err
+	}
+
+	prod.client.SetReadDeadline(time.Now().Add(prod.timeout))
+	defer prod.client.SetReadDeadline(time.Time{})
+	for {
+		msg, err := prod.client.Read()
+		if err != nil || msg.Op == shared.NATSOpPong {
+			return err
+		}
+	}
+}
+
+// sendBatch publishes all messages of the current batch and waits for their
+// acknowledgements. If the batch is empty an idle connection is checked by
+// sending a ping.
+func (prod *NATS) sendBatch() {
+	if len(prod.batch) == 0 {
+		if prod.client != nil && time.Since(prod.lastPing) >= natsPingInterval {
+			if err := prod.ping(); err != nil {
+				Log.Error.Print("NATS error - ", err)
+				prod.disconnect()
+			}
+		}
+		return // ### return, nothing to send ###
+	}
+
+	batch := prod.batch
+	prod.batch = make([]natsEntry, 0, prod.batchMax)
+	prod.lastSend = time.Now()
+
+	acked := make([]byte, len(batch))
+	var err error
+
+	if !prod.connect() {
+		err = fmt.Errorf("Not connected")
+	} else {
+		firstSeq := prod.sequence + 1
+		for _, entry := range batch {
+			prod.sequence++
+			reply := ""
+			if prod.jetStream {
+				reply = fmt.Sprintf("%s.%d", prod.inbox, prod.sequence)
+			}
+			if err = prod.client.Publish(entry.subject, reply, entry.payload); err != nil {
+				break // ### break, message too large or connection lost ###
+			}
+		}
+		if err == nil {
+			err = prod.client.Ping()
+		}
+		if err == nil {
+			prod.lastPing = time.Now()
+			err = prod.readAcks(firstSeq, acked, time.Now().Add(prod.timeout))
+		}
+	}
+
+	if err != nil {
+		Log.Error.Print("NATS error - ", err)
+		prod.disconnect()
+	}
+
+	for i, entry := range batch {
+		if acked[i] != 1 {
+			entry.msg.Drop(prod.GetTimeout())
+		}
+	}
+}
+
+func (prod *NATS) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	subject := prod.getSubject(msg, streamID)
+	if !shared.IsValidNATSSubject(subject) {
+		prod.Reject(msg, fmt.Sprintf("Invalid subject \"%s\"", subject))
+		return // ### return, invalid subject ###
+	}
+
+	prod.batch = append(prod.batch, natsEntry{
+		msg:     msg,
+		subject: subject,
+		payload: payload,
+	})
+
+	if len(prod.batch) >= prod.batchMax {
+		prod.sendBatch()
+	}
+}
+
+func (prod *NATS) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) >= prod.batchTimeout {
+		prod.sendBatch()
+	}
+}
+
+func (prod *NATS) close() {
+	defer prod.WorkerDone()
+	prod.sendBatch()
+	prod.disconnect()
+}
+
+// Produce writes to a NATS server.
+func (prod *NATS) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	interval := prod.batchTimeout
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(interval, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
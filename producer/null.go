@@ -16,8 +16,11 @@ package producer
 
 import (
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Null producer plugin
@@ -25,13 +28,49 @@ import (
 //
 //   - "producer.Null":
 //     Enable: true
+//     Statistics: false
+//     StatisticsIntervalSec: 5
+//     MessageDelayMs: 0
+//     BatchSize: 0
+//     BatchDelayMs: 0
 //
-// This producer does nothing and provides only bare-bone configuration (i.e.
-// enabled and streams).
+// This producer discards all messages and provides only bare-bone
+// configuration (i.e. enabled and streams).
 // Use this producer to test consumer performance.
+//
+// Statistics can be set to true to count the messages and bytes received per
+// stream. The totals and the throughput are written to the metrics as
+// "Null:<stream>:Messages", "Null:<stream>:Bytes" and
+// "Null:<stream>:MessagesSec" and are written to the log as note. Messages
+// received by a wildcard producer are counted for the stream they have been
+// sent to if that stream is listed, otherwise they are counted for "*".
+// By default this is set to false.
+//
+// StatisticsIntervalSec defines the number of seconds between two throughput
+// measurements. By default this is set to 5.
+//
+// MessageDelayMs defines the number of milliseconds to wait for each message
+// to simulate a slow endpoint. By default this is set to 0.
+//
+// BatchSize and BatchDelayMs can be set to wait BatchDelayMs milliseconds
+// after every BatchSize messages, e.g. to simulate a slow endpoint accepting
+// batches. By default both are set to 0, i.e. no delay.
 type Null struct {
-	control chan core.PluginControl
-	streams []core.MessageStreamID
+	control    chan core.PluginControl
+	streams    []core.MessageStreamID
+	stats      map[core.MessageStreamID]*nullStreamStats
+	interval   time.Duration
+	delay      time.Duration
+	batchDelay time.Duration
+	batchSize  int64
+	count      *int64
+}
+
+type nullStreamStats struct {
+	name     string
+	messages *int64
+	bytes    *int64
+	reported int64
 }
 
 func init() {
@@ -45,9 +84,62 @@ func (prod *Null) Configure(conf core.PluginConfig) error {
 	for i, stream := range conf.Stream {
 		prod.streams[i] = core.GetStreamID(stream)
 	}
+
+	prod.delay = time.Duration(conf.GetInt("MessageDelayMs", 0)) * time.Millisecond
+	prod.batchDelay = time.Duration(conf.GetInt("BatchDelayMs", 0)) * time.Millisecond
+	prod.batchSize = int64(conf.GetInt("BatchSize", 0))
+	prod.interval = time.Duration(conf.GetInt("StatisticsIntervalSec", 5)) * time.Second
+	if prod.interval <= 0 {
+		prod.interval = time.Second
+	}
+	prod.count = new(int64)
+
+	if conf.GetBool("Statistics", false) {
+		prod.stats = make(map[core.MessageStreamID]*nullStreamStats)
+		for i, streamID := range prod.streams {
+			stats := &nullStreamStats{
+				name:     conf.Stream[i],
+				messages: new(int64),
+				bytes:    new(int64),
+			}
+			for _, metric := range stats.metricNames() {
+				if _, err := shared.Metric.Get(metric); err != nil {
+					shared.Metric.New(metric)
+				}
+			}
+			prod.stats[streamID] = stats
+		}
+	}
 	return nil
 }
 
+// metricNames returns the names of the messages, bytes and throughput
+// metrics of this stream.
+func (stats *nullStreamStats) metricNames() []string {
+	prefix := "Null:" + stats.name
+	return []string{prefix + ":Messages", prefix + ":Bytes", prefix + ":MessagesSec"}
+}
+
+// report updates the metrics and writes the throughput since the last report
+// to the log.
+func (stats *nullStreamStats) report(elapsed time.Duration) {
+	messages := atomic.LoadInt64(stats.messages)
+	bytes := atomic.LoadInt64(stats.bytes)
+	metrics := stats.metricNames()
+
+	delta := messages - stats.reported
+	stats.reported = messages
+	rate := float64(delta) / elapsed.Seconds()
+
+	shared.Metric.Set(metrics[0], messages)
+	shared.Metric.Set(metrics[1], bytes)
+	shared.Metric.SetF(metrics[2], rate)
+
+	if delta > 0 {
+		Log.Note.Printf("Null: %s received %d messages (%.1f msg/sec)", stats.name, delta, rate)
+	}
+}
+
 // Streams returns the streams this producer is listening to.
 func (prod *Null) Streams() []core.MessageStreamID {
 	return prod.streams
@@ -58,16 +150,59 @@ func (prod *Null) Control() chan<- core.PluginControl {
 	return prod.control
 }
 
-// Enqueue simply ignores the message
+// Enqueue discards the message after counting it and waiting for the
+// configured delays.
 func (prod *Null) Enqueue(msg core.Message) {
+	if prod.stats != nil {
+		stats, known := prod.stats[msg.StreamID]
+		if !known {
+			stats = prod.stats[core.WildcardStreamID]
+		}
+		if stats != nil {
+			atomic.AddInt64(stats.messages, 1)
+			atomic.AddInt64(stats.bytes, int64(len(msg.Data)))
+		}
+	}
+
+	if prod.delay > 0 {
+		time.Sleep(prod.delay)
+	}
+	if prod.batchSize > 0 && atomic.AddInt64(prod.count, 1)%prod.batchSize == 0 {
+		time.Sleep(prod.batchDelay)
+	}
 }
 
-// Produce writes to a buffer that is dumped to a file.
+// Produce waits for the stop command and reports statistics if enabled.
 func (prod *Null) Produce(threads *sync.WaitGroup) {
+	if prod.stats == nil {
+		for {
+			command := <-prod.control
+			if command == core.PluginControlStop {
+				return // ### return ###
+			}
+		}
+	}
+
+	ticker := time.NewTicker(prod.interval)
+	defer ticker.Stop()
+	lastReport := time.Now()
+
 	for {
-		command := <-prod.control
-		if command == core.PluginControlStop {
-			return // ### return ###
+		select {
+		case command := <-prod.control:
+			if command == core.PluginControlStop {
+				for _, stats := range prod.stats {
+					stats.report(time.Since(lastReport))
+					Log.Note.Printf("Null: %s received %d messages, %d bytes in total", stats.name, atomic.LoadInt64(stats.messages), atomic.LoadInt64(stats.bytes))
+				}
+				return // ### return ###
+			}
+
+		case now := <-ticker.C:
+			for _, stats := range prod.stats {
+				stats.report(now.Sub(lastReport))
+			}
+			lastReport = now
 		}
 	}
 }
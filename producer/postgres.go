@@ -0,0 +1,567 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	postgresProtocolVersion = 196608
+	postgresSSLRequest      = 80877103
+	postgresMaxMessageSize  = 1 << 24
+)
+
+var postgresCopyLine = regexp.MustCompile(`COPY [^,]+, line (\d+)`)
+
+// Postgres producer plugin
+// Configuration example
+//
+//   - "producer.Postgres":
+//     Enable: true
+//     Address: "localhost:5432"
+//     Database: "gollum"
+//     User: "gollum"
+//     Password: ""
+//     TLS: false
+//     TLSCA: ""
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//     Table:
+//       "access": "public.access_log"
+//     Columns:
+//       - "host"
+//       - "status"
+//     Fields:
+//       "status": "response/status"
+//     TimestampColumn: ""
+//     PayloadColumn: ""
+//     BatchMaxCount: 1000
+//     BatchSizeMaxKB: 8192
+//     BatchTimeoutSec: 5
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The Postgres producer loads JSON messages into PostgreSQL tables by using
+// COPY FROM STDIN. Messages are sent in batches per table. Each message is
+// converted into a row by mapping fields of the message to columns. As a COPY
+// is aborted by the first invalid row, rows not matching the table schema,
+// e.g. because of a type mismatch or a constraint violation, are removed from
+// the batch and sent to the RejectStream, which can be used as dead-letter
+// stream. The remaining rows of the batch are sent again. Batches failing
+// because of network or server errors are sent again and dropped, i.e. sent
+// to the retry stream, after all retries failed. Batches for tables or
+// columns that do not exist are rejected.
+//
+// Address defines the host and port of the PostgreSQL server.
+// By default this is set to "localhost:5432".
+//
+// Database defines the database containing the tables.
+// By default this is set to "gollum".
+//
+// User and Password define the credentials used to log in. Password, MD5 and
+// SCRAM-SHA-256 authentication are supported. By default User is set to
+// "gollum" and Password is set to "".
+//
+// TLS can be set to true to connect to PostgreSQL via TLS.
+// By default this is set to false.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server certificate. When
+// left empty the host part of Address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server certificate. By default this is set to false.
+//
+// Table maps a stream to a table. Table names may contain a schema, e.g.
+// "public.logs". You can define the wildcard stream (*) here, too. If no
+// mapping is set for a stream the stream name is used as table.
+// By default no mappings are set.
+//
+// Columns defines the columns written, in the order they are sent. This
+// setting is mandatory.
+//
+// Fields maps column names to fields of the message. Field paths can be
+// defined in a format accepted by shared.MarshalMap.Path. Columns without a
+// mapping are read from the field with the same name. Missing fields are
+// written as NULL. JSON objects and arrays are written as JSON text, which
+// can be stored in json or jsonb columns. By default no fields are set.
+//
+// TimestampColumn defines a column the message timestamp is written to.
+// By default this is set to "", i.e. the timestamp is not written.
+//
+// PayloadColumn defines a column messages that are not a JSON object are
+// written to as text. If not set these messages are rejected.
+// By default this is set to "".
+//
+// BatchMaxCount defines the maximum number of rows sent in one COPY.
+// By default this is set to 1000.
+//
+// BatchSizeMaxKB defines the maximum size of a COPY in KB.
+// By default this is set to 8192.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// batch before the next batch is sent. By default this is set to 5.
+//
+// Workers defines the number of batches sent concurrently. Each worker uses
+// its own connection. By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times a batch is sent again after a network
+// error or a server error. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a batch is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
+type Postgres struct {
+	core.ProducerBase
+	address     string
+	database    string
+	user        string
+	password    string
+	tlsConfig   *tls.Config
+	timeout     time.Duration
+	connections []*postgresConnection
+	batcher     *sqlBatcher
+}
+
+// postgresConnection is a connection used by one worker.
+type postgresConnection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// postgresError is an ErrorResponse sent by the server.
+type postgresError struct {
+	code    string
+	message string
+	where   string
+}
+
+func (err postgresError) Error() string {
+	return fmt.Sprintf("%s (SQLSTATE %s)", err.message, err.code)
+}
+
+func init() {
+	shared.RuntimeType.Register(Postgres{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Postgres) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address = conf.GetString("Address", "localhost:5432")
+	prod.database = conf.GetString("Database", "gollum")
+	prod.user = conf.GetString("User", "gollum")
+	prod.password = conf.GetString("Password", "")
+	prod.timeout = time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond
+
+	if conf.GetBool("TLS", false) {
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+		if prod.tlsConfig.ServerName == "" {
+			prod.tlsConfig.ServerName, _, _ = net.SplitHostPort(prod.address)
+		}
+	}
+
+	prod.batcher = newSQLBatcher("Postgres", conf, 1000, prod.encodeRow, prod.GetTimeout())
+	if len(prod.batcher.columns) == 0 {
+		return fmt.Errorf("Postgres: Columns must be set")
+	}
+
+	prod.connections = make([]*postgresConnection, cap(prod.batcher.queue))
+	for i := range prod.connections {
+		prod.connections[i] = new(postgresConnection)
+	}
+	return nil
+}
+
+// encodeRow encodes a row in the text format of COPY.
+func (prod *Postgres) encodeRow(values shared.MarshalMap) ([]byte, error) {
+	row := make([]byte, 0, 128)
+	for i, column := range prod.batcher.columns {
+		if i > 0 {
+			row = append(row, '\t')
+		}
+
+		var text string
+		switch value := values[column].(type) {
+		case nil:
+			row = append(row, `\N`...)
+			continue // ### continue, NULL ###
+		case string:
+			text = value
+		case json.Number:
+			text = value.String()
+		case bool:
+			text = strconv.FormatBool(value)
+		default:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err // ### return, invalid value ###
+			}
+			text = string(encoded)
+		}
+
+		for j := 0; j < len(text); j++ {
+			switch char := text[j]; char {
+			case '\\':
+				row = append(row, `\\`...)
+			case '\n':
+				row = append(row, `\n`...)
+			case '\r':
+				row = append(row, `\r`...)
+			case '\t':
+				row = append(row, `\t`...)
+			default:
+				row = append(row, char)
+			}
+		}
+	}
+	return append(row, '\n'), nil
+}
+
+func (pg *postgresConnection) close() {
+	if pg.conn != nil {
+		pg.conn.Close()
+		pg.conn = nil
+	}
+}
+
+// writeMessage sends a message of the given type. A type of 0 is used for
+// messages without type, i.e. the startup message.
+func (pg *postgresConnection) writeMessage(msgType byte, body []byte) error {
+	message := make([]byte, 0, len(body)+5)
+	if msgType != 0 {
+		message = append(message, msgType)
+	}
+	message = append(message, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(message[len(message)-4:], uint32(len(body)+4))
+	_, err := pg.conn.Write(append(message, body...))
+	return err
+}
+
+// readMessage reads a message and returns its type and body. Notices and
+// parameter updates are skipped.
+func (pg *postgresConnection) readMessage() (byte, []byte, error) {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(pg.reader, header); err != nil {
+			return 0, nil, err
+		}
+
+		size := int(binary.BigEndian.Uint32(header[1:]))
+		if size < 4 || size > postgresMaxMessageSize {
+			return 0, nil, fmt.Errorf("Invalid message size %d", size)
+		}
+
+		body := make([]byte, size-4)
+		if _, err := io.ReadFull(pg.reader, body); err != nil {
+			return 0, nil, err
+		}
+
+		switch header[0] {
+		case 'N', 'S', 'A': // NoticeResponse, ParameterStatus, NotificationResponse
+		default:
+			return header[0], body, nil
+		}
+	}
+}
+
+func parsePostgresError(body []byte) postgresError {
+	err := postgresError{}
+	for len(body) > 1 {
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		switch body[0] {
+		case 'C':
+			err.code = value
+		case 'M':
+			err.message = value
+		case 'W':
+			err.where = value
+		}
+		body = body[2+end:]
+	}
+	return err
+}
+
+func postgresCString(values ...string) []byte {
+	data := []byte{}
+	for _, value := range values {
+		data = append(append(data, value...), 0)
+	}
+	return data
+}
+
+func (prod *Postgres) connect(pg *postgresConnection) error {
+	conn, err := net.DialTimeout("tcp", prod.address, prod.timeout)
+	if err != nil {
+		return err // ### return, connection failed ###
+	}
+	conn.SetDeadline(time.Now().Add(prod.timeout))
+	pg.conn = conn
+
+	if prod.tlsConfig != nil {
+		request := make([]byte, 4)
+		binary.BigEndian.PutUint32(request, postgresSSLRequest)
+		response := make([]byte, 1)
+		if err := pg.writeMessage(0, request); err != nil {
+			pg.close()
+			return err // ### return, write failed ###
+		}
+		if _, err := io.ReadFull(conn, response); err != nil || response[0] != 'S' {
+			pg.close()
+			return fmt.Errorf("Server does not support TLS")
+		}
+
+		tlsConn := tls.Client(conn, prod.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			pg.close()
+			return err // ### return, handshake failed ###
+		}
+		pg.conn = tlsConn
+	}
+	pg.reader = bufio.NewReader(pg.conn)
+
+	if err := prod.startup(pg); err != nil {
+		pg.close()
+		return err
+	}
+	return nil
+}
+
+// startup sends the startup message, authenticates and waits for the server
+// to become ready.
+func (prod *Postgres) startup(pg *postgresConnection) error {
+	startup := make([]byte, 4)
+	binary.BigEndian.PutUint32(startup, postgresProtocolVersion)
+	startup = append(startup, postgresCString("user", prod.user, "database", prod.database, "application_name", "gollum", "")...)
+	if err := pg.writeMessage(0, startup); err != nil {
+		return err
+	}
+
+	var scram *shared.ScramClient
+	for {
+		msgType, body, err := pg.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msgType {
+		case 'E':
+			return parsePostgresError(body)
+
+		case 'Z':
+			return nil // ### return, ready ###
+
+		case 'R':
+			if len(body) < 4 {
+				return fmt.Errorf("Invalid authentication request")
+			}
+
+			switch method := binary.BigEndian.Uint32(body); method {
+			case 0: // AuthenticationOk
+
+			case 3: // AuthenticationCleartextPassword
+				err = pg.writeMessage('p', postgresCString(prod.password))
+
+			case 5: // AuthenticationMD5Password
+				inner := md5.Sum([]byte(prod.password + prod.user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), body[4:]...))
+				err = pg.writeMessage('p', postgresCString("md5"+hex.EncodeToString(outer[:])))
+
+			case 10: // AuthenticationSASL
+				if !strings.Contains(string(body[4:]), "SCRAM-SHA-256\x00") {
+					return fmt.Errorf("Server requires an unsupported SASL mechanism")
+				}
+				scram = shared.NewScramClient("", prod.password)
+				first := scram.FirstMessage()
+				response := postgresCString("SCRAM-SHA-256")
+				response = append(response, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(response[len(response)-4:], uint32(len(first)))
+				err = pg.writeMessage('p', append(response, first...))
+
+			case 11: // AuthenticationSASLContinue
+				if scram == nil {
+					return fmt.Errorf("Unexpected SASL message")
+				}
+				final, scramErr := scram.FinalMessage(string(body[4:]))
+				if scramErr != nil {
+					return scramErr
+				}
+				err = pg.writeMessage('p', []byte(final))
+
+			case 12: // AuthenticationSASLFinal
+				if scram == nil {
+					return fmt.Errorf("Unexpected SASL message")
+				}
+				err = scram.Verify(string(body[4:]))
+
+			default:
+				return fmt.Errorf("Unsupported authentication method %d", method)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copy loads a batch into a table by using COPY FROM STDIN. Schema errors are
+// returned as sqlRowError, sqlDataError or sqlBatchError.
+func (prod *Postgres) copy(worker int, batch *sqlBatch) error {
+	pg := prod.connections[worker]
+	if pg.conn == nil {
+		if err := prod.connect(pg); err != nil {
+			return err // ### return, not connected ###
+		}
+	}
+
+	err := prod.copyRows(pg, batch)
+	if pgErr, isPostgresError := err.(postgresError); isPostgresError {
+		return classifyPostgresError(pgErr)
+	}
+	if err != nil {
+		pg.close()
+	}
+	return err
+}
+
+func (prod *Postgres) copyRows(pg *postgresConnection, batch *sqlBatch) error {
+	pg.conn.SetDeadline(time.Now().Add(prod.timeout))
+	query := fmt.Sprintf("COPY %s %s FROM STDIN",
+		quoteSQLTable(batch.table, `"`),
+		sqlColumnList(prod.batcher.columns, `"`))
+
+	if err := pg.writeMessage('Q', postgresCString(query)); err != nil {
+		return err
+	}
+
+	var result error
+	for {
+		msgType, body, err := pg.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msgType {
+		case 'G': // CopyInResponse
+			buffers := make(net.Buffers, 0, 2*len(batch.rows)+1)
+			for _, row := range batch.rows {
+				header := []byte{'d', 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(header[1:], uint32(len(row)+4))
+				buffers = append(buffers, header, row)
+			}
+			buffers = append(buffers, []byte{'c', 0, 0, 0, 4})
+			if _, err := buffers.WriteTo(pg.conn); err != nil {
+				return err
+			}
+
+		case 'E':
+			result = parsePostgresError(body)
+
+		case 'Z':
+			return result // ### return, done ###
+
+		case 'C': // CommandComplete
+
+		default:
+			return fmt.Errorf("Unexpected message type '%c'", msgType)
+		}
+	}
+}
+
+// classifyPostgresError converts errors caused by invalid rows or tables
+// into the errors handled by sqlBatcher. All other errors are retried.
+func classifyPostgresError(err postgresError) error {
+	switch {
+	case strings.HasPrefix(err.code, "22"), strings.HasPrefix(err.code, "23"):
+		// Data exceptions and integrity constraint violations
+		if match := postgresCopyLine.FindStringSubmatch(err.where); match != nil {
+			if line, convErr := strconv.Atoi(match[1]); convErr == nil {
+				return sqlRowError{line - 1, err.Error()}
+			}
+		}
+		return sqlDataError{err.Error()}
+
+	case strings.HasPrefix(err.code, "42"):
+		// Syntax errors, unknown tables and columns, missing privileges
+		return sqlBatchError{err.Error()}
+
+	default:
+		return err
+	}
+}
+
+func (prod *Postgres) close() {
+	prod.batcher.close()
+	for _, pg := range prod.connections {
+		pg.close()
+	}
+	prod.WorkerDone()
+}
+
+func (prod *Postgres) sendMessage(msg core.Message) {
+	prod.batcher.add(&prod.ProducerBase, msg)
+}
+
+// Produce loads batches of rows into PostgreSQL.
+func (prod *Postgres) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+	prod.batcher.start(&prod.ProducerBase, prod.copy)
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batcher.batchTimeout, prod.sendMessage, nil, prod.batcher.sendBatchOnTimeOut)
+}
@@ -64,11 +64,14 @@ import (
 //  - "binary_le" is an alias for "binary"
 //  - "binary_be" is the same as "binary" but uses big endian encoding
 //  - "fixed" assumes fixed size messages
+//  - "varint" reads an unsigned varint at a given offset
+//  - "protobuf" is an alias for "varint" and reads length delimited protocol
+//    buffer messages
 //
 // Delimiter defines the delimiter used by the text and delimiter partitioner.
 // By default this is set to "\n".
 //
-// Offset defines the offset used by the binary and text paritioner.
+// Offset defines the offset used by the binary, varint and text paritioner.
 // By default this is set to 0. This setting is ignored by the fixed partitioner.
 //
 // Size defines the size in bytes used by the binary or fixed partitioner.
@@ -134,6 +137,9 @@ func (prod *Proxy) Configure(conf core.PluginConfig) error {
 	case "ascii":
 		flags |= shared.BufferedReaderFlagMLE
 
+	case "varint", "protobuf":
+		flags |= shared.BufferedReaderFlagMLEVarint
+
 	case "delimiter":
 		// Nothing to add
 
@@ -0,0 +1,321 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+
+// PubSub producer plugin
+// Configuration example
+//
+//   - "producer.PubSub":
+//     Enable: true
+//     Project: "my-project"
+//     Topic:
+//       "console": "logs"
+//     CredentialsFile: ""
+//     Endpoint: "https://pubsub.googleapis.com"
+//     OrderingKeyMetadata: ""
+//     SendMetadata: false
+//     BatchMaxCount: 1000
+//     BatchSizeMaxKB: 8192
+//     BatchTimeoutSec: 1
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     RetryDelayMs: 1000
+//
+// The PubSub producer publishes messages to Google Cloud Pub/Sub topics.
+// Messages are sent in batches per topic. All batches of a topic are published
+// by the same worker so that messages sharing an ordering key keep their order.
+// Messages rejected by Pub/Sub are sent to the RejectStream if set. Batches
+// failing after all retries are dropped, i.e. sent to the retry stream.
+//
+// Project defines the Google Cloud project containing the topics. This setting
+// is mandatory.
+//
+// Topic maps a stream to a topic. You can define the wildcard stream (*) here,
+// too. If no mapping is set for a stream the stream name is used as topic.
+// By default no mappings are set.
+//
+// CredentialsFile defines a service account key or user credentials file. If
+// empty the file named by GOOGLE_APPLICATION_CREDENTIALS is used. If this is
+// not set either, credentials are requested from the metadata server, e.g. to
+// use workload identity on Kubernetes Engine. By default this is set to "".
+//
+// Endpoint defines the URL of the Pub/Sub API. Regional endpoints, e.g.
+// "https://europe-west1-pubsub.googleapis.com", are recommended when using
+// ordering keys. By default this is set to "https://pubsub.googleapis.com".
+//
+// OrderingKeyMetadata defines a metadata field used as ordering key. Messages
+// without this field are sent without ordering key. Subscriptions have to
+// enable message ordering to receive messages in order.
+// By default this is set to "", i.e. no ordering keys are sent.
+//
+// SendMetadata can be set to true to send all metadata fields of a message as
+// attributes. By default this is set to false.
+//
+// BatchMaxCount defines the maximum number of messages sent in one request.
+// Pub/Sub accepts up to 1000 messages per request. By default this is set to
+// 1000.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB. Pub/Sub rejects
+// requests larger than 10 MB. By default this is set to 8192.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 1.
+//
+// Workers defines the number of requests sent concurrently.
+// By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times a request is sent again after a network
+// error, a server error or because of rate limits. By default this is set to 3.
+//
+// RetryDelayMs defines the number of milliseconds to wait before a request is
+// sent again. The delay is doubled for each retry. By default this is set to
+// 1000.
+type PubSub struct {
+	core.ProducerBase
+	client       *http.Client
+	credentials  *shared.GoogleCredentials
+	baseURL      string
+	topic        map[core.MessageStreamID]string
+	orderingKey  string
+	sendMetadata bool
+	batches      map[string]*pubSubBatch
+	batchMax     int
+	batchSizeMax int
+	batchTimeout time.Duration
+	lastSend     time.Time
+	queues       []chan *pubSubBatch
+	senders      *sync.WaitGroup
+	retries      int
+	retryDelay   time.Duration
+}
+
+type pubSubMessage struct {
+	Data        string            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+type pubSubBatch struct {
+	topic    string
+	messages []core.Message
+	encoded  []pubSubMessage
+	size     int
+}
+
+func init() {
+	shared.RuntimeType.Register(PubSub{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *PubSub) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	project := conf.GetString("Project", "")
+	if project == "" {
+		return fmt.Errorf("PubSub: Project must be set")
+	}
+
+	endpoint := strings.TrimRight(conf.GetString("Endpoint", "https://pubsub.googleapis.com"), "/")
+	prod.baseURL = fmt.Sprintf("%s/v1/projects/%s/topics/", endpoint, url.PathEscape(project))
+
+	if prod.credentials, err = shared.NewGoogleCredentials(conf.GetString("CredentialsFile", ""), pubSubScope); err != nil {
+		return err
+	}
+
+	prod.topic = conf.GetStreamMap("Topic", "")
+	prod.orderingKey = conf.GetString("OrderingKeyMetadata", "")
+	prod.sendMetadata = conf.GetBool("SendMetadata", false)
+
+	prod.batchMax = conf.GetInt("BatchMaxCount", 1000)
+	prod.batchSizeMax = conf.GetInt("BatchSizeMaxKB", 8192) << 10
+	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 1)) * time.Second
+	prod.retries = conf.GetInt("Retries", 3)
+	prod.retryDelay = time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+
+	workers := conf.GetInt("Workers", 2)
+	if workers < 1 {
+		workers = 1
+	}
+
+	prod.batches = make(map[string]*pubSubBatch)
+	prod.queues = make([]chan *pubSubBatch, workers)
+	for i := range prod.queues {
+		prod.queues[i] = make(chan *pubSubBatch, 1)
+	}
+	prod.senders = new(sync.WaitGroup)
+	return nil
+}
+
+func (prod *PubSub) getTopic(streamID core.MessageStreamID) string {
+	if topic, topicMapped := prod.topic[streamID]; topicMapped {
+		return topic // ### return, mapped topic ###
+	}
+	if topic, topicMapped := prod.topic[core.WildcardStreamID]; topicMapped {
+		return topic // ### return, wildcard topic ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// publish sends a batch to Pub/Sub, retrying failed requests.
+func (prod *PubSub) publish(batch *pubSubBatch) {
+	request := map[string]interface{}{"messages": batch.encoded}
+	publishURL := prod.baseURL + url.PathEscape(batch.topic) + ":publish"
+	delay := prod.retryDelay
+
+	for attempt := 0; attempt <= prod.retries; attempt++ {
+		err := prod.credentials.Post(context.Background(), prod.client, publishURL, request, nil)
+		if err == nil {
+			return // ### return, published ###
+		}
+
+		if apiErr, isAPIError := err.(shared.GoogleAPIError); isAPIError && !apiErr.Temporary() {
+			Log.Error.Printf("PubSub rejected %d messages for topic %s - %s", len(batch.messages), batch.topic, apiErr.Error())
+			for _, msg := range batch.messages {
+				prod.Reject(msg, apiErr.Error())
+			}
+			return // ### return, rejected ###
+		}
+
+		Log.Error.Printf("PubSub error publishing to %s - %s", batch.topic, err.Error())
+		if attempt < prod.retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	for _, msg := range batch.messages {
+		msg.Drop(prod.GetTimeout())
+	}
+}
+
+func (prod *PubSub) sendLoop(queue <-chan *pubSubBatch) {
+	defer prod.senders.Done()
+	for batch := range queue {
+		prod.publish(batch)
+	}
+}
+
+// sendBatch passes the batch of a topic to the worker responsible for this
+// topic.
+func (prod *PubSub) sendBatch(topic string) {
+	if batch, exists := prod.batches[topic]; exists && len(batch.messages) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(topic))
+		prod.queues[hash.Sum32()%uint32(len(prod.queues))] <- batch
+		delete(prod.batches, topic)
+	}
+}
+
+func (prod *PubSub) sendAllBatches() {
+	for topic := range prod.batches {
+		prod.sendBatch(topic)
+	}
+	prod.lastSend = time.Now()
+}
+
+func (prod *PubSub) sendBatchOnTimeOut() {
+	if time.Since(prod.lastSend) > prod.batchTimeout {
+		prod.sendAllBatches()
+	}
+}
+
+func (prod *PubSub) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	encoded := pubSubMessage{
+		Data:        base64.StdEncoding.EncodeToString(payload),
+		OrderingKey: msg.Metadata[prod.orderingKey],
+	}
+	if prod.sendMetadata && len(msg.Metadata) > 0 {
+		encoded.Attributes = msg.Metadata
+	}
+
+	if len(payload) == 0 && len(encoded.Attributes) == 0 {
+		Log.Error.Print("PubSub format error - message has no data and no attributes")
+		prod.Reject(msg, "message has no data and no attributes")
+		return // ### return, invalid message ###
+	}
+
+	size := len(encoded.Data) + len(encoded.OrderingKey) + 64
+	for key, value := range encoded.Attributes {
+		size += len(key) + len(value) + 8
+	}
+
+	topic := prod.getTopic(streamID)
+	batch, exists := prod.batches[topic]
+	if exists && batch.size+size > prod.batchSizeMax {
+		prod.sendBatch(topic)
+		exists = false
+	}
+	if !exists {
+		batch = &pubSubBatch{topic: topic}
+		prod.batches[topic] = batch
+	}
+
+	batch.messages = append(batch.messages, msg)
+	batch.encoded = append(batch.encoded, encoded)
+	batch.size += size
+
+	if len(batch.messages) >= prod.batchMax {
+		prod.sendBatch(topic)
+	}
+}
+
+func (prod *PubSub) flush() {
+	prod.sendAllBatches()
+	for _, queue := range prod.queues {
+		close(queue)
+	}
+	prod.senders.Wait()
+	prod.WorkerDone()
+}
+
+// Produce publishes batches of messages to Pub/Sub.
+func (prod *PubSub) Produce(workers *sync.WaitGroup) {
+	defer prod.flush()
+
+	for _, queue := range prod.queues {
+		prod.senders.Add(1)
+		go prod.sendLoop(queue)
+	}
+
+	prod.lastSend = time.Now()
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batchTimeout, prod.sendMessage, nil, prod.sendBatchOnTimeOut)
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNS producer plugin
+// Configuration example
+//
+//   - "producer.SNS":
+//     Enable: true
+//     Region: "eu-west-1"
+//     Topic:
+//       "*": "arn:aws:sns:eu-west-1:123456789012:logs"
+//     AccessKeyID: ""
+//     SecretAccessKey: ""
+//     Profile: ""
+//     Endpoint: ""
+//     GroupIDMetadata: ""
+//     GroupIDDefault: "gollum"
+//     DeduplicationID: true
+//     SendMetadata: false
+//     BatchMaxCount: 10
+//     BatchSizeMaxKB: 256
+//     BatchTimeoutSec: 1
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     ThrottleRetries: 10
+//     RetryDelayMs: 1000
+//
+// The SNS producer publishes messages to Amazon SNS topics by using
+// PublishBatch requests. Messages are batched and split like by the SQS
+// producer. Messages rejected by SNS are sent to the RejectStream if set.
+// Messages failing after all retries are dropped, i.e. sent to the retry
+// stream.
+//
+// Topic maps a stream to a topic ARN. You can define the wildcard stream (*)
+// here, too. This setting is mandatory.
+//
+// Endpoint defines the URL of the SNS API. By default this is set to "",
+// i.e. "https://sns.<Region>.amazonaws.com" is used.
+//
+// GroupIDMetadata, GroupIDDefault and DeduplicationID are used for FIFO
+// topics (names ending with ".fifo") in the same way as for FIFO queues.
+//
+// All other settings are equal to the settings of the SQS producer.
+type SNS struct {
+	core.ProducerBase
+	client      *http.Client
+	credentials *shared.AWSCredentials
+	region      string
+	endpoint    string
+	topic       map[core.MessageStreamID]string
+	options     awsMessageOptions
+	batcher     *awsBatcher
+}
+
+func init() {
+	shared.RuntimeType.Register(SNS{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *SNS) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if prod.credentials, prod.region, err = configureAWS("SNS", conf); err != nil {
+		return err
+	}
+
+	prod.topic = conf.GetStreamMap("Topic", "")
+	if len(prod.topic) == 0 {
+		return fmt.Errorf("SNS: Topic must be set")
+	}
+
+	prod.endpoint = strings.TrimRight(conf.GetString("Endpoint", ""), "/")
+	if prod.endpoint == "" {
+		prod.endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com", prod.region)
+	}
+	prod.endpoint += "/"
+
+	prod.options.configure(conf)
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+	prod.batcher = newAWSBatcher("SNS", conf, 10, 256, prod.GetTimeout())
+	return nil
+}
+
+func (prod *SNS) getTopic(streamID core.MessageStreamID) (string, bool) {
+	if topic, topicMapped := prod.topic[streamID]; topicMapped {
+		return topic, true // ### return, mapped topic ###
+	}
+	topic, topicMapped := prod.topic[core.WildcardStreamID]
+	return topic, topicMapped
+}
+
+func (prod *SNS) sendBatch(batch *awsBatch) ([]awsEntry, error) {
+	values := url.Values{
+		"Action":   {"PublishBatch"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {batch.target},
+	}
+
+	for i, entry := range batch.entries {
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		values.Set(prefix+"Id", strconv.Itoa(i))
+		values.Set(prefix+"Message", entry.data)
+		if entry.key != "" {
+			values.Set(prefix+"MessageGroupId", entry.key)
+		}
+		if entry.dedupID != "" {
+			values.Set(prefix+"MessageDeduplicationId", entry.dedupID)
+		}
+
+		names := make([]string, 0, len(entry.attributes))
+		for name := range entry.attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for j, name := range names {
+			attribute := fmt.Sprintf("%sMessageAttributes.entry.%d.", prefix, j+1)
+			values.Set(attribute+"Name", name)
+			values.Set(attribute+"Value.DataType", "String")
+			values.Set(attribute+"Value.StringValue", entry.attributes[name])
+		}
+	}
+
+	result := awsBatchResult{}
+	if err := prod.credentials.PostQuery(context.Background(), prod.client, prod.endpoint, "sns", prod.region, values, &result); err != nil {
+		return awsRequestFailed(&prod.ProducerBase, "SNS", batch, err)
+	}
+
+	retry := []awsEntry{}
+	for _, failed := range result.Failed {
+		if idx, err := strconv.Atoi(failed.ID); err == nil && idx >= 0 && idx < len(batch.entries) {
+			retry = awsFailure(&prod.ProducerBase, "SNS", batch.entries[idx], failed.SenderFault, failed.Code, failed.Message, retry)
+		}
+	}
+	return retry, nil
+}
+
+func (prod *SNS) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	topic, topicMapped := prod.getTopic(streamID)
+	if !topicMapped {
+		Log.Error.Print("SNS no topic set for stream ", core.StreamTypes.GetStreamName(streamID))
+		prod.Reject(msg, "no topic for stream "+core.StreamTypes.GetStreamName(streamID))
+		return // ### return, no topic ###
+	}
+	prod.batcher.add(&prod.ProducerBase, topic, prod.options.newEntry(msg, payload, topic))
+}
+
+func (prod *SNS) close() {
+	prod.batcher.close()
+	prod.WorkerDone()
+}
+
+// Produce publishes batches of messages to SNS.
+func (prod *SNS) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+	prod.batcher.start(prod.sendBatch)
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batcher.batchTimeout, prod.sendMessage, nil, prod.batcher.sendBatchOnTimeOut)
+}
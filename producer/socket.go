@@ -15,10 +15,12 @@
 package producer
 
 import (
+	"fmt"
 	"github.com/trivago/gollum/core"
-	"github.com/trivago/gollum/core/log"
 	"github.com/trivago/gollum/shared"
-	"net"
+	"hash/fnv"
+	"io"
+	"strings"
 	"sync"
 	"time"
 )
@@ -32,12 +34,59 @@ import (
 //     ConnectionBufferSizeKB: 4096
 //     BatchSizeMaxKB: 16384
 //     BatchSizeByte: 4096
+//     BatchMaxCount: 0
 //     BatchTimeoutSec: 5
 //     Acknowledge: "ACK\n"
+//     Compression: "none"
+//     Framing: "none"
+//     Delimiter: "\n"
+//     FramingPrefix: ""
+//     FramingPostfix: "\n"
+//     FramingTimestampFormat: "2006-01-02T15:04:05Z07:00"
+//     SingleWrite: true
+//     Distribution: "failover"
+//     DistributionKey: ""
+//     ConnectTimeoutMs: 5000
+//     ReconnectDelayMs: 1000
+//     ReconnectDelayMaxMs: 30000
 //
 // Address stores the identifier to connect to.
 // This can either be any ip address and port like "localhost:5880" or a file
-// like "unix:///var/gollum.socket". By default this is set to ":5880".
+// like "unix:///var/gollum.socket". Abstract unix domain sockets (linux only)
+// are prefixed with "@", e.g. "unix://@gollum". A list of addresses can be
+// given to send to multiple endpoints, see Distribution. By default this is
+// set to ":5880".
+// The fuses of all streams this producer listens to are burned while no
+// connection can be established.
+//
+// Distribution defines how batches are distributed if more than one address
+// is given. By default this is set to "failover".
+//  - "failover" sends to the first available address in the list. If sending
+//    fails the next address is used. Addresses earlier in the list are used
+//    again as soon as they are available.
+//  - "roundrobin" sends each batch to the next available address.
+//  - "hash" sends messages with the same value of the metadata field
+//    DistributionKey to the same address by using rendezvous hashing. If an
+//    address is not available its messages are distributed between the
+//    remaining addresses. Messages already batched for an address are sent
+//    when it is available again.
+//
+// DistributionKey defines the metadata field used by the "hash" distribution.
+// Messages without this field are treated as having an empty key. This setting
+// is required if Distribution is set to "hash".
+//
+// ConnectTimeoutMs defines the maximum number of milliseconds to wait for a
+// connection to be established. By default this is set to 5000.
+//
+// ReconnectDelayMs defines the number of milliseconds to wait before an
+// address is used again after connecting or sending failed. The delay is
+// doubled after each failed attempt. Unavailable addresses are checked again
+// by connecting to them after this delay so that they are used again as soon
+// as possible. Checks are done every BatchTimeoutSec seconds. For UDP only
+// failed sends can be detected. By default this is set to 1000.
+//
+// ReconnectDelayMaxMs defines the maximum delay between two attempts to
+// connect to an address. By default this is set to 30000.
 //
 // ConnectionBufferSizeKB sets the connection buffer size in KB. By default this
 // is set to 1024, i.e. 1 MB buffer.
@@ -47,7 +96,12 @@ import (
 // By default this is set to 8192.
 //
 // BatchSizeByte defines the number of bytes to be buffered before they are written
-// to scribe. By default this is set to 8KB.
+// to the socket. A flush is triggered as soon as this threshold is reached.
+// By default this is set to 8KB.
+//
+// BatchMaxCount defines the number of messages to be buffered before they are
+// written to the socket. Set to 0 to flush based on size and time only.
+// By default this is set to 0.
 //
 // BatchTimeoutSec defines the maximum number of seconds to wait after the last
 // message arrived before a batch is flushed automatically. By default this is
@@ -58,18 +112,67 @@ import (
 // This setting is disabled by default, i.e. set to "".
 // If Acknowledge is enabled and a IP-Address is given to Address, TCP is used
 // to open the connection, otherwise UDP is used.
+//
+// Compression defines the algorithm used to compress each batch before it is
+// sent. Valid values are "none", "gzip", "zlib", "snappy", "zstd", "lz4" and
+// any other compressor registered by core.RegisterCompressor. Batches are
+// compressed separately. All of these except zlib can be read as one stream
+// by the receiver.
+// By default this is set to "none".
+//
+// Framing defines how messages are separated after they have been formatted.
+// By default this is set to "none".
+//  - "none" sends messages as returned by the formatter.
+//  - "newline" terminates each message with "\n".
+//  - "delimiter" terminates each message with Delimiter.
+//  - "length" prefixes each message with its length as 4 byte big endian
+//    number. This can be read by the "binary_be" partitioner of the socket
+//    consumer. "binary_be" is an alias for this value.
+//  - "length_le" is the same as "length" but uses little endian encoding.
+//    "binary" and "binary_le" are aliases for this value.
+//  - "envelope" adds FramingPrefix and FramingPostfix to each message.
+// Messages already ending with the delimiter are not terminated again.
+//
+// Delimiter defines the delimiter used by the "delimiter" framing. Special
+// characters like \n \r \t will be transformed into the actual control
+// characters. By default this is set to "\n".
+//
+// FramingPrefix and FramingPostfix define the strings added before and after
+// each message when using the "envelope" framing. Special characters are
+// transformed like for Delimiter. Both settings may contain the placeholders
+// supported by format.Envelope, e.g. ${stream} or ${meta:<key>}. By default
+// FramingPrefix is set to "" and FramingPostfix is set to "\n".
+//
+// FramingTimestampFormat defines the format used for the ${timestamp}
+// placeholder. By default this is set to "2006-01-02T15:04:05Z07:00".
+//
+// SingleWrite defines whether a batch is copied into a single buffer that is
+// sent with a single write. If set to false messages are not copied but
+// written separately. TCP and unix domain sockets still write a batch with a
+// single writev call in this case while UDP sends one datagram per message.
+// Compression is done per message if this is set to false.
+// By default this is set to true.
 type Socket struct {
 	core.ProducerBase
-	connection   net.Conn
-	batch        *core.MessageBatch
-	protocol     string
-	address      string
-	batchSize    int
-	batchTimeout time.Duration
-	bufferSizeKB int
-	acknowledge  string
+	endpoints       []*socketEndpoint
+	batches         []*core.MessageBatch
+	distribution    socketDistribution
+	distributionKey string
+	nextEndpoint    int
+	batchSize       int
+	batchCount      int
+	batchTimeout    time.Duration
+	compressor      core.Compressor
 }
 
+type socketDistribution int
+
+const (
+	socketDistributionFailover = socketDistribution(iota)
+	socketDistributionRoundRobin
+	socketDistributionHash
+)
+
 type bufferedConn interface {
 	SetWriteBuffer(bytes int) error
 }
@@ -88,84 +191,216 @@ func (prod *Socket) Configure(conf core.PluginConfig) error {
 	bufferSizeMax := conf.GetInt("BatchSizeMaxKB", 8<<10) << 10
 
 	prod.batchSize = conf.GetInt("BatchSizeByte", 8192)
+	prod.batchCount = conf.GetInt("BatchMaxCount", 0)
 	prod.batchTimeout = time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second
-	prod.bufferSizeKB = conf.GetInt("ConnectionBufferSizeKB", 1<<10) // 1 MB
 
-	prod.acknowledge = shared.Unescape(conf.GetString("Acknowledge", ""))
-	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", ":5880"))
+	acknowledge := shared.Unescape(conf.GetString("Acknowledge", ""))
+	for _, addressURI := range conf.GetStringArray("Address", []string{":5880"}) {
+		address, protocol := shared.ParseAddress(addressURI)
+		if protocol != "unix" {
+			if acknowledge != "" {
+				protocol = "tcp"
+			} else {
+				protocol = "udp"
+			}
+		}
+
+		prod.endpoints = append(prod.endpoints, &socketEndpoint{
+			address:        address,
+			protocol:       protocol,
+			bufferSizeKB:   conf.GetInt("ConnectionBufferSizeKB", 1<<10), // 1 MB
+			connectTimeout: time.Duration(conf.GetInt("ConnectTimeoutMs", 5000)) * time.Millisecond,
+			reconnectDelay: time.Duration(conf.GetInt("ReconnectDelayMs", 1000)) * time.Millisecond,
+			reconnectMax:   time.Duration(conf.GetInt("ReconnectDelayMaxMs", 30000)) * time.Millisecond,
+			acknowledge:    acknowledge,
+			guard:          new(sync.Mutex),
+		})
+	}
+	if len(prod.endpoints) == 0 {
+		return fmt.Errorf("Socket: no address configured")
+	}
 
-	if prod.protocol != "unix" {
-		if prod.acknowledge != "" {
-			prod.protocol = "tcp"
-		} else {
-			prod.protocol = "udp"
+	switch strings.ToLower(conf.GetString("Distribution", "failover")) {
+	case "failover":
+		prod.distribution = socketDistributionFailover
+	case "roundrobin":
+		prod.distribution = socketDistributionRoundRobin
+	case "hash":
+		prod.distribution = socketDistributionHash
+		if prod.distributionKey = conf.GetString("DistributionKey", ""); prod.distributionKey == "" {
+			return fmt.Errorf("Socket: DistributionKey is required by the hash distribution")
 		}
+	default:
+		return fmt.Errorf("Socket: Distribution %s is not supported", conf.GetString("Distribution", ""))
+	}
+
+	if prod.compressor, err = core.NewCompressor(conf.GetString("Compression", "none")); err != nil {
+		return err
+	}
+
+	formatter, err := newSocketFraming(conf, prod.ProducerBase.GetFormatter())
+	if err != nil {
+		return err
+	}
+
+	// The hash distribution needs one batch per endpoint, all other
+	// distributions send a single batch to any endpoint.
+	batchCount := 1
+	if prod.distribution == socketDistributionHash {
+		batchCount = len(prod.endpoints)
 	}
 
-	prod.batch = core.NewMessageBatch(bufferSizeMax, prod.ProducerBase.GetFormatter())
+	singleWrite := conf.GetBool("SingleWrite", true)
+	for i := 0; i < batchCount; i++ {
+		if singleWrite {
+			prod.batches = append(prod.batches, core.NewMessageBatch(bufferSizeMax, formatter))
+		} else {
+			prod.batches = append(prod.batches, core.NewVectoredMessageBatch(bufferSizeMax, formatter))
+		}
+	}
 
 	return nil
 }
 
-func (prod *Socket) validate() bool {
-	if prod.acknowledge == "" {
-		return true
-	}
+// getEndpoint returns a connected endpoint to send the batch with the given
+// index to or nil if no endpoint is available.
+func (prod *Socket) getEndpoint(batchIdx int) *socketEndpoint {
+	switch prod.distribution {
+	case socketDistributionHash:
+		if endpoint := prod.endpoints[batchIdx]; endpoint.connect() {
+			return endpoint // ### return, hashed endpoint ###
+		}
+		return nil
 
-	response := make([]byte, len(prod.acknowledge))
-	_, err := prod.connection.Read(response)
-	if err != nil {
-		Log.Error.Print("Socket response error:", err)
-		return false
+	case socketDistributionRoundRobin:
+		prod.nextEndpoint = (prod.nextEndpoint + 1) % len(prod.endpoints)
+		for i := 0; i < len(prod.endpoints); i++ {
+			endpoint := prod.endpoints[(prod.nextEndpoint+i)%len(prod.endpoints)]
+			if endpoint.connect() {
+				return endpoint // ### return, next endpoint ###
+			}
+		}
+		return nil
+
+	default:
+		for _, endpoint := range prod.endpoints {
+			if endpoint.connect() {
+				return endpoint // ### return, first available endpoint ###
+			}
+		}
+		return nil
 	}
-	return string(response) == prod.acknowledge
 }
 
-func (prod *Socket) onWriteError(err error) bool {
-	Log.Error.Print("Socket error - ", err)
-	prod.connection.Close()
-	prod.connection = nil
-	return false
+// getBatchIndex returns the index of the batch a message is added to.
+// Messages are assigned to the available endpoint with the highest hash of
+// key and address (rendezvous hashing) when using the hash distribution.
+func (prod *Socket) getBatchIndex(msg core.Message) int {
+	if prod.distribution != socketDistributionHash {
+		return 0 // ### return, single batch ###
+	}
+
+	key := msg.Metadata[prod.distributionKey]
+	bestIdx, bestAvailable, bestHash := 0, false, uint32(0)
+	for i, endpoint := range prod.endpoints {
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(endpoint.address))
+		score := hash.Sum32()
+		available := endpoint.available()
+
+		if (available && !bestAvailable) || (available == bestAvailable && score > bestHash) {
+			bestIdx, bestAvailable, bestHash = i, available, score
+		}
+	}
+	return bestIdx
 }
 
 func (prod *Socket) sendBatch() {
-	// If we have not yet connected or the connection dropped: connect.
-	if prod.connection == nil {
-		conn, err := net.Dial(prod.protocol, prod.address)
+	failed := false
+	for batchIdx, batch := range prod.batches {
+		if batch.IsEmpty() {
+			continue // ### continue, nothing to send ###
+		}
+		endpoint := prod.getEndpoint(batchIdx)
+		if endpoint == nil {
+			failed = true
+			continue // ### continue, no endpoint available ###
+		}
 
-		if err != nil {
-			Log.Error.Print("Socket connection error - ", err)
-		} else {
-			conn.(bufferedConn).SetWriteBuffer(prod.bufferSizeKB << 10)
-			prod.connection = conn
+		var writer io.Writer = endpoint
+		if prod.compressor != nil {
+			writer = core.NewCompressedBatchWriter(prod.compressor, endpoint)
+		}
+		batch.Flush(writer, endpoint.validate, endpoint.onWriteError)
+	}
+
+	prod.updateFuses(failed)
+}
+
+// updateFuses activates the fuses if at least one endpoint is connected and
+// burns them if sending failed because no endpoint is available.
+func (prod *Socket) updateFuses(failed bool) {
+	switch {
+	case prod.isConnected():
+		prod.ActivateFuses()
+	case failed:
+		prod.BurnFuses()
+	}
+}
+
+// isConnected returns true if at least one endpoint is connected.
+func (prod *Socket) isConnected() bool {
+	for _, endpoint := range prod.endpoints {
+		if endpoint.isConnected() {
+			return true // ### return, connected ###
 		}
 	}
+	return false
+}
 
-	// Flush the buffer to the connection if it is active
-	if prod.connection != nil {
-		prod.batch.Flush(prod.connection, prod.validate, prod.onWriteError)
+// checkEndpoints connects to all endpoints that are not connected and whose
+// reconnect delay has passed.
+func (prod *Socket) checkEndpoints() {
+	for _, endpoint := range prod.endpoints {
+		endpoint.connect()
 	}
+	prod.updateFuses(false)
+}
+
+func (prod *Socket) reachedBatchThreshold(batch *core.MessageBatch) bool {
+	return batch.ReachedSizeThreshold(prod.batchSize) || batch.ReachedCountThreshold(prod.batchCount)
 }
 
 func (prod *Socket) sendBatchOnTimeOut() {
-	if prod.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.batch.ReachedSizeThreshold(prod.batchSize) {
-		prod.sendBatch()
+	prod.checkEndpoints()
+	for _, batch := range prod.batches {
+		if batch.ReachedTimeThreshold(prod.batchTimeout) || prod.reachedBatchThreshold(batch) {
+			prod.sendBatch()
+			return // ### return, all batches sent ###
+		}
 	}
 }
 
 func (prod *Socket) sendMessage(message core.Message) {
-	if !prod.batch.Append(message) {
+	batch := prod.batches[prod.getBatchIndex(message)]
+	if !batch.Append(message) {
+		prod.sendBatch()
+		batch.Append(message)
+	}
+	if prod.reachedBatchThreshold(batch) {
 		prod.sendBatch()
-		prod.batch.Append(message)
 	}
 }
 
 func (prod *Socket) flush() {
 	prod.sendBatch()
-	prod.batch.WaitForFlush(5 * time.Second)
+	for _, batch := range prod.batches {
+		batch.WaitForFlush(5 * time.Second)
+	}
 
-	if prod.connection != nil {
-		prod.connection.Close()
+	for _, endpoint := range prod.endpoints {
+		endpoint.close()
 	}
 	prod.WorkerDone()
 }
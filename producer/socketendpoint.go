@@ -0,0 +1,176 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// socketEndpoint is a server the socket producer sends to. Endpoints that
+// failed are not used until their reconnect delay has passed. The delay is
+// doubled after each failed attempt up to a maximum delay.
+type socketEndpoint struct {
+	address        string
+	protocol       string
+	connection     net.Conn
+	failures       uint
+	retryAt        time.Time
+	bufferSizeKB   int
+	connectTimeout time.Duration
+	reconnectDelay time.Duration
+	reconnectMax   time.Duration
+	acknowledge    string
+	guard          *sync.Mutex
+}
+
+// available returns true if the endpoint is connected or may be connected.
+func (endpoint *socketEndpoint) available() bool {
+	endpoint.guard.Lock()
+	defer endpoint.guard.Unlock()
+	return endpoint.connection != nil || !time.Now().Before(endpoint.retryAt)
+}
+
+// isConnected returns true if a connection to the endpoint is open.
+func (endpoint *socketEndpoint) isConnected() bool {
+	endpoint.guard.Lock()
+	defer endpoint.guard.Unlock()
+	return endpoint.connection != nil
+}
+
+// connect opens a connection to the endpoint if it is not connected and the
+// reconnect delay has passed. True is returned if the endpoint is connected.
+func (endpoint *socketEndpoint) connect() bool {
+	endpoint.guard.Lock()
+	defer endpoint.guard.Unlock()
+
+	if endpoint.connection != nil {
+		return true // ### return, already connected ###
+	}
+	if time.Now().Before(endpoint.retryAt) {
+		return false // ### return, wait for reconnect ###
+	}
+
+	conn, err := net.DialTimeout(endpoint.protocol, endpoint.address, endpoint.connectTimeout)
+	if err != nil {
+		Log.Error.Print("Socket connection error - ", err)
+		endpoint.fail()
+		return false // ### return, connect failed ###
+	}
+
+	if buffered, isBuffered := conn.(bufferedConn); isBuffered {
+		buffered.SetWriteBuffer(endpoint.bufferSizeKB << 10)
+	}
+	if endpoint.failures > 0 {
+		Log.Note.Print("Socket reconnected to ", endpoint.address)
+	}
+	endpoint.connection = conn
+	endpoint.failures = 0
+	return true
+}
+
+// fail closes the connection and delays the next reconnect. The guard has to
+// be locked when calling this function.
+func (endpoint *socketEndpoint) fail() {
+	if endpoint.connection != nil {
+		endpoint.connection.Close()
+		endpoint.connection = nil
+	}
+
+	delay := endpoint.reconnectDelay << endpoint.failures
+	if delay > endpoint.reconnectMax || delay <= 0 {
+		delay = endpoint.reconnectMax
+	} else {
+		endpoint.failures++
+	}
+	endpoint.retryAt = time.Now().Add(delay)
+}
+
+func (endpoint *socketEndpoint) getConnection() (net.Conn, error) {
+	endpoint.guard.Lock()
+	defer endpoint.guard.Unlock()
+
+	if endpoint.connection == nil {
+		return nil, fmt.Errorf("Not connected to %s", endpoint.address)
+	}
+	return endpoint.connection, nil
+}
+
+// Write writes data to the current connection.
+func (endpoint *socketEndpoint) Write(data []byte) (int, error) {
+	conn, err := endpoint.getConnection()
+	if err != nil {
+		return 0, err // ### return, not connected ###
+	}
+	return conn.Write(data)
+}
+
+// WriteBuffers writes all buffers to the current connection. Stream sockets
+// use a single writev call to do so.
+func (endpoint *socketEndpoint) WriteBuffers(buffers [][]byte) (int64, error) {
+	conn, err := endpoint.getConnection()
+	if err != nil {
+		return 0, err // ### return, not connected ###
+	}
+	vector := net.Buffers(buffers)
+	return vector.WriteTo(conn)
+}
+
+// validate reads the acknowledge string from the connection if required.
+func (endpoint *socketEndpoint) validate() bool {
+	if endpoint.acknowledge == "" {
+		return true // ### return, no acknowledge required ###
+	}
+
+	conn, err := endpoint.getConnection()
+	if err == nil {
+		response := make([]byte, len(endpoint.acknowledge))
+		if _, err = conn.Read(response); err == nil && string(response) == endpoint.acknowledge {
+			return true // ### return, acknowledged ###
+		}
+	}
+
+	if err != nil {
+		Log.Error.Print("Socket response error:", err)
+	}
+	endpoint.guard.Lock()
+	endpoint.fail()
+	endpoint.guard.Unlock()
+	return false
+}
+
+// onWriteError closes the connection so that the batch is sent again, either
+// to this or to another endpoint.
+func (endpoint *socketEndpoint) onWriteError(err error) bool {
+	Log.Error.Print("Socket error - ", err)
+	endpoint.guard.Lock()
+	endpoint.fail()
+	endpoint.guard.Unlock()
+	return false
+}
+
+// close closes the connection to the endpoint.
+func (endpoint *socketEndpoint) close() {
+	endpoint.guard.Lock()
+	defer endpoint.guard.Unlock()
+
+	if endpoint.connection != nil {
+		endpoint.connection.Close()
+		endpoint.connection = nil
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"strings"
+)
+
+type socketFramingMode int
+
+const (
+	socketFramingNone = socketFramingMode(iota)
+	socketFramingDelimiter
+	socketFramingLengthBE
+	socketFramingLengthLE
+	socketFramingEnvelope
+)
+
+// socketFraming is a formatter wrapping the formatter of a producer. It adds
+// the framing required by the receiver to separate messages sent in a batch.
+type socketFraming struct {
+	base      core.Formatter
+	mode      socketFramingMode
+	delimiter []byte
+	prefix    core.MessageTemplate
+	postfix   core.MessageTemplate
+}
+
+// newSocketFraming returns a formatter adding the framing configured by the
+// "Framing" setting to messages formatted by base. If no framing is
+// configured, base is returned.
+func newSocketFraming(conf core.PluginConfig, base core.Formatter) (core.Formatter, error) {
+	framing := socketFraming{
+		base:      base,
+		delimiter: []byte(shared.Unescape(conf.GetString("Delimiter", "\n"))),
+	}
+
+	switch strings.ToLower(conf.GetString("Framing", "none")) {
+	case "none":
+		return base, nil // ### return, no framing ###
+	case "newline":
+		framing.mode = socketFramingDelimiter
+		framing.delimiter = []byte("\n")
+	case "delimiter":
+		framing.mode = socketFramingDelimiter
+		if len(framing.delimiter) == 0 {
+			return nil, fmt.Errorf("Socket: Delimiter must not be empty")
+		}
+	case "length", "binary_be":
+		framing.mode = socketFramingLengthBE
+	case "length_le", "binary", "binary_le":
+		framing.mode = socketFramingLengthLE
+	case "envelope":
+		framing.mode = socketFramingEnvelope
+		timestampFormat := conf.GetString("FramingTimestampFormat", "2006-01-02T15:04:05Z07:00")
+		framing.prefix = core.NewMessageTemplate(shared.Unescape(conf.GetString("FramingPrefix", "")), timestampFormat)
+		framing.postfix = core.NewMessageTemplate(shared.Unescape(conf.GetString("FramingPostfix", "\n")), timestampFormat)
+	default:
+		return nil, fmt.Errorf("Socket: Framing %s is not supported", conf.GetString("Framing", ""))
+	}
+
+	return framing, nil
+}
+
+// Format formats the message using the base formatter and adds the framing.
+func (framing socketFraming) Format(msg core.Message) ([]byte, core.MessageStreamID) {
+	payload, streamID := framing.base.Format(msg)
+
+	var frame []byte
+	switch framing.mode {
+	case socketFramingDelimiter:
+		if bytes.HasSuffix(payload, framing.delimiter) {
+			return payload, streamID // ### return, already delimited ###
+		}
+		frame = make([]byte, 0, len(payload)+len(framing.delimiter))
+		frame = append(frame, payload...)
+		frame = append(frame, framing.delimiter...)
+
+	case socketFramingLengthBE:
+		frame = make([]byte, 4, 4+len(payload))
+		binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+		frame = append(frame, payload...)
+
+	case socketFramingLengthLE:
+		frame = make([]byte, 4, 4+len(payload))
+		binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+		frame = append(frame, payload...)
+
+	case socketFramingEnvelope:
+		frame = make([]byte, 0, len(payload)+64)
+		frame = framing.prefix.Append(frame, msg, streamID)
+		frame = append(frame, payload...)
+		frame = framing.postfix.Append(frame, msg, streamID)
+	}
+
+	return frame, streamID
+}
@@ -0,0 +1,337 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlBatch stores the encoded rows sent to a table. Messages are kept so that
+// they can be rejected or dropped if their row cannot be inserted.
+type sqlBatch struct {
+	table    string
+	messages []core.Message
+	rows     [][]byte
+	size     int
+}
+
+// sqlRowError is returned by senders if a specific row of a batch does not
+// match the table schema.
+type sqlRowError struct {
+	index  int
+	reason string
+}
+
+// sqlDataError is returned by senders if a batch contains at least one row
+// not matching the table schema but the row is not known.
+type sqlDataError struct {
+	reason string
+}
+
+// sqlBatchError is returned by senders if a batch will never be accepted,
+// e.g. because the table does not exist.
+type sqlBatchError struct {
+	reason string
+}
+
+func (err sqlRowError) Error() string   { return err.reason }
+func (err sqlDataError) Error() string  { return err.reason }
+func (err sqlBatchError) Error() string { return err.reason }
+
+// sqlBatchSender inserts a batch by using the connection of the given worker.
+type sqlBatchSender func(worker int, batch *sqlBatch) error
+
+// sqlRowEncoder encodes the column values of a row. Missing columns are not
+// set in values.
+type sqlRowEncoder func(values shared.MarshalMap) ([]byte, error)
+
+// sqlBatcher converts messages into rows, collects rows per table and passes
+// full batches to a fixed number of workers. It is shared by all SQL batch
+// loaders.
+type sqlBatcher struct {
+	name            string
+	table           map[core.MessageStreamID]string
+	columns         []string
+	fields          map[string]string
+	timestampColumn string
+	timestampFormat string
+	payloadColumn   string
+	encode          sqlRowEncoder
+	batches         map[string]*sqlBatch
+	batchMax        int
+	batchSizeMax    int
+	batchTimeout    time.Duration
+	lastSend        time.Time
+	queue           chan *sqlBatch
+	senders         *sync.WaitGroup
+	retries         int
+	retryDelay      time.Duration
+	dropTimeout     time.Duration
+}
+
+func newSQLBatcher(name string, conf core.PluginConfig, countMax int, encode sqlRowEncoder, dropTimeout time.Duration) *sqlBatcher {
+	workers := conf.GetInt("Workers", 2)
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &sqlBatcher{
+		name:            name,
+		table:           conf.GetStreamMap("Table", ""),
+		columns:         conf.GetStringArray("Columns", []string{}),
+		fields:          conf.GetStringMap("Fields", map[string]string{}),
+		timestampColumn: conf.GetString("TimestampColumn", ""),
+		timestampFormat: time.RFC3339Nano,
+		payloadColumn:   conf.GetString("PayloadColumn", ""),
+		encode:          encode,
+		batches:         make(map[string]*sqlBatch),
+		batchMax:        conf.GetInt("BatchMaxCount", countMax),
+		batchSizeMax:    conf.GetInt("BatchSizeMaxKB", 8192) << 10,
+		batchTimeout:    time.Duration(conf.GetInt("BatchTimeoutSec", 5)) * time.Second,
+		queue:           make(chan *sqlBatch, workers),
+		senders:         new(sync.WaitGroup),
+		retries:         conf.GetInt("Retries", 3),
+		retryDelay:      time.Duration(conf.GetInt("RetryDelayMs", 1000)) * time.Millisecond,
+		dropTimeout:     dropTimeout,
+	}
+}
+
+func (batcher *sqlBatcher) getTable(streamID core.MessageStreamID) string {
+	if table, tableMapped := batcher.table[streamID]; tableMapped {
+		return table // ### return, mapped table ###
+	}
+	if table, tableMapped := batcher.table[core.WildcardStreamID]; tableMapped {
+		return table // ### return, wildcard table ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+// newRow maps the fields of a message to columns and encodes the row. If no
+// columns are set, all fields of the message are used.
+func (batcher *sqlBatcher) newRow(msg core.Message, payload []byte) ([]byte, error) {
+	values := shared.NewMarshalMap()
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		if batcher.payloadColumn == "" {
+			return nil, err // ### return, not a JSON object ###
+		}
+		values = shared.MarshalMap{batcher.payloadColumn: string(payload)}
+	}
+
+	columns := values
+	if len(batcher.columns) > 0 {
+		columns = shared.NewMarshalMap()
+		for _, column := range batcher.columns {
+			path, mapped := batcher.fields[column]
+			if !mapped {
+				path = column
+			}
+			if value, found := values.Path(path); found {
+				columns[column] = value
+			}
+		}
+	}
+
+	if batcher.timestampColumn != "" {
+		columns[batcher.timestampColumn] = msg.Timestamp.UTC().Format(batcher.timestampFormat)
+	}
+	return batcher.encode(columns)
+}
+
+// add converts a message and appends it to the batch of its table. Batches
+// are sent if they are full.
+func (batcher *sqlBatcher) add(prod *core.ProducerBase, msg core.Message) {
+	payload, streamID := prod.Format(msg)
+	row, err := batcher.newRow(msg, payload)
+	if err != nil {
+		Log.Error.Printf("%s format error - %s", batcher.name, err.Error())
+		prod.Reject(msg, err.Error())
+		return // ### return, invalid message ###
+	}
+
+	table := batcher.getTable(streamID)
+	batch, exists := batcher.batches[table]
+	if exists && batch.size+len(row) > batcher.batchSizeMax {
+		batcher.sendBatch(table)
+		exists = false
+	}
+	if !exists {
+		batch = &sqlBatch{table: table}
+		batcher.batches[table] = batch
+	}
+
+	batch.messages = append(batch.messages, msg)
+	batch.rows = append(batch.rows, row)
+	batch.size += len(row)
+
+	if len(batch.rows) >= batcher.batchMax {
+		batcher.sendBatch(table)
+	}
+}
+
+func (batcher *sqlBatcher) sendBatch(table string) {
+	if batch, exists := batcher.batches[table]; exists && len(batch.rows) > 0 {
+		batcher.queue <- batch
+		delete(batcher.batches, table)
+	}
+}
+
+func (batcher *sqlBatcher) sendAllBatches() {
+	for table := range batcher.batches {
+		batcher.sendBatch(table)
+	}
+	batcher.lastSend = time.Now()
+}
+
+func (batcher *sqlBatcher) sendBatchOnTimeOut() {
+	if time.Since(batcher.lastSend) > batcher.batchTimeout {
+		batcher.sendAllBatches()
+	}
+}
+
+// split returns the parts of a batch before and after the given row. The
+// row itself is not part of the result.
+func (batch *sqlBatch) split(index int) (*sqlBatch, *sqlBatch) {
+	head := &sqlBatch{table: batch.table, messages: batch.messages[:index], rows: batch.rows[:index]}
+	tail := &sqlBatch{table: batch.table, messages: batch.messages[index:], rows: batch.rows[index:]}
+	return head, tail
+}
+
+// send passes a batch to the given sender. Rows not matching the table schema
+// are rejected, i.e. sent to the RejectStream. If the failing row is not
+// known the batch is split in halves until the row is found. Batches failing
+// because of other errors are sent again and dropped after all retries.
+func (batcher *sqlBatcher) send(prod *core.ProducerBase, worker int, batch *sqlBatch, sender sqlBatchSender) {
+	pending := []*sqlBatch{batch}
+	delay := batcher.retryDelay
+	retries := 0
+
+	for len(pending) > 0 {
+		batch := pending[0]
+		if len(batch.rows) == 0 {
+			pending = pending[1:]
+			continue // ### continue, nothing to send ###
+		}
+
+		err := sender(worker, batch)
+		if rowErr, isRowError := err.(sqlRowError); isRowError && (rowErr.index < 0 || rowErr.index >= len(batch.rows)) {
+			err = sqlDataError{rowErr.reason}
+		}
+
+		switch err := err.(type) {
+		case nil:
+			pending = pending[1:]
+
+		case sqlRowError:
+			Log.Error.Printf("%s rejected row for table %s - %s", batcher.name, batch.table, err.reason)
+			prod.Reject(batch.messages[err.index], err.reason)
+
+			head, tail := batch.split(err.index)
+			tail.messages, tail.rows = tail.messages[1:], tail.rows[1:]
+			pending = append([]*sqlBatch{head, tail}, pending[1:]...)
+
+		case sqlDataError:
+			if len(batch.rows) == 1 {
+				Log.Error.Printf("%s rejected row for table %s - %s", batcher.name, batch.table, err.reason)
+				prod.Reject(batch.messages[0], err.reason)
+				pending = pending[1:]
+			} else {
+				pending = append(batcher.bisect(batch), pending[1:]...)
+			}
+
+		case sqlBatchError:
+			Log.Error.Printf("%s rejected %d rows for table %s - %s", batcher.name, len(batch.rows), batch.table, err.reason)
+			for _, msg := range batch.messages {
+				prod.Reject(msg, err.reason)
+			}
+			pending = pending[1:]
+
+		default:
+			Log.Error.Printf("%s error inserting into %s - %s", batcher.name, batch.table, err.Error())
+			if retries >= batcher.retries {
+				for _, batch := range pending {
+					for _, msg := range batch.messages {
+						msg.Drop(batcher.dropTimeout)
+					}
+				}
+				return // ### return, too many retries ###
+			}
+			retries++
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// bisect splits a batch into two halves.
+func (batcher *sqlBatcher) bisect(batch *sqlBatch) []*sqlBatch {
+	head, tail := batch.split(len(batch.rows) / 2)
+	return []*sqlBatch{head, tail}
+}
+
+// start starts the workers sending batches via the given sender.
+func (batcher *sqlBatcher) start(prod *core.ProducerBase, sender sqlBatchSender) {
+	for worker := 0; worker < cap(batcher.queue); worker++ {
+		batcher.senders.Add(1)
+		go func(worker int) {
+			defer batcher.senders.Done()
+			for batch := range batcher.queue {
+				batcher.send(prod, worker, batch, sender)
+			}
+		}(worker)
+	}
+	batcher.lastSend = time.Now()
+}
+
+// close sends all remaining batches and waits for the workers to finish.
+func (batcher *sqlBatcher) close() {
+	batcher.sendAllBatches()
+	close(batcher.queue)
+	batcher.senders.Wait()
+}
+
+// quoteSQLIdentifier quotes a column name.
+func quoteSQLIdentifier(name string, quote string) string {
+	return quote + strings.Replace(name, quote, quote+quote, -1) + quote
+}
+
+// quoteSQLTable quotes a table name. Table names containing a dot are quoted
+// per part, e.g. schema.table.
+func quoteSQLTable(name string, quote string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quoteSQLIdentifier(part, quote)
+	}
+	return strings.Join(parts, ".")
+}
+
+// sqlColumnList returns the quoted list of columns.
+func sqlColumnList(columns []string, quote string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteSQLIdentifier(column, quote)
+	}
+	return fmt.Sprintf("(%s)", strings.Join(quoted, ", "))
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sqsContentType = "application/x-amz-json-1.0"
+
+// SQS producer plugin
+// Configuration example
+//
+//   - "producer.SQS":
+//     Enable: true
+//     Region: "eu-west-1"
+//     Queue:
+//       "console": "https://sqs.eu-west-1.amazonaws.com/123456789012/logs"
+//     AccessKeyID: ""
+//     SecretAccessKey: ""
+//     Profile: ""
+//     Endpoint: ""
+//     GroupIDMetadata: ""
+//     GroupIDDefault: "gollum"
+//     DeduplicationID: true
+//     SendMetadata: false
+//     DelaySec: 0
+//     BatchMaxCount: 10
+//     BatchSizeMaxKB: 256
+//     BatchTimeoutSec: 1
+//     Workers: 2
+//     TimeoutMs: 30000
+//     Retries: 3
+//     ThrottleRetries: 10
+//     RetryDelayMs: 1000
+//
+// The SQS producer sends messages to Amazon SQS queues by using
+// SendMessageBatch requests. Messages are batched per queue. Batches are split
+// so that they do not exceed the size limit of SQS. All batches of a queue are
+// sent by the same worker so that the order of messages sent to FIFO queues is
+// kept. Messages rejected by SQS are sent to the RejectStream if set. Messages
+// failing after all retries are dropped, i.e. sent to the retry stream.
+//
+// Region defines the AWS region of the queues. If not set AWS_REGION or
+// AWS_DEFAULT_REGION is used. This setting is mandatory if none of these
+// variables is set.
+//
+// Queue maps a stream to a queue URL or queue name. Names are resolved to
+// URLs when the first message is sent. You can define the wildcard stream (*)
+// here, too. If no mapping is set for a stream the stream name is used as
+// queue name. By default no mappings are set.
+//
+// AccessKeyID and SecretAccessKey define the access key to use. If not set
+// credentials are loaded like the AWS SDKs do, i.e. from the environment, a
+// web identity token (IAM roles for service accounts), the shared credentials
+// file, the ECS container endpoint or the EC2 instance metadata service.
+// By default these are set to "".
+//
+// Profile defines the profile of the shared credentials file to use. By
+// default this is set to "", i.e. AWS_PROFILE or "default" is used.
+//
+// Endpoint defines the URL of the SQS API. By default this is set to "",
+// i.e. "https://sqs.<Region>.amazonaws.com" is used.
+//
+// GroupIDMetadata defines a metadata field used as message group id for FIFO
+// queues (names ending with ".fifo"). By default this is set to "", i.e. all
+// messages are sent with GroupIDDefault.
+//
+// GroupIDDefault defines the message group id used for FIFO queues if a
+// message has no group id. By default this is set to "gollum".
+//
+// DeduplicationID can be set to false to not send deduplication ids to FIFO
+// queues. This requires content based deduplication to be enabled for the
+// queue. By default this is set to true, i.e. ids are generated from the
+// message so that messages sent again are detected by SQS.
+//
+// SendMetadata can be set to true to send all metadata fields of a message as
+// message attributes. SQS accepts up to 10 attributes per message.
+// By default this is set to false.
+//
+// DelaySec defines the number of seconds messages are hidden after they have
+// been sent. This is not supported by FIFO queues. By default this is set to 0.
+//
+// BatchMaxCount defines the maximum number of messages sent in one request.
+// SQS accepts up to 10 messages per request. By default this is set to 10.
+//
+// BatchSizeMaxKB defines the maximum size of a request in KB. Messages
+// larger than this are rejected. By default this is set to 256.
+//
+// BatchTimeoutSec defines the maximum number of seconds to wait after the last
+// request before the next batch is sent. By default this is set to 1.
+//
+// Workers defines the number of requests sent concurrently.
+// By default this is set to 2.
+//
+// TimeoutMs defines the number of milliseconds to wait for a response.
+// By default this is set to 30000.
+//
+// Retries defines the number of times failed messages are sent again after a
+// network error or a server error. By default this is set to 3.
+//
+// ThrottleRetries defines the number of times messages are sent again after
+// being throttled. Throttling does not count against Retries.
+// By default this is set to 10.
+//
+// RetryDelayMs defines the number of milliseconds to wait before messages are
+// sent again. The delay is doubled for each retry. Delays after throttling are
+// capped at 10 seconds. By default this is set to 1000.
+type SQS struct {
+	core.ProducerBase
+	client      *http.Client
+	credentials *shared.AWSCredentials
+	region      string
+	endpoint    string
+	queue       map[core.MessageStreamID]string
+	queueURLs   map[string]string
+	guard       *sync.Mutex
+	options     awsMessageOptions
+	delay       int
+	batcher     *awsBatcher
+}
+
+type sqsAttribute struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue"`
+}
+
+type sqsEntry struct {
+	ID                     string                  `json:"Id"`
+	MessageBody            string                  `json:"MessageBody"`
+	DelaySeconds           int                     `json:"DelaySeconds,omitempty"`
+	MessageAttributes      map[string]sqsAttribute `json:"MessageAttributes,omitempty"`
+	MessageGroupID         string                  `json:"MessageGroupId,omitempty"`
+	MessageDeduplicationID string                  `json:"MessageDeduplicationId,omitempty"`
+}
+
+// awsBatchResult is the result of SQS and SNS batch requests.
+type awsBatchResult struct {
+	Failed []struct {
+		ID          string `json:"Id" xml:"Id"`
+		SenderFault bool   `json:"SenderFault" xml:"SenderFault"`
+		Code        string `json:"Code" xml:"Code"`
+		Message     string `json:"Message" xml:"Message"`
+	} `json:"Failed" xml:"PublishBatchResult>Failed>member"`
+}
+
+func init() {
+	shared.RuntimeType.Register(SQS{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *SQS) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	if prod.credentials, prod.region, err = configureAWS("SQS", conf); err != nil {
+		return err
+	}
+
+	prod.endpoint = strings.TrimRight(conf.GetString("Endpoint", ""), "/")
+	if prod.endpoint == "" {
+		prod.endpoint = fmt.Sprintf("https://sqs.%s.amazonaws.com", prod.region)
+	}
+
+	prod.queue = conf.GetStreamMap("Queue", "")
+	prod.queueURLs = make(map[string]string)
+	prod.guard = new(sync.Mutex)
+	prod.options.configure(conf)
+	prod.delay = conf.GetInt("DelaySec", 0)
+	prod.client = &http.Client{Timeout: time.Duration(conf.GetInt("TimeoutMs", 30000)) * time.Millisecond}
+	prod.batcher = newAWSBatcher("SQS", conf, 10, 256, prod.GetTimeout())
+	return nil
+}
+
+func (prod *SQS) getQueue(streamID core.MessageStreamID) string {
+	if queue, queueMapped := prod.queue[streamID]; queueMapped {
+		return queue // ### return, mapped queue ###
+	}
+	if queue, queueMapped := prod.queue[core.WildcardStreamID]; queueMapped {
+		return queue // ### return, wildcard queue ###
+	}
+	return core.StreamTypes.GetStreamName(streamID)
+}
+
+func (prod *SQS) post(action string, request interface{}, response interface{}) error {
+	return prod.credentials.PostJSON(context.Background(), prod.client, prod.endpoint, "sqs", prod.region, "AmazonSQS."+action, sqsContentType, request, response)
+}
+
+// getQueueURL returns the URL of a queue, resolving queue names if required.
+func (prod *SQS) getQueueURL(queue string) (string, error) {
+	if strings.HasPrefix(queue, "https://") || strings.HasPrefix(queue, "http://") {
+		return queue, nil // ### return, queue url ###
+	}
+
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+	if queueURL, resolved := prod.queueURLs[queue]; resolved {
+		return queueURL, nil // ### return, cached ###
+	}
+
+	result := struct {
+		QueueURL string `json:"QueueUrl"`
+	}{}
+	if err := prod.post("GetQueueUrl", map[string]string{"QueueName": queue}, &result); err != nil {
+		return "", err
+	}
+	prod.queueURLs[queue] = result.QueueURL
+	return result.QueueURL, nil
+}
+
+func (prod *SQS) sendBatch(batch *awsBatch) ([]awsEntry, error) {
+	queueURL, err := prod.getQueueURL(batch.target)
+	if err != nil {
+		return awsRequestFailed(&prod.ProducerBase, "SQS", batch, err)
+	}
+
+	fifo := strings.HasSuffix(batch.target, ".fifo")
+	entries := make([]sqsEntry, len(batch.entries))
+	for i, entry := range batch.entries {
+		entries[i] = sqsEntry{
+			ID:                     strconv.Itoa(i),
+			MessageBody:            entry.data,
+			MessageGroupID:         entry.key,
+			MessageDeduplicationID: entry.dedupID,
+		}
+		if !fifo {
+			entries[i].DelaySeconds = prod.delay
+		}
+		if len(entry.attributes) > 0 {
+			entries[i].MessageAttributes = make(map[string]sqsAttribute, len(entry.attributes))
+			for key, value := range entry.attributes {
+				entries[i].MessageAttributes[key] = sqsAttribute{DataType: "String", StringValue: value}
+			}
+		}
+	}
+
+	result := awsBatchResult{}
+	request := map[string]interface{}{"QueueUrl": queueURL, "Entries": entries}
+	if err := prod.post("SendMessageBatch", request, &result); err != nil {
+		return awsRequestFailed(&prod.ProducerBase, "SQS", batch, err)
+	}
+
+	retry := []awsEntry{}
+	for _, failed := range result.Failed {
+		if idx, err := strconv.Atoi(failed.ID); err == nil && idx >= 0 && idx < len(batch.entries) {
+			retry = awsFailure(&prod.ProducerBase, "SQS", batch.entries[idx], failed.SenderFault, failed.Code, failed.Message, retry)
+		}
+	}
+	return retry, nil
+}
+
+func (prod *SQS) sendMessage(msg core.Message) {
+	payload, streamID := prod.ProducerBase.Format(msg)
+	queue := prod.getQueue(streamID)
+	prod.batcher.add(&prod.ProducerBase, queue, prod.options.newEntry(msg, payload, queue))
+}
+
+func (prod *SQS) close() {
+	prod.batcher.close()
+	prod.WorkerDone()
+}
+
+// Produce sends batches of messages to SQS.
+func (prod *SQS) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+	prod.batcher.start(prod.sendBatch)
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.batcher.batchTimeout, prod.sendMessage, nil, prod.batcher.sendBatchOnTimeOut)
+}
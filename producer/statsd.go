@@ -0,0 +1,523 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statsd producer plugin
+// Configuration example
+//
+//   - "producer.Statsd":
+//     Enable: true
+//     Address: "udp://localhost:8125"
+//     Dialect: "dogstatsd"
+//     Prefix: "gollum."
+//     FlushIntervalMs: 1000
+//     MaxPacketSize: 1432
+//     SampleRate: 1.0
+//     MaxMetrics: 10000
+//     ReconnectDelayMs: 1000
+//     NameField: "metric"
+//     ValueField: "value"
+//     TypeField: "type"
+//     TagsField: "tags"
+//     Metrics:
+//       "http.requests": "counter"
+//       "http.bytes": "counter:size"
+//       "http.latency": "timing:latency"
+//       "http.clients": "set:client/ip"
+//     TagFields:
+//       - "status"
+//     Tags:
+//       "env": "production"
+//
+// This producer converts JSON messages to metrics and sends them to a statsd
+// server or a Datadog agent. Messages are formatted before they are
+// converted, so a formatter can be used to convert messages to JSON. Messages
+// that are not valid JSON are ignored.
+// Metrics are aggregated by name, type and tags and sent once per
+// FlushIntervalMs: counters are summed up, the last value of a gauge is sent
+// and each distinct value of a set is sent once. Values of timings,
+// histograms and distributions are sent individually and can be sampled.
+// Metrics that are still aggregated when gollum is stopped are sent before
+// the producer shuts down.
+//
+// Address defines the server to send metrics to. The protocol can be either
+// "udp://" or "tcp://". TCP packets are terminated by a newline.
+// By default this is set to "udp://localhost:8125".
+//
+// Dialect defines the protocol variant to use. Set to "statsd" to send plain
+// statsd metrics or to "dogstatsd" to send tags as supported by the Datadog
+// agent and other DogStatsD implementations. Tags are not sent when using
+// "statsd". By default this is set to "statsd".
+//
+// Prefix defines a string prepended to all metric names. By default this is
+// set to "".
+//
+// FlushIntervalMs defines the number of milliseconds metrics are aggregated
+// before they are sent. By default this is set to 1000.
+//
+// MaxPacketSize defines the maximum size of a packet in bytes. Multiple
+// metrics are sent in one packet, separated by newlines, as long as they fit.
+// By default this is set to 1432.
+//
+// SampleRate defines the fraction of timing, histogram and distribution
+// values sent, e.g. 0.1 to send every 10th value. The sample rate is sent
+// with each value so that the server can scale the results accordingly.
+// Counters, gauges and sets are aggregated and not sampled.
+// By default this is set to 1, i.e. all values are sent.
+//
+// MaxMetrics defines the maximum number of metrics aggregated per flush
+// interval, counting each combination of name, type and tags. Values for
+// additional metrics are ignored and a warning is written once per interval.
+// This protects the server against an unbounded number of tag values.
+// Set to 0 to disable the limit. By default this is set to 10000.
+//
+// ReconnectDelayMs defines the number of milliseconds to wait before trying to
+// reconnect after a connection failed. Metrics sent in the meantime are
+// dropped. By default this is set to 1000.
+//
+// NameField, ValueField, TypeField and TagsField define the JSON fields a
+// metric is read from if Metrics is not set. This way messages can describe
+// the metric to send, e.g. {"metric":"logins","value":1,"type":"counter"}.
+// Valid types are "counter", "gauge", "timing", "histogram", "distribution"
+// and "set" or their short forms "c", "g", "ms", "h", "d" and "s". Messages
+// without a type are sent as counters, counters without a value are counted
+// with a value of 1. Tags can be given as an object of names and values or as
+// an array of strings. Field paths can be defined in a format accepted by
+// shared.MarshalMap.Path. By default these are set to "metric", "value",
+// "type" and "tags".
+//
+// Metrics defines a map of metric names and the type and field used to
+// generate a metric from each message. Definitions are given as "<type>" or
+// "<type>:<field>" with the types listed above. Counters without a field are
+// incremented by 1 per message. All other types require a field. Messages
+// where a field is missing or not numeric are ignored for the corresponding
+// metric. If this is set, NameField, ValueField, TypeField and TagsField are
+// ignored. By default this is set to {}.
+//
+// TagFields defines a list of JSON fields added as tags to each metric. The
+// tag name is the field path. Fields that are missing are not added.
+// By default this is set to [].
+//
+// Tags defines a map of tags added to each metric. By default this is set to
+// {}.
+type Statsd struct {
+	core.ProducerBase
+	connection     net.Conn
+	protocol       string
+	address        string
+	dogStatsd      bool
+	prefix         string
+	flushInterval  time.Duration
+	maxPacketSize  int
+	sampleRate     float64
+	maxMetrics     int
+	reconnectDelay time.Duration
+	lastFailure    time.Time
+	nameField      string
+	valueField     string
+	typeField      string
+	tagsField      string
+	mappings       []statsdMapping
+	tagFields      []string
+	tags           []string
+	metrics        map[string]*statsdMetric
+	overflow       bool
+}
+
+type statsdMapping struct {
+	name       string
+	metricType string
+	field      string
+}
+
+type statsdMetric struct {
+	name       string
+	metricType string
+	tags       []string
+	sum        float64
+	last       string
+	distinct   map[string]struct{}
+	samples    []string
+}
+
+func init() {
+	shared.RuntimeType.Register(Statsd{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Statsd) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "udp://localhost:8125"))
+	switch prod.protocol {
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("Statsd: unknown protocol type %s", prod.protocol)
+	}
+
+	switch dialect := strings.ToLower(conf.GetString("Dialect", "statsd")); dialect {
+	case "statsd":
+		prod.dogStatsd = false
+	case "dogstatsd", "datadog":
+		prod.dogStatsd = true
+	default:
+		return fmt.Errorf("Statsd: unknown dialect %s", dialect)
+	}
+
+	switch sampleRate := conf.GetValue("SampleRate", 1.0).(type) {
+	case float64:
+		prod.sampleRate = sampleRate
+	case int:
+		prod.sampleRate = float64(sampleRate)
+	default:
+		return fmt.Errorf("Statsd: SampleRate must be a number")
+	}
+	if prod.sampleRate <= 0 || prod.sampleRate > 1 {
+		return fmt.Errorf("Statsd: SampleRate must be larger than 0 and not larger than 1")
+	}
+
+	prod.prefix = conf.GetString("Prefix", "")
+	prod.flushInterval = time.Duration(conf.GetInt("FlushIntervalMs", 1000)) * time.Millisecond
+	if prod.flushInterval <= 0 {
+		return fmt.Errorf("Statsd: FlushIntervalMs must be larger than 0")
+	}
+	prod.maxPacketSize = conf.GetInt("MaxPacketSize", 1432)
+	prod.maxMetrics = conf.GetInt("MaxMetrics", 10000)
+	prod.reconnectDelay = time.Duration(conf.GetInt("ReconnectDelayMs", 1000)) * time.Millisecond
+	prod.metrics = make(map[string]*statsdMetric)
+
+	prod.nameField = conf.GetString("NameField", "metric")
+	prod.valueField = conf.GetString("ValueField", "value")
+	prod.typeField = conf.GetString("TypeField", "type")
+	prod.tagsField = conf.GetString("TagsField", "tags")
+	prod.tagFields = conf.GetStringArray("TagFields", []string{})
+
+	tags := conf.GetStringMap("Tags", map[string]string{})
+	for name, value := range tags {
+		prod.tags = append(prod.tags, shared.StatsdTag(name, value))
+	}
+	sort.Strings(prod.tags)
+
+	metrics := conf.GetStringMap("Metrics", map[string]string{})
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mapping, err := newStatsdMapping(name, metrics[name])
+		if err != nil {
+			return err
+		}
+		prod.mappings = append(prod.mappings, mapping)
+	}
+
+	return nil
+}
+
+// newStatsdMapping parses a metric definition in the form "type" or
+// "type:field".
+func newStatsdMapping(name string, definition string) (statsdMapping, error) {
+	mapping := statsdMapping{name: name}
+	typeName := definition
+	if split := strings.IndexByte(definition, ':'); split >= 0 {
+		typeName = definition[:split]
+		mapping.field = definition[split+1:]
+	}
+
+	metricType, err := shared.ParseStatsdType(typeName)
+	switch {
+	case err != nil:
+		return mapping, fmt.Errorf("Statsd: %s (%s)", err, name)
+	case metricType != shared.StatsdCounter && mapping.field == "":
+		return mapping, fmt.Errorf("Statsd: %s requires a field (%s)", typeName, name)
+	}
+
+	mapping.metricType = metricType
+	return mapping, nil
+}
+
+// statsdValue converts a decoded JSON value to the value of a metric. Sets
+// accept any value, all other types require a number or a numeric string.
+func statsdValue(value interface{}, metricType string) (float64, string, bool) {
+	if metricType == shared.StatsdSet {
+		return 0, aggregateString(value), true
+	}
+	number, isNumber := aggregateNumber(value)
+	return number, shared.StatsdFormatNumber(number), isNumber
+}
+
+// messageTags returns the tags of a message, i.e. the static tags, the values
+// of TagFields and, if given, the tags stored in tagsValue.
+func (prod *Statsd) messageTags(values shared.MarshalMap, tagsValue interface{}) []string {
+	if !prod.dogStatsd {
+		return nil // ### return, tags are not supported ###
+	}
+
+	tags := append([]string{}, prod.tags...)
+	for _, field := range prod.tagFields {
+		if value, found := values.Path(field); found && value != nil {
+			tags = append(tags, shared.StatsdTag(field, aggregateString(value)))
+		}
+	}
+
+	switch messageTags := tagsValue.(type) {
+	case map[string]interface{}:
+		for name, value := range messageTags {
+			tags = append(tags, shared.StatsdTag(name, aggregateString(value)))
+		}
+	case []interface{}:
+		for _, tag := range messageTags {
+			tags = append(tags, shared.StatsdTag(aggregateString(tag), ""))
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// getMetric returns the aggregated metric for the given name, type and tags.
+func (prod *Statsd) getMetric(name string, metricType string, tags []string) *statsdMetric {
+	// Names and tags never contain "|" after being escaped
+	key := metricType + "|" + name + "|" + strings.Join(tags, ",")
+	if metric, exists := prod.metrics[key]; exists {
+		return metric // ### return, known metric ###
+	}
+
+	if prod.maxMetrics > 0 && len(prod.metrics) >= prod.maxMetrics {
+		if !prod.overflow {
+			prod.overflow = true
+			Log.Warning.Printf("Statsd: More than %d metrics in one flush interval, ignoring new metrics", prod.maxMetrics)
+		}
+		return nil // ### return, too many metrics ###
+	}
+
+	metric := &statsdMetric{
+		name:       name,
+		metricType: metricType,
+		tags:       tags,
+	}
+	prod.metrics[key] = metric
+	return metric
+}
+
+// addValue adds a value to the aggregated metric for the given name, type and
+// tags.
+func (prod *Statsd) addValue(name string, metricType string, tags []string, number float64, value string) {
+	switch metricType {
+	case shared.StatsdTiming, shared.StatsdHistogram, shared.StatsdDistribution:
+		if prod.sampleRate < 1 && rand.Float64() >= prod.sampleRate {
+			return // ### return, not sampled ###
+		}
+	}
+
+	metric := prod.getMetric(prod.prefix+name, metricType, tags)
+	if metric == nil {
+		return // ### return, too many metrics ###
+	}
+
+	switch metricType {
+	case shared.StatsdCounter:
+		metric.sum += number
+	case shared.StatsdGauge:
+		metric.last = value
+	case shared.StatsdSet:
+		if metric.distinct == nil {
+			metric.distinct = make(map[string]struct{})
+		}
+		metric.distinct[value] = struct{}{}
+	default:
+		metric.samples = append(metric.samples, value)
+	}
+}
+
+// addMappedMetrics adds one value per metric defined by Metrics.
+func (prod *Statsd) addMappedMetrics(values shared.MarshalMap) {
+	tags := prod.messageTags(values, nil)
+	for _, mapping := range prod.mappings {
+		if mapping.field == "" {
+			prod.addValue(mapping.name, mapping.metricType, tags, 1, "1")
+			continue // ### continue, counted ###
+		}
+
+		field, found := values.Path(mapping.field)
+		if !found {
+			continue // ### continue, field missing ###
+		}
+		if number, value, valid := statsdValue(field, mapping.metricType); valid {
+			prod.addValue(mapping.name, mapping.metricType, tags, number, value)
+		}
+	}
+}
+
+// addMessageMetric adds the metric described by the fields of a message.
+func (prod *Statsd) addMessageMetric(values shared.MarshalMap) {
+	nameValue, found := values.Path(prod.nameField)
+	name, isString := nameValue.(string)
+	if !found || !isString || name == "" {
+		return // ### return, no metric ###
+	}
+
+	metricType := shared.StatsdCounter
+	if typeValue, found := values.Path(prod.typeField); found {
+		typeName, _ := typeValue.(string)
+		var err error
+		if metricType, err = shared.ParseStatsdType(typeName); err != nil {
+			Log.Debug.Print("Statsd: ", err)
+			return // ### return, invalid type ###
+		}
+	}
+
+	number, value := float64(1), "1"
+	field, found := values.Path(prod.valueField)
+	switch {
+	case found:
+		var valid bool
+		if number, value, valid = statsdValue(field, metricType); !valid {
+			return // ### return, invalid value ###
+		}
+	case metricType != shared.StatsdCounter:
+		return // ### return, value missing ###
+	}
+
+	tagsValue, _ := values.Path(prod.tagsField)
+	prod.addValue(name, metricType, prod.messageTags(values, tagsValue), number, value)
+}
+
+func (prod *Statsd) addMessage(msg core.Message) {
+	payload, _ := prod.ProducerBase.Format(msg)
+
+	values := shared.NewMarshalMap()
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return // ### return, no JSON ###
+	}
+
+	if len(prod.mappings) > 0 {
+		prod.addMappedMetrics(values)
+	} else {
+		prod.addMessageMetric(values)
+	}
+}
+
+// lines returns the lines to send for all aggregated metrics.
+func (prod *Statsd) lines() []string {
+	lines := []string{}
+	for _, metric := range prod.metrics {
+		switch metric.metricType {
+		case shared.StatsdCounter:
+			lines = append(lines, shared.StatsdLine(metric.name, shared.StatsdFormatNumber(metric.sum), metric.metricType, 1, metric.tags))
+		case shared.StatsdGauge:
+			lines = append(lines, shared.StatsdLine(metric.name, metric.last, metric.metricType, 1, metric.tags))
+		case shared.StatsdSet:
+			for value := range metric.distinct {
+				lines = append(lines, shared.StatsdLine(metric.name, value, metric.metricType, 1, metric.tags))
+			}
+		default:
+			for _, value := range metric.samples {
+				lines = append(lines, shared.StatsdLine(metric.name, value, metric.metricType, prod.sampleRate, metric.tags))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (prod *Statsd) connect() bool {
+	if prod.connection != nil {
+		return true // ### return, already connected ###
+	}
+	if time.Since(prod.lastFailure) < prod.reconnectDelay {
+		return false // ### return, wait before reconnecting ###
+	}
+
+	conn, err := net.Dial(prod.protocol, prod.address)
+	if err != nil {
+		Log.Error.Print("Statsd connection error - ", err)
+		prod.lastFailure = time.Now()
+		return false
+	}
+
+	prod.connection = conn
+	return true
+}
+
+// sendMetrics sends all aggregated metrics and starts a new flush interval.
+func (prod *Statsd) sendMetrics() {
+	if len(prod.metrics) == 0 {
+		return // ### return, nothing to send ###
+	}
+
+	packets := shared.StatsdPackets(prod.lines(), prod.maxPacketSize)
+	prod.metrics = make(map[string]*statsdMetric)
+	prod.overflow = false
+
+	// Try to send the metrics, reconnect once if the connection was lost
+	for retry := 0; retry < 2 && len(packets) > 0; retry++ {
+		if !prod.connect() {
+			break // ### break, not connected ###
+		}
+		for len(packets) > 0 {
+			packet := packets[0]
+			if prod.protocol == "tcp" {
+				packet = append(packet, '\n')
+			}
+			if _, err := prod.connection.Write(packet); err != nil {
+				Log.Error.Print("Statsd write error - ", err)
+				prod.connection.Close()
+				prod.connection = nil
+				break // ### break, reconnect ###
+			}
+			packets = packets[1:]
+		}
+	}
+
+	if len(packets) > 0 {
+		Log.Warning.Printf("Statsd: Dropped %d packets", len(packets))
+	}
+}
+
+func (prod *Statsd) close() {
+	defer prod.WorkerDone()
+	prod.sendMetrics()
+	if prod.connection != nil {
+		prod.connection.Close()
+	}
+}
+
+// Produce aggregates metrics and sends them once per flush interval.
+func (prod *Statsd) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	prod.AddMainWorker(workers)
+	prod.TickerControlLoop(prod.flushInterval, prod.addMessage, nil, prod.sendMetrics)
+}
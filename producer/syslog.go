@@ -0,0 +1,351 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/log"
+	"github.com/trivago/gollum/shared"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SyslogMetadataFacility is the metadata key overriding the facility of a
+	// message. Facility names and numbers are accepted.
+	SyslogMetadataFacility = "syslog_facility"
+	// SyslogMetadataSeverity is the metadata key overriding the severity of a
+	// message. Severity names and numbers are accepted.
+	SyslogMetadataSeverity = "syslog_severity"
+	// SyslogMetadataAppName is the metadata key overriding the app-name (or
+	// tag) of a message.
+	SyslogMetadataAppName = "syslog_appname"
+	// SyslogMetadataMsgID is the metadata key overriding the msgid of a
+	// message.
+	SyslogMetadataMsgID = "syslog_msgid"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3,
+	"warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Syslog producer plugin
+// Configuration example
+//
+//   - "producer.Syslog":
+//     Enable: true
+//     Address: "udp://localhost:514"
+//     Format: "RFC5424"
+//     Framing: "octet-counting"
+//     Facility: "user"
+//     Severity: "notice"
+//     AppName: "gollum"
+//     Hostname: ""
+//     MsgID: ""
+//     ReconnectDelayMs: 1000
+//     TLSCA: "/etc/ssl/ca.pem"
+//     TLSCert: ""
+//     TLSKey: ""
+//     TLSServerName: ""
+//     TLSInsecureSkipVerify: false
+//
+// The syslog producer sends messages to a syslog server. Each message is
+// prepended with a syslog header.
+//
+// Address defines the server to connect to. The protocol can be given as
+// "udp://", "tcp://" or "tls://". By default this is set to
+// "udp://localhost:514".
+//
+// Format defines the syslog standard used for the message header. This can be
+// set to "RFC5424" or "RFC3164". By default this is set to "RFC5424".
+//
+// Framing defines how messages are separated on TCP and TLS connections.
+// If set to "octet-counting" each message is prefixed by its length as of
+// RFC6587. If set to "newline" each message is terminated by "\n". UDP
+// messages are never framed. By default this is set to "octet-counting".
+//
+// Facility defines the syslog facility as name (e.g. "local0") or number.
+// Severity defines the syslog severity as name (e.g. "err") or number.
+// Both values can be overridden per message by the metadata fields
+// "syslog_facility" and "syslog_severity". By default these are set to
+// "user" and "notice".
+//
+// AppName defines the app-name (RFC5424) or tag (RFC3164) of messages. This
+// can be overridden per message by the metadata field "syslog_appname".
+// By default this is set to "gollum".
+//
+// Hostname defines the hostname sent with each message. When left empty the
+// hostname of the machine is used. By default this is set to "".
+//
+// MsgID defines the msgid of RFC5424 messages. This can be overridden per
+// message by the metadata field "syslog_msgid". By default this is set to "",
+// i.e. no msgid is sent.
+//
+// ReconnectDelayMs defines the number of milliseconds to wait before trying to
+// reconnect after a connection failed. Messages arriving in the meantime are
+// dropped. By default this is set to 1000.
+//
+// TLSCA defines a file containing the CA certificates used to verify the
+// server certificate. When left empty the system CAs are used.
+//
+// TLSCert and TLSKey define a client certificate and key presented to the
+// server. By default no client certificate is sent.
+//
+// TLSServerName defines the name used to verify the server certificate. When
+// left empty the host part of Address is used.
+//
+// TLSInsecureSkipVerify can be set to true to disable verification of the
+// server certificate. By default this is set to false.
+type Syslog struct {
+	core.ProducerBase
+	connection     net.Conn
+	tlsConfig      *tls.Config
+	protocol       string
+	address        string
+	rfc3164        bool
+	octetCounting  bool
+	facility       int
+	severity       int
+	appName        string
+	hostname       string
+	msgID          string
+	procID         string
+	reconnectDelay time.Duration
+	lastFailure    time.Time
+}
+
+func init() {
+	shared.RuntimeType.Register(Syslog{})
+}
+
+func parseSyslogLevel(value string, names map[string]int, maxValue int) (int, error) {
+	if level, isName := names[strings.ToLower(value)]; isName {
+		return level, nil
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 0 || level > maxValue {
+		return 0, fmt.Errorf("Unknown syslog level \"%s\"", value)
+	}
+	return level, nil
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Syslog) Configure(conf core.PluginConfig) error {
+	err := prod.ProducerBase.Configure(conf)
+	if err != nil {
+		return err
+	}
+
+	prod.address, prod.protocol = shared.ParseAddress(conf.GetString("Address", "udp://localhost:514"))
+	switch prod.protocol {
+	case "udp", "tcp":
+	case "tls":
+		prod.tlsConfig, err = shared.NewClientTLSConfig(
+			conf.GetString("TLSCA", ""),
+			conf.GetString("TLSCert", ""),
+			conf.GetString("TLSKey", ""),
+			conf.GetString("TLSServerName", ""),
+			conf.GetBool("TLSInsecureSkipVerify", false))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Syslog: unknown protocol type %s", prod.protocol)
+	}
+
+	switch strings.ToUpper(conf.GetString("Format", "RFC5424")) {
+	case "RFC5424":
+	case "RFC3164":
+		prod.rfc3164 = true
+	default:
+		return fmt.Errorf("Syslog: Format %s is not supported", conf.GetString("Format", ""))
+	}
+
+	switch strings.ToLower(conf.GetString("Framing", "octet-counting")) {
+	case "octet-counting":
+		prod.octetCounting = prod.protocol != "udp"
+	case "newline":
+	default:
+		return fmt.Errorf("Syslog: Framing %s is not supported", conf.GetString("Framing", ""))
+	}
+
+	if prod.facility, err = parseSyslogLevel(conf.GetString("Facility", "user"), syslogFacilities, 23); err != nil {
+		return err
+	}
+	if prod.severity, err = parseSyslogLevel(conf.GetString("Severity", "notice"), syslogSeverities, 7); err != nil {
+		return err
+	}
+
+	prod.appName = conf.GetString("AppName", "gollum")
+	prod.msgID = conf.GetString("MsgID", "")
+	prod.hostname = conf.GetString("Hostname", "")
+	if prod.hostname == "" {
+		prod.hostname, _ = os.Hostname()
+	}
+
+	prod.procID = strconv.Itoa(os.Getpid())
+	prod.reconnectDelay = time.Duration(conf.GetInt("ReconnectDelayMs", 1000)) * time.Millisecond
+	return nil
+}
+
+// getSyslogMetadata returns the metadata field stored for key or defaultValue if
+// the field is not set.
+func getSyslogMetadata(msg core.Message, key string, defaultValue string) string {
+	if value, exists := msg.Metadata[key]; exists && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func syslogHeaderValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
+
+// frame formats a message as syslog message including the transport framing.
+func (prod *Syslog) frame(msg core.Message, payload []byte) []byte {
+	facility, severity := prod.facility, prod.severity
+	if value := getSyslogMetadata(msg, SyslogMetadataFacility, ""); value != "" {
+		if level, err := parseSyslogLevel(value, syslogFacilities, 23); err == nil {
+			facility = level
+		}
+	}
+	if value := getSyslogMetadata(msg, SyslogMetadataSeverity, ""); value != "" {
+		if level, err := parseSyslogLevel(value, syslogSeverities, 7); err == nil {
+			severity = level
+		}
+	}
+
+	appName := getSyslogMetadata(msg, SyslogMetadataAppName, prod.appName)
+	priority := facility<<3 | severity
+
+	var header string
+	if prod.rfc3164 {
+		header = fmt.Sprintf("<%d>%s %s %s[%s]: ", priority,
+			msg.Timestamp.Format(time.Stamp),
+			syslogHeaderValue(prod.hostname),
+			syslogHeaderValue(appName),
+			prod.procID)
+	} else {
+		header = fmt.Sprintf("<%d>1 %s %s %s %s %s - ", priority,
+			msg.Timestamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+			syslogHeaderValue(prod.hostname),
+			syslogHeaderValue(appName),
+			prod.procID,
+			syslogHeaderValue(getSyslogMetadata(msg, SyslogMetadataMsgID, prod.msgID)))
+	}
+
+	// Strip trailing newlines, messages are framed
+	for len(payload) > 0 && payload[len(payload)-1] == '\n' {
+		payload = payload[:len(payload)-1]
+	}
+
+	frameLen := len(header) + len(payload)
+	frame := make([]byte, 0, frameLen+12)
+
+	if prod.octetCounting {
+		frame = strconv.AppendInt(frame, int64(frameLen), 10)
+		frame = append(frame, ' ')
+	}
+	frame = append(frame, header...)
+	frame = append(frame, payload...)
+	if !prod.octetCounting && prod.protocol != "udp" {
+		frame = append(frame, '\n')
+	}
+	return frame
+}
+
+func (prod *Syslog) connect() bool {
+	if prod.connection != nil {
+		return true // ### return, already connected ###
+	}
+	if time.Since(prod.lastFailure) < prod.reconnectDelay {
+		return false // ### return, wait before reconnecting ###
+	}
+
+	var conn net.Conn
+	var err error
+	if prod.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", prod.address, prod.tlsConfig)
+	} else {
+		conn, err = net.Dial(prod.protocol, prod.address)
+	}
+
+	if err != nil {
+		Log.Error.Print("Syslog connection error - ", err)
+		prod.lastFailure = time.Now()
+		return false
+	}
+
+	prod.connection = conn
+	return true
+}
+
+func (prod *Syslog) onWriteError(err error) {
+	Log.Error.Print("Syslog write error - ", err)
+	prod.connection.Close()
+	prod.connection = nil
+}
+
+func (prod *Syslog) sendMessage(msg core.Message) {
+	payload, _ := prod.ProducerBase.Format(msg)
+	frame := prod.frame(msg, payload)
+
+	// Try to send the message, reconnect once if the connection was lost
+	for retry := 0; retry < 2; retry++ {
+		if !prod.connect() {
+			break // ### break, not connected ###
+		}
+		if _, err := prod.connection.Write(frame); err != nil {
+			prod.onWriteError(err)
+			continue // ### continue, reconnect ###
+		}
+		return // ### return, sent ###
+	}
+
+	msg.Drop(prod.GetTimeout())
+}
+
+func (prod *Syslog) close() {
+	if prod.connection != nil {
+		prod.connection.Close()
+	}
+	prod.WorkerDone()
+}
+
+// Produce writes syslog messages to a given server.
+func (prod *Syslog) Produce(workers *sync.WaitGroup) {
+	defer prod.close()
+
+	prod.AddMainWorker(workers)
+	prod.DefaultControlLoop(prod.sendMessage, nil)
+}
@@ -0,0 +1,669 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQP 0-9-1 frame types
+const (
+	AMQPFrameMethod    = byte(1)
+	AMQPFrameHeader    = byte(2)
+	AMQPFrameBody      = byte(3)
+	AMQPFrameHeartbeat = byte(8)
+)
+
+// AMQP 0-9-1 class ids
+const (
+	AMQPClassConnection = uint16(10)
+	AMQPClassChannel    = uint16(20)
+	AMQPClassBasic      = uint16(60)
+	AMQPClassConfirm    = uint16(85)
+)
+
+// AMQP 0-9-1 method ids. Method ids are only unique within a class.
+const (
+	AMQPConnectionStart   = uint16(10)
+	AMQPConnectionStartOk = uint16(11)
+	AMQPConnectionTune    = uint16(30)
+	AMQPConnectionTuneOk  = uint16(31)
+	AMQPConnectionOpen    = uint16(40)
+	AMQPConnectionOpenOk  = uint16(41)
+	AMQPConnectionClose   = uint16(50)
+	AMQPConnectionCloseOk = uint16(51)
+
+	AMQPChannelOpen    = uint16(10)
+	AMQPChannelOpenOk  = uint16(11)
+	AMQPChannelClose   = uint16(40)
+	AMQPChannelCloseOk = uint16(41)
+
+	AMQPBasicQos       = uint16(10)
+	AMQPBasicQosOk     = uint16(11)
+	AMQPBasicConsume   = uint16(20)
+	AMQPBasicConsumeOk = uint16(21)
+	AMQPBasicCancel    = uint16(30)
+	AMQPBasicPublish   = uint16(40)
+	AMQPBasicReturn    = uint16(50)
+	AMQPBasicDeliver   = uint16(60)
+	AMQPBasicAck       = uint16(80)
+	AMQPBasicNack      = uint16(120)
+
+	AMQPConfirmSelect   = uint16(10)
+	AMQPConfirmSelectOk = uint16(11)
+)
+
+// Bits of the content header property flags
+const (
+	amqpPropertyContentType  = uint16(1 << 15)
+	amqpPropertyDeliveryMode = uint16(1 << 12)
+	amqpPropertyTimestamp    = uint16(1 << 6)
+)
+
+const (
+	amqpFrameEnd      = byte(0xCE)
+	amqpChannel       = uint16(1)
+	amqpFrameMax      = 131072
+	amqpFrameOverhead = 8
+)
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// AMQPFrame is a single AMQP frame.
+type AMQPFrame struct {
+	Type    byte
+	Channel uint16
+	Payload []byte
+}
+
+// AMQPError is returned if the broker closes the connection or the channel.
+type AMQPError struct {
+	Code uint16
+	Text string
+}
+
+// Error implements the standard error interface
+func (err AMQPError) Error() string {
+	return fmt.Sprintf("AMQP: %d %s", err.Code, err.Text)
+}
+
+// ReadAMQPFrame reads a single frame from the given reader. Frames larger than
+// maxSize bytes are rejected if maxSize is greater than 0.
+func ReadAMQPFrame(reader io.Reader, maxSize int) (AMQPFrame, error) {
+	frame := AMQPFrame{}
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return frame, err
+	}
+
+	frame.Type = header[0]
+	frame.Channel = binary.BigEndian.Uint16(header[1:3])
+	size := int(binary.BigEndian.Uint32(header[3:7]))
+	if maxSize > 0 && size > maxSize {
+		return frame, fmt.Errorf("AMQP: frame of %d bytes exceeds the maximum size", size)
+	}
+
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return frame, err
+	}
+	if data[size] != amqpFrameEnd {
+		return frame, fmt.Errorf("AMQP: invalid frame end")
+	}
+	frame.Payload = data[:size]
+	return frame, nil
+}
+
+// WriteAMQPFrame writes a single frame to the given writer.
+func WriteAMQPFrame(writer io.Writer, frame AMQPFrame) error {
+	data := NewAMQPWriter(len(frame.Payload) + amqpFrameOverhead)
+	data.WriteOctet(frame.Type)
+	data.WriteShort(frame.Channel)
+	data.WriteLong(uint32(len(frame.Payload)))
+	data.WriteRaw(frame.Payload)
+	data.WriteOctet(amqpFrameEnd)
+
+	_, err := writer.Write(data.Bytes())
+	return err
+}
+
+// AMQPWriter encodes the arguments of AMQP methods.
+type AMQPWriter struct {
+	data []byte
+}
+
+// NewAMQPWriter creates a new writer with the given initial capacity.
+func NewAMQPWriter(size int) *AMQPWriter {
+	return &AMQPWriter{make([]byte, 0, size)}
+}
+
+// Bytes returns the encoded data.
+func (writer *AMQPWriter) Bytes() []byte {
+	return writer.data
+}
+
+// WriteOctet writes a single byte.
+func (writer *AMQPWriter) WriteOctet(value byte) {
+	writer.data = append(writer.data, value)
+}
+
+// WriteShort writes a big endian two byte integer.
+func (writer *AMQPWriter) WriteShort(value uint16) {
+	writer.data = append(writer.data, byte(value>>8), byte(value))
+}
+
+// WriteLong writes a big endian four byte integer.
+func (writer *AMQPWriter) WriteLong(value uint32) {
+	writer.data = append(writer.data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// WriteLonglong writes a big endian eight byte integer.
+func (writer *AMQPWriter) WriteLonglong(value uint64) {
+	writer.WriteLong(uint32(value >> 32))
+	writer.WriteLong(uint32(value))
+}
+
+// WriteShortstr writes a string with a one byte length prefix. Strings are
+// truncated to 255 bytes.
+func (writer *AMQPWriter) WriteShortstr(value string) {
+	if len(value) > 255 {
+		value = value[:255]
+	}
+	writer.WriteOctet(byte(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteLongstr writes a string with a four byte length prefix.
+func (writer *AMQPWriter) WriteLongstr(value []byte) {
+	writer.WriteLong(uint32(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteBits writes up to eight flags packed into one byte. The first flag is
+// stored in the lowest bit.
+func (writer *AMQPWriter) WriteBits(flags ...bool) {
+	value := byte(0)
+	for i, flag := range flags {
+		if flag {
+			value |= 1 << uint(i)
+		}
+	}
+	writer.WriteOctet(value)
+}
+
+// WriteTable writes a field table. Supported value types are string, bool,
+// int, int32, int64 and nested tables.
+func (writer *AMQPWriter) WriteTable(table map[string]interface{}) {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := NewAMQPWriter(64)
+	for _, key := range keys {
+		fields.WriteShortstr(key)
+		switch value := table[key].(type) {
+		case string:
+			fields.WriteOctet('S')
+			fields.WriteLongstr([]byte(value))
+		case bool:
+			fields.WriteOctet('t')
+			fields.WriteBits(value)
+		case int:
+			fields.WriteOctet('l')
+			fields.WriteLonglong(uint64(value))
+		case int32:
+			fields.WriteOctet('I')
+			fields.WriteLong(uint32(value))
+		case int64:
+			fields.WriteOctet('l')
+			fields.WriteLonglong(uint64(value))
+		case map[string]interface{}:
+			fields.WriteOctet('F')
+			fields.WriteTable(value)
+		default:
+			fields.WriteOctet('V')
+		}
+	}
+	writer.WriteLongstr(fields.Bytes())
+}
+
+// WriteRaw appends the given data as-is.
+func (writer *AMQPWriter) WriteRaw(value []byte) {
+	writer.data = append(writer.data, value...)
+}
+
+// AMQPReader decodes the arguments of AMQP methods.
+type AMQPReader struct {
+	data   []byte
+	offset int
+}
+
+// NewAMQPReader creates a new reader for the given data.
+func NewAMQPReader(data []byte) *AMQPReader {
+	return &AMQPReader{data, 0}
+}
+
+func (reader *AMQPReader) next(size int) ([]byte, error) {
+	if size < 0 || reader.offset+size > len(reader.data) {
+		return nil, fmt.Errorf("AMQP: unexpected end of frame")
+	}
+	data := reader.data[reader.offset : reader.offset+size]
+	reader.offset += size
+	return data, nil
+}
+
+// ReadOctet reads a single byte.
+func (reader *AMQPReader) ReadOctet() (byte, error) {
+	data, err := reader.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+// ReadShort reads a big endian two byte integer.
+func (reader *AMQPReader) ReadShort() (uint16, error) {
+	data, err := reader.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(data), nil
+}
+
+// ReadLong reads a big endian four byte integer.
+func (reader *AMQPReader) ReadLong() (uint32, error) {
+	data, err := reader.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// ReadLonglong reads a big endian eight byte integer.
+func (reader *AMQPReader) ReadLonglong() (uint64, error) {
+	data, err := reader.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// ReadShortstr reads a string with a one byte length prefix.
+func (reader *AMQPReader) ReadShortstr() (string, error) {
+	length, err := reader.ReadOctet()
+	if err != nil {
+		return "", err
+	}
+	data, err := reader.next(int(length))
+	return string(data), err
+}
+
+// ReadLongstr reads a string with a four byte length prefix. Field tables
+// can be skipped by using this function, too.
+func (reader *AMQPReader) ReadLongstr() ([]byte, error) {
+	length, err := reader.ReadLong()
+	if err != nil {
+		return nil, err
+	}
+	return reader.next(int(length))
+}
+
+// DecodeAMQPMethod returns the class id, the method id and a reader for the
+// arguments of a method frame.
+func DecodeAMQPMethod(frame AMQPFrame) (uint16, uint16, *AMQPReader, error) {
+	if frame.Type != AMQPFrameMethod || len(frame.Payload) < 4 {
+		return 0, 0, nil, fmt.Errorf("AMQP: expected method frame, got frame type %d", frame.Type)
+	}
+	classID := binary.BigEndian.Uint16(frame.Payload[0:2])
+	methodID := binary.BigEndian.Uint16(frame.Payload[2:4])
+	return classID, methodID, NewAMQPReader(frame.Payload[4:]), nil
+}
+
+// DecodeAMQPClose returns the error sent with a connection.close or
+// channel.close method.
+func DecodeAMQPClose(args *AMQPReader) AMQPError {
+	code, _ := args.ReadShort()
+	text, _ := args.ReadShortstr()
+	return AMQPError{code, text}
+}
+
+// DecodeAMQPContentHeader returns the body size stored in a content header
+// frame. Properties are ignored.
+func DecodeAMQPContentHeader(frame AMQPFrame) (uint64, error) {
+	if frame.Type != AMQPFrameHeader {
+		return 0, fmt.Errorf("AMQP: expected content header, got frame type %d", frame.Type)
+	}
+	reader := NewAMQPReader(frame.Payload)
+	if _, err := reader.next(4); err != nil {
+		return 0, err
+	}
+	return reader.ReadLonglong()
+}
+
+// AMQPOptions contains the settings used when opening a connection.
+type AMQPOptions struct {
+	Username  string
+	Password  string
+	VHost     string
+	Heartbeat time.Duration
+}
+
+// AMQPProperties contains the message properties sent with basic.publish.
+// Empty values are not sent.
+type AMQPProperties struct {
+	ContentType string
+	Persistent  bool
+	Timestamp   time.Time
+}
+
+// AMQPClient is a connection to an AMQP 0-9-1 broker using a single channel.
+// Frames can be written by multiple goroutines but have to be read by a
+// single goroutine.
+type AMQPClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	guard     *sync.Mutex
+	lastWrite time.Time
+	frameMax  int
+	heartbeat time.Duration
+}
+
+// DialAMQP connects to an AMQP 0-9-1 broker, authenticates using the PLAIN
+// mechanism and opens a channel. The connection uses TLS if tlsConfig is not
+// nil. The given timeout is used for connecting and the handshake.
+func DialAMQP(network string, address string, tlsConfig *tls.Config, timeout time.Duration, options AMQPOptions) (*AMQPClient, error) {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, network, address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &AMQPClient{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		guard:    new(sync.Mutex),
+		frameMax: amqpFrameMax,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := client.handshake(options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (client *AMQPClient) handshake(options AMQPOptions) error {
+	if _, err := client.conn.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+
+	args, err := client.expect(0, AMQPClassConnection, AMQPConnectionStart)
+	if err != nil {
+		return err
+	}
+	args.next(2) // version
+	args.ReadLongstr()
+	mechanisms, _ := args.ReadLongstr()
+	if !strings.Contains(" "+string(mechanisms)+" ", " PLAIN ") {
+		return fmt.Errorf("AMQP: broker does not support PLAIN authentication")
+	}
+
+	startOk := NewAMQPWriter(256)
+	startOk.WriteTable(map[string]interface{}{
+		"product": "gollum",
+		"capabilities": map[string]interface{}{
+			"publisher_confirms":     true,
+			"consumer_cancel_notify": true,
+		},
+	})
+	startOk.WriteShortstr("PLAIN")
+	startOk.WriteLongstr([]byte("\x00" + options.Username + "\x00" + options.Password))
+	startOk.WriteShortstr("en_US")
+	if err := client.WriteMethod(0, AMQPClassConnection, AMQPConnectionStartOk, startOk.Bytes()); err != nil {
+		return err
+	}
+
+	if args, err = client.expect(0, AMQPClassConnection, AMQPConnectionTune); err != nil {
+		return err
+	}
+	channelMax, _ := args.ReadShort()
+	frameMax, _ := args.ReadLong()
+	heartbeat, _ := args.ReadShort()
+
+	if frameMax > 0 && int(frameMax) < client.frameMax {
+		client.frameMax = int(frameMax)
+	}
+	client.heartbeat = options.Heartbeat
+	if serverHeartbeat := time.Duration(heartbeat) * time.Second; client.heartbeat > 0 && serverHeartbeat > 0 && serverHeartbeat < client.heartbeat {
+		client.heartbeat = serverHeartbeat
+	}
+	if channelMax == 0 || channelMax > amqpChannel {
+		channelMax = amqpChannel
+	}
+
+	tuneOk := NewAMQPWriter(8)
+	tuneOk.WriteShort(channelMax)
+	tuneOk.WriteLong(uint32(client.frameMax))
+	tuneOk.WriteShort(uint16(client.heartbeat / time.Second))
+	if err := client.WriteMethod(0, AMQPClassConnection, AMQPConnectionTuneOk, tuneOk.Bytes()); err != nil {
+		return err
+	}
+
+	open := NewAMQPWriter(len(options.VHost) + 3)
+	open.WriteShortstr(options.VHost)
+	open.WriteShortstr("")
+	open.WriteBits(false)
+	if err := client.WriteMethod(0, AMQPClassConnection, AMQPConnectionOpen, open.Bytes()); err != nil {
+		return err
+	}
+	if _, err := client.expect(0, AMQPClassConnection, AMQPConnectionOpenOk); err != nil {
+		return err
+	}
+
+	return client.Call(AMQPClassChannel, AMQPChannelOpen, []byte{0}, AMQPChannelOpenOk)
+}
+
+// expect reads the next method frame and returns its arguments. An error is
+// returned if the method does not match or the broker closed the connection
+// or channel.
+func (client *AMQPClient) expect(channel uint16, classID uint16, methodID uint16) (*AMQPReader, error) {
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type == AMQPFrameHeartbeat {
+			continue // ### continue, ignore heartbeats ###
+		}
+
+		frameClass, frameMethod, args, err := DecodeAMQPMethod(frame)
+		switch {
+		case err != nil:
+			return nil, err
+		case frameClass == classID && frameMethod == methodID && frame.Channel == channel:
+			return args, nil
+		}
+		if err := client.CheckClose(frameClass, frameMethod, args); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("AMQP: unexpected method %d.%d", frameClass, frameMethod)
+	}
+}
+
+// CheckClose returns an AMQPError if the given method closes the connection or
+// the channel. The close is confirmed to the broker.
+func (client *AMQPClient) CheckClose(classID uint16, methodID uint16, args *AMQPReader) error {
+	switch {
+	case classID == AMQPClassConnection && methodID == AMQPConnectionClose:
+		client.WriteMethod(0, AMQPClassConnection, AMQPConnectionCloseOk, nil)
+		return DecodeAMQPClose(args)
+	case classID == AMQPClassChannel && methodID == AMQPChannelClose:
+		client.WriteMethod(amqpChannel, AMQPClassChannel, AMQPChannelCloseOk, nil)
+		return DecodeAMQPClose(args)
+	}
+	return nil
+}
+
+// Call sends a method on the channel of this client and waits for the given
+// response method of the same class. This must only be used while no other
+// goroutine reads from this client.
+func (client *AMQPClient) Call(classID uint16, methodID uint16, args []byte, responseID uint16) error {
+	if err := client.WriteMethod(amqpChannel, classID, methodID, args); err != nil {
+		return err
+	}
+	_, err := client.expect(amqpChannel, classID, responseID)
+	return err
+}
+
+// ReadFrame reads the next frame.
+func (client *AMQPClient) ReadFrame() (AMQPFrame, error) {
+	return ReadAMQPFrame(client.reader, client.frameMax)
+}
+
+// WriteMethod sends a method frame. Channel 0 is used for connection methods,
+// all other methods have to use the channel of this client.
+func (client *AMQPClient) WriteMethod(channel uint16, classID uint16, methodID uint16, args []byte) error {
+	payload := NewAMQPWriter(len(args) + 4)
+	payload.WriteShort(classID)
+	payload.WriteShort(methodID)
+	payload.WriteRaw(args)
+	return client.write(AMQPFrame{AMQPFrameMethod, channel, payload.Bytes()})
+}
+
+// WriteChannelMethod sends a method frame on the channel of this client.
+func (client *AMQPClient) WriteChannelMethod(classID uint16, methodID uint16, args []byte) error {
+	return client.WriteMethod(amqpChannel, classID, methodID, args)
+}
+
+func (client *AMQPClient) write(frames ...AMQPFrame) error {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	client.lastWrite = time.Now()
+
+	writer := bufio.NewWriter(client.conn)
+	for _, frame := range frames {
+		if err := WriteAMQPFrame(writer, frame); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Publish sends a message to the given exchange. The message body is split
+// into multiple frames if necessary.
+func (client *AMQPClient) Publish(exchange string, routingKey string, properties AMQPProperties, body []byte) error {
+	method := NewAMQPWriter(len(exchange) + len(routingKey) + 9)
+	method.WriteShort(AMQPClassBasic)
+	method.WriteShort(AMQPBasicPublish)
+	method.WriteShort(0)
+	method.WriteShortstr(exchange)
+	method.WriteShortstr(routingKey)
+	method.WriteBits(false, false)
+
+	flags := uint16(0)
+	props := NewAMQPWriter(len(properties.ContentType) + 16)
+	if properties.ContentType != "" {
+		flags |= amqpPropertyContentType
+		props.WriteShortstr(properties.ContentType)
+	}
+	if properties.Persistent {
+		flags |= amqpPropertyDeliveryMode
+		props.WriteOctet(2)
+	}
+	if !properties.Timestamp.IsZero() {
+		flags |= amqpPropertyTimestamp
+		props.WriteLonglong(uint64(properties.Timestamp.Unix()))
+	}
+
+	header := NewAMQPWriter(14 + len(props.Bytes()))
+	header.WriteShort(AMQPClassBasic)
+	header.WriteShort(0)
+	header.WriteLonglong(uint64(len(body)))
+	header.WriteShort(flags)
+	header.WriteRaw(props.Bytes())
+
+	frames := []AMQPFrame{
+		{AMQPFrameMethod, amqpChannel, method.Bytes()},
+		{AMQPFrameHeader, amqpChannel, header.Bytes()},
+	}
+	for maxBody := client.frameMax - amqpFrameOverhead; len(body) > 0; {
+		size := len(body)
+		if size > maxBody {
+			size = maxBody
+		}
+		frames = append(frames, AMQPFrame{AMQPFrameBody, amqpChannel, body[:size]})
+		body = body[size:]
+	}
+	return client.write(frames...)
+}
+
+// Heartbeat sends a heartbeat frame if no frame has been sent for half of the
+// negotiated heartbeat interval.
+func (client *AMQPClient) Heartbeat() error {
+	client.guard.Lock()
+	idle := time.Since(client.lastWrite)
+	client.guard.Unlock()
+
+	if client.heartbeat <= 0 || idle < client.heartbeat/2 {
+		return nil // ### return, not idle ###
+	}
+	return client.write(AMQPFrame{AMQPFrameHeartbeat, 0, nil})
+}
+
+// HeartbeatInterval returns the negotiated heartbeat interval. A value of 0
+// means that heartbeats are disabled.
+func (client *AMQPClient) HeartbeatInterval() time.Duration {
+	return client.heartbeat
+}
+
+// SetReadDeadline sets the deadline for reading frames.
+func (client *AMQPClient) SetReadDeadline(deadline time.Time) error {
+	return client.conn.SetReadDeadline(deadline)
+}
+
+// Close sends connection.close and closes the connection without waiting
+// for the broker's response.
+func (client *AMQPClient) Close() error {
+	args := NewAMQPWriter(8)
+	args.WriteShort(200)
+	args.WriteShortstr("")
+	args.WriteShort(0)
+	args.WriteShort(0)
+
+	client.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	client.WriteMethod(0, AMQPClassConnection, AMQPConnectionClose, args.Bytes())
+	return client.conn.Close()
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAMQPFrame(t *testing.T) {
+	expect := NewExpect(t)
+	buffer := bytes.Buffer{}
+
+	args := NewAMQPWriter(16)
+	args.WriteLonglong(42)
+	args.WriteBits(true, false, true)
+
+	method := NewAMQPWriter(16)
+	method.WriteShort(AMQPClassBasic)
+	method.WriteShort(AMQPBasicAck)
+	method.WriteRaw(args.Bytes())
+
+	expect.NoError(WriteAMQPFrame(&buffer, AMQPFrame{AMQPFrameMethod, 1, method.Bytes()}))
+	expect.Equal([]byte{AMQPFrameMethod, 0, 1, 0, 0, 0, 13}, buffer.Bytes()[:7])
+	expect.Equal(byte(0xCE), buffer.Bytes()[buffer.Len()-1])
+
+	frame, err := ReadAMQPFrame(bytes.NewReader(buffer.Bytes()), 0)
+	expect.NoError(err)
+	expect.Equal(uint16(1), frame.Channel)
+
+	classID, methodID, reader, err := DecodeAMQPMethod(frame)
+	expect.NoError(err)
+	expect.Equal(AMQPClassBasic, classID)
+	expect.Equal(AMQPBasicAck, methodID)
+
+	tag, _ := reader.ReadLonglong()
+	expect.Equal(uint64(42), tag)
+	bits, _ := reader.ReadOctet()
+	expect.Equal(byte(5), bits)
+
+	_, err = reader.ReadOctet()
+	expect.NotNil(err)
+
+	// Frames exceeding the maximum size are rejected
+	_, err = ReadAMQPFrame(bytes.NewReader(buffer.Bytes()), 8)
+	expect.NotNil(err)
+
+	// Frames have to be terminated by the frame end octet
+	data := buffer.Bytes()
+	data[len(data)-1] = 0
+	_, err = ReadAMQPFrame(bytes.NewReader(data), 0)
+	expect.NotNil(err)
+}
+
+func TestAMQPTable(t *testing.T) {
+	expect := NewExpect(t)
+
+	writer := NewAMQPWriter(64)
+	writer.WriteTable(map[string]interface{}{
+		"b": true,
+		"a": "x",
+	})
+
+	// Keys are sorted
+	expect.Equal("\x00\x00\x00\x0C\x01aS\x00\x00\x00\x01x\x01bt\x01", string(writer.Bytes()))
+
+	reader := NewAMQPReader(writer.Bytes())
+	table, err := reader.ReadLongstr()
+	expect.NoError(err)
+	expect.Equal(12, len(table))
+
+	writer = NewAMQPWriter(8)
+	writer.WriteTable(nil)
+	expect.Equal([]byte{0, 0, 0, 0}, writer.Bytes())
+}
+
+func TestAMQPContentHeader(t *testing.T) {
+	expect := NewExpect(t)
+
+	header := NewAMQPWriter(16)
+	header.WriteShort(AMQPClassBasic)
+	header.WriteShort(0)
+	header.WriteLonglong(1000)
+	header.WriteShort(0)
+
+	size, err := DecodeAMQPContentHeader(AMQPFrame{AMQPFrameHeader, 1, header.Bytes()})
+	expect.NoError(err)
+	expect.Equal(uint64(1000), size)
+
+	_, err = DecodeAMQPContentHeader(AMQPFrame{AMQPFrameBody, 1, header.Bytes()})
+	expect.NotNil(err)
+
+	closeArgs := NewAMQPWriter(16)
+	closeArgs.WriteShort(404)
+	closeArgs.WriteShortstr("NOT_FOUND")
+	closeErr := DecodeAMQPClose(NewAMQPReader(closeArgs.Bytes()))
+	expect.Equal(uint16(404), closeErr.Code)
+	expect.Equal("AMQP: 404 NOT_FOUND", closeErr.Error())
+}
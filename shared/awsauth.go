@@ -0,0 +1,600 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsSigningAlgorithm   = "AWS4-HMAC-SHA256"
+	awsTimeFormat         = "20060102T150405Z"
+	awsRefreshGap         = 5 * time.Minute
+	awsContainerHost      = "http://169.254.170.2"
+	awsMetadataEndpoint   = "http://169.254.169.254"
+	awsDefaultSTSEndpoint = "https://sts.amazonaws.com"
+)
+
+// AWSCredentials signs requests to AWS APIs using signature version 4.
+// Credentials are either given directly or loaded from the same sources the
+// AWS SDKs use: the environment variables AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, a web identity token (AWS_WEB_IDENTITY_TOKEN_FILE and
+// AWS_ROLE_ARN, e.g. IAM roles for Kubernetes service accounts), the shared
+// credentials file, the ECS container credentials endpoint and the EC2
+// instance metadata service. Temporary credentials are refreshed shortly
+// before they expire.
+type AWSCredentials struct {
+	source          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time
+	roleARN         string
+	tokenFile       string
+	client          *http.Client
+	guard           *sync.Mutex
+}
+
+type awsTemporaryCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// AWSAPIError is returned if an AWS API answered a request with an error.
+type AWSAPIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// Error implements the error interface
+func (err AWSAPIError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", err.Code, err.StatusCode, err.Message)
+}
+
+// Temporary returns true if the request failed because of a server error or
+// throttling and may succeed if it is sent again.
+func (err AWSAPIError) Temporary() bool {
+	if err.StatusCode >= 500 || err.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return IsAWSTemporaryCode(err.Code)
+}
+
+// IsAWSThrottlingCode returns true if the given error code is returned by AWS
+// APIs if requests are throttled.
+func IsAWSThrottlingCode(code string) bool {
+	switch code {
+	case "Throttling", "ThrottlingException", "ThrottledException", "RequestThrottled",
+		"RequestThrottledException", "TooManyRequestsException", "RequestLimitExceeded",
+		"ProvisionedThroughputExceededException", "LimitExceededException",
+		"KMSThrottlingException":
+		return true
+	}
+	return false
+}
+
+// IsAWSTemporaryCode returns true if the given error code is returned by AWS
+// APIs if requests are throttled or failed because of a server error.
+func IsAWSTemporaryCode(code string) bool {
+	switch code {
+	case "ServiceUnavailable", "InternalFailure", "InternalError":
+		return true
+	}
+	return IsAWSThrottlingCode(code)
+}
+
+// NewAWSCredentials creates credentials using the given access key. If no
+// access key is given credentials are searched in the environment, in the
+// shared credentials file using the given profile and at the container and
+// instance metadata endpoints. If profile is empty AWS_PROFILE or "default"
+// is used.
+func NewAWSCredentials(accessKeyID, secretAccessKey, sessionToken, profile string) (*AWSCredentials, error) {
+	creds := &AWSCredentials{
+		source: "static",
+		client: &http.Client{Timeout: 10 * time.Second},
+		guard:  new(sync.Mutex),
+	}
+
+	switch {
+	case accessKeyID != "":
+		if secretAccessKey == "" {
+			return nil, fmt.Errorf("No secret access key given for %s", accessKeyID)
+		}
+		creds.accessKeyID = accessKeyID
+		creds.secretAccessKey = secretAccessKey
+		creds.sessionToken = sessionToken
+		return creds, nil // ### return, static credentials ###
+
+	case profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		creds.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		creds.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		return creds, nil // ### return, environment ###
+
+	case profile == "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		creds.source = "webidentity"
+		creds.tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		creds.roleARN = os.Getenv("AWS_ROLE_ARN")
+		return creds, nil // ### return, web identity ###
+	}
+
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	explicitProfile := profile != ""
+	if profile == "" {
+		profile = "default"
+	}
+
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			file = filepath.Join(home, ".aws", "credentials")
+		}
+	}
+
+	values, err := readAWSProfile(file, profile)
+	switch {
+	case err == nil && values["aws_access_key_id"] != "":
+		creds.accessKeyID = values["aws_access_key_id"]
+		creds.secretAccessKey = values["aws_secret_access_key"]
+		creds.sessionToken = values["aws_session_token"]
+		return creds, nil // ### return, shared credentials file ###
+
+	case explicitProfile:
+		if err == nil {
+			err = fmt.Errorf("Profile %s not found in %s", profile, file)
+		}
+		return nil, err // ### return, profile required ###
+	}
+
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		creds.source = "container"
+	} else {
+		creds.source = "metadata"
+	}
+	return creds, nil
+}
+
+// readAWSProfile reads the values of a profile from a shared credentials file.
+func readAWSProfile(file string, profile string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			// Comment
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(strings.TrimPrefix(line[1:len(line)-1], "profile "))
+		case section == profile:
+			if separator := strings.IndexByte(line, '='); separator > 0 {
+				values[strings.TrimSpace(line[:separator])] = strings.TrimSpace(line[separator+1:])
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// retrieve returns the current access key, requesting new temporary
+// credentials if required.
+func (creds *AWSCredentials) retrieve() (string, string, string, error) {
+	creds.guard.Lock()
+	defer creds.guard.Unlock()
+
+	if creds.source == "static" || (creds.accessKeyID != "" && time.Now().Add(awsRefreshGap).Before(creds.expires)) {
+		return creds.accessKeyID, creds.secretAccessKey, creds.sessionToken, nil // ### return, valid ###
+	}
+
+	var temporary awsTemporaryCredentials
+	var err error
+
+	switch creds.source {
+	case "webidentity":
+		temporary, err = creds.assumeRoleWithWebIdentity()
+	case "container":
+		temporary, err = creds.requestContainerCredentials()
+	default:
+		temporary, err = creds.requestInstanceCredentials()
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if temporary.AccessKeyID == "" {
+		return "", "", "", fmt.Errorf("No %s credentials returned", creds.source)
+	}
+	if temporary.SessionToken == "" {
+		temporary.SessionToken = temporary.Token
+	}
+
+	creds.accessKeyID = temporary.AccessKeyID
+	creds.secretAccessKey = temporary.SecretAccessKey
+	creds.sessionToken = temporary.SessionToken
+	if creds.expires, err = time.Parse(time.RFC3339, temporary.Expiration); err != nil {
+		creds.expires = time.Now().Add(15 * time.Minute)
+	}
+	return creds.accessKeyID, creds.secretAccessKey, creds.sessionToken, nil
+}
+
+func (creds *AWSCredentials) getJSON(req *http.Request, value interface{}) error {
+	resp, err := creds.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("Credentials request failed with %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func (creds *AWSCredentials) requestContainerCredentials() (awsTemporaryCredentials, error) {
+	temporary := awsTemporaryCredentials{}
+	credentialsURL := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		credentialsURL = awsContainerHost + relative
+	}
+
+	req, err := http.NewRequest("GET", credentialsURL, nil)
+	if err != nil {
+		return temporary, err
+	}
+
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return temporary, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	err = creds.getJSON(req, &temporary)
+	return temporary, err
+}
+
+// requestInstanceCredentials requests the credentials of the instance role
+// via IMDSv2.
+func (creds *AWSCredentials) requestInstanceCredentials() (awsTemporaryCredentials, error) {
+	temporary := awsTemporaryCredentials{}
+	endpoint := strings.TrimRight(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = awsMetadataEndpoint
+	}
+
+	req, _ := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := creds.client.Do(req)
+	if err != nil {
+		return temporary, fmt.Errorf("No AWS credentials found: %s", err)
+	}
+	token, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<12))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return temporary, fmt.Errorf("Instance metadata token request failed with %s", resp.Status)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, _ := http.NewRequest("GET", endpoint+path, nil)
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		resp, err := creds.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Instance metadata request failed with %s", resp.Status)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	}
+
+	roles, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return temporary, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return temporary, fmt.Errorf("No instance role found")
+	}
+
+	data, err := get("/latest/meta-data/iam/security-credentials/" + url.PathEscape(role))
+	if err != nil {
+		return temporary, err
+	}
+	err = json.Unmarshal(data, &temporary)
+	return temporary, err
+}
+
+func (creds *AWSCredentials) assumeRoleWithWebIdentity() (awsTemporaryCredentials, error) {
+	temporary := awsTemporaryCredentials{}
+	token, err := ioutil.ReadFile(creds.tokenFile)
+	if err != nil {
+		return temporary, err
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("gollum-%d", time.Now().Unix())
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if endpoint == "" {
+		endpoint = awsDefaultSTSEndpoint
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+		}
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {creds.roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := creds.client.PostForm(strings.TrimRight(endpoint, "/")+"/", query)
+	if err != nil {
+		return temporary, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return temporary, parseAWSError(resp)
+	}
+
+	result := struct {
+		Credentials awsTemporaryCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	return result.Credentials, err
+}
+
+// parseAWSError creates an AWSAPIError from a JSON or XML error response.
+func parseAWSError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<14))
+	apiErr := AWSAPIError{StatusCode: resp.StatusCode, Code: resp.Status}
+
+	jsonError := struct {
+		Type     string `json:"__type"`
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Message2 string `json:"Message"`
+	}{}
+	xmlError := struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}{}
+
+	switch {
+	case json.Unmarshal(body, &jsonError) == nil:
+		if jsonError.Type != "" {
+			apiErr.Code = jsonError.Type[strings.LastIndexByte(jsonError.Type, '#')+1:]
+		} else if jsonError.Code != "" {
+			apiErr.Code = jsonError.Code
+		}
+		apiErr.Message = jsonError.Message + jsonError.Message2
+
+	case xml.Unmarshal(body, &xmlError) == nil && xmlError.Code != "":
+		apiErr.Code = xmlError.Code
+		apiErr.Message = xmlError.Message
+
+	default:
+		apiErr.Message = string(bytes.TrimSpace(body))
+	}
+
+	// Errors of the SQS JSON protocol contain the legacy query error code
+	if queryError := resp.Header.Get("X-Amzn-Query-Error"); queryError != "" {
+		apiErr.Code = strings.SplitN(queryError, ";", 2)[0]
+	}
+	return apiErr
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+// awsEscape encodes a string as required by the canonical request.
+func awsEscape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+// Sign adds a signature version 4 authorization header to the given request.
+func (creds *AWSCredentials) Sign(req *http.Request, body []byte, service, region string, now time.Time) error {
+	accessKeyID, secretAccessKey, sessionToken, err := creds.retrieve()
+	if err != nil {
+		return err
+	}
+
+	timestamp := now.UTC().Format(awsTimeFormat)
+	date := timestamp[:8]
+	req.Header.Set("X-Amz-Date", timestamp)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// Canonical headers
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := bytes.Buffer{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := awsSigningAlgorithm + "\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := awsHMAC([]byte("AWS4"+secretAccessKey), date)
+	key = awsHMAC(key, region)
+	key = awsHMAC(key, service)
+	key = awsHMAC(key, "aws4_request")
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, accessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// do signs and sends a request and returns the response body. An AWSAPIError
+// is returned if the request has not been answered with 200.
+func (creds *AWSCredentials) do(ctx context.Context, client *http.Client, req *http.Request, body []byte, service, region string) ([]byte, error) {
+	if err := creds.Sign(req, body, service, region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseAWSError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// PostJSON sends a request to an AWS API using the JSON protocol, e.g.
+// target "AmazonSQS.SendMessage", and decodes the response into the given
+// value. The response is ignored if response is nil.
+func (creds *AWSCredentials) PostJSON(ctx context.Context, client *http.Client, endpoint, service, region, target, contentType string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Target", target)
+
+	data, err := creds.do(ctx, client, req, body, service, region)
+	if err != nil || response == nil {
+		return err
+	}
+	return json.Unmarshal(data, response)
+}
+
+// PostQuery sends a request to an AWS API using the query protocol and
+// decodes the XML response into the given value. The response is ignored if
+// response is nil.
+func (creds *AWSCredentials) PostQuery(ctx context.Context, client *http.Client, endpoint, service, region string, values url.Values, response interface{}) error {
+	body := []byte(values.Encode())
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	data, err := creds.do(ctx, client, req, body, service, region)
+	if err != nil || response == nil {
+		return err
+	}
+	return xml.Unmarshal(data, response)
+}
+
+// AWSRegion returns the region set by AWS_REGION or AWS_DEFAULT_REGION if the
+// given region is empty.
+func AWSRegion(region string) string {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return region
+}
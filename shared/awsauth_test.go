@@ -0,0 +1,107 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAWSSignature(t *testing.T) {
+	expect := NewExpect(t)
+
+	// "get-vanilla" of the AWS signature version 4 test suite
+	creds, err := NewAWSCredentials("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", "")
+	expect.NoError(err)
+
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse(awsTimeFormat, "20150830T123600Z")
+	expect.NoError(creds.Sign(req, nil, "service", "us-east-1", now))
+	expect.Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestAWSCredentials(t *testing.T) {
+	expect := NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum_aws")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+	fmt.Fprint(file, "[default]\naws_access_key_id = DEFAULT\naws_secret_access_key = secret\n\n"+
+		"# comment\n[profile test]\naws_access_key_id=TEST\naws_secret_access_key=secret\naws_session_token=token\n")
+	file.Close()
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", file.Name())
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	creds, err := NewAWSCredentials("", "", "", "test")
+	expect.NoError(err)
+	accessKeyID, _, sessionToken, _ := creds.retrieve()
+	expect.Equal("TEST", accessKeyID)
+	expect.Equal("token", sessionToken)
+
+	_, err = NewAWSCredentials("", "", "", "unknown")
+	expect.NotNil(err)
+
+	// Container credentials are used if no file is found
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/credentials":
+			requests++
+			expect.Equal("auth", req.Header.Get("Authorization"))
+			fmt.Fprintf(w, `{"AccessKeyId":"KEY%d","SecretAccessKey":"secret","Token":"token","Expiration":"%s"}`,
+				requests, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			expect.Equal("Test.Action", req.Header.Get("X-Amz-Target"))
+			expect.True(strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=KEY1/"))
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.test#ThrottlingException","message":"slow down"}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", file.Name()+".missing")
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", server.URL+"/credentials")
+	os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "auth")
+	defer os.Unsetenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	defer os.Unsetenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+
+	creds, err = NewAWSCredentials("", "", "", "")
+	expect.NoError(err)
+	expect.Equal("container", creds.source)
+
+	err = creds.PostJSON(context.Background(), http.DefaultClient, server.URL, "test", "us-east-1", "Test.Action", "application/x-amz-json-1.0", map[string]string{}, nil)
+	apiErr, isAPIError := err.(AWSAPIError)
+	expect.True(isAPIError)
+	expect.Equal("ThrottlingException", apiErr.Code)
+	expect.Equal("slow down", apiErr.Message)
+	expect.True(apiErr.Temporary())
+	expect.True(IsAWSThrottlingCode(apiErr.Code))
+	expect.False(IsAWSThrottlingCode("InternalFailure"))
+	expect.True(IsAWSTemporaryCode("InternalFailure"))
+
+	// Credentials are cached until they expire
+	creds.PostJSON(context.Background(), http.DefaultClient, server.URL, "test", "us-east-1", "Test.Action", "application/x-amz-json-1.0", map[string]string{}, nil)
+	expect.Equal(1, requests)
+}
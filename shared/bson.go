@@ -0,0 +1,426 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BSONElement is a key/value pair of a BSONDocument
+type BSONElement struct {
+	Key   string
+	Value interface{}
+}
+
+// BSONDocument is a BSON document with a fixed key order. This is required
+// for MongoDB commands where the first key names the command.
+type BSONDocument []BSONElement
+
+// BSONObjectID holds a 12 byte MongoDB ObjectId
+type BSONObjectID [12]byte
+
+const (
+	bsonDouble   = 0x01
+	bsonString   = 0x02
+	bsonDocument = 0x03
+	bsonArray    = 0x04
+	bsonBinary   = 0x05
+	bsonObjectID = 0x07
+	bsonBool     = 0x08
+	bsonDateTime = 0x09
+	bsonNull     = 0x0A
+	bsonInt32    = 0x10
+	bsonInt64    = 0x12
+)
+
+// errBSONShortData is returned by UnmarshalBSON if a document is incomplete
+var errBSONShortData = fmt.Errorf("Unexpected end of BSON data")
+
+// MarshalBSON encodes a BSONDocument or a map as BSON document. Supported
+// value types are nil, bool, string, all integer types, float32, float64,
+// json.Number, time.Time, []byte, BSONObjectID, BSONDocument, maps with string
+// keys and slices. Map keys are written in sorted order.
+func MarshalBSON(document interface{}) ([]byte, error) {
+	return appendBSONValue(make([]byte, 0, 256), "", document, true)
+}
+
+func appendBSONCString(data []byte, value string) ([]byte, error) {
+	for i := 0; i < len(value); i++ {
+		if value[i] == 0 {
+			return data, fmt.Errorf("BSON keys must not contain null bytes")
+		}
+	}
+	return append(append(data, value...), 0), nil
+}
+
+func appendBSONInt32(data []byte, value int32) []byte {
+	return append(data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+func appendBSONInt64(data []byte, value int64) []byte {
+	for shift := uint(0); shift < 64; shift += 8 {
+		data = append(data, byte(value>>shift))
+	}
+	return data
+}
+
+// appendBSONDocument writes the elements of a document and the length prefix.
+func appendBSONDocument(data []byte, elements BSONDocument) ([]byte, error) {
+	start := len(data)
+	data = appendBSONInt32(data, 0)
+
+	var err error
+	for _, element := range elements {
+		if data, err = appendBSONValue(data, element.Key, element.Value, false); err != nil {
+			return data, err
+		}
+	}
+
+	data = append(data, 0)
+	binary.LittleEndian.PutUint32(data[start:], uint32(len(data)-start))
+	return data, nil
+}
+
+func sortedBSONElements(values map[string]interface{}) BSONDocument {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	elements := make(BSONDocument, len(keys))
+	for i, key := range keys {
+		elements[i] = BSONElement{key, values[key]}
+	}
+	return elements
+}
+
+// appendBSONValue writes a typed element. If root is set, value must be a
+// document which is written without type and key.
+func appendBSONValue(data []byte, key string, value interface{}, root bool) ([]byte, error) {
+	var elements BSONDocument
+	isArray := false
+
+	switch value.(type) {
+	case BSONDocument:
+		elements = value.(BSONDocument)
+	case map[string]interface{}:
+		elements = sortedBSONElements(value.(map[string]interface{}))
+	case MarshalMap:
+		elements = sortedBSONElements(value.(MarshalMap))
+	case map[string]string:
+		values := make(map[string]interface{})
+		for k, v := range value.(map[string]string) {
+			values[k] = v
+		}
+		elements = sortedBSONElements(values)
+	case []interface{}:
+		for i, item := range value.([]interface{}) {
+			elements = append(elements, BSONElement{strconv.Itoa(i), item})
+		}
+		isArray = true
+	case []string:
+		for i, item := range value.([]string) {
+			elements = append(elements, BSONElement{strconv.Itoa(i), item})
+		}
+		isArray = true
+	case []BSONDocument:
+		for i, item := range value.([]BSONDocument) {
+			elements = append(elements, BSONElement{strconv.Itoa(i), item})
+		}
+		isArray = true
+	default:
+		if root {
+			return data, fmt.Errorf("BSON documents must be a map or BSONDocument, got %T", value)
+		}
+	}
+
+	var err error
+	if !root {
+		typeOffset := len(data)
+		data = append(data, 0)
+		if data, err = appendBSONCString(data, key); err != nil {
+			return data, err
+		}
+
+		typeCode, err := appendBSONScalar(&data, value)
+		if err != nil {
+			return data, err
+		}
+		if typeCode != 0 {
+			data[typeOffset] = typeCode
+			return data, nil // ### return, scalar value ###
+		}
+
+		data[typeOffset] = bsonDocument
+		if isArray {
+			data[typeOffset] = bsonArray
+		}
+	}
+
+	return appendBSONDocument(data, elements)
+}
+
+// appendBSONScalar writes value if it is not a document or array and returns
+// its type code. Zero is returned for documents and arrays.
+func appendBSONScalar(data *[]byte, value interface{}) (byte, error) {
+	switch value.(type) {
+	case BSONDocument, map[string]interface{}, MarshalMap, map[string]string, []interface{}, []string, []BSONDocument:
+		return 0, nil
+
+	case nil:
+		return bsonNull, nil
+
+	case bool:
+		if value.(bool) {
+			*data = append(*data, 1)
+		} else {
+			*data = append(*data, 0)
+		}
+		return bsonBool, nil
+
+	case string:
+		str := value.(string)
+		*data = appendBSONInt32(*data, int32(len(str)+1))
+		*data = append(append(*data, str...), 0)
+		return bsonString, nil
+
+	case []byte:
+		bin := value.([]byte)
+		*data = appendBSONInt32(*data, int32(len(bin)))
+		*data = append(append(*data, 0), bin...)
+		return bsonBinary, nil
+
+	case BSONObjectID:
+		id := value.(BSONObjectID)
+		*data = append(*data, id[:]...)
+		return bsonObjectID, nil
+
+	case time.Time:
+		ms := value.(time.Time).UnixNano() / int64(time.Millisecond)
+		*data = appendBSONInt64(*data, ms)
+		return bsonDateTime, nil
+
+	case float32:
+		*data = appendBSONInt64(*data, int64(math.Float64bits(float64(value.(float32)))))
+		return bsonDouble, nil
+
+	case float64:
+		*data = appendBSONInt64(*data, int64(math.Float64bits(value.(float64))))
+		return bsonDouble, nil
+
+	case json.Number:
+		number := value.(json.Number)
+		if intValue, err := number.Int64(); err == nil {
+			return appendBSONScalar(data, intValue)
+		}
+		floatValue, err := number.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return appendBSONScalar(data, floatValue)
+
+	case int8, int16, int32, uint8, uint16:
+		*data = appendBSONInt32(*data, int32(bsonIntValue(value)))
+		return bsonInt32, nil
+
+	case int, int64, uint32:
+		*data = appendBSONInt64(*data, bsonIntValue(value))
+		return bsonInt64, nil
+
+	case uint, uint64:
+		var intValue uint64
+		if v, isUint := value.(uint); isUint {
+			intValue = uint64(v)
+		} else {
+			intValue = value.(uint64)
+		}
+		if intValue > math.MaxInt64 {
+			return 0, fmt.Errorf("BSON cannot store %d as integer", intValue)
+		}
+		*data = appendBSONInt64(*data, int64(intValue))
+		return bsonInt64, nil
+
+	default:
+		return 0, fmt.Errorf("BSON cannot encode values of type %T", value)
+	}
+}
+
+func bsonIntValue(value interface{}) int64 {
+	switch value.(type) {
+	case int8:
+		return int64(value.(int8))
+	case int16:
+		return int64(value.(int16))
+	case int32:
+		return int64(value.(int32))
+	case uint8:
+		return int64(value.(uint8))
+	case uint16:
+		return int64(value.(uint16))
+	case uint32:
+		return int64(value.(uint32))
+	case int:
+		return int64(value.(int))
+	default:
+		return value.(int64)
+	}
+}
+
+// UnmarshalBSON decodes a BSON document. Documents are returned as
+// map[string]interface{}, arrays as []interface{}, integers as int32 or int64,
+// doubles as float64, binary data as []byte, datetimes as time.Time and
+// ObjectIds as BSONObjectID.
+func UnmarshalBSON(data []byte) (map[string]interface{}, error) {
+	document, _, err := readBSONDocument(data)
+	return document, err
+}
+
+func readBSONCString(data []byte) (string, []byte, error) {
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 {
+			return string(data[:i]), data[i+1:], nil
+		}
+	}
+	return "", data, errBSONShortData
+}
+
+// readBSONElements reads the elements of a document or array and returns
+// the data following it.
+func readBSONElements(data []byte, element func(key string, value interface{})) ([]byte, error) {
+	if len(data) < 5 {
+		return data, errBSONShortData
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if size < 5 || size > len(data) {
+		return data, errBSONShortData
+	}
+
+	remain := data[4 : size-1]
+	for len(remain) > 0 {
+		typeCode := remain[0]
+		key, next, err := readBSONCString(remain[1:])
+		if err != nil {
+			return data, err
+		}
+
+		var value interface{}
+		if value, remain, err = readBSONValue(typeCode, next); err != nil {
+			return data, err
+		}
+		element(key, value)
+	}
+	return data[size:], nil
+}
+
+func readBSONDocument(data []byte) (map[string]interface{}, []byte, error) {
+	document := make(map[string]interface{})
+	remain, err := readBSONElements(data, func(key string, value interface{}) {
+		document[key] = value
+	})
+	return document, remain, err
+}
+
+func readBSONValue(typeCode byte, data []byte) (interface{}, []byte, error) {
+	need := func(size int) error {
+		if len(data) < size {
+			return errBSONShortData
+		}
+		return nil
+	}
+
+	switch typeCode {
+	case bsonDouble:
+		if err := need(8); err != nil {
+			return nil, data, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), data[8:], nil
+
+	case bsonString:
+		if err := need(4); err != nil {
+			return nil, data, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 1 || need(4+size) != nil {
+			return nil, data, errBSONShortData
+		}
+		return string(data[4 : 4+size-1]), data[4+size:], nil
+
+	case bsonDocument:
+		return readBSONDocument(data)
+
+	case bsonArray:
+		array := []interface{}{}
+		remain, err := readBSONElements(data, func(key string, value interface{}) {
+			array = append(array, value)
+		})
+		return array, remain, err
+
+	case bsonBinary:
+		if err := need(5); err != nil {
+			return nil, data, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 0 || need(5+size) != nil {
+			return nil, data, errBSONShortData
+		}
+		return data[5 : 5+size], data[5+size:], nil
+
+	case bsonObjectID:
+		if err := need(12); err != nil {
+			return nil, data, err
+		}
+		id := BSONObjectID{}
+		copy(id[:], data)
+		return id, data[12:], nil
+
+	case bsonBool:
+		if err := need(1); err != nil {
+			return nil, data, err
+		}
+		return data[0] != 0, data[1:], nil
+
+	case bsonDateTime:
+		if err := need(8); err != nil {
+			return nil, data, err
+		}
+		ms := int64(binary.LittleEndian.Uint64(data))
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(), data[8:], nil
+
+	case bsonNull:
+		return nil, data, nil
+
+	case bsonInt32:
+		if err := need(4); err != nil {
+			return nil, data, err
+		}
+		return int32(binary.LittleEndian.Uint32(data)), data[4:], nil
+
+	case 0x11, bsonInt64: // timestamp, int64
+		if err := need(8); err != nil {
+			return nil, data, err
+		}
+		return int64(binary.LittleEndian.Uint64(data)), data[8:], nil
+
+	default:
+		return nil, data, fmt.Errorf("Unsupported BSON type 0x%02x", typeCode)
+	}
+}
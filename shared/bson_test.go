@@ -0,0 +1,78 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBSONMarshal(t *testing.T) {
+	expect := NewExpect(t)
+
+	// Example from bsonspec.org
+	data, err := MarshalBSON(map[string]interface{}{"hello": "world"})
+	expect.NoError(err)
+	expect.Equal("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00", string(data))
+
+	// Command documents keep their key order
+	data, err = MarshalBSON(BSONDocument{{"z", int32(1)}, {"a", true}})
+	expect.NoError(err)
+	expect.Equal("\x10\x00\x00\x00\x10z\x00\x01\x00\x00\x00\x08a\x00\x01\x00", string(data))
+
+	_, err = MarshalBSON("not a document")
+	expect.NotNil(err)
+	_, err = MarshalBSON(map[string]interface{}{"a\x00b": 1})
+	expect.NotNil(err)
+}
+
+func TestBSONRoundtrip(t *testing.T) {
+	expect := NewExpect(t)
+	timestamp := time.Date(2016, 5, 4, 3, 2, 1, 5000000, time.UTC)
+
+	data, err := MarshalBSON(map[string]interface{}{
+		"int":     json.Number("12345678901"),
+		"float":   json.Number("1.5"),
+		"string":  "test",
+		"null":    nil,
+		"bool":    false,
+		"time":    timestamp,
+		"binary":  []byte{1, 2},
+		"id":      BSONObjectID{1, 2, 3},
+		"array":   []interface{}{int32(1), "two"},
+		"nested":  map[string]interface{}{"key": int8(-1)},
+		"ordered": BSONDocument{{"b", 1}, {"a", 2}},
+	})
+	expect.NoError(err)
+
+	document, err := UnmarshalBSON(data)
+	expect.NoError(err)
+	expect.Equal(int64(12345678901), document["int"])
+	expect.Equal(1.5, document["float"])
+	expect.Equal("test", document["string"])
+	expect.Nil(document["null"])
+	expect.Equal(false, document["bool"])
+	expect.Equal(timestamp, document["time"])
+	expect.Equal("\x01\x02", string(document["binary"].([]byte)))
+	expect.Equal(BSONObjectID{1, 2, 3}, document["id"])
+	expect.Equal(2, len(document["array"].([]interface{})))
+	expect.Equal("two", document["array"].([]interface{})[1])
+	expect.Equal(int32(-1), document["nested"].(map[string]interface{})["key"])
+	expect.Equal(int64(2), document["ordered"].(map[string]interface{})["a"])
+
+	_, err = UnmarshalBSON(data[:len(data)-3])
+	expect.NotNil(err)
+}
@@ -58,6 +58,12 @@ const (
 	// Only one MLE flag is supported at a time.
 	BufferedReaderFlagMLEFixed = BufferedReaderFlags(6)
 
+	// BufferedReaderFlagMLEVarint enables reading if length encoded messages.
+	// Runlength is read as unsigned varint as used by protocol buffers for
+	// length delimited messages.
+	// Only one MLE flag is supported at a time.
+	BufferedReaderFlagMLEVarint = BufferedReaderFlags(7)
+
 	// BufferedReaderFlagMaskMLE is a bitmask to mask out everything but MLE flags
 	BufferedReaderFlagMaskMLE = BufferedReaderFlags(7)
 
@@ -89,6 +95,9 @@ var BufferDataInvalid = bufferError("Invalid data")
 // default behavior, which is looking for a delimiter string.
 // In addition to that every data "piece" will recieve an incrementing sequence
 // number.
+// Messages returned by the reader point into the internal buffer, i.e. they
+// are not copied. The reader guarantees that these bytes are never written
+// again, so messages may be kept as long as they are treated as read-only.
 type BufferedReader struct {
 	data       []byte
 	delimiter  []byte
@@ -144,6 +153,8 @@ func NewBufferedReader(bufferSize int, flags BufferedReaderFlags, offsetOrLength
 			buffer.parse = buffer.parseMLE64
 		case BufferedReaderFlagMLEFixed:
 			buffer.parse = buffer.parseMLEFixed
+		case BufferedReaderFlagMLEVarint:
+			buffer.parse = buffer.parseMLEVarint
 		}
 	}
 
@@ -261,6 +272,21 @@ func (buffer *BufferedReader) parseMLE64() ([]byte, int) {
 	return buffer.extractMessage(int(messageLen), buffer.paramMLE+8)
 }
 
+// messages are separated varint length encoded
+func (buffer *BufferedReader) parseMLEVarint() ([]byte, int) {
+	if buffer.paramMLE >= buffer.end {
+		return nil, 0 // ### return, incomplete ###
+	}
+	messageLen, lenSize := binary.Uvarint(buffer.data[buffer.paramMLE:buffer.end])
+	switch {
+	case lenSize == 0:
+		return nil, 0 // ### return, incomplete ###
+	case lenSize < 0 || messageLen > uint64(^uint(0)>>1):
+		return nil, -1 // ### return, malformed ###
+	}
+	return buffer.extractMessage(int(messageLen), buffer.paramMLE+lenSize)
+}
+
 // ReadAll calls ReadOne as long as there are messages in the stream.
 // Messages will be send to the given write callback.
 // If callback is nil, data will be read and discarded.
@@ -290,6 +316,15 @@ func (buffer *BufferedReader) ReadAll(reader io.Reader, callback BufferReadCallb
 // encountered an error.
 func (buffer *BufferedReader) ReadOne(reader io.Reader) (data []byte, seq uint64, more bool, err error) {
 	if buffer.incomplete {
+		// Messages returned earlier may still point into the buffer, so a new
+		// buffer is created instead of reusing the old one. Only the data of
+		// the incomplete message is copied.
+		if len(buffer.data) == buffer.end {
+			temp := buffer.data[:buffer.end]
+			buffer.data = make([]byte, buffer.end+buffer.growSize)
+			copy(buffer.data, temp)
+		}
+
 		bytesRead, err := reader.Read(buffer.data[buffer.end:])
 
 		if err != nil {
@@ -313,28 +348,21 @@ func (buffer *BufferedReader) ReadOne(reader io.Reader) (data []byte, seq uint64
 	}
 
 	if msgData == nil {
-		// Check if buffer needs to be resized
-		if len(buffer.data) == buffer.end {
-			temp := buffer.data
-			buffer.data = make([]byte, len(buffer.data)+buffer.growSize)
-			copy(buffer.data, temp)
-		}
 		buffer.incomplete = true
 		return nil, 0, true, nil // ### return, incomplete ###
 	}
 
-	msgDataCopy := make([]byte, len(msgData))
-	copy(msgDataCopy, msgData)
+	// The message is returned without copying it. The remaining data is not
+	// moved either, so bytes that have been returned are never overwritten.
+	msgData = msgData[:len(msgData):len(msgData)]
+	buffer.data = buffer.data[nextMsgIdx:]
+	buffer.end -= nextMsgIdx
 
-	if nextMsgIdx < buffer.end {
-		copy(buffer.data, buffer.data[nextMsgIdx:buffer.end])
-		buffer.end -= nextMsgIdx
-	} else {
-		buffer.end = 0
+	if buffer.end == 0 {
 		buffer.incomplete = true
 	}
 
 	seqNum := buffer.sequence
 	buffer.sequence++
-	return msgDataCopy, seqNum, buffer.end > 0, nil
+	return msgData, seqNum, buffer.end > 0, nil
 }
@@ -16,6 +16,7 @@ package shared
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"strings"
@@ -201,6 +202,32 @@ func TestBufferedReaderMLE64(t *testing.T) {
 	data.expect.Nil(msg)
 }
 
+func TestBufferedReaderMLEVarint(t *testing.T) {
+	data := bufferedReaderTestData{
+		expect: NewExpect(t),
+		tokens: []string{"test1", strings.Repeat("test 2", 50), "test\t3"},
+		parsed: 0,
+	}
+
+	var parseData []byte
+	for _, s := range data.tokens {
+		lengthBytes := make([]byte, binary.MaxVarintLen64)
+		parseData = append(parseData, lengthBytes[:binary.PutUvarint(lengthBytes, uint64(len(s)))]...)
+		parseData = append(parseData, s...)
+	}
+
+	parseReader := bytes.NewReader(parseData)
+	reader := NewBufferedReader(16, BufferedReaderFlagMLEVarint, 0, "")
+
+	err := reader.ReadAll(parseReader, data.write)
+	data.expect.NoError(err)
+	data.expect.Equal(3, data.parsed)
+
+	msg, _, _, err := reader.ReadOne(parseReader)
+	data.expect.Equal(io.EOF, err)
+	data.expect.Nil(msg)
+}
+
 func TestBufferedReaderMLE8EO(t *testing.T) {
 	data := bufferedReaderTestData{
 		expect: NewExpect(t),
@@ -267,3 +294,27 @@ func TestBufferedReaderDelimiterE(t *testing.T) {
 		data.expect.Equal(fmt.Sprintf("%s\n", s), string(msg))
 	}
 }
+
+func TestBufferedReaderSharedData(t *testing.T) {
+	expect := NewExpect(t)
+	tokens := []string{"test1", "a much longer test 2", "test\t3", "4"}
+
+	parseData := strings.Join(tokens, "\n") + "\n"
+	parseReader := strings.NewReader(parseData)
+	reader := NewBufferedReader(8, 0, 0, "\n")
+
+	messages := [][]byte{}
+	reader.ReadAll(parseReader, func(msg []byte, seq uint64) {
+		messages = append(messages, msg)
+	})
+
+	// Messages must not be overwritten by later reads
+	expect.Equal(len(tokens), len(messages))
+	for i, msg := range messages {
+		expect.Equal(tokens[i], string(msg))
+	}
+
+	// Appending to a message must not modify the following message
+	_ = append(messages[2], "xxx"...)
+	expect.Equal(tokens[3], string(messages[3]))
+}
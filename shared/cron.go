@@ -0,0 +1,220 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with the five fields minute, hour,
+// day of month, month and day of week. See ParseCronSchedule.
+type CronSchedule struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	anyDay     bool
+	anyWeekday bool
+}
+
+type cronField struct {
+	min   int
+	max   int
+	names []string
+}
+
+var (
+	cronMinute  = cronField{0, 59, nil}
+	cronHour    = cronField{0, 23, nil}
+	cronDay     = cronField{1, 31, nil}
+	cronMonth   = cronField{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	cronWeekday = cronField{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSearchYears limits the search of Next for schedules that never match,
+// e.g. "0 0 30 2 *".
+const cronSearchYears = 5
+
+// ParseCronSchedule parses a cron expression like "0 */6 * * *". Each field
+// can be "*", a value, a range like "1-5" or a comma separated list of these.
+// Values and ranges can be followed by a step like "/15". Months and days of
+// the week can be given as names, e.g. "jan" or "mon". Sunday is 0 or 7.
+// If both day of month and day of week are restricted, a day matches if
+// either of them matches. The macros @yearly, @annually, @monthly, @weekly,
+// @daily, @midnight and @hourly are supported, too.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	expanded := strings.TrimSpace(spec)
+	if macro, isMacro := cronMacros[strings.ToLower(expanded)]; isMacro {
+		expanded = macro
+	}
+
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression \"%s\" must have 5 fields", spec)
+	}
+
+	schedule := &CronSchedule{
+		anyDay:     fields[2] == "*" || fields[2] == "?",
+		anyWeekday: fields[4] == "*" || fields[4] == "?",
+	}
+
+	var err error
+	if schedule.minutes, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if schedule.days, err = cronDay.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays, err = cronWeekday.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1 // 7 is an alias for sunday
+	}
+	return schedule, nil
+}
+
+func (field cronField) parse(spec string) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(spec, ",") {
+		valueRange, stepSpec := part, ""
+		if slash := strings.IndexByte(part, '/'); slash != -1 {
+			valueRange, stepSpec = part[:slash], part[slash+1:]
+		}
+
+		step := 1
+		if stepSpec != "" {
+			var err error
+			if step, err = strconv.Atoi(stepSpec); err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid cron step \"%s\"", part)
+			}
+		}
+
+		var first, last int
+		switch {
+		case valueRange == "*" || valueRange == "?":
+			first, last = field.min, field.max
+
+		case strings.IndexByte(valueRange, '-') > 0:
+			dash := strings.IndexByte(valueRange, '-')
+			var err error
+			if first, err = field.value(valueRange[:dash]); err != nil {
+				return 0, err
+			}
+			if last, err = field.value(valueRange[dash+1:]); err != nil {
+				return 0, err
+			}
+			if last < first {
+				return 0, fmt.Errorf("Invalid cron range \"%s\"", part)
+			}
+
+		default:
+			var err error
+			if first, err = field.value(valueRange); err != nil {
+				return 0, err
+			}
+			last = first
+			if stepSpec != "" {
+				last = field.max // "5/15" equals "5-max/15"
+			}
+		}
+
+		for value := first; value <= last; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (field cronField) value(spec string) (int, error) {
+	lowerSpec := strings.ToLower(spec)
+	for idx, name := range field.names {
+		if lowerSpec == name {
+			return idx + field.min, nil
+		}
+	}
+
+	value, err := strconv.Atoi(spec)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("Invalid cron value \"%s\", expected %d-%d", spec, field.min, field.max)
+	}
+	return value, nil
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	dayMatch := schedule.days&(1<<uint(t.Day())) != 0
+	weekdayMatch := schedule.weekdays&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case schedule.anyDay && schedule.anyWeekday:
+		return true
+	case schedule.anyDay:
+		return weekdayMatch
+	case schedule.anyWeekday:
+		return dayMatch
+	default:
+		return dayMatch || weekdayMatch
+	}
+}
+
+// Next returns the first time after t matching the schedule. The schedule is
+// evaluated in the location of t. If no matching time exists within the next
+// years, e.g. for "0 0 31 2 *", the zero time is returned.
+func (schedule *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	endYear := next.Year() + cronSearchYears
+
+	for next.Year() <= endYear {
+		switch {
+		case schedule.months&(1<<uint(next.Month())) == 0:
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, loc)
+
+		case !schedule.matchesDay(next):
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, loc)
+
+		case schedule.hours&(1<<uint(next.Hour())) == 0:
+			// Add instead of time.Date to step over DST transitions
+			next = next.Add(time.Hour - time.Duration(next.Minute())*time.Minute)
+
+		case schedule.minutes&(1<<uint(next.Minute())) == 0:
+			next = next.Add(time.Minute)
+
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
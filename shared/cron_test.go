@@ -0,0 +1,63 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	expect := NewExpect(t)
+	start := time.Date(2015, 3, 7, 14, 5, 9, 0, time.UTC) // saturday
+
+	next := func(spec string, from time.Time) time.Time {
+		schedule, err := ParseCronSchedule(spec)
+		expect.NoError(err)
+		if schedule == nil {
+			return time.Time{}
+		}
+		return schedule.Next(from)
+	}
+
+	expect.Equal(time.Date(2015, 3, 7, 18, 0, 0, 0, time.UTC), next("0 */6 * * *", start))
+	expect.Equal(time.Date(2015, 3, 8, 0, 0, 0, 0, time.UTC), next("@daily", start))
+	expect.Equal(time.Date(2015, 3, 7, 14, 6, 0, 0, time.UTC), next("* * * * *", start))
+	expect.Equal(time.Date(2015, 3, 7, 14, 30, 0, 0, time.UTC), next("0,30 8-18 * * *", start))
+	expect.Equal(time.Date(2015, 3, 9, 8, 0, 0, 0, time.UTC), next("0 8 * * mon-fri", start))
+	expect.Equal(time.Date(2015, 3, 8, 8, 0, 0, 0, time.UTC), next("0 8 * * 7", start))
+	expect.Equal(time.Date(2015, 4, 1, 0, 0, 0, 0, time.UTC), next("0 0 1 apr,oct *", start))
+	expect.Equal(time.Date(2015, 3, 9, 0, 0, 0, 0, time.UTC), next("0 0 15 * 1", start))
+	expect.Equal(time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC), next("0 0 29 2 *", start))
+	expect.Equal(time.Date(2015, 3, 7, 14, 20, 0, 0, time.UTC), next("5/15 * * * *", start))
+	expect.True(next("0 0 31 2 *", start).IsZero())
+
+	// Next is strictly after the given time
+	exact := time.Date(2015, 3, 7, 18, 0, 0, 0, time.UTC)
+	expect.Equal(time.Date(2015, 3, 8, 0, 0, 0, 0, time.UTC), next("0 */6 * * *", exact))
+
+	// Schedules are evaluated in the location of the given time
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err == nil {
+		expect.Equal(time.Date(2015, 3, 7, 23, 0, 0, 0, time.UTC), next("0 0 * * *", start.In(berlin)).UTC())
+		// 02:00 does not exist on 2015-03-29
+		expect.Equal(time.Date(2015, 3, 29, 3, 0, 0, 0, berlin), next("0 * * * *", time.Date(2015, 3, 29, 1, 30, 0, 0, berlin)))
+	}
+
+	for _, invalid := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@often"} {
+		_, err := ParseCronSchedule(invalid)
+		expect.NotNil(err)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// EncryptedChunkSize is the maximum number of plaintext bytes stored in
+	// one chunk of an encrypted stream.
+	EncryptedChunkSize = 64 << 10
+
+	encryptedVersion   = 1
+	encryptedNonceSize = 12
+)
+
+var encryptedMagic = []byte("GENC")
+
+// An encrypted stream starts with a header of the following format:
+//
+//	"GENC" | version (1 byte) | key ID length (1 byte) | key ID | nonce (12 byte)
+//
+// The header is followed by a sequence of chunks, each consisting of a flag
+// byte marking the last chunk, the length of the sealed data (uint32, big
+// endian) and the data sealed with AES-GCM. The nonce of each chunk is
+// derived from the header nonce and the chunk index. The header and the flag
+// byte are authenticated so chunks can neither be reordered, replaced nor
+// removed.
+
+// encryptedChunkNonce returns the nonce for the given chunk.
+func encryptedChunkNonce(nonce []byte, chunk uint64) []byte {
+	chunkNonce := make([]byte, len(nonce))
+	copy(chunkNonce, nonce)
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, chunk)
+	for i := range counter {
+		chunkNonce[len(chunkNonce)-8+i] ^= counter[i]
+	}
+	return chunkNonce
+}
+
+// encryptedChunkData returns the additional data authenticated with a chunk.
+func encryptedChunkData(header []byte, final bool) []byte {
+	data := make([]byte, len(header)+1)
+	copy(data, header)
+	if final {
+		data[len(header)] = 1
+	}
+	return data
+}
+
+func newEncryptedAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedWriter encrypts data written to it using AES-GCM. Data is
+// buffered and sealed in chunks of EncryptedChunkSize bytes. Close has to be
+// called to write the last chunk.
+type EncryptedWriter struct {
+	writer io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	buffer []byte
+	chunk  uint64
+}
+
+// NewEncryptedWriter creates a new writer encrypting data with the given
+// AES-128, AES-192 or AES-256 key. The key ID is stored in the header to
+// identify the key when reading the data. The header is written immediately.
+func NewEncryptedWriter(writer io.Writer, key []byte, keyID string) (*EncryptedWriter, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("Key ID must not be longer than 255 characters")
+	}
+
+	aead, err := newEncryptedAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBuffer(make([]byte, 0, len(encryptedMagic)+2+len(keyID)+len(nonce)))
+	header.Write(encryptedMagic)
+	header.WriteByte(encryptedVersion)
+	header.WriteByte(byte(len(keyID)))
+	header.WriteString(keyID)
+	header.Write(nonce)
+
+	if _, err := writer.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &EncryptedWriter{
+		writer: writer,
+		aead:   aead,
+		header: header.Bytes(),
+		nonce:  nonce,
+		buffer: make([]byte, 0, EncryptedChunkSize),
+	}, nil
+}
+
+// Write buffers and encrypts the given data.
+func (writer *EncryptedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		space := EncryptedChunkSize - len(writer.buffer)
+		if space == 0 {
+			if err := writer.writeChunk(false); err != nil {
+				return written, err
+			}
+			space = EncryptedChunkSize
+		}
+		if space > len(data) {
+			space = len(data)
+		}
+		writer.buffer = append(writer.buffer, data[:space]...)
+		data = data[space:]
+		written += space
+	}
+	return written, nil
+}
+
+func (writer *EncryptedWriter) writeChunk(final bool) error {
+	nonce := encryptedChunkNonce(writer.nonce, writer.chunk)
+	sealed := writer.aead.Seal(nil, nonce, writer.buffer, encryptedChunkData(writer.header, final))
+
+	chunkHeader := make([]byte, 5)
+	if final {
+		chunkHeader[0] = 1
+	}
+	binary.BigEndian.PutUint32(chunkHeader[1:], uint32(len(sealed)))
+
+	if _, err := writer.writer.Write(chunkHeader); err != nil {
+		return err
+	}
+	if _, err := writer.writer.Write(sealed); err != nil {
+		return err
+	}
+
+	writer.buffer = writer.buffer[:0]
+	writer.chunk++
+	return nil
+}
+
+// Close writes the remaining data as the last chunk. The underlying writer
+// is not closed.
+func (writer *EncryptedWriter) Close() error {
+	return writer.writeChunk(true)
+}
+
+// EncryptedReader decrypts a stream written by EncryptedWriter.
+type EncryptedReader struct {
+	reader io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	keyID  string
+	buffer []byte
+	chunk  uint64
+	done   bool
+}
+
+// NewEncryptedReader reads the header of an encrypted stream and uses
+// getKey to request the key for the key ID stored in the header.
+func NewEncryptedReader(reader io.Reader, getKey func(keyID string) ([]byte, error)) (*EncryptedReader, error) {
+	prefix := make([]byte, len(encryptedMagic)+2)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix[:len(encryptedMagic)], encryptedMagic) {
+		return nil, fmt.Errorf("Not an encrypted stream")
+	}
+	if version := prefix[len(encryptedMagic)]; version != encryptedVersion {
+		return nil, fmt.Errorf("Unsupported encryption version %d", version)
+	}
+
+	rest := make([]byte, int(prefix[len(prefix)-1])+encryptedNonceSize)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+
+	keyID := string(rest[:len(rest)-encryptedNonceSize])
+	key, err := getKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEncryptedAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedReader{
+		reader: reader,
+		aead:   aead,
+		header: append(prefix, rest...),
+		nonce:  rest[len(rest)-encryptedNonceSize:],
+		keyID:  keyID,
+	}, nil
+}
+
+// KeyID returns the key ID stored in the header of the stream.
+func (reader *EncryptedReader) KeyID() string {
+	return reader.keyID
+}
+
+// Read decrypts data from the underlying reader. An error is returned if the
+// data has been modified or the stream has been truncated.
+func (reader *EncryptedReader) Read(data []byte) (int, error) {
+	for len(reader.buffer) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		if err := reader.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	read := copy(data, reader.buffer)
+	reader.buffer = reader.buffer[read:]
+	return read, nil
+}
+
+func (reader *EncryptedReader) readChunk() error {
+	chunkHeader := make([]byte, 5)
+	if _, err := io.ReadFull(reader.reader, chunkHeader); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	final := chunkHeader[0] == 1
+	sealedSize := binary.BigEndian.Uint32(chunkHeader[1:])
+	if sealedSize > EncryptedChunkSize+uint32(reader.aead.Overhead()) {
+		return fmt.Errorf("Invalid chunk size %d", sealedSize)
+	}
+
+	sealed := make([]byte, sealedSize)
+	if _, err := io.ReadFull(reader.reader, sealed); err != nil {
+		return err
+	}
+
+	nonce := encryptedChunkNonce(reader.nonce, reader.chunk)
+	plain, err := reader.aead.Open(sealed[:0], nonce, sealed, encryptedChunkData(reader.header, final))
+	if err != nil {
+		return err
+	}
+
+	reader.buffer = plain
+	reader.chunk++
+	reader.done = final
+	return nil
+}
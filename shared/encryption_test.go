@@ -0,0 +1,110 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func testEncryptedKey(key []byte) func(string) ([]byte, error) {
+	return func(keyID string) ([]byte, error) {
+		if keyID != "test" {
+			return nil, fmt.Errorf("Unknown key %s", keyID)
+		}
+		return key, nil
+	}
+}
+
+func TestEncryptedStream(t *testing.T) {
+	expect := NewExpect(t)
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	// Larger than two chunks
+	plain := bytes.Repeat([]byte("0123456789"), EncryptedChunkSize/4)
+	encrypted := bytes.Buffer{}
+
+	writer, err := NewEncryptedWriter(&encrypted, key, "test")
+	expect.NoError(err)
+	writer.Write(plain[:100])
+	writer.Write(plain[100:])
+	expect.NoError(writer.Close())
+	expect.False(bytes.Contains(encrypted.Bytes(), plain[:64]))
+
+	reader, err := NewEncryptedReader(bytes.NewReader(encrypted.Bytes()), testEncryptedKey(key))
+	expect.NoError(err)
+	expect.Equal("test", reader.KeyID())
+
+	decrypted, err := ioutil.ReadAll(reader)
+	expect.NoError(err)
+	expect.True(bytes.Equal(plain, decrypted))
+
+	// Empty streams consist of the final chunk only
+	encrypted.Reset()
+	writer, _ = NewEncryptedWriter(&encrypted, key, "test")
+	expect.NoError(writer.Close())
+
+	reader, err = NewEncryptedReader(bytes.NewReader(encrypted.Bytes()), testEncryptedKey(key))
+	expect.NoError(err)
+	decrypted, err = ioutil.ReadAll(reader)
+	expect.NoError(err)
+	expect.Equal(0, len(decrypted))
+}
+
+func TestEncryptedStreamTampering(t *testing.T) {
+	expect := NewExpect(t)
+	key := bytes.Repeat([]byte{0x42}, 16)
+
+	plain := bytes.Repeat([]byte("x"), EncryptedChunkSize+10)
+	encrypted := bytes.Buffer{}
+	writer, _ := NewEncryptedWriter(&encrypted, key, "test")
+	writer.Write(plain)
+	writer.Close()
+	data := encrypted.Bytes()
+
+	readAll := func(data []byte, key []byte) error {
+		reader, err := NewEncryptedReader(bytes.NewReader(data), testEncryptedKey(key))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, reader)
+		return err
+	}
+
+	// Wrong key
+	expect.NotNil(readAll(data, bytes.Repeat([]byte{0x43}, 16)))
+
+	// Modified data
+	modified := append([]byte{}, data...)
+	modified[len(modified)-1] ^= 1
+	expect.NotNil(readAll(modified, key))
+
+	// Modified key ID
+	modified = append([]byte{}, data...)
+	modified[6] = 'T'
+	expect.NotNil(readAll(modified, key))
+
+	// Truncated after the first chunk
+	headerSize := len(encryptedMagic) + 2 + len("test") + encryptedNonceSize
+	firstChunk := headerSize + 5 + EncryptedChunkSize + 16
+	expect.NotNil(readAll(data[:firstChunk], key))
+
+	// Removed first chunk
+	expect.NotNil(readAll(append(append([]byte{}, data[:headerSize]...), data[firstChunk:]...), key))
+	expect.NoError(readAll(data, key))
+}
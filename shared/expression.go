@@ -0,0 +1,1107 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrExpressionTimeout is returned if an expression did not finish within
+// the time passed to Expression.Eval.
+var ErrExpressionTimeout = fmt.Errorf("Expression timed out")
+
+// expressionCheckInterval defines after how many evaluation steps the
+// deadline of an expression is checked.
+const expressionCheckInterval = 32
+
+// ExpressionScope resolves the variables used by an expression. The second
+// return value is false if the variable is not known.
+type ExpressionScope func(name string) (interface{}, bool)
+
+// Expression is a small, side effect free expression language that can be
+// used to define predicates and transformations in a config file.
+// Expressions are parsed once and can be evaluated by multiple go routines.
+//
+// Values are either null, booleans, numbers (float64), strings, arrays
+// ([]interface{}) or objects (map[string]interface{}), i.e. the types used
+// by encoding/json. Fields of objects are accessed by "a.b" or "a["b"]",
+// array elements by "a[0]". Accessing a field that does not exist yields
+// null.
+//
+// Operators in order of precedence, lowest first:
+//   c ? a : b          conditional
+//   ||                 logical or
+//   &&                 logical and
+//   == != < <= > >=    comparison
+//   =~ !~              regular expression (does not) match
+//   in                 substring, array element or object key test
+//   + -                addition, string concatenation, subtraction
+//   * / %              multiplication, division, modulo
+//   ! -                logical not, negation
+//
+// Functions:
+//   len(x)                   length of a string, array or object
+//   lower(s), upper(s)       change the case of a string
+//   trim(s)                  remove leading and trailing whitespace
+//   contains(s, sub)         true if s contains sub
+//   startsWith(s, prefix)    true if s starts with prefix
+//   endsWith(s, suffix)      true if s ends with suffix
+//   replace(s, old, new)     replace all occurrences of old
+//   substr(s, start[, len])  part of a string by byte offset
+//   split(s, sep)            split a string into an array
+//   join(array, sep)         join array elements into a string
+//   extract(s, regex)        first capture group or match of regex, or ""
+//   string(x)                convert to string, arrays and objects as JSON
+//   number(x)                convert to number, null if not possible
+//   int(x)                   convert to number and truncate fractions
+//   json(s)                  parse a JSON string, null if not valid
+//   has(x)                   true if x is not null
+//   default(x, y)            x if x is not null, y otherwise
+//   now()                    current unix time in seconds
+//
+// Values are considered false if they are null, false, 0, "" or an empty
+// array or object.
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(ctx *exprContext) (interface{}, error)
+}
+
+type exprContext struct {
+	scope    ExpressionScope
+	deadline time.Time
+	steps    int
+}
+
+// tick counts an evaluation step and returns ErrExpressionTimeout if the
+// deadline has passed. The clock is only read every few steps.
+func (ctx *exprContext) tick(force bool) error {
+	ctx.steps++
+	if ctx.deadline.IsZero() || (!force && ctx.steps%expressionCheckInterval != 0) {
+		return nil
+	}
+	if time.Now().After(ctx.deadline) {
+		return ErrExpressionTimeout
+	}
+	return nil
+}
+
+// ParseExpression parses the given source. Variables lists the names of all
+// variables that can be resolved by the scope passed to Eval. Using any
+// other variable is reported as an error.
+func ParseExpression(source string, variables []string) (*Expression, error) {
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := exprParser{
+		tokens:    tokens,
+		variables: make(map[string]bool),
+	}
+	for _, name := range variables {
+		parser.variables[name] = true
+	}
+
+	root, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != exprTokenEnd {
+		return nil, parser.errorf("unexpected %s", parser.peek())
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (expr *Expression) String() string {
+	return expr.source
+}
+
+// Eval evaluates the expression. If timeout is greater than 0 evaluation is
+// stopped with ErrExpressionTimeout once it takes longer than timeout.
+func (expr *Expression) Eval(scope ExpressionScope, timeout time.Duration) (interface{}, error) {
+	ctx := exprContext{scope: scope}
+	if timeout > 0 {
+		ctx.deadline = time.Now().Add(timeout)
+	}
+	return expr.root.eval(&ctx)
+}
+
+// EvalBool evaluates the expression and converts the result to a boolean.
+func (expr *Expression) EvalBool(scope ExpressionScope, timeout time.Duration) (bool, error) {
+	value, err := expr.Eval(scope, timeout)
+	if err != nil {
+		return false, err
+	}
+	return ExpressionTruth(value), nil
+}
+
+// ExpressionTruth returns false for null, false, 0, "" and empty arrays or
+// objects and true for all other values.
+func ExpressionTruth(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// ExpressionString converts a value to a string. Numbers are formatted
+// without exponent, arrays and objects are encoded as JSON and null becomes
+// an empty string.
+func ExpressionString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+// expressionNumber converts a value to a number. The second return value is
+// false if the value cannot be converted.
+func expressionNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// normalizeExpressionValue converts numeric and map types not produced by
+// encoding/json, e.g. from metadata or YAML, to the types used by
+// expressions.
+func normalizeExpressionValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case MarshalMap:
+		return map[string]interface{}(v)
+	case map[string]string:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = item
+		}
+		return result
+	case []string:
+		result := make([]interface{}, len(v))
+		for idx, item := range v {
+			result[idx] = item
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// Tokenizer
+
+type exprTokenKind int
+
+const (
+	exprTokenEnd = exprTokenKind(iota)
+	exprTokenNumber
+	exprTokenString
+	exprTokenIdent
+	exprTokenOperator
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (token exprToken) String() string {
+	if token.kind == exprTokenEnd {
+		return "end of expression"
+	}
+	return fmt.Sprintf("\"%s\"", token.text)
+}
+
+// exprOperators lists all operators, longer operators first.
+var exprOperators = []string{
+	"==", "!=", "<=", ">=", "&&", "||", "=~", "!~",
+	"<", ">", "+", "-", "*", "/", "%", "!", "?", ":", ".", ",", "(", ")", "[", "]",
+}
+
+func tokenizeExpression(source string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	pos := 0
+
+nextToken:
+	for pos < len(source) {
+		char := source[pos]
+		switch {
+		case char == ' ' || char == '\t' || char == '\r' || char == '\n':
+			pos++
+
+		case char >= '0' && char <= '9':
+			start := pos
+			for pos < len(source) && (source[pos] >= '0' && source[pos] <= '9' || source[pos] == '.' ||
+				source[pos] == 'e' || source[pos] == 'E' ||
+				((source[pos] == '+' || source[pos] == '-') && (source[pos-1] == 'e' || source[pos-1] == 'E'))) {
+				pos++
+			}
+			number, err := strconv.ParseFloat(source[start:pos], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Expression: invalid number \"%s\" at %d", source[start:pos], start)
+			}
+			tokens = append(tokens, exprToken{exprTokenNumber, source[start:pos], number, start})
+
+		case char == '"' || char == '\'':
+			start := pos
+			pos++
+			value := []byte{}
+			for pos < len(source) && source[pos] != char {
+				if source[pos] == '\\' && pos+1 < len(source) {
+					pos++
+					switch source[pos] {
+					case 'n':
+						value = append(value, '\n')
+					case 'r':
+						value = append(value, '\r')
+					case 't':
+						value = append(value, '\t')
+					default:
+						value = append(value, source[pos])
+					}
+				} else {
+					value = append(value, source[pos])
+				}
+				pos++
+			}
+			if pos >= len(source) {
+				return nil, fmt.Errorf("Expression: unterminated string at %d", start)
+			}
+			pos++
+			tokens = append(tokens, exprToken{exprTokenString, source[start:pos], string(value), start})
+
+		case char == '_' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z':
+			start := pos
+			for pos < len(source) && (source[pos] == '_' || source[pos] >= 'a' && source[pos] <= 'z' ||
+				source[pos] >= 'A' && source[pos] <= 'Z' || source[pos] >= '0' && source[pos] <= '9') {
+				pos++
+			}
+			tokens = append(tokens, exprToken{exprTokenIdent, source[start:pos], nil, start})
+
+		default:
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[pos:], op) {
+					tokens = append(tokens, exprToken{exprTokenOperator, op, nil, pos})
+					pos += len(op)
+					continue nextToken
+				}
+			}
+			return nil, fmt.Errorf("Expression: unexpected character '%c' at %d", char, pos)
+		}
+	}
+
+	return append(tokens, exprToken{exprTokenEnd, "", nil, len(source)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens    []exprToken
+	pos       int
+	variables map[string]bool
+}
+
+func (parser *exprParser) peek() exprToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *exprParser) next() exprToken {
+	token := parser.tokens[parser.pos]
+	if token.kind != exprTokenEnd {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *exprParser) isOperator(ops ...string) bool {
+	token := parser.peek()
+	if token.kind != exprTokenOperator && token.kind != exprTokenIdent {
+		return false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (parser *exprParser) expect(op string) error {
+	if !parser.isOperator(op) {
+		return parser.errorf("expected \"%s\" but found %s", op, parser.peek())
+	}
+	parser.next()
+	return nil
+}
+
+func (parser *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Expression: %s at %d", fmt.Sprintf(format, args...), parser.peek().pos)
+}
+
+func (parser *exprParser) parseTernary() (exprNode, error) {
+	cond, err := parser.parseOr()
+	if err != nil || !parser.isOperator("?") {
+		return cond, err
+	}
+	parser.next()
+	then, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := parser.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &exprTernary{cond, then, otherwise}, nil
+}
+
+func (parser *exprParser) parseOr() (exprNode, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.isOperator("||") {
+		parser.next()
+		var right exprNode
+		if right, err = parser.parseAnd(); err == nil {
+			left = &exprLogical{left, right, false}
+		}
+	}
+	return left, err
+}
+
+func (parser *exprParser) parseAnd() (exprNode, error) {
+	left, err := parser.parseComparison()
+	for err == nil && parser.isOperator("&&") {
+		parser.next()
+		var right exprNode
+		if right, err = parser.parseComparison(); err == nil {
+			left = &exprLogical{left, right, true}
+		}
+	}
+	return left, err
+}
+
+func (parser *exprParser) parseComparison() (exprNode, error) {
+	left, err := parser.parseAdditive()
+	if err != nil || !parser.isOperator("==", "!=", "<", "<=", ">", ">=", "=~", "!~", "in") {
+		return left, err
+	}
+
+	op := parser.next().text
+	right, err := parser.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "=~", "!~":
+		node := &exprMatch{value: left, pattern: right, negate: op == "!~"}
+		if literal, isLiteral := right.(*exprLiteral); isLiteral {
+			pattern, isString := literal.value.(string)
+			if !isString {
+				return nil, parser.errorf("regular expression must be a string")
+			}
+			if node.regex, err = regexp.Compile(pattern); err != nil {
+				return nil, parser.errorf("%s", err)
+			}
+		}
+		return node, nil
+	case "in":
+		return &exprIn{left, right}, nil
+	default:
+		return &exprBinary{op, left, right}, nil
+	}
+}
+
+func (parser *exprParser) parseAdditive() (exprNode, error) {
+	left, err := parser.parseMultiplicative()
+	for err == nil && parser.isOperator("+", "-") {
+		op := parser.next().text
+		var right exprNode
+		if right, err = parser.parseMultiplicative(); err == nil {
+			left = &exprBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (parser *exprParser) parseMultiplicative() (exprNode, error) {
+	left, err := parser.parseUnary()
+	for err == nil && parser.isOperator("*", "/", "%") {
+		op := parser.next().text
+		var right exprNode
+		if right, err = parser.parseUnary(); err == nil {
+			left = &exprBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (parser *exprParser) parseUnary() (exprNode, error) {
+	if parser.isOperator("!", "-") {
+		op := parser.next().text
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op, operand}, nil
+	}
+	return parser.parsePostfix()
+}
+
+func (parser *exprParser) parsePostfix() (exprNode, error) {
+	node, err := parser.parsePrimary()
+	for err == nil {
+		switch {
+		case parser.isOperator("."):
+			parser.next()
+			token := parser.next()
+			if token.kind != exprTokenIdent {
+				return nil, parser.errorf("expected field name but found %s", token)
+			}
+			node = &exprIndex{node, &exprLiteral{token.text}}
+
+		case parser.isOperator("["):
+			parser.next()
+			var index exprNode
+			if index, err = parser.parseTernary(); err == nil {
+				err = parser.expect("]")
+				node = &exprIndex{node, index}
+			}
+
+		default:
+			return node, nil
+		}
+	}
+	return nil, err
+}
+
+func (parser *exprParser) parseList(closing string) ([]exprNode, error) {
+	items := []exprNode{}
+	if parser.isOperator(closing) {
+		parser.next()
+		return items, nil
+	}
+	for {
+		item, err := parser.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if !parser.isOperator(",") {
+			break
+		}
+		parser.next()
+	}
+	return items, parser.expect(closing)
+}
+
+func (parser *exprParser) parsePrimary() (exprNode, error) {
+	token := parser.next()
+	switch token.kind {
+	case exprTokenNumber, exprTokenString:
+		return &exprLiteral{token.value}, nil
+
+	case exprTokenIdent:
+		switch token.text {
+		case "true":
+			return &exprLiteral{true}, nil
+		case "false":
+			return &exprLiteral{false}, nil
+		case "null":
+			return &exprLiteral{nil}, nil
+		}
+
+		if parser.isOperator("(") {
+			parser.next()
+			function, known := exprFunctions[token.text]
+			if !known {
+				return nil, fmt.Errorf("Expression: unknown function \"%s\" at %d", token.text, token.pos)
+			}
+			args, err := parser.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			if len(args) < function.minArgs || len(args) > function.maxArgs {
+				return nil, fmt.Errorf("Expression: wrong number of arguments for \"%s\" at %d", token.text, token.pos)
+			}
+			return &exprCall{token.text, function.call, args}, nil
+		}
+
+		if !parser.variables[token.text] {
+			return nil, fmt.Errorf("Expression: unknown variable \"%s\" at %d", token.text, token.pos)
+		}
+		return &exprVariable{token.text}, nil
+
+	case exprTokenOperator:
+		switch token.text {
+		case "(":
+			node, err := parser.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			return node, parser.expect(")")
+		case "[":
+			items, err := parser.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &exprArray{items}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Expression: unexpected %s at %d", token, token.pos)
+}
+
+// Nodes
+
+type exprLiteral struct {
+	value interface{}
+}
+
+func (node *exprLiteral) eval(ctx *exprContext) (interface{}, error) {
+	return node.value, nil
+}
+
+type exprVariable struct {
+	name string
+}
+
+func (node *exprVariable) eval(ctx *exprContext) (interface{}, error) {
+	if err := ctx.tick(false); err != nil {
+		return nil, err
+	}
+	if ctx.scope == nil {
+		return nil, nil
+	}
+	value, _ := ctx.scope(node.name)
+	return normalizeExpressionValue(value), nil
+}
+
+type exprArray struct {
+	items []exprNode
+}
+
+func (node *exprArray) eval(ctx *exprContext) (interface{}, error) {
+	result := make([]interface{}, len(node.items))
+	for idx, item := range node.items {
+		value, err := item.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result[idx] = value
+	}
+	return result, nil
+}
+
+type exprIndex struct {
+	value exprNode
+	index exprNode
+}
+
+func (node *exprIndex) eval(ctx *exprContext) (interface{}, error) {
+	value, err := node.value.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index, err := node.index.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.tick(false); err != nil {
+		return nil, err
+	}
+
+	switch container := value.(type) {
+	case map[string]interface{}:
+		return normalizeExpressionValue(container[ExpressionString(index)]), nil
+	case []interface{}:
+		if number, isNumber := expressionNumber(index); isNumber {
+			idx := int(number)
+			if idx < 0 {
+				idx += len(container)
+			}
+			if idx >= 0 && idx < len(container) {
+				return normalizeExpressionValue(container[idx]), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+
+func (node *exprUnary) eval(ctx *exprContext) (interface{}, error) {
+	value, err := node.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if node.op == "!" {
+		return !ExpressionTruth(value), nil
+	}
+	number, isNumber := expressionNumber(value)
+	if !isNumber {
+		return nil, fmt.Errorf("Expression: cannot negate %s", ExpressionString(value))
+	}
+	return -number, nil
+}
+
+type exprLogical struct {
+	left  exprNode
+	right exprNode
+	and   bool
+}
+
+func (node *exprLogical) eval(ctx *exprContext) (interface{}, error) {
+	left, err := node.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ExpressionTruth(left) != node.and {
+		return !node.and, nil // ### return, short circuit ###
+	}
+	right, err := node.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ExpressionTruth(right), nil
+}
+
+type exprTernary struct {
+	cond      exprNode
+	then      exprNode
+	otherwise exprNode
+}
+
+func (node *exprTernary) eval(ctx *exprContext) (interface{}, error) {
+	cond, err := node.cond.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ExpressionTruth(cond) {
+		return node.then.eval(ctx)
+	}
+	return node.otherwise.eval(ctx)
+}
+
+type exprBinary struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (node *exprBinary) eval(ctx *exprContext) (interface{}, error) {
+	left, err := node.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := node.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.tick(false); err != nil {
+		return nil, err
+	}
+
+	switch node.op {
+	case "==":
+		return expressionEqual(left, right), nil
+	case "!=":
+		return !expressionEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return expressionCompare(node.op, left, right), nil
+	}
+
+	_, leftIsString := left.(string)
+	_, rightIsString := right.(string)
+	if node.op == "+" && (leftIsString || rightIsString) {
+		return ExpressionString(left) + ExpressionString(right), nil
+	}
+
+	leftNum, leftOk := expressionNumber(left)
+	rightNum, rightOk := expressionNumber(right)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("Expression: operator \"%s\" requires numbers", node.op)
+	}
+
+	switch node.op {
+	case "+":
+		return leftNum + rightNum, nil
+	case "-":
+		return leftNum - rightNum, nil
+	case "*":
+		return leftNum * rightNum, nil
+	case "/":
+		if rightNum == 0 {
+			return nil, fmt.Errorf("Expression: division by zero")
+		}
+		return leftNum / rightNum, nil
+	default:
+		if rightNum == 0 {
+			return nil, fmt.Errorf("Expression: division by zero")
+		}
+		return math.Mod(leftNum, rightNum), nil
+	}
+}
+
+// expressionEqual compares two values. Numbers and strings containing
+// numbers are compared numerically, so that metadata values can be compared
+// to number literals.
+func expressionEqual(left, right interface{}) bool {
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case float64:
+		r, isNumber := expressionNumber(right)
+		_, isBool := right.(bool)
+		return isNumber && !isBool && l == r
+	case string:
+		switch r := right.(type) {
+		case string:
+			return l == r
+		case float64:
+			number, isNumber := expressionNumber(l)
+			return isNumber && number == r
+		}
+		return false
+	case bool:
+		r, isBool := right.(bool)
+		return isBool && l == r
+	default:
+		return right != nil && ExpressionString(left) == ExpressionString(right)
+	}
+}
+
+func expressionCompare(op string, left, right interface{}) bool {
+	var order int
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+
+	if leftIsString && rightIsString {
+		order = strings.Compare(leftString, rightString)
+	} else {
+		leftNum, leftOk := expressionNumber(left)
+		rightNum, rightOk := expressionNumber(right)
+		if !leftOk || !rightOk {
+			return false // ### return, not comparable ###
+		}
+		switch {
+		case leftNum < rightNum:
+			order = -1
+		case leftNum > rightNum:
+			order = 1
+		}
+	}
+
+	switch op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+type exprMatch struct {
+	value   exprNode
+	pattern exprNode
+	regex   *regexp.Regexp
+	negate  bool
+}
+
+func (node *exprMatch) eval(ctx *exprContext) (interface{}, error) {
+	value, err := node.value.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	regex := node.regex
+	if regex == nil {
+		pattern, err := node.pattern.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if regex, err = regexp.Compile(ExpressionString(pattern)); err != nil {
+			return nil, fmt.Errorf("Expression: %s", err)
+		}
+	}
+	if err := ctx.tick(true); err != nil {
+		return nil, err
+	}
+	return regex.MatchString(ExpressionString(value)) != node.negate, nil
+}
+
+type exprIn struct {
+	value     exprNode
+	container exprNode
+}
+
+func (node *exprIn) eval(ctx *exprContext) (interface{}, error) {
+	value, err := node.value.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	container, err := node.container.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.tick(true); err != nil {
+		return nil, err
+	}
+
+	switch c := container.(type) {
+	case string:
+		return strings.Contains(c, ExpressionString(value)), nil
+	case []interface{}:
+		for _, item := range c {
+			if expressionEqual(normalizeExpressionValue(item), value) {
+				return true, nil
+			}
+		}
+	case map[string]interface{}:
+		_, exists := c[ExpressionString(value)]
+		return exists, nil
+	}
+	return false, nil
+}
+
+// Functions
+
+type exprFunction struct {
+	minArgs int
+	maxArgs int
+	call    func(args []interface{}) (interface{}, error)
+}
+
+type exprCall struct {
+	name     string
+	function func(args []interface{}) (interface{}, error)
+	args     []exprNode
+}
+
+func (node *exprCall) eval(ctx *exprContext) (interface{}, error) {
+	args := make([]interface{}, len(node.args))
+	for idx, arg := range node.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[idx] = value
+	}
+	if err := ctx.tick(true); err != nil {
+		return nil, err
+	}
+	result, err := node.function(args)
+	if err != nil {
+		return nil, fmt.Errorf("Expression: %s: %s", node.name, err)
+	}
+	return result, nil
+}
+
+func exprStringFunction(function func(string) interface{}) exprFunction {
+	return exprFunction{1, 1, func(args []interface{}) (interface{}, error) {
+		return function(ExpressionString(args[0])), nil
+	}}
+}
+
+func exprStringPredicate(function func(string, string) bool) exprFunction {
+	return exprFunction{2, 2, func(args []interface{}) (interface{}, error) {
+		return function(ExpressionString(args[0]), ExpressionString(args[1])), nil
+	}}
+}
+
+var exprFunctions map[string]exprFunction
+
+func init() {
+	exprFunctions = map[string]exprFunction{
+		"lower":      exprStringFunction(func(s string) interface{} { return strings.ToLower(s) }),
+		"upper":      exprStringFunction(func(s string) interface{} { return strings.ToUpper(s) }),
+		"trim":       exprStringFunction(func(s string) interface{} { return strings.TrimSpace(s) }),
+		"contains":   exprStringPredicate(strings.Contains),
+		"startsWith": exprStringPredicate(strings.HasPrefix),
+		"endsWith":   exprStringPredicate(strings.HasSuffix),
+
+		"len": {1, 1, func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil:
+				return 0.0, nil
+			case []interface{}:
+				return float64(len(v)), nil
+			case map[string]interface{}:
+				return float64(len(v)), nil
+			default:
+				return float64(utf8.RuneCountInString(ExpressionString(v))), nil
+			}
+		}},
+
+		"replace": {3, 3, func(args []interface{}) (interface{}, error) {
+			return strings.Replace(ExpressionString(args[0]), ExpressionString(args[1]), ExpressionString(args[2]), -1), nil
+		}},
+
+		"substr": {2, 3, func(args []interface{}) (interface{}, error) {
+			value := ExpressionString(args[0])
+			start, isNumber := expressionNumber(args[1])
+			if !isNumber {
+				return nil, fmt.Errorf("start must be a number")
+			}
+			from := int(math.Max(0, math.Min(start, float64(len(value)))))
+			to := len(value)
+			if len(args) == 3 {
+				length, isNumber := expressionNumber(args[2])
+				if !isNumber {
+					return nil, fmt.Errorf("length must be a number")
+				}
+				to = int(math.Max(float64(from), math.Min(float64(from)+length, float64(len(value)))))
+			}
+			return value[from:to], nil
+		}},
+
+		"split": {2, 2, func(args []interface{}) (interface{}, error) {
+			parts := strings.Split(ExpressionString(args[0]), ExpressionString(args[1]))
+			return normalizeExpressionValue(parts), nil
+		}},
+
+		"join": {2, 2, func(args []interface{}) (interface{}, error) {
+			items, isArray := args[0].([]interface{})
+			if !isArray {
+				return ExpressionString(args[0]), nil
+			}
+			parts := make([]string, len(items))
+			for idx, item := range items {
+				parts[idx] = ExpressionString(normalizeExpressionValue(item))
+			}
+			return strings.Join(parts, ExpressionString(args[1])), nil
+		}},
+
+		"extract": {2, 2, func(args []interface{}) (interface{}, error) {
+			regex, err := regexp.Compile(ExpressionString(args[1]))
+			if err != nil {
+				return nil, err
+			}
+			match := regex.FindStringSubmatch(ExpressionString(args[0]))
+			switch len(match) {
+			case 0:
+				return "", nil
+			case 1:
+				return match[0], nil
+			default:
+				return match[1], nil
+			}
+		}},
+
+		"string": {1, 1, func(args []interface{}) (interface{}, error) {
+			return ExpressionString(args[0]), nil
+		}},
+
+		"number": {1, 1, func(args []interface{}) (interface{}, error) {
+			if number, isNumber := expressionNumber(args[0]); isNumber {
+				return number, nil
+			}
+			return nil, nil
+		}},
+
+		"int": {1, 1, func(args []interface{}) (interface{}, error) {
+			if number, isNumber := expressionNumber(args[0]); isNumber {
+				return math.Trunc(number), nil
+			}
+			return nil, nil
+		}},
+
+		"json": {1, 1, func(args []interface{}) (interface{}, error) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(ExpressionString(args[0])), &value); err != nil {
+				return nil, nil
+			}
+			return value, nil
+		}},
+
+		"has": {1, 1, func(args []interface{}) (interface{}, error) {
+			return args[0] != nil, nil
+		}},
+
+		"default": {2, 2, func(args []interface{}) (interface{}, error) {
+			if args[0] != nil {
+				return args[0], nil
+			}
+			return args[1], nil
+		}},
+
+		"now": {0, 0, func(args []interface{}) (interface{}, error) {
+			return float64(time.Now().UnixNano()) / float64(time.Second), nil
+		}},
+	}
+}
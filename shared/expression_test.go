@@ -0,0 +1,147 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testExpressionScope(payload string) ExpressionScope {
+	var data interface{}
+	json.Unmarshal([]byte(payload), &data)
+	meta := map[string]string{"host": "web01", "code": "404"}
+
+	return func(name string) (interface{}, bool) {
+		switch name {
+		case "payload":
+			return payload, true
+		case "json":
+			return data, true
+		case "meta":
+			return meta, true
+		}
+		return nil, false
+	}
+}
+
+func evalTestExpression(expect Expect, source string, payload string) interface{} {
+	expr, err := ParseExpression(source, []string{"payload", "json", "meta"})
+	if !expect.NoError(err) {
+		return nil
+	}
+	value, err := expr.Eval(testExpressionScope(payload), 0)
+	expect.NoError(err)
+	return value
+}
+
+func TestExpressionOperators(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal(7.0, evalTestExpression(expect, "1 + 2 * 3", ""))
+	expect.Equal(9.0, evalTestExpression(expect, "(1 + 2) * 3", ""))
+	expect.Equal(1.0, evalTestExpression(expect, "7 % 3", ""))
+	expect.Equal(-2.5, evalTestExpression(expect, "-5 / 2", ""))
+	expect.Equal("ab1", evalTestExpression(expect, "'a' + \"b\" + 1", ""))
+	expect.Equal(true, evalTestExpression(expect, "1 < 2 && 'a' < 'b'", ""))
+	expect.Equal(true, evalTestExpression(expect, "false || !null", ""))
+	expect.Equal("yes", evalTestExpression(expect, "2 >= 2 ? 'yes' : 'no'", ""))
+	expect.Equal(true, evalTestExpression(expect, "meta.code == 404", ""))
+	expect.Equal(false, evalTestExpression(expect, "meta.code == '40'", ""))
+	expect.Equal(true, evalTestExpression(expect, "payload =~ '^ERROR'", "ERROR: failed"))
+	expect.Equal(true, evalTestExpression(expect, "payload !~ '^INFO'", "ERROR: failed"))
+	expect.Equal(true, evalTestExpression(expect, "'fail' in payload", "ERROR: failed"))
+	expect.Equal(true, evalTestExpression(expect, "2 in [1, 2, 3]", ""))
+	expect.Equal(true, evalTestExpression(expect, "'host' in meta", ""))
+}
+
+func TestExpressionFields(t *testing.T) {
+	expect := NewExpect(t)
+	payload := `{"user":{"name":"Alice","roles":["admin","dev"]},"status":500}`
+
+	expect.Equal("Alice", evalTestExpression(expect, "json.user.name", payload))
+	expect.Equal("dev", evalTestExpression(expect, "json.user.roles[1]", payload))
+	expect.Equal("dev", evalTestExpression(expect, "json.user.roles[-1]", payload))
+	expect.Equal("admin", evalTestExpression(expect, "json['user']['roles'][0]", payload))
+	expect.Nil(evalTestExpression(expect, "json.missing.field", payload))
+	expect.Equal(true, evalTestExpression(expect, "json.status >= 500", payload))
+	expect.Nil(evalTestExpression(expect, "json.user", "no json"))
+}
+
+func TestExpressionFunctions(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal("WEB01", evalTestExpression(expect, "upper(meta.host)", ""))
+	expect.Equal(5.0, evalTestExpression(expect, "len(trim('  hällo '))", ""))
+	expect.Equal("a-b-c", evalTestExpression(expect, "join(split('a,b,c', ','), '-')", ""))
+	expect.Equal("bc", evalTestExpression(expect, "substr('abcd', 1, 2)", ""))
+	expect.Equal("cd", evalTestExpression(expect, "substr('abcd', 2)", ""))
+	expect.Equal("", evalTestExpression(expect, "substr('abcd', 10, 2)", ""))
+	expect.Equal("42", evalTestExpression(expect, "extract(payload, 'id=(\\\\d+)')", "request id=42 done"))
+	expect.Equal(3.0, evalTestExpression(expect, "int(number('3.7'))", ""))
+	expect.Nil(evalTestExpression(expect, "number('abc')", ""))
+	expect.Equal(`{"a":1}`, evalTestExpression(expect, "string(json(payload))", `{"a":1}`))
+	expect.Equal("fallback", evalTestExpression(expect, "default(json.missing, 'fallback')", "{}"))
+	expect.Equal(true, evalTestExpression(expect, "startsWith(payload, 'x') && endsWith(payload, 'z')", "xyz"))
+	expect.Equal("x_z", evalTestExpression(expect, "replace(payload, 'y', '_')", "xyz"))
+}
+
+func TestExpressionErrors(t *testing.T) {
+	expect := NewExpect(t)
+	variables := []string{"payload"}
+
+	_, err := ParseExpression("1 +", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("unknown + 1", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("missing(payload)", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("len(payload, 1)", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("payload =~ '('", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("'unterminated", variables)
+	expect.NotNil(err)
+	_, err = ParseExpression("(1 + 2", variables)
+	expect.NotNil(err)
+
+	expr, err := ParseExpression("1 / (payload == 'x' ? 0 : 1)", variables)
+	expect.NoError(err)
+	_, err = expr.Eval(testExpressionScope("x"), 0)
+	expect.NotNil(err)
+	value, err := expr.Eval(testExpressionScope("y"), 0)
+	expect.NoError(err)
+	expect.Equal(1.0, value)
+}
+
+func TestExpressionTimeout(t *testing.T) {
+	expect := NewExpect(t)
+
+	expr, err := ParseExpression("len(payload) > 0", []string{"payload"})
+	expect.NoError(err)
+
+	slowScope := func(name string) (interface{}, bool) {
+		time.Sleep(5 * time.Millisecond)
+		return "value", true
+	}
+
+	_, err = expr.Eval(slowScope, time.Millisecond)
+	expect.Equal(ErrExpressionTimeout, err)
+
+	result, err := expr.EvalBool(slowScope, 0)
+	expect.NoError(err)
+	expect.True(result)
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// FluentdMetadataPrefix is prepended to the names of all metadata fields
+	// generated from Fluentd records.
+	FluentdMetadataPrefix = "fluentd_"
+	// FluentdEventTimeExt is the msgpack extension type used for EventTime
+	FluentdEventTimeExt = int8(0)
+)
+
+// FluentdDigest returns the hex encoded SHA512 hash of all given parts as used
+// by the Fluentd forward protocol handshake.
+func FluentdDigest(parts ...string) string {
+	hash := sha512.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// FluentdString converts a decoded msgpack str or bin value to string.
+// Other types are returned as empty string.
+func FluentdString(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return value.(string)
+	case []byte:
+		return string(value.([]byte))
+	default:
+		return ""
+	}
+}
+
+// FluentdEventTime encodes the given time as Fluentd EventTime extension.
+func FluentdEventTime(timestamp time.Time) MsgpackExt {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(timestamp.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(timestamp.Nanosecond()))
+	return MsgpackExt{Type: FluentdEventTimeExt, Data: data}
+}
+
+// FluentdTime converts a decoded msgpack value to time. Integers and floating
+// point values are treated as seconds since epoch. If the value is not a
+// valid timestamp, false is returned.
+func FluentdTime(value interface{}) (time.Time, bool) {
+	switch value.(type) {
+	case int64:
+		return time.Unix(value.(int64), 0), true
+	case uint64:
+		return time.Unix(int64(value.(uint64)), 0), true
+	case float64:
+		seconds := int64(value.(float64))
+		return time.Unix(seconds, int64((value.(float64)-float64(seconds))*1e9)), true
+	case MsgpackExt:
+		ext := value.(MsgpackExt)
+		if ext.Type == FluentdEventTimeExt && len(ext.Data) == 8 {
+			seconds := binary.BigEndian.Uint32(ext.Data)
+			nanoseconds := binary.BigEndian.Uint32(ext.Data[4:])
+			return time.Unix(int64(seconds), int64(nanoseconds)), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// GELFMetadataPrefix is prepended to the name of GELF fields when they are
+	// stored as message metadata, e.g. "host" is stored as "gelf_host".
+	// Additional fields are stored without their leading underscore.
+	GELFMetadataPrefix = "gelf_"
+
+	// GELFChunkHeaderSize is the size of the header of a chunked GELF message.
+	GELFChunkHeaderSize = 12
+
+	// GELFMaxChunks is the maximum number of chunks a GELF message may be
+	// split into.
+	GELFMaxChunks = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	firstSeen time.Time
+}
+
+// GELFAssembler collects the chunks of chunked GELF messages sent via UDP.
+// Messages that are not completed within a given timeout are discarded.
+// This type is not threadsafe.
+type GELFAssembler struct {
+	messages    map[uint64]*gelfChunkedMessage
+	timeout     time.Duration
+	lastCleanup time.Time
+}
+
+// NewGELFAssembler creates a new assembler discarding incomplete messages
+// after the given timeout.
+func NewGELFAssembler(timeout time.Duration) *GELFAssembler {
+	return &GELFAssembler{
+		messages:    make(map[uint64]*gelfChunkedMessage),
+		timeout:     timeout,
+		lastCleanup: time.Now(),
+	}
+}
+
+// Add processes a received GELF packet. If the packet completes a message,
+// the (still compressed) message is returned. Packets that are not chunked
+// are returned as-is. If the message is not yet complete nil is returned.
+func (assembler *GELFAssembler) Add(packet []byte) ([]byte, error) {
+	if !bytes.HasPrefix(packet, gelfChunkMagic) {
+		return packet, nil // ### return, not chunked ###
+	}
+	if len(packet) < GELFChunkHeaderSize {
+		return nil, fmt.Errorf("GELF chunk too short")
+	}
+
+	now := time.Now()
+	if now.Sub(assembler.lastCleanup) > assembler.timeout {
+		assembler.discardExpired(now)
+	}
+
+	messageID := binary.BigEndian.Uint64(packet[2:])
+	sequence, count := int(packet[10]), int(packet[11])
+	if count == 0 || count > GELFMaxChunks || sequence >= count {
+		return nil, fmt.Errorf("GELF chunk %d of %d is invalid", sequence, count)
+	}
+
+	message, exists := assembler.messages[messageID]
+	if !exists {
+		message = &gelfChunkedMessage{
+			chunks:    make([][]byte, count),
+			firstSeen: now,
+		}
+		assembler.messages[messageID] = message
+	}
+
+	if len(message.chunks) != count {
+		delete(assembler.messages, messageID)
+		return nil, fmt.Errorf("GELF chunk count mismatch")
+	}
+
+	if message.chunks[sequence] == nil {
+		chunk := make([]byte, len(packet)-GELFChunkHeaderSize)
+		copy(chunk, packet[GELFChunkHeaderSize:])
+		message.chunks[sequence] = chunk
+		message.received++
+	}
+
+	if message.received < count {
+		return nil, nil // ### return, incomplete ###
+	}
+
+	delete(assembler.messages, messageID)
+	return bytes.Join(message.chunks, nil), nil
+}
+
+func (assembler *GELFAssembler) discardExpired(now time.Time) {
+	for messageID, message := range assembler.messages {
+		if now.Sub(message.firstSeen) > assembler.timeout {
+			delete(assembler.messages, messageID)
+		}
+	}
+	assembler.lastCleanup = now
+}
+
+// GELFChunks splits a GELF message into chunks of at most chunkSize bytes,
+// including the chunk header. If the message fits into a single packet it is
+// returned as-is. An error is returned if more than GELFMaxChunks chunks
+// would be required.
+func GELFChunks(data []byte, chunkSize int, messageID uint64) ([][]byte, error) {
+	if len(data) <= chunkSize {
+		return [][]byte{data}, nil // ### return, no chunking required ###
+	}
+
+	payloadSize := chunkSize - GELFChunkHeaderSize
+	if payloadSize <= 0 {
+		return nil, fmt.Errorf("GELF chunk size %d is too small", chunkSize)
+	}
+
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > GELFMaxChunks {
+		return nil, fmt.Errorf("GELF message requires %d chunks, only %d are allowed", count, GELFMaxChunks)
+	}
+
+	chunks := make([][]byte, count)
+	for idx := range chunks {
+		start := idx * payloadSize
+		end := start + payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := make([]byte, GELFChunkHeaderSize+end-start)
+		copy(chunk, gelfChunkMagic)
+		binary.BigEndian.PutUint64(chunk[2:], messageID)
+		chunk[10] = byte(idx)
+		chunk[11] = byte(count)
+		copy(chunk[GELFChunkHeaderSize:], data[start:end])
+		chunks[idx] = chunk
+	}
+	return chunks, nil
+}
+
+// GELFDecompress returns the uncompressed GELF message. Gzip and zlib
+// compressed messages are detected by their header. Other messages are
+// returned as-is.
+func GELFDecompress(data []byte) ([]byte, error) {
+	switch {
+	case len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+
+	case len(data) > 1 && data[0]&0x0f == 0x08 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+
+	default:
+		return data, nil
+	}
+}
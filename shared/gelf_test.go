@@ -0,0 +1,73 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"testing"
+	"time"
+)
+
+func TestGELFChunks(t *testing.T) {
+	expect := NewExpect(t)
+	data := bytes.Repeat([]byte("0123456789"), 10)
+
+	chunks, err := GELFChunks(data, 200, 1)
+	expect.NoError(err)
+	expect.Equal(1, len(chunks))
+
+	chunks, err = GELFChunks(data, GELFChunkHeaderSize+30, 42)
+	expect.NoError(err)
+	expect.Equal(4, len(chunks))
+	expect.Equal(GELFChunkHeaderSize+10, len(chunks[3]))
+
+	// Chunks may arrive out of order and duplicated
+	assembler := NewGELFAssembler(time.Second)
+	for _, idx := range []int{2, 0, 0, 3} {
+		message, err := assembler.Add(chunks[idx])
+		expect.NoError(err)
+		expect.Nil(message)
+	}
+
+	message, err := assembler.Add(chunks[1])
+	expect.NoError(err)
+	expect.Equal(string(data), string(message))
+
+	_, err = GELFChunks(data, GELFChunkHeaderSize, 1)
+	expect.NotNil(err)
+}
+
+func TestGELFDecompress(t *testing.T) {
+	expect := NewExpect(t)
+	data := []byte(`{"version":"1.1","host":"test","short_message":"hello"}`)
+
+	gzipData := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&gzipData)
+	gzipWriter.Write(data)
+	gzipWriter.Close()
+
+	zlibData := bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(&zlibData)
+	zlibWriter.Write(data)
+	zlibWriter.Close()
+
+	for _, compressed := range [][]byte{data, gzipData.Bytes(), zlibData.Bytes()} {
+		decompressed, err := GELFDecompress(compressed)
+		expect.NoError(err)
+		expect.Equal(string(data), string(decompressed))
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleTokenURI        = "https://oauth2.googleapis.com/token"
+	googleMetadataHost    = "metadata.google.internal"
+	googleJWTGrantType    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	googleTokenLifetime   = time.Hour
+	googleTokenRefreshGap = time.Minute
+)
+
+// GoogleCredentials provides OAuth2 access tokens for Google Cloud APIs.
+// Tokens are requested using a service account key, the refresh token of a
+// user account or the metadata server available on Google Compute Engine and
+// Kubernetes Engine (workload identity). Tokens are cached until shortly
+// before they expire.
+type GoogleCredentials struct {
+	kind         string
+	email        string
+	keyID        string
+	key          *rsa.PrivateKey
+	tokenURI     string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	scopes       []string
+	client       *http.Client
+	token        string
+	expires      time.Time
+	guard        *sync.Mutex
+}
+
+// googleCredentialsFile contains the fields of service account and user
+// credential files used by GoogleCredentials.
+type googleCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type googleTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// NewGoogleCredentials creates credentials for the given OAuth2 scopes. If
+// file is empty the file named by the GOOGLE_APPLICATION_CREDENTIALS
+// environment variable is used. If this variable is not set either, tokens are
+// requested from the metadata server. The metadata server address can be
+// changed by setting GCE_METADATA_HOST.
+func NewGoogleCredentials(file string, scopes ...string) (*GoogleCredentials, error) {
+	creds := &GoogleCredentials{
+		kind:   "metadata",
+		scopes: scopes,
+		client: &http.Client{Timeout: 10 * time.Second},
+		guard:  new(sync.Mutex),
+	}
+
+	if file == "" {
+		file = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if file == "" {
+		return creds, nil // ### return, use metadata server ###
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	content := googleCredentialsFile{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	creds.kind = content.Type
+	creds.tokenURI = content.TokenURI
+	if creds.tokenURI == "" {
+		creds.tokenURI = googleTokenURI
+	}
+
+	switch content.Type {
+	case "service_account":
+		creds.email = content.ClientEmail
+		creds.keyID = content.PrivateKeyID
+		if creds.key, err = parseGoogleKey(content.PrivateKey); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	case "authorized_user":
+		creds.clientID = content.ClientID
+		creds.clientSecret = content.ClientSecret
+		creds.refreshToken = content.RefreshToken
+	default:
+		return nil, fmt.Errorf("%s: unsupported credentials type \"%s\"", file, content.Type)
+	}
+	return creds, nil
+}
+
+func parseGoogleKey(encoded string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil // ### return, PKCS1 key ###
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, isRSA := parsed.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// Token returns a valid access token.
+func (creds *GoogleCredentials) Token() (string, error) {
+	creds.guard.Lock()
+	defer creds.guard.Unlock()
+
+	if creds.token != "" && time.Now().Add(googleTokenRefreshGap).Before(creds.expires) {
+		return creds.token, nil // ### return, cached ###
+	}
+
+	var resp *http.Response
+	var err error
+
+	switch creds.kind {
+	case "service_account":
+		var assertion string
+		if assertion, err = creds.signJWT(); err != nil {
+			return "", err
+		}
+		resp, err = creds.client.PostForm(creds.tokenURI, url.Values{
+			"grant_type": {googleJWTGrantType},
+			"assertion":  {assertion},
+		})
+
+	case "authorized_user":
+		resp, err = creds.client.PostForm(creds.tokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.clientID},
+			"client_secret": {creds.clientSecret},
+			"refresh_token": {creds.refreshToken},
+		})
+
+	default:
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = googleMetadataHost
+		}
+		query := url.Values{}
+		if len(creds.scopes) > 0 {
+			query.Set("scopes", strings.Join(creds.scopes, ","))
+		}
+
+		var req *http.Request
+		tokenURL := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token?%s", host, query.Encode())
+		if req, err = http.NewRequest("GET", tokenURL, nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = creds.client.Do(req)
+	}
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Token request failed with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	token := googleTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("Token response does not contain an access token")
+	}
+
+	creds.token = token.AccessToken
+	creds.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return creds.token, nil
+}
+
+// signJWT creates the assertion used to request a token for a service
+// account.
+func (creds *GoogleCredentials) signJWT() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": creds.keyID,
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.email,
+		"scope": strings.Join(creds.scopes, " "),
+		"aud":   creds.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleTokenLifetime).Unix(),
+	})
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, creds.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// GoogleAPIError is returned by GoogleCredentials.Post if a request has been
+// answered with a status code other than 200.
+type GoogleAPIError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+// Error implements the error interface
+func (err GoogleAPIError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Status, err.Message)
+}
+
+// Temporary returns true if the request failed because of a server error or
+// rate limits and may succeed if it is sent again.
+func (err GoogleAPIError) Temporary() bool {
+	return err.StatusCode == http.StatusTooManyRequests || err.StatusCode >= 500
+}
+
+// Post sends a JSON encoded request to a Google Cloud API and decodes the JSON
+// response into the given value. The response is ignored if response is nil.
+// A GoogleAPIError is returned if the request has not been answered with 200.
+func (creds *GoogleCredentials) Post(ctx context.Context, client *http.Client, url string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	token, err := creds.Token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return GoogleAPIError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(message)),
+		}
+	}
+
+	if response == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil // ### return, response ignored ###
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGoogleCredentials(t *testing.T) {
+	expect := NewExpect(t)
+	requests := int32(0)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.NoError(err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case req.URL.Path == "/token":
+			expect.Equal(googleJWTGrantType, req.FormValue("grant_type"))
+
+			parts := strings.Split(req.FormValue("assertion"), ".")
+			expect.Equal(3, len(parts))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			expect.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+
+			claims := map[string]interface{}{}
+			data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			json.Unmarshal(data, &claims)
+			expect.Equal("test@example.iam.gserviceaccount.com", claims["iss"])
+			expect.Equal("scope1 scope2", claims["scope"])
+			fmt.Fprint(w, `{"access_token":"account-token","expires_in":3600}`)
+
+		case strings.HasSuffix(req.URL.Path, "/service-accounts/default/token"):
+			expect.Equal("Google", req.Header.Get("Metadata-Flavor"))
+			fmt.Fprint(w, `{"access_token":"metadata-token","expires_in":3600}`)
+
+		case req.URL.Path == "/api":
+			expect.Equal("Bearer account-token", req.Header.Get("Authorization"))
+			request := map[string]string{}
+			json.NewDecoder(req.Body).Decode(&request)
+			if request["fail"] != "" {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, `{"echo":%q}`, request["value"])
+
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	keyFile, err := ioutil.TempFile("", "gollum_google")
+	expect.NoError(err)
+	defer os.Remove(keyFile.Name())
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	content, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "test@example.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    server.URL + "/token",
+	})
+	keyFile.Write(content)
+	keyFile.Close()
+
+	creds, err := NewGoogleCredentials(keyFile.Name(), "scope1", "scope2")
+	expect.NoError(err)
+
+	token, err := creds.Token()
+	expect.NoError(err)
+	expect.Equal("account-token", token)
+	token, _ = creds.Token()
+	expect.Equal("account-token", token)
+	expect.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	response := map[string]string{}
+	expect.NoError(creds.Post(context.Background(), http.DefaultClient, server.URL+"/api", map[string]string{"value": "test"}, &response))
+	expect.Equal("test", response["echo"])
+
+	err = creds.Post(context.Background(), http.DefaultClient, server.URL+"/api", map[string]string{"fail": "true"}, nil)
+	apiErr, isAPIError := err.(GoogleAPIError)
+	expect.True(isAPIError)
+	expect.True(apiErr.Temporary())
+	expect.Equal("unavailable", apiErr.Message)
+
+	// Without a file the metadata server is used
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+
+	creds, err = NewGoogleCredentials("", "scope1")
+	expect.NoError(err)
+	token, err = creds.Token()
+	expect.NoError(err)
+	expect.Equal("metadata-token", token)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// GRPCContentType is the content type used by gRPC requests and responses.
+const GRPCContentType = "application/grpc"
+
+// GRPCStatus is the status code of a gRPC call.
+type GRPCStatus int
+
+const (
+	// GRPCStatusOK is returned on success.
+	GRPCStatusOK = GRPCStatus(0)
+	// GRPCStatusInvalidArgument is returned for malformed requests.
+	GRPCStatusInvalidArgument = GRPCStatus(3)
+	// GRPCStatusPermissionDenied is returned if a request is not allowed.
+	GRPCStatusPermissionDenied = GRPCStatus(7)
+	// GRPCStatusResourceExhausted is returned if a message exceeds the size
+	// limit.
+	GRPCStatusResourceExhausted = GRPCStatus(8)
+	// GRPCStatusUnimplemented is returned for unknown methods or encodings.
+	GRPCStatusUnimplemented = GRPCStatus(12)
+	// GRPCStatusInternal is returned for unexpected errors.
+	GRPCStatusInternal = GRPCStatus(13)
+	// GRPCStatusUnavailable is returned if the service is shutting down.
+	GRPCStatusUnavailable = GRPCStatus(14)
+	// GRPCStatusUnauthenticated is returned if authentication failed.
+	GRPCStatusUnauthenticated = GRPCStatus(16)
+)
+
+// GRPCFrameTooLargeError is returned by ReadGRPCFrame if a message exceeds
+// the given size limit.
+type GRPCFrameTooLargeError struct {
+	size uint32
+}
+
+// Error implements the standard error interface
+func (err GRPCFrameTooLargeError) Error() string {
+	return fmt.Sprintf("gRPC message of %d bytes exceeds the size limit", err.size)
+}
+
+// ReadGRPCFrame reads a length prefixed gRPC message from the given reader.
+// The returned flag is true if the message is compressed. Messages larger
+// than maxSize bytes cause a GRPCFrameTooLargeError. io.EOF is returned if
+// the stream ended before a new message started.
+func ReadGRPCFrame(reader io.Reader, maxSize int) ([]byte, bool, error) {
+	header := [5]byte{}
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, false, fmt.Errorf("Incomplete gRPC message header")
+		}
+		return nil, false, err // ### return, end of stream or error ###
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if int64(size) > int64(maxSize) {
+		return nil, false, GRPCFrameTooLargeError{size}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, false, fmt.Errorf("Incomplete gRPC message: %s", err.Error())
+	}
+	return data, header[0] == 1, nil
+}
+
+// WriteGRPCFrame writes a length prefixed gRPC message to the given writer.
+func WriteGRPCFrame(writer io.Writer, data []byte, compressed bool) error {
+	frame := make([]byte, 5, 5+len(data))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	_, err := writer.Write(append(frame, data...))
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGRPCFrame(t *testing.T) {
+	expect := NewExpect(t)
+	buffer := bytes.Buffer{}
+
+	expect.NoError(WriteGRPCFrame(&buffer, []byte("test"), false))
+	expect.NoError(WriteGRPCFrame(&buffer, []byte("compressed"), true))
+	expect.Equal("\x00\x00\x00\x00\x04test", string(buffer.Bytes()[:9]))
+
+	data, compressed, err := ReadGRPCFrame(&buffer, 1024)
+	expect.NoError(err)
+	expect.False(compressed)
+	expect.Equal("test", string(data))
+
+	data, compressed, err = ReadGRPCFrame(&buffer, 1024)
+	expect.NoError(err)
+	expect.True(compressed)
+	expect.Equal("compressed", string(data))
+
+	_, _, err = ReadGRPCFrame(&buffer, 1024)
+	expect.Equal(io.EOF, err)
+
+	WriteGRPCFrame(&buffer, []byte("too large"), false)
+	_, _, err = ReadGRPCFrame(&buffer, 4)
+	_, isTooLarge := err.(GRPCFrameTooLargeError)
+	expect.True(isTooLarge)
+
+	buffer.Reset()
+	buffer.Write([]byte{0, 0, 0})
+	_, _, err = ReadGRPCFrame(&buffer, 1024)
+	expect.NotNil(err)
+	expect.Neq(io.EOF, err)
+}
+
+func TestIngestBatch(t *testing.T) {
+	expect := NewExpect(t)
+
+	messages := []IngestMessage{
+		{Stream: "test", Data: []byte("first"), Metadata: map[string]string{"key": "value", "empty": ""}, Timestamp: 1234567890123456789},
+		{Data: []byte("second")},
+		{},
+	}
+
+	decoded, err := DecodeIngestBatch(EncodeIngestBatch(messages))
+	expect.NoError(err)
+	expect.Equal(3, len(decoded))
+
+	expect.Equal("test", decoded[0].Stream)
+	expect.Equal("first", string(decoded[0].Data))
+	expect.Equal("value", decoded[0].Metadata["key"])
+	expect.Equal(2, len(decoded[0].Metadata))
+	expect.Equal(int64(1234567890123456789), decoded[0].Timestamp)
+
+	expect.Equal("", decoded[1].Stream)
+	expect.Equal("second", string(decoded[1].Data))
+	expect.Nil(decoded[1].Metadata)
+	expect.Equal(int64(0), decoded[1].Timestamp)
+
+	expect.Equal(0, len(decoded[2].Data))
+
+	_, err = DecodeIngestBatch([]byte{0x0A, 0x05, 0x01})
+	expect.NotNil(err)
+}
+
+func TestIngestAck(t *testing.T) {
+	expect := NewExpect(t)
+
+	ack, err := DecodeIngestAck(EncodeIngestAck(IngestAck{Accepted: 300, Rejected: 2}))
+	expect.NoError(err)
+	expect.Equal(uint64(300), ack.Accepted)
+	expect.Equal(uint64(2), ack.Rejected)
+
+	ack, err = DecodeIngestAck(nil)
+	expect.NoError(err)
+	expect.Equal(uint64(0), ack.Accepted)
+}
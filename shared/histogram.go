@@ -0,0 +1,123 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"sync/atomic"
+)
+
+const (
+	histogramSubBuckets = 4
+	histogramBuckets    = 63 * histogramSubBuckets // int64 uses 63 bits
+)
+
+// Histogram counts int64 values in logarithmic buckets. Each power of two is
+// split into four buckets so that percentiles are accurate to about 25%.
+// Negative values are counted as 0. All functions are threadsafe.
+type Histogram struct {
+	counts [histogramBuckets]uint64
+	max    int64
+}
+
+// HistogramSnapshot holds the state of a histogram at a given time.
+type HistogramSnapshot struct {
+	counts [histogramBuckets]uint64
+	// Count is the number of values added to the histogram
+	Count uint64
+	// Max is the largest value added to the histogram
+	Max int64
+}
+
+// NewHistogram creates a new, empty histogram.
+func NewHistogram() *Histogram {
+	return new(Histogram)
+}
+
+// histogramBucket returns the bucket index for a given value.
+func histogramBucket(value int64) int {
+	if value < histogramSubBuckets {
+		if value < 0 {
+			return 0
+		}
+		return int(value) // ### return, exact bucket ###
+	}
+
+	exponent := uint(0)
+	for shifted := uint64(value); shifted > 1; shifted >>= 1 {
+		exponent++
+	}
+	sub := int(uint64(value)>>(exponent-2)) & (histogramSubBuckets - 1)
+	return int(exponent)*histogramSubBuckets + sub
+}
+
+// histogramUpperBound returns the largest value stored in a given bucket.
+func histogramUpperBound(bucket int) int64 {
+	if bucket < histogramSubBuckets {
+		return int64(bucket) // ### return, exact bucket ###
+	}
+	exponent := uint(bucket / histogramSubBuckets)
+	sub := uint64(bucket % histogramSubBuckets)
+	return int64(((histogramSubBuckets + sub + 1) << (exponent - 2)) - 1)
+}
+
+// Add counts the given value.
+func (hist *Histogram) Add(value int64) {
+	atomic.AddUint64(&hist.counts[histogramBucket(value)], 1)
+	for {
+		max := atomic.LoadInt64(&hist.max)
+		if value <= max || atomic.CompareAndSwapInt64(&hist.max, max, value) {
+			return // ### return, max is up to date ###
+		}
+	}
+}
+
+// Reset returns the current state of the histogram and resets all counters.
+// Values added while Reset is running are either counted by the returned
+// snapshot or by the histogram.
+func (hist *Histogram) Reset() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Max: atomic.SwapInt64(&hist.max, 0),
+	}
+	for i := range hist.counts {
+		snapshot.counts[i] = atomic.SwapUint64(&hist.counts[i], 0)
+		snapshot.Count += snapshot.counts[i]
+	}
+	return snapshot
+}
+
+// Percentile returns an estimate of the value below which the given
+// percentage (0-100) of all values fall. If no values have been counted, 0 is
+// returned.
+func (snapshot HistogramSnapshot) Percentile(percent float64) int64 {
+	if snapshot.Count == 0 {
+		return 0 // ### return, no values ###
+	}
+
+	rank := uint64(float64(snapshot.Count)*percent/100.0 + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := uint64(0)
+	for bucket, count := range snapshot.counts {
+		if seen += count; seen >= rank {
+			if bound := histogramUpperBound(bucket); bound < snapshot.Max {
+				return bound
+			}
+			break // ### break, use max ###
+		}
+	}
+	return snapshot.Max
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal(0, histogramBucket(-1))
+	expect.Equal(3, histogramBucket(3))
+	expect.Equal(int64(7), histogramUpperBound(histogramBucket(7)))
+	expect.Equal(int64(1279), histogramUpperBound(histogramBucket(1100)))
+	expect.Equal(int64(9223372036854775807), histogramUpperBound(histogramBucket(9223372036854775807)))
+
+	// Bounds are increasing and match their own bucket
+	for bucket := histogramBucket(4); bucket < histogramBuckets; bucket++ {
+		expect.Equal(bucket, histogramBucket(histogramUpperBound(bucket)))
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	expect := NewExpect(t)
+	hist := NewHistogram()
+
+	for i := int64(1); i <= 1000; i++ {
+		hist.Add(i)
+	}
+
+	snapshot := hist.Reset()
+	expect.Equal(uint64(1000), snapshot.Count)
+	expect.Equal(int64(1000), snapshot.Max)
+	expect.Equal(int64(511), snapshot.Percentile(50))
+	expect.Equal(int64(1000), snapshot.Percentile(99))
+	expect.Equal(int64(1), snapshot.Percentile(0))
+
+	snapshot = hist.Reset()
+	expect.Equal(uint64(0), snapshot.Count)
+	expect.Equal(int64(0), snapshot.Percentile(50))
+}
+
+func TestMetricHistogram(t *testing.T) {
+	expect := NewExpect(t)
+
+	hist := Metric.NewHistogram("TestHist")
+	expect.Equal(hist, Metric.NewHistogram("TestHist"))
+
+	hist.Add(10)
+	hist.Add(20)
+	Metric.UpdateHistograms()
+
+	values := make(map[string]int64)
+	data, err := Metric.Dump()
+	expect.NoError(err)
+	expect.NoError(json.Unmarshal(data, &values))
+
+	expect.Equal(int64(2), values["TestHistCount"])
+	expect.Equal(int64(20), values["TestHistMax"])
+	expect.Equal(int64(11), values["TestHistP50"])
+}
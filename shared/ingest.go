@@ -0,0 +1,213 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+)
+
+// IngestPath is the HTTP/2 path of the streaming Ingest RPC defined in
+// proto/ingest.proto.
+const IngestPath = "/gollum.Ingest/Ingest"
+
+// IngestMessage is a message of the gollum Ingest service.
+type IngestMessage struct {
+	Stream    string
+	Data      []byte
+	Metadata  map[string]string
+	Timestamp int64
+}
+
+// IngestAck is the response to a batch of the gollum Ingest service.
+type IngestAck struct {
+	Accepted uint64
+	Rejected uint64
+}
+
+// EncodeIngestBatch encodes the given messages as a gollum.Batch.
+func EncodeIngestBatch(messages []IngestMessage) []byte {
+	batch := NewProtobufWriter(len(messages) * 64)
+	for _, msg := range messages {
+		encoded := NewProtobufWriter(len(msg.Data) + len(msg.Stream) + 16)
+		if msg.Stream != "" {
+			encoded.WriteStringField(1, msg.Stream)
+		}
+		if len(msg.Data) > 0 {
+			encoded.WriteBytesField(2, msg.Data)
+		}
+		for key, value := range msg.Metadata {
+			entry := NewProtobufWriter(len(key) + len(value) + 4)
+			entry.WriteStringField(1, key)
+			entry.WriteStringField(2, value)
+			encoded.WriteBytesField(3, entry.Bytes())
+		}
+		if msg.Timestamp != 0 {
+			encoded.WriteVarintField(4, uint64(msg.Timestamp))
+		}
+		batch.WriteBytesField(1, encoded.Bytes())
+	}
+	return batch.Bytes()
+}
+
+// DecodeIngestBatch decodes a gollum.Batch. Unknown fields are ignored. The
+// data of the returned messages references the given buffer.
+func DecodeIngestBatch(data []byte) ([]IngestMessage, error) {
+	messages := []IngestMessage{}
+	reader := NewProtobufReader(data)
+
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != ProtobufBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return nil, err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		encoded, err := reader.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeIngestMessage(encoded)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func decodeIngestMessage(data []byte) (IngestMessage, error) {
+	msg := IngestMessage{}
+	reader := NewProtobufReader(data)
+
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return msg, err
+		}
+
+		switch {
+		case field == 1 && wireType == ProtobufBytes:
+			value, err := reader.ReadBytes()
+			if err != nil {
+				return msg, err
+			}
+			msg.Stream = string(value)
+
+		case field == 2 && wireType == ProtobufBytes:
+			if msg.Data, err = reader.ReadBytes(); err != nil {
+				return msg, err
+			}
+
+		case field == 3 && wireType == ProtobufBytes:
+			entry, err := reader.ReadBytes()
+			if err != nil {
+				return msg, err
+			}
+			key, value, err := decodeIngestMetadata(entry)
+			if err != nil {
+				return msg, err
+			}
+			if msg.Metadata == nil {
+				msg.Metadata = make(map[string]string)
+			}
+			msg.Metadata[key] = value
+
+		case field == 4 && wireType == ProtobufVarint:
+			value, err := reader.ReadVarint()
+			if err != nil {
+				return msg, err
+			}
+			msg.Timestamp = int64(value)
+
+		default:
+			if err := reader.Skip(wireType); err != nil {
+				return msg, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+func decodeIngestMetadata(data []byte) (string, string, error) {
+	var key, value string
+	reader := NewProtobufReader(data)
+
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return "", "", err
+		}
+		if (field != 1 && field != 2) || wireType != ProtobufBytes {
+			if err := reader.Skip(wireType); err != nil {
+				return "", "", err
+			}
+			continue // ### continue, unknown field ###
+		}
+
+		data, err := reader.ReadBytes()
+		if err != nil {
+			return "", "", err
+		}
+		if field == 1 {
+			key = string(data)
+		} else {
+			value = string(data)
+		}
+	}
+	return key, value, nil
+}
+
+// EncodeIngestAck encodes the given ack as a gollum.Ack.
+func EncodeIngestAck(ack IngestAck) []byte {
+	encoded := NewProtobufWriter(16)
+	if ack.Accepted > 0 {
+		encoded.WriteVarintField(1, ack.Accepted)
+	}
+	if ack.Rejected > 0 {
+		encoded.WriteVarintField(2, ack.Rejected)
+	}
+	return encoded.Bytes()
+}
+
+// DecodeIngestAck decodes a gollum.Ack.
+func DecodeIngestAck(data []byte) (IngestAck, error) {
+	ack := IngestAck{}
+	reader := NewProtobufReader(data)
+
+	for reader.HasData() {
+		field, wireType, err := reader.ReadTag()
+		if err != nil {
+			return ack, err
+		}
+
+		switch {
+		case field == 1 && wireType == ProtobufVarint:
+			ack.Accepted, err = reader.ReadVarint()
+		case field == 2 && wireType == ProtobufVarint:
+			ack.Rejected, err = reader.ReadVarint()
+		default:
+			err = reader.Skip(wireType)
+		}
+		if err != nil {
+			return ack, fmt.Errorf("Invalid ack: %s", err.Error())
+		}
+	}
+	return ack, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiLabelName matches valid Loki label names
+var LokiLabelName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+var lokiLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// LokiEntry is a single log line sent to Loki.
+type LokiEntry struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// LokiStream is a set of entries sharing the same labels.
+type LokiStream struct {
+	Labels  map[string]string
+	Entries []LokiEntry
+}
+
+// LokiLabelString formats labels as used by the Loki protobuf API, e.g.
+// `{app="web", level="info"}`. Labels are sorted by name so that equal label
+// sets generate the same string.
+func LokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labelString := bytes.Buffer{}
+	labelString.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			labelString.WriteString(", ")
+		}
+		labelString.WriteString(name)
+		labelString.WriteString(`="`)
+		labelString.WriteString(lokiLabelReplacer.Replace(labels[name]))
+		labelString.WriteByte('"')
+	}
+	labelString.WriteByte('}')
+	return labelString.String()
+}
+
+// EncodeLokiProtobuf encodes streams as logproto.PushRequest. Loki expects
+// this message to be compressed with snappy (block format).
+func EncodeLokiProtobuf(streams []LokiStream) []byte {
+	request := NewProtobufWriter(4096)
+	for _, stream := range streams {
+		streamWriter := NewProtobufWriter(1024)
+		streamWriter.WriteStringField(1, LokiLabelString(stream.Labels))
+
+		for _, entry := range stream.Entries {
+			timestamp := NewProtobufWriter(16)
+			timestamp.WriteVarintField(1, uint64(entry.Timestamp.Unix()))
+			timestamp.WriteVarintField(2, uint64(entry.Timestamp.Nanosecond()))
+
+			entryWriter := NewProtobufWriter(len(entry.Line) + 32)
+			entryWriter.WriteBytesField(1, timestamp.Bytes())
+			entryWriter.WriteStringField(2, entry.Line)
+			streamWriter.WriteBytesField(2, entryWriter.Bytes())
+		}
+		request.WriteBytesField(1, streamWriter.Bytes())
+	}
+	return request.Bytes()
+}
+
+// EncodeLokiJSON encodes streams as JSON push request.
+func EncodeLokiJSON(streams []LokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{make([]jsonStream, 0, len(streams))}
+
+	for _, stream := range streams {
+		encoded := jsonStream{
+			Stream: stream.Labels,
+			Values: make([][2]string, 0, len(stream.Entries)),
+		}
+		for _, entry := range stream.Entries {
+			encoded.Values = append(encoded.Values, [2]string{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line})
+		}
+		request.Streams = append(request.Streams, encoded)
+	}
+	return json.Marshal(request)
+}
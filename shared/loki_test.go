@@ -0,0 +1,95 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func lokiTestStreams() []LokiStream {
+	return []LokiStream{
+		{
+			Labels: map[string]string{"level": "info", "app": "web"},
+			Entries: []LokiEntry{
+				{time.Unix(1425736509, 123), "first"},
+				{time.Unix(1425736510, 0), "second"},
+			},
+		},
+	}
+}
+
+func TestLokiLabelString(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal(`{app="web", level="info"}`, LokiLabelString(map[string]string{"level": "info", "app": "web"}))
+	expect.Equal(`{msg="a \"quoted\" \\ line\n"}`, LokiLabelString(map[string]string{"msg": "a \"quoted\" \\ line\n"}))
+	expect.Equal(`{}`, LokiLabelString(map[string]string{}))
+
+	expect.True(LokiLabelName.MatchString("service_name"))
+	expect.False(LokiLabelName.MatchString("1st"))
+	expect.False(LokiLabelName.MatchString("service-name"))
+}
+
+func TestLokiProtobuf(t *testing.T) {
+	expect := NewExpect(t)
+	reader := NewProtobufReader(EncodeLokiProtobuf(lokiTestStreams()))
+
+	field, _, err := reader.ReadTag()
+	expect.NoError(err)
+	expect.Equal(1, field)
+	streamData, _ := reader.ReadBytes()
+	expect.False(reader.HasData())
+
+	stream := NewProtobufReader(streamData)
+	field, _, _ = stream.ReadTag()
+	expect.Equal(1, field)
+	labels, _ := stream.ReadBytes()
+	expect.Equal(`{app="web", level="info"}`, string(labels))
+
+	field, _, _ = stream.ReadTag()
+	expect.Equal(2, field)
+	entryData, _ := stream.ReadBytes()
+	entry := NewProtobufReader(entryData)
+
+	field, _, _ = entry.ReadTag()
+	expect.Equal(1, field)
+	timestampData, _ := entry.ReadBytes()
+	timestamp := NewProtobufReader(timestampData)
+	timestamp.ReadTag()
+	seconds, _ := timestamp.ReadVarint()
+	expect.Equal(uint64(1425736509), seconds)
+	timestamp.ReadTag()
+	nanos, _ := timestamp.ReadVarint()
+	expect.Equal(uint64(123), nanos)
+
+	field, _, _ = entry.ReadTag()
+	expect.Equal(2, field)
+	line, _ := entry.ReadBytes()
+	expect.Equal("first", string(line))
+
+	field, _, _ = stream.ReadTag()
+	expect.Equal(2, field)
+	stream.ReadBytes()
+	expect.False(stream.HasData())
+}
+
+func TestLokiJSON(t *testing.T) {
+	expect := NewExpect(t)
+
+	data, err := EncodeLokiJSON(lokiTestStreams())
+	expect.NoError(err)
+	expect.Equal(`{"streams":[{"stream":{"app":"web","level":"info"},"values":[["1425736509000000123","first"],["1425736510000000000","second"]]}]}`, string(data))
+}
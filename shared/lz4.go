@@ -0,0 +1,443 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+)
+
+// LZ4Magic is the magic number at the start of each LZ4 frame.
+const LZ4Magic = uint32(0x184D2204)
+
+const (
+	lz4SkippableMagic = uint32(0x184D2A50)
+	lz4SkippableMask  = uint32(0xFFFFFFF0)
+	lz4BlockSize      = 64 << 10
+	lz4WindowSize     = 64 << 10
+	lz4HashLog        = 14
+	lz4MinMatch       = 4
+	lz4LastLiterals   = 5  // the last bytes of a block are always literals
+	lz4MatchLimit     = 12 // the last match has to start this far from the end
+	lz4Uncompressed   = uint32(1 << 31)
+)
+
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+// lz4HeaderChecksum calculates the XXH32 based checksum of a frame
+// descriptor. Descriptors are shorter than 16 bytes, so the main loop of
+// XXH32 is not required.
+func lz4HeaderChecksum(descriptor []byte) byte {
+	hash := xxh32Prime5 + uint32(len(descriptor))
+	for ; len(descriptor) >= 4; descriptor = descriptor[4:] {
+		hash += binary.LittleEndian.Uint32(descriptor) * xxh32Prime3
+		hash = bits.RotateLeft32(hash, 17) * xxh32Prime4
+	}
+	for _, value := range descriptor {
+		hash += uint32(value) * xxh32Prime5
+		hash = bits.RotateLeft32(hash, 11) * xxh32Prime1
+	}
+	hash ^= hash >> 15
+	hash *= xxh32Prime2
+	hash ^= hash >> 13
+	hash *= xxh32Prime3
+	hash ^= hash >> 16
+	return byte(hash >> 8)
+}
+
+// lz4Writer compresses data to an LZ4 frame.
+type lz4Writer struct {
+	writer  io.Writer
+	buffer  []byte
+	table   []int32
+	started bool
+	err     error
+}
+
+// NewLZ4Writer returns a writer compressing all data written to it to a
+// single LZ4 frame using independent blocks of 64 KB. The frame is completed
+// by calling Close.
+func NewLZ4Writer(writer io.Writer) io.WriteCloser {
+	return &lz4Writer{
+		writer: writer,
+		buffer: make([]byte, 0, lz4BlockSize),
+		table:  make([]int32, 1<<lz4HashLog),
+	}
+}
+
+// Write compresses all full blocks and buffers the remaining data.
+func (writer *lz4Writer) Write(data []byte) (int, error) {
+	written := 0
+	for writer.err == nil && len(data) > 0 {
+		count := copy(writer.buffer[len(writer.buffer):lz4BlockSize], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+count]
+		data = data[count:]
+		written += count
+		if len(writer.buffer) == lz4BlockSize {
+			writer.writeBlock()
+		}
+	}
+	return written, writer.err
+}
+
+// Close writes the remaining data and the end mark. The underlying writer is
+// not closed.
+func (writer *lz4Writer) Close() error {
+	if writer.err == nil {
+		writer.writeBlock()
+	}
+	if writer.err == nil {
+		_, writer.err = writer.writer.Write([]byte{0, 0, 0, 0})
+	}
+	return writer.err
+}
+
+// writeBlock compresses the buffered data. The frame header is written
+// before the first block.
+func (writer *lz4Writer) writeBlock() {
+	out := make([]byte, 0, len(writer.buffer)+16)
+	if !writer.started {
+		// Version 1, independent blocks, 64 KB maximum block size
+		out = append(out, 0, 0, 0, 0, 0x60, 0x40)
+		binary.LittleEndian.PutUint32(out, LZ4Magic)
+		out = append(out, lz4HeaderChecksum(out[4:6]))
+		writer.started = true
+	}
+
+	if len(writer.buffer) > 0 {
+		block := writer.compressBlock(writer.buffer)
+		if len(block) >= len(writer.buffer) {
+			out = append(out, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(writer.buffer))|lz4Uncompressed)
+			out = append(out, writer.buffer...)
+		} else {
+			out = append(out, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(block)))
+			out = append(out, block...)
+		}
+	}
+
+	writer.buffer = writer.buffer[:0]
+	if len(out) > 0 {
+		_, writer.err = writer.writer.Write(out)
+	}
+}
+
+// appendLZ4Length appends the bytes of a length exceeding the 4 bits stored
+// in the token.
+func appendLZ4Length(out []byte, length int) []byte {
+	for length -= 15; length >= 255; length -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(length))
+}
+
+// appendLZ4Sequence appends literals followed by a match. A match length of
+// 0 denotes the last sequence containing literals only.
+func appendLZ4Sequence(out []byte, literals []byte, offset int, match int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals) << 4)
+	}
+	if match > 0 {
+		if match-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(match - lz4MinMatch)
+		}
+	}
+
+	out = append(out, token)
+	if len(literals) >= 15 {
+		out = appendLZ4Length(out, len(literals))
+	}
+	out = append(out, literals...)
+	if match > 0 {
+		out = append(out, byte(offset), byte(offset>>8))
+		if match-lz4MinMatch >= 15 {
+			out = appendLZ4Length(out, match-lz4MinMatch)
+		}
+	}
+	return out
+}
+
+// compressBlock compresses a block of at most 64 KB.
+func (writer *lz4Writer) compressBlock(data []byte) []byte {
+	for i := range writer.table {
+		writer.table[i] = 0
+	}
+
+	out := make([]byte, 0, len(data))
+	anchor := 0
+	matchEnd := len(data) - lz4LastLiterals
+
+	for pos := 0; pos+lz4MatchLimit <= len(data); {
+		value := binary.LittleEndian.Uint32(data[pos:])
+		hash := (value * xxh32Prime1) >> (32 - lz4HashLog)
+		candidate := int(writer.table[hash]) - 1
+		writer.table[hash] = int32(pos + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(data[candidate:]) != value {
+			pos += 1 + (pos-anchor)>>6 // skip faster through incompressible data
+			continue
+		}
+
+		length := lz4MinMatch
+		for pos+length < matchEnd && data[candidate+length] == data[pos+length] {
+			length++
+		}
+		out = appendLZ4Sequence(out, data[anchor:pos], pos-candidate, length)
+		pos += length
+		anchor = pos
+	}
+	return appendLZ4Sequence(out, data[anchor:], 0, 0)
+}
+
+// decodeLZ4Block decodes a block and appends it to out. Matches may refer to
+// the data already stored in out.
+func decodeLZ4Block(out []byte, block []byte, maxSize int) ([]byte, error) {
+	start := len(out)
+	readLength := func(pos int, length int) (int, int, error) {
+		for {
+			if pos >= len(block) {
+				return 0, 0, fmt.Errorf("lz4: truncated block")
+			}
+			value := int(block[pos])
+			pos++
+			length += value
+			if value != 255 {
+				return pos, length, nil
+			}
+		}
+	}
+
+	for pos := 0; pos < len(block); {
+		token := int(block[pos])
+		pos++
+
+		literals := token >> 4
+		if literals == 15 {
+			var err error
+			if pos, literals, err = readLength(pos, literals); err != nil {
+				return nil, err
+			}
+		}
+		if literals > len(block)-pos || len(out)-start+literals > maxSize {
+			return nil, fmt.Errorf("lz4: invalid literal length")
+		}
+		out = append(out, block[pos:pos+literals]...)
+		pos += literals
+		if pos == len(block) {
+			break // ### break, last sequence ###
+		}
+
+		if pos+2 > len(block) {
+			return nil, fmt.Errorf("lz4: truncated block")
+		}
+		offset := int(block[pos]) | int(block[pos+1])<<8
+		pos += 2
+
+		match := token & 0x0F
+		if match == 15 {
+			var err error
+			if pos, match, err = readLength(pos, match); err != nil {
+				return nil, err
+			}
+		}
+		match += lz4MinMatch
+		if offset == 0 || offset > len(out) || len(out)-start+match > maxSize {
+			return nil, fmt.Errorf("lz4: invalid match")
+		}
+
+		from := len(out) - offset
+		for i := 0; i < match; i++ {
+			out = append(out, out[from+i])
+		}
+	}
+	return out, nil
+}
+
+// lz4Reader decompresses LZ4 frames.
+type lz4Reader struct {
+	reader       io.Reader
+	header       []byte
+	decoded      []byte
+	pending      []byte
+	blockMax     int
+	blockCheck   bool
+	contentCheck bool
+	independent  bool
+	inFrame      bool
+}
+
+// NewLZ4Reader returns a reader decompressing all LZ4 frames read from the
+// given reader. Skippable frames are ignored. Checksums of blocks and content
+// are not validated and dictionaries are not supported.
+func NewLZ4Reader(reader io.Reader) io.Reader {
+	return &lz4Reader{
+		reader: reader,
+		header: make([]byte, 15),
+	}
+}
+
+// Read satisfies the io.Reader interface.
+func (reader *lz4Reader) Read(data []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if err := reader.next(); err != nil {
+			return 0, err
+		}
+	}
+	count := copy(data, reader.pending)
+	reader.pending = reader.pending[count:]
+	return count, nil
+}
+
+// next decodes the next block, reading frame headers as required.
+func (reader *lz4Reader) next() error {
+	if !reader.inFrame {
+		return reader.readFrameHeader()
+	}
+
+	sizeField, err := reader.readUint32()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if sizeField == 0 {
+		reader.inFrame = false
+		if reader.contentCheck {
+			if _, err := reader.readUint32(); err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		return nil // ### return, end of frame ###
+	}
+
+	size := int(sizeField &^ lz4Uncompressed)
+	if size > reader.blockMax {
+		return fmt.Errorf("lz4: block exceeds maximum block size")
+	}
+	block := make([]byte, size)
+	if _, err := io.ReadFull(reader.reader, block); err != nil {
+		return unexpectedEOF(err)
+	}
+	if reader.blockCheck {
+		if _, err := reader.readUint32(); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	// Linked blocks may refer to the previous 64 KB of decoded data
+	window := reader.decoded
+	if reader.independent {
+		window = window[:0]
+	} else if len(window) > lz4WindowSize {
+		window = window[len(window)-lz4WindowSize:]
+	}
+	start := len(window)
+
+	if sizeField&lz4Uncompressed != 0 {
+		reader.decoded = append(window, block...)
+	} else if reader.decoded, err = decodeLZ4Block(window, block, reader.blockMax); err != nil {
+		return err
+	}
+	reader.pending = reader.decoded[start:]
+	return nil
+}
+
+// readFrameHeader reads the header of the next frame and skips skippable
+// frames. io.EOF is returned if there is no more frame.
+func (reader *lz4Reader) readFrameHeader() error {
+	magic, err := reader.readUint32()
+	if err != nil {
+		return err // ### return, no more frames ###
+	}
+
+	if magic&lz4SkippableMask == lz4SkippableMagic {
+		size, err := reader.readUint32()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, reader.reader, int64(size)); err != nil {
+			return unexpectedEOF(err)
+		}
+		return nil // ### return, skippable frame ###
+	}
+	if magic != LZ4Magic {
+		return fmt.Errorf("lz4: invalid magic number")
+	}
+
+	header := reader.header[:2]
+	if _, err := io.ReadFull(reader.reader, header); err != nil {
+		return unexpectedEOF(err)
+	}
+	flags, blockDescriptor := header[0], header[1]
+	if flags>>6 != 1 {
+		return fmt.Errorf("lz4: unsupported version")
+	}
+	if flags&0x01 != 0 {
+		return fmt.Errorf("lz4: dictionaries are not supported")
+	}
+
+	size := 1 // header checksum
+	if flags&0x08 != 0 {
+		size += 8 // content size
+	}
+	header = reader.header[:2+size]
+	if _, err := io.ReadFull(reader.reader, header[2:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if lz4HeaderChecksum(header[:len(header)-1]) != header[len(header)-1] {
+		return fmt.Errorf("lz4: header checksum mismatch")
+	}
+
+	blockSizeID := (blockDescriptor >> 4) & 0x07
+	if blockSizeID < 4 {
+		return fmt.Errorf("lz4: invalid block size")
+	}
+	reader.blockMax = 1 << (8 + 2*uint(blockSizeID))
+	reader.independent = flags&0x20 != 0
+	reader.blockCheck = flags&0x10 != 0
+	reader.contentCheck = flags&0x04 != 0
+	reader.decoded = reader.decoded[:0]
+	reader.inFrame = true
+	return nil
+}
+
+func (reader *lz4Reader) readUint32() (uint32, error) {
+	data := reader.header[:4]
+	if _, err := io.ReadFull(reader.reader, data); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
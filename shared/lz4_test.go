@@ -0,0 +1,68 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestLZ4Reader(t *testing.T) {
+	expect := NewExpect(t)
+
+	// lz4 -9 -BD --content-size, using linked blocks and a content checksum
+	data, _ := hex.DecodeString("04224d186c401d000000000000003e0f0000006e68656c6c6f20060050776f726c6400000000e5fc6ad1")
+	decoded, err := ioutil.ReadAll(NewLZ4Reader(bytes.NewReader(data)))
+	expect.NoError(err)
+	expect.Equal("hello hello hello hello world", string(decoded))
+
+	// Concatenated frames are read as one stream
+	decoded, err = ioutil.ReadAll(NewLZ4Reader(bytes.NewReader(append(data, data...))))
+	expect.NoError(err)
+	expect.Equal("hello hello hello hello worldhello hello hello hello world", string(decoded))
+
+	// Truncated frames must not panic
+	for i := 1; i < len(data)-4; i++ {
+		_, err = ioutil.ReadAll(NewLZ4Reader(bytes.NewReader(data[:i])))
+		expect.NotNil(err)
+	}
+}
+
+func TestLZ4Writer(t *testing.T) {
+	expect := NewExpect(t)
+
+	logs := bytes.Buffer{}
+	for i := 0; logs.Len() < 200000; i++ {
+		fmt.Fprintf(&logs, `{"level":"info","msg":"request %d served"}`+"\n", i)
+	}
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, data := range [][]byte{{}, []byte("short"), logs.Bytes(), random} {
+		buffer := bytes.Buffer{}
+		writer := NewLZ4Writer(&buffer)
+		_, err := writer.Write(data)
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+
+		decoded, err := ioutil.ReadAll(NewLZ4Reader(&buffer))
+		expect.NoError(err)
+		expect.True(bytes.Equal(data, decoded))
+	}
+}
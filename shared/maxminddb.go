@@ -0,0 +1,365 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEnd       = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+
+	mmdbDataSeparator = 16
+	mmdbMaxDepth      = 64
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a database.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// errMMDBShortData is returned if a database is truncated
+var errMMDBShortData = fmt.Errorf("Unexpected end of MaxMind DB data")
+
+// MaxMindDB is a reader for databases in the MaxMind DB format, e.g. the
+// GeoIP2 and GeoLite2 databases. The whole database is held in memory.
+// A MaxMindDB is read-only and can be used by multiple go routines.
+type MaxMindDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	ipv4Start  uint64
+	// Metadata contains the metadata section of the database, e.g. the
+	// "database_type" and "build_epoch" fields.
+	Metadata map[string]interface{}
+}
+
+// OpenMaxMindDB reads the database stored in the given file.
+func OpenMaxMindDB(path string) (*MaxMindDB, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMaxMindDB(data)
+}
+
+// NewMaxMindDB parses a database held in memory.
+func NewMaxMindDB(data []byte) (*MaxMindDB, error) {
+	markerIdx := bytes.LastIndex(data, mmdbMetadataMarker)
+	if markerIdx < 0 {
+		return nil, fmt.Errorf("Not a MaxMind DB: metadata not found")
+	}
+
+	metadataSection := data[markerIdx+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDBValue(metadataSection, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, isMap := value.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("MaxMind DB metadata is not a map")
+	}
+
+	db := &MaxMindDB{
+		nodeCount:  mmdbUint(metadata["node_count"]),
+		recordSize: mmdbUint(metadata["record_size"]),
+		ipVersion:  mmdbUint(metadata["ip_version"]),
+		Metadata:   metadata,
+	}
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("Unsupported MaxMind DB record size %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint64(markerIdx) {
+		return nil, errMMDBShortData
+	}
+	db.tree = data[:treeSize]
+	db.data = data[treeSize+mmdbDataSeparator : markerIdx]
+
+	// IPv4 addresses are stored at ::a.b.c.d in IPv6 databases
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// mmdbUint converts an unsigned integer read from a database to uint64.
+func mmdbUint(value interface{}) uint64 {
+	switch number := value.(type) {
+	case uint16:
+		return uint64(number)
+	case uint32:
+		return uint64(number)
+	case uint64:
+		return number
+	default:
+		return 0
+	}
+}
+
+// readRecord returns the left (0) or right (1) record of the given node.
+func (db *MaxMindDB) readRecord(node uint64, bit uint) uint64 {
+	offset := node * db.recordSize / 4
+	record := db.tree[offset : offset+db.recordSize/4]
+
+	switch db.recordSize {
+	case 24:
+		record = record[bit*3:]
+		return uint64(record[0])<<16 | uint64(record[1])<<8 | uint64(record[2])
+	case 28:
+		if bit == 0 {
+			return uint64(record[3]&0xF0)<<20 | uint64(record[0])<<16 | uint64(record[1])<<8 | uint64(record[2])
+		}
+		return uint64(record[3]&0x0F)<<24 | uint64(record[4])<<16 | uint64(record[5])<<8 | uint64(record[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(record[bit*4:]))
+	}
+}
+
+// Lookup returns the record stored for the given IP address. If the address
+// is not part of the database nil is returned. Records are usually maps of
+// type map[string]interface{}.
+func (db *MaxMindDB) Lookup(ip net.IP) (interface{}, error) {
+	address := ip.To4()
+	node := uint64(0)
+
+	switch {
+	case address != nil && db.ipVersion == 6:
+		node = db.ipv4Start
+	case address == nil && db.ipVersion == 4:
+		return nil, fmt.Errorf("Cannot look up IPv6 address %s in an IPv4 database", ip)
+	case address == nil:
+		if address = ip.To16(); address == nil {
+			return nil, fmt.Errorf("Invalid IP address")
+		}
+	}
+
+	for i := 0; i < len(address)*8 && node < db.nodeCount; i++ {
+		bit := uint(address[i>>3]>>(7-uint(i&7))) & 1
+		node = db.readRecord(node, bit)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil // ### return, not found ###
+	case node < db.nodeCount:
+		return nil, fmt.Errorf("Invalid MaxMind DB search tree")
+	}
+
+	offset := node - db.nodeCount - mmdbDataSeparator
+	if offset >= uint64(len(db.data)) {
+		return nil, errMMDBShortData
+	}
+	value, _, err := decodeMMDBValue(db.data, int(offset), 0)
+	return value, err
+}
+
+// decodeMMDBValue decodes the value stored at the given offset of a data
+// section. The value and the offset of the next value are returned. Depth
+// counts the nesting of maps, arrays and pointers so that circular pointers
+// of damaged databases are detected.
+func decodeMMDBValue(data []byte, offset int, depth int) (interface{}, int, error) {
+	if offset >= len(data) {
+		return nil, offset, errMMDBShortData
+	}
+	if depth > mmdbMaxDepth {
+		return nil, offset, fmt.Errorf("MaxMind DB data is nested too deeply")
+	}
+
+	ctrl := data[offset]
+	offset++
+	typeCode := int(ctrl >> 5)
+
+	if typeCode == mmdbPointer {
+		pointer, next, err := decodeMMDBPointer(data, ctrl, offset)
+		if err != nil {
+			return nil, offset, err
+		}
+		value, _, err := decodeMMDBValue(data, pointer, depth+1)
+		return value, next, err
+	}
+
+	if typeCode == 0 {
+		if offset >= len(data) {
+			return nil, offset, errMMDBShortData
+		}
+		typeCode = 7 + int(data[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1F)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > len(data) {
+			return nil, offset, errMMDBShortData
+		}
+		value := 0
+		for _, b := range data[offset : offset+extra] {
+			value = value<<8 | int(b)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + value
+		case 2:
+			size = 285 + value
+		default:
+			size = 65821 + value
+		}
+	}
+
+	if (typeCode == mmdbMap || typeCode == mmdbArray) && size > len(data)-offset {
+		return nil, offset, errMMDBShortData // ### return, each element requires a byte ###
+	}
+
+	switch typeCode {
+	case mmdbMap:
+		values := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, next, err
+			}
+			keyString, isString := key.(string)
+			if !isString {
+				return nil, next, fmt.Errorf("MaxMind DB map key is not a string")
+			}
+			if values[keyString], offset, err = decodeMMDBValue(data, next, depth+1); err != nil {
+				return nil, offset, err
+			}
+		}
+		return values, offset, nil
+
+	case mmdbArray:
+		values := make([]interface{}, size)
+		for i := range values {
+			var err error
+			if values[i], offset, err = decodeMMDBValue(data, offset, depth+1); err != nil {
+				return nil, offset, err
+			}
+		}
+		return values, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+
+	case mmdbEnd, mmdbContainer:
+		return nil, offset, fmt.Errorf("Unsupported MaxMind DB type %d", typeCode)
+	}
+
+	if offset+size > len(data) {
+		return nil, offset, errMMDBShortData
+	}
+	payload := data[offset : offset+size]
+	offset += size
+
+	switch typeCode {
+	case mmdbString:
+		return string(payload), offset, nil
+
+	case mmdbBytes:
+		return append([]byte{}, payload...), offset, nil
+
+	case mmdbDouble:
+		if size != 8 {
+			return nil, offset, fmt.Errorf("Invalid MaxMind DB double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+
+	case mmdbFloat:
+		if size != 4 {
+			return nil, offset, fmt.Errorf("Invalid MaxMind DB float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), offset, nil
+
+	case mmdbInt32:
+		value := uint32(0)
+		for _, b := range payload {
+			value = value<<8 | uint32(b)
+		}
+		return int32(value), offset, nil
+
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		value := uint64(0)
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		switch typeCode {
+		case mmdbUint16:
+			return uint16(value), offset, nil
+		case mmdbUint32:
+			return uint32(value), offset, nil
+		default:
+			return value, offset, nil
+		}
+
+	case mmdbUint128:
+		return new(big.Int).SetBytes(payload), offset, nil
+
+	default:
+		return nil, offset, fmt.Errorf("Unknown MaxMind DB type %d", typeCode)
+	}
+}
+
+// decodeMMDBPointer returns the data section offset a pointer refers to and
+// the offset of the next value.
+func decodeMMDBPointer(data []byte, ctrl byte, offset int) (int, int, error) {
+	size := int(ctrl>>3)&0x3 + 1
+	if offset+size > len(data) {
+		return 0, offset, errMMDBShortData
+	}
+
+	value := 0
+	if size < 4 {
+		value = int(ctrl & 0x7)
+	}
+	for _, b := range data[offset : offset+size] {
+		value = value<<8 | int(b)
+	}
+
+	switch size {
+	case 2:
+		value += 2048
+	case 3:
+		value += 526336
+	}
+	return value, offset + size, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+	"testing"
+)
+
+// appendMMDBTestValue encodes strings, maps, uint32 and float64 values.
+func appendMMDBTestValue(data []byte, value interface{}) []byte {
+	header := func(typeCode int, size int) {
+		ctrl := byte(size)
+		if size >= 29 {
+			ctrl = 29
+		}
+		if typeCode > 7 {
+			data = append(data, ctrl, byte(typeCode-7))
+		} else {
+			data = append(data, byte(typeCode<<5)|ctrl)
+		}
+		if size >= 29 {
+			data = append(data, byte(size-29))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		header(mmdbString, len(v))
+		data = append(data, v...)
+	case uint32:
+		header(mmdbUint32, 4)
+		data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	case float64:
+		header(mmdbDouble, 8)
+		bits := make([]byte, 8)
+		binary.BigEndian.PutUint64(bits, math.Float64bits(v))
+		data = append(data, bits...)
+	case map[string]interface{}:
+		header(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			data = appendMMDBTestValue(data, key)
+			data = appendMMDBTestValue(data, v[key])
+		}
+	}
+	return data
+}
+
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	data     [2]int
+	id       int
+}
+
+// newMMDBTestDB builds a database with record size 24 mapping each network
+// to a record.
+func newMMDBTestDB(ipVersion uint32, networks map[string]interface{}) []byte {
+	root := &mmdbTestNode{data: [2]int{-1, -1}}
+	dataSection := []byte{}
+
+	for cidr, record := range networks {
+		_, network, _ := net.ParseCIDR(cidr)
+		address := network.IP
+		prefix, _ := network.Mask.Size()
+		if ipVersion == 6 && len(address) == net.IPv4len {
+			address = append(make(net.IP, 12), address...)
+			prefix += 96
+		}
+
+		node := root
+		for i := 0; i < prefix; i++ {
+			bit := address[i>>3] >> (7 - uint(i&7)) & 1
+			if i == prefix-1 {
+				node.data[bit] = len(dataSection)
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{data: [2]int{-1, -1}}
+			}
+			node = node.children[bit]
+		}
+		dataSection = appendMMDBTestValue(dataSection, record)
+	}
+
+	nodes := []*mmdbTestNode{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].id = i
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	db := []byte{}
+	for _, node := range nodes {
+		for bit, child := range node.children {
+			record := nodeCount
+			switch {
+			case child != nil:
+				record = child.id
+			case node.data[bit] >= 0:
+				record = nodeCount + mmdbDataSeparator + node.data[bit]
+			}
+			db = append(db, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	db = append(db, make([]byte, mmdbDataSeparator)...)
+	db = append(db, dataSection...)
+	db = append(db, mmdbMetadataMarker...)
+	return appendMMDBTestValue(db, map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint32(24),
+		"ip_version":    ipVersion,
+		"database_type": "Test",
+	})
+}
+
+func TestMaxMindDB(t *testing.T) {
+	expect := NewExpect(t)
+
+	for _, ipVersion := range []uint32{4, 6} {
+		data := newMMDBTestDB(ipVersion, map[string]interface{}{
+			"1.2.3.0/24": map[string]interface{}{"country": "DE", "location": 1.5},
+			"1.2.4.1/32": map[string]interface{}{"country": "US"},
+		})
+
+		db, err := NewMaxMindDB(data)
+		expect.NoError(err)
+		expect.Equal("Test", db.Metadata["database_type"])
+
+		record, err := db.Lookup(net.ParseIP("1.2.3.4"))
+		expect.NoError(err)
+		expect.Equal(map[string]interface{}{"country": "DE", "location": 1.5}, record)
+
+		record, err = db.Lookup(net.ParseIP("1.2.4.1"))
+		expect.NoError(err)
+		expect.Equal(map[string]interface{}{"country": "US"}, record)
+
+		record, err = db.Lookup(net.ParseIP("1.2.4.2"))
+		expect.NoError(err)
+		expect.Nil(record)
+	}
+
+	_, err := NewMaxMindDB([]byte("not a database"))
+	expect.NotNil(err)
+}
+
+func TestMaxMindDBDecode(t *testing.T) {
+	expect := NewExpect(t)
+
+	// Pointers refer to values earlier in the data section
+	data := appendMMDBTestValue(nil, "shared")
+	data = append(data, 0xE1, 0x20, 0x00, 0x20, 0x00)
+	value, next, err := decodeMMDBValue(data, len(data)-5, 0)
+	expect.NoError(err)
+	expect.Equal(len(data), next)
+	expect.Equal(map[string]interface{}{"shared": "shared"}, value)
+
+	// Extended types and large sizes
+	value, _, err = decodeMMDBValue([]byte{0x02, 0x02, 0x01, 0x00}, 0, 0)
+	expect.NoError(err)
+	expect.Equal(uint64(256), value)
+
+	value, _, err = decodeMMDBValue([]byte{0x01, 0x07}, 0, 0)
+	expect.NoError(err)
+	expect.Equal(true, value)
+
+	value, _, err = decodeMMDBValue([]byte{0x01, 0x03, 0xFF}, 0, 0)
+	expect.NoError(err)
+	expect.Equal(new(big.Int).SetInt64(0xFF), value)
+
+	long := append([]byte{0x9D, 0x01}, make([]byte, 30)...)
+	value, _, err = decodeMMDBValue(long, 0, 0)
+	expect.NoError(err)
+	expect.Equal(30, len(value.([]byte)))
+
+	// Truncated and circular data is rejected
+	_, _, err = decodeMMDBValue([]byte{0x44, 'a'}, 0, 0)
+	expect.NotNil(err)
+	_, _, err = decodeMMDBValue([]byte{0x20, 0x00}, 0, 0)
+	expect.NotNil(err)
+}
@@ -38,14 +38,26 @@ func init() {
 	Metric.Set(MetricProcessStart, ProcessStartTime.Unix())
 }
 
+// metricPercentiles lists the percentiles reported for each histogram.
+var metricPercentiles = []struct {
+	suffix  string
+	percent float64
+}{{"P50", 50}, {"P90", 90}, {"P99", 99}}
+
+type metricHistogram struct {
+	histogram *Histogram
+	values    map[string]int64
+}
+
 type metrics struct {
-	mutex *sync.Mutex
-	store map[string]*int64
+	mutex      *sync.Mutex
+	store      map[string]*int64
+	histograms map[string]*metricHistogram
 }
 
 // Metric allows any part of gollum to store and/or modify metric values by
 // name.
-var Metric = metrics{new(sync.Mutex), make(map[string]*int64)}
+var Metric = metrics{new(sync.Mutex), make(map[string]*int64), make(map[string]*metricHistogram)}
 
 // New creates a new metric under the given name with a value of 0
 func (met *metrics) New(name string) {
@@ -117,7 +129,57 @@ func (met *metrics) Get(name string) (int64, error) {
 	return atomic.LoadInt64(val), nil
 }
 
+// NewHistogram creates a new histogram under the given name and returns it.
+// If a histogram with this name already exists, the existing histogram is
+// returned. Histograms are reported by Dump as the metrics "<name>Count",
+// "<name>Max", "<name>P50", "<name>P90" and "<name>P99". These values refer
+// to the interval between the last two calls to UpdateHistograms.
+// This function may be called at any time.
+func (met *metrics) NewHistogram(name string) *Histogram {
+	met.mutex.Lock()
+	defer met.mutex.Unlock()
+
+	if existing, exists := met.histograms[name]; exists {
+		return existing.histogram // ### return, already registered ###
+	}
+
+	hist := &metricHistogram{
+		histogram: NewHistogram(),
+		values:    make(map[string]int64),
+	}
+	met.histograms[name] = hist
+	return hist.histogram
+}
+
+// UpdateHistograms calculates the values reported for all histograms
+// and resets the histograms afterwards.
+func (met *metrics) UpdateHistograms() {
+	met.mutex.Lock()
+	defer met.mutex.Unlock()
+
+	for name, hist := range met.histograms {
+		snapshot := hist.histogram.Reset()
+		hist.values[name+"Count"] = int64(snapshot.Count)
+		hist.values[name+"Max"] = snapshot.Max
+		for _, percentile := range metricPercentiles {
+			hist.values[name+percentile.suffix] = snapshot.Percentile(percentile.percent)
+		}
+	}
+}
+
 // Dump creates a JSON string from all stored metrics
 func (met *metrics) Dump() ([]byte, error) {
-	return json.Marshal(Metric.store)
+	met.mutex.Lock()
+	defer met.mutex.Unlock()
+
+	values := make(map[string]int64, len(met.store)+len(met.histograms)*(2+len(metricPercentiles)))
+	for name, value := range met.store {
+		values[name] = atomic.LoadInt64(value)
+	}
+	for _, hist := range met.histograms {
+		for name, value := range hist.values {
+			values[name] = value
+		}
+	}
+	return json.Marshal(values)
 }
@@ -0,0 +1,612 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	MQTTConnect     = byte(1)
+	MQTTConnAck     = byte(2)
+	MQTTPublish     = byte(3)
+	MQTTPubAck      = byte(4)
+	MQTTPubRec      = byte(5)
+	MQTTPubRel      = byte(6)
+	MQTTPubComp     = byte(7)
+	MQTTSubscribe   = byte(8)
+	MQTTSubAck      = byte(9)
+	MQTTUnsubscribe = byte(10)
+	MQTTUnsubAck    = byte(11)
+	MQTTPingReq     = byte(12)
+	MQTTPingResp    = byte(13)
+	MQTTDisconnect  = byte(14)
+)
+
+// MQTT protocol levels
+const (
+	MQTTVersion311 = byte(4)
+	MQTTVersion5   = byte(5)
+)
+
+// ParseMQTTVersion converts a protocol version like "3.1.1" or "5" into the
+// protocol level sent with CONNECT.
+func ParseMQTTVersion(version string) (byte, error) {
+	switch version {
+	case "3.1.1", "4":
+		return MQTTVersion311, nil
+	case "5", "5.0":
+		return MQTTVersion5, nil
+	}
+	return 0, fmt.Errorf("MQTT: unsupported protocol version %s", version)
+}
+
+// mqttMaxRemainingLength is the largest length that can be encoded as
+// variable byte integer.
+const mqttMaxRemainingLength = 268435455
+
+// mqttPropertySessionExpiry is the MQTT 5 property id of the session expiry
+// interval.
+const mqttPropertySessionExpiry = 0x11
+
+// MQTTPacket is a single MQTT control packet. Flags contains the lower four
+// bits of the fixed header.
+type MQTTPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// MQTTError is returned if the broker answers with an error code. For MQTT
+// 3.1.1 these are the CONNACK return codes and the SUBACK failure code 0x80,
+// for MQTT 5 the reason codes of 0x80 and above.
+type MQTTError struct {
+	Code byte
+}
+
+// Error implements the standard error interface
+func (err MQTTError) Error() string {
+	switch err.Code {
+	case 1:
+		return "MQTT: unacceptable protocol version"
+	case 2:
+		return "MQTT: identifier rejected"
+	case 3:
+		return "MQTT: server unavailable"
+	case 4:
+		return "MQTT: bad user name or password"
+	case 5:
+		return "MQTT: not authorized"
+	}
+	return fmt.Sprintf("MQTT: reason code 0x%02x", err.Code)
+}
+
+// ReadMQTTPacket reads a single MQTT control packet from the given reader.
+// Packets larger than maxSize bytes are rejected if maxSize is greater than 0.
+func ReadMQTTPacket(reader io.ByteReader, maxSize int) (MQTTPacket, error) {
+	packet := MQTTPacket{}
+	header, err := reader.ReadByte()
+	if err != nil {
+		return packet, err
+	}
+	packet.Type = header >> 4
+	packet.Flags = header & 0x0F
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return packet, fmt.Errorf("MQTT: invalid remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return packet, err
+		}
+		length |= int(digit&0x7F) << shift
+		if digit&0x80 == 0 {
+			break // ### break, last digit ###
+		}
+	}
+
+	if maxSize > 0 && length > maxSize {
+		return packet, fmt.Errorf("MQTT: packet of %d bytes exceeds the maximum size", length)
+	}
+
+	packet.Body = make([]byte, length)
+	for i := range packet.Body {
+		if packet.Body[i], err = reader.ReadByte(); err != nil {
+			return packet, err
+		}
+	}
+	return packet, nil
+}
+
+// WriteMQTTPacket writes a single MQTT control packet to the given writer.
+func WriteMQTTPacket(writer io.Writer, packet MQTTPacket) error {
+	if len(packet.Body) > mqttMaxRemainingLength {
+		return fmt.Errorf("MQTT: packet of %d bytes is too large", len(packet.Body))
+	}
+
+	data := NewMQTTWriter(len(packet.Body) + 5)
+	data.WriteUint8(packet.Type<<4 | packet.Flags&0x0F)
+	data.WriteVarint(len(packet.Body))
+	data.WriteRaw(packet.Body)
+
+	_, err := writer.Write(data.Bytes())
+	return err
+}
+
+// MQTTWriter encodes the variable header and payload of MQTT packets.
+type MQTTWriter struct {
+	data []byte
+}
+
+// NewMQTTWriter creates a new writer with the given initial capacity.
+func NewMQTTWriter(size int) *MQTTWriter {
+	return &MQTTWriter{make([]byte, 0, size)}
+}
+
+// Bytes returns the encoded data.
+func (writer *MQTTWriter) Bytes() []byte {
+	return writer.data
+}
+
+// WriteUint8 writes a single byte.
+func (writer *MQTTWriter) WriteUint8(value byte) {
+	writer.data = append(writer.data, value)
+}
+
+// WriteUint16 writes a big endian two byte integer.
+func (writer *MQTTWriter) WriteUint16(value uint16) {
+	writer.data = append(writer.data, byte(value>>8), byte(value))
+}
+
+// WriteUint32 writes a big endian four byte integer.
+func (writer *MQTTWriter) WriteUint32(value uint32) {
+	writer.data = append(writer.data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// WriteVarint writes a variable byte integer.
+func (writer *MQTTWriter) WriteVarint(value int) {
+	for {
+		digit := byte(value & 0x7F)
+		value >>= 7
+		if value > 0 {
+			digit |= 0x80
+		}
+		writer.data = append(writer.data, digit)
+		if value == 0 {
+			return // ### return, done ###
+		}
+	}
+}
+
+// WriteString writes a length prefixed UTF-8 string.
+func (writer *MQTTWriter) WriteString(value string) {
+	writer.WriteUint16(uint16(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteBinary writes length prefixed binary data.
+func (writer *MQTTWriter) WriteBinary(value []byte) {
+	writer.WriteUint16(uint16(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteRaw appends the given data as-is.
+func (writer *MQTTWriter) WriteRaw(value []byte) {
+	writer.data = append(writer.data, value...)
+}
+
+// MQTTReader decodes the variable header and payload of MQTT packets.
+type MQTTReader struct {
+	data   []byte
+	offset int
+}
+
+// NewMQTTReader creates a new reader for the given data.
+func NewMQTTReader(data []byte) *MQTTReader {
+	return &MQTTReader{data, 0}
+}
+
+func (reader *MQTTReader) next(size int) ([]byte, error) {
+	if size < 0 || reader.offset+size > len(reader.data) {
+		return nil, fmt.Errorf("MQTT: unexpected end of packet")
+	}
+	data := reader.data[reader.offset : reader.offset+size]
+	reader.offset += size
+	return data, nil
+}
+
+// HasData returns true if there is data left to read.
+func (reader *MQTTReader) HasData() bool {
+	return reader.offset < len(reader.data)
+}
+
+// Rest returns all data that has not been read yet.
+func (reader *MQTTReader) Rest() []byte {
+	data := reader.data[reader.offset:]
+	reader.offset = len(reader.data)
+	return data
+}
+
+// ReadUint8 reads a single byte.
+func (reader *MQTTReader) ReadUint8() (byte, error) {
+	data, err := reader.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+// ReadUint16 reads a big endian two byte integer.
+func (reader *MQTTReader) ReadUint16() (uint16, error) {
+	data, err := reader.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(data), nil
+}
+
+// ReadVarint reads a variable byte integer.
+func (reader *MQTTReader) ReadVarint() (int, error) {
+	value := 0
+	for shift := uint(0); shift <= 21; shift += 7 {
+		digit, err := reader.ReadUint8()
+		if err != nil {
+			return 0, err
+		}
+		value |= int(digit&0x7F) << shift
+		if digit&0x80 == 0 {
+			return value, nil // ### return, last digit ###
+		}
+	}
+	return 0, fmt.Errorf("MQTT: invalid variable byte integer")
+}
+
+// ReadString reads a length prefixed UTF-8 string.
+func (reader *MQTTReader) ReadString() (string, error) {
+	length, err := reader.ReadUint16()
+	if err != nil {
+		return "", err
+	}
+	data, err := reader.next(int(length))
+	return string(data), err
+}
+
+// SkipProperties skips the MQTT 5 property block at the current position.
+func (reader *MQTTReader) SkipProperties() error {
+	length, err := reader.ReadVarint()
+	if err != nil {
+		return err
+	}
+	_, err = reader.next(length)
+	return err
+}
+
+// MQTTConnectOptions contains the settings sent with a CONNECT packet.
+// SessionExpirySec is only used by MQTT 5. MQTT 3.1.1 brokers keep the
+// session of clients connecting without CleanStart until it is cleared.
+type MQTTConnectOptions struct {
+	Version          byte
+	ClientID         string
+	CleanStart       bool
+	KeepAlive        time.Duration
+	Username         string
+	Password         string
+	SessionExpirySec uint32
+}
+
+// EncodeMQTTConnect creates a CONNECT packet.
+func EncodeMQTTConnect(options MQTTConnectOptions) MQTTPacket {
+	body := NewMQTTWriter(64 + len(options.ClientID) + len(options.Username) + len(options.Password))
+	body.WriteString("MQTT")
+	body.WriteUint8(options.Version)
+
+	flags := byte(0)
+	if options.CleanStart {
+		flags |= 0x02
+	}
+	if options.Username != "" {
+		flags |= 0x80
+	}
+	if options.Password != "" {
+		flags |= 0x40
+	}
+	body.WriteUint8(flags)
+	body.WriteUint16(uint16(options.KeepAlive / time.Second))
+
+	if options.Version >= MQTTVersion5 {
+		if options.SessionExpirySec > 0 {
+			body.WriteVarint(5)
+			body.WriteUint8(mqttPropertySessionExpiry)
+			body.WriteUint32(options.SessionExpirySec)
+		} else {
+			body.WriteVarint(0)
+		}
+	}
+
+	body.WriteString(options.ClientID)
+	if options.Username != "" {
+		body.WriteString(options.Username)
+	}
+	if options.Password != "" {
+		body.WriteString(options.Password)
+	}
+	return MQTTPacket{Type: MQTTConnect, Body: body.Bytes()}
+}
+
+// DecodeMQTTConnAck decodes a CONNACK packet and returns whether the broker
+// resumed an existing session. An MQTTError is returned if the connection
+// was refused.
+func DecodeMQTTConnAck(packet MQTTPacket) (bool, error) {
+	if packet.Type != MQTTConnAck {
+		return false, fmt.Errorf("MQTT: expected CONNACK, got packet type %d", packet.Type)
+	}
+
+	reader := NewMQTTReader(packet.Body)
+	flags, err := reader.ReadUint8()
+	if err != nil {
+		return false, err
+	}
+	code, err := reader.ReadUint8()
+	if err != nil {
+		return false, err
+	}
+	if code != 0 {
+		return false, MQTTError{code}
+	}
+	return flags&0x01 != 0, nil
+}
+
+// MQTTMessage is the content of a PUBLISH packet. PacketID is only used for
+// a QoS greater than 0.
+type MQTTMessage struct {
+	Topic    string
+	PacketID uint16
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	Payload  []byte
+}
+
+// EncodeMQTTPublish creates a PUBLISH packet for the given protocol version.
+func EncodeMQTTPublish(version byte, msg MQTTMessage) MQTTPacket {
+	flags := (msg.QoS & 0x03) << 1
+	if msg.Dup {
+		flags |= 0x08
+	}
+	if msg.Retain {
+		flags |= 0x01
+	}
+
+	body := NewMQTTWriter(len(msg.Topic) + len(msg.Payload) + 8)
+	body.WriteString(msg.Topic)
+	if msg.QoS > 0 {
+		body.WriteUint16(msg.PacketID)
+	}
+	if version >= MQTTVersion5 {
+		body.WriteVarint(0)
+	}
+	body.WriteRaw(msg.Payload)
+	return MQTTPacket{Type: MQTTPublish, Flags: flags, Body: body.Bytes()}
+}
+
+// DecodeMQTTPublish decodes a PUBLISH packet sent with the given protocol
+// version. MQTT 5 properties are ignored.
+func DecodeMQTTPublish(version byte, packet MQTTPacket) (MQTTMessage, error) {
+	msg := MQTTMessage{
+		QoS:    (packet.Flags >> 1) & 0x03,
+		Retain: packet.Flags&0x01 != 0,
+		Dup:    packet.Flags&0x08 != 0,
+	}
+	if msg.QoS > 2 {
+		return msg, fmt.Errorf("MQTT: invalid QoS %d", msg.QoS)
+	}
+
+	var err error
+	reader := NewMQTTReader(packet.Body)
+	if msg.Topic, err = reader.ReadString(); err != nil {
+		return msg, err
+	}
+	if msg.QoS > 0 {
+		if msg.PacketID, err = reader.ReadUint16(); err != nil {
+			return msg, err
+		}
+	}
+	if version >= MQTTVersion5 {
+		if err = reader.SkipProperties(); err != nil {
+			return msg, err
+		}
+	}
+	msg.Payload = reader.Rest()
+	return msg, nil
+}
+
+// EncodeMQTTAck creates a PUBACK, PUBREC, PUBREL or PUBCOMP packet. The reason
+// code is omitted so the packet is valid for all protocol versions.
+func EncodeMQTTAck(packetType byte, packetID uint16) MQTTPacket {
+	flags := byte(0)
+	if packetType == MQTTPubRel {
+		flags = 0x02
+	}
+	body := NewMQTTWriter(2)
+	body.WriteUint16(packetID)
+	return MQTTPacket{Type: packetType, Flags: flags, Body: body.Bytes()}
+}
+
+// DecodeMQTTAck decodes a PUBACK, PUBREC, PUBREL or PUBCOMP packet. Returns
+// the packet id and an MQTTError if an MQTT 5 broker returned an error code.
+func DecodeMQTTAck(packet MQTTPacket) (uint16, error) {
+	reader := NewMQTTReader(packet.Body)
+	packetID, err := reader.ReadUint16()
+	if err != nil {
+		return 0, err
+	}
+	if code, err := reader.ReadUint8(); err == nil && code >= 0x80 {
+		return packetID, MQTTError{code}
+	}
+	return packetID, nil
+}
+
+// MQTTSubscription is a topic filter and the maximum QoS requested for it.
+type MQTTSubscription struct {
+	Filter string
+	QoS    byte
+}
+
+// EncodeMQTTSubscribe creates a SUBSCRIBE packet for the given protocol
+// version.
+func EncodeMQTTSubscribe(version byte, packetID uint16, subscriptions []MQTTSubscription) MQTTPacket {
+	body := NewMQTTWriter(64)
+	body.WriteUint16(packetID)
+	if version >= MQTTVersion5 {
+		body.WriteVarint(0)
+	}
+	for _, subscription := range subscriptions {
+		body.WriteString(subscription.Filter)
+		body.WriteUint8(subscription.QoS & 0x03)
+	}
+	return MQTTPacket{Type: MQTTSubscribe, Flags: 0x02, Body: body.Bytes()}
+}
+
+// DecodeMQTTSubAck decodes a SUBACK packet and returns the packet id and the
+// granted QoS of each subscription. An MQTTError is returned if at least one
+// subscription was refused.
+func DecodeMQTTSubAck(version byte, packet MQTTPacket) (uint16, []byte, error) {
+	reader := NewMQTTReader(packet.Body)
+	packetID, err := reader.ReadUint16()
+	if err != nil {
+		return 0, nil, err
+	}
+	if version >= MQTTVersion5 {
+		if err := reader.SkipProperties(); err != nil {
+			return packetID, nil, err
+		}
+	}
+
+	granted := reader.Rest()
+	for _, code := range granted {
+		if code >= 0x80 {
+			return packetID, granted, MQTTError{code}
+		}
+	}
+	return packetID, granted, nil
+}
+
+// MQTTClient is a connection to an MQTT broker. Packets can be written by
+// multiple goroutines but have to be read by a single goroutine.
+type MQTTClient struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	guard          *sync.Mutex
+	lastWrite      time.Time
+	version        byte
+	sessionPresent bool
+}
+
+// DialMQTT connects to an MQTT broker and sends a CONNECT packet. The
+// connection uses TLS if tlsConfig is not nil. The given timeout is used for
+// connecting and waiting for the CONNACK.
+func DialMQTT(network string, address string, tlsConfig *tls.Config, timeout time.Duration, options MQTTConnectOptions) (*MQTTClient, error) {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, network, address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &MQTTClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		guard:   new(sync.Mutex),
+		version: options.Version,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := client.Write(EncodeMQTTConnect(options)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	packet, err := ReadMQTTPacket(client.reader, 0)
+	if err == nil {
+		client.sessionPresent, err = DecodeMQTTConnAck(packet)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Version returns the protocol version used by this connection.
+func (client *MQTTClient) Version() byte {
+	return client.version
+}
+
+// SessionPresent returns true if the broker resumed an existing session.
+func (client *MQTTClient) SessionPresent() bool {
+	return client.sessionPresent
+}
+
+// Read reads the next packet. Packets larger than maxSize bytes are rejected
+// if maxSize is greater than 0.
+func (client *MQTTClient) Read(maxSize int) (MQTTPacket, error) {
+	return ReadMQTTPacket(client.reader, maxSize)
+}
+
+// Write sends a packet to the broker.
+func (client *MQTTClient) Write(packet MQTTPacket) error {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	client.lastWrite = time.Now()
+	return WriteMQTTPacket(client.conn, packet)
+}
+
+// Ping sends a PINGREQ if no packet has been sent for half of the given keep
+// alive interval.
+func (client *MQTTClient) Ping(keepAlive time.Duration) error {
+	client.guard.Lock()
+	idle := time.Since(client.lastWrite)
+	client.guard.Unlock()
+
+	if keepAlive <= 0 || idle < keepAlive/2 {
+		return nil // ### return, not idle ###
+	}
+	return client.Write(MQTTPacket{Type: MQTTPingReq})
+}
+
+// Close sends a DISCONNECT packet and closes the connection.
+func (client *MQTTClient) Close() error {
+	client.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	client.Write(MQTTPacket{Type: MQTTDisconnect})
+	return client.conn.Close()
+}
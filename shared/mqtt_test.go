@@ -0,0 +1,82 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	expect := NewExpect(t)
+	buffer := bytes.Buffer{}
+
+	publish := MQTTMessage{Topic: "a/b", PacketID: 10, QoS: 1, Retain: true, Payload: bytes.Repeat([]byte("x"), 200)}
+	expect.NoError(WriteMQTTPacket(&buffer, EncodeMQTTPublish(MQTTVersion5, publish)))
+
+	// Remaining length of 2+3 topic, 2 id, 1 properties, 200 payload
+	expect.Equal([]byte{0x33, 0xD0, 0x01}, buffer.Bytes()[:3])
+
+	packet, err := ReadMQTTPacket(bufio.NewReader(&buffer), 0)
+	expect.NoError(err)
+	expect.Equal(MQTTPublish, packet.Type)
+
+	decoded, err := DecodeMQTTPublish(MQTTVersion5, packet)
+	expect.NoError(err)
+	expect.Equal(publish.Topic, decoded.Topic)
+	expect.Equal(publish.PacketID, decoded.PacketID)
+	expect.Equal(publish.QoS, decoded.QoS)
+	expect.True(decoded.Retain)
+	expect.False(decoded.Dup)
+	expect.Equal(string(publish.Payload), string(decoded.Payload))
+
+	// Size limit
+	WriteMQTTPacket(&buffer, EncodeMQTTPublish(MQTTVersion311, publish))
+	_, err = ReadMQTTPacket(bufio.NewReader(&buffer), 100)
+	expect.NotNil(err)
+}
+
+func TestMQTTConnect(t *testing.T) {
+	expect := NewExpect(t)
+
+	connect := EncodeMQTTConnect(MQTTConnectOptions{
+		Version:    MQTTVersion311,
+		ClientID:   "id",
+		CleanStart: true,
+		KeepAlive:  30 * time.Second,
+		Username:   "user",
+	})
+	expect.Equal("\x00\x04MQTT\x04\x82\x00\x1e\x00\x02id\x00\x04user", string(connect.Body))
+
+	connect = EncodeMQTTConnect(MQTTConnectOptions{Version: MQTTVersion5, ClientID: "id", SessionExpirySec: 60})
+	expect.Equal("\x00\x04MQTT\x05\x00\x00\x00\x05\x11\x00\x00\x00\x3c\x00\x02id", string(connect.Body))
+
+	present, err := DecodeMQTTConnAck(MQTTPacket{Type: MQTTConnAck, Body: []byte{1, 0}})
+	expect.NoError(err)
+	expect.True(present)
+
+	_, err = DecodeMQTTConnAck(MQTTPacket{Type: MQTTConnAck, Body: []byte{0, 5}})
+	expect.Equal(MQTTError{5}, err)
+
+	_, granted, err := DecodeMQTTSubAck(MQTTVersion5, MQTTPacket{Type: MQTTSubAck, Body: []byte{0, 1, 0, 1, 0x87}})
+	expect.Equal([]byte{1, 0x87}, granted)
+	expect.Equal(MQTTError{0x87}, err)
+
+	packetID, err := DecodeMQTTAck(EncodeMQTTAck(MQTTPubRel, 513))
+	expect.NoError(err)
+	expect.Equal(uint16(513), packetID)
+}
@@ -0,0 +1,554 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// MsgpackExt holds a msgpack extension value
+type MsgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// MsgpackWriter allows writing msgpack encoded values to a byte buffer.
+type MsgpackWriter struct {
+	data []byte
+}
+
+// MsgpackReader allows decoding msgpack values from a byte buffer.
+type MsgpackReader struct {
+	data   []byte
+	offset int
+}
+
+// MsgpackStreamReader decodes msgpack values from a stream, e.g. a network
+// connection. Data is read until a complete value can be decoded.
+type MsgpackStreamReader struct {
+	source io.Reader
+	buffer []byte
+	chunk  []byte
+}
+
+// errMsgpackShortData is returned by MsgpackReader if a value is incomplete
+var errMsgpackShortData = fmt.Errorf("Unexpected end of msgpack data")
+
+// NewMsgpackWriter creates a new writer with the given initial capacity.
+func NewMsgpackWriter(capacity int) *MsgpackWriter {
+	return &MsgpackWriter{
+		data: make([]byte, 0, capacity),
+	}
+}
+
+// Bytes returns the encoded data
+func (writer *MsgpackWriter) Bytes() []byte {
+	return writer.data
+}
+
+// Reset clears the encoded data so that the writer can be reused.
+func (writer *MsgpackWriter) Reset() {
+	writer.data = writer.data[:0]
+}
+
+func (writer *MsgpackWriter) writeHeader(code byte, size int, bits uint) {
+	writer.data = append(writer.data, code)
+	for shift := int(bits) - 8; shift >= 0; shift -= 8 {
+		writer.data = append(writer.data, byte(size>>uint(shift)))
+	}
+}
+
+// WriteNil writes a nil value.
+func (writer *MsgpackWriter) WriteNil() {
+	writer.data = append(writer.data, 0xc0)
+}
+
+// WriteBool writes a boolean value.
+func (writer *MsgpackWriter) WriteBool(value bool) {
+	if value {
+		writer.data = append(writer.data, 0xc3)
+	} else {
+		writer.data = append(writer.data, 0xc2)
+	}
+}
+
+// WriteInt writes a signed integer using the smallest possible encoding.
+func (writer *MsgpackWriter) WriteInt(value int64) {
+	switch {
+	case value >= 0:
+		writer.WriteUint(uint64(value))
+	case value >= -32:
+		writer.data = append(writer.data, byte(value))
+	case value >= math.MinInt8:
+		writer.data = append(writer.data, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		writer.data = append(writer.data, 0xd1)
+		writer.data = append(writer.data, byte(value>>8), byte(value))
+	case value >= math.MinInt32:
+		writer.data = append(writer.data, 0xd2, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(writer.data[len(writer.data)-4:], uint32(value))
+	default:
+		writer.data = append(writer.data, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(writer.data[len(writer.data)-8:], uint64(value))
+	}
+}
+
+// WriteUint writes an unsigned integer using the smallest possible encoding.
+func (writer *MsgpackWriter) WriteUint(value uint64) {
+	switch {
+	case value <= 0x7f:
+		writer.data = append(writer.data, byte(value))
+	case value <= math.MaxUint8:
+		writer.data = append(writer.data, 0xcc, byte(value))
+	case value <= math.MaxUint16:
+		writer.data = append(writer.data, 0xcd, byte(value>>8), byte(value))
+	case value <= math.MaxUint32:
+		writer.data = append(writer.data, 0xce, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(writer.data[len(writer.data)-4:], uint32(value))
+	default:
+		writer.data = append(writer.data, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(writer.data[len(writer.data)-8:], value)
+	}
+}
+
+// WriteFloat writes a 64 bit floating point value.
+func (writer *MsgpackWriter) WriteFloat(value float64) {
+	writer.data = append(writer.data, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(writer.data[len(writer.data)-8:], math.Float64bits(value))
+}
+
+// WriteString writes a string value.
+func (writer *MsgpackWriter) WriteString(value string) {
+	switch size := len(value); {
+	case size <= 31:
+		writer.data = append(writer.data, 0xa0|byte(size))
+	case size <= math.MaxUint8:
+		writer.writeHeader(0xd9, size, 8)
+	case size <= math.MaxUint16:
+		writer.writeHeader(0xda, size, 16)
+	default:
+		writer.writeHeader(0xdb, size, 32)
+	}
+	writer.data = append(writer.data, value...)
+}
+
+// WriteBytes writes a binary value.
+func (writer *MsgpackWriter) WriteBytes(value []byte) {
+	switch size := len(value); {
+	case size <= math.MaxUint8:
+		writer.writeHeader(0xc4, size, 8)
+	case size <= math.MaxUint16:
+		writer.writeHeader(0xc5, size, 16)
+	default:
+		writer.writeHeader(0xc6, size, 32)
+	}
+	writer.data = append(writer.data, value...)
+}
+
+// WriteArrayHeader starts an array with the given number of elements. The
+// elements have to be written after this call.
+func (writer *MsgpackWriter) WriteArrayHeader(size int) {
+	switch {
+	case size <= 15:
+		writer.data = append(writer.data, 0x90|byte(size))
+	case size <= math.MaxUint16:
+		writer.writeHeader(0xdc, size, 16)
+	default:
+		writer.writeHeader(0xdd, size, 32)
+	}
+}
+
+// WriteMapHeader starts a map with the given number of key value pairs. The
+// keys and values have to be written after this call in alternating order.
+func (writer *MsgpackWriter) WriteMapHeader(size int) {
+	switch {
+	case size <= 15:
+		writer.data = append(writer.data, 0x80|byte(size))
+	case size <= math.MaxUint16:
+		writer.writeHeader(0xde, size, 16)
+	default:
+		writer.writeHeader(0xdf, size, 32)
+	}
+}
+
+// WriteExt writes an extension value of the given type.
+func (writer *MsgpackWriter) WriteExt(extType int8, value []byte) {
+	switch size := len(value); size {
+	case 1:
+		writer.data = append(writer.data, 0xd4)
+	case 2:
+		writer.data = append(writer.data, 0xd5)
+	case 4:
+		writer.data = append(writer.data, 0xd6)
+	case 8:
+		writer.data = append(writer.data, 0xd7)
+	case 16:
+		writer.data = append(writer.data, 0xd8)
+	default:
+		switch {
+		case size <= math.MaxUint8:
+			writer.writeHeader(0xc7, size, 8)
+		case size <= math.MaxUint16:
+			writer.writeHeader(0xc8, size, 16)
+		default:
+			writer.writeHeader(0xc9, size, 32)
+		}
+	}
+	writer.data = append(writer.data, byte(extType))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteRaw appends already encoded data.
+func (writer *MsgpackWriter) WriteRaw(data []byte) {
+	writer.data = append(writer.data, data...)
+}
+
+// WriteValue writes a generic value as returned by e.g. json.Unmarshal.
+// Floating point values without fraction and json.Number values are written
+// as integers if possible. Map keys
+// are written in sorted order. Unsupported types are written as string.
+func (writer *MsgpackWriter) WriteValue(value interface{}) {
+	switch value.(type) {
+	case nil:
+		writer.WriteNil()
+	case bool:
+		writer.WriteBool(value.(bool))
+	case int:
+		writer.WriteInt(int64(value.(int)))
+	case int64:
+		writer.WriteInt(value.(int64))
+	case uint64:
+		writer.WriteUint(value.(uint64))
+	case float64:
+		number := value.(float64)
+		if number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 {
+			writer.WriteInt(int64(number))
+		} else {
+			writer.WriteFloat(number)
+		}
+	case json.Number:
+		if number, err := value.(json.Number).Int64(); err == nil {
+			writer.WriteInt(number)
+		} else if number, err := value.(json.Number).Float64(); err == nil {
+			writer.WriteFloat(number)
+		} else {
+			writer.WriteString(value.(json.Number).String())
+		}
+	case string:
+		writer.WriteString(value.(string))
+	case []byte:
+		writer.WriteBytes(value.([]byte))
+	case MsgpackExt:
+		ext := value.(MsgpackExt)
+		writer.WriteExt(ext.Type, ext.Data)
+	case []interface{}:
+		array := value.([]interface{})
+		writer.WriteArrayHeader(len(array))
+		for _, item := range array {
+			writer.WriteValue(item)
+		}
+	case map[string]interface{}:
+		object := value.(map[string]interface{})
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writer.WriteMapHeader(len(keys))
+		for _, key := range keys {
+			writer.WriteString(key)
+			writer.WriteValue(object[key])
+		}
+	case map[string]string:
+		object := value.(map[string]string)
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writer.WriteMapHeader(len(keys))
+		for _, key := range keys {
+			writer.WriteString(key)
+			writer.WriteString(object[key])
+		}
+	default:
+		writer.WriteString(fmt.Sprint(value))
+	}
+}
+
+// NewMsgpackReader creates a new reader for the given, encoded data.
+func NewMsgpackReader(data []byte) MsgpackReader {
+	return MsgpackReader{
+		data:   data,
+		offset: 0,
+	}
+}
+
+// HasData returns true as long as there is unread data left
+func (reader *MsgpackReader) HasData() bool {
+	return reader.offset < len(reader.data)
+}
+
+// Offset returns the number of bytes read so far
+func (reader *MsgpackReader) Offset() int {
+	return reader.offset
+}
+
+func (reader *MsgpackReader) read(size int) ([]byte, error) {
+	if size < 0 || size > len(reader.data)-reader.offset {
+		return nil, errMsgpackShortData
+	}
+	start := reader.offset
+	reader.offset += size
+	return reader.data[start:reader.offset], nil
+}
+
+func (reader *MsgpackReader) readSize(bytes int) (int, error) {
+	data, err := reader.read(bytes)
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	for _, value := range data {
+		size = size<<8 | int(value)
+	}
+	return size, nil
+}
+
+// capacity limits the capacity reserved for arrays and maps so that invalid
+// sizes do not cause large allocations.
+func (reader *MsgpackReader) capacity(size int) int {
+	if remaining := len(reader.data) - reader.offset; size > remaining {
+		return remaining
+	}
+	return size
+}
+
+func (reader *MsgpackReader) readArray(size int) ([]interface{}, error) {
+	array := make([]interface{}, 0, reader.capacity(size))
+	for i := 0; i < size; i++ {
+		value, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (reader *MsgpackReader) readMap(size int) (map[string]interface{}, error) {
+	object := make(map[string]interface{}, reader.capacity(size))
+	for i := 0; i < size; i++ {
+		key, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case string:
+			object[key.(string)] = value
+		case []byte:
+			object[string(key.([]byte))] = value
+		default:
+			object[fmt.Sprint(key)] = value
+		}
+	}
+	return object, nil
+}
+
+func (reader *MsgpackReader) readExt(size int) (MsgpackExt, error) {
+	extType, err := reader.read(1)
+	if err != nil {
+		return MsgpackExt{}, err
+	}
+	data, err := reader.read(size)
+	if err != nil {
+		return MsgpackExt{}, err
+	}
+	return MsgpackExt{Type: int8(extType[0]), Data: data}, nil
+}
+
+// ReadValue decodes the next value. Integers are returned as int64 unless
+// they do not fit, in which case uint64 is used. Floating point values are
+// returned as float64, strings as string, binary data as []byte, arrays as
+// []interface{}, maps as map[string]interface{} and extension values as
+// MsgpackExt. Map keys that are not strings are converted to strings.
+// Returned slices reference the data passed to the reader.
+func (reader *MsgpackReader) ReadValue() (interface{}, error) {
+	header, err := reader.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch code := header[0]; {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return reader.readMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return reader.readArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		data, err := reader.read(int(code & 0x1f))
+		return string(data), err
+	}
+
+	switch code := header[0]; code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		size, err := reader.readSize(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return reader.read(size)
+
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		size, err := reader.readSize(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return reader.readExt(size)
+
+	case 0xca: // float 32
+		data, err := reader.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+
+	case 0xcb: // float 64
+		data, err := reader.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		data, err := reader.read(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		value := uint64(0)
+		for _, part := range data {
+			value = value<<8 | uint64(part)
+		}
+		if value > math.MaxInt64 {
+			return value, nil
+		}
+		return int64(value), nil
+
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		data, err := reader.read(1 << (code - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		value := int64(int8(data[0]))
+		for _, part := range data[1:] {
+			value = value<<8 | int64(part)
+		}
+		return value, nil
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return reader.readExt(1 << (code - 0xd4))
+
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		size, err := reader.readSize(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := reader.read(size)
+		return string(data), err
+
+	case 0xdc, 0xdd: // array 16, 32
+		size, err := reader.readSize(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return reader.readArray(size)
+
+	case 0xde, 0xdf: // map 16, 32
+		size, err := reader.readSize(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return reader.readMap(size)
+	}
+
+	return nil, fmt.Errorf("Invalid msgpack type 0x%x at offset %d", header[0], reader.offset-1)
+}
+
+// NewMsgpackStreamReader creates a new reader decoding values from the given
+// source.
+func NewMsgpackStreamReader(source io.Reader) *MsgpackStreamReader {
+	return &MsgpackStreamReader{
+		source: source,
+		chunk:  make([]byte, 4096),
+	}
+}
+
+// ReadValue reads and decodes the next value from the stream. See
+// MsgpackReader.ReadValue for the types returned. The returned slices are
+// copies, i.e. they are not overwritten by the next call.
+// Errors other than incomplete data returned by the decoder are permanent,
+// i.e. the stream cannot be decoded any further.
+func (stream *MsgpackStreamReader) ReadValue() (interface{}, error) {
+	for {
+		if len(stream.buffer) > 0 {
+			reader := NewMsgpackReader(stream.buffer)
+			value, err := reader.ReadValue()
+			if err == nil {
+				// Copy the remaining data so that returned values are not
+				// overwritten by the next read.
+				stream.buffer = append([]byte(nil), stream.buffer[reader.Offset():]...)
+				return value, nil // ### return, got a value ###
+			}
+			if err != errMsgpackShortData {
+				return nil, err // ### return, invalid data ###
+			}
+		}
+
+		// Read at least as much as is buffered so that large values do not
+		// have to be decoded over and over again.
+		if len(stream.chunk) < len(stream.buffer) {
+			stream.chunk = make([]byte, len(stream.buffer))
+		}
+		size, err := stream.source.Read(stream.chunk)
+		stream.buffer = append(stream.buffer, stream.chunk[:size]...)
+		if err != nil && size == 0 {
+			if err == io.EOF && len(stream.buffer) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err // ### return, read error ###
+		}
+	}
+}
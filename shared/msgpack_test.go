@@ -0,0 +1,101 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMsgpackReadWrite(t *testing.T) {
+	expect := NewExpect(t)
+	writer := NewMsgpackWriter(64)
+
+	writer.WriteInt(1)
+	writer.WriteInt(-1)
+	writer.WriteInt(-200)
+	writer.WriteUint(300)
+	writer.WriteInt(-70000)
+	writer.WriteUint(1 << 40)
+	expect.Equal("\x01\xff\xd1\xff\x38\xcd\x01\x2c\xd2\xff\xfe\xee\x90\xcf\x00\x00\x01\x00\x00\x00\x00\x00", string(writer.Bytes()))
+
+	reader := NewMsgpackReader(writer.Bytes())
+	for _, expected := range []int64{1, -1, -200, 300, -70000, 1 << 40} {
+		value, err := reader.ReadValue()
+		expect.NoError(err)
+		expect.Equal(expected, value)
+	}
+	expect.False(reader.HasData())
+
+	writer.Reset()
+	writer.WriteValue(map[string]interface{}{
+		"b": []interface{}{true, nil, 1.5, float64(3)},
+		"a": "test",
+	})
+	writer.WriteBytes([]byte{1, 2})
+	writer.WriteExt(0, []byte{0, 0, 0, 1, 0, 0, 0, 2})
+	expect.Equal("\x82\xa1a\xa4test\xa1b\x94\xc3\xc0\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00\x03", string(writer.Bytes()[:23]))
+
+	reader = NewMsgpackReader(writer.Bytes())
+	value, err := reader.ReadValue()
+	expect.NoError(err)
+	object, isMap := value.(map[string]interface{})
+	expect.True(isMap)
+	expect.Equal("test", object["a"])
+	array, isArray := object["b"].([]interface{})
+	expect.True(isArray)
+	expect.Equal(4, len(array))
+	expect.Equal(1.5, array[2])
+	expect.Equal(int64(3), array[3])
+
+	value, _ = reader.ReadValue()
+	expect.Equal("\x01\x02", string(value.([]byte)))
+	value, _ = reader.ReadValue()
+	expect.Equal(int8(0), value.(MsgpackExt).Type)
+	expect.Equal(8, len(value.(MsgpackExt).Data))
+
+	// Incomplete data must not be decoded
+	reader = NewMsgpackReader(writer.Bytes()[:10])
+	_, err = reader.ReadValue()
+	expect.Equal(errMsgpackShortData, err)
+}
+
+func TestMsgpackStreamReader(t *testing.T) {
+	expect := NewExpect(t)
+	writer := NewMsgpackWriter(64)
+
+	writer.WriteArrayHeader(2)
+	writer.WriteString("PING")
+	writer.WriteString(string(bytes.Repeat([]byte("x"), 5000)))
+	writer.WriteMapHeader(1)
+	writer.WriteString("ack")
+	writer.WriteString("id")
+
+	stream := NewMsgpackStreamReader(iotest.OneByteReader(bytes.NewReader(writer.Bytes())))
+
+	value, err := stream.ReadValue()
+	expect.NoError(err)
+	expect.Equal("PING", value.([]interface{})[0])
+	expect.Equal(5000, len(value.([]interface{})[1].(string)))
+
+	value, err = stream.ReadValue()
+	expect.NoError(err)
+	expect.Equal("id", value.(map[string]interface{})["ack"])
+
+	_, err = stream.ReadValue()
+	expect.Equal(io.EOF, err)
+}
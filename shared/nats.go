@@ -0,0 +1,424 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NATSOpMsg is the operation of a message received from a subscription.
+	NATSOpMsg = "MSG"
+	// NATSOpPong is the operation of a response to a ping.
+	NATSOpPong = "PONG"
+)
+
+const natsHeaderVersion = "NATS/1.0"
+
+// NATSError is returned if the server reports a protocol error.
+type NATSError struct {
+	Text string
+}
+
+// Error implements the standard error interface
+func (err NATSError) Error() string {
+	return fmt.Sprintf("NATS: %s", err.Text)
+}
+
+// NATSInfo contains the fields of the INFO sent by a server that are used by
+// NATSClient.
+type NATSInfo struct {
+	ServerID     string `json:"server_id"`
+	Version      string `json:"version"`
+	MaxPayload   int    `json:"max_payload"`
+	Headers      bool   `json:"headers"`
+	AuthRequired bool   `json:"auth_required"`
+	TLSRequired  bool   `json:"tls_required"`
+}
+
+// NATSOptions contains the settings sent when connecting to a server.
+type NATSOptions struct {
+	Name     string
+	Username string
+	Password string
+	Token    string
+}
+
+// NATSMessage is a single operation read from a server. Messages have the
+// operation NATSOpMsg, responses to pings have the operation NATSOpPong.
+type NATSMessage struct {
+	Op          string
+	Subject     string
+	SID         string
+	Reply       string
+	Status      int
+	Description string
+	Header      textproto.MIMEHeader
+	Payload     []byte
+}
+
+// NATSClient is a connection to a NATS server.
+// Writes are buffered and sent by calling Flush. All methods writing to the
+// server may be called concurrently.
+type NATSClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	guard  *sync.Mutex
+	info   NATSInfo
+}
+
+// NewNATSInbox returns a new unique inbox subject prefix.
+func NewNATSInbox() string {
+	id := make([]byte, 11)
+	rand.Read(id)
+	return "_INBOX." + hex.EncodeToString(id)
+}
+
+// DialNATS connects to a NATS server. If tlsConfig is not nil the connection
+// is upgraded to TLS after the server sent its INFO.
+func DialNATS(network string, address string, tlsConfig *tls.Config, timeout time.Duration, options NATSOptions) (*NATSClient, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &NATSClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		guard:  new(sync.Mutex),
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := client.handshake(tlsConfig, options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+func (client *NATSClient) handshake(tlsConfig *tls.Config, options NATSOptions) error {
+	line, err := client.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("NATS: expected INFO, got \"%s\"", line)
+	}
+	if err := json.Unmarshal([]byte(line[5:]), &client.info); err != nil {
+		return fmt.Errorf("NATS: invalid INFO - %s", err.Error())
+	}
+
+	if tlsConfig != nil {
+		tlsConn := tls.Client(client.conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		client.conn = tlsConn
+		client.reader = bufio.NewReader(tlsConn)
+	} else if client.info.TLSRequired {
+		return fmt.Errorf("NATS: server requires TLS")
+	}
+	client.writer = bufio.NewWriter(client.conn)
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"tls_required":  tlsConfig != nil,
+		"name":          options.Name,
+		"user":          options.Username,
+		"pass":          options.Password,
+		"auth_token":    options.Token,
+		"lang":          "go",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	})
+	fmt.Fprintf(client.writer, "CONNECT %s\r\nPING\r\n", connect)
+	if err := client.writer.Flush(); err != nil {
+		return err
+	}
+
+	// The server answers with an error if the connect was refused
+	msg, err := client.Read()
+	if err != nil {
+		return err
+	}
+	if msg.Op != NATSOpPong {
+		return fmt.Errorf("NATS: expected PONG, got %s", msg.Op)
+	}
+	return nil
+}
+
+// Info returns the INFO sent by the server when connecting.
+func (client *NATSClient) Info() NATSInfo {
+	return client.info
+}
+
+func (client *NATSClient) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Read reads the next message or pong from the server. Pings sent by the
+// server are answered automatically.
+func (client *NATSClient) Read() (NATSMessage, error) {
+	for {
+		line, err := client.readLine()
+		if err != nil {
+			return NATSMessage{}, err
+		}
+
+		op := line
+		args := ""
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			op, args = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+
+		switch strings.ToUpper(op) {
+		case "MSG", "HMSG":
+			return client.readMessage(strings.ToUpper(op) == "HMSG", strings.Fields(args))
+
+		case "PING":
+			if err := client.write("PONG\r\n"); err != nil {
+				return NATSMessage{}, err
+			}
+
+		case "PONG":
+			return NATSMessage{Op: NATSOpPong}, nil
+
+		case "-ERR":
+			return NATSMessage{}, NATSError{strings.Trim(args, "'")}
+
+		case "+OK", "INFO":
+			// Ignored
+
+		default:
+			return NATSMessage{}, fmt.Errorf("NATS: unknown operation \"%s\"", op)
+		}
+	}
+}
+
+// readMessage reads the payload of a MSG or HMSG operation with the given
+// arguments.
+func (client *NATSClient) readMessage(withHeader bool, args []string) (NATSMessage, error) {
+	msg := NATSMessage{Op: NATSOpMsg}
+	minArgs := 3
+	if withHeader {
+		minArgs = 4
+	}
+	if len(args) < minArgs || len(args) > minArgs+1 {
+		return msg, fmt.Errorf("NATS: invalid message arguments")
+	}
+
+	msg.Subject, msg.SID = args[0], args[1]
+	if len(args) > minArgs {
+		msg.Reply = args[2]
+	}
+
+	headerSize := 0
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err == nil && withHeader {
+		headerSize, err = strconv.Atoi(args[len(args)-2])
+	}
+	if err != nil || size < headerSize || (client.info.MaxPayload > 0 && size > client.info.MaxPayload+headerSize) {
+		return msg, fmt.Errorf("NATS: invalid message size")
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(client.reader, data); err != nil {
+		return msg, err
+	}
+	if headerSize > 0 {
+		if err := msg.parseHeader(data[:headerSize]); err != nil {
+			return msg, err
+		}
+	}
+	msg.Payload = data[headerSize:size]
+	return msg, nil
+}
+
+// parseHeader parses the status line and the header fields sent with a
+// message.
+func (msg *NATSMessage) parseHeader(data []byte) error {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	status, err := reader.ReadLine()
+	if err != nil || !strings.HasPrefix(status, natsHeaderVersion) {
+		return fmt.Errorf("NATS: invalid message header")
+	}
+
+	if fields := strings.SplitN(strings.TrimSpace(status[len(natsHeaderVersion):]), " ", 2); fields[0] != "" {
+		msg.Status, _ = strconv.Atoi(fields[0])
+		if len(fields) > 1 {
+			msg.Description = fields[1]
+		}
+	}
+
+	msg.Header, err = reader.ReadMIMEHeader()
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (client *NATSClient) write(format string, args ...interface{}) error {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	if _, err := fmt.Fprintf(client.writer, format, args...); err != nil {
+		return err
+	}
+	return client.writer.Flush()
+}
+
+// Publish sends a message to the given subject. If reply is not empty it is
+// sent as the reply subject. The message is sent with the next call to Flush.
+func (client *NATSClient) Publish(subject string, reply string, payload []byte) error {
+	if client.info.MaxPayload > 0 && len(payload) > client.info.MaxPayload {
+		return fmt.Errorf("NATS: message of %d bytes exceeds the maximum payload", len(payload))
+	}
+
+	client.guard.Lock()
+	defer client.guard.Unlock()
+
+	if reply != "" {
+		fmt.Fprintf(client.writer, "PUB %s %s %d\r\n", subject, reply, len(payload))
+	} else {
+		fmt.Fprintf(client.writer, "PUB %s %d\r\n", subject, len(payload))
+	}
+	client.writer.Write(payload)
+	_, err := client.writer.WriteString("\r\n")
+	return err
+}
+
+// Flush sends all buffered messages to the server.
+func (client *NATSClient) Flush() error {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	return client.writer.Flush()
+}
+
+// Subscribe subscribes to the given subject. If queue is not empty, messages
+// are distributed between all subscribers of the same queue group.
+func (client *NATSClient) Subscribe(subject string, queue string, sid string) error {
+	if queue != "" {
+		return client.write("SUB %s %s %s\r\n", subject, queue, sid)
+	}
+	return client.write("SUB %s %s\r\n", subject, sid)
+}
+
+// Ping sends a ping to the server. The server answers with a message having
+// the NATSOpPong operation after all previous messages have been processed.
+func (client *NATSClient) Ping() error {
+	return client.write("PING\r\n")
+}
+
+// Request sends a message to the given subject and waits for the first reply.
+// Messages of other subscriptions received in the meantime are discarded, so
+// this must only be used while no other goroutine reads from this client.
+func (client *NATSClient) Request(subject string, payload []byte, timeout time.Duration) (NATSMessage, error) {
+	inbox := NewNATSInbox()
+	sid := inbox[len(inbox)-8:]
+
+	client.guard.Lock()
+	fmt.Fprintf(client.writer, "SUB %s %s\r\nUNSUB %s 1\r\n", inbox, sid, sid)
+	client.guard.Unlock()
+
+	if err := client.Publish(subject, inbox, payload); err != nil {
+		return NATSMessage{}, err
+	}
+	if err := client.Flush(); err != nil {
+		return NATSMessage{}, err
+	}
+
+	client.SetReadDeadline(time.Now().Add(timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := client.Read()
+		switch {
+		case err != nil:
+			return msg, err
+		case msg.Op != NATSOpMsg || msg.Subject != inbox:
+			continue // ### continue, not the reply ###
+		case msg.Status == 503:
+			return msg, fmt.Errorf("NATS: no responders for %s", subject)
+		}
+		return msg, nil
+	}
+}
+
+// DecodeNATSAPIError returns the error contained in a JetStream API response.
+// If the response does not contain an error, nil is returned.
+func DecodeNATSAPIError(payload []byte) error {
+	response := struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			ErrCode     int    `json:"err_code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return fmt.Errorf("NATS: invalid API response - %s", err.Error())
+	}
+	if response.Error != nil {
+		return NATSError{fmt.Sprintf("%d %s (%d)", response.Error.Code, response.Error.Description, response.Error.ErrCode)}
+	}
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read. A zero value disables the
+// deadline.
+func (client *NATSClient) SetReadDeadline(deadline time.Time) error {
+	return client.conn.SetReadDeadline(deadline)
+}
+
+// Close closes the connection.
+func (client *NATSClient) Close() error {
+	client.Flush()
+	return client.conn.Close()
+}
+
+// IsValidNATSSubject returns true if the given subject can be used to publish
+// messages, i.e. it is not empty, contains no whitespace or wildcards and
+// has no empty tokens.
+func IsValidNATSSubject(subject string) bool {
+	if subject == "" {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestNATSClient(input string, output *bytes.Buffer) *NATSClient {
+	return &NATSClient{
+		reader: bufio.NewReader(strings.NewReader(input)),
+		writer: bufio.NewWriter(output),
+		guard:  new(sync.Mutex),
+	}
+}
+
+func TestNATSRead(t *testing.T) {
+	expect := NewExpect(t)
+	output := bytes.Buffer{}
+
+	client := newTestNATSClient("PING\r\n"+
+		"+OK\r\n"+
+		"MSG a.b 1 reply.x 5\r\nhello\r\n"+
+		"HMSG _INBOX.x 2 44 44\r\nNATS/1.0 408 Request Timeout\r\nKey: value\r\n\r\n\r\n"+
+		"PONG\r\n"+
+		"-ERR 'Authorization Violation'\r\n", &output)
+
+	msg, err := client.Read()
+	expect.NoError(err)
+	expect.Equal("PONG\r\n", output.String())
+	expect.Equal(NATSOpMsg, msg.Op)
+	expect.Equal("a.b", msg.Subject)
+	expect.Equal("1", msg.SID)
+	expect.Equal("reply.x", msg.Reply)
+	expect.Equal("hello", string(msg.Payload))
+
+	msg, err = client.Read()
+	expect.NoError(err)
+	expect.Equal("2", msg.SID)
+	expect.Equal("", msg.Reply)
+	expect.Equal(408, msg.Status)
+	expect.Equal("Request Timeout", msg.Description)
+	expect.Equal("value", msg.Header.Get("key"))
+	expect.Equal(0, len(msg.Payload))
+
+	msg, err = client.Read()
+	expect.NoError(err)
+	expect.Equal(NATSOpPong, msg.Op)
+
+	_, err = client.Read()
+	expect.Equal("NATS: Authorization Violation", err.Error())
+}
+
+func TestNATSPublish(t *testing.T) {
+	expect := NewExpect(t)
+	output := bytes.Buffer{}
+	client := newTestNATSClient("", &output)
+	client.info.MaxPayload = 8
+
+	expect.NoError(client.Publish("a.b", "", []byte("test")))
+	expect.NoError(client.Publish("a.c", "reply", []byte("")))
+	expect.Equal(0, output.Len())
+
+	expect.NoError(client.Flush())
+	expect.Equal("PUB a.b 4\r\ntest\r\nPUB a.c reply 0\r\n\r\n", output.String())
+
+	expect.NotNil(client.Publish("a.b", "", []byte("too large")))
+}
+
+func TestNATSSubject(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.True(IsValidNATSSubject("logs.access"))
+	expect.True(IsValidNATSSubject("$JS.API.INFO"))
+	expect.False(IsValidNATSSubject(""))
+	expect.False(IsValidNATSSubject("logs..access"))
+	expect.False(IsValidNATSSubject("logs.*"))
+	expect.False(IsValidNATSSubject("logs.>"))
+	expect.False(IsValidNATSSubject("logs access"))
+
+	expect.NoError(DecodeNATSAPIError([]byte(`{"stream":"S","seq":1}`)))
+	err := DecodeNATSAPIError([]byte(`{"error":{"code":404,"err_code":10059,"description":"stream not found"}}`))
+	expect.Equal("NATS: 404 stream not found (10059)", err.Error())
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProtobufWireType defines the encoding of a protobuf field
+type ProtobufWireType int
+
+const (
+	// ProtobufVarint is used for int32, int64, uint32, uint64, sint32, sint64,
+	// bool and enum fields
+	ProtobufVarint = ProtobufWireType(0)
+	// ProtobufFixed64 is used for fixed64, sfixed64 and double fields
+	ProtobufFixed64 = ProtobufWireType(1)
+	// ProtobufBytes is used for string, bytes, embedded messages and packed
+	// repeated fields
+	ProtobufBytes = ProtobufWireType(2)
+	// ProtobufStartGroup is used by the deprecated group encoding
+	ProtobufStartGroup = ProtobufWireType(3)
+	// ProtobufEndGroup is used by the deprecated group encoding
+	ProtobufEndGroup = ProtobufWireType(4)
+	// ProtobufFixed32 is used for fixed32, sfixed32 and float fields
+	ProtobufFixed32 = ProtobufWireType(5)
+)
+
+// ProtobufReader allows reading protobuf encoded fields from a byte buffer
+// without the need of generated code.
+type ProtobufReader struct {
+	data   []byte
+	offset int
+}
+
+// ProtobufWriter allows writing protobuf encoded fields to a byte buffer
+// without the need of generated code.
+type ProtobufWriter struct {
+	data []byte
+}
+
+// NewProtobufReader creates a new reader for the given, encoded message.
+func NewProtobufReader(data []byte) ProtobufReader {
+	return ProtobufReader{
+		data:   data,
+		offset: 0,
+	}
+}
+
+// HasData returns true as long as there is unread data left
+func (reader *ProtobufReader) HasData() bool {
+	return reader.offset < len(reader.data)
+}
+
+// ReadTag reads the next field number and wire type.
+func (reader *ProtobufReader) ReadTag() (int, ProtobufWireType, error) {
+	tag, err := reader.ReadVarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(tag >> 3), ProtobufWireType(tag & 0x7), nil
+}
+
+// ReadVarint reads a base 128 varint.
+func (reader *ProtobufReader) ReadVarint() (uint64, error) {
+	value, size := binary.Uvarint(reader.data[reader.offset:])
+	if size <= 0 {
+		return 0, fmt.Errorf("Invalid protobuf varint at offset %d", reader.offset)
+	}
+	reader.offset += size
+	return value, nil
+}
+
+// ReadFixed32 reads a little endian encoded 32 bit value.
+func (reader *ProtobufReader) ReadFixed32() (uint32, error) {
+	if reader.offset+4 > len(reader.data) {
+		return 0, fmt.Errorf("Unexpected end of protobuf data")
+	}
+	value := binary.LittleEndian.Uint32(reader.data[reader.offset:])
+	reader.offset += 4
+	return value, nil
+}
+
+// ReadFixed64 reads a little endian encoded 64 bit value.
+func (reader *ProtobufReader) ReadFixed64() (uint64, error) {
+	if reader.offset+8 > len(reader.data) {
+		return 0, fmt.Errorf("Unexpected end of protobuf data")
+	}
+	value := binary.LittleEndian.Uint64(reader.data[reader.offset:])
+	reader.offset += 8
+	return value, nil
+}
+
+// ReadBytes reads a length delimited field. The returned slice references the
+// data passed to the reader, i.e. it is not copied.
+func (reader *ProtobufReader) ReadBytes() ([]byte, error) {
+	length, err := reader.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(reader.data)-reader.offset) {
+		return nil, fmt.Errorf("Unexpected end of protobuf data")
+	}
+	start := reader.offset
+	reader.offset += int(length)
+	return reader.data[start:reader.offset], nil
+}
+
+// Skip reads over the value of a field with the given wire type.
+func (reader *ProtobufReader) Skip(wireType ProtobufWireType) error {
+	var err error
+	switch wireType {
+	case ProtobufVarint:
+		_, err = reader.ReadVarint()
+	case ProtobufFixed64:
+		_, err = reader.ReadFixed64()
+	case ProtobufBytes:
+		_, err = reader.ReadBytes()
+	case ProtobufFixed32:
+		_, err = reader.ReadFixed32()
+	case ProtobufStartGroup:
+		for err == nil {
+			var nestedType ProtobufWireType
+			if _, nestedType, err = reader.ReadTag(); err == nil {
+				if nestedType == ProtobufEndGroup {
+					return nil // ### return, end of group ###
+				}
+				err = reader.Skip(nestedType)
+			}
+		}
+	default:
+		err = fmt.Errorf("Unknown protobuf wire type %d", wireType)
+	}
+	return err
+}
+
+// NewProtobufWriter creates a new writer with the given initial capacity.
+func NewProtobufWriter(capacity int) ProtobufWriter {
+	return ProtobufWriter{
+		data: make([]byte, 0, capacity),
+	}
+}
+
+// Bytes returns the encoded message
+func (writer *ProtobufWriter) Bytes() []byte {
+	return writer.data
+}
+
+// Len returns the number of bytes written
+func (writer *ProtobufWriter) Len() int {
+	return len(writer.data)
+}
+
+// WriteTag writes a field number and wire type.
+func (writer *ProtobufWriter) WriteTag(field int, wireType ProtobufWireType) {
+	writer.WriteVarint(uint64(field)<<3 | uint64(wireType))
+}
+
+// WriteVarint writes a base 128 varint.
+func (writer *ProtobufWriter) WriteVarint(value uint64) {
+	for value >= 0x80 {
+		writer.data = append(writer.data, byte(value)|0x80)
+		value >>= 7
+	}
+	writer.data = append(writer.data, byte(value))
+}
+
+// WriteFixed32 writes a little endian encoded 32 bit value.
+func (writer *ProtobufWriter) WriteFixed32(value uint32) {
+	writer.data = append(writer.data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+// WriteFixed64 writes a little endian encoded 64 bit value.
+func (writer *ProtobufWriter) WriteFixed64(value uint64) {
+	writer.WriteFixed32(uint32(value))
+	writer.WriteFixed32(uint32(value >> 32))
+}
+
+// WriteBytes writes a length delimited value.
+func (writer *ProtobufWriter) WriteBytes(value []byte) {
+	writer.WriteVarint(uint64(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// WriteVarintField writes a tag followed by a varint value.
+func (writer *ProtobufWriter) WriteVarintField(field int, value uint64) {
+	writer.WriteTag(field, ProtobufVarint)
+	writer.WriteVarint(value)
+}
+
+// WriteBytesField writes a tag followed by a length delimited value.
+func (writer *ProtobufWriter) WriteBytesField(field int, value []byte) {
+	writer.WriteTag(field, ProtobufBytes)
+	writer.WriteBytes(value)
+}
+
+// WriteStringField writes a tag followed by a length delimited string.
+func (writer *ProtobufWriter) WriteStringField(field int, value string) {
+	writer.WriteTag(field, ProtobufBytes)
+	writer.WriteVarint(uint64(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// ProtobufZigZag32 encodes a signed 32 bit value for sint32 fields.
+func ProtobufZigZag32(value int32) uint64 {
+	return uint64(uint32((value << 1) ^ (value >> 31)))
+}
+
+// ProtobufZigZag64 encodes a signed 64 bit value for sint64 fields.
+func ProtobufZigZag64(value int64) uint64 {
+	return uint64((value << 1) ^ (value >> 63))
+}
+
+// ProtobufUnZigZag decodes a sint32 or sint64 value.
+func ProtobufUnZigZag(value uint64) int64 {
+	return int64(value>>1) ^ -int64(value&1)
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+)
+
+func TestProtobufReadWrite(t *testing.T) {
+	expect := NewExpect(t)
+	writer := NewProtobufWriter(16)
+
+	writer.WriteVarintField(1, 150)
+	expect.Equal("\x08\x96\x01", string(writer.Bytes()))
+
+	writer.WriteStringField(2, "testing")
+	writer.WriteTag(3, ProtobufFixed32)
+	writer.WriteFixed32(0x01020304)
+	writer.WriteTag(4, ProtobufFixed64)
+	writer.WriteFixed64(0x0102030405060708)
+	writer.WriteVarintField(5, ProtobufZigZag64(-2))
+
+	reader := NewProtobufReader(writer.Bytes())
+
+	field, wireType, err := reader.ReadTag()
+	expect.NoError(err)
+	expect.Equal(1, field)
+	expect.Equal(ProtobufVarint, wireType)
+	value, _ := reader.ReadVarint()
+	expect.Equal(uint64(150), value)
+
+	field, wireType, _ = reader.ReadTag()
+	expect.Equal(2, field)
+	expect.Equal(ProtobufBytes, wireType)
+	data, _ := reader.ReadBytes()
+	expect.Equal("testing", string(data))
+
+	_, wireType, _ = reader.ReadTag()
+	expect.NoError(reader.Skip(wireType))
+
+	_, _, _ = reader.ReadTag()
+	value, _ = reader.ReadFixed64()
+	expect.Equal(uint64(0x0102030405060708), value)
+
+	field, _, _ = reader.ReadTag()
+	expect.Equal(5, field)
+	value, _ = reader.ReadVarint()
+	expect.Equal(int64(-2), ProtobufUnZigZag(value))
+	expect.False(reader.HasData())
+
+	_, err = reader.ReadVarint()
+	expect.NotNil(err)
+}
+
+func TestProtobufZigZag(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal(uint64(0), ProtobufZigZag32(0))
+	expect.Equal(uint64(1), ProtobufZigZag32(-1))
+	expect.Equal(uint64(4294967295), ProtobufZigZag32(-2147483648))
+	expect.Equal(int64(-2147483648), ProtobufUnZigZag(ProtobufZigZag32(-2147483648)))
+	expect.Equal(int64(-9223372036854775808), ProtobufUnZigZag(ProtobufZigZag64(-9223372036854775808)))
+}
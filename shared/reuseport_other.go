@@ -0,0 +1,28 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package shared
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenPacketReusePort always fails as SO_REUSEPORT is not supported on
+// this platform.
+func listenPacketReusePort(network, address string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package shared
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenPacketReusePort opens a packet connection with SO_REUSEPORT set so
+// that multiple connections can be bound to the same address. The kernel
+// distributes incoming packets between these connections.
+func listenPacketReusePort(network, address string) (net.PacketConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var err error
+			controlErr := conn.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	return config.ListenPacket(context.Background(), network, address)
+}
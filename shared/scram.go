@@ -0,0 +1,154 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ScramClient implements the client side of a SCRAM-SHA-256 authentication
+// exchange (RFC 7677). The password is used as-is, i.e. SASLprep is not
+// applied.
+type ScramClient struct {
+	username        string
+	password        string
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+// NewScramClient creates a new SCRAM-SHA-256 client with a random nonce.
+func NewScramClient(username, password string) *ScramClient {
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+
+	escaper := strings.NewReplacer("=", "=3D", ",", "=2C")
+	client := &ScramClient{
+		username: escaper.Replace(username),
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(nonce),
+	}
+	client.clientFirstBare = fmt.Sprintf("n=%s,r=%s", client.username, client.nonce)
+	return client
+}
+
+// FirstMessage returns the client-first-message
+func (client *ScramClient) FirstMessage() string {
+	return "n,," + client.clientFirstBare
+}
+
+func scramHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// scramSaltPassword implements PBKDF2 with HMAC-SHA-256 for one block.
+func scramSaltPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+
+	mac.Write(salt)
+	mac.Write(block)
+	result := mac.Sum(nil)
+	previous := result
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(previous)
+		previous = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= previous[j]
+		}
+	}
+	return result
+}
+
+func parseScramMessage(message string) map[byte]string {
+	attributes := make(map[byte]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) >= 2 && attribute[1] == '=' {
+			attributes[attribute[0]] = attribute[2:]
+		}
+	}
+	return attributes
+}
+
+// FinalMessage returns the client-final-message for the given
+// server-first-message.
+func (client *ScramClient) FinalMessage(serverFirst string) (string, error) {
+	attributes := parseScramMessage(serverFirst)
+	if reason, isError := attributes['e']; isError {
+		return "", fmt.Errorf("SCRAM authentication failed: %s", reason)
+	}
+
+	nonce := attributes['r']
+	if !strings.HasPrefix(nonce, client.nonce) || len(nonce) == len(client.nonce) {
+		return "", fmt.Errorf("SCRAM server nonce is invalid")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attributes['s'])
+	if err != nil {
+		return "", fmt.Errorf("SCRAM salt is invalid: %s", err.Error())
+	}
+
+	iterations, err := strconv.Atoi(attributes['i'])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("SCRAM iteration count is invalid")
+	}
+
+	clientFinal := "c=biws,r=" + nonce
+	client.authMessage = client.clientFirstBare + "," + serverFirst + "," + clientFinal
+	client.saltedPassword = scramSaltPassword(client.password, salt, iterations)
+
+	clientKey := scramHMAC(client.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := scramHMAC(storedKey[:], client.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Verify checks the server signature of the server-final-message.
+func (client *ScramClient) Verify(serverFinal string) error {
+	attributes := parseScramMessage(serverFinal)
+	if reason, isError := attributes['e']; isError {
+		return fmt.Errorf("SCRAM authentication failed: %s", reason)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attributes['v'])
+	if err != nil || client.saltedPassword == nil {
+		return fmt.Errorf("SCRAM server signature is invalid")
+	}
+
+	serverKey := scramHMAC(client.saltedPassword, "Server Key")
+	expected := scramHMAC(serverKey, client.authMessage)
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return fmt.Errorf("SCRAM server signature does not match")
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+)
+
+func TestScramClient(t *testing.T) {
+	expect := NewExpect(t)
+
+	// Test vector from RFC 7677
+	client := NewScramClient("user", "pencil")
+	client.nonce = "rOprNGfwEbeRWgbNEkqO"
+	client.clientFirstBare = "n=user,r=" + client.nonce
+	expect.Equal("n,,n=user,r=rOprNGfwEbeRWgbNEkqO", client.FirstMessage())
+
+	final, err := client.FinalMessage("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	expect.NoError(err)
+	expect.Equal("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", final)
+
+	expect.NoError(client.Verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	expect.NotNil(client.Verify("v=AAAA"))
+
+	// Server nonces have to extend the client nonce
+	_, err = client.FinalMessage("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	expect.NotNil(err)
+
+	escaped := NewScramClient("a=b,c", "")
+	expect.Equal("n=a=3Db=2Cc", escaped.clientFirstBare[:len("n=a=3Db=2Cc")])
+}
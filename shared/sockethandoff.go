@@ -0,0 +1,231 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SocketHandoffEnv is the name of the environment variable used to pass
+// inherited sockets to a new process. The variable contains a comma
+// separated list of "network://address" entries. The n-th entry maps to the
+// file descriptor 3+n.
+const SocketHandoffEnv = "GOLLUM_INHERITED_SOCKETS"
+
+type fileSocket interface {
+	File() (*os.File, error)
+}
+
+type socketHandoff struct {
+	inherited map[string]*os.File
+	active    map[string]fileSocket
+	guard     *sync.Mutex
+}
+
+var sockets = newSocketHandoff(os.Getenv(SocketHandoffEnv))
+
+func newSocketHandoff(spec string) socketHandoff {
+	handoff := socketHandoff{
+		inherited: make(map[string]*os.File),
+		active:    make(map[string]fileSocket),
+		guard:     new(sync.Mutex),
+	}
+
+	if spec != "" {
+		for idx, key := range strings.Split(spec, ",") {
+			handoff.inherited[key] = os.NewFile(uintptr(3+idx), key)
+		}
+	}
+	return handoff
+}
+
+func (handoff *socketHandoff) takeInherited(key string) *os.File {
+	handoff.guard.Lock()
+	defer handoff.guard.Unlock()
+
+	file, exists := handoff.inherited[key]
+	if exists {
+		delete(handoff.inherited, key)
+	}
+	return file
+}
+
+func (handoff *socketHandoff) isInherited(key string) bool {
+	handoff.guard.Lock()
+	defer handoff.guard.Unlock()
+
+	_, exists := handoff.inherited[key]
+	return exists
+}
+
+func (handoff *socketHandoff) register(key string, socket fileSocket) {
+	handoff.guard.Lock()
+	defer handoff.guard.Unlock()
+	handoff.active[key] = socket
+}
+
+// IsInheritedSocket returns true if a socket for the given network and address
+// has been inherited from a previous process and has not been opened yet.
+func IsInheritedSocket(network, address string) bool {
+	return sockets.isInherited(fmt.Sprintf("%s://%s", network, address))
+}
+
+// RemoveStaleSocket removes the unix domain socket file at the given address
+// if no process is listening to it anymore. Abstract sockets and sockets
+// inherited from a previous process are not removed.
+func RemoveStaleSocket(address string) error {
+	if strings.HasPrefix(address, "@") || IsInheritedSocket("unix", address) {
+		return nil // ### return, abstract or inherited socket ###
+	}
+
+	stats, err := os.Stat(address)
+	if err != nil || stats.Mode()&os.ModeSocket == 0 {
+		return nil // ### return, no socket ###
+	}
+
+	if conn, err := net.Dial("unix", address); err == nil {
+		conn.Close()
+		return nil // ### return, socket is in use ###
+	}
+
+	return os.Remove(address)
+}
+
+// ListenSocket is analogous to net.Listen but returns a listener inherited
+// from a previous process instead of opening a new one if possible.
+// All listeners opened by this function are passed on by HandoffSockets.
+func ListenSocket(network, address string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+
+	key := fmt.Sprintf("%s://%s", network, address)
+	if file := sockets.takeInherited(key); file != nil {
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+
+	if err != nil {
+		return nil, err // ### return, could not listen ###
+	}
+
+	if socket, isFileSocket := listener.(fileSocket); isFileSocket {
+		sockets.register(key, socket)
+	}
+	return listener, nil
+}
+
+// ListenPacketSocket is analogous to net.ListenPacket but returns a
+// connection inherited from a previous process instead of opening a new one
+// if possible. All connections opened by this function are passed on by
+// HandoffSockets.
+func ListenPacketSocket(network, address string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+
+	key := fmt.Sprintf("%s://%s", network, address)
+	if file := sockets.takeInherited(key); file != nil {
+		conn, err = net.FilePacketConn(file)
+		file.Close()
+	} else {
+		conn, err = net.ListenPacket(network, address)
+	}
+
+	if err != nil {
+		return nil, err // ### return, could not listen ###
+	}
+
+	if socket, isFileSocket := conn.(fileSocket); isFileSocket {
+		sockets.register(key, socket)
+	}
+	return conn, nil
+}
+
+// ListenPacketSockets opens count packet connections bound to the same
+// address by using SO_REUSEPORT. If count is 1 this is the same as calling
+// ListenPacketSocket. Connections are inherited from a previous process if
+// possible and are passed on by HandoffSockets. If opening one of the
+// connections fails, all connections are closed and an error is returned.
+func ListenPacketSockets(network, address string, count int) ([]net.PacketConn, error) {
+	if count <= 1 {
+		conn, err := ListenPacketSocket(network, address)
+		if err != nil {
+			return nil, err // ### return, could not listen ###
+		}
+		return []net.PacketConn{conn}, nil
+	}
+
+	conns := make([]net.PacketConn, 0, count)
+	for i := 0; i < count; i++ {
+		var conn net.PacketConn
+		var err error
+
+		key := fmt.Sprintf("%s://%s#%d", network, address, i)
+		if file := sockets.takeInherited(key); file != nil {
+			conn, err = net.FilePacketConn(file)
+			file.Close()
+		} else {
+			conn, err = listenPacketReusePort(network, address)
+		}
+
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err // ### return, could not listen ###
+		}
+
+		if socket, isFileSocket := conn.(fileSocket); isFileSocket {
+			sockets.register(key, socket)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// HandoffSockets returns duplicates of all sockets opened by ListenSocket,
+// ListenPacketSocket and ListenPacketSockets as well as the environment variable required to pass
+// them to a new process. The files have to be passed to the new process in
+// the returned order, starting at file descriptor 3.
+// Sockets that have already been closed are ignored.
+func HandoffSockets() ([]*os.File, string) {
+	sockets.guard.Lock()
+	defer sockets.guard.Unlock()
+
+	files := []*os.File{}
+	keys := []string{}
+
+	for key, socket := range sockets.active {
+		file, err := socket.File()
+		if err != nil {
+			continue // ### continue, closed ###
+		}
+
+		// The socket file has to survive closing the listener in this process
+		if unixListener, isUnix := socket.(*net.UnixListener); isUnix {
+			unixListener.SetUnlinkOnClose(false)
+		}
+
+		files = append(files, file)
+		keys = append(keys, key)
+	}
+
+	return files, fmt.Sprintf("%s=%s", SocketHandoffEnv, strings.Join(keys, ","))
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Statsd metric types as used in the statsd line protocol
+const (
+	StatsdCounter      = "c"
+	StatsdGauge        = "g"
+	StatsdTiming       = "ms"
+	StatsdHistogram    = "h"
+	StatsdDistribution = "d"
+	StatsdSet          = "s"
+)
+
+var statsdTypes = map[string]string{
+	"counter":      StatsdCounter,
+	"count":        StatsdCounter,
+	"c":            StatsdCounter,
+	"gauge":        StatsdGauge,
+	"g":            StatsdGauge,
+	"timing":       StatsdTiming,
+	"timer":        StatsdTiming,
+	"ms":           StatsdTiming,
+	"histogram":    StatsdHistogram,
+	"h":            StatsdHistogram,
+	"distribution": StatsdDistribution,
+	"d":            StatsdDistribution,
+	"set":          StatsdSet,
+	"s":            StatsdSet,
+}
+
+var (
+	statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_", "#", "_")
+	statsdTagReplacer  = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+)
+
+// ParseStatsdType converts a metric type given by name, e.g. "counter", or
+// by its protocol identifier, e.g. "c", to the protocol identifier.
+func ParseStatsdType(name string) (string, error) {
+	if metricType, known := statsdTypes[strings.ToLower(name)]; known {
+		return metricType, nil
+	}
+	return "", fmt.Errorf("Unknown statsd metric type \"%s\"", name)
+}
+
+// StatsdTag formats a DogStatsD tag. Characters not allowed in tags are
+// replaced by "_". If value is empty the tag consists of the name only.
+func StatsdTag(name, value string) string {
+	if value == "" {
+		return statsdTagReplacer.Replace(name)
+	}
+	return statsdTagReplacer.Replace(name + ":" + value)
+}
+
+// StatsdFormatNumber formats a metric value without exponent and trailing
+// zeros.
+func StatsdFormatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// StatsdLine formats a metric in the statsd line protocol, e.g.
+// "name:1|c|@0.5|#tag:value". Characters not allowed in names are replaced by
+// "_". The sample rate is only added if it is lower than 1 and tags are only
+// added if given, i.e. tags should only be passed for DogStatsD.
+func StatsdLine(name, value, metricType string, sampleRate float64, tags []string) string {
+	line := bytes.Buffer{}
+	line.WriteString(statsdNameReplacer.Replace(name))
+	line.WriteByte(':')
+	line.WriteString(strings.Replace(value, "\n", "_", -1))
+	line.WriteByte('|')
+	line.WriteString(metricType)
+	if sampleRate > 0 && sampleRate < 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(sampleRate, 'f', -1, 64))
+	}
+	if len(tags) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(tags, ","))
+	}
+	return line.String()
+}
+
+// StatsdPackets joins lines to packets separated by newlines. Packets are not
+// larger than maxSize bytes unless a single line exceeds this size.
+func StatsdPackets(lines []string, maxSize int) [][]byte {
+	packets := [][]byte{}
+	packet := []byte{}
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxSize {
+			packets = append(packets, packet)
+			packet = []byte{}
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+)
+
+func TestStatsdLine(t *testing.T) {
+	expect := NewExpect(t)
+
+	expect.Equal("requests:3|c", StatsdLine("requests", "3", StatsdCounter, 1, nil))
+	expect.Equal("latency:12.5|ms|@0.1", StatsdLine("latency", StatsdFormatNumber(12.5), StatsdTiming, 0.1, nil))
+	expect.Equal("a_b_c:1|g|#env:prod,canary", StatsdLine("a:b|c", "1", StatsdGauge, 1, []string{StatsdTag("env", "prod"), StatsdTag("canary", "")}))
+	expect.Equal("tag_with_comma:a_b", StatsdTag("tag_with_comma", "a,b"))
+	expect.Equal("1000000", StatsdFormatNumber(1e6))
+
+	metricType, err := ParseStatsdType("Histogram")
+	expect.NoError(err)
+	expect.Equal(StatsdHistogram, metricType)
+	_, err = ParseStatsdType("meter")
+	expect.NotNil(err)
+}
+
+func TestStatsdPackets(t *testing.T) {
+	expect := NewExpect(t)
+
+	packets := StatsdPackets([]string{"a:1|c", "b:2|c", "c:3|c"}, 11)
+	expect.Equal(2, len(packets))
+	expect.Equal("a:1|c\nb:2|c", string(packets[0]))
+	expect.Equal("c:3|c", string(packets[1]))
+
+	packets = StatsdPackets([]string{"long_metric:1|c", "a:1|c"}, 8)
+	expect.Equal(2, len(packets))
+	expect.Equal("long_metric:1|c", string(packets[0]))
+
+	expect.Equal(0, len(StatsdPackets([]string{}, 1432)))
+}
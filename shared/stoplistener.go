@@ -30,9 +30,10 @@ type StopListener struct {
 type StopRequestError struct{}
 
 // NewStopListener creates a new, stoppable TCP server connection.
-// Address needs to be cmpliant to net.Listen.
+// Address needs to be cmpliant to net.Listen. The listener may be inherited
+// from a previous process, see ListenSocket.
 func NewStopListener(address string) (*StopListener, error) {
-	listen, err := net.Listen("tcp", address)
+	listen, err := ListenSocket("tcp", address)
 	if err != nil {
 		return nil, err // ### return, could not connect ###
 	}
@@ -0,0 +1,113 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// strftimeLayouts maps strftime directives to Go time layouts.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'f': "999999999",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'T': "15:04:05",
+	'F': "2006-01-02",
+	'%': "%",
+}
+
+// StrftimeLayout converts a strftime format, e.g. "%Y-%m-%d", into a Go time
+// layout. Unknown directives are kept as-is.
+func StrftimeLayout(format string) string {
+	layout := bytes.Buffer{}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			layout.WriteByte(format[i])
+			continue // ### continue, no directive ###
+		}
+		i++
+		if directive, known := strftimeLayouts[format[i]]; known {
+			layout.WriteString(directive)
+		} else {
+			layout.WriteByte('%')
+			layout.WriteByte(format[i])
+		}
+	}
+	return layout.String()
+}
+
+// HasStrftimeDirective returns true if the given string contains at least one
+// known strftime directive other than "%%".
+func HasStrftimeDirective(format string) bool {
+	for i := 0; i+1 < len(format); i++ {
+		if format[i] != '%' {
+			continue // ### continue, no directive ###
+		}
+		i++
+		if _, known := strftimeLayouts[format[i]]; known && format[i] != '%' {
+			return true
+		}
+	}
+	return false
+}
+
+// Strftime replaces all known strftime directives in the given format with
+// the corresponding values of t. Unknown directives are kept as-is. The
+// directive %f is replaced by nine digits of nanoseconds.
+func Strftime(format string, t time.Time) string {
+	if strings.IndexByte(format, '%') == -1 {
+		return format // ### return, no directives ###
+	}
+
+	result := bytes.Buffer{}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			result.WriteByte(format[i])
+			continue // ### continue, no directive ###
+		}
+		i++
+		switch directive, known := strftimeLayouts[format[i]]; {
+		case !known:
+			result.WriteByte('%')
+			result.WriteByte(format[i])
+		case format[i] == 'f':
+			fmt.Fprintf(&result, "%09d", t.Nanosecond())
+		case format[i] == '%':
+			result.WriteByte('%')
+		default:
+			result.WriteString(t.Format(directive))
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	expect := NewExpect(t)
+	testTime := time.Date(2015, 3, 7, 14, 5, 9, 12345, time.UTC)
+
+	expect.Equal("/var/log/2015/03/07/gollum_14.log", Strftime("/var/log/%Y/%m/%d/gollum_%H.log", testTime))
+	expect.Equal("2015-03-07T14:05:09.000012345", Strftime("%FT%T.%f", testTime))
+	expect.Equal("Saturday, 7 Mar 02PM", Strftime("%A,%e %b %I%p", testTime))
+	expect.Equal("/var/log/%_%.log", Strftime("/var/log/%_%%.log", testTime))
+	expect.Equal("no directives", Strftime("no directives", testTime))
+
+	expect.Equal("2006-01-02 15:04:05.999999999", StrftimeLayout("%Y-%m-%d %H:%M:%S.%f"))
+	expect.Equal("%q 100%", StrftimeLayout("%q 100%"))
+
+	expect.True(HasStrftimeDirective("/var/log/%Y/gollum.log"))
+	expect.False(HasStrftimeDirective("/var/log/%/gollum_%%.log"))
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// NewServerTLSConfig creates a TLS configuration for servers from the given
+// certificate and key files. If clientCAFile is not empty, clients have to
+// present a certificate signed by one of the CAs stored in this file.
+func NewServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// GetTLSPeerIdentity returns the common name and all subject alternative names
+// (DNS names, email addresses, IP addresses) of the verified peer certificate
+// of a TLS connection. If no certificate was presented empty values are
+// returned.
+func GetTLSPeerIdentity(state tls.ConnectionState) (commonName string, altNames []string) {
+	if len(state.PeerCertificates) == 0 {
+		return "", nil // ### return, no certificate ###
+	}
+
+	cert := state.PeerCertificates[0]
+	altNames = append(altNames, cert.DNSNames...)
+	altNames = append(altNames, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		altNames = append(altNames, ip.String())
+	}
+
+	return strings.TrimSpace(cert.Subject.CommonName), altNames
+}
+
+// NewClientTLSConfig creates a TLS configuration for clients. If caFile is not
+// empty, server certificates are verified against the CAs stored in this
+// file instead of the system CAs. If certFile is not empty, the given
+// certificate is presented to the server. serverName overrides the name used
+// to verify the server certificate if not empty.
+func NewClientTLSConfig(caFile string, certFile string, keyFile string, serverName string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+
+	return config, nil
+}
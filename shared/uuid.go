@@ -0,0 +1,74 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// UUID is a RFC 9562 universally unique identifier.
+type UUID [16]byte
+
+// NewUUIDv4 returns a random UUID.
+func NewUUIDv4() UUID {
+	id := UUID{}
+	rand.Read(id[:])
+	id.setVersion(4)
+	return id
+}
+
+// NewUUIDv7 returns a UUID starting with the given time in milliseconds
+// followed by random data, i.e. UUIDs created at different times are sorted
+// by their creation time.
+func NewUUIDv7(now time.Time) UUID {
+	id := UUID{}
+	rand.Read(id[6:])
+
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(now.UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], timestamp[2:])
+
+	id.setVersion(7)
+	return id
+}
+
+func (id *UUID) setVersion(version byte) {
+	id[6] = (id[6] & 0x0F) | (version << 4)
+	id[8] = (id[8] & 0x3F) | 0x80 // RFC 9562 variant
+}
+
+// Version returns the version stored in the UUID.
+func (id UUID) Version() int {
+	return int(id[6] >> 4)
+}
+
+// String returns the canonical representation of the UUID, e.g.
+// "01890a5d-ac96-774b-bcce-b302099a8057".
+func (id UUID) String() string {
+	buffer := make([]byte, 36)
+	hex.Encode(buffer[0:8], id[0:4])
+	buffer[8] = '-'
+	hex.Encode(buffer[9:13], id[4:6])
+	buffer[13] = '-'
+	hex.Encode(buffer[14:18], id[6:8])
+	buffer[18] = '-'
+	hex.Encode(buffer[19:23], id[8:10])
+	buffer[23] = '-'
+	hex.Encode(buffer[24:], id[10:])
+	return string(buffer)
+}
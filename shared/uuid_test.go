@@ -0,0 +1,41 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestUUID(t *testing.T) {
+	expect := NewExpect(t)
+	format := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[47][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+
+	id := NewUUIDv4()
+	expect.Equal(4, id.Version())
+	expect.True(format.MatchString(id.String()))
+	expect.Neq(id, NewUUIDv4())
+
+	now := time.Unix(1700000000, 123000000)
+	id = NewUUIDv7(now)
+	expect.Equal(7, id.Version())
+	expect.True(format.MatchString(id.String()))
+	expect.Equal("018bcfe5-687b", id.String()[:13])
+
+	// UUIDv7 are sorted by time
+	later := NewUUIDv7(now.Add(time.Millisecond))
+	expect.True(later.String() > id.String())
+}
@@ -0,0 +1,609 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	wasmPageSize = 65536
+	wasmMaxPages = 65536
+
+	wasmTypeI32     = 0x7F
+	wasmTypeI64     = 0x7E
+	wasmTypeF32     = 0x7D
+	wasmTypeF64     = 0x7C
+	wasmTypeFuncRef = 0x70
+	wasmTypeFunc    = 0x60
+	wasmBlockEmpty  = 0x40
+
+	wasmSectionCustom    = 0
+	wasmSectionType      = 1
+	wasmSectionImport    = 2
+	wasmSectionFunction  = 3
+	wasmSectionTable     = 4
+	wasmSectionMemory    = 5
+	wasmSectionGlobal    = 6
+	wasmSectionExport    = 7
+	wasmSectionStart     = 8
+	wasmSectionElement   = 9
+	wasmSectionCode      = 10
+	wasmSectionData      = 11
+	wasmSectionDataCount = 12
+
+	wasmExternFunc   = 0
+	wasmExternTable  = 1
+	wasmExternMemory = 2
+	wasmExternGlobal = 3
+)
+
+// wasmMagic is the header of all WebAssembly binaries (version 1).
+var wasmMagic = []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+// errWasmShortData is returned if a module is truncated
+var errWasmShortData = fmt.Errorf("Unexpected end of WebAssembly module")
+
+// WasmModule is a decoded WebAssembly module in the binary format. Modules
+// are decoded and compiled once and can be instantiated multiple times by
+// using NewWasmInstance. A WasmModule is read-only and can be used by
+// multiple go routines.
+// The MVP instruction set is supported including floating point numbers,
+// multi-value blocks, sign extension, saturating conversions and the bulk
+// memory instructions. Modules are not validated beyond what is required to
+// execute them. Invalid code results in a trap when it is executed.
+type WasmModule struct {
+	types      []wasmFuncType
+	imports    []wasmImport
+	funcs      []wasmFunction
+	tableSize  uint32
+	elements   []wasmElement
+	hasMemory  bool
+	memMin     uint32
+	memMax     uint32
+	globals    []wasmGlobal
+	exports    map[string]wasmExport
+	start      int
+	data       []wasmData
+	numImports uint32
+}
+
+type wasmFuncType struct {
+	params  []byte
+	results []byte
+}
+
+type wasmImport struct {
+	module  string
+	name    string
+	typeIdx uint32
+}
+
+type wasmFunction struct {
+	typeIdx   uint32
+	numLocals int
+	code      []wasmInstr
+	brTables  [][]uint32
+}
+
+type wasmGlobal struct {
+	valType byte
+	mutable bool
+	init    uint64
+}
+
+type wasmExport struct {
+	kind  byte
+	index uint32
+}
+
+type wasmElement struct {
+	offset uint32
+	funcs  []uint32
+}
+
+type wasmData struct {
+	active bool
+	offset uint32
+	init   []byte
+}
+
+// wasmInstr is a decoded instruction. The meaning of the immediates depends
+// on the opcode, e.g. a holds the constant of i32.const, the local index of
+// local.get or the offset of memory instructions. For blocks, a and b store
+// the positions of the matching else and end instructions, c the number of
+// values carried by a branch to the block.
+type wasmInstr struct {
+	op uint16
+	a  uint64
+	b  uint32
+	c  uint32
+	d  uint32
+}
+
+// Prefixed instructions (0xFC) are stored as wasmOpPrefix | sub-opcode.
+const wasmOpPrefix = 0xFC00
+
+// wasmReader decodes the primitive types of the binary format.
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wasmReader) eof() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.pos >= len(r.data) {
+		panic(errWasmShortData)
+	}
+	value := r.data[r.pos]
+	r.pos++
+	return value
+}
+
+func (r *wasmReader) bytes(length uint32) []byte {
+	if uint64(r.pos)+uint64(length) > uint64(len(r.data)) {
+		panic(errWasmShortData)
+	}
+	value := r.data[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return value
+}
+
+func (r *wasmReader) u32() uint32 {
+	var result uint64
+	for shift := uint(0); shift < 35; shift += 7 {
+		value := r.byte()
+		result |= uint64(value&0x7F) << shift
+		if value&0x80 == 0 {
+			if result > math.MaxUint32 {
+				panic(fmt.Errorf("Integer too large"))
+			}
+			return uint32(result)
+		}
+	}
+	panic(fmt.Errorf("Integer too large"))
+}
+
+func (r *wasmReader) sleb(bits uint) int64 {
+	var result int64
+	shift := uint(0)
+	for {
+		value := r.byte()
+		result |= int64(value&0x7F) << shift
+		shift += 7
+		if value&0x80 == 0 {
+			if shift < 64 && value&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result
+		}
+		if shift >= bits+7 {
+			panic(fmt.Errorf("Integer too large"))
+		}
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *wasmReader) limits() (uint32, uint32) {
+	flags := r.byte()
+	min := r.u32()
+	max := uint32(wasmMaxPages)
+	if flags&1 != 0 {
+		max = r.u32()
+	}
+	return min, max
+}
+
+// OpenWasmModule reads and decodes the module stored in the given file.
+func OpenWasmModule(path string) (*WasmModule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewWasmModule(data)
+}
+
+// NewWasmModule decodes a module held in memory.
+func NewWasmModule(data []byte) (module *WasmModule, err error) {
+	if !bytes.HasPrefix(data, wasmMagic) {
+		return nil, fmt.Errorf("Not a WebAssembly module or unsupported version")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			module = nil
+			if recovered, isError := r.(error); isError {
+				err = fmt.Errorf("Invalid WebAssembly module: %s", recovered)
+			} else {
+				err = fmt.Errorf("Invalid WebAssembly module: %v", r)
+			}
+		}
+	}()
+
+	module = &WasmModule{
+		exports: make(map[string]wasmExport),
+		start:   -1,
+	}
+	funcTypes := []uint32{}
+	reader := &wasmReader{data: data, pos: len(wasmMagic)}
+
+	for !reader.eof() {
+		id := reader.byte()
+		section := &wasmReader{data: reader.bytes(reader.u32())}
+
+		switch id {
+		case wasmSectionCustom, wasmSectionDataCount:
+			// ignored
+
+		case wasmSectionType:
+			for count := section.u32(); count > 0; count-- {
+				if section.byte() != wasmTypeFunc {
+					return nil, fmt.Errorf("Invalid function type")
+				}
+				params := append([]byte{}, section.bytes(section.u32())...)
+				results := append([]byte{}, section.bytes(section.u32())...)
+				module.types = append(module.types, wasmFuncType{params, results})
+			}
+
+		case wasmSectionImport:
+			for count := section.u32(); count > 0; count-- {
+				imp := wasmImport{module: section.name(), name: section.name()}
+				if kind := section.byte(); kind != wasmExternFunc {
+					return nil, fmt.Errorf("Import of %s.%s is not supported, only functions can be imported", imp.module, imp.name)
+				}
+				imp.typeIdx = section.u32()
+				module.imports = append(module.imports, imp)
+			}
+			module.numImports = uint32(len(module.imports))
+
+		case wasmSectionFunction:
+			for count := section.u32(); count > 0; count-- {
+				funcTypes = append(funcTypes, section.u32())
+			}
+
+		case wasmSectionTable:
+			for count := section.u32(); count > 0; count-- {
+				if section.byte() != wasmTypeFuncRef {
+					return nil, fmt.Errorf("Only funcref tables are supported")
+				}
+				min, _ := section.limits()
+				module.tableSize = min
+			}
+
+		case wasmSectionMemory:
+			if section.u32() > 0 {
+				module.hasMemory = true
+				module.memMin, module.memMax = section.limits()
+			}
+
+		case wasmSectionGlobal:
+			for count := section.u32(); count > 0; count-- {
+				global := wasmGlobal{valType: section.byte(), mutable: section.byte() == 1}
+				global.init = module.constExpr(section)
+				module.globals = append(module.globals, global)
+			}
+
+		case wasmSectionExport:
+			for count := section.u32(); count > 0; count-- {
+				name := section.name()
+				module.exports[name] = wasmExport{kind: section.byte(), index: section.u32()}
+			}
+
+		case wasmSectionStart:
+			module.start = int(section.u32())
+
+		case wasmSectionElement:
+			for count := section.u32(); count > 0; count-- {
+				module.readElement(section)
+			}
+
+		case wasmSectionCode:
+			count := section.u32()
+			if int(count) != len(funcTypes) {
+				return nil, fmt.Errorf("Function and code section do not match")
+			}
+			for idx := uint32(0); idx < count; idx++ {
+				body := &wasmReader{data: section.bytes(section.u32())}
+				function, err := module.compile(funcTypes[idx], body)
+				if err != nil {
+					return nil, fmt.Errorf("Function %d: %s", idx+module.numImports, err)
+				}
+				module.funcs = append(module.funcs, function)
+			}
+
+		case wasmSectionData:
+			for count := section.u32(); count > 0; count-- {
+				segment := wasmData{}
+				switch section.u32() {
+				case 0:
+					segment.active = true
+					segment.offset = uint32(module.constExpr(section))
+				case 1:
+				case 2:
+					section.u32()
+					segment.active = true
+					segment.offset = uint32(module.constExpr(section))
+				default:
+					return nil, fmt.Errorf("Invalid data segment")
+				}
+				segment.init = section.bytes(section.u32())
+				module.data = append(module.data, segment)
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown section %d", id)
+		}
+	}
+
+	if len(funcTypes) != len(module.funcs) {
+		return nil, fmt.Errorf("Function and code section do not match")
+	}
+	for _, function := range module.funcs {
+		if int(function.typeIdx) >= len(module.types) {
+			return nil, fmt.Errorf("Invalid function type index")
+		}
+	}
+	for _, imp := range module.imports {
+		if int(imp.typeIdx) >= len(module.types) {
+			return nil, fmt.Errorf("Invalid function type index")
+		}
+	}
+	return module, nil
+}
+
+// constExpr evaluates a constant expression as used for global initializers
+// and segment offsets.
+func (module *WasmModule) constExpr(r *wasmReader) uint64 {
+	var value uint64
+	for {
+		switch op := r.byte(); op {
+		case 0x0B:
+			return value
+		case 0x41:
+			value = uint64(uint32(int32(r.sleb(32))))
+		case 0x42:
+			value = uint64(r.sleb(64))
+		case 0x43:
+			value = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+		case 0x44:
+			value = binary.LittleEndian.Uint64(r.bytes(8))
+		case 0x23:
+			idx := r.u32()
+			if int(idx) >= len(module.globals) {
+				panic(fmt.Errorf("Invalid global index %d", idx))
+			}
+			value = module.globals[idx].init
+		case 0xD0:
+			r.byte()
+			value = 0
+		case 0xD2:
+			value = uint64(r.u32()) + 1
+		default:
+			panic(fmt.Errorf("Unsupported constant expression 0x%02X", op))
+		}
+	}
+}
+
+// readElement reads an element segment. Passive and declarative segments
+// are skipped as the table instructions using them are not supported.
+func (module *WasmModule) readElement(r *wasmReader) {
+	flags := r.u32()
+	active := flags&1 == 0
+	element := wasmElement{}
+
+	if active {
+		if flags&2 != 0 {
+			r.u32() // table index
+		}
+		element.offset = uint32(module.constExpr(r))
+	}
+	if flags&3 != 0 {
+		r.byte() // element kind or reference type
+	}
+
+	for count := r.u32(); count > 0; count-- {
+		if flags&4 != 0 {
+			ref := module.constExpr(r)
+			element.funcs = append(element.funcs, uint32(ref)-1)
+		} else {
+			element.funcs = append(element.funcs, r.u32())
+		}
+	}
+	if active {
+		module.elements = append(module.elements, element)
+	}
+}
+
+// blockType decodes the type of a block and returns the number of
+// parameters and results.
+func (module *WasmModule) blockType(r *wasmReader) (uint32, uint32) {
+	if r.pos < len(r.data) {
+		switch r.data[r.pos] {
+		case wasmBlockEmpty:
+			r.pos++
+			return 0, 0
+		case wasmTypeI32, wasmTypeI64, wasmTypeF32, wasmTypeF64, wasmTypeFuncRef, 0x6F:
+			r.pos++
+			return 0, 1
+		}
+	}
+	idx := r.sleb(33)
+	if idx < 0 || int(idx) >= len(module.types) {
+		panic(fmt.Errorf("Invalid block type"))
+	}
+	return uint32(len(module.types[idx].params)), uint32(len(module.types[idx].results))
+}
+
+// compile decodes the body of a function. Block instructions are linked to
+// their else and end instructions so that branches do not need to scan the
+// code.
+func (module *WasmModule) compile(typeIdx uint32, r *wasmReader) (wasmFunction, error) {
+	if int(typeIdx) >= len(module.types) {
+		return wasmFunction{}, fmt.Errorf("Invalid function type index")
+	}
+	function := wasmFunction{
+		typeIdx:   typeIdx,
+		numLocals: len(module.types[typeIdx].params),
+	}
+
+	for groups := r.u32(); groups > 0; groups-- {
+		count := r.u32()
+		r.byte()
+		if uint64(function.numLocals)+uint64(count) > 50000 {
+			return function, fmt.Errorf("Too many locals")
+		}
+		function.numLocals += int(count)
+	}
+
+	code := []wasmInstr{}
+	blocks := []int{}
+
+	for !r.eof() {
+		instr := wasmInstr{op: uint16(r.byte())}
+
+		switch instr.op {
+		case 0x02, 0x03, 0x04: // block, loop, if
+			params, results := module.blockType(r)
+			instr.d = params
+			if instr.op == 0x03 {
+				instr.c = params
+			} else {
+				instr.c = results
+			}
+			blocks = append(blocks, len(code))
+
+		case 0x05: // else
+			if len(blocks) == 0 {
+				return function, fmt.Errorf("Unexpected else")
+			}
+			code[blocks[len(blocks)-1]].a = uint64(len(code))
+
+		case 0x0B: // end
+			if len(blocks) > 0 {
+				start := blocks[len(blocks)-1]
+				blocks = blocks[:len(blocks)-1]
+				code[start].b = uint32(len(code))
+				if code[start].op == 0x04 && code[start].a != 0 {
+					code[code[start].a].b = uint32(len(code))
+				}
+			}
+
+		case 0x0C, 0x0D, 0x10, 0x20, 0x21, 0x22, 0x23, 0x24: // br, br_if, call, local.*, global.*
+			instr.a = uint64(r.u32())
+
+		case 0x0E: // br_table
+			targets := make([]uint32, r.u32()+1)
+			for idx := range targets {
+				targets[idx] = r.u32()
+			}
+			instr.a = uint64(len(function.brTables))
+			function.brTables = append(function.brTables, targets)
+
+		case 0x11: // call_indirect
+			instr.a = uint64(r.u32())
+			r.u32() // table index
+
+		case 0x1C: // select t*
+			for count := r.u32(); count > 0; count-- {
+				r.byte()
+			}
+			instr.op = 0x1B
+
+		case 0x3F, 0x40: // memory.size, memory.grow
+			r.byte()
+
+		case 0x41:
+			instr.a = uint64(uint32(int32(r.sleb(32))))
+		case 0x42:
+			instr.a = uint64(r.sleb(64))
+		case 0x43:
+			instr.a = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+		case 0x44:
+			instr.a = binary.LittleEndian.Uint64(r.bytes(8))
+
+		case 0xFC:
+			instr.op = wasmOpPrefix | uint16(r.u32())
+			switch instr.op &^ wasmOpPrefix {
+			case 0, 1, 2, 3, 4, 5, 6, 7: // saturating conversions
+			case 8: // memory.init
+				instr.a = uint64(r.u32())
+				r.byte()
+			case 9: // data.drop
+				instr.a = uint64(r.u32())
+			case 10: // memory.copy
+				r.byte()
+				r.byte()
+			case 11: // memory.fill
+				r.byte()
+			default:
+				return function, fmt.Errorf("Unsupported instruction 0xFC %d", instr.op&^wasmOpPrefix)
+			}
+
+		default:
+			switch {
+			case instr.op >= 0x28 && instr.op <= 0x3E: // memory access
+				r.u32() // alignment
+				instr.a = uint64(r.u32())
+			case instr.op == 0x00 || instr.op == 0x01 || instr.op == 0x0F || instr.op == 0x1A || instr.op == 0x1B:
+			case instr.op >= 0x45 && instr.op <= 0xC4:
+			default:
+				return function, fmt.Errorf("Unsupported instruction 0x%02X", instr.op)
+			}
+		}
+		code = append(code, instr)
+	}
+
+	if len(blocks) > 0 || len(code) == 0 || code[len(code)-1].op != 0x0B {
+		return function, fmt.Errorf("Unterminated function body")
+	}
+	function.code = code
+	return function, nil
+}
+
+// HasFunction returns true if the module exports a function with the given
+// name.
+func (module *WasmModule) HasFunction(name string) bool {
+	export, exists := module.exports[name]
+	return exists && export.kind == wasmExternFunc
+}
+
+// FunctionType returns the number of parameters and results of the exported
+// function with the given name.
+func (module *WasmModule) FunctionType(name string) (params int, results int, err error) {
+	export, exists := module.exports[name]
+	if !exists || export.kind != wasmExternFunc {
+		return 0, 0, fmt.Errorf("Function %s is not exported", name)
+	}
+	typ := module.funcType(export.index)
+	return len(typ.params), len(typ.results), nil
+}
+
+// funcType returns the type of the function with the given index.
+func (module *WasmModule) funcType(idx uint32) wasmFuncType {
+	if idx < module.numImports {
+		return module.types[module.imports[idx].typeIdx]
+	}
+	return module.types[module.funcs[idx-module.numImports].typeIdx]
+}
@@ -0,0 +1,245 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func wasmTestLength(length int) []byte {
+	encoded := []byte{}
+	for length >= 0x80 {
+		encoded = append(encoded, byte(length)|0x80)
+		length >>= 7
+	}
+	return append(encoded, byte(length))
+}
+
+func wasmTestSection(id byte, items ...[]byte) []byte {
+	payload := []byte{byte(len(items))}
+	for _, item := range items {
+		payload = append(payload, item...)
+	}
+	section := append([]byte{id}, wasmTestLength(len(payload))...)
+	return append(section, payload...)
+}
+
+func wasmTestName(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+func wasmTestExport(name string, kind byte, idx byte) []byte {
+	return append(wasmTestName(name), kind, idx)
+}
+
+func wasmTestBody(locals []byte, code ...byte) []byte {
+	body := append(append([]byte{}, locals...), code...)
+	return append(wasmTestLength(len(body)), body...)
+}
+
+// wasmTestModule returns a module exporting the functions alloc, transform
+// (converts ASCII to upper case), filter (accepts input starting with "y"),
+// spin (endless loop), counter, fact (recursive factorial), choose
+// (br_table) and indirect (call_indirect to choose).
+func wasmTestModule() []byte {
+	module := append([]byte{}, wasmMagic...)
+
+	module = append(module, wasmTestSection(wasmSectionType,
+		[]byte{0x60, 1, 0x7F, 1, 0x7F},       // 0: (i32) i32
+		[]byte{0x60, 2, 0x7F, 0x7F, 1, 0x7E}, // 1: (i32, i32) i64
+		[]byte{0x60, 2, 0x7F, 0x7F, 1, 0x7F}, // 2: (i32, i32) i32
+		[]byte{0x60, 0, 1, 0x7F},             // 3: () i32
+		[]byte{0x60, 0, 0},                   // 4: ()
+		[]byte{0x60, 1, 0x7E, 1, 0x7E},       // 5: (i64) i64
+	)...)
+	module = append(module, wasmTestSection(wasmSectionFunction,
+		[]byte{0}, []byte{1}, []byte{2}, []byte{4}, []byte{3}, []byte{5}, []byte{0}, []byte{0})...)
+	module = append(module, wasmTestSection(wasmSectionTable, []byte{0x70, 0, 1})...)
+	module = append(module, wasmTestSection(wasmSectionMemory, []byte{1, 1, 2})...)
+	module = append(module, wasmTestSection(wasmSectionGlobal, []byte{0x7F, 1, 0x41, 0, 0x0B})...)
+	module = append(module, wasmTestSection(wasmSectionExport,
+		wasmTestExport("memory", wasmExternMemory, 0),
+		wasmTestExport("alloc", wasmExternFunc, 0),
+		wasmTestExport("transform", wasmExternFunc, 1),
+		wasmTestExport("filter", wasmExternFunc, 2),
+		wasmTestExport("spin", wasmExternFunc, 3),
+		wasmTestExport("counter", wasmExternFunc, 4),
+		wasmTestExport("fact", wasmExternFunc, 5),
+		wasmTestExport("choose", wasmExternFunc, 6),
+		wasmTestExport("indirect", wasmExternFunc, 7),
+	)...)
+	module = append(module, wasmTestSection(wasmSectionElement, []byte{0, 0x41, 0, 0x0B, 1, 6})...)
+
+	module = append(module, wasmTestSection(wasmSectionCode,
+		// alloc: return 1024
+		wasmTestBody([]byte{0}, 0x41, 0x80, 0x08, 0x0B),
+		// transform
+		wasmTestBody([]byte{1, 3, 0x7F},
+			0x20, 0x01, 0x45, 0x04, 0x40, 0x42, 0x7F, 0x0F, 0x0B, // return -1 if len == 0
+			0x23, 0x00, 0x41, 0x01, 0x6A, 0x24, 0x00, // counter++
+			0x02, 0x40, 0x03, 0x40,
+			0x20, 0x02, 0x20, 0x01, 0x4F, 0x0D, 0x01, // break if i >= len
+			0x20, 0x00, 0x20, 0x02, 0x6A, 0x22, 0x03, 0x2D, 0x00, 0x00, 0x22, 0x04, // b = mem[ptr+i]
+			0x41, 0xE1, 0x00, 0x4F, 0x20, 0x04, 0x41, 0xFA, 0x00, 0x4D, 0x71, // 'a' <= b <= 'z'
+			0x04, 0x40, 0x20, 0x03, 0x20, 0x04, 0x41, 0x20, 0x6B, 0x3A, 0x00, 0x00, 0x0B,
+			0x20, 0x02, 0x41, 0x01, 0x6A, 0x21, 0x02, 0x0C, 0x00, // i++
+			0x0B, 0x0B,
+			0x20, 0x00, 0xAD, 0x42, 0x20, 0x86, 0x20, 0x01, 0xAD, 0x84, 0x0B), // ptr << 32 | len
+		// filter: mem[ptr] == 'y'
+		wasmTestBody([]byte{0}, 0x20, 0x00, 0x2D, 0x00, 0x00, 0x41, 0xF9, 0x00, 0x46, 0x0B),
+		// spin
+		wasmTestBody([]byte{0}, 0x03, 0x40, 0x0C, 0x00, 0x0B, 0x0B),
+		// counter
+		wasmTestBody([]byte{0}, 0x23, 0x00, 0x0B),
+		// fact
+		wasmTestBody([]byte{0},
+			0x20, 0x00, 0x50, 0x04, 0x7E, 0x42, 0x01, 0x05,
+			0x20, 0x00, 0x20, 0x00, 0x42, 0x01, 0x7D, 0x10, 0x05, 0x7E, 0x0B, 0x0B),
+		// choose
+		wasmTestBody([]byte{0},
+			0x02, 0x40, 0x02, 0x40, 0x02, 0x40,
+			0x20, 0x00, 0x0E, 0x02, 0x00, 0x01, 0x02,
+			0x0B, 0x41, 0x0A, 0x0F,
+			0x0B, 0x41, 0x14, 0x0F,
+			0x0B, 0x41, 0x1E, 0x0B),
+		// indirect
+		wasmTestBody([]byte{0}, 0x20, 0x00, 0x41, 0x00, 0x11, 0x00, 0x00, 0x0B),
+	)...)
+
+	return append(module, wasmTestSection(wasmSectionData, []byte{0, 0x41, 0x10, 0x0B, 2, 'o', 'k'})...)
+}
+
+func TestWasmInstance(t *testing.T) {
+	expect := NewExpect(t)
+
+	module, err := NewWasmModule(wasmTestModule())
+	if !expect.NoError(err) {
+		return
+	}
+	inst, err := NewWasmInstance(module, WasmOptions{})
+	if !expect.NoError(err) {
+		return
+	}
+
+	data, err := inst.ReadMemory(0x10, 2)
+	expect.NoError(err)
+	expect.Equal("ok", string(data))
+
+	results, err := inst.Call("alloc", 5)
+	expect.NoError(err)
+	expect.Equal(uint64(1024), results[0])
+
+	expect.NoError(inst.WriteMemory(1024, []byte("hello, World")))
+	results, err = inst.Call("transform", 1024, 12)
+	expect.NoError(err)
+	expect.Equal(uint64(1024)<<32|12, results[0])
+	data, err = inst.ReadMemory(1024, 12)
+	expect.NoError(err)
+	expect.Equal("HELLO, WORLD", string(data))
+
+	results, err = inst.Call("transform", 1024, 0)
+	expect.NoError(err)
+	expect.Equal(int64(-1), int64(results[0]))
+
+	results, err = inst.Call("counter")
+	expect.NoError(err)
+	expect.Equal(uint64(1), results[0])
+
+	// Reset restores memory and globals
+	inst.Reset()
+	data, _ = inst.ReadMemory(1024, 5)
+	expect.Equal([]byte{0, 0, 0, 0, 0}, data)
+	results, _ = inst.Call("counter")
+	expect.Equal(uint64(0), results[0])
+
+	results, err = inst.Call("fact", 20)
+	expect.NoError(err)
+	expect.Equal(uint64(2432902008176640000), results[0])
+
+	for input, expected := range map[uint64]uint64{0: 10, 1: 20, 2: 30, 7: 30} {
+		results, err = inst.Call("choose", input)
+		expect.NoError(err)
+		expect.Equal(expected, results[0])
+		results, err = inst.Call("indirect", input)
+		expect.NoError(err)
+		expect.Equal(expected, results[0])
+	}
+
+	_, err = inst.Call("transform", 70000, 4)
+	expect.NotNil(err)
+	_, err = inst.Call("missing")
+	expect.NotNil(err)
+}
+
+func TestWasmLimits(t *testing.T) {
+	expect := NewExpect(t)
+
+	module, err := NewWasmModule(wasmTestModule())
+	if !expect.NoError(err) {
+		return
+	}
+	inst, err := NewWasmInstance(module, WasmOptions{})
+	if !expect.NoError(err) {
+		return
+	}
+
+	inst.Fuel = 100000
+	_, err = inst.Call("spin")
+	expect.Equal(ErrWasmFuelExhausted, err)
+
+	inst.Fuel = 0
+	inst.Timeout = 10 * time.Millisecond
+	_, err = inst.Call("spin")
+	expect.Equal(ErrWasmTimeout, err)
+
+	// Instances remain usable after a trap
+	results, err := inst.Call("counter")
+	expect.NoError(err)
+	expect.Equal(uint64(0), results[0])
+
+	_, err = NewWasmModule([]byte("not wasm"))
+	expect.NotNil(err)
+	_, err = NewWasmModule(wasmTestModule()[:60])
+	expect.NotNil(err)
+}
+
+func TestWasmPool(t *testing.T) {
+	expect := NewExpect(t)
+
+	module, err := NewWasmModule(wasmTestModule())
+	if !expect.NoError(err) {
+		return
+	}
+	pool, err := NewWasmPool(module, "transform", WasmOptions{}, 100000, 0, 2)
+	if !expect.NoError(err) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		var output []byte
+		err = pool.Call([]byte("message"), func(inst *WasmInstance, result uint64) error {
+			output, err = inst.ReadMemory(uint32(result>>32), uint32(result))
+			return err
+		})
+		expect.NoError(err)
+		expect.Equal("MESSAGE", string(output))
+	}
+
+	_, err = NewWasmPool(module, "spin", WasmOptions{}, 0, 0, 1)
+	expect.NotNil(err)
+	_, err = NewWasmPool(module, "transform", WasmOptions{MaxMemoryPages: 1}, 0, 0, 1)
+	expect.NoError(err)
+}
@@ -0,0 +1,1153 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	wasmStackSize    = 1 << 16
+	wasmMaxLabels    = 1 << 14
+	wasmMaxCallDepth = 1024
+	wasmCheckSteps   = 4096
+	wasmDirtyShift   = 12
+)
+
+// ErrWasmFuelExhausted is returned if a call executed more instructions than
+// allowed by WasmInstance.Fuel.
+var ErrWasmFuelExhausted = fmt.Errorf("WebAssembly call exceeded its instruction limit")
+
+// ErrWasmTimeout is returned if a call took longer than allowed by
+// WasmInstance.Timeout.
+var ErrWasmTimeout = fmt.Errorf("WebAssembly call timed out")
+
+// wasmTrap is used to unwind the interpreter if execution has to stop.
+type wasmTrap struct {
+	err error
+}
+
+func trapWasm(format string, args ...interface{}) {
+	panic(wasmTrap{fmt.Errorf("WebAssembly trap: "+format, args...)})
+}
+
+// WasmHostFunction implements a function imported by a module. Parameters
+// and results are passed as raw bits, i.e. i32 values are stored in the
+// lower 32 bits and floating point numbers as their IEEE 754 binary
+// representation. Returning an error stops execution of the module.
+type WasmHostFunction func(inst *WasmInstance, args []uint64) ([]uint64, error)
+
+// WasmOptions configures a WasmInstance.
+type WasmOptions struct {
+	// MaxMemoryPages limits the size of the linear memory in pages of 64 KiB.
+	// Set to 0 to use the limit defined by the module.
+	MaxMemoryPages uint32
+	// Imports maps "<module>.<name>" to the functions imported by the
+	// module. Imports of the WASI module "wasi_snapshot_preview1" that are
+	// not set here are provided by a minimal implementation without file
+	// system access, see WasiModuleName.
+	Imports map[string]WasmHostFunction
+}
+
+type wasmLabel struct {
+	height int
+	arity  int
+	target int
+	loop   bool
+}
+
+// WasmInstance is an instance of a WasmModule, i.e. a module with its own
+// memory, globals and table. Instances are not thread safe.
+// The state after instantiation can be restored by calling Reset, so that
+// consecutive calls do not influence each other.
+type WasmInstance struct {
+	// Fuel limits the number of instructions a single call may execute.
+	// Set to 0 to disable the limit.
+	Fuel int64
+	// Timeout limits the time a single call may take. Set to 0 to disable
+	// the limit.
+	Timeout time.Duration
+
+	module    *WasmModule
+	host      []WasmHostFunction
+	memory    []byte
+	maxPages  uint32
+	globals   []uint64
+	table     []int64
+	dropped   []bool
+	stack     []uint64
+	sp        int
+	labels    []wasmLabel
+	lp        int
+	depth     int
+	fuelLeft  int64
+	slice     int64
+	sliceSize int64
+	deadline  time.Time
+	snapshot  []byte
+	snapGlobs []uint64
+	dirty     []bool
+	dirtyList []uint32
+}
+
+// NewWasmInstance creates a new instance of the given module. Data and
+// element segments are copied to memory and table and the start function of
+// the module is executed.
+func NewWasmInstance(module *WasmModule, options WasmOptions) (*WasmInstance, error) {
+	inst := &WasmInstance{
+		module:   module,
+		maxPages: module.memMax,
+		stack:    make([]uint64, wasmStackSize),
+		labels:   make([]wasmLabel, wasmMaxLabels),
+		dropped:  make([]bool, len(module.data)),
+	}
+	if options.MaxMemoryPages > 0 && options.MaxMemoryPages < inst.maxPages {
+		inst.maxPages = options.MaxMemoryPages
+	}
+
+	for _, imp := range module.imports {
+		function, exists := options.Imports[imp.module+"."+imp.name]
+		if !exists && imp.module == WasiModuleName {
+			function = wasiFunction(imp.name, module.types[imp.typeIdx])
+			exists = function != nil
+		}
+		if !exists {
+			return nil, fmt.Errorf("Unresolved WebAssembly import %s.%s", imp.module, imp.name)
+		}
+		inst.host = append(inst.host, function)
+	}
+
+	if module.hasMemory {
+		if module.memMin > inst.maxPages {
+			return nil, fmt.Errorf("WebAssembly module requires %d memory pages, only %d are allowed", module.memMin, inst.maxPages)
+		}
+		inst.memory = make([]byte, int(module.memMin)*wasmPageSize)
+	}
+	inst.globals = make([]uint64, len(module.globals))
+	for idx, global := range module.globals {
+		inst.globals[idx] = global.init
+	}
+
+	inst.table = make([]int64, module.tableSize)
+	for idx := range inst.table {
+		inst.table[idx] = -1
+	}
+	numFuncs := module.numImports + uint32(len(module.funcs))
+	for _, element := range module.elements {
+		if uint64(element.offset)+uint64(len(element.funcs)) > uint64(len(inst.table)) {
+			return nil, fmt.Errorf("WebAssembly element segment does not fit into table")
+		}
+		for idx, function := range element.funcs {
+			if function >= numFuncs {
+				return nil, fmt.Errorf("Invalid function index in WebAssembly element segment")
+			}
+			inst.table[int(element.offset)+idx] = int64(function)
+		}
+	}
+
+	for idx, segment := range module.data {
+		if !segment.active {
+			continue
+		}
+		if uint64(segment.offset)+uint64(len(segment.init)) > uint64(len(inst.memory)) {
+			return nil, fmt.Errorf("WebAssembly data segment does not fit into memory")
+		}
+		copy(inst.memory[segment.offset:], segment.init)
+		inst.dropped[idx] = true
+	}
+
+	for name, export := range module.exports {
+		if export.kind == wasmExternFunc && export.index >= numFuncs {
+			return nil, fmt.Errorf("Invalid WebAssembly export %s", name)
+		}
+	}
+
+	if module.start >= 0 {
+		if uint32(module.start) >= numFuncs {
+			return nil, fmt.Errorf("Invalid WebAssembly start function")
+		}
+		if _, err := inst.run(uint32(module.start), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	inst.Snapshot()
+	return inst, nil
+}
+
+// Snapshot stores the current state of memory and globals. This state is
+// restored by Reset. NewWasmInstance takes a snapshot after executing the
+// start function, so Snapshot only needs to be called if the module requires
+// additional initialization, e.g. by an exported "_initialize" function.
+func (inst *WasmInstance) Snapshot() {
+	inst.snapshot = append(inst.snapshot[:0], inst.memory...)
+	inst.snapGlobs = append(inst.snapGlobs[:0], inst.globals...)
+	inst.dirty = make([]bool, (len(inst.memory)>>wasmDirtyShift)+1)
+	inst.dirtyList = inst.dirtyList[:0]
+}
+
+// Memory returns the linear memory of the instance. The returned slice is
+// only valid until the next call as memory may grow.
+func (inst *WasmInstance) Memory() []byte {
+	return inst.memory
+}
+
+// ReadMemory returns a copy of length bytes of memory starting at offset.
+func (inst *WasmInstance) ReadMemory(offset, length uint32) ([]byte, error) {
+	if uint64(offset)+uint64(length) > uint64(len(inst.memory)) {
+		return nil, fmt.Errorf("WebAssembly memory access out of bounds")
+	}
+	return append([]byte{}, inst.memory[offset:offset+length]...), nil
+}
+
+// WriteMemory copies data to memory starting at offset.
+func (inst *WasmInstance) WriteMemory(offset uint32, data []byte) error {
+	if uint64(offset)+uint64(len(data)) > uint64(len(inst.memory)) {
+		return fmt.Errorf("WebAssembly memory access out of bounds")
+	}
+	copy(inst.memory[offset:], data)
+	inst.markDirty(uint64(offset), uint64(len(data)))
+	return nil
+}
+
+// Reset restores memory and globals to the state after instantiation.
+// Only modified parts of the memory are copied.
+func (inst *WasmInstance) Reset() {
+	if len(inst.memory) != len(inst.snapshot) {
+		inst.memory = inst.memory[:len(inst.snapshot)]
+	}
+	for _, chunk := range inst.dirtyList {
+		start := int(chunk) << wasmDirtyShift
+		end := start + 1<<wasmDirtyShift
+		if end > len(inst.snapshot) {
+			end = len(inst.snapshot)
+		}
+		if start < end {
+			copy(inst.memory[start:end], inst.snapshot[start:end])
+		}
+		inst.dirty[chunk] = false
+	}
+	inst.dirtyList = inst.dirtyList[:0]
+	copy(inst.globals, inst.snapGlobs)
+	for idx, segment := range inst.module.data {
+		inst.dropped[idx] = segment.active
+	}
+}
+
+// markDirty records modified parts of the memory for Reset.
+func (inst *WasmInstance) markDirty(offset, length uint64) {
+	if length == 0 {
+		return
+	}
+	for chunk := offset >> wasmDirtyShift; chunk <= (offset+length-1)>>wasmDirtyShift; chunk++ {
+		if chunk >= uint64(len(inst.dirty)) {
+			return // ### return, grown memory is truncated by Reset ###
+		}
+		if !inst.dirty[chunk] {
+			inst.dirty[chunk] = true
+			inst.dirtyList = append(inst.dirtyList, uint32(chunk))
+		}
+	}
+}
+
+// Call executes the exported function with the given name. Arguments and
+// results are passed as raw bits, see WasmHostFunction.
+func (inst *WasmInstance) Call(name string, args ...uint64) ([]uint64, error) {
+	export, exists := inst.module.exports[name]
+	if !exists || export.kind != wasmExternFunc {
+		return nil, fmt.Errorf("Function %s is not exported", name)
+	}
+	return inst.run(export.index, args)
+}
+
+// run executes the function with the given index and converts traps to
+// errors.
+func (inst *WasmInstance) run(idx uint32, args []uint64) (results []uint64, err error) {
+	typ := inst.module.funcType(idx)
+	if len(args) != len(typ.params) {
+		return nil, fmt.Errorf("Function expects %d arguments, got %d", len(typ.params), len(args))
+	}
+
+	inst.sp, inst.lp, inst.depth = 0, 0, 0
+	inst.fuelLeft = inst.Fuel
+	inst.startSlice()
+	inst.deadline = time.Time{}
+	if inst.Timeout > 0 {
+		inst.deadline = time.Now().Add(inst.Timeout)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			results = nil
+			switch recovered := r.(type) {
+			case wasmTrap:
+				err = recovered.err
+			case error:
+				err = fmt.Errorf("WebAssembly trap: %s", recovered)
+			default:
+				err = fmt.Errorf("WebAssembly trap: %v", recovered)
+			}
+		}
+	}()
+
+	copy(inst.stack, args)
+	inst.sp = len(args)
+	inst.invoke(idx)
+	return append([]uint64{}, inst.stack[:len(typ.results)]...), nil
+}
+
+// checkLimits is called every few instructions to enforce Fuel and Timeout.
+func (inst *WasmInstance) checkLimits() {
+	if inst.Fuel > 0 {
+		inst.fuelLeft -= inst.sliceSize
+		if inst.fuelLeft <= 0 {
+			panic(wasmTrap{ErrWasmFuelExhausted})
+		}
+	}
+	if !inst.deadline.IsZero() && time.Now().After(inst.deadline) {
+		panic(wasmTrap{ErrWasmTimeout})
+	}
+	inst.startSlice()
+}
+
+// startSlice sets the number of instructions executed until the limits are
+// checked again.
+func (inst *WasmInstance) startSlice() {
+	inst.sliceSize = wasmCheckSteps
+	if inst.Fuel > 0 && inst.fuelLeft < wasmCheckSteps {
+		inst.sliceSize = inst.fuelLeft
+	}
+	inst.slice = inst.sliceSize
+}
+
+// memoryRange returns the effective address of a memory access and traps
+// if it is out of bounds.
+func (inst *WasmInstance) memoryRange(base uint64, offset uint64, size uint64) uint64 {
+	addr := uint64(uint32(base)) + offset
+	if addr+size > uint64(len(inst.memory)) {
+		trapWasm("out of bounds memory access")
+	}
+	return addr
+}
+
+// grow adds the given number of pages to memory and returns the previous
+// number of pages or -1 if the memory cannot grow.
+func (inst *WasmInstance) grow(pages uint32) int32 {
+	current := uint32(len(inst.memory) / wasmPageSize)
+	if !inst.module.hasMemory || uint64(current)+uint64(pages) > uint64(inst.maxPages) {
+		return -1
+	}
+	newSize := int(current+pages) * wasmPageSize
+	if newSize <= cap(inst.memory) {
+		oldSize := len(inst.memory)
+		inst.memory = inst.memory[:newSize]
+		for idx := oldSize; idx < newSize; idx++ {
+			inst.memory[idx] = 0
+		}
+	} else {
+		inst.memory = append(inst.memory, make([]byte, newSize-len(inst.memory))...)
+	}
+	return int32(current)
+}
+
+// callHost calls an imported function.
+func (inst *WasmInstance) callHost(idx uint32) {
+	typ := inst.module.funcType(idx)
+	numParams := len(typ.params)
+	args := append([]uint64{}, inst.stack[inst.sp-numParams:inst.sp]...)
+	inst.sp -= numParams
+
+	results, err := inst.host[idx](inst, args)
+	if err != nil {
+		panic(wasmTrap{err})
+	}
+	if len(results) != len(typ.results) {
+		trapWasm("host function %s returned %d values", inst.module.imports[idx].name, len(results))
+	}
+	copy(inst.stack[inst.sp:], results)
+	inst.sp += len(results)
+}
+
+func wasmBool(value bool) uint64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func wasmF32(value uint64) float32 {
+	return math.Float32frombits(uint32(value))
+}
+
+func wasmF64(value uint64) float64 {
+	return math.Float64frombits(value)
+}
+
+func wasmFromF32(value float32) uint64 {
+	return uint64(math.Float32bits(value))
+}
+
+func wasmFromF64(value float64) uint64 {
+	return math.Float64bits(value)
+}
+
+// wasmTrunc converts a float to an integer in the given range and traps if
+// the value is NaN or out of range.
+func wasmTrunc(value float64, min, max float64) float64 {
+	if math.IsNaN(value) {
+		trapWasm("invalid conversion to integer")
+	}
+	value = math.Trunc(value)
+	if value < min || value >= max {
+		trapWasm("integer overflow")
+	}
+	return value
+}
+
+// wasmTruncSat converts a float to an integer type of the given size,
+// saturating at the bounds of the type.
+func wasmTruncSat(value float64, signed bool, size uint) uint64 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	value = math.Trunc(value)
+	if signed {
+		min := -math.Pow(2, float64(size-1))
+		max := math.Pow(2, float64(size-1))
+		switch {
+		case value < min:
+			return uint64(int64(min)) & (1<<size - 1)
+		case value >= max:
+			return 1<<(size-1) - 1
+		}
+		return uint64(int64(value)) & (1<<size - 1)
+	}
+	max := math.Pow(2, float64(size))
+	switch {
+	case value <= 0:
+		return 0
+	case value >= max:
+		if size == 64 {
+			return math.MaxUint64
+		}
+		return 1<<size - 1
+	}
+	return uint64(value)
+}
+
+func wasmMin(a, b float64) float64 {
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return math.NaN()
+	case a == 0 && b == 0:
+		if math.Signbit(a) {
+			return a
+		}
+		return b
+	}
+	return math.Min(a, b)
+}
+
+func wasmMax(a, b float64) float64 {
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return math.NaN()
+	case a == 0 && b == 0:
+		if math.Signbit(a) {
+			return b
+		}
+		return a
+	}
+	return math.Max(a, b)
+}
+
+// invoke executes the function with the given index. Parameters are taken
+// from the stack and replaced by the results.
+func (inst *WasmInstance) invoke(idx uint32) {
+	module := inst.module
+	if idx < module.numImports {
+		inst.callHost(idx)
+		return // ### return, host function ###
+	}
+
+	inst.depth++
+	if inst.depth > wasmMaxCallDepth {
+		trapWasm("call stack exhausted")
+	}
+
+	function := &module.funcs[idx-module.numImports]
+	typ := module.types[function.typeIdx]
+	base := inst.sp - len(typ.params)
+	if base+function.numLocals+1024 > len(inst.stack) {
+		trapWasm("stack overflow")
+	}
+
+	stack := inst.stack
+	sp := base + function.numLocals
+	for i := inst.sp; i < sp; i++ {
+		stack[i] = 0
+	}
+	labelBase := inst.lp
+	code := function.code
+	pc := 0
+
+	for {
+		instr := &code[pc]
+		pc++
+
+		if inst.slice == 0 {
+			inst.checkLimits()
+		}
+		inst.slice--
+
+		switch instr.op {
+		case 0x00: // unreachable
+			trapWasm("unreachable executed")
+
+		case 0x01: // nop
+
+		case 0x02, 0x03: // block, loop
+			if inst.lp >= len(inst.labels) {
+				trapWasm("too many nested blocks")
+			}
+			label := wasmLabel{height: sp - int(instr.d), arity: int(instr.c)}
+			if instr.op == 0x03 {
+				label.target = pc
+				label.loop = true
+			} else {
+				label.target = int(instr.b) + 1
+			}
+			inst.labels[inst.lp] = label
+			inst.lp++
+
+		case 0x04: // if
+			if inst.lp >= len(inst.labels) {
+				trapWasm("too many nested blocks")
+			}
+			sp--
+			inst.labels[inst.lp] = wasmLabel{height: sp - int(instr.d), arity: int(instr.c), target: int(instr.b) + 1}
+			inst.lp++
+			if uint32(stack[sp]) == 0 {
+				if instr.a != 0 {
+					pc = int(instr.a) + 1
+				} else {
+					pc = int(instr.b)
+				}
+			}
+
+		case 0x05: // else, reached at the end of the if branch
+			pc = int(instr.b)
+
+		case 0x0B: // end
+			if inst.lp > labelBase {
+				inst.lp--
+				continue
+			}
+			// end of function
+			numResults := len(typ.results)
+			copy(stack[base:], stack[sp-numResults:sp])
+			inst.sp = base + numResults
+			inst.depth--
+			return
+
+		case 0x0C, 0x0D, 0x0E, 0x0F: // br, br_if, br_table, return
+			var depth int
+			switch instr.op {
+			case 0x0C:
+				depth = int(instr.a)
+			case 0x0D:
+				sp--
+				if uint32(stack[sp]) == 0 {
+					continue
+				}
+				depth = int(instr.a)
+			case 0x0E:
+				sp--
+				targets := function.brTables[instr.a]
+				selector := uint32(stack[sp])
+				if selector >= uint32(len(targets)-1) {
+					selector = uint32(len(targets) - 1)
+				}
+				depth = int(targets[selector])
+			default:
+				depth = inst.lp - labelBase
+			}
+
+			if depth >= inst.lp-labelBase {
+				numResults := len(typ.results)
+				copy(stack[base:], stack[sp-numResults:sp])
+				inst.sp = base + numResults
+				inst.lp = labelBase
+				inst.depth--
+				return // ### return, branch to function level ###
+			}
+
+			labelIdx := inst.lp - 1 - depth
+			label := inst.labels[labelIdx]
+			copy(stack[label.height:], stack[sp-label.arity:sp])
+			sp = label.height + label.arity
+			pc = label.target
+			if label.loop {
+				inst.lp = labelIdx + 1
+			} else {
+				inst.lp = labelIdx
+			}
+
+		case 0x10, 0x11: // call, call_indirect
+			callee := uint32(instr.a)
+			if instr.op == 0x11 {
+				sp--
+				elem := uint64(uint32(stack[sp]))
+				if elem >= uint64(len(inst.table)) || inst.table[elem] < 0 {
+					trapWasm("undefined table element")
+				}
+				callee = uint32(inst.table[elem])
+				expected := module.types[instr.a]
+				actual := module.funcType(callee)
+				if string(expected.params) != string(actual.params) || string(expected.results) != string(actual.results) {
+					trapWasm("indirect call type mismatch")
+				}
+			}
+			if callee >= module.numImports+uint32(len(module.funcs)) {
+				trapWasm("invalid function index")
+			}
+			inst.sp = sp
+			inst.invoke(callee)
+			sp = inst.sp
+
+		case 0x1A: // drop
+			sp--
+
+		case 0x1B: // select
+			sp -= 2
+			if uint32(stack[sp+1]) == 0 {
+				stack[sp-1] = stack[sp]
+			}
+
+		case 0x20: // local.get
+			stack[sp] = stack[base+int(instr.a)]
+			sp++
+		case 0x21: // local.set
+			sp--
+			stack[base+int(instr.a)] = stack[sp]
+		case 0x22: // local.tee
+			stack[base+int(instr.a)] = stack[sp-1]
+		case 0x23: // global.get
+			stack[sp] = inst.globals[instr.a]
+			sp++
+		case 0x24: // global.set
+			sp--
+			inst.globals[instr.a] = stack[sp]
+
+		// Memory loads
+		case 0x28:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 4)
+			stack[sp-1] = uint64(binary.LittleEndian.Uint32(inst.memory[addr:]))
+		case 0x29:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 8)
+			stack[sp-1] = binary.LittleEndian.Uint64(inst.memory[addr:])
+		case 0x2A:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 4)
+			stack[sp-1] = uint64(binary.LittleEndian.Uint32(inst.memory[addr:]))
+		case 0x2B:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 8)
+			stack[sp-1] = binary.LittleEndian.Uint64(inst.memory[addr:])
+		case 0x2C:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 1)
+			stack[sp-1] = uint64(uint32(int32(int8(inst.memory[addr]))))
+		case 0x2D:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 1)
+			stack[sp-1] = uint64(inst.memory[addr])
+		case 0x2E:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 2)
+			stack[sp-1] = uint64(uint32(int32(int16(binary.LittleEndian.Uint16(inst.memory[addr:])))))
+		case 0x2F:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 2)
+			stack[sp-1] = uint64(binary.LittleEndian.Uint16(inst.memory[addr:]))
+		case 0x30:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 1)
+			stack[sp-1] = uint64(int64(int8(inst.memory[addr])))
+		case 0x31:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 1)
+			stack[sp-1] = uint64(inst.memory[addr])
+		case 0x32:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 2)
+			stack[sp-1] = uint64(int64(int16(binary.LittleEndian.Uint16(inst.memory[addr:]))))
+		case 0x33:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 2)
+			stack[sp-1] = uint64(binary.LittleEndian.Uint16(inst.memory[addr:]))
+		case 0x34:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 4)
+			stack[sp-1] = uint64(int64(int32(binary.LittleEndian.Uint32(inst.memory[addr:]))))
+		case 0x35:
+			addr := inst.memoryRange(stack[sp-1], instr.a, 4)
+			stack[sp-1] = uint64(binary.LittleEndian.Uint32(inst.memory[addr:]))
+
+		// Memory stores
+		case 0x36, 0x38, 0x3E:
+			sp -= 2
+			addr := inst.memoryRange(stack[sp], instr.a, 4)
+			binary.LittleEndian.PutUint32(inst.memory[addr:], uint32(stack[sp+1]))
+			inst.markDirty(addr, 4)
+		case 0x37, 0x39:
+			sp -= 2
+			addr := inst.memoryRange(stack[sp], instr.a, 8)
+			binary.LittleEndian.PutUint64(inst.memory[addr:], stack[sp+1])
+			inst.markDirty(addr, 8)
+		case 0x3A, 0x3C:
+			sp -= 2
+			addr := inst.memoryRange(stack[sp], instr.a, 1)
+			inst.memory[addr] = byte(stack[sp+1])
+			inst.markDirty(addr, 1)
+		case 0x3B, 0x3D:
+			sp -= 2
+			addr := inst.memoryRange(stack[sp], instr.a, 2)
+			binary.LittleEndian.PutUint16(inst.memory[addr:], uint16(stack[sp+1]))
+			inst.markDirty(addr, 2)
+
+		case 0x3F: // memory.size
+			stack[sp] = uint64(len(inst.memory) / wasmPageSize)
+			sp++
+		case 0x40: // memory.grow
+			stack[sp-1] = uint64(uint32(inst.grow(uint32(stack[sp-1]))))
+
+		case 0x41, 0x42, 0x43, 0x44: // constants
+			stack[sp] = instr.a
+			sp++
+
+		// i32 comparisons
+		case 0x45:
+			stack[sp-1] = wasmBool(uint32(stack[sp-1]) == 0)
+		case 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F:
+			sp--
+			a, b := uint32(stack[sp-1]), uint32(stack[sp])
+			var result bool
+			switch instr.op {
+			case 0x46:
+				result = a == b
+			case 0x47:
+				result = a != b
+			case 0x48:
+				result = int32(a) < int32(b)
+			case 0x49:
+				result = a < b
+			case 0x4A:
+				result = int32(a) > int32(b)
+			case 0x4B:
+				result = a > b
+			case 0x4C:
+				result = int32(a) <= int32(b)
+			case 0x4D:
+				result = a <= b
+			case 0x4E:
+				result = int32(a) >= int32(b)
+			default:
+				result = a >= b
+			}
+			stack[sp-1] = wasmBool(result)
+
+		// i64 comparisons
+		case 0x50:
+			stack[sp-1] = wasmBool(stack[sp-1] == 0)
+		case 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			var result bool
+			switch instr.op {
+			case 0x51:
+				result = a == b
+			case 0x52:
+				result = a != b
+			case 0x53:
+				result = int64(a) < int64(b)
+			case 0x54:
+				result = a < b
+			case 0x55:
+				result = int64(a) > int64(b)
+			case 0x56:
+				result = a > b
+			case 0x57:
+				result = int64(a) <= int64(b)
+			case 0x58:
+				result = a <= b
+			case 0x59:
+				result = int64(a) >= int64(b)
+			default:
+				result = a >= b
+			}
+			stack[sp-1] = wasmBool(result)
+
+		// f32 and f64 comparisons
+		case 0x5B, 0x5C, 0x5D, 0x5E, 0x5F, 0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66:
+			sp--
+			var a, b float64
+			op := instr.op
+			if op <= 0x60 {
+				a, b = float64(wasmF32(stack[sp-1])), float64(wasmF32(stack[sp]))
+			} else {
+				a, b = wasmF64(stack[sp-1]), wasmF64(stack[sp])
+				op -= 6
+			}
+			var result bool
+			switch op {
+			case 0x5B:
+				result = a == b
+			case 0x5C:
+				result = a != b
+			case 0x5D:
+				result = a < b
+			case 0x5E:
+				result = a > b
+			case 0x5F:
+				result = a <= b
+			default:
+				result = a >= b
+			}
+			stack[sp-1] = wasmBool(result)
+
+		// i32 arithmetic
+		case 0x67:
+			stack[sp-1] = uint64(bits.LeadingZeros32(uint32(stack[sp-1])))
+		case 0x68:
+			stack[sp-1] = uint64(bits.TrailingZeros32(uint32(stack[sp-1])))
+		case 0x69:
+			stack[sp-1] = uint64(bits.OnesCount32(uint32(stack[sp-1])))
+		case 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78:
+			sp--
+			a, b := uint32(stack[sp-1]), uint32(stack[sp])
+			var result uint32
+			switch instr.op {
+			case 0x6A:
+				result = a + b
+			case 0x6B:
+				result = a - b
+			case 0x6C:
+				result = a * b
+			case 0x6D:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				if int32(a) == math.MinInt32 && int32(b) == -1 {
+					trapWasm("integer overflow")
+				}
+				result = uint32(int32(a) / int32(b))
+			case 0x6E:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				result = a / b
+			case 0x6F:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				if int32(b) == -1 {
+					result = 0
+				} else {
+					result = uint32(int32(a) % int32(b))
+				}
+			case 0x70:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				result = a % b
+			case 0x71:
+				result = a & b
+			case 0x72:
+				result = a | b
+			case 0x73:
+				result = a ^ b
+			case 0x74:
+				result = a << (b & 31)
+			case 0x75:
+				result = uint32(int32(a) >> (b & 31))
+			case 0x76:
+				result = a >> (b & 31)
+			case 0x77:
+				result = bits.RotateLeft32(a, int(b&31))
+			default:
+				result = bits.RotateLeft32(a, -int(b&31))
+			}
+			stack[sp-1] = uint64(result)
+
+		// i64 arithmetic
+		case 0x79:
+			stack[sp-1] = uint64(bits.LeadingZeros64(stack[sp-1]))
+		case 0x7A:
+			stack[sp-1] = uint64(bits.TrailingZeros64(stack[sp-1]))
+		case 0x7B:
+			stack[sp-1] = uint64(bits.OnesCount64(stack[sp-1]))
+		case 0x7C, 0x7D, 0x7E, 0x7F, 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8A:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			var result uint64
+			switch instr.op {
+			case 0x7C:
+				result = a + b
+			case 0x7D:
+				result = a - b
+			case 0x7E:
+				result = a * b
+			case 0x7F:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				if int64(a) == math.MinInt64 && int64(b) == -1 {
+					trapWasm("integer overflow")
+				}
+				result = uint64(int64(a) / int64(b))
+			case 0x80:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				result = a / b
+			case 0x81:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				if int64(b) == -1 {
+					result = 0
+				} else {
+					result = uint64(int64(a) % int64(b))
+				}
+			case 0x82:
+				if b == 0 {
+					trapWasm("integer divide by zero")
+				}
+				result = a % b
+			case 0x83:
+				result = a & b
+			case 0x84:
+				result = a | b
+			case 0x85:
+				result = a ^ b
+			case 0x86:
+				result = a << (b & 63)
+			case 0x87:
+				result = uint64(int64(a) >> (b & 63))
+			case 0x88:
+				result = a >> (b & 63)
+			case 0x89:
+				result = bits.RotateLeft64(a, int(b&63))
+			default:
+				result = bits.RotateLeft64(a, -int(b&63))
+			}
+			stack[sp-1] = result
+
+		// f32 arithmetic
+		case 0x8B:
+			stack[sp-1] = stack[sp-1] &^ (1 << 31)
+		case 0x8C:
+			stack[sp-1] = uint64(uint32(stack[sp-1]) ^ (1 << 31))
+		case 0x8D, 0x8E, 0x8F, 0x90, 0x91:
+			value := float64(wasmF32(stack[sp-1]))
+			stack[sp-1] = wasmFromF32(float32(wasmUnaryFloat(instr.op, value)))
+		case 0x92, 0x93, 0x94, 0x95, 0x96, 0x97:
+			sp--
+			a, b := wasmF32(stack[sp-1]), wasmF32(stack[sp])
+			var result float32
+			switch instr.op {
+			case 0x92:
+				result = a + b
+			case 0x93:
+				result = a - b
+			case 0x94:
+				result = a * b
+			case 0x95:
+				result = a / b
+			case 0x96:
+				result = float32(wasmMin(float64(a), float64(b)))
+			default:
+				result = float32(wasmMax(float64(a), float64(b)))
+			}
+			stack[sp-1] = wasmFromF32(result)
+		case 0x98:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1])&^(1<<31) | uint32(stack[sp])&(1<<31))
+
+		// f64 arithmetic
+		case 0x99:
+			stack[sp-1] = stack[sp-1] &^ (1 << 63)
+		case 0x9A:
+			stack[sp-1] = stack[sp-1] ^ (1 << 63)
+		case 0x9B, 0x9C, 0x9D, 0x9E, 0x9F:
+			stack[sp-1] = wasmFromF64(wasmUnaryFloat(instr.op-0x0E, wasmF64(stack[sp-1])))
+		case 0xA0, 0xA1, 0xA2, 0xA3, 0xA4, 0xA5:
+			sp--
+			a, b := wasmF64(stack[sp-1]), wasmF64(stack[sp])
+			var result float64
+			switch instr.op {
+			case 0xA0:
+				result = a + b
+			case 0xA1:
+				result = a - b
+			case 0xA2:
+				result = a * b
+			case 0xA3:
+				result = a / b
+			case 0xA4:
+				result = wasmMin(a, b)
+			default:
+				result = wasmMax(a, b)
+			}
+			stack[sp-1] = wasmFromF64(result)
+		case 0xA6:
+			sp--
+			stack[sp-1] = stack[sp-1]&^(1<<63) | stack[sp]&(1<<63)
+
+		// Conversions
+		case 0xA7:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xA8:
+			stack[sp-1] = uint64(uint32(int32(wasmTrunc(float64(wasmF32(stack[sp-1])), math.MinInt32, -math.MinInt32))))
+		case 0xA9:
+			stack[sp-1] = uint64(uint32(wasmTrunc(float64(wasmF32(stack[sp-1])), 0, math.MaxUint32+1)))
+		case 0xAA:
+			stack[sp-1] = uint64(uint32(int32(wasmTrunc(wasmF64(stack[sp-1]), math.MinInt32, -math.MinInt32))))
+		case 0xAB:
+			stack[sp-1] = uint64(uint32(wasmTrunc(wasmF64(stack[sp-1]), 0, math.MaxUint32+1)))
+		case 0xAC:
+			stack[sp-1] = uint64(int64(int32(stack[sp-1])))
+		case 0xAD:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xAE:
+			stack[sp-1] = uint64(int64(wasmTrunc(float64(wasmF32(stack[sp-1])), math.MinInt64, -math.MinInt64)))
+		case 0xAF:
+			stack[sp-1] = uint64(wasmTrunc(float64(wasmF32(stack[sp-1])), 0, math.MaxUint64))
+		case 0xB0:
+			stack[sp-1] = uint64(int64(wasmTrunc(wasmF64(stack[sp-1]), math.MinInt64, -math.MinInt64)))
+		case 0xB1:
+			stack[sp-1] = uint64(wasmTrunc(wasmF64(stack[sp-1]), 0, math.MaxUint64))
+		case 0xB2:
+			stack[sp-1] = wasmFromF32(float32(int32(stack[sp-1])))
+		case 0xB3:
+			stack[sp-1] = wasmFromF32(float32(uint32(stack[sp-1])))
+		case 0xB4:
+			stack[sp-1] = wasmFromF32(float32(int64(stack[sp-1])))
+		case 0xB5:
+			stack[sp-1] = wasmFromF32(float32(stack[sp-1]))
+		case 0xB6:
+			stack[sp-1] = wasmFromF32(float32(wasmF64(stack[sp-1])))
+		case 0xB7:
+			stack[sp-1] = wasmFromF64(float64(int32(stack[sp-1])))
+		case 0xB8:
+			stack[sp-1] = wasmFromF64(float64(uint32(stack[sp-1])))
+		case 0xB9:
+			stack[sp-1] = wasmFromF64(float64(int64(stack[sp-1])))
+		case 0xBA:
+			stack[sp-1] = wasmFromF64(float64(stack[sp-1]))
+		case 0xBB:
+			stack[sp-1] = wasmFromF64(float64(wasmF32(stack[sp-1])))
+		case 0xBC, 0xBE:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xBD, 0xBF:
+			// reinterpretation does not change the bits
+
+		// Sign extension
+		case 0xC0:
+			stack[sp-1] = uint64(uint32(int32(int8(stack[sp-1]))))
+		case 0xC1:
+			stack[sp-1] = uint64(uint32(int32(int16(stack[sp-1]))))
+		case 0xC2:
+			stack[sp-1] = uint64(int64(int8(stack[sp-1])))
+		case 0xC3:
+			stack[sp-1] = uint64(int64(int16(stack[sp-1])))
+		case 0xC4:
+			stack[sp-1] = uint64(int64(int32(stack[sp-1])))
+
+		// Saturating conversions
+		case wasmOpPrefix | 0:
+			stack[sp-1] = wasmTruncSat(float64(wasmF32(stack[sp-1])), true, 32)
+		case wasmOpPrefix | 1:
+			stack[sp-1] = wasmTruncSat(float64(wasmF32(stack[sp-1])), false, 32)
+		case wasmOpPrefix | 2:
+			stack[sp-1] = wasmTruncSat(wasmF64(stack[sp-1]), true, 32)
+		case wasmOpPrefix | 3:
+			stack[sp-1] = wasmTruncSat(wasmF64(stack[sp-1]), false, 32)
+		case wasmOpPrefix | 4:
+			stack[sp-1] = wasmTruncSat(float64(wasmF32(stack[sp-1])), true, 64)
+		case wasmOpPrefix | 5:
+			stack[sp-1] = wasmTruncSat(float64(wasmF32(stack[sp-1])), false, 64)
+		case wasmOpPrefix | 6:
+			stack[sp-1] = wasmTruncSat(wasmF64(stack[sp-1]), true, 64)
+		case wasmOpPrefix | 7:
+			stack[sp-1] = wasmTruncSat(wasmF64(stack[sp-1]), false, 64)
+
+		// Bulk memory
+		case wasmOpPrefix | 8: // memory.init
+			sp -= 3
+			dst, src, length := uint64(uint32(stack[sp])), uint64(uint32(stack[sp+1])), uint64(uint32(stack[sp+2]))
+			if instr.a >= uint64(len(module.data)) {
+				trapWasm("invalid data segment")
+			}
+			var segment []byte
+			if !inst.dropped[instr.a] {
+				segment = module.data[instr.a].init
+			}
+			if src+length > uint64(len(segment)) || dst+length > uint64(len(inst.memory)) {
+				trapWasm("out of bounds memory access")
+			}
+			copy(inst.memory[dst:dst+length], segment[src:])
+			inst.markDirty(dst, length)
+		case wasmOpPrefix | 9: // data.drop
+			if instr.a >= uint64(len(module.data)) {
+				trapWasm("invalid data segment")
+			}
+			inst.dropped[instr.a] = true
+		case wasmOpPrefix | 10: // memory.copy
+			sp -= 3
+			dst, src, length := uint64(uint32(stack[sp])), uint64(uint32(stack[sp+1])), uint64(uint32(stack[sp+2]))
+			if src+length > uint64(len(inst.memory)) || dst+length > uint64(len(inst.memory)) {
+				trapWasm("out of bounds memory access")
+			}
+			copy(inst.memory[dst:dst+length], inst.memory[src:src+length])
+			inst.markDirty(dst, length)
+		case wasmOpPrefix | 11: // memory.fill
+			sp -= 3
+			dst, value, length := uint64(uint32(stack[sp])), byte(stack[sp+1]), uint64(uint32(stack[sp+2]))
+			if dst+length > uint64(len(inst.memory)) {
+				trapWasm("out of bounds memory access")
+			}
+			area := inst.memory[dst : dst+length]
+			for i := range area {
+				area[i] = value
+			}
+			inst.markDirty(dst, length)
+
+		default:
+			trapWasm("unsupported instruction 0x%X", instr.op)
+		}
+	}
+}
+
+// wasmUnaryFloat implements ceil, floor, trunc, nearest and sqrt using the
+// f32 opcodes.
+func wasmUnaryFloat(op uint16, value float64) float64 {
+	switch op {
+	case 0x8D:
+		return math.Ceil(value)
+	case 0x8E:
+		return math.Floor(value)
+	case 0x8F:
+		return math.Trunc(value)
+	case 0x90:
+		return math.RoundToEven(value)
+	default:
+		return math.Sqrt(value)
+	}
+}
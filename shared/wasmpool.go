@@ -0,0 +1,137 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// WasmPool runs messages through a WebAssembly module implementing the
+// following ABI:
+//
+//   alloc(size i32) i32              returns a buffer of size bytes
+//   <function>(ptr i32, len i32) x   processes the input stored in the buffer
+//
+// The module has to export its memory. If the module exports a function
+// named "_initialize" it is called once after instantiation, as required by
+// WASI reactor modules. Instances are reset after each call so that calls do
+// not influence each other and memory does not grow across calls.
+// A WasmPool can be used by multiple go routines. Instances are created on
+// demand and up to size instances are kept for later use.
+type WasmPool struct {
+	module    *WasmModule
+	function  string
+	options   WasmOptions
+	fuel      int64
+	timeout   time.Duration
+	instances chan *WasmInstance
+}
+
+// OpenWasmPool reads the module stored in the given file and creates a pool
+// for it, see NewWasmPool.
+func OpenWasmPool(path string, function string, options WasmOptions, fuel int64, timeout time.Duration, size int) (*WasmPool, error) {
+	module, err := OpenWasmModule(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewWasmPool(module, function, options, fuel, timeout, size)
+}
+
+// NewWasmPool creates a pool calling the given function of a module. Fuel
+// and timeout limit each call, see WasmInstance. An instance is created to
+// verify that the module can be instantiated.
+func NewWasmPool(module *WasmModule, function string, options WasmOptions, fuel int64, timeout time.Duration, size int) (*WasmPool, error) {
+	if params, results, err := module.FunctionType("alloc"); err != nil || params != 1 || results != 1 {
+		return nil, fmt.Errorf("WebAssembly module has to export alloc(size i32) i32")
+	}
+	if params, results, err := module.FunctionType(function); err != nil || params != 2 || results != 1 {
+		return nil, fmt.Errorf("WebAssembly module has to export %s(ptr i32, len i32) with one result", function)
+	}
+	if export, exists := module.exports["memory"]; !exists || export.kind != wasmExternMemory {
+		return nil, fmt.Errorf("WebAssembly module has to export its memory")
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &WasmPool{
+		module:    module,
+		function:  function,
+		options:   options,
+		fuel:      fuel,
+		timeout:   timeout,
+		instances: make(chan *WasmInstance, size),
+	}
+	inst, err := pool.newInstance()
+	if err != nil {
+		return nil, err
+	}
+	pool.instances <- inst
+	return pool, nil
+}
+
+func (pool *WasmPool) newInstance() (*WasmInstance, error) {
+	inst, err := NewWasmInstance(pool.module, pool.options)
+	if err != nil {
+		return nil, err
+	}
+	inst.Fuel = pool.fuel
+	inst.Timeout = pool.timeout
+	if pool.module.HasFunction("_initialize") {
+		if _, err := inst.Call("_initialize"); err != nil {
+			return nil, err
+		}
+		inst.Snapshot()
+	}
+	return inst, nil
+}
+
+// Call passes data to the function of the pool and calls handle with the
+// result of the function. The instance passed to handle can be used to read
+// the output of the function and is only valid during handle.
+func (pool *WasmPool) Call(data []byte, handle func(inst *WasmInstance, result uint64) error) error {
+	var inst *WasmInstance
+	select {
+	case inst = <-pool.instances:
+	default:
+		var err error
+		if inst, err = pool.newInstance(); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		inst.Reset()
+		select {
+		case pool.instances <- inst:
+		default:
+		}
+	}()
+
+	results, err := inst.Call("alloc", uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	ptr := uint32(results[0])
+	if err := inst.WriteMemory(ptr, data); err != nil {
+		return err
+	}
+
+	if results, err = inst.Call(pool.function, uint64(ptr), uint64(len(data))); err != nil {
+		return err
+	}
+	return handle(inst, results[0])
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// WasiModuleName is the module name of WASI preview 1 imports. Modules
+// compiled for WASI, e.g. by Go (GOOS=wasip1), TinyGo or Rust
+// (wasm32-wasip1), import functions from this module even if they are not
+// used. A minimal implementation is provided that has no access to files,
+// arguments or environment variables. Output written to stdout or stderr is
+// discarded. Clocks and random numbers are provided by the host.
+const WasiModuleName = "wasi_snapshot_preview1"
+
+const (
+	wasiSuccess = 0
+	wasiEBADF   = 8
+	wasiEFAULT  = 21
+	wasiENOSYS  = 52
+)
+
+// wasiHostFunctions contains the implemented WASI functions. All of them
+// return an errno as single i32 result.
+var wasiHostFunctions = map[string]func(inst *WasmInstance, args []uint64) uint32{
+	"args_sizes_get":    wasiZeroSizes,
+	"environ_sizes_get": wasiZeroSizes,
+	"args_get":          wasiNoop,
+	"environ_get":       wasiNoop,
+	"sched_yield":       wasiNoop,
+	"fd_prestat_get":    wasiBadFile,
+
+	"clock_time_get": func(inst *WasmInstance, args []uint64) uint32 {
+		return wasiStoreUint64(inst, args[2], uint64(time.Now().UnixNano()))
+	},
+
+	"clock_res_get": func(inst *WasmInstance, args []uint64) uint32 {
+		return wasiStoreUint64(inst, args[1], 1000)
+	},
+
+	"random_get": func(inst *WasmInstance, args []uint64) uint32 {
+		offset, length := uint64(uint32(args[0])), uint64(uint32(args[1]))
+		if offset+length > uint64(len(inst.memory)) {
+			return wasiEFAULT
+		}
+		rand.Read(inst.memory[offset : offset+length])
+		inst.markDirty(offset, length)
+		return wasiSuccess
+	},
+
+	"fd_write": func(inst *WasmInstance, args []uint64) uint32 {
+		fd, iovs, count := uint32(args[0]), uint64(uint32(args[1])), uint64(uint32(args[2]))
+		if fd != 1 && fd != 2 {
+			return wasiEBADF
+		}
+		if iovs+count*8 > uint64(len(inst.memory)) {
+			return wasiEFAULT
+		}
+		written := uint32(0)
+		for idx := uint64(0); idx < count; idx++ {
+			written += binary.LittleEndian.Uint32(inst.memory[iovs+idx*8+4:])
+		}
+		return wasiStoreUint32(inst, args[3], written)
+	},
+}
+
+func wasiNoop(inst *WasmInstance, args []uint64) uint32 {
+	return wasiSuccess
+}
+
+func wasiBadFile(inst *WasmInstance, args []uint64) uint32 {
+	return wasiEBADF
+}
+
+func wasiZeroSizes(inst *WasmInstance, args []uint64) uint32 {
+	if errno := wasiStoreUint32(inst, args[0], 0); errno != wasiSuccess {
+		return errno
+	}
+	return wasiStoreUint32(inst, args[1], 0)
+}
+
+func wasiStoreUint32(inst *WasmInstance, offset uint64, value uint32) uint32 {
+	offset = uint64(uint32(offset))
+	if offset+4 > uint64(len(inst.memory)) {
+		return wasiEFAULT
+	}
+	binary.LittleEndian.PutUint32(inst.memory[offset:], value)
+	inst.markDirty(offset, 4)
+	return wasiSuccess
+}
+
+func wasiStoreUint64(inst *WasmInstance, offset uint64, value uint64) uint32 {
+	offset = uint64(uint32(offset))
+	if offset+8 > uint64(len(inst.memory)) {
+		return wasiEFAULT
+	}
+	binary.LittleEndian.PutUint64(inst.memory[offset:], value)
+	inst.markDirty(offset, 8)
+	return wasiSuccess
+}
+
+// wasiFunction returns the implementation of the given WASI function.
+// proc_exit stops execution, functions that are not implemented return
+// ENOSYS. Nil is returned for functions with an unexpected signature.
+func wasiFunction(name string, typ wasmFuncType) WasmHostFunction {
+	if name == "proc_exit" {
+		return func(inst *WasmInstance, args []uint64) ([]uint64, error) {
+			return nil, fmt.Errorf("WebAssembly module exited with code %d", uint32(args[0]))
+		}
+	}
+	if len(typ.results) != 1 || typ.results[0] != wasmTypeI32 {
+		return nil // ### return, unknown signature ###
+	}
+
+	function, implemented := wasiHostFunctions[name]
+	if !implemented {
+		return func(inst *WasmInstance, args []uint64) ([]uint64, error) {
+			return []uint64{wasiENOSYS}, nil
+		}
+	}
+	return func(inst *WasmInstance, args []uint64) ([]uint64, error) {
+		return []uint64{uint64(function(inst, args))}, nil
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileBuffers(t *testing.T) {
+	expect := NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum_writev")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buffers := [][]byte{[]byte("abc"), nil, []byte("def")}
+	for i := 0; i < 2000; i++ {
+		buffers = append(buffers, []byte("x"))
+	}
+
+	written, err := WriteFileBuffers(file, buffers)
+	expect.NoError(err)
+	expect.Equal(int64(2006), written)
+	expect.Equal("abc", string(buffers[0]))
+
+	data, err := ioutil.ReadFile(file.Name())
+	expect.NoError(err)
+	expect.Equal("abcdef"+strings.Repeat("x", 2000), string(data))
+
+	file.Close()
+	_, err = WriteFileBuffers(file, buffers)
+	expect.NotNil(err)
+}
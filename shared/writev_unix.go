@@ -0,0 +1,98 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package shared
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// writevMaxBuffers is the number of buffers passed to a single writev call.
+// This matches IOV_MAX on most systems.
+const writevMaxBuffers = 1024
+
+// WriteFileBuffers writes all buffers to the given file by using writev, i.e.
+// up to 1024 buffers are written with a single syscall. The buffers are not
+// modified. The number of bytes written is returned.
+func WriteFileBuffers(file *os.File, buffers [][]byte) (int64, error) {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err // ### return, no file descriptor ###
+	}
+
+	iovecs := make([]syscall.Iovec, 0, writevMaxBuffers)
+	written := int64(0)
+	bufferIdx, offset := 0, 0
+
+	for {
+		// Skip empty and already written buffers
+		for bufferIdx < len(buffers) && offset >= len(buffers[bufferIdx]) {
+			bufferIdx++
+			offset = 0
+		}
+		if bufferIdx == len(buffers) {
+			return written, nil // ### return, done ###
+		}
+
+		iovecs = iovecs[:0]
+		for idx := bufferIdx; idx < len(buffers) && len(iovecs) < writevMaxBuffers; idx++ {
+			buffer := buffers[idx]
+			if idx == bufferIdx {
+				buffer = buffer[offset:]
+			}
+			if len(buffer) > 0 {
+				iovec := syscall.Iovec{Base: &buffer[0]}
+				iovec.SetLen(len(buffer))
+				iovecs = append(iovecs, iovec)
+			}
+		}
+
+		var count uintptr
+		var errno syscall.Errno
+		err = conn.Write(func(fd uintptr) bool {
+			count, _, errno = syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+			return errno != syscall.EAGAIN
+		})
+
+		switch {
+		case err != nil:
+			return written, err // ### return, descriptor closed ###
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			return written, &os.PathError{Op: "writev", Path: file.Name(), Err: errno}
+		case count == 0:
+			return written, io.ErrShortWrite
+		}
+
+		// Advance to the first buffer not written completely
+		written += int64(count)
+		remain := int(count)
+		for remain > 0 {
+			if pending := len(buffers[bufferIdx]) - offset; remain < pending {
+				offset += remain
+				remain = 0
+			} else {
+				remain -= pending
+				bufferIdx++
+				offset = 0
+			}
+		}
+	}
+}
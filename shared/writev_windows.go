@@ -0,0 +1,34 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"os"
+)
+
+// WriteFileBuffers writes all buffers to the given file. writev is not
+// available on windows so each buffer is written separately. The number of
+// bytes written is returned.
+func WriteFileBuffers(file *os.File, buffers [][]byte) (int64, error) {
+	written := int64(0)
+	for _, buffer := range buffers {
+		count, err := file.Write(buffer)
+		written += int64(count)
+		if err != nil {
+			return written, err // ### return, write failed ###
+		}
+	}
+	return written, nil
+}
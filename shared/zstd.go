@@ -0,0 +1,918 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// ZstdMagic is the magic number at the start of each Zstandard frame.
+const ZstdMagic = uint32(0xFD2FB528)
+
+const (
+	zstdSkippableMagic = uint32(0x184D2A50)
+	zstdSkippableMask  = uint32(0xFFFFFFF0)
+	zstdMaxBlockSize   = 128 << 10
+	zstdMaxHuffmanBits = 11
+)
+
+// Predefined FSE distributions as defined by RFC 8878.
+var (
+	zstdLiteralLengthsDefault = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthsDefault = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetsDefault = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	zstdLiteralLengthBase = []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLiteralLengthBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMatchLengthBase = []uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMatchLengthBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// zstdForwardBits reads bits from the start of a buffer, least significant
+// bit first. This is used to read FSE table descriptions.
+type zstdForwardBits struct {
+	data   []byte
+	bitPos int
+}
+
+func (reader *zstdForwardBits) peek(count int) uint32 {
+	value := uint64(0)
+	start := reader.bitPos / 8
+	for i := 0; i < 8 && start+i < len(reader.data); i++ {
+		value |= uint64(reader.data[start+i]) << uint(8*i)
+	}
+	return uint32(value>>uint(reader.bitPos%8)) & (1<<uint(count) - 1)
+}
+
+func (reader *zstdForwardBits) skip(count int) {
+	reader.bitPos += count
+}
+
+// zstdBackwardBits reads bits from the end of a buffer, starting below the
+// highest set bit of the last byte. This is used to read Huffman and FSE
+// encoded streams. Reading past the start of the buffer returns zero bits.
+type zstdBackwardBits struct {
+	data   []byte
+	bitPos int
+}
+
+func newZstdBackwardBits(data []byte) (zstdBackwardBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return zstdBackwardBits{}, fmt.Errorf("zstd: invalid bitstream")
+	}
+	return zstdBackwardBits{
+		data:   data,
+		bitPos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1,
+	}, nil
+}
+
+func (reader *zstdBackwardBits) peek(count int) uint64 {
+	if count == 0 || reader.bitPos <= 0 {
+		return 0
+	}
+	start := reader.bitPos - count
+	shift := 0
+	if start < 0 {
+		shift = -start
+		start = 0
+	}
+
+	value := uint64(0)
+	first := start / 8
+	for i := 0; i < 8 && first+i < len(reader.data); i++ {
+		value |= uint64(reader.data[first+i]) << uint(8*i)
+	}
+	value >>= uint(start % 8)
+	value &= 1<<uint(count-shift) - 1
+	return value << uint(shift)
+}
+
+func (reader *zstdBackwardBits) read(count int) uint64 {
+	value := reader.peek(count)
+	reader.bitPos -= count
+	return value
+}
+
+// overflow returns true if more bits have been read than available.
+func (reader *zstdBackwardBits) overflow() bool {
+	return reader.bitPos < 0
+}
+
+type zstdFSEEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+type zstdFSETable struct {
+	tableLog int
+	entries  []zstdFSEEntry
+}
+
+// readZstdFSECounts reads an FSE table description and returns the normalized
+// counts, the accuracy log and the number of bytes read.
+func readZstdFSECounts(data []byte, maxSymbol int, maxLog int) ([]int16, int, int, error) {
+	if len(data) == 0 {
+		return nil, 0, 0, fmt.Errorf("zstd: missing FSE table")
+	}
+	reader := zstdForwardBits{data: data}
+	tableLog := int(reader.peek(4)) + 5
+	reader.skip(4)
+	if tableLog > maxLog {
+		return nil, 0, 0, fmt.Errorf("zstd: FSE accuracy log %d too large", tableLog)
+	}
+
+	counts := make([]int16, 0, maxSymbol+1)
+	remaining := (1 << uint(tableLog)) + 1
+	threshold := 1 << uint(tableLog)
+	nbBits := tableLog + 1
+	previous0 := false
+
+	for remaining > 1 {
+		if previous0 {
+			for {
+				repeat := int(reader.peek(2))
+				reader.skip(2)
+				for i := 0; i < repeat; i++ {
+					counts = append(counts, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		if len(counts) > maxSymbol || reader.bitPos > len(data)*8 {
+			return nil, 0, 0, fmt.Errorf("zstd: invalid FSE table")
+		}
+
+		max := (2*threshold - 1) - remaining
+		value := int(reader.peek(nbBits))
+		count := 0
+		if value&(threshold-1) < max {
+			count = value & (threshold - 1)
+			reader.skip(nbBits - 1)
+		} else {
+			count = value & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			reader.skip(nbBits)
+		}
+
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		previous0 = count == 0
+
+		for remaining < threshold && threshold > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	if remaining != 1 || len(counts) > maxSymbol+1 || reader.bitPos > len(data)*8 {
+		return nil, 0, 0, fmt.Errorf("zstd: invalid FSE table")
+	}
+	return counts, tableLog, (reader.bitPos + 7) / 8, nil
+}
+
+// newZstdFSETable builds a decoding table from normalized counts.
+func newZstdFSETable(counts []int16, tableLog int) (*zstdFSETable, error) {
+	size := 1 << uint(tableLog)
+	table := &zstdFSETable{tableLog: tableLog, entries: make([]zstdFSEEntry, size)}
+	next := make([]int, len(counts))
+	high := size - 1
+
+	for symbol, count := range counts {
+		if count == -1 {
+			table.entries[high].symbol = uint8(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = int(count)
+		}
+	}
+
+	step := (size >> 1) + (size >> 3) + 3
+	pos := 0
+	for symbol, count := range counts {
+		for i := 0; i < int(count); i++ {
+			table.entries[pos].symbol = uint8(symbol)
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, fmt.Errorf("zstd: invalid FSE distribution")
+	}
+
+	for i := range table.entries {
+		entry := &table.entries[i]
+		state := next[entry.symbol]
+		next[entry.symbol]++
+		entry.nbBits = uint8(tableLog - (bits.Len(uint(state)) - 1))
+		entry.newState = uint16((state << entry.nbBits) - size)
+	}
+	return table, nil
+}
+
+// newZstdRLETable returns a table always decoding the given symbol.
+func newZstdRLETable(symbol byte) *zstdFSETable {
+	return &zstdFSETable{entries: []zstdFSEEntry{{symbol: symbol}}}
+}
+
+type zstdFSEState struct {
+	table *zstdFSETable
+	state int
+}
+
+func (state *zstdFSEState) init(reader *zstdBackwardBits) {
+	state.state = int(reader.read(state.table.tableLog))
+}
+
+func (state *zstdFSEState) symbol() uint8 {
+	return state.table.entries[state.state].symbol
+}
+
+func (state *zstdFSEState) update(reader *zstdBackwardBits) {
+	entry := state.table.entries[state.state]
+	state.state = int(entry.newState) + int(reader.read(int(entry.nbBits)))
+}
+
+type zstdHuffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+type zstdHuffmanTable struct {
+	maxBits int
+	entries []zstdHuffmanEntry
+}
+
+// readZstdHuffmanTable reads a Huffman tree description and returns the
+// decoding table and the number of bytes read.
+func readZstdHuffmanTable(data []byte) (*zstdHuffmanTable, int, error) {
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("zstd: missing Huffman table")
+	}
+
+	weights := make([]uint8, 0, 256)
+	header := int(data[0])
+	size := 0
+
+	if header >= 128 {
+		count := header - 127
+		size = 1 + (count+1)/2
+		if size > len(data) {
+			return nil, 0, fmt.Errorf("zstd: truncated Huffman table")
+		}
+		for i := 0; i < count; i++ {
+			value := data[1+i/2]
+			if i%2 == 0 {
+				value >>= 4
+			}
+			weights = append(weights, value&0x0F)
+		}
+	} else {
+		size = 1 + header
+		if size > len(data) {
+			return nil, 0, fmt.Errorf("zstd: truncated Huffman table")
+		}
+		counts, tableLog, used, err := readZstdFSECounts(data[1:size], 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		table, err := newZstdFSETable(counts, tableLog)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader, err := newZstdBackwardBits(data[1+used : size])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		state1 := zstdFSEState{table: table}
+		state2 := zstdFSEState{table: table}
+		state1.init(&reader)
+		state2.init(&reader)
+		for len(weights) < 254 {
+			weights = append(weights, state1.symbol())
+			state1.update(&reader)
+			if reader.overflow() {
+				weights = append(weights, state2.symbol())
+				break
+			}
+			weights = append(weights, state2.symbol())
+			state2.update(&reader)
+			if reader.overflow() {
+				weights = append(weights, state1.symbol())
+				break
+			}
+		}
+	}
+
+	// The weight of the last symbol is implied
+	total := 0
+	for _, weight := range weights {
+		if weight > zstdMaxHuffmanBits {
+			return nil, 0, fmt.Errorf("zstd: invalid Huffman weight")
+		}
+		if weight > 0 {
+			total += 1 << (weight - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("zstd: invalid Huffman table")
+	}
+	maxBits := bits.Len(uint(total))
+	rest := (1 << uint(maxBits)) - total
+	if maxBits > zstdMaxHuffmanBits || rest&(rest-1) != 0 {
+		return nil, 0, fmt.Errorf("zstd: invalid Huffman table")
+	}
+	weights = append(weights, uint8(bits.Len(uint(rest))))
+
+	table := &zstdHuffmanTable{maxBits: maxBits, entries: make([]zstdHuffmanEntry, 1<<uint(maxBits))}
+	pos := 0
+	for weight := uint8(1); weight <= uint8(maxBits); weight++ {
+		for symbol, symbolWeight := range weights {
+			if symbolWeight != weight {
+				continue // ### continue, other weight ###
+			}
+			entry := zstdHuffmanEntry{uint8(symbol), uint8(maxBits) + 1 - weight}
+			for i := 0; i < 1<<(weight-1); i++ {
+				table.entries[pos] = entry
+				pos++
+			}
+		}
+	}
+	return table, size, nil
+}
+
+// decode decodes count symbols from the given stream.
+func (table *zstdHuffmanTable) decode(out []byte, stream []byte, count int) ([]byte, error) {
+	reader, err := newZstdBackwardBits(stream)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		entry := table.entries[reader.peek(table.maxBits)]
+		reader.bitPos -= int(entry.nbBits)
+		out = append(out, entry.symbol)
+	}
+	if reader.bitPos != 0 {
+		return nil, fmt.Errorf("zstd: corrupted Huffman stream")
+	}
+	return out, nil
+}
+
+// zstdDecoder holds the state shared by all blocks of a frame.
+type zstdDecoder struct {
+	out            []byte
+	frameStart     int
+	maxSize        int
+	huffman        *zstdHuffmanTable
+	literalLengths *zstdFSETable
+	offsets        *zstdFSETable
+	matchLengths   *zstdFSETable
+	repeats        [3]int
+}
+
+// ZstdDecompress decompresses all Zstandard frames in the given data.
+// Skippable frames are ignored. Dictionaries are not supported. If maxSize is
+// greater than 0, an error is returned if the decompressed data would exceed
+// maxSize bytes.
+func ZstdDecompress(data []byte, maxSize int) ([]byte, error) {
+	decoder := zstdDecoder{maxSize: maxSize}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("zstd: truncated frame")
+		}
+		magic := binary.LittleEndian.Uint32(data)
+
+		if magic&zstdSkippableMask == zstdSkippableMagic {
+			if len(data) < 8 || int(binary.LittleEndian.Uint32(data[4:])) > len(data)-8 {
+				return nil, fmt.Errorf("zstd: truncated skippable frame")
+			}
+			data = data[8+binary.LittleEndian.Uint32(data[4:]):]
+			continue // ### continue, skippable frame ###
+		}
+		if magic != ZstdMagic {
+			return nil, fmt.Errorf("zstd: invalid magic number")
+		}
+
+		used, err := decoder.decodeFrame(data[4:])
+		if err != nil {
+			return nil, err
+		}
+		data = data[4+used:]
+	}
+	return decoder.out, nil
+}
+
+// decodeFrame decodes a single frame following the magic number and returns
+// the number of bytes read.
+func (decoder *zstdDecoder) decodeFrame(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("zstd: truncated frame header")
+	}
+	descriptor := data[0]
+	contentSizeFlag := descriptor >> 6
+	singleSegment := descriptor&0x20 != 0
+	hasChecksum := descriptor&0x04 != 0
+	dictionaryIDSize := []int{0, 1, 2, 4}[descriptor&0x03]
+
+	if descriptor&0x08 != 0 {
+		return 0, fmt.Errorf("zstd: reserved bit set in frame header")
+	}
+
+	contentSizeSize := []int{0, 2, 4, 8}[contentSizeFlag]
+	if contentSizeFlag == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	pos := 1
+	if !singleSegment {
+		pos++ // window descriptor
+	}
+
+	if len(data) < pos+dictionaryIDSize+contentSizeSize {
+		return 0, fmt.Errorf("zstd: truncated frame header")
+	}
+	for i := 0; i < dictionaryIDSize; i++ {
+		if data[pos+i] != 0 {
+			return 0, fmt.Errorf("zstd: dictionaries are not supported")
+		}
+	}
+	pos += dictionaryIDSize + contentSizeSize
+
+	decoder.frameStart = len(decoder.out)
+	decoder.huffman = nil
+	decoder.literalLengths, decoder.offsets, decoder.matchLengths = nil, nil, nil
+	decoder.repeats = [3]int{1, 4, 8}
+
+	for {
+		if len(data) < pos+3 {
+			return 0, fmt.Errorf("zstd: truncated block header")
+		}
+		header := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		pos += 3
+
+		last := header&1 != 0
+		blockSize := header >> 3
+		blockType := (header >> 1) & 0x03
+
+		if blockType == 1 {
+			if len(data) < pos+1 {
+				return 0, fmt.Errorf("zstd: truncated block")
+			}
+			if err := decoder.grow(blockSize); err != nil {
+				return 0, err
+			}
+			for i := 0; i < blockSize; i++ {
+				decoder.out = append(decoder.out, data[pos])
+			}
+			pos++
+		} else {
+			if blockSize > zstdMaxBlockSize || len(data) < pos+blockSize {
+				return 0, fmt.Errorf("zstd: truncated block")
+			}
+			switch blockType {
+			case 0:
+				if err := decoder.grow(blockSize); err != nil {
+					return 0, err
+				}
+				decoder.out = append(decoder.out, data[pos:pos+blockSize]...)
+			case 2:
+				if err := decoder.decodeBlock(data[pos : pos+blockSize]); err != nil {
+					return 0, err
+				}
+			default:
+				return 0, fmt.Errorf("zstd: reserved block type")
+			}
+			pos += blockSize
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if hasChecksum {
+		if len(data) < pos+4 {
+			return 0, fmt.Errorf("zstd: truncated checksum")
+		}
+		if uint32(zstdXXHash64(decoder.out[decoder.frameStart:], 0)) != binary.LittleEndian.Uint32(data[pos:]) {
+			return 0, fmt.Errorf("zstd: checksum mismatch")
+		}
+		pos += 4
+	}
+	return pos, nil
+}
+
+// grow returns an error if adding size bytes exceeds the maximum size.
+func (decoder *zstdDecoder) grow(size int) error {
+	if decoder.maxSize > 0 && len(decoder.out)+size > decoder.maxSize {
+		return fmt.Errorf("zstd: decompressed data exceeds %d bytes", decoder.maxSize)
+	}
+	return nil
+}
+
+// decodeLiterals decodes the literals section of a compressed block and
+// returns the literals and the number of bytes read.
+func (decoder *zstdDecoder) decodeLiterals(data []byte) ([]byte, int, error) {
+	if len(data) < 1 {
+		return nil, 0, fmt.Errorf("zstd: truncated literals")
+	}
+	literalsType := data[0] & 0x03
+	sizeFormat := (data[0] >> 2) & 0x03
+
+	if literalsType < 2 {
+		size, headerSize := 0, 0
+		switch sizeFormat {
+		case 0, 2:
+			size, headerSize = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return nil, 0, fmt.Errorf("zstd: truncated literals")
+			}
+			size, headerSize = int(data[0]>>4)|int(data[1])<<4, 2
+		case 3:
+			if len(data) < 3 {
+				return nil, 0, fmt.Errorf("zstd: truncated literals")
+			}
+			size, headerSize = int(data[0]>>4)|int(data[1])<<4|int(data[2])<<12, 3
+		}
+		if size > zstdMaxBlockSize {
+			return nil, 0, fmt.Errorf("zstd: literals too large")
+		}
+
+		if literalsType == 0 {
+			if len(data) < headerSize+size {
+				return nil, 0, fmt.Errorf("zstd: truncated literals")
+			}
+			return data[headerSize : headerSize+size], headerSize + size, nil
+		}
+		if len(data) < headerSize+1 {
+			return nil, 0, fmt.Errorf("zstd: truncated literals")
+		}
+		literals := make([]byte, size)
+		for i := range literals {
+			literals[i] = data[headerSize]
+		}
+		return literals, headerSize + 1, nil
+	}
+
+	// Huffman compressed literals
+	headerSize, sizeBits, streams := 3, 10, 4
+	switch sizeFormat {
+	case 0:
+		streams = 1
+	case 2:
+		headerSize, sizeBits = 4, 14
+	case 3:
+		headerSize, sizeBits = 5, 18
+	}
+	if len(data) < headerSize {
+		return nil, 0, fmt.Errorf("zstd: truncated literals")
+	}
+	header := uint64(0)
+	for i := 0; i < headerSize; i++ {
+		header |= uint64(data[i]) << uint(8*i)
+	}
+	mask := uint64(1)<<uint(sizeBits) - 1
+	regenerated := int((header >> 4) & mask)
+	compressed := int((header >> uint(4+sizeBits)) & mask)
+	if regenerated > zstdMaxBlockSize || len(data) < headerSize+compressed {
+		return nil, 0, fmt.Errorf("zstd: truncated literals")
+	}
+
+	payload := data[headerSize : headerSize+compressed]
+	if literalsType == 2 {
+		table, used, err := readZstdHuffmanTable(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		decoder.huffman = table
+		payload = payload[used:]
+	} else if decoder.huffman == nil {
+		return nil, 0, fmt.Errorf("zstd: missing Huffman table")
+	}
+
+	literals := make([]byte, 0, regenerated)
+	var err error
+	if streams == 1 {
+		literals, err = decoder.huffman.decode(literals, payload, regenerated)
+	} else {
+		if len(payload) < 6 {
+			return nil, 0, fmt.Errorf("zstd: truncated literals")
+		}
+		sizes := [4]int{
+			int(binary.LittleEndian.Uint16(payload[0:])),
+			int(binary.LittleEndian.Uint16(payload[2:])),
+			int(binary.LittleEndian.Uint16(payload[4:])),
+		}
+		sizes[3] = len(payload) - 6 - sizes[0] - sizes[1] - sizes[2]
+		if sizes[3] < 0 {
+			return nil, 0, fmt.Errorf("zstd: invalid literals jump table")
+		}
+
+		segment := (regenerated + 3) / 4
+		start := 6
+		for i, size := range sizes {
+			count := segment
+			if i == 3 {
+				count = regenerated - 3*segment
+			}
+			if count < 0 {
+				return nil, 0, fmt.Errorf("zstd: invalid literals size")
+			}
+			if literals, err = decoder.huffman.decode(literals, payload[start:start+size], count); err != nil {
+				break
+			}
+			start += size
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return literals, headerSize + compressed, nil
+}
+
+// readSequenceTable reads the decoding table for one of the sequence symbol
+// types and returns the number of bytes read.
+func readZstdSequenceTable(mode byte, data []byte, previous *zstdFSETable, defaults []int16, defaultLog int, maxSymbol int, maxLog int) (*zstdFSETable, int, error) {
+	switch mode {
+	case 0:
+		table, err := newZstdFSETable(defaults, defaultLog)
+		return table, 0, err
+	case 1:
+		if len(data) < 1 {
+			return nil, 0, fmt.Errorf("zstd: truncated sequences")
+		}
+		if int(data[0]) > maxSymbol {
+			return nil, 0, fmt.Errorf("zstd: invalid RLE symbol")
+		}
+		return newZstdRLETable(data[0]), 1, nil
+	case 2:
+		counts, tableLog, used, err := readZstdFSECounts(data, maxSymbol, maxLog)
+		if err != nil {
+			return nil, 0, err
+		}
+		table, err := newZstdFSETable(counts, tableLog)
+		return table, used, err
+	default:
+		if previous == nil {
+			return nil, 0, fmt.Errorf("zstd: missing sequence table")
+		}
+		return previous, 0, nil
+	}
+}
+
+// decodeBlock decodes a compressed block.
+func (decoder *zstdDecoder) decodeBlock(data []byte) error {
+	literals, pos, err := decoder.decodeLiterals(data)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < pos+1 {
+		return fmt.Errorf("zstd: truncated sequences")
+	}
+	count := int(data[pos])
+	switch {
+	case count == 0:
+		pos++
+	case count < 128:
+		pos++
+	case count < 255:
+		if len(data) < pos+2 {
+			return fmt.Errorf("zstd: truncated sequences")
+		}
+		count = (count-128)<<8 + int(data[pos+1])
+		pos += 2
+	default:
+		if len(data) < pos+3 {
+			return fmt.Errorf("zstd: truncated sequences")
+		}
+		count = int(data[pos+1]) + int(data[pos+2])<<8 + 0x7F00
+		pos += 3
+	}
+
+	if count == 0 {
+		if err := decoder.grow(len(literals)); err != nil {
+			return err
+		}
+		decoder.out = append(decoder.out, literals...)
+		return nil // ### return, literals only ###
+	}
+
+	if len(data) < pos+1 {
+		return fmt.Errorf("zstd: truncated sequences")
+	}
+	modes := data[pos]
+	pos++
+	if modes&0x03 != 0 {
+		return fmt.Errorf("zstd: reserved bits set in sequences header")
+	}
+
+	used := 0
+	if decoder.literalLengths, used, err = readZstdSequenceTable(modes>>6, data[pos:], decoder.literalLengths, zstdLiteralLengthsDefault, 6, 35, 9); err != nil {
+		return err
+	}
+	pos += used
+	if decoder.offsets, used, err = readZstdSequenceTable((modes>>4)&0x03, data[pos:], decoder.offsets, zstdOffsetsDefault, 5, 31, 8); err != nil {
+		return err
+	}
+	pos += used
+	if decoder.matchLengths, used, err = readZstdSequenceTable((modes>>2)&0x03, data[pos:], decoder.matchLengths, zstdMatchLengthsDefault, 6, 52, 9); err != nil {
+		return err
+	}
+	pos += used
+
+	reader, err := newZstdBackwardBits(data[pos:])
+	if err != nil {
+		return err
+	}
+	literalLength := zstdFSEState{table: decoder.literalLengths}
+	offset := zstdFSEState{table: decoder.offsets}
+	matchLength := zstdFSEState{table: decoder.matchLengths}
+	literalLength.init(&reader)
+	offset.init(&reader)
+	matchLength.init(&reader)
+
+	for i := 0; i < count; i++ {
+		offsetCode := offset.symbol()
+		matchCode := matchLength.symbol()
+		literalCode := literalLength.symbol()
+		if offsetCode > 31 || int(matchCode) >= len(zstdMatchLengthBase) || int(literalCode) >= len(zstdLiteralLengthBase) {
+			return fmt.Errorf("zstd: invalid sequence code")
+		}
+
+		offsetValue := int(1<<offsetCode) + int(reader.read(int(offsetCode)))
+		matchSize := int(zstdMatchLengthBase[matchCode]) + int(reader.read(int(zstdMatchLengthBits[matchCode])))
+		literalSize := int(zstdLiteralLengthBase[literalCode]) + int(reader.read(int(zstdLiteralLengthBits[literalCode])))
+
+		if i < count-1 {
+			literalLength.update(&reader)
+			matchLength.update(&reader)
+			offset.update(&reader)
+		}
+		if reader.overflow() {
+			return fmt.Errorf("zstd: corrupted sequences")
+		}
+
+		distance, err := decoder.resolveOffset(offsetValue, literalSize)
+		if err != nil {
+			return err
+		}
+		if literalSize > len(literals) {
+			return fmt.Errorf("zstd: literal length exceeds literals")
+		}
+		if err := decoder.grow(literalSize + matchSize); err != nil {
+			return err
+		}
+
+		decoder.out = append(decoder.out, literals[:literalSize]...)
+		literals = literals[literalSize:]
+
+		if distance > len(decoder.out)-decoder.frameStart {
+			return fmt.Errorf("zstd: offset exceeds decoded data")
+		}
+		start := len(decoder.out) - distance
+		for j := 0; j < matchSize; j++ {
+			decoder.out = append(decoder.out, decoder.out[start+j])
+		}
+	}
+
+	if reader.bitPos != 0 {
+		return fmt.Errorf("zstd: corrupted sequences")
+	}
+	if err := decoder.grow(len(literals)); err != nil {
+		return err
+	}
+	decoder.out = append(decoder.out, literals...)
+	return nil
+}
+
+// resolveOffset converts an offset value into a distance and updates the
+// repeated offsets.
+func (decoder *zstdDecoder) resolveOffset(value int, literalSize int) (int, error) {
+	repeats := &decoder.repeats
+	if value > 3 {
+		distance := value - 3
+		repeats[2], repeats[1], repeats[0] = repeats[1], repeats[0], distance
+		return distance, nil
+	}
+
+	if literalSize == 0 {
+		value++
+	}
+	switch value {
+	case 1:
+		return repeats[0], nil
+	case 2:
+		repeats[0], repeats[1] = repeats[1], repeats[0]
+	case 3:
+		repeats[0], repeats[1], repeats[2] = repeats[2], repeats[0], repeats[1]
+	default:
+		distance := repeats[0] - 1
+		if distance <= 0 {
+			return 0, fmt.Errorf("zstd: invalid repeated offset")
+		}
+		repeats[0], repeats[1], repeats[2] = distance, repeats[0], repeats[1]
+	}
+	return repeats[0], nil
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	return bits.RotateLeft64(acc, 31) * xxhPrime1
+}
+
+func xxhMerge(acc, value uint64) uint64 {
+	acc ^= xxhRound(0, value)
+	return acc*xxhPrime1 + xxhPrime4
+}
+
+// zstdXXHash64 calculates the XXH64 hash used for frame checksums.
+func zstdXXHash64(data []byte, seed uint64) uint64 {
+	length := uint64(len(data))
+	hash := uint64(0)
+
+	if len(data) >= 32 {
+		v1 := seed + xxhPrime1 + xxhPrime2
+		v2 := seed + xxhPrime2
+		v3 := seed
+		v4 := seed - xxhPrime1
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(data[0:]))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(data[24:]))
+		}
+		hash = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		hash = xxhMerge(hash, v1)
+		hash = xxhMerge(hash, v2)
+		hash = xxhMerge(hash, v3)
+		hash = xxhMerge(hash, v4)
+	} else {
+		hash = seed + xxhPrime5
+	}
+
+	hash += length
+	for ; len(data) >= 8; data = data[8:] {
+		hash ^= xxhRound(0, binary.LittleEndian.Uint64(data))
+		hash = bits.RotateLeft64(hash, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(data) >= 4 {
+		hash ^= uint64(binary.LittleEndian.Uint32(data)) * xxhPrime1
+		hash = bits.RotateLeft64(hash, 23)*xxhPrime2 + xxhPrime3
+		data = data[4:]
+	}
+	for _, char := range data {
+		hash ^= uint64(char) * xxhPrime5
+		hash = bits.RotateLeft64(hash, 11) * xxhPrime1
+	}
+
+	hash ^= hash >> 33
+	hash *= xxhPrime2
+	hash ^= hash >> 29
+	hash *= xxhPrime3
+	hash ^= hash >> 32
+	return hash
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestZstdDecompress(t *testing.T) {
+	expect := NewExpect(t)
+
+	// zstd -3 --check
+	data, _ := hex.DecodeString("28b52ffd241d8d00005868656c6c6f20776f726c640100f14a11d75f93d4")
+	decoded, err := ZstdDecompress(data, 0)
+	expect.NoError(err)
+	expect.Equal("hello hello hello hello world", string(decoded))
+
+	// Checksum mismatch
+	data[len(data)-1] ^= 0xFF
+	_, err = ZstdDecompress(data, 0)
+	expect.NotNil(err)
+
+	// zstd -19 --check, using Huffman coded literals and FSE coded sequences
+	lines := []string{}
+	for i := 0; i < 40; i++ {
+		level := []string{"info", "warn", "debug"}[i*i%7%3]
+		lines = append(lines, fmt.Sprintf(`{"level":"%s","msg":"request %d served"}`, level, i))
+	}
+	data, _ = hex.DecodeString("28b52ffd64b905fd0400f2861618706f0e5239b9696ebb1eaaaae5d444842449e475d5fd3301f1c3e1bb" +
+		"7bfbaff7d9e3009f3a6d7a55b5328d36f473f6d5668e037cae3d998c3dd40d5454c095c752d046010ba468a767a12432899814d2411a" +
+		"25895c96da25ad2ba831705ed8fabf0140275ad00111ec30842d422338c23f3fd6a4801d24a7c80c19e03e6dfdde405c744d2fe8eed6" +
+		"fa2611382baeb136a0a5bb06a1a979356ba801c8f74ce2")
+	decoded, err = ZstdDecompress(data, 0)
+	expect.NoError(err)
+	expect.Equal(strings.Join(lines, "\n"), string(decoded))
+
+	// Size limit
+	_, err = ZstdDecompress(data, 1024)
+	expect.NotNil(err)
+
+	// Truncated frames must not panic
+	for i := 4; i < len(data); i += 7 {
+		_, err = ZstdDecompress(data[:i], 0)
+		expect.NotNil(err)
+	}
+}
+
+func TestZstdFrames(t *testing.T) {
+	expect := NewExpect(t)
+
+	// Skippable frame followed by a frame with a raw and an RLE block
+	data := []byte("\x50\x2A\x4D\x18\x02\x00\x00\x00ab" +
+		"\x28\xB5\x2F\xFD\x00\x00" +
+		"\x20\x00\x00test" +
+		"\x1B\x00\x00!")
+	decoded, err := ZstdDecompress(data, 0)
+	expect.NoError(err)
+	expect.Equal("test!!!", string(decoded))
+
+	_, err = ZstdDecompress([]byte("not zstd"), 0)
+	expect.NotNil(err)
+}
+
+func TestZstdWriter(t *testing.T) {
+	expect := NewExpect(t)
+
+	logs := bytes.Buffer{}
+	for i := 0; logs.Len() < 300000; i++ {
+		fmt.Fprintf(&logs, `{"level":"info","msg":"request %d served"}`+"\n", i)
+	}
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, data := range [][]byte{{}, []byte("short"), logs.Bytes(), random} {
+		buffer := bytes.Buffer{}
+		writer := NewZstdWriter(&buffer)
+		_, err := writer.Write(data)
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+
+		decoded, err := ZstdDecompress(buffer.Bytes(), 0)
+		expect.NoError(err)
+		expect.True(bytes.Equal(data, decoded))
+	}
+}
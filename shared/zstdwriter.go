@@ -0,0 +1,334 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+const (
+	zstdHashLog      = 14
+	zstdMinMatch     = 4
+	zstdWindowLog    = 17 // equals zstdMaxBlockSize
+	zstdRepeatOffset = 3  // offset values up to 3 denote repeated offsets
+)
+
+// zstdFSESymbol holds the values required to encode a symbol with FSE.
+type zstdFSESymbol struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// zstdFSEEncoder encodes symbols using a normalized distribution.
+type zstdFSEEncoder struct {
+	tableLog   int
+	stateTable []uint16
+	symbols    []zstdFSESymbol
+}
+
+// Encoders for the predefined distributions. Only these are used for
+// compression, so no table descriptions have to be written.
+var (
+	zstdLiteralLengthEncoder = newZstdFSEEncoder(zstdLiteralLengthsDefault, 6)
+	zstdMatchLengthEncoder   = newZstdFSEEncoder(zstdMatchLengthsDefault, 6)
+	zstdOffsetEncoder        = newZstdFSEEncoder(zstdOffsetsDefault, 5)
+)
+
+// newZstdFSEEncoder builds an encoding table from normalized counts. Symbols
+// are spread exactly like the decoding table built by newZstdFSETable.
+func newZstdFSEEncoder(counts []int16, tableLog int) *zstdFSEEncoder {
+	decoding, err := newZstdFSETable(counts, tableLog)
+	if err != nil {
+		panic(err)
+	}
+
+	size := 1 << uint(tableLog)
+	encoder := &zstdFSEEncoder{
+		tableLog:   tableLog,
+		stateTable: make([]uint16, size),
+		symbols:    make([]zstdFSESymbol, len(counts)),
+	}
+
+	next := make([]int, len(counts))
+	total := 0
+	for symbol, count := range counts {
+		next[symbol] = total
+		switch {
+		case count == -1 || count == 1:
+			encoder.symbols[symbol] = zstdFSESymbol{
+				deltaNbBits:    uint32(tableLog<<16) - uint32(size),
+				deltaFindState: int32(total - 1),
+			}
+			total++
+		case count > 1:
+			maxBitsOut := tableLog - (bits.Len32(uint32(count-1)) - 1)
+			encoder.symbols[symbol] = zstdFSESymbol{
+				deltaNbBits:    uint32(maxBitsOut<<16) - uint32(int(count)<<uint(maxBitsOut)),
+				deltaFindState: int32(total - int(count)),
+			}
+			total += int(count)
+		}
+	}
+
+	for position, entry := range decoding.entries {
+		encoder.stateTable[next[entry.symbol]] = uint16(size + position)
+		next[entry.symbol]++
+	}
+	return encoder
+}
+
+// init returns the initial state for the given symbol.
+func (encoder *zstdFSEEncoder) init(symbol uint8) uint32 {
+	transform := encoder.symbols[symbol]
+	nbBitsOut := (transform.deltaNbBits + (1 << 15)) >> 16
+	value := (nbBitsOut << 16) - transform.deltaNbBits
+	return uint32(encoder.stateTable[int32(value>>nbBitsOut)+transform.deltaFindState])
+}
+
+// encode writes the bits of the given state and returns the state for the
+// given symbol.
+func (encoder *zstdFSEEncoder) encode(writer *zstdBitWriter, state uint32, symbol uint8) uint32 {
+	transform := encoder.symbols[symbol]
+	nbBitsOut := (state + transform.deltaNbBits) >> 16
+	writer.add(uint64(state), uint(nbBitsOut))
+	return uint32(encoder.stateTable[int32(state>>nbBitsOut)+transform.deltaFindState])
+}
+
+// flush writes the final state.
+func (encoder *zstdFSEEncoder) flush(writer *zstdBitWriter, state uint32) {
+	writer.add(uint64(state), uint(encoder.tableLog))
+}
+
+// zstdBitWriter writes bits least significant bit first so that they can be
+// read backwards by zstdBackwardBits.
+type zstdBitWriter struct {
+	data      []byte
+	container uint64
+	count     uint
+}
+
+func (writer *zstdBitWriter) add(value uint64, count uint) {
+	writer.container |= (value & (1<<count - 1)) << writer.count
+	writer.count += count
+	for writer.count >= 8 {
+		writer.data = append(writer.data, byte(writer.container))
+		writer.container >>= 8
+		writer.count -= 8
+	}
+}
+
+// close adds the end mark and writes the remaining bits.
+func (writer *zstdBitWriter) close() []byte {
+	writer.add(1, 1)
+	if writer.count > 0 {
+		writer.data = append(writer.data, byte(writer.container))
+	}
+	return writer.data
+}
+
+// zstdSequence is a run of literals followed by a match.
+type zstdSequence struct {
+	literals uint32
+	match    uint32
+	offset   uint32
+}
+
+// zstdLengthCode returns the code of the given literal or match length.
+func zstdLengthCode(value uint32, base []uint32) uint8 {
+	return uint8(sort.Search(len(base), func(i int) bool { return base[i] > value }) - 1)
+}
+
+// zstdWriter compresses data to a Zstandard frame.
+type zstdWriter struct {
+	writer  io.Writer
+	buffer  []byte
+	table   []int32
+	started bool
+	err     error
+}
+
+// NewZstdWriter returns a writer compressing all data written to it to a
+// single Zstandard frame. Data is compressed in blocks of 128 KB using the
+// predefined FSE distributions of RFC 8878 for sequences. Literals are stored
+// uncompressed. The frame is completed by calling Close.
+func NewZstdWriter(writer io.Writer) io.WriteCloser {
+	return &zstdWriter{
+		writer: writer,
+		buffer: make([]byte, 0, zstdMaxBlockSize),
+		table:  make([]int32, 1<<zstdHashLog),
+	}
+}
+
+// Write compresses all full blocks and buffers the remaining data.
+func (writer *zstdWriter) Write(data []byte) (int, error) {
+	written := 0
+	for writer.err == nil && len(data) > 0 {
+		if len(writer.buffer) == zstdMaxBlockSize {
+			writer.writeBlock(false)
+		}
+		count := copy(writer.buffer[len(writer.buffer):zstdMaxBlockSize], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+count]
+		data = data[count:]
+		written += count
+	}
+	return written, writer.err
+}
+
+// Close writes the last block. The underlying writer is not closed.
+func (writer *zstdWriter) Close() error {
+	if writer.err == nil {
+		writer.writeBlock(true)
+	}
+	return writer.err
+}
+
+// writeBlock compresses the buffered data. The frame header is written
+// before the first block.
+func (writer *zstdWriter) writeBlock(last bool) {
+	out := make([]byte, 0, len(writer.buffer)+16)
+	if !writer.started {
+		out = append(out, 0, 0, 0, 0, 0, (zstdWindowLog-10)<<3)
+		binary.LittleEndian.PutUint32(out, ZstdMagic)
+		writer.started = true
+	}
+
+	lastFlag := 0
+	if last {
+		lastFlag = 1
+	}
+	block := writer.compressBlock(writer.buffer)
+	if block == nil {
+		header := lastFlag | len(writer.buffer)<<3
+		out = append(out, byte(header), byte(header>>8), byte(header>>16))
+		out = append(out, writer.buffer...)
+	} else {
+		header := lastFlag | 2<<1 | len(block)<<3
+		out = append(out, byte(header), byte(header>>8), byte(header>>16))
+		out = append(out, block...)
+	}
+
+	writer.buffer = writer.buffer[:0]
+	_, writer.err = writer.writer.Write(out)
+}
+
+// compressBlock returns the content of a compressed block or nil if the data
+// cannot be compressed.
+func (writer *zstdWriter) compressBlock(data []byte) []byte {
+	for i := range writer.table {
+		writer.table[i] = 0
+	}
+
+	literals := make([]byte, 0, len(data))
+	sequences := []zstdSequence{}
+	anchor := 0
+
+	for pos := 0; pos+zstdMinMatch <= len(data); {
+		value := binary.LittleEndian.Uint32(data[pos:])
+		hash := (value * 2654435761) >> (32 - zstdHashLog)
+		candidate := int(writer.table[hash]) - 1
+		writer.table[hash] = int32(pos + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(data[candidate:]) != value {
+			pos += 1 + (pos-anchor)>>6 // skip faster through incompressible data
+			continue
+		}
+
+		length := zstdMinMatch
+		for pos+length < len(data) && data[candidate+length] == data[pos+length] {
+			length++
+		}
+		sequences = append(sequences, zstdSequence{
+			literals: uint32(pos - anchor),
+			match:    uint32(length),
+			offset:   uint32(pos - candidate),
+		})
+		literals = append(literals, data[anchor:pos]...)
+		pos += length
+		anchor = pos
+	}
+	literals = append(literals, data[anchor:]...)
+
+	block := make([]byte, 0, len(data))
+	switch size := len(literals); {
+	case size < 32:
+		block = append(block, byte(size<<3))
+	case size < 4096:
+		block = append(block, byte(1<<2|size<<4), byte(size>>4))
+	default:
+		block = append(block, byte(3<<2|size<<4), byte(size>>4), byte(size>>12))
+	}
+	block = append(block, literals...)
+
+	switch count := len(sequences); {
+	case count < 128:
+		block = append(block, byte(count))
+	case count < 0x7F00:
+		block = append(block, byte(count>>8+128), byte(count))
+	default:
+		block = append(block, 0xFF, byte(count-0x7F00), byte((count-0x7F00)>>8))
+	}
+	if len(sequences) > 0 {
+		block = append(block, 0) // predefined distributions
+		block = append(block, encodeZstdSequences(sequences)...)
+	}
+
+	if len(block) >= len(data) {
+		return nil // ### return, not compressible ###
+	}
+	return block
+}
+
+// encodeZstdSequences writes the sequences in reverse order so that they
+// can be read from the end of the stream.
+func encodeZstdSequences(sequences []zstdSequence) []byte {
+	count := len(sequences)
+	literalCodes := make([]uint8, count)
+	matchCodes := make([]uint8, count)
+	offsetCodes := make([]uint8, count)
+	for i, sequence := range sequences {
+		literalCodes[i] = zstdLengthCode(sequence.literals, zstdLiteralLengthBase)
+		matchCodes[i] = zstdLengthCode(sequence.match, zstdMatchLengthBase)
+		offsetCodes[i] = uint8(bits.Len32(sequence.offset+zstdRepeatOffset) - 1)
+	}
+
+	writer := &zstdBitWriter{data: make([]byte, 0, count*4)}
+	addExtraBits := func(i int) {
+		literalCode, matchCode, offsetCode := literalCodes[i], matchCodes[i], offsetCodes[i]
+		writer.add(uint64(sequences[i].literals-zstdLiteralLengthBase[literalCode]), uint(zstdLiteralLengthBits[literalCode]))
+		writer.add(uint64(sequences[i].match-zstdMatchLengthBase[matchCode]), uint(zstdMatchLengthBits[matchCode]))
+		writer.add(uint64(sequences[i].offset+zstdRepeatOffset), uint(offsetCode))
+	}
+
+	last := count - 1
+	matchState := zstdMatchLengthEncoder.init(matchCodes[last])
+	offsetState := zstdOffsetEncoder.init(offsetCodes[last])
+	literalState := zstdLiteralLengthEncoder.init(literalCodes[last])
+	addExtraBits(last)
+
+	for i := last - 1; i >= 0; i-- {
+		offsetState = zstdOffsetEncoder.encode(writer, offsetState, offsetCodes[i])
+		matchState = zstdMatchLengthEncoder.encode(writer, matchState, matchCodes[i])
+		literalState = zstdLiteralLengthEncoder.encode(writer, literalState, literalCodes[i])
+		addExtraBits(i)
+	}
+
+	zstdMatchLengthEncoder.flush(writer, matchState)
+	zstdOffsetEncoder.flush(writer, offsetState)
+	zstdLiteralLengthEncoder.flush(writer, literalState)
+	return writer.close()
+}
@@ -27,6 +27,12 @@ import (
 //     Stream: "data"
 //	   Formatter: "format.Envelope"
 //     Filter: "filter.All"
+//     RetryBudget: 100
+//     DeadLetterStream: "spool"
+//     FusePolicy: "none"
+//     Priority: 1
+//     Mirror:
+//       - "raw"
 //
 // Messages will be sent to all producers attached to this stream.
 //
@@ -39,6 +45,38 @@ import (
 //
 // Filter defines a filter function that removes or allows certain messages to
 // pass through this stream. By default this is set to filter.All.
+//
+// RetryBudget defines the maximum number of messages per second that may be
+// dropped or retried by the producers of this stream. The budget is shared by
+// all producers attached to this stream. Set to 0 to disable this limit.
+// By default this is set to 0.
+//
+// DeadLetterStream defines the stream messages are sent to if the retry budget
+// is exhausted. If no stream is set these messages are discarded. This stream
+// should not be the same as the stream configured or its retry target.
+// By default this is set to "".
+//
+// FusePolicy defines how this stream reacts to back-pressure from its
+// producers. A producer burns the fuses of its streams if its channel exceeds
+// the FuseHighWatermark or if its endpoint is not reachable. When set to
+// "pause" consumers that support it stop reading new data while the fuse is
+// burned. When set to "block" messages sent to this stream are blocked in
+// addition to that, which also affects consumers that do not support pausing.
+// When set to "none" back-pressure is ignored and messages are handled as
+// defined by the producer's ChannelTimeoutMs. By default this is set to "none".
+//
+// Priority defines the weight of this stream for producers listening to
+// streams of different priority. Each priority is queued separately and
+// queues are read by weighted round robin, so messages of a stream with a
+// priority of 4 are read four times as often as those of a stream with a
+// priority of 1 if the producer is saturated. Streams of lower priority are
+// throttled first. By default this is set to 1.
+//
+// Mirror defines a list of streams a copy of each message is sent to before
+// the message is filtered or formatted by this stream. Each copy is filtered
+// and formatted by the plugin configured for its stream, so e.g. raw data and
+// a trimmed version of the same message can be sent to different producers.
+// Mirrors must not create loops. By default no mirrors are set.
 type Broadcast struct {
 	core.StreamBase
 }
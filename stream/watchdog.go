@@ -0,0 +1,217 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/shared"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchdogMetadataStream is the metadata key storing the name of the silent
+// stream in heartbeat messages.
+const WatchdogMetadataStream = "watchdog_stream"
+
+// Watchdog stream plugin
+// Configuration example
+//
+//   - "stream.Watchdog":
+//     Enable: true
+//     Stream: "data"
+//     Formatter: "format.Envelope"
+//     Filter: "filter.All"
+//     TimeoutSec: 60
+//     HeartbeatMessage: "No data received"
+//     HeartbeatStream: "alerts"
+//     HeartbeatRepeat: true
+//
+// Messages will be sent to all producers attached to this stream. If no
+// message passed this stream for a given time, a heartbeat message is
+// generated. This can be used to detect silent failures of upstream services.
+// Heartbeat messages carry the name of the silent stream as the metadata field
+// "watchdog_stream". Streams are watched while gollum is running, i.e. not
+// when testing a configuration.
+//
+// TimeoutSec defines the number of seconds without messages after which a
+// heartbeat message is sent. By default this is set to 60.
+//
+// HeartbeatMessage defines the payload of the heartbeat message. When left
+// empty a message containing the stream name and the timeout is generated.
+// By default this is set to "".
+//
+// HeartbeatStream defines the stream the heartbeat message is sent to. When
+// left empty the heartbeat is sent to the silent stream itself. Heartbeat
+// messages do not count as activity on the silent stream.
+// By default this is set to "".
+//
+// HeartbeatRepeat can be set to false to send only one heartbeat message per
+// silent period. If set to true a heartbeat is sent every TimeoutSec seconds
+// as long as the stream stays silent. By default this is set to true.
+//
+// This stream defines the same fields as stream.Broadcast.
+type Watchdog struct {
+	core.StreamBase
+	broadcast func(msg core.Message)
+	states    []*watchdogState
+	quit      chan struct{}
+	watchers  *sync.WaitGroup
+}
+
+type watchdogState struct {
+	streamID core.MessageStreamID
+	target   core.MessageStreamID
+	message  []byte
+	timeout  time.Duration
+	repeat   bool
+	lastSeen int64
+	sequence uint64
+}
+
+// watchdogStates is written during configuration only and is read-only
+// afterwards, so no locking is required to access the map itself.
+var watchdogStates = make(map[core.MessageStreamID]*watchdogState)
+
+func init() {
+	shared.RuntimeType.Register(Watchdog{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (stream *Watchdog) Configure(conf core.PluginConfig) error {
+	if err := stream.StreamBase.Configure(conf); err != nil {
+		return err // ### return, base stream error ###
+	}
+
+	timeout := time.Duration(conf.GetInt("TimeoutSec", 60)) * time.Second
+	if timeout <= 0 {
+		return fmt.Errorf("Watchdog: TimeoutSec must be larger than 0")
+	}
+
+	message := conf.GetString("HeartbeatMessage", "")
+	target := conf.GetString("HeartbeatStream", "")
+	repeat := conf.GetBool("HeartbeatRepeat", true)
+
+	// One watchdog per stream. The plugin is created once per stream so all
+	// streams of this config are watched by the first instance.
+	for _, streamName := range conf.Stream {
+		streamID := core.GetStreamID(streamName)
+		if _, exists := watchdogStates[streamID]; exists {
+			continue // ### continue, already watched ###
+		}
+
+		state := &watchdogState{
+			streamID: streamID,
+			target:   streamID,
+			message:  []byte(message),
+			timeout:  timeout,
+			repeat:   repeat,
+			lastSeen: time.Now().UnixNano(),
+		}
+		if target != "" {
+			state.target = core.GetStreamID(target)
+		}
+		if message == "" {
+			state.message = []byte(fmt.Sprintf("No messages on stream %s for %d seconds", streamName, int(timeout/time.Second)))
+		}
+
+		watchdogStates[streamID] = state
+		stream.states = append(stream.states, state)
+	}
+
+	stream.watchers = new(sync.WaitGroup)
+	stream.broadcast = stream.StreamBase.Distribute
+	stream.StreamBase.Distribute = stream.distribute
+	return nil
+}
+
+// distribute marks the message's stream as active and sends the message to
+// all producers.
+func (stream *Watchdog) distribute(msg core.Message) {
+	if _, isHeartbeat := msg.Source.(*watchdogState); !isHeartbeat {
+		if state, isWatched := watchdogStates[msg.StreamID]; isWatched {
+			atomic.StoreInt64(&state.lastSeen, time.Now().UnixNano())
+		}
+	}
+	stream.broadcast(msg)
+}
+
+// Start starts watching the streams of this plugin.
+func (stream *Watchdog) Start() {
+	stream.quit = make(chan struct{})
+	for _, state := range stream.states {
+		atomic.StoreInt64(&state.lastSeen, time.Now().UnixNano())
+		stream.watchers.Add(1)
+		go func(state *watchdogState) {
+			defer stream.watchers.Done()
+			state.watch(stream.quit)
+		}(state)
+	}
+}
+
+// Stop stops watching the streams of this plugin and waits until no more
+// heartbeat messages are sent.
+func (stream *Watchdog) Stop() {
+	if stream.quit != nil {
+		close(stream.quit)
+		stream.watchers.Wait()
+		stream.quit = nil
+	}
+}
+
+func (state *watchdogState) watch(quit <-chan struct{}) {
+	defer shared.RecoverShutdown()
+
+	streamName := core.StreamTypes.GetStreamName(state.streamID)
+	lastHeartbeat := time.Time{}
+
+	// Check at least once per second but never less often than required
+	checkInterval := state.timeout / 4
+	if checkInterval > time.Second {
+		checkInterval = time.Second
+	}
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return // ### return, stopped ###
+		case <-ticker.C:
+		}
+
+		lastSeen := time.Unix(0, atomic.LoadInt64(&state.lastSeen))
+		if time.Since(lastSeen) < state.timeout {
+			lastHeartbeat = time.Time{}
+			continue // ### continue, stream is active ###
+		}
+
+		switch {
+		case lastHeartbeat.IsZero():
+		case !state.repeat, time.Since(lastHeartbeat) < state.timeout:
+			continue // ### continue, already sent ###
+		}
+
+		lastHeartbeat = time.Now()
+		state.sequence++
+
+		msg := core.NewMessage(state, state.message, state.sequence)
+		msg.StreamID = state.target
+		msg.Metadata = core.MessageMetadata{WatchdogMetadataStream: streamName}
+		core.StreamTypes.GetStreamOrFallback(state.target).Enqueue(msg)
+	}
+}
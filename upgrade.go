@@ -0,0 +1,69 @@
+// Copyright 2015 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/shared"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// startUpgradeProcess starts a new gollum process with the same command line
+// as this process. All listening sockets are passed to the new process so
+// that no connections are refused while this process is shutting down.
+// Nothing else is handed over. Files written by producers are opened by both
+// processes until this process has flushed its messages and exited.
+func startUpgradeProcess() error {
+	files, socketEnv := shared.HandoffSockets()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	env := []string{}
+	for _, value := range os.Environ() {
+		if !strings.HasPrefix(value, shared.SocketHandoffEnv+"=") {
+			env = append(env, value)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(env, socketEnv)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	return cmd.Start()
+}
+
+// testUpgradeConfig runs the configuration test of this binary on the
+// configuration file used by this process. An error containing the output of
+// the test is returned if it fails.
+func testUpgradeConfig() error {
+	args := []string{"-tc", *flagConfigFile}
+	if *flagPlugins != "" {
+		args = append(args, "-pl", *flagPlugins)
+	}
+
+	output, err := exec.Command(os.Args[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Configuration test failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}